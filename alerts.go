@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alert rule types
+const (
+	alertLimitExceeded    = "limitExceeded"
+	alertHeartbeatMissing = "heartbeatMissing"
+	alertWriteRejected    = "writeRejected"
+)
+
+// maxAlerts is the number of alerts kept in memory
+const maxAlerts = 1000
+
+// AlertsConfig configures the alerting engine
+type AlertsConfig struct {
+	// Disabled turns off the alerting engine
+	Disabled bool `json:"disabled,omitempty"`
+	// IntervalMs is the evaluation interval of the rules, defaults to 1000
+	IntervalMs int `json:"intervalMs,omitempty"`
+	// Rules replaces the default rules if set
+	Rules []AlertRule `json:"rules,omitempty"`
+	// Webhooks receive a JSON POST for every fired and resolved alert of rules with notify
+	Webhooks []string `json:"webhooks,omitempty"`
+	// MQTT publishes fired and resolved alerts of rules with notify
+	MQTT *MQTTConfig `json:"mqtt,omitempty"`
+}
+
+// AlertRule describes a single alert condition
+type AlertRule struct {
+	Name string `json:"name"`
+	// Type is limitExceeded, heartbeatMissing or writeRejected
+	Type string `json:"type"`
+	// Usecase is lpc or lpp for limitExceeded and heartbeatMissing
+	Usecase string `json:"usecase,omitempty"`
+	// ThresholdPercent is the allowed excess over the active limit (limitExceeded)
+	ThresholdPercent float64 `json:"thresholdPercent,omitempty"`
+	// ToleranceWatts is an absolute allowed excess added to the percentage (limitExceeded)
+	ToleranceWatts float64 `json:"toleranceWatts,omitempty"`
+	// ReactionSeconds is the time the DUT gets to follow a changed limit (limitExceeded)
+	ReactionSeconds float64 `json:"reactionSeconds,omitempty"`
+	// Source is the measurement compared with the limit: mpc, evcem or mgcp, defaults to
+	// the first one available (limitExceeded)
+	Source string `json:"source,omitempty"`
+	// ForSeconds is the time the condition has to hold before the alert fires
+	ForSeconds int `json:"forSeconds,omitempty"`
+	// IntervalSeconds is the expected heartbeat interval, defaults to 60 (heartbeatMissing)
+	IntervalSeconds int `json:"intervalSeconds,omitempty"`
+	// Intervals is the number of missing heartbeat intervals, defaults to 2 (heartbeatMissing)
+	Intervals int `json:"intervals,omitempty"`
+	// States are the final command states that fire the alert, defaults to rejected (writeRejected)
+	States   []commandState `json:"states,omitempty"`
+	Severity string         `json:"severity,omitempty"`
+	Notify   bool           `json:"notify,omitempty"`
+}
+
+var defaultAlertRules = []AlertRule{
+	{Name: "lpc-limit-exceeded", Type: alertLimitExceeded, Usecase: "lpc", ThresholdPercent: 5, ForSeconds: 60, Severity: severityError, Notify: true},
+	{Name: "lpp-limit-exceeded", Type: alertLimitExceeded, Usecase: "lpp", ThresholdPercent: 5, ForSeconds: 60, Severity: severityError, Notify: true},
+	{Name: "lpc-heartbeat-missing", Type: alertHeartbeatMissing, Usecase: "lpc", Intervals: 2, Severity: severityError, Notify: true},
+	{Name: "lpp-heartbeat-missing", Type: alertHeartbeatMissing, Usecase: "lpp", Intervals: 2, Severity: severityError, Notify: true},
+	{Name: "write-rejected", Type: alertWriteRejected, Severity: severityWarning, Notify: true},
+}
+
+func (c AlertsConfig) rules() []AlertRule {
+	if c.Rules != nil {
+		return c.Rules
+	}
+	return defaultAlertRules
+}
+
+func (c AlertsConfig) interval() time.Duration {
+	if c.IntervalMs <= 0 {
+		return time.Second
+	}
+	return time.Duration(c.IntervalMs) * time.Millisecond
+}
+
+func (r AlertRule) severity() string {
+	if r.Severity == "" {
+		return severityWarning
+	}
+	return r.Severity
+}
+
+func (r AlertRule) heartbeatTimeout() time.Duration {
+	interval, n := r.IntervalSeconds, r.Intervals
+	if interval <= 0 {
+		interval = 60
+	}
+	if n <= 0 {
+		n = 2
+	}
+	return time.Duration(interval*n) * time.Second
+}
+
+// alert states
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+	// alertFired is used for one-shot alerts without a resolve condition
+	alertFired = "fired"
+)
+
+// alert is a fired alert rule for a peer
+type alert struct {
+	ID         uint64                 `json:"id"`
+	Rule       string                 `json:"rule"`
+	Type       string                 `json:"type"`
+	Severity   string                 `json:"severity"`
+	SKI        string                 `json:"ski,omitempty"`
+	State      string                 `json:"state"`
+	Message    string                 `json:"message"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	FiredAt    time.Time              `json:"firedAt"`
+	ResolvedAt *time.Time             `json:"resolvedAt,omitempty"`
+}
+
+// alertCondition tracks a continuous rule condition of a peer
+type alertCondition struct {
+	since  time.Time
+	active *alert
+}
+
+// alertStore keeps fired alerts and the state of all rule conditions
+type alertStore struct {
+	mu         sync.Mutex
+	nextID     uint64
+	alerts     []*alert
+	conditions map[string]*alertCondition
+}
+
+func newAlertStore() *alertStore {
+	return &alertStore{conditions: make(map[string]*alertCondition)}
+}
+
+func (h *hems) alertsConfig() AlertsConfig {
+	if h.config == nil {
+		return AlertsConfig{}
+	}
+	return h.config.Alerts
+}
+
+// runAlerts evaluates the continuous alert rules periodically
+func (h *hems) runAlerts() {
+	cfg := h.alertsConfig()
+	if cfg.Disabled {
+		return
+	}
+	ticker := time.NewTicker(cfg.interval())
+	defer ticker.Stop()
+	for range ticker.C {
+		h.evaluateAlerts(cfg)
+	}
+}
+
+func (h *hems) evaluateAlerts(cfg AlertsConfig) {
+	now := time.Now()
+	for ski, peer := range h.getAllPeers() {
+		for _, rule := range cfg.rules() {
+			var (
+				active bool
+				msg    string
+				data   map[string]interface{}
+			)
+			switch rule.Type {
+			case alertLimitExceeded:
+				active, msg, data = h.limitExceeded(rule, ski, peer, now)
+			case alertHeartbeatMissing:
+				active, msg, data = heartbeatMissing(rule, peer, now)
+			default:
+				continue
+			}
+			h.updateAlertCondition(cfg, rule, ski, active, msg, data, now)
+		}
+	}
+}
+
+func heartbeatMissing(rule AlertRule, peer *peerData, now time.Time) (bool, string, map[string]interface{}) {
+	if !peer.connected {
+		return false, "", nil
+	}
+	var ts *time.Time
+	switch strings.ToLower(rule.Usecase) {
+	case "lpc":
+		ts = peer.usecaseData.LpcHeartbeatTimestamp
+	case "lpp":
+		ts = peer.usecaseData.LppHeartbeatTimestamp
+	}
+	// no heartbeat has been received yet, the usecase is not in use
+	if ts == nil {
+		return false, "", nil
+	}
+	last := *ts
+	since := now.Sub(last)
+	if since <= rule.heartbeatTimeout() {
+		return false, "", nil
+	}
+	msg := fmt.Sprintf("%s: no heartbeat for %s", strings.ToUpper(rule.Usecase), since.Truncate(time.Second))
+	return true, msg, map[string]interface{}{"lastHeartbeat": last, "sinceSeconds": since.Seconds()}
+}
+
+// updateAlertCondition fires an alert once the condition held for the configured time
+// and resolves it when the condition is gone
+func (h *hems) updateAlertCondition(cfg AlertsConfig, rule AlertRule, ski string, active bool, msg string, data map[string]interface{}, now time.Time) {
+	key := rule.Name + "/" + ski
+
+	h.alerts.mu.Lock()
+	cond, ok := h.alerts.conditions[key]
+	if !active {
+		if !ok {
+			h.alerts.mu.Unlock()
+			return
+		}
+		delete(h.alerts.conditions, key)
+		if cond.active == nil {
+			h.alerts.mu.Unlock()
+			return
+		}
+		cond.active.State = alertResolved
+		cond.active.ResolvedAt = &now
+		snap := *cond.active
+		h.alerts.mu.Unlock()
+		h.publishAlert(cfg, rule, snap)
+		return
+	}
+
+	if !ok {
+		cond = &alertCondition{since: now}
+		h.alerts.conditions[key] = cond
+	}
+	if cond.active != nil || now.Sub(cond.since) < time.Duration(rule.ForSeconds)*time.Second {
+		h.alerts.mu.Unlock()
+		return
+	}
+	cond.active = h.addAlert(rule, ski, alertFiring, msg, data, now)
+	snap := *cond.active
+	h.alerts.mu.Unlock()
+	h.publishAlert(cfg, rule, snap)
+}
+
+// addAlert stores a new alert. The caller must hold the alert store mutex.
+func (h *hems) addAlert(rule AlertRule, ski, state, msg string, data map[string]interface{}, now time.Time) *alert {
+	h.alerts.nextID++
+	a := &alert{
+		ID:       h.alerts.nextID,
+		Rule:     rule.Name,
+		Type:     rule.Type,
+		Severity: rule.severity(),
+		SKI:      ski,
+		State:    state,
+		Message:  msg,
+		Data:     data,
+		FiredAt:  now,
+	}
+	h.alerts.alerts = append(h.alerts.alerts, a)
+	if len(h.alerts.alerts) > maxAlerts {
+		h.alerts.alerts = h.alerts.alerts[len(h.alerts.alerts)-maxAlerts:]
+	}
+	return a
+}
+
+// alertCommand fires the writeRejected rules for a finished write command
+func (h *hems) alertCommand(c command) {
+	cfg := h.alertsConfig()
+	if cfg.Disabled {
+		return
+	}
+	for _, rule := range cfg.rules() {
+		if rule.Type != alertWriteRejected {
+			continue
+		}
+		states := rule.States
+		if len(states) == 0 {
+			states = []commandState{commandRejected}
+		}
+		match := false
+		for _, s := range states {
+			if s == c.State {
+				match = true
+			}
+		}
+		if !match {
+			continue
+		}
+
+		msg := fmt.Sprintf("write command %s (%s) %s", c.ID, c.Cmd, c.State)
+		if c.Error != "" {
+			msg += ": " + c.Error
+		}
+		h.alerts.mu.Lock()
+		snap := *h.addAlert(rule, c.ski, alertFired, msg, map[string]interface{}{"command": c.ID, "cmd": c.Cmd}, time.Now())
+		h.alerts.mu.Unlock()
+		h.publishAlert(cfg, rule, snap)
+	}
+}
+
+// publishAlert records the alert on the timeline, broadcasts it and sends the notifications
+func (h *hems) publishAlert(cfg AlertsConfig, rule AlertRule, a alert) {
+	severity := a.Severity
+	if a.State == alertResolved {
+		severity = severityInfo
+		h.Infof("alert %s resolved for %s", a.Rule, a.SKI)
+	} else {
+		h.Errorf("alert %s for %s: %s", a.Rule, a.SKI, a.Message)
+	}
+	// write alerts share the datagrams of their command, value alerts are caused by the last notify
+	ref := h.nearestDatagram(a.SKI)
+	if id, ok := a.Data["command"].(string); ok {
+		if c, found := h.getCommand(id); found {
+			ref = commandDatagramRef(c)
+		}
+	}
+	h.recordCorrelatedEvent("alert", severity, a.SKI, fmt.Sprintf("%s %s: %s", a.Rule, a.State, a.Message), map[string]interface{}{"alert": a.ID}, ref)
+	h.broadcastJSON(map[string]interface{}{
+		"type":  "alert",
+		"ski":   a.SKI,
+		"alert": a,
+	})
+
+	if !rule.Notify {
+		return
+	}
+	for _, target := range cfg.Webhooks {
+		go func(target string) {
+			if err := postWebhook(target, a); err != nil {
+				h.Errorf("alert webhook %s: %v", target, err)
+			}
+		}(target)
+	}
+	if cfg.MQTT != nil && cfg.MQTT.Broker != "" {
+		go func(mqtt MQTTConfig) {
+			topic := mqtt.Topic
+			if topic == "" {
+				topic = "device-tester/alerts"
+			}
+			b, err := json.Marshal(a)
+			if err != nil {
+				return
+			}
+			if err := publishMQTT(mqtt, topic+"/"+a.Rule, b); err != nil {
+				h.Errorf("alert mqtt %s: %v", mqtt.Broker, err)
+			}
+		}(*cfg.MQTT)
+	}
+}
+
+// getAlerts returns the stored alerts, newest first, optionally filtered by state and peer
+func (h *hems) getAlerts(state, ski string) []alert {
+	h.alerts.mu.Lock()
+	defer h.alerts.mu.Unlock()
+
+	out := []alert{}
+	for i := len(h.alerts.alerts) - 1; i >= 0; i-- {
+		a := h.alerts.alerts[i]
+		if (state != "" && a.State != state) || (ski != "" && a.SKI != ski) {
+			continue
+		}
+		out = append(out, *a)
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// AnonymizationConfig configures the pseudonyms of anonymized exports
+type AnonymizationConfig struct {
+	// Secret keys the pseudonyms so they stay the same across restarts and testers sharing
+	// it, without a secret the pseudonyms only stay the same until the tester restarts
+	Secret string `json:"secret,omitempty"`
+}
+
+// minAnonymizedLength is the length below which collected values are not replaced, short
+// values would replace unrelated text
+const minAnonymizedLength = 4
+
+var (
+	anonSKIPattern    = regexp.MustCompile(`(?i)\b[0-9a-f]{40}\b`)
+	anonMACPattern    = regexp.MustCompile(`(?i)\b[0-9a-f]{2}(?:[:-][0-9a-f]{2}){5}\b`)
+	anonDevicePattern = regexp.MustCompile(`d:_[in]:[A-Za-z0-9_.\-]+`)
+	// anonFieldPattern finds JSON fields that carry identifying values, their values are
+	// replaced wherever they occur
+	anonFieldPattern = regexp.MustCompile(`"(serialNumber|serial|identifier|identificationValue|evccId|shipId)"\s*:\s*"([^"\\]+)"`)
+)
+
+// anonFieldKinds are the pseudonym kinds of the identifying JSON fields
+var anonFieldKinds = map[string]string{
+	"serialNumber":        "serial",
+	"serial":              "serial",
+	"identifier":          "id",
+	"identificationValue": "id",
+	"evccId":              "id",
+	"shipId":              "shipid",
+}
+
+// anonymizer replaces serial numbers, SKIs, MAC addresses, EVCC IDs, RFID UIDs and SPINE
+// device addresses in exports with stable pseudonyms, so exports can be shared without
+// identifying the DUT or the EV. The same value always maps to the same pseudonym, the
+// relations within and across exports made with the same key are kept.
+type anonymizer struct {
+	key []byte
+
+	mu sync.Mutex
+	// known are collected identifying values with their pseudonym kind
+	known map[string]string
+}
+
+// newAnonymizationKey returns the random key used when no secret is configured
+func newAnonymizationKey() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}
+
+// newAnonymizer returns an anonymizer that knows the identifying values the tester
+// learned from the DUTs, the EVs and their sessions
+func (h *hems) newAnonymizer() *anonymizer {
+	a := &anonymizer{key: h.anonKey, known: make(map[string]string)}
+	if h.config != nil && h.config.Anonymization.Secret != "" {
+		a.key = []byte(h.config.Anonymization.Secret)
+	}
+
+	h.peersMu.Lock()
+	for _, peer := range h.peers {
+		a.addKnown("serial", peer.serial)
+		a.addKnown("id", peer.identifier)
+		for _, item := range peer.usecaseData.EvccIdentifications {
+			a.addKnown("id", item.Value)
+		}
+	}
+	h.peersMu.Unlock()
+
+	if h.shipIDs != nil {
+		h.shipIDs.mu.Lock()
+		for _, entry := range h.shipIDs.ids {
+			a.addKnown("shipid", entry.ShipID)
+		}
+		h.shipIDs.mu.Unlock()
+	}
+
+	h.sessions.mu.Lock()
+	for _, s := range h.sessions.sessions {
+		for _, id := range s.Identifications {
+			if _, value, ok := strings.Cut(id, ":"); ok {
+				a.addKnown("id", value)
+			}
+		}
+	}
+	h.sessions.mu.Unlock()
+	return a
+}
+
+// requestAnonymizer returns an anonymizer when the request asks for ?anonymize=true, nil otherwise
+func (h *hems) requestAnonymizer(q url.Values) (*anonymizer, error) {
+	v := q.Get("anonymize")
+	if v == "" {
+		return nil, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("anonymize must be true or false")
+	}
+	if !on {
+		return nil, nil
+	}
+	return h.newAnonymizer(), nil
+}
+
+// pseudonym returns the stable replacement of a value, e.g. serial-1f3a9c02
+func (a *anonymizer) pseudonym(kind, value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(kind + ":" + value))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// addKnown adds a value that is replaced wherever it occurs
+func (a *anonymizer) addKnown(kind, value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minAnonymizedLength {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.known[value]; !ok {
+		a.known[value] = kind
+	}
+}
+
+// knownPattern matches the known values, longest first so a value containing another
+// one is replaced as a whole
+func (a *anonymizer) knownPattern() (*regexp.Regexp, map[string]string) {
+	a.mu.Lock()
+	known := make(map[string]string, len(a.known))
+	values := make([]string, 0, len(a.known))
+	for v, kind := range a.known {
+		known[v] = kind
+		values = append(values, v)
+	}
+	a.mu.Unlock()
+	if len(values) == 0 {
+		return nil, known
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	isWord := func(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+	parts := make([]string, len(values))
+	for i, v := range values {
+		p := regexp.QuoteMeta(v)
+		// values only match whole words, a serial like 2024 must not replace part of a date
+		if r := []rune(v); isWord(r[0]) {
+			p = `\b` + p
+		}
+		if r := []rune(v); isWord(r[len(r)-1]) {
+			p += `\b`
+		}
+		parts[i] = p
+	}
+	return regexp.MustCompile(strings.Join(parts, "|")), known
+}
+
+// apply returns b with all identifying values replaced by their pseudonyms. The values of
+// identifying JSON fields in b are learned first, all patterns are replaced in one pass
+// so pseudonyms are never replaced again.
+func (a *anonymizer) apply(b []byte) []byte {
+	if a == nil {
+		return b
+	}
+	for _, m := range anonFieldPattern.FindAllSubmatch(b, -1) {
+		a.addKnown(anonFieldKinds[string(m[1])], string(m[2]))
+	}
+	patterns := []string{anonDevicePattern.String(), anonSKIPattern.String(), anonMACPattern.String()}
+	knownRe, known := a.knownPattern()
+	if knownRe != nil {
+		patterns = append(patterns, knownRe.String())
+	}
+	re := regexp.MustCompile(strings.Join(patterns, "|"))
+	return re.ReplaceAllFunc(b, func(m []byte) []byte {
+		s := string(m)
+		switch {
+		case strings.HasPrefix(s, "d:_"):
+			// keep the address type, only the identifier is replaced
+			prefix := s[:len("d:_i:")]
+			return []byte(prefix + a.pseudonym("device", s[len(prefix):]))
+		case len(s) == 40 && anonSKIPattern.MatchString(s):
+			return []byte(a.pseudonym("ski", strings.ToLower(s)))
+		case known[s] != "":
+			return []byte(a.pseudonym(known[s], s))
+		case anonMACPattern.MatchString(s):
+			return []byte(a.pseudonym("mac", strings.ToLower(strings.ReplaceAll(s, "-", ":"))))
+		}
+		return m
+	})
+}
+
+// applyString is apply for strings such as file names
+func (a *anonymizer) applyString(s string) string {
+	if a == nil {
+		return s
+	}
+	return string(a.apply([]byte(s)))
+}
+
+// anonymizingWriter buffers an export and writes it anonymized on Close, as identifying
+// values can be split across writes
+type anonymizingWriter struct {
+	a   *anonymizer
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (aw *anonymizingWriter) Write(p []byte) (int, error) {
+	return aw.buf.Write(p)
+}
+
+func (aw *anonymizingWriter) Close() error {
+	_, err := aw.w.Write(aw.a.apply(aw.buf.Bytes()))
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// wrap returns a writer that anonymizes everything written to w once it is closed, writes
+// pass through unchanged without an anonymizer
+func (a *anonymizer) wrap(w io.Writer) io.WriteCloser {
+	if a == nil {
+		return nopWriteCloser{w}
+	}
+	return &anonymizingWriter{a: a, w: w}
+}
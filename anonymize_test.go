@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnonymizerKeepsDeviceAddressType(t *testing.T) {
+	a := &anonymizer{key: []byte("test"), known: make(map[string]string)}
+	for _, prefix := range []string{"d:_i:", "d:_n:"} {
+		addr := prefix + "47859_Wallbox-0001"
+		got := string(a.apply([]byte(`{"device":"` + addr + `"}`)))
+		if strings.Contains(got, "Wallbox-0001") {
+			t.Errorf("%s not anonymized: %s", addr, got)
+		}
+		if !strings.Contains(got, `"`+prefix) {
+			t.Errorf("%s lost its address type: %s", addr, got)
+		}
+	}
+}
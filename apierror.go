@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Machine readable codes of API error responses
+const (
+	errCodeInvalidRequest   = "invalidRequest"
+	errCodeInvalidJSON      = "invalidJson"
+	errCodeInvalidValue     = "invalidValue"
+	errCodeSchemaViolation  = "schemaViolation"
+	errCodeUnknownCommand   = "unknownCommand"
+	errCodeInvalidRetry     = "invalidRetryPolicy"
+	errCodeNotFound         = "notFound"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeConflict         = "conflict"
+	errCodeRateLimited      = "rateLimited"
+	errCodeTooLarge         = "requestTooLarge"
+	errCodeUnavailable      = "unavailable"
+	errCodeInternal         = "internal"
+	errCodeWriteRejected    = "writeRejected"
+	errCodeWriteFailed      = "writeFailed"
+	errCodeWriteTimeout     = "writeTimeout"
+	errCodePartialFailure   = "partialWriteFailure"
+	errCodeMethodNotAllowed = "methodNotAllowed"
+)
+
+// apiError is the error envelope of all API endpoints. Error keeps the human readable
+// message in the field clients already read, Code is meant for programmatic handling.
+type apiError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	// Details is the per entity outcome of a write that failed for some entities
+	Details []apiErrorDetail `json:"details,omitempty"`
+	// Fields lists the invalid fields of a rejected payload
+	Fields []apiFieldError `json:"fields,omitempty"`
+}
+
+// apiErrorDetail is the outcome of the write to a single remote entity
+type apiErrorDetail struct {
+	Entity      string       `json:"entity"`
+	MsgCounter  uint64       `json:"msgCounter,omitempty"`
+	State       commandState `json:"state"`
+	Code        string       `json:"code,omitempty"`
+	ErrorNumber *uint        `json:"errorNumber,omitempty"`
+	Description string       `json:"description,omitempty"`
+	// Error is set when the write could not be sent to the entity
+	Error string `json:"error,omitempty"`
+}
+
+// writeAPIError writes the error envelope with the status code
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiError{Error: message, Code: code})
+}
+
+// writeAPIFieldErrors rejects a payload that failed the schema validation
+func writeAPIFieldErrors(w http.ResponseWriter, fields []apiFieldError) {
+	msg := fmt.Sprintf("%s %s", fields[0].Field, fields[0].Error)
+	if len(fields) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(fields)-1)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(apiError{Error: msg, Code: errCodeSchemaViolation, Fields: fields})
+}
+
+// commandErrorCode returns the error code of a final command state, empty for acknowledged
+func commandErrorCode(state commandState) string {
+	switch state {
+	case commandRejected:
+		return errCodeWriteRejected
+	case commandTimedOut:
+		return errCodeWriteTimeout
+	case commandFailed:
+		return errCodeWriteFailed
+	}
+	return ""
+}
+
+// commandErrorDetails returns the per entity outcome of a failed command and whether
+// some of its entities acknowledged the write
+func commandErrorDetails(c command) ([]apiErrorDetail, bool) {
+	details := make([]apiErrorDetail, 0, len(c.Messages))
+	partial := false
+	for _, m := range c.Messages {
+		if m.State == commandAcknowledged {
+			partial = true
+		}
+		details = append(details, apiErrorDetail{
+			Entity:      m.Entity,
+			MsgCounter:  m.MsgCounter,
+			State:       m.State,
+			Code:        commandErrorCode(m.State),
+			ErrorNumber: m.ErrorNumber,
+			Description: m.Description,
+			Error:       m.Error,
+		})
+	}
+	return details, partial
+}
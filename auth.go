@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig configures token based access control for the web API
+type AuthConfig struct {
+	Enabled bool         `json:"enabled"`
+	Users   []UserConfig `json:"users,omitempty"`
+	// OIDC enables the login at an OpenID Connect IdP in addition to the static tokens
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+}
+
+// UserConfig represents a single API user with its access token and role
+type UserConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// role defines the access level of an API user.
+// Higher roles include all permissions of the lower ones.
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// parseRole converts a configured role name into a role
+func parseRole(name string) role {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "viewer":
+		return roleViewer
+	case "operator":
+		return roleOperator
+	case "admin":
+		return roleAdmin
+	}
+	return roleNone
+}
+
+// authUser is the authenticated user of a request
+type authUser struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	role role
+}
+
+// requestToken returns the API token of a request.
+// Browsers cannot set headers on websocket connections, so the token
+// is also accepted as `token` query parameter.
+func requestToken(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); v != "" {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate resolves the user of a request.
+// If authentication is disabled every request is treated as admin.
+func (h *hems) authenticate(r *http.Request) (authUser, bool) {
+	if h.config == nil || !h.config.Auth.Enabled {
+		return authUser{Name: "anonymous", Role: roleAdmin.String(), role: roleAdmin}, true
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		return authUser{}, false
+	}
+	for _, u := range h.config.Auth.Users {
+		if u.Token == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(u.Token), []byte(token)) == 1 {
+			rl := parseRole(u.Role)
+			return authUser{Name: u.Name, Role: rl.String(), role: rl}, rl != roleNone
+		}
+	}
+	if t, ok := h.oidc.lookup(token); ok {
+		return t.user, true
+	}
+	return authUser{}, false
+}
+
+// requireRole wraps a handler and only calls it if the request is
+// authenticated with at least the given role
+func (h *hems) requireRole(min role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := h.authenticate(r)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="device-tester"`)
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, "authentication required")
+			return
+		}
+		if user.role < min {
+			h.Infof("access denied for user %s (%s) to %s %s", user.Name, user.Role, r.Method, r.URL.Path)
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, "role "+min.String()+" required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// redacted returns a copy of the config that is safe to serve to clients
+func (c *Config) redacted() *Config {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	out.Auth.Users = nil
+	if out.Auth.OIDC != nil {
+		oidc := *out.Auth.OIDC
+		oidc.ClientSecret = ""
+		out.Auth.OIDC = &oidc
+	}
+	if out.Alerts.MQTT != nil {
+		mqtt := *out.Alerts.MQTT
+		mqtt.Password = ""
+		out.Alerts.MQTT = &mqtt
+	}
+	if len(out.Alerts.Webhooks) > 0 {
+		// webhook URLs carry their secret in the path or query
+		out.Alerts.Webhooks = make([]string, len(c.Alerts.Webhooks))
+	}
+	out.Anonymization.Secret = ""
+	if len(out.Notifiers) > 0 {
+		out.Notifiers = make([]NotifierConfig, len(c.Notifiers))
+		for i, n := range c.Notifiers {
+			n.WebhookURL, n.BotToken = "", ""
+			if n.SMTP != nil {
+				smtp := *n.SMTP
+				smtp.Password = ""
+				n.SMTP = &smtp
+			}
+			out.Notifiers[i] = n
+		}
+	}
+	if len(out.Tracing.Headers) > 0 {
+		// headers usually carry the collector credentials
+		out.Tracing.Headers = map[string]string{}
+		for k := range c.Tracing.Headers {
+			out.Tracing.Headers[k] = ""
+		}
+	}
+	return &out
+}
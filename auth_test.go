@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newAuthTestHems() *hems {
+	return &hems{config: &Config{Auth: AuthConfig{Enabled: true, Users: []UserConfig{
+		{Name: "viewer", Token: "viewer-token", Role: "viewer"},
+		{Name: "operator", Token: "operator-token", Role: "operator"},
+		{Name: "admin", Token: "admin-token", Role: "admin"},
+	}}}}
+}
+
+func TestRequireRoleAdmin(t *testing.T) {
+	h := newAuthTestHems()
+	handler := h.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"viewer-token", http.StatusForbidden},
+		{"operator-token", http.StatusForbidden},
+		{"admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q: status %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := &Config{}
+	c.Alerts.Webhooks = []string{"https://hooks.example/T000/secret", "https://alerts.example/?token=secret"}
+	c.Notifiers = []NotifierConfig{{WebhookURL: "https://hooks.slack.example/secret"}}
+
+	out := c.redacted()
+	if len(out.Alerts.Webhooks) != 2 {
+		t.Fatalf("webhooks %v, want 2 masked entries", out.Alerts.Webhooks)
+	}
+	for i, u := range out.Alerts.Webhooks {
+		if u != "" {
+			t.Errorf("webhook %d not masked: %q", i, u)
+		}
+	}
+	if out.Notifiers[0].WebhookURL != "" {
+		t.Errorf("notifier webhook not masked: %q", out.Notifiers[0].WebhookURL)
+	}
+	if c.Alerts.Webhooks[0] == "" {
+		t.Error("redacted modified the original config")
+	}
+}
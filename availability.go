@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// maxAvailabilityIntervals is the number of connection intervals kept per SKI
+const maxAvailabilityIntervals = 10000
+
+// availabilityStats are the availability figures of a DUT within a time window. The
+// window starts at the first connection of the DUT at the earliest.
+type availabilityStats struct {
+	SKI                 string    `json:"ski"`
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	Connected           bool      `json:"connected"`
+	ObservedSeconds     float64   `json:"observedSeconds"`
+	ConnectedSeconds    float64   `json:"connectedSeconds"`
+	AvailabilityPercent float64   `json:"availabilityPercent"`
+	Disconnects         int       `json:"disconnects"`
+	// Outages include an outage still open at the end of the window
+	Outages              int     `json:"outages"`
+	OutageSeconds        float64 `json:"outageSeconds"`
+	LongestOutageSeconds float64 `json:"longestOutageSeconds"`
+	MeanOutageSeconds    float64 `json:"meanOutageSeconds"`
+	// MeanTimeBetweenDisconnectsSeconds is the connected time per disconnect, unset
+	// without disconnects
+	MeanTimeBetweenDisconnectsSeconds *float64 `json:"meanTimeBetweenDisconnectsSeconds,omitempty"`
+}
+
+// connectionInterval is a connection of a DUT, End is zero while it is connected
+type connectionInterval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// availabilityTracker records the connection intervals of the DUTs since the tester started
+type availabilityTracker struct {
+	mu        sync.Mutex
+	intervals map[string][]connectionInterval
+}
+
+func newAvailabilityTracker() *availabilityTracker {
+	return &availabilityTracker{intervals: make(map[string][]connectionInterval)}
+}
+
+// availabilityConnected opens a connection interval of a DUT
+func (h *hems) availabilityConnected(ski string) {
+	ski = shiputil.NormalizeSKI(ski)
+	h.availability.mu.Lock()
+	defer h.availability.mu.Unlock()
+	list := h.availability.intervals[ski]
+	if n := len(list); n > 0 && list[n-1].End.IsZero() {
+		return
+	}
+	list = append(list, connectionInterval{Start: time.Now()})
+	if len(list) > maxAvailabilityIntervals {
+		list = list[len(list)-maxAvailabilityIntervals:]
+	}
+	h.availability.intervals[ski] = list
+}
+
+// availabilityDisconnected closes the open connection interval of a DUT
+func (h *hems) availabilityDisconnected(ski string) {
+	ski = shiputil.NormalizeSKI(ski)
+	h.availability.mu.Lock()
+	defer h.availability.mu.Unlock()
+	list := h.availability.intervals[ski]
+	if n := len(list); n > 0 && list[n-1].End.IsZero() {
+		list[n-1].End = time.Now()
+	}
+}
+
+// computeAvailability evaluates the connection intervals of a DUT within [from, to]
+func computeAvailability(ski string, list []connectionInterval, from, to time.Time) availabilityStats {
+	s := availabilityStats{SKI: ski, From: from, To: to}
+	if len(list) == 0 {
+		return s
+	}
+	if from.IsZero() || from.Before(list[0].Start) {
+		s.From = list[0].Start
+	}
+	if !to.After(s.From) {
+		return s
+	}
+	s.ObservedSeconds = to.Sub(s.From).Seconds()
+
+	outage := func(start, end time.Time) {
+		if start.Before(s.From) {
+			start = s.From
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			return
+		}
+		d := end.Sub(start).Seconds()
+		s.Outages++
+		s.OutageSeconds += d
+		if d > s.LongestOutageSeconds {
+			s.LongestOutageSeconds = d
+		}
+	}
+	for i, c := range list {
+		if c.Start.After(to) {
+			break
+		}
+		end := c.End
+		if end.IsZero() || end.After(to) {
+			end = to
+			s.Connected = true
+		}
+		start := c.Start
+		if start.Before(s.From) {
+			start = s.From
+		}
+		if end.After(start) {
+			s.ConnectedSeconds += end.Sub(start).Seconds()
+		}
+		if c.End.IsZero() || c.End.After(to) {
+			break
+		}
+		if !c.End.Before(s.From) {
+			s.Disconnects++
+		}
+		next := to
+		if i+1 < len(list) {
+			next = list[i+1].Start
+		}
+		outage(c.End, next)
+	}
+	s.AvailabilityPercent = s.ConnectedSeconds / s.ObservedSeconds * 100
+	if s.Outages > 0 {
+		s.MeanOutageSeconds = s.OutageSeconds / float64(s.Outages)
+	}
+	if s.Disconnects > 0 {
+		mtbd := s.ConnectedSeconds / float64(s.Disconnects)
+		s.MeanTimeBetweenDisconnectsSeconds = &mtbd
+	}
+	return s
+}
+
+// availabilityOf returns the availability of a DUT within [from, to], false when the DUT
+// was not connected before to
+func (h *hems) availabilityOf(ski string, from, to time.Time) (availabilityStats, bool) {
+	ski = shiputil.NormalizeSKI(ski)
+	h.availability.mu.Lock()
+	list := append([]connectionInterval(nil), h.availability.intervals[ski]...)
+	h.availability.mu.Unlock()
+	if len(list) == 0 || list[0].Start.After(to) {
+		return availabilityStats{}, false
+	}
+	return computeAvailability(ski, list, from, to), true
+}
+
+// availabilitySKIs returns the SKIs with connection intervals
+func (h *hems) availabilitySKIs() []string {
+	h.availability.mu.Lock()
+	defer h.availability.mu.Unlock()
+	skis := make([]string, 0, len(h.availability.intervals))
+	for ski := range h.availability.intervals {
+		skis = append(skis, ski)
+	}
+	return skis
+}
+
+// getAvailability returns the availability of all DUTs since their first connection,
+// optionally for one SKI
+func (h *hems) getAvailability(ski string) []availabilityStats {
+	ski = shiputil.NormalizeSKI(ski)
+	now := time.Now()
+	h.availability.mu.Lock()
+	defer h.availability.mu.Unlock()
+	out := []availabilityStats{}
+	for key, list := range h.availability.intervals {
+		if ski != "" && key != ski {
+			continue
+		}
+		out = append(out, computeAvailability(key, list, time.Time{}, now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SKI < out[j].SKI })
+	return out
+}
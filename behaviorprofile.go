@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// behaviorProfileSteuerbox emulates a German FNN Steuerbox, the energy guard of a
+// controllable consumption device according to §14a EnWG
+const behaviorProfileSteuerbox = "fnn-steuerbox"
+
+// behaviorProfile is a preset of the energy guard behavior of a device in the field
+type behaviorProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// FailsafePowerWatts and FailsafeDurationMinutes are written when the DUT announces LPC
+	FailsafePowerWatts      float64 `json:"failsafePowerWatts"`
+	FailsafeDurationMinutes int64   `json:"failsafeDurationMinutes"`
+	// DimmingPowerWatts is the indefinite consumption limit written while dimming
+	DimmingPowerWatts float64 `json:"dimmingPowerWatts"`
+	// HeartbeatTimeoutSeconds is announced to the DUT instead of the default, the
+	// heartbeat is sent 2 seconds before it ends
+	HeartbeatTimeoutSeconds float64 `json:"heartbeatTimeoutSeconds"`
+}
+
+// behaviorProfiles are the presets selectable via the behaviorProfile config entry
+var behaviorProfiles = map[string]behaviorProfile{
+	behaviorProfileSteuerbox: {
+		Name:                    behaviorProfileSteuerbox,
+		Description:             "FNN Steuerbox, §14a EnWG: 4.2 kW failsafe limit for at least 2 hours, dimming to 4.2 kW, heartbeat every 60 seconds",
+		FailsafePowerWatts:      4200,
+		FailsafeDurationMinutes: 120,
+		DimmingPowerWatts:       4200,
+		HeartbeatTimeoutSeconds: 62,
+	},
+}
+
+// behaviorProfile returns the selected preset, nil if none is configured
+func (c *Config) behaviorProfile() (*behaviorProfile, error) {
+	if c == nil || c.BehaviorProfile == "" {
+		return nil, nil
+	}
+	p, ok := behaviorProfiles[c.BehaviorProfile]
+	if !ok {
+		names := make([]string, 0, len(behaviorProfiles))
+		for name := range behaviorProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown behavior profile %q, available: %v", c.BehaviorProfile, names)
+	}
+	return &p, nil
+}
+
+// localHeartbeatTimeout returns the heartbeat timeout announced to the DUT
+func (h *hems) localHeartbeatTimeout() time.Duration {
+	if p, _ := h.config.behaviorProfile(); p != nil && p.HeartbeatTimeoutSeconds > 0 {
+		return time.Duration(p.HeartbeatTimeoutSeconds * float64(time.Second))
+	}
+	return localHeartbeatTimeout
+}
+
+// behaviorProfileState tracks the SKIs the failsafe values were written to and the
+// dimming state
+type behaviorProfileState struct {
+	mu          sync.Mutex
+	applied     map[string]time.Time
+	dimmed      bool
+	dimmedSince time.Time
+}
+
+// applyBehaviorProfile writes the failsafe values of the profile once the DUT announces
+// LPC, and the dimming limit while dimming is active. It is done once per connection.
+func (h *hems) applyBehaviorProfile(ski string) {
+	p, _ := h.config.behaviorProfile()
+	if p == nil || h.uceglpc == nil || len(remoteEntities(h.uceglpc.RemoteEntitiesScenarios(), ski)) == 0 {
+		return
+	}
+	h.behavior.mu.Lock()
+	if _, ok := h.behavior.applied[ski]; ok {
+		h.behavior.mu.Unlock()
+		return
+	}
+	if h.behavior.applied == nil {
+		h.behavior.applied = make(map[string]time.Time)
+	}
+	h.behavior.applied[ski] = time.Now()
+	dimmed := h.behavior.dimmed
+	h.behavior.mu.Unlock()
+
+	writes := []map[string]interface{}{
+		{"cmd": "writeLPCFailsafeValue", "ski": ski, "failsafePower": p.FailsafePowerWatts},
+		{"cmd": "writeLPCFailsafeDuration", "ski": ski, "durationMinutes": float64(p.FailsafeDurationMinutes)},
+	}
+	if dimmed {
+		writes = append(writes, h.dimmingPayload(p, ski, true))
+	}
+	for _, payload := range writes {
+		if _, err := h.enqueueBehaviorWrite(payload); err != nil {
+			h.Errorf("behavior profile %s: %v", p.Name, err)
+		}
+	}
+	h.recordEvent("behaviorProfile", severityInfo, ski, fmt.Sprintf("%s: failsafe limit %.0f W for %d min written", p.Name, p.FailsafePowerWatts, p.FailsafeDurationMinutes), nil)
+}
+
+// resetBehaviorProfile lets the failsafe values be written again on the next connection
+func (h *hems) resetBehaviorProfile(ski string) {
+	h.behavior.mu.Lock()
+	delete(h.behavior.applied, ski)
+	h.behavior.mu.Unlock()
+}
+
+func (h *hems) dimmingPayload(p *behaviorProfile, ski string, active bool) map[string]interface{} {
+	return map[string]interface{}{"cmd": "writeLPCConsumptionLimit", "ski": ski, "value": p.DimmingPowerWatts, "isActive": active, "durationSeconds": float64(0)}
+}
+
+func (h *hems) enqueueBehaviorWrite(payload map[string]interface{}) (*command, error) {
+	cmd, _ := payload["cmd"].(string)
+	exec, err := h.writeCommandExec(cmd, payload)
+	if err != nil {
+		return nil, err
+	}
+	return h.enqueueCommand(cmd, payload, nil, exec)
+}
+
+// setDimming starts or ends dimming to the limit of the profile, as a Steuerbox does on a
+// control command of the grid operator. The limit is indefinite until dimming ends and is
+// written to the DUTs the profile was applied to, DUTs connecting later get it with the
+// failsafe values.
+func (h *hems) setDimming(active bool, by string) ([]*command, error) {
+	p, err := h.config.behaviorProfile()
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("no behavior profile configured")
+	}
+	if h.uceglpc == nil {
+		return nil, fmt.Errorf("LPC usecase is disabled")
+	}
+	h.behavior.mu.Lock()
+	h.behavior.dimmed = active
+	h.behavior.dimmedSince = time.Now()
+	skis := make([]string, 0, len(h.behavior.applied))
+	for ski := range h.behavior.applied {
+		skis = append(skis, ski)
+	}
+	h.behavior.mu.Unlock()
+	sort.Strings(skis)
+
+	commands := make([]*command, 0, len(skis))
+	ids := make([]string, 0, len(skis))
+	for _, ski := range skis {
+		c, err := h.enqueueBehaviorWrite(h.dimmingPayload(p, ski, active))
+		if err != nil {
+			h.Errorf("behavior profile %s: %v", p.Name, err)
+			continue
+		}
+		commands = append(commands, c)
+		ids = append(ids, c.ID)
+	}
+
+	msg := fmt.Sprintf("%s: dimming to %.0f W started", p.Name, p.DimmingPowerWatts)
+	if !active {
+		msg = p.Name + ": dimming ended"
+	}
+	h.recordEvent("behaviorProfile", severityInfo, "", msg, map[string]interface{}{"by": by, "skis": skis, "commands": ids})
+	h.broadcastJSON(map[string]interface{}{"type": "behaviorProfile", "status": h.behaviorProfileStatus()})
+	return commands, nil
+}
+
+// behaviorProfileStatus returns the active profile, the dimming state and the SKIs the
+// failsafe values were written to in the current connection
+func (h *hems) behaviorProfileStatus() map[string]interface{} {
+	p, err := h.config.behaviorProfile()
+	h.behavior.mu.Lock()
+	defer h.behavior.mu.Unlock()
+	applied := make(map[string]time.Time, len(h.behavior.applied))
+	for ski, t := range h.behavior.applied {
+		applied[ski] = t
+	}
+	status := map[string]interface{}{
+		"profile":     p,
+		"dimmed":      h.behavior.dimmed,
+		"dimmedSince": optionalTime(h.behavior.dimmedSince),
+		"applied":     applied,
+	}
+	if err != nil {
+		status["error"] = err.Error()
+	}
+	available := make([]behaviorProfile, 0, len(behaviorProfiles))
+	for _, bp := range behaviorProfiles {
+		available = append(available, bp)
+	}
+	sort.Slice(available, func(i, j int) bool { return available[i].Name < available[j].Name })
+	status["available"] = available
+	return status
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+// usecaseUpdate is published by the use case handlers after they stored the new data of a peer
+type usecaseUpdate struct {
+	SKI     string
+	Usecase string
+	Event   api.EventType
+	Device  spineapi.DeviceRemoteInterface
+	Entity  spineapi.EntityRemoteInterface
+	Peer    *peerData
+	Time    time.Time
+}
+
+// busSubscriber is a named sink of a topic, the name is used in panic reports
+type busSubscriber[T any] struct {
+	name string
+	fn   func(T)
+}
+
+// busTopic delivers messages of one type to its subscribers, synchronously and in
+// subscription order. A panicking subscriber is reported and does not stop the others.
+type busTopic[T any] struct {
+	name string
+	mu   sync.RWMutex
+	subs []busSubscriber[T]
+}
+
+func (t *busTopic[T]) subscribe(name string, fn func(T)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subs = append(t.subs, busSubscriber[T]{name: name, fn: fn})
+}
+
+func (t *busTopic[T]) publish(msg T, onPanic func(sub string, r interface{})) {
+	t.mu.RLock()
+	subs := t.subs
+	t.mu.RUnlock()
+	for _, s := range subs {
+		func() {
+			defer func() {
+				if r := recover(); r != nil && onPanic != nil {
+					onPanic(s.name, r)
+				}
+			}()
+			s.fn(msg)
+		}()
+	}
+}
+
+// subscribers returns the names of the subscribers
+func (t *busTopic[T]) subscribers() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.subs))
+	for _, s := range t.subs {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// eventBus decouples the producers of tester state from its sinks: use case handlers
+// and the timeline publish, websocket, series, latency and extensions subscribe
+type eventBus struct {
+	usecaseUpdates busTopic[usecaseUpdate]
+	timeline       busTopic[timelineEvent]
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		usecaseUpdates: busTopic[usecaseUpdate]{name: "usecaseUpdates"},
+		timeline:       busTopic[timelineEvent]{name: "timeline"},
+	}
+}
+
+// subscribeBuiltinSinks registers the sinks of the tester itself, extensions subscribe in setupExtensions
+func (h *hems) subscribeBuiltinSinks() {
+	h.bus.usecaseUpdates.subscribe("latency", func(u usecaseUpdate) {
+		h.observeDataUpdate(u.SKI, u.Event)
+	})
+	h.bus.usecaseUpdates.subscribe("series", func(u usecaseUpdate) {
+		h.recordSeries(u.SKI, u.Peer)
+	})
+	// also broadcasts the usecase data of the peer to websocket clients
+	h.bus.usecaseUpdates.subscribe("entities", func(u usecaseUpdate) {
+		h.updateEntitiesFromDevice(u.SKI, u.Device, u.Peer)
+	})
+
+	h.bus.timeline.subscribe("websocket", func(ev timelineEvent) {
+		h.broadcastJSON(map[string]interface{}{
+			"type":  "event",
+			"ski":   ev.SKI,
+			"event": ev,
+		})
+	})
+	h.bus.timeline.subscribe("notifiers", h.notifyTimelineEvent)
+}
+
+// publishUsecaseUpdate hands the result of a use case event to all subscribed sinks
+func (h *hems) publishUsecaseUpdate(ski, usecase string, event api.EventType, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, peer *peerData) {
+	h.bus.usecaseUpdates.publish(usecaseUpdate{
+		SKI:     ski,
+		Usecase: usecase,
+		Event:   event,
+		Device:  device,
+		Entity:  entity,
+		Peer:    peer,
+		Time:    time.Now(),
+	}, h.busPanic(h.bus.usecaseUpdates.name))
+}
+
+// publishTimelineEvent hands a recorded timeline event to all subscribed sinks
+func (h *hems) publishTimelineEvent(ev timelineEvent) {
+	h.bus.timeline.publish(ev, h.busPanic(h.bus.timeline.name))
+}
+
+// busPanic logs a panicking subscriber, it does not record a timeline event as the
+// timeline subscribers may be the ones panicking
+func (h *hems) busPanic(topic string) func(string, interface{}) {
+	return func(sub string, r interface{}) {
+		h.Errorf("event bus: subscriber %s of %s panicked: %v", sub, topic, r)
+	}
+}
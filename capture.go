@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	shipmodel "github.com/enbility/ship-go/model"
+	"github.com/enbility/ship-go/ship"
+	shiputil "github.com/enbility/ship-go/util"
+	"github.com/enbility/spine-go/model"
+)
+
+// maxCapturedDatagrams is the number of SPINE datagrams kept in the capture
+const maxCapturedDatagrams = 5000
+
+// nearestDatagramWindow is the maximum age of a received datagram that is
+// correlated with an event without an exact msgCounter reference
+const nearestDatagramWindow = 2 * time.Second
+
+// Directions of captured datagrams
+const (
+	datagramSent     = "send"
+	datagramReceived = "recv"
+)
+
+// Correlation kinds of events and datagrams
+const (
+	// correlationExact events reference the msgCounter of the datagram they came from
+	correlationExact = "exact"
+	// correlationNearest events reference the last datagram received from the peer before the event
+	correlationNearest = "nearest"
+)
+
+// capturedDatagram is a SPINE datagram sent to or received from a peer
+type capturedDatagram struct {
+	ID                  uint64          `json:"id"`
+	Time                time.Time       `json:"time"`
+	Direction           string          `json:"direction"`
+	SKI                 string          `json:"ski"`
+	MsgCounter          *uint64         `json:"msgCounter,omitempty"`
+	MsgCounterReference *uint64         `json:"msgCounterReference,omitempty"`
+	CmdClassifier       string          `json:"cmdClassifier,omitempty"`
+	Functions           []string        `json:"functions,omitempty"`
+	Datagram            json.RawMessage `json:"datagram,omitempty"`
+}
+
+// datagramRef links an event or write result to a captured datagram
+type datagramRef struct {
+	MsgCounter  *uint64 `json:"msgCounter,omitempty"`
+	DatagramID  *uint64 `json:"datagramId,omitempty"`
+	Correlation string  `json:"correlation,omitempty"`
+}
+
+// datagramCapture keeps the most recent SPINE datagrams of all peers
+type datagramCapture struct {
+	mu        sync.Mutex
+	nextID    uint64
+	datagrams []capturedDatagram
+}
+
+func newDatagramCapture() *datagramCapture {
+	return &datagramCapture{}
+}
+
+// captureDatagramLog captures the SPINE datagrams of the ship-go "Send:" and "Recv:" traces
+func (h *hems) captureDatagramLog(args ...interface{}) {
+	if h.capture == nil || len(args) < 3 {
+		return
+	}
+	prefix, _ := args[0].(string)
+	var direction string
+	switch prefix {
+	case "Send:":
+		direction = datagramSent
+	case "Recv:":
+		direction = datagramReceived
+	default:
+		return
+	}
+	ski, _ := args[1].(string)
+	text, _ := args[2].(string)
+	if !strings.Contains(text, "datagram") {
+		// SHIP handshake and control messages
+		return
+	}
+	dg, err := parseCapturedDatagram(text)
+	if err != nil {
+		h.Debugf("capture %s datagram of %s: %v", direction, ski, err)
+		return
+	}
+	dg.Time = time.Now()
+	dg.Direction = direction
+	dg.SKI = shiputil.NormalizeSKI(ski)
+
+	h.capture.mu.Lock()
+	h.capture.nextID++
+	dg.ID = h.capture.nextID
+	h.capture.datagrams = append(h.capture.datagrams, dg)
+	if len(h.capture.datagrams) > maxCapturedDatagrams {
+		h.capture.datagrams = h.capture.datagrams[len(h.capture.datagrams)-maxCapturedDatagrams:]
+	}
+	h.capture.mu.Unlock()
+
+	h.trackResponseTime(dg)
+	h.countMessage(dg)
+	if direction == datagramReceived {
+		h.validateDatagram(dg, text)
+		h.trackMsgCounter(dg)
+		h.observeRestartDatagram(dg)
+	}
+}
+
+// parseCapturedDatagram decodes a SHIP data message in EEBUS JSON format
+func parseCapturedDatagram(text string) (capturedDatagram, error) {
+	var dg capturedDatagram
+	var data shipmodel.ShipData
+	if err := json.Unmarshal(ship.JsonFromEEBUSJson([]byte(text)), &data); err != nil {
+		return dg, err
+	}
+	var spine model.Datagram
+	if err := json.Unmarshal(data.Data.Payload, &spine); err != nil {
+		return dg, err
+	}
+
+	header := spine.Datagram.Header
+	if header.MsgCounter != nil {
+		n := uint64(*header.MsgCounter)
+		dg.MsgCounter = &n
+	}
+	if header.MsgCounterReference != nil {
+		n := uint64(*header.MsgCounterReference)
+		dg.MsgCounterReference = &n
+	}
+	if header.CmdClassifier != nil {
+		dg.CmdClassifier = string(*header.CmdClassifier)
+	}
+	for _, cmd := range spine.Datagram.Payload.Cmd {
+		if d, err := cmd.Data(); err == nil && d.Function != nil {
+			dg.Functions = append(dg.Functions, string(*d.Function))
+		} else {
+			dg.Functions = append(dg.Functions, cmd.DataName())
+		}
+	}
+	dg.Datagram, _ = json.Marshal(spine)
+	return dg, nil
+}
+
+// datagramFilter selects captured datagrams, empty fields match all datagrams
+type datagramFilter struct {
+	SKI       string
+	Direction string
+	// MsgCounter and Reference match the header fields of the datagram
+	MsgCounter *uint64
+	Reference  *uint64
+	Since      time.Time
+	Limit      int
+}
+
+func (f datagramFilter) match(dg capturedDatagram) bool {
+	if f.SKI != "" && dg.SKI != f.SKI {
+		return false
+	}
+	if f.Direction != "" && dg.Direction != f.Direction {
+		return false
+	}
+	if f.MsgCounter != nil && (dg.MsgCounter == nil || *dg.MsgCounter != *f.MsgCounter) {
+		return false
+	}
+	if f.Reference != nil && (dg.MsgCounterReference == nil || *dg.MsgCounterReference != *f.Reference) {
+		return false
+	}
+	if !f.Since.IsZero() && dg.Time.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// getDatagrams returns the matching captured datagrams, oldest first. A limit keeps the most recent ones.
+func (h *hems) getDatagrams(f datagramFilter) []capturedDatagram {
+	f.SKI = shiputil.NormalizeSKI(f.SKI)
+	h.capture.mu.Lock()
+	defer h.capture.mu.Unlock()
+
+	out := []capturedDatagram{}
+	for _, dg := range h.capture.datagrams {
+		if f.match(dg) {
+			out = append(out, dg)
+		}
+	}
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[len(out)-f.Limit:]
+	}
+	return out
+}
+
+// getDatagram returns a captured datagram by ID
+func (h *hems) getDatagram(id uint64) (capturedDatagram, bool) {
+	h.capture.mu.Lock()
+	defer h.capture.mu.Unlock()
+	for _, dg := range h.capture.datagrams {
+		if dg.ID == id {
+			return dg, true
+		}
+	}
+	return capturedDatagram{}, false
+}
+
+// findDatagram returns the ID of the most recent datagram matching the filter
+func (h *hems) findDatagram(f datagramFilter) *uint64 {
+	f.SKI = shiputil.NormalizeSKI(f.SKI)
+	h.capture.mu.Lock()
+	defer h.capture.mu.Unlock()
+	for i := len(h.capture.datagrams) - 1; i >= 0; i-- {
+		if f.match(h.capture.datagrams[i]) {
+			id := h.capture.datagrams[i].ID
+			return &id
+		}
+	}
+	return nil
+}
+
+// nearestDatagram references the last datagram received from the peer within nearestDatagramWindow
+func (h *hems) nearestDatagram(ski string) datagramRef {
+	if ski == "" {
+		return datagramRef{}
+	}
+	ski = shiputil.NormalizeSKI(ski)
+	since := time.Now().Add(-nearestDatagramWindow)
+	h.capture.mu.Lock()
+	defer h.capture.mu.Unlock()
+	for i := len(h.capture.datagrams) - 1; i >= 0; i-- {
+		dg := h.capture.datagrams[i]
+		if dg.Time.Before(since) {
+			break
+		}
+		if dg.SKI == ski && dg.Direction == datagramReceived {
+			id := dg.ID
+			return datagramRef{MsgCounter: dg.MsgCounter, DatagramID: &id, Correlation: correlationNearest}
+		}
+	}
+	return datagramRef{}
+}
+
+// commandDatagramRef references the datagram of the first message of a finished command:
+// the result if one was received, otherwise the sent write
+func commandDatagramRef(c command) datagramRef {
+	for _, m := range c.Messages {
+		if !m.wasSent() {
+			continue
+		}
+		ref := datagramRef{Correlation: correlationExact}
+		switch {
+		case m.ResultDatagramID != nil:
+			ref.MsgCounter, ref.DatagramID = m.ResultMsgCounter, m.ResultDatagramID
+		case m.DatagramID != nil:
+			n := m.MsgCounter
+			ref.MsgCounter, ref.DatagramID = &n, m.DatagramID
+		default:
+			n := m.MsgCounter
+			ref.MsgCounter = &n
+		}
+		return ref
+	}
+	return datagramRef{}
+}
+
+// commandMsgCounters returns the msgCounters of the sent messages and of their results
+func commandMsgCounters(c command) map[string]interface{} {
+	sent := make([]uint64, 0, len(c.Messages))
+	results := make([]uint64, 0, len(c.Messages))
+	for _, m := range c.Messages {
+		if !m.wasSent() {
+			continue
+		}
+		sent = append(sent, m.MsgCounter)
+		if m.ResultMsgCounter != nil {
+			results = append(results, *m.ResultMsgCounter)
+		}
+	}
+	return map[string]interface{}{"sent": sent, "results": results}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// planSlot is a normalized slot of a charge plan or of the slots sent to the EV
+type planSlot struct {
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	// PowerW is the planned power, or the value of a sent slot (price or power limit)
+	PowerW    float64  `json:"powerW"`
+	MinPowerW *float64 `json:"minPowerW,omitempty"`
+	MaxPowerW *float64 `json:"maxPowerW,omitempty"`
+}
+
+func (s planSlot) end() time.Time {
+	return s.Start.Add(time.Duration(s.DurationSeconds * float64(time.Second)))
+}
+
+// sentSlots are the power limits and incentives last sent to an EV
+type sentSlots struct {
+	SentAt time.Time `json:"sentAt"`
+	// Default is set when the eebus-go defaults were sent, they are not known in detail
+	Default     bool       `json:"default,omitempty"`
+	PowerLimits []planSlot `json:"powerLimits,omitempty"`
+	// Incentives use PowerW for the incentive value, e.g. the price
+	Incentives []planSlot `json:"incentives,omitempty"`
+}
+
+// planExcess is a plan slot above the power limit sent for its time
+type planExcess struct {
+	Slot   int       `json:"slot"`
+	Start  time.Time `json:"start"`
+	PowerW float64   `json:"powerW"`
+	LimitW float64   `json:"limitW"`
+}
+
+// cevcPlan is the charge plan of an EV with the constraints it was planned with
+type cevcPlan struct {
+	SKI        string     `json:"ski"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty"`
+	// Revision counts the plans received from the EV
+	Revision int        `json:"revision"`
+	Slots    []planSlot `json:"slots"`
+	// EVConstraints are the charge plan constraints announced by the EV, MaxPowerW per slot
+	EVConstraints           []planSlot `json:"evConstraints,omitempty"`
+	EVConstraintsReceivedAt *time.Time `json:"evConstraintsReceivedAt,omitempty"`
+	Sent                    *sentSlots `json:"sent,omitempty"`
+	// Excess lists the plan slots above the sent power limits
+	Excess []planExcess `json:"excess"`
+}
+
+// cevcPlanStore keeps the last charge plan and constraints per SKI
+type cevcPlanStore struct {
+	mu    sync.Mutex
+	plans map[string]*cevcPlan
+}
+
+func newCevcPlanStore() *cevcPlanStore {
+	return &cevcPlanStore{plans: make(map[string]*cevcPlan)}
+}
+
+func (s *cevcPlanStore) plan(ski string) *cevcPlan {
+	p, ok := s.plans[ski]
+	if !ok {
+		p = &cevcPlan{SKI: ski}
+		s.plans[ski] = p
+	}
+	return p
+}
+
+// sequentialSlots converts slots that follow each other from start
+func sequentialSlots(start time.Time, slots []ucapi.DurationSlotValue) []planSlot {
+	out := make([]planSlot, 0, len(slots))
+	t := start
+	for _, s := range slots {
+		out = append(out, planSlot{Start: t, DurationSeconds: s.Duration.Seconds(), PowerW: s.Value})
+		t = t.Add(s.Duration)
+	}
+	return out
+}
+
+// recordChargePlan stores a charge plan received from the EV
+func (h *hems) recordChargePlan(ski string, plan ucapi.ChargePlan) {
+	now := time.Now()
+	slots := make([]planSlot, 0, len(plan.Slots))
+	for _, s := range plan.Slots {
+		slot := planSlot{Start: s.Start, PowerW: s.Value}
+		if !s.End.IsZero() {
+			slot.DurationSeconds = s.End.Sub(s.Start).Seconds()
+		}
+		if s.MinValue != 0 {
+			v := s.MinValue
+			slot.MinPowerW = &v
+		}
+		if s.MaxValue != 0 {
+			v := s.MaxValue
+			slot.MaxPowerW = &v
+		}
+		slots = append(slots, slot)
+	}
+
+	h.cevcPlans.mu.Lock()
+	p := h.cevcPlans.plan(ski)
+	p.Slots = slots
+	p.ReceivedAt = &now
+	p.Revision++
+	revision := p.Revision
+	h.cevcPlans.mu.Unlock()
+
+	h.recordEvent("cevcPlan", severityInfo, ski, "charge plan received", map[string]interface{}{
+		"revision": revision,
+		"slots":    len(slots),
+	})
+	if snap := h.getChargePlan(ski); snap != nil {
+		h.broadcastJSON(map[string]interface{}{"type": "cevcPlan", "ski": ski, "plan": snap})
+	}
+}
+
+// recordChargePlanConstraints stores the charge plan constraints of the EV, which start now
+func (h *hems) recordChargePlanConstraints(ski string, constraints []ucapi.DurationSlotValue) {
+	now := time.Now()
+	h.cevcPlans.mu.Lock()
+	defer h.cevcPlans.mu.Unlock()
+	p := h.cevcPlans.plan(ski)
+	p.EVConstraints = nil
+	t := now
+	for _, c := range constraints {
+		max := c.Value
+		p.EVConstraints = append(p.EVConstraints, planSlot{Start: t, DurationSeconds: c.Duration.Seconds(), PowerW: c.Value, MaxPowerW: &max})
+		t = t.Add(c.Duration)
+	}
+	p.EVConstraintsReceivedAt = &now
+}
+
+// recordSentSlots stores the power limits and incentives sent to an EV, nil slots are the defaults
+func (h *hems) recordSentSlots(ski string, limits, incentives []ucapi.DurationSlotValue) {
+	now := time.Now()
+	sent := &sentSlots{
+		SentAt:      now,
+		Default:     limits == nil && incentives == nil,
+		PowerLimits: sequentialSlots(now, limits),
+		Incentives:  sequentialSlots(now, incentives),
+	}
+	h.cevcPlans.mu.Lock()
+	h.cevcPlans.plan(ski).Sent = sent
+	h.cevcPlans.mu.Unlock()
+}
+
+// planExcesses returns the plan slots whose power is above a sent limit they overlap
+func planExcesses(slots []planSlot, limits []planSlot) []planExcess {
+	out := []planExcess{}
+	for i, s := range slots {
+		for _, l := range limits {
+			if !s.Start.Before(l.end()) || !l.Start.Before(s.end()) {
+				continue
+			}
+			if s.PowerW > l.PowerW {
+				out = append(out, planExcess{Slot: i, Start: s.Start, PowerW: s.PowerW, LimitW: l.PowerW})
+				break
+			}
+		}
+	}
+	return out
+}
+
+func copyCevcPlan(p *cevcPlan) *cevcPlan {
+	c := *p
+	c.Slots = append([]planSlot(nil), p.Slots...)
+	c.EVConstraints = append([]planSlot(nil), p.EVConstraints...)
+	if p.Sent != nil {
+		sent := *p.Sent
+		c.Sent = &sent
+	}
+	c.Excess = []planExcess{}
+	if c.Sent != nil {
+		c.Excess = planExcesses(c.Slots, c.Sent.PowerLimits)
+	}
+	return &c
+}
+
+// getChargePlan returns the charge plan of a peer, nil if none was recorded
+func (h *hems) getChargePlan(ski string) *cevcPlan {
+	h.cevcPlans.mu.Lock()
+	defer h.cevcPlans.mu.Unlock()
+	p, ok := h.cevcPlans.plans[ski]
+	if !ok {
+		return nil
+	}
+	return copyCevcPlan(p)
+}
+
+// getChargePlans returns the charge plans of all peers sorted by SKI
+func (h *hems) getChargePlans() []*cevcPlan {
+	h.cevcPlans.mu.Lock()
+	defer h.cevcPlans.mu.Unlock()
+	out := make([]*cevcPlan, 0, len(h.cevcPlans.plans))
+	for _, p := range h.cevcPlans.plans {
+		out = append(out, copyCevcPlan(p))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SKI < out[j].SKI })
+	return out
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Power chart layout in pixels
+const (
+	chartWidth, chartHeight = 720, 260
+	chartLeft, chartRight   = 60, 10
+	chartTop, chartBottom   = 20, 30
+)
+
+// chartBand is a shaded and labelled time range of a power chart, e.g. a test phase
+type chartBand struct {
+	label    string
+	from, to time.Time
+	fill     string
+}
+
+// chartLimit is a dashed limit line over a time range
+type chartLimit struct {
+	label    string
+	from, to time.Time
+	watts    float64
+}
+
+// chartPoint is a measured power value
+type chartPoint struct {
+	t     time.Time
+	watts float64
+}
+
+// powerChart is a timeline of the measured power of a test with its limits, rendered
+// as SVG by the test endpoints
+type powerChart struct {
+	start, end time.Time
+	bands      []chartBand
+	limits     []chartLimit
+	points     []chartPoint
+}
+
+func (c powerChart) svg() []byte {
+	plotW, plotH := float64(chartWidth-chartLeft-chartRight), float64(chartHeight-chartTop-chartBottom)
+	span := math.Max(c.end.Sub(c.start).Seconds(), 1)
+	maxW := 1.0
+	for _, p := range c.points {
+		maxW = math.Max(maxW, p.watts)
+	}
+	for _, l := range c.limits {
+		maxW = math.Max(maxW, l.watts)
+	}
+	maxW *= 1.1
+	x := func(t time.Time) float64 { return float64(chartLeft) + t.Sub(c.start).Seconds()/span*plotW }
+	y := func(w float64) float64 { return float64(chartTop) + plotH - math.Max(w, 0)/maxW*plotH }
+	bottom := float64(chartTop) + plotH
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="11">`+"\n", chartWidth, chartHeight)
+	for _, band := range c.bands {
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%d" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x(band.from), chartTop, math.Max(x(band.to)-x(band.from), 0), plotH, band.fill)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d">%s</text>`+"\n", x(band.from)+2, chartTop-6, band.label)
+	}
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%.1f" stroke="black"/>`+"\n", chartLeft, chartTop, chartLeft, bottom)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="black"/>`+"\n", chartLeft, bottom, chartWidth-chartRight, bottom)
+	fmt.Fprintf(&b, `<text x="4" y="%d">%.0f W</text>`+"\n", chartTop+10, maxW)
+	fmt.Fprintf(&b, `<text x="4" y="%.1f">0 W</text>`+"\n", bottom)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%.0f s</text>`+"\n", chartWidth-chartRight, chartHeight-10, span)
+	for _, l := range c.limits {
+		ly := y(l.watts)
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#c0392b" stroke-dasharray="4 3"/>`+"\n", x(l.from), ly, x(l.to), ly)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" fill="#c0392b">%s</text>`+"\n", x(l.from)+4, ly-3, l.label)
+	}
+	if len(c.points) > 0 {
+		b.WriteString(`<polyline fill="none" stroke="#2c7be5" stroke-width="1.5" points="`)
+		for i, p := range c.points {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(&b, "%.1f,%.1f", x(p.t), y(p.watts))
+		}
+		b.WriteString(`"/>` + "\n")
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
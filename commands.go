@@ -0,0 +1,723 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// commandState is the lifecycle state of a queued write command
+type commandState string
+
+const (
+	commandQueued       commandState = "queued"
+	commandSent         commandState = "sent"
+	commandAcknowledged commandState = "acknowledged"
+	commandRejected     commandState = "rejected"
+	commandTimedOut     commandState = "timedOut"
+	commandFailed       commandState = "failed"
+)
+
+// final returns true if the state will not change anymore
+func (s commandState) final() bool {
+	return s == commandAcknowledged || s == commandRejected || s == commandTimedOut || s == commandFailed
+}
+
+// maxCommands is the number of commands kept for status queries
+const maxCommands = 500
+
+// sentMessage references a SPINE message sent to a remote entity
+type sentMessage struct {
+	Entity     spineapi.EntityRemoteInterface
+	MsgCounter model.MsgCounterType
+	// Err is set when the write could not be sent to the entity
+	Err error
+}
+
+// RetryConfig configures automatic retries of limit and failsafe writes
+type RetryConfig struct {
+	// MaxRetries is the number of retries after the first attempt, 0 disables retries
+	MaxRetries int `json:"maxRetries"`
+	// BackoffMs is the delay before the first retry, defaults to 2000
+	BackoffMs int `json:"backoffMs,omitempty"`
+	// BackoffFactor multiplies the delay for every further retry, defaults to 1
+	BackoffFactor float64 `json:"backoffFactor,omitempty"`
+	// RetryOn lists the attempt results that trigger a retry, defaults to rejected and timedOut
+	RetryOn []commandState `json:"retryOn,omitempty"`
+	// AbortOnErrorNumbers lists SPINE error numbers which stop retrying,
+	// defaults to 6 (command not supported)
+	AbortOnErrorNumbers []uint `json:"abortOnErrorNumbers,omitempty"`
+}
+
+// backoff returns the delay before the given retry (1 based)
+func (c RetryConfig) backoff(retry int) time.Duration {
+	delay := float64(c.BackoffMs)
+	if delay <= 0 {
+		delay = 2000
+	}
+	factor := c.BackoffFactor
+	if factor <= 0 {
+		factor = 1
+	}
+	for i := 1; i < retry; i++ {
+		delay *= factor
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+func (c RetryConfig) retriesOn(state commandState) bool {
+	if len(c.RetryOn) == 0 {
+		return state == commandRejected || state == commandTimedOut
+	}
+	return slices.Contains(c.RetryOn, state)
+}
+
+func (c RetryConfig) abortsOn(errorNumber uint) bool {
+	if c.AbortOnErrorNumbers == nil {
+		return errorNumber == uint(model.ErrorNumberTypeCommandNotSupported)
+	}
+	return slices.Contains(c.AbortOnErrorNumbers, errorNumber)
+}
+
+// commandAttempt records the outcome of a single execution of a command
+type commandAttempt struct {
+	Attempt   int              `json:"attempt"`
+	StartedAt time.Time        `json:"startedAt"`
+	EndedAt   time.Time        `json:"endedAt"`
+	State     commandState     `json:"state"`
+	Error     string           `json:"error,omitempty"`
+	Messages  []commandMessage `json:"messages,omitempty"`
+}
+
+// commandMessage is the state of a single SPINE message sent for a command
+type commandMessage struct {
+	Entity      string       `json:"entity"`
+	MsgCounter  uint64       `json:"msgCounter"`
+	State       commandState `json:"state"`
+	ErrorNumber *uint        `json:"errorNumber,omitempty"`
+	Description string       `json:"description,omitempty"`
+	// DatagramID is the captured datagram of the sent write, the Result fields
+	// reference the result datagram of the DUT
+	DatagramID       *uint64 `json:"datagramId,omitempty"`
+	ResultMsgCounter *uint64 `json:"resultMsgCounter,omitempty"`
+	ResultDatagramID *uint64 `json:"resultDatagramId,omitempty"`
+	// Error is the reason the write could not be sent to the entity
+	Error string `json:"error,omitempty"`
+
+	ski string
+}
+
+// command is a queued write operation towards the remote device(s)
+type command struct {
+	ID        string                 `json:"id"`
+	Cmd       string                 `json:"cmd"`
+	Payload   map[string]interface{} `json:"payload,omitempty"`
+	State     commandState           `json:"state"`
+	Error     string                 `json:"error,omitempty"`
+	Messages  []commandMessage       `json:"messages,omitempty"`
+	Attempt   int                    `json:"attempt"`
+	Attempts  []commandAttempt       `json:"attempts,omitempty"`
+	Retry     *RetryConfig           `json:"retry,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+
+	exec      func() ([]sentMessage, error)
+	startedAt time.Time
+	ski       string
+	done      chan struct{}
+}
+
+// commandQueue executes write commands sequentially and tracks their results
+type commandQueue struct {
+	mu       sync.Mutex
+	nextID   int
+	commands map[string]*command
+	order    []string
+	queue    chan *command
+
+	// pending maps "<ski>/<msgCounter>" to the command waiting for the result
+	pending map[string]*command
+	// early keeps results which arrived before the message was registered as pending
+	early map[string]earlyResult
+}
+
+type earlyResult struct {
+	result   model.ResultDataType
+	received time.Time
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{
+		commands: make(map[string]*command),
+		queue:    make(chan *command, 100),
+		pending:  make(map[string]*command),
+		early:    make(map[string]earlyResult),
+	}
+}
+
+func resultKey(ski string, counter model.MsgCounterType) string {
+	return fmt.Sprintf("%s/%d", ski, counter)
+}
+
+// snapshot returns a copy of the command which is safe to marshal.
+// The caller must hold the queue mutex.
+func (c *command) snapshot() command {
+	out := *c
+	out.Messages = append([]commandMessage(nil), c.Messages...)
+	out.Attempts = append([]commandAttempt(nil), c.Attempts...)
+	return out
+}
+
+// enqueueCommand adds a write command to the queue.
+// A non-nil retry policy enables automatic retries of failed attempts.
+func (h *hems) enqueueCommand(cmd string, payload map[string]interface{}, retry *RetryConfig, exec func() ([]sentMessage, error)) (*command, error) {
+	q := h.commands
+
+	q.mu.Lock()
+	q.nextID++
+	now := time.Now()
+	c := &command{
+		ID:        strconv.Itoa(q.nextID),
+		Cmd:       cmd,
+		Payload:   payload,
+		State:     commandQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Retry:     retry,
+		exec:      exec,
+		done:      make(chan struct{}),
+	}
+	if ski, ok := payload["ski"].(string); ok {
+		c.ski = ski
+	}
+	q.commands[c.ID] = c
+	q.order = append(q.order, c.ID)
+	for len(q.order) > maxCommands {
+		delete(q.commands, q.order[0])
+		q.order = q.order[1:]
+	}
+	snap := c.snapshot()
+	q.mu.Unlock()
+
+	select {
+	case q.queue <- c:
+	default:
+		h.setCommandState(c, commandFailed, "command queue full")
+		return c, errors.New("command queue full")
+	}
+
+	h.broadcastCommand(snap)
+	return c, nil
+}
+
+// runCommandQueue executes queued commands one after another
+func (h *hems) runCommandQueue() {
+	for c := range h.commands.queue {
+		h.executeCommand(c)
+	}
+}
+
+func (h *hems) executeCommand(c *command) {
+	q := h.commands
+
+	q.mu.Lock()
+	c.Attempt++
+	c.startedAt = time.Now()
+	attempt := c.Attempt
+	q.mu.Unlock()
+
+	fmt.Printf("Executing command %s: %s (attempt %d)\n", c.ID, c.Cmd, attempt)
+	sent, err := c.exec()
+
+	var skis []string
+	delivered := 0
+	q.mu.Lock()
+	for _, msg := range sent {
+		entity := ""
+		ski := ""
+		if msg.Entity != nil {
+			entity = fmt.Sprint(msg.Entity.Address())
+			if msg.Entity.Device() != nil {
+				ski = msg.Entity.Device().Ski()
+			}
+		}
+		if msg.Err != nil {
+			c.Messages = append(c.Messages, commandMessage{
+				Entity: entity,
+				State:  commandFailed,
+				Error:  msg.Err.Error(),
+				ski:    ski,
+			})
+			continue
+		}
+		delivered++
+		skis = append(skis, ski)
+		c.Messages = append(c.Messages, commandMessage{
+			Entity:     entity,
+			MsgCounter: uint64(msg.MsgCounter),
+			State:      commandSent,
+			ski:        ski,
+		})
+		key := resultKey(ski, msg.MsgCounter)
+		q.pending[key] = c
+		if early, ok := q.early[key]; ok {
+			delete(q.early, key)
+			delete(q.pending, key)
+			applyResult(&c.Messages[len(c.Messages)-1], early.result)
+			h.correlateMessage(&c.Messages[len(c.Messages)-1])
+		}
+	}
+	startedAt := c.startedAt
+	q.mu.Unlock()
+
+	h.awaitDataUpdate(c.Cmd, skis, startedAt)
+
+	switch {
+	case err != nil && delivered == 0:
+		h.setCommandState(c, commandFailed, err.Error())
+		return
+	case delivered == 0:
+		h.setCommandState(c, commandFailed, "no remote entity available for this command")
+		return
+	case err != nil:
+		h.setCommandState(c, commandSent, err.Error())
+	default:
+		h.setCommandState(c, commandSent, "")
+	}
+	h.evaluateCommand(c)
+
+	time.AfterFunc(h.writeTimeout(), func() {
+		h.timeoutCommand(c, attempt)
+	})
+}
+
+// applyResult stores a SPINE result in the message state
+func applyResult(m *commandMessage, result model.ResultDataType) {
+	if result.ErrorNumber != nil {
+		n := uint(*result.ErrorNumber)
+		m.ErrorNumber = &n
+	}
+	if result.Description != nil {
+		m.Description = string(*result.Description)
+	}
+	if result.ErrorNumber == nil || *result.ErrorNumber == model.ErrorNumberTypeNoError {
+		m.State = commandAcknowledged
+	} else {
+		m.State = commandRejected
+	}
+}
+
+// correlateMessage references the captured datagrams of a sent message and of its result
+func (h *hems) correlateMessage(m *commandMessage) {
+	if !m.wasSent() {
+		return
+	}
+	n := m.MsgCounter
+	if m.DatagramID == nil {
+		m.DatagramID = h.findDatagram(datagramFilter{SKI: m.ski, Direction: datagramSent, MsgCounter: &n})
+	}
+	if m.ResultDatagramID != nil || m.State == commandSent {
+		return
+	}
+	if id := h.findDatagram(datagramFilter{SKI: m.ski, Direction: datagramReceived, Reference: &n}); id != nil {
+		m.ResultDatagramID = id
+		if dg, ok := h.getDatagram(*id); ok {
+			m.ResultMsgCounter = dg.MsgCounter
+		}
+	}
+}
+
+// evaluateCommand sets the final state once all messages of the command got a result
+func (h *hems) evaluateCommand(c *command) {
+	q := h.commands
+
+	q.mu.Lock()
+	if c.State.final() {
+		q.mu.Unlock()
+		return
+	}
+	// a rejection outranks entities the write could not be sent to
+	state := commandAcknowledged
+	for _, m := range c.Messages {
+		if m.State == commandSent {
+			q.mu.Unlock()
+			return
+		}
+		if m.State == commandRejected {
+			state = commandRejected
+		}
+		if m.State == commandFailed && state == commandAcknowledged {
+			state = commandFailed
+		}
+	}
+	errText := c.Error
+	q.mu.Unlock()
+
+	h.setCommandState(c, state, errText)
+}
+
+// timeoutCommand marks all messages of an attempt without result as timed out
+func (h *hems) timeoutCommand(c *command, attempt int) {
+	q := h.commands
+
+	q.mu.Lock()
+	if c.State.final() || c.Attempt != attempt || c.State != commandSent {
+		q.mu.Unlock()
+		return
+	}
+	for i := range c.Messages {
+		if c.Messages[i].State == commandSent {
+			c.Messages[i].State = commandTimedOut
+		}
+	}
+	for key, pc := range q.pending {
+		if pc == c {
+			delete(q.pending, key)
+		}
+	}
+	q.mu.Unlock()
+
+	h.setCommandState(c, commandTimedOut, fmt.Sprintf("%s (%s)", errResponseTimeout, h.writeTimeout()))
+}
+
+// setCommandState updates the state of a command and broadcasts the change.
+// A final state of a command with retry policy may schedule another attempt.
+func (h *hems) setCommandState(c *command, state commandState, errText string) {
+	q := h.commands
+
+	q.mu.Lock()
+	if c.State.final() {
+		q.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	c.State = state
+	c.Error = errText
+	c.UpdatedAt = now
+	if state.final() {
+		for i := range c.Messages {
+			h.correlateMessage(&c.Messages[i])
+		}
+	}
+	if state.final() && c.Attempt > 0 {
+		c.Attempts = append(c.Attempts, commandAttempt{
+			Attempt:   c.Attempt,
+			StartedAt: c.startedAt,
+			EndedAt:   now,
+			State:     state,
+			Error:     errText,
+			Messages:  append([]commandMessage(nil), c.Messages...),
+		})
+		if delay, ok := c.retryDelay(); ok {
+			for key, pc := range q.pending {
+				if pc == c {
+					delete(q.pending, key)
+				}
+			}
+			c.State = commandQueued
+			c.Error = fmt.Sprintf("attempt %d %s, retrying in %s", c.Attempt, state, delay)
+			c.Messages = nil
+			time.AfterFunc(delay, func() {
+				select {
+				case q.queue <- c:
+				default:
+					h.setCommandState(c, commandFailed, "command queue full")
+				}
+			})
+		}
+	}
+	snap := c.snapshot()
+	if c.State.final() {
+		close(c.done)
+	}
+	q.mu.Unlock()
+
+	fmt.Printf("Command %s (%s): %s %s\n", snap.ID, snap.Cmd, snap.State, snap.Error)
+	h.broadcastCommand(snap)
+
+	if snap.State.final() {
+		severity := severityInfo
+		if snap.State != commandAcknowledged {
+			severity = severityWarning
+		}
+		msg := fmt.Sprintf("command %s (%s) %s", snap.ID, snap.Cmd, snap.State)
+		if snap.Error != "" {
+			msg += ": " + snap.Error
+		}
+		data := map[string]interface{}{"command": snap.ID, "msgCounters": commandMsgCounters(snap)}
+		if errs := commandEntityErrors(snap); len(errs) > 0 {
+			data["entityErrors"] = errs
+		}
+		h.recordCorrelatedEvent("command", severity, snap.ski, msg, data, commandDatagramRef(snap))
+		h.alertCommand(snap)
+		h.recordResultLatency(snap)
+		h.traceCommand(snap)
+	}
+}
+
+// retryDelay returns the delay before the next attempt if the last attempt
+// qualifies for a retry. The caller must hold the queue mutex.
+func (c *command) retryDelay() (time.Duration, bool) {
+	if c.Retry == nil || c.Attempt > c.Retry.MaxRetries || !c.Retry.retriesOn(c.State) {
+		return 0, false
+	}
+	for _, m := range c.Messages {
+		if m.ErrorNumber != nil && c.Retry.abortsOn(*m.ErrorNumber) {
+			return 0, false
+		}
+	}
+	return c.Retry.backoff(c.Attempt), true
+}
+
+// handleResultMessage is registered as result callback on all local features
+// and matches incoming SPINE results to sent command messages
+func (h *hems) handleResultMessage(msg spineapi.ResponseMessage) {
+	result, ok := msg.Data.(*model.ResultDataType)
+	if !ok || result == nil {
+		return
+	}
+	h.recordResultStats(msg, *result)
+
+	ski := ""
+	if msg.DeviceRemote != nil {
+		ski = msg.DeviceRemote.Ski()
+	}
+	key := resultKey(ski, msg.MsgCounterReference)
+
+	q := h.commands
+	q.mu.Lock()
+	c, ok := q.pending[key]
+	if !ok {
+		// the result may arrive before the sent message got registered
+		now := time.Now()
+		for k, e := range q.early {
+			if now.Sub(e.received) > h.writeTimeout() {
+				delete(q.early, k)
+			}
+		}
+		q.early[key] = earlyResult{result: *result, received: now}
+		q.mu.Unlock()
+		return
+	}
+	delete(q.pending, key)
+	for i := range c.Messages {
+		if c.Messages[i].MsgCounter == uint64(msg.MsgCounterReference) && c.Messages[i].State == commandSent {
+			applyResult(&c.Messages[i], *result)
+			h.correlateMessage(&c.Messages[i])
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	h.evaluateCommand(c)
+}
+
+// registerResultCallbacks installs the result callback on all local features
+func (h *hems) registerResultCallbacks() {
+	for _, entity := range h.myService.LocalDevice().Entities() {
+		for _, feature := range entity.Features() {
+			feature.AddResultCallback(h.handleResultMessage)
+		}
+	}
+}
+
+// getCommand returns a snapshot of a command
+func (h *hems) getCommand(id string) (command, bool) {
+	q := h.commands
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.commands[id]
+	if !ok {
+		return command{}, false
+	}
+	return c.snapshot(), true
+}
+
+// getCommands returns snapshots of all known commands, oldest first
+func (h *hems) getCommands() []command {
+	q := h.commands
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := make([]command, 0, len(q.order))
+	for _, id := range q.order {
+		out = append(out, q.commands[id].snapshot())
+	}
+	return out
+}
+
+// broadcastCommand sends a command state update to all websocket clients
+func (h *hems) broadcastCommand(c command) {
+	h.broadcastJSON(map[string]interface{}{
+		"type":    "command",
+		"ski":     c.ski,
+		"command": c,
+	})
+}
+
+// entityResult is the outcome of a write for a single remote entity
+type entityResult struct {
+	Entity  string       `json:"entity"`
+	Success bool         `json:"success"`
+	State   commandState `json:"state"`
+	// Error is the send error, the SPINE result description or the timeout
+	Error string `json:"error,omitempty"`
+}
+
+// commandResult is a command in a write response with one result per remote entity.
+// Failed commands carry the error envelope fields, error is the command error.
+type commandResult struct {
+	command
+	Results []entityResult   `json:"results"`
+	Code    string           `json:"code,omitempty"`
+	Details []apiErrorDetail `json:"details,omitempty"`
+}
+
+func newCommandResult(snap command) commandResult {
+	res := commandResult{command: snap, Results: make([]entityResult, 0, len(snap.Messages))}
+	for _, m := range snap.Messages {
+		r := entityResult{Entity: m.Entity, Success: m.State == commandAcknowledged, State: m.State, Error: m.Error}
+		switch {
+		case r.Error != "":
+		case m.State == commandRejected:
+			r.Error = "rejected"
+			if m.ErrorNumber != nil {
+				r.Error = fmt.Sprintf("rejected with error number %d", *m.ErrorNumber)
+			}
+			if m.Description != "" {
+				r.Error += ": " + m.Description
+			}
+		case m.State == commandTimedOut:
+			r.Error = errResponseTimeout.Error()
+		}
+		res.Results = append(res.Results, r)
+	}
+	if code := commandErrorCode(snap.State); code != "" {
+		details, partial := commandErrorDetails(snap)
+		if partial {
+			code = errCodePartialFailure
+		}
+		res.Code, res.Details = code, details
+	}
+	return res
+}
+
+// commandHTTPStatus maps the state of a command to the status of its write response
+func commandHTTPStatus(state commandState) int {
+	switch state {
+	case commandAcknowledged:
+		return http.StatusOK
+	case commandRejected, commandFailed:
+		return http.StatusBadGateway
+	case commandTimedOut:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusAccepted
+}
+
+// waitForCommands blocks until all commands reached a final state for requests
+// with `?wait=true`, it returns false when the client went away
+func waitForCommands(r *http.Request, commands ...*command) bool {
+	if r.URL.Query().Get("wait") != "true" {
+		return true
+	}
+	for _, c := range commands {
+		select {
+		case <-c.done:
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
+
+// writeCommandResponse answers an enqueued write request. With `?wait=true`
+// the response is delayed until the command reached a final state.
+func (h *hems) writeCommandResponse(w http.ResponseWriter, r *http.Request, c *command) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !waitForCommands(r, c) {
+		return
+	}
+
+	snap, _ := h.getCommand(c.ID)
+	w.WriteHeader(commandHTTPStatus(snap.State))
+	if err := json.NewEncoder(w).Encode(newCommandResult(snap)); err != nil {
+		h.Errorf("encode command: %v", err)
+	}
+}
+
+// appendSent records a sent message if the write returned a msgCounter
+func appendSent(sent []sentMessage, entity spineapi.EntityRemoteInterface, msgCounter *model.MsgCounterType) []sentMessage {
+	if msgCounter == nil {
+		return sent
+	}
+	return append(sent, sentMessage{Entity: entity, MsgCounter: *msgCounter})
+}
+
+// appendSendError records an entity the write could not be sent to
+func appendSendError(sent []sentMessage, entity spineapi.EntityRemoteInterface, err error) []sentMessage {
+	return append(sent, sentMessage{Entity: entity, Err: err})
+}
+
+// sendErrors summarizes the failed entities of a write, nil if all were sent
+func sendErrors(sent []sentMessage) error {
+	failed := 0
+	for _, msg := range sent {
+		if msg.Err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("write failed for %d of %d entities", failed, len(sent))
+}
+
+// commandEntityErrors returns the send errors of a command by entity address
+func commandEntityErrors(c command) map[string]string {
+	errs := map[string]string{}
+	for _, m := range c.Messages {
+		if !m.wasSent() {
+			errs[m.Entity] = m.Error
+		}
+	}
+	return errs
+}
+
+// wasSent reports whether the message reached the SPINE layer, messages that
+// failed to send have no msgCounter
+func (m commandMessage) wasSent() bool {
+	return m.Error == ""
+}
+
+// retryPolicy returns the retry policy of a write request. A `retry` object
+// in the payload overrides the configured default policy.
+func (h *hems) retryPolicy(payload map[string]interface{}) (*RetryConfig, error) {
+	var policy RetryConfig
+	if h.config != nil {
+		policy = h.config.Retry
+	}
+	if v, ok := payload["retry"]; ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		policy = RetryConfig{}
+		if err := json.Unmarshal(b, &policy); err != nil {
+			return nil, err
+		}
+	}
+	if policy.MaxRetries <= 0 {
+		return nil, nil
+	}
+	return &policy, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Measurement sources of the limit compliance check, auto prefers MPC over EVCEM over MGCP
+const (
+	powerSourceAuto  = ""
+	powerSourceMPC   = "mpc"
+	powerSourceEVCEM = "evcem"
+	powerSourceMGCP  = "mgcp"
+)
+
+// Compliance states of an active limit
+const (
+	complianceInactive      = "inactive"
+	complianceNoMeasurement = "noMeasurement"
+	// complianceReacting is reported within the reaction time allowance after a limit change
+	complianceReacting = "reacting"
+	complianceOk       = "ok"
+	// complianceExceeded is reported while the power is above the limit, before the alert fired
+	complianceExceeded  = "exceeded"
+	complianceViolation = "violation"
+)
+
+// measuredPower returns the consumption power of a peer from the source, production
+// is negative. MGCP is the power at the grid connection point.
+func measuredPower(peer *peerData, source string) (float64, string, bool) {
+	d := peer.usecaseData
+	mpc := func() (float64, bool) { return d.MpcPower, d.MpcPower != 0 }
+	evcem := func() (float64, bool) {
+		if len(d.EvcemPowerPerPhase) == 0 {
+			return 0, false
+		}
+		total := 0.0
+		for _, p := range d.EvcemPowerPerPhase {
+			total += p
+		}
+		return total, true
+	}
+	mgcp := func() (float64, bool) { return d.MgcPower, d.MgcPower != 0 }
+
+	switch strings.ToLower(source) {
+	case powerSourceMPC:
+		p, ok := mpc()
+		return p, powerSourceMPC, ok
+	case powerSourceEVCEM:
+		p, ok := evcem()
+		return p, powerSourceEVCEM, ok
+	case powerSourceMGCP:
+		p, ok := mgcp()
+		return p, powerSourceMGCP, ok
+	}
+	if p, ok := mpc(); ok {
+		return p, powerSourceMPC, true
+	}
+	if p, ok := evcem(); ok {
+		return p, powerSourceEVCEM, true
+	}
+	if p, ok := mgcp(); ok {
+		return p, powerSourceMGCP, true
+	}
+	return 0, "", false
+}
+
+// observedLimit is the last seen limit of a use case of a peer
+type observedLimit struct {
+	active    bool
+	value     float64
+	changedAt time.Time
+}
+
+// complianceTracker records when the limits of the peers changed, the reaction time
+// allowance starts with every change
+type complianceTracker struct {
+	mu     sync.Mutex
+	limits map[string]observedLimit
+}
+
+func newComplianceTracker() *complianceTracker {
+	return &complianceTracker{limits: make(map[string]observedLimit)}
+}
+
+// observe returns the time the limit was last changed
+func (t *complianceTracker) observe(ski, usecase string, active bool, value float64, now time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := ski + "/" + usecase
+	l, ok := t.limits[key]
+	if !ok || l.active != active || l.value != value {
+		l = observedLimit{active: active, value: value, changedAt: now}
+		t.limits[key] = l
+	}
+	return l.changedAt
+}
+
+// complianceStatus is the comparison of an active limit against the measured power
+type complianceStatus struct {
+	Rule    string `json:"rule"`
+	SKI     string `json:"ski"`
+	Usecase string `json:"usecase"`
+	State   string `json:"state"`
+	// Source is the use case the power was taken from
+	Source string   `json:"source,omitempty"`
+	LimitW *float64 `json:"limitW,omitempty"`
+	// PowerW is the measured consumption, or production for LPP
+	PowerW *float64 `json:"powerW,omitempty"`
+	// MaxAllowedW is the limit with the rule tolerances applied
+	MaxAllowedW    *float64   `json:"maxAllowedW,omitempty"`
+	LimitChangedAt *time.Time `json:"limitChangedAt,omitempty"`
+	// ReactionEndsAt is the end of the reaction time allowance after the last limit change
+	ReactionEndsAt *time.Time `json:"reactionEndsAt,omitempty"`
+	// ExceededSince is the start of the current excess, the alert fires after forSeconds
+	ExceededSince *time.Time `json:"exceededSince,omitempty"`
+	AlertID       uint64     `json:"alertId,omitempty"`
+}
+
+// limitCompliance compares the active limit of the rule's use case with the measured power
+func (h *hems) limitCompliance(rule AlertRule, ski string, peer *peerData, now time.Time) complianceStatus {
+	status := complianceStatus{Rule: rule.Name, SKI: ski, Usecase: strings.ToLower(rule.Usecase), State: complianceInactive}
+	d := peer.usecaseData
+	var active bool
+	var limit float64
+	switch status.Usecase {
+	case "lpc":
+		active, limit = d.LpcLimitActive, d.LpcLimitValue
+	case "lpp":
+		active, limit = d.LppLimitActive, math.Abs(d.LppLimitValue)
+	default:
+		return status
+	}
+	changedAt := h.compliance.observe(ski, status.Usecase, active, limit, now)
+	if !active || !peer.connected {
+		return status
+	}
+	status.LimitW = &limit
+	status.LimitChangedAt = optionalTime(changedAt)
+
+	power, source, ok := measuredPower(peer, rule.Source)
+	if !ok {
+		status.State = complianceNoMeasurement
+		return status
+	}
+	if status.Usecase == "lpp" {
+		// production is reported as negative consumption
+		power = -power
+	}
+	max := limit*(1+rule.ThresholdPercent/100) + rule.ToleranceWatts
+	status.Source, status.PowerW, status.MaxAllowedW = source, &power, &max
+
+	reactionEnd := changedAt.Add(time.Duration(rule.ReactionSeconds * float64(time.Second)))
+	switch {
+	case now.Before(reactionEnd):
+		status.State = complianceReacting
+		status.ReactionEndsAt = &reactionEnd
+	case power <= max:
+		status.State = complianceOk
+	default:
+		status.State = complianceExceeded
+	}
+	return status
+}
+
+// getCompliance evaluates the limitExceeded rules for all peers or the one with the SKI
+func (h *hems) getCompliance(ski string) []complianceStatus {
+	cfg := h.alertsConfig()
+	now := time.Now()
+	out := []complianceStatus{}
+	for peerSKI, peer := range h.getAllPeers() {
+		if ski != "" && peerSKI != ski {
+			continue
+		}
+		for _, rule := range cfg.rules() {
+			if rule.Type != alertLimitExceeded {
+				continue
+			}
+			status := h.limitCompliance(rule, peerSKI, peer, now)
+			if status.State == complianceExceeded {
+				h.alerts.mu.Lock()
+				if cond, ok := h.alerts.conditions[rule.Name+"/"+peerSKI]; ok {
+					since := cond.since
+					status.ExceededSince = &since
+					if cond.active != nil {
+						status.State = complianceViolation
+						status.AlertID = cond.active.ID
+					}
+				}
+				h.alerts.mu.Unlock()
+			}
+			out = append(out, status)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SKI != out[j].SKI {
+			return out[i].SKI < out[j].SKI
+		}
+		return out[i].Rule < out[j].Rule
+	})
+	return out
+}
+
+// limitExceeded is the condition of the limitExceeded rules, it holds once the reaction
+// time allowance after the last limit change is over and the power is above the limit
+func (h *hems) limitExceeded(rule AlertRule, ski string, peer *peerData, now time.Time) (bool, string, map[string]interface{}) {
+	status := h.limitCompliance(rule, ski, peer, now)
+	if status.State != complianceExceeded {
+		return false, "", nil
+	}
+	msg := fmt.Sprintf("%s: measured power %.0f W (%s) exceeds active limit %.0f W, allowed %.0f W",
+		strings.ToUpper(status.Usecase), *status.PowerW, strings.ToUpper(status.Source), *status.LimitW, *status.MaxAllowedW)
+	return true, msg, map[string]interface{}{
+		"power":      *status.PowerW,
+		"limit":      *status.LimitW,
+		"maxAllowed": *status.MaxAllowedW,
+		"source":     status.Source,
+	}
+}
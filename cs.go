@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	cslpc "github.com/enbility/eebus-go/usecases/cs/lpc"
+	cslpp "github.com/enbility/eebus-go/usecases/cs/lpp"
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// ApprovalConfig configures how limit writes are approved in controllable system mode
+type ApprovalConfig struct {
+	// Mode is "manual" (default, decided via API), "accept" or "deny"
+	Mode string `json:"mode,omitempty"`
+	// DelayMs delays the automatic decision of the accept and deny modes
+	DelayMs int `json:"delayMs,omitempty"`
+	// TimeoutMs is the time SPINE waits for a decision before rejecting the write, defaults to 60000
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+	// Reason is sent along with automatically denied writes
+	Reason string `json:"reason,omitempty"`
+}
+
+func (c ApprovalConfig) mode() string {
+	switch strings.ToLower(c.Mode) {
+	case "accept", "deny":
+		return strings.ToLower(c.Mode)
+	}
+	return "manual"
+}
+
+func (c ApprovalConfig) timeout() time.Duration {
+	if c.TimeoutMs <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.TimeoutMs) * time.Millisecond
+}
+
+// approvalState is the state of a pending limit approval
+type approvalState string
+
+const (
+	approvalPending  approvalState = "pending"
+	approvalAccepted approvalState = "accepted"
+	approvalDenied   approvalState = "denied"
+	approvalExpired  approvalState = "expired"
+)
+
+// pendingApproval is a limit write of the remote energy guard waiting for a decision
+type pendingApproval struct {
+	ID              string        `json:"id"`
+	Usecase         string        `json:"usecase"`
+	SKI             string        `json:"ski"`
+	MsgCounter      uint64        `json:"msgCounter"`
+	Value           float64       `json:"value"`
+	DurationSeconds int64         `json:"durationSeconds"`
+	IsActive        bool          `json:"isActive"`
+	State           approvalState `json:"state"`
+	Reason          string        `json:"reason,omitempty"`
+	DecidedBy       string        `json:"decidedBy,omitempty"`
+	ReceivedAt      time.Time     `json:"receivedAt"`
+	ExpiresAt       time.Time     `json:"expiresAt"`
+	DecidedAt       *time.Time    `json:"decidedAt,omitempty"`
+}
+
+// approvalStore keeps all limit writes that required an approval
+type approvalStore struct {
+	mu    sync.Mutex
+	items map[string]*pendingApproval
+}
+
+// approvalID identifies a limit write, the msgCounter is only unique per remote device
+func approvalID(ski, usecase string, msgCounter model.MsgCounterType) string {
+	return fmt.Sprintf("%s-%s-%d", strings.ToLower(usecase), ski, msgCounter)
+}
+
+// setupControllableSystem adds the controllable system use cases if they are enabled.
+// They have to be enabled explicitly as they change the role of the tester.
+func (h *hems) setupControllableSystem() {
+	enabled := func(name string) bool {
+		cfg, ok := h.config.Usecases[name]
+		return ok && cfg.Enabled
+	}
+
+	h.approvals = &approvalStore{items: make(map[string]*pendingApproval)}
+
+	if enabled("cslpc") {
+		h.uccslpc = cslpc.NewLPC(h.usecaseEntity("cslpc"), h.HandleCsLPC)
+		h.myService.AddUseCase(h.uccslpc)
+		h.trackUsecase("CSLPC", h.uccslpc)
+		fmt.Println("Usecase CS LPC enabled")
+	}
+	if enabled("cslpp") {
+		h.uccslpp = cslpp.NewLPP(h.usecaseEntity("cslpp"), h.HandleCsLPP)
+		h.myService.AddUseCase(h.uccslpp)
+		h.trackUsecase("CSLPP", h.uccslpp)
+		fmt.Println("Usecase CS LPP enabled")
+	}
+
+	if h.uccslpc != nil || h.uccslpp != nil {
+		for _, name := range []string{"cslpc", "cslpp"} {
+			if f := h.usecaseEntity(name).FeatureOfTypeAndRole(model.FeatureTypeTypeLoadControl, model.RoleTypeServer); f != nil {
+				f.SetWriteApprovalTimeout(h.config.Approval.timeout())
+			}
+		}
+		fmt.Printf("Limit approval mode: %s\n", h.config.Approval.mode())
+	}
+}
+
+// HandleCsLPC Controllable System LPC Handler
+func (h *hems) HandleCsLPC(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
+	fmt.Println("CsLPC Event: ", event)
+
+	peer := h.getOrCreatePeer(ski)
+
+	switch event {
+	case cslpc.UseCaseSupportUpdate:
+		h.updateUsecaseSupport(peer, "CSLPC")
+	case cslpc.WriteApprovalRequired:
+		h.addPendingApprovals(ski, "LPC", h.uccslpc.PendingConsumptionLimits())
+	case cslpc.DataUpdateLimit:
+		limit, err := h.uccslpc.ConsumptionLimit()
+		if err != nil {
+			fmt.Println("Error getting CS ConsumptionLimit:", err)
+		} else {
+			peer.usecaseData.CsLpcLimitValue = limit.Value
+			peer.usecaseData.CsLpcLimitDurSeconds = limit.Duration / time.Second
+			peer.usecaseData.CsLpcLimitActive = limit.IsActive
+		}
+	case cslpc.DataUpdateFailsafeConsumptionActivePowerLimit:
+		value, _, err := h.uccslpc.FailsafeConsumptionActivePowerLimit()
+		if err != nil {
+			fmt.Println("Error getting CS FailsafeConsumptionActivePowerLimit:", err)
+		} else {
+			peer.usecaseData.CsLpcFailsafePower = value
+		}
+	case cslpc.DataUpdateFailsafeDurationMinimum:
+		duration, _, err := h.uccslpc.FailsafeDurationMinimum()
+		if err != nil {
+			fmt.Println("Error getting CS FailsafeDurationMinimum:", err)
+		} else {
+			peer.usecaseData.CsLpcFailsafeDur = duration / time.Minute
+		}
+	case cslpc.DataUpdateHeartbeat:
+		peer.usecaseData.CsLpcHeartbeatOk = h.superviseHeartbeat(ski, "CSLPC", entity)
+	}
+	h.publishUsecaseUpdate(ski, "CSLPC", event, device, entity, peer)
+}
+
+// HandleCsLPP Controllable System LPP Handler
+func (h *hems) HandleCsLPP(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
+	fmt.Println("CsLPP Event: ", event)
+
+	peer := h.getOrCreatePeer(ski)
+
+	switch event {
+	case cslpp.UseCaseSupportUpdate:
+		h.updateUsecaseSupport(peer, "CSLPP")
+	case cslpp.WriteApprovalRequired:
+		h.addPendingApprovals(ski, "LPP", h.uccslpp.PendingProductionLimits())
+	case cslpp.DataUpdateLimit:
+		limit, err := h.uccslpp.ProductionLimit()
+		if err != nil {
+			fmt.Println("Error getting CS ProductionLimit:", err)
+		} else {
+			peer.usecaseData.CsLppLimitValue = limit.Value
+			peer.usecaseData.CsLppLimitDurSeconds = limit.Duration / time.Second
+			peer.usecaseData.CsLppLimitActive = limit.IsActive
+		}
+	case cslpp.DataUpdateFailsafeProductionActivePowerLimit:
+		value, _, err := h.uccslpp.FailsafeProductionActivePowerLimit()
+		if err != nil {
+			fmt.Println("Error getting CS FailsafeProductionActivePowerLimit:", err)
+		} else {
+			peer.usecaseData.CsLppFailsafePower = value
+		}
+	case cslpp.DataUpdateFailsafeDurationMinimum:
+		duration, _, err := h.uccslpp.FailsafeDurationMinimum()
+		if err != nil {
+			fmt.Println("Error getting CS FailsafeDurationMinimum:", err)
+		} else {
+			peer.usecaseData.CsLppFailsafeDur = duration / time.Minute
+		}
+	case cslpp.DataUpdateHeartbeat:
+		peer.usecaseData.CsLppHeartbeatOk = h.superviseHeartbeat(ski, "CSLPP", entity)
+	}
+	h.publishUsecaseUpdate(ski, "CSLPP", event, device, entity, peer)
+}
+
+// addPendingApprovals records new pending limits and schedules the automatic decision
+func (h *hems) addPendingApprovals(ski, usecase string, limits map[model.MsgCounterType]ucapi.LoadLimit) {
+	cfg := h.config.Approval
+	now := time.Now()
+
+	for msgCounter, limit := range limits {
+		id := approvalID(ski, usecase, msgCounter)
+
+		h.approvals.mu.Lock()
+		if _, ok := h.approvals.items[id]; ok {
+			h.approvals.mu.Unlock()
+			continue
+		}
+		item := &pendingApproval{
+			ID:              id,
+			Usecase:         usecase,
+			SKI:             ski,
+			MsgCounter:      uint64(msgCounter),
+			Value:           limit.Value,
+			DurationSeconds: int64(limit.Duration / time.Second),
+			IsActive:        limit.IsActive,
+			State:           approvalPending,
+			ReceivedAt:      now,
+			ExpiresAt:       now.Add(cfg.timeout()),
+		}
+		h.approvals.items[id] = item
+		snap := *item
+		h.approvals.mu.Unlock()
+
+		fmt.Printf("Limit write %s requires approval: %v W, %d s, active=%v\n", id, snap.Value, snap.DurationSeconds, snap.IsActive)
+		h.broadcastApproval(snap)
+
+		switch cfg.mode() {
+		case "accept", "deny":
+			approve := cfg.mode() == "accept"
+			time.AfterFunc(time.Duration(cfg.DelayMs)*time.Millisecond, func() {
+				_ = h.decideApproval(id, approve, cfg.Reason, "auto")
+			})
+		}
+		time.AfterFunc(cfg.timeout(), func() {
+			h.expireApproval(id)
+		})
+	}
+}
+
+// decideApproval accepts or denies a pending limit write
+func (h *hems) decideApproval(id string, approve bool, reason, decidedBy string) error {
+	if h.approvals == nil {
+		return fmt.Errorf("controllable system mode not enabled")
+	}
+	h.approvals.mu.Lock()
+	item, ok := h.approvals.items[id]
+	if !ok {
+		h.approvals.mu.Unlock()
+		return fmt.Errorf("approval %s not found", id)
+	}
+	if item.State != approvalPending {
+		h.approvals.mu.Unlock()
+		return fmt.Errorf("approval %s is already %s", id, item.State)
+	}
+	now := time.Now()
+	item.DecidedAt = &now
+	item.DecidedBy = decidedBy
+	item.Reason = reason
+	item.State = approvalDenied
+	if approve {
+		item.State = approvalAccepted
+	}
+	snap := *item
+	h.approvals.mu.Unlock()
+
+	msgCounter := model.MsgCounterType(snap.MsgCounter)
+	switch snap.Usecase {
+	case "LPC":
+		h.uccslpc.ApproveOrDenyConsumptionLimit(msgCounter, approve, reason)
+	case "LPP":
+		h.uccslpp.ApproveOrDenyProductionLimit(msgCounter, approve, reason)
+	}
+
+	fmt.Printf("Limit write %s %s by %s\n", id, snap.State, decidedBy)
+	h.broadcastApproval(snap)
+	return nil
+}
+
+// expireApproval marks an undecided approval as expired, SPINE answers the
+// write with an error once the approval timeout passed
+func (h *hems) expireApproval(id string) {
+	h.approvals.mu.Lock()
+	item, ok := h.approvals.items[id]
+	if !ok || item.State != approvalPending {
+		h.approvals.mu.Unlock()
+		return
+	}
+	item.State = approvalExpired
+	snap := *item
+	h.approvals.mu.Unlock()
+
+	fmt.Printf("Limit write %s expired without decision\n", id)
+	h.broadcastApproval(snap)
+}
+
+// getApprovals returns all recorded approvals, newest first
+func (h *hems) getApprovals() []pendingApproval {
+	out := []pendingApproval{}
+	if h.approvals == nil {
+		return out
+	}
+	h.approvals.mu.Lock()
+	for _, item := range h.approvals.items {
+		out = append(out, *item)
+	}
+	h.approvals.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ReceivedAt.After(out[j].ReceivedAt) })
+	return out
+}
+
+func (h *hems) broadcastApproval(item pendingApproval) {
+	h.broadcastJSON(map[string]interface{}{
+		"type":     "approval",
+		"ski":      item.SKI,
+		"approval": item,
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// diagnosticModules are the dependencies whose versions matter for issue reports
+var diagnosticModules = []string{
+	"github.com/enbility/eebus-go",
+	"github.com/enbility/ship-go",
+	"github.com/enbility/spine-go",
+}
+
+// diagnosticVersion describes the tester build and the host it runs on
+type diagnosticVersion struct {
+	CreatedAt time.Time `json:"createdAt"`
+	GoVersion string    `json:"goVersion"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Module    string    `json:"module,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	// Revision and Modified are the VCS state the binary was built from
+	Revision     string            `json:"revision,omitempty"`
+	Modified     bool              `json:"modified,omitempty"`
+	Dependencies map[string]string `json:"dependencies"`
+	LocalSKI     string            `json:"localSki,omitempty"`
+	// SKI is the DUT the bundle was limited to
+	SKI string `json:"ski,omitempty"`
+}
+
+func (h *hems) diagnosticVersion(ski string) diagnosticVersion {
+	v := diagnosticVersion{
+		CreatedAt:    time.Now(),
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Dependencies: make(map[string]string),
+		SKI:          ski,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		v.Module = info.Main.Path
+		v.Version = info.Main.Version
+		for _, dep := range info.Deps {
+			for _, m := range diagnosticModules {
+				if dep.Path == m {
+					v.Dependencies[m] = dep.Version
+				}
+			}
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v.Revision = s.Value
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	if h.myService != nil {
+		v.LocalSKI = h.myService.LocalService().SKI()
+	}
+	return v
+}
+
+// writeDiagnosticBundle writes a zip with everything needed for an issue report: version
+// info, the redacted config, the log buffer, peers, entity snapshots, events, statistics
+// and the captured SPINE datagrams and SHIP frames. A SKI limits the peer specific parts
+// to one DUT, the log buffer is not kept per peer and always included entirely. With an
+// anonymizer the identifying values are replaced in all files and file names. The config
+// is only included with withConfig, like /api/config it is reserved to admins.
+func (h *hems) writeDiagnosticBundle(w io.Writer, ski string, since time.Time, anon *anonymizer, withConfig bool) error {
+	ski = shiputil.NormalizeSKI(ski)
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	add := func(name string, write func(io.Writer) error) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: anon.applyString(name), Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		out := anon.wrap(f)
+		if err := write(out); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	addJSON := func(name string, v interface{}) error {
+		return add(name, func(f io.Writer) error {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			return enc.Encode(v)
+		})
+	}
+
+	if err := addJSON("version.json", h.diagnosticVersion(ski)); err != nil {
+		return err
+	}
+	if withConfig {
+		if err := addJSON("config.json", h.config.redacted()); err != nil {
+			return err
+		}
+	}
+	if err := add("logs.txt", func(f io.Writer) error {
+		for _, line := range h.getLogs() {
+			if _, err := io.WriteString(f, line+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	peers := []PeerInfo{}
+	for _, p := range h.peerInfos() {
+		if ski == "" || shiputil.NormalizeSKI(p.SKI) == ski {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].SKI < peers[j].SKI })
+	if err := addJSON("peers.json", peers); err != nil {
+		return err
+	}
+	for _, p := range peers {
+		peer := h.getPeer(p.SKI)
+		if peer == nil {
+			continue
+		}
+		snap := peer.entities.snapshot()
+		if snap.JSON == nil {
+			continue
+		}
+		if err := add("entities/"+p.SKI+".json", func(f io.Writer) error {
+			_, err := f.Write(snap.JSON)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := addJSON("events.json", h.getEvents(eventFilter{SKI: ski, Since: since})); err != nil {
+		return err
+	}
+	if err := addJSON("stats.json", h.getStats(ski)); err != nil {
+		return err
+	}
+	if err := addJSON("datagrams.json", h.getDatagrams(datagramFilter{SKI: ski, Since: since})); err != nil {
+		return err
+	}
+	frames := []shipFrame{}
+	for _, f := range h.getShipFrames(ski, nil, 0) {
+		if !f.Time.Before(since) {
+			frames = append(frames, f)
+		}
+	}
+	if err := addJSON("ship-frames.json", frames); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// diagnosticBundleName is the download file name of a bundle
+func diagnosticBundleName(ski string, t time.Time) string {
+	name := "device-tester-diagnostics-" + t.Format("20060102-150405")
+	if ski != "" {
+		name += "-" + strings.ToLower(ski)
+	}
+	return fmt.Sprintf("%s.zip", name)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// defaultDUTFile keeps the DUT registry in the working directory
+const defaultDUTFile = "duts.json"
+
+// maxDUTSessions is the number of finished charging sessions kept per DUT
+const maxDUTSessions = 1000
+
+var errUnknownDUT = errors.New("unknown DUT")
+
+// DUTRegistryConfig configures the registry of the devices under test
+type DUTRegistryConfig struct {
+	// File is the registry file, defaults to duts.json
+	File string `json:"file,omitempty"`
+}
+
+func (c DUTRegistryConfig) file() string {
+	if c.File != "" {
+		return c.File
+	}
+	return defaultDUTFile
+}
+
+// dutEntry is a device under test with the charging sessions recorded while it was
+// connected. Test runs link to the entry by its id.
+type dutEntry struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Vendor   string `json:"vendor,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	// SKI links connections of the DUT to the entry, a SKI belongs to one entry
+	SKI       string            `json:"ski,omitempty"`
+	Notes     string            `json:"notes,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Sessions  []chargingSession `json:"sessions"`
+}
+
+// dutRequest creates or changes a DUT entry, unset fields keep their value on updates
+type dutRequest struct {
+	Name     *string `json:"name"`
+	Vendor   *string `json:"vendor"`
+	Model    *string `json:"model"`
+	Firmware *string `json:"firmware"`
+	SKI      *string `json:"ski"`
+	Notes    *string `json:"notes"`
+}
+
+// dutSummary is the list entry of a DUT
+type dutSummary struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Vendor    string    `json:"vendor,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Firmware  string    `json:"firmware,omitempty"`
+	SKI       string    `json:"ski,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	Connected bool      `json:"connected"`
+	Sessions  int       `json:"sessions"`
+	TestRuns  int       `json:"testRuns"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// dutDetail is a DUT entry with its sessions and test runs
+type dutDetail struct {
+	dutEntry
+	Connected bool             `json:"connected"`
+	TestRuns  []testRunSummary `json:"testRuns"`
+}
+
+// dutRegistry persists the DUT entries
+type dutRegistry struct {
+	mu     sync.Mutex
+	path   string
+	nextID int
+	duts   map[string]*dutEntry
+}
+
+// loadDUTs reads the DUT registry file
+func (h *hems) loadDUTs() {
+	h.duts = &dutRegistry{path: h.config.DUTRegistry.file(), duts: make(map[string]*dutEntry)}
+	data, err := os.ReadFile(h.duts.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.Errorf("dut registry: %v", err)
+		}
+		return
+	}
+	var entries []*dutEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		h.Errorf("dut registry %s: %v", h.duts.path, err)
+		return
+	}
+	for _, e := range entries {
+		if e.Sessions == nil {
+			e.Sessions = []chargingSession{}
+		}
+		h.duts.duts[e.ID] = e
+		if n, err := strconv.Atoi(strings.TrimPrefix(e.ID, "dut-")); err == nil && n > h.duts.nextID {
+			h.duts.nextID = n
+		}
+	}
+	h.Infof("%d DUTs loaded from %s", len(entries), h.duts.path)
+}
+
+// save writes the registry, the caller holds the lock
+func (r *dutRegistry) save() error {
+	entries := make([]*dutEntry, 0, len(r.duts))
+	for _, e := range r.duts {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.path, b, 0644); err != nil {
+		return fmt.Errorf("write %s: %w", r.path, err)
+	}
+	return nil
+}
+
+// bySKI returns the entry linked to a SKI, the caller holds the lock
+func (r *dutRegistry) bySKI(ski string) *dutEntry {
+	ski = shiputil.NormalizeSKI(ski)
+	if ski == "" {
+		return nil
+	}
+	for _, e := range r.duts {
+		if e.SKI == ski {
+			return e
+		}
+	}
+	return nil
+}
+
+// dutForSKI returns the id of the DUT entry linked to a SKI, empty if there is none
+func (h *hems) dutForSKI(ski string) string {
+	if h.duts == nil {
+		return ""
+	}
+	h.duts.mu.Lock()
+	defer h.duts.mu.Unlock()
+	if e := h.duts.bySKI(ski); e != nil {
+		return e.ID
+	}
+	return ""
+}
+
+// dutFirmware returns the firmware of a DUT entry, empty if it is unknown
+func (h *hems) dutFirmware(id string) string {
+	if h.duts == nil || id == "" {
+		return ""
+	}
+	h.duts.mu.Lock()
+	defer h.duts.mu.Unlock()
+	if e := h.duts.duts[id]; e != nil {
+		return e.Firmware
+	}
+	return ""
+}
+
+// apply sets the fields of the request, the caller holds the lock
+func (r *dutRegistry) apply(e *dutEntry, req dutRequest) error {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		}
+	}
+	set(&e.Name, req.Name)
+	set(&e.Vendor, req.Vendor)
+	set(&e.Model, req.Model)
+	set(&e.Firmware, req.Firmware)
+	set(&e.Notes, req.Notes)
+	if e.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if req.SKI != nil {
+		ski := shiputil.NormalizeSKI(strings.TrimSpace(*req.SKI))
+		if other := r.bySKI(ski); other != nil && other.ID != e.ID {
+			return fmt.Errorf("SKI %s is already linked to %s (%s)", ski, other.ID, other.Name)
+		}
+		e.SKI = ski
+	}
+	return nil
+}
+
+// createDUT adds a DUT entry. Vendor and model default to the brand and model the DUT
+// reported if it is a known peer.
+func (h *hems) createDUT(req dutRequest) (*dutEntry, error) {
+	now := time.Now()
+	e := &dutEntry{CreatedAt: now, UpdatedAt: now, Sessions: []chargingSession{}}
+	h.duts.mu.Lock()
+	defer h.duts.mu.Unlock()
+	if err := h.duts.apply(e, req); err != nil {
+		return nil, err
+	}
+	if peer := h.getPeer(e.SKI); e.SKI != "" && peer != nil {
+		h.peersMu.Lock()
+		if e.Vendor == "" {
+			e.Vendor = peer.brand
+		}
+		if e.Model == "" {
+			e.Model = peer.model
+		}
+		h.peersMu.Unlock()
+	}
+	h.duts.nextID++
+	e.ID = fmt.Sprintf("dut-%d", h.duts.nextID)
+	h.duts.duts[e.ID] = e
+	if err := h.duts.save(); err != nil {
+		delete(h.duts.duts, e.ID)
+		return nil, err
+	}
+	h.Infof("DUT %s (%s) added", e.ID, e.Name)
+	out := *e
+	return &out, nil
+}
+
+// updateDUT changes the fields of a DUT entry
+func (h *hems) updateDUT(id string, req dutRequest) (*dutEntry, error) {
+	h.duts.mu.Lock()
+	defer h.duts.mu.Unlock()
+	e, ok := h.duts.duts[id]
+	if !ok {
+		return nil, errUnknownDUT
+	}
+	updated := *e
+	if err := h.duts.apply(&updated, req); err != nil {
+		return nil, err
+	}
+	updated.UpdatedAt = time.Now()
+	*e = updated
+	if err := h.duts.save(); err != nil {
+		return nil, err
+	}
+	out := *e
+	return &out, nil
+}
+
+// deleteDUT removes a DUT entry with its sessions, stored test runs keep the id
+func (h *hems) deleteDUT(id string) error {
+	h.duts.mu.Lock()
+	defer h.duts.mu.Unlock()
+	if _, ok := h.duts.duts[id]; !ok {
+		return errUnknownDUT
+	}
+	delete(h.duts.duts, id)
+	return h.duts.save()
+}
+
+// dutSessionEnded adds a finished charging session to the DUT of the SKI
+func (h *hems) dutSessionEnded(s chargingSession) {
+	if h.duts == nil {
+		return
+	}
+	h.duts.mu.Lock()
+	defer h.duts.mu.Unlock()
+	e := h.duts.duts[s.DUT]
+	if e == nil {
+		return
+	}
+	e.Sessions = append(e.Sessions, s)
+	if len(e.Sessions) > maxDUTSessions {
+		e.Sessions = e.Sessions[len(e.Sessions)-maxDUTSessions:]
+	}
+	if err := h.duts.save(); err != nil {
+		h.Errorf("dut registry: %v", err)
+	}
+}
+
+// dutTestRuns returns the stored test runs of a DUT, runs stored before the DUT was
+// registered are matched by its SKI
+func dutTestRuns(e *dutEntry, runs []testRunSummary) []testRunSummary {
+	out := []testRunSummary{}
+	for _, r := range runs {
+		if r.DUT == e.ID || (r.DUT == "" && e.SKI != "" && shiputil.NormalizeSKI(r.SKI) == e.SKI) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (h *hems) dutConnected(ski string) bool {
+	if ski == "" {
+		return false
+	}
+	peer := h.getPeer(ski)
+	if peer == nil {
+		return false
+	}
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	return peer.connected
+}
+
+// getDUTs returns all DUT entries sorted by name
+func (h *hems) getDUTs() ([]dutSummary, error) {
+	runs, err := h.listTestRuns()
+	if err != nil {
+		return nil, err
+	}
+	h.duts.mu.Lock()
+	out := make([]dutSummary, 0, len(h.duts.duts))
+	for _, e := range h.duts.duts {
+		out = append(out, dutSummary{
+			ID: e.ID, Name: e.Name, Vendor: e.Vendor, Model: e.Model, Firmware: e.Firmware, SKI: e.SKI, Notes: e.Notes,
+			Sessions: len(e.Sessions), TestRuns: len(dutTestRuns(e, runs)), UpdatedAt: e.UpdatedAt,
+		})
+	}
+	h.duts.mu.Unlock()
+	for i := range out {
+		out[i].Connected = h.dutConnected(out[i].SKI)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// getDUT returns a DUT entry with its sessions, newest first, including the active
+// session, and its stored test runs
+func (h *hems) getDUT(id string) (*dutDetail, error) {
+	runs, err := h.listTestRuns()
+	if err != nil {
+		return nil, err
+	}
+	h.duts.mu.Lock()
+	e, ok := h.duts.duts[id]
+	if !ok {
+		h.duts.mu.Unlock()
+		return nil, errUnknownDUT
+	}
+	d := &dutDetail{dutEntry: *e, TestRuns: dutTestRuns(e, runs)}
+	d.Sessions = append([]chargingSession{}, e.Sessions...)
+	h.duts.mu.Unlock()
+
+	for _, s := range h.getSessions("") {
+		if s.Active && s.DUT == id {
+			d.Sessions = append(d.Sessions, s)
+		}
+	}
+	sort.SliceStable(d.Sessions, func(i, j int) bool { return d.Sessions[i].StartedAt.After(d.Sessions[j].StartedAt) })
+	d.Connected = h.dutConnected(d.SKI)
+	return d, nil
+}
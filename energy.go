@@ -0,0 +1,253 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// EnergyConfig configures the energy accounting derived from EVCEM measurements
+type EnergyConfig struct {
+	// TolerancePercent is the allowed deviation between integrated energy and the DUT energy counter, defaults to 5
+	TolerancePercent float64 `json:"tolerancePercent,omitempty"`
+	// MinEnergyWh is the counter energy required before the plausibility check is evaluated, defaults to 100
+	MinEnergyWh float64 `json:"minEnergyWh,omitempty"`
+	// NominalVoltage is used to estimate power from currents if the DUT reports no power, defaults to 230
+	NominalVoltage float64 `json:"nominalVoltage,omitempty"`
+	// MaxGapSeconds is the longest interval between two samples that is still integrated, defaults to 300
+	MaxGapSeconds int `json:"maxGapSeconds,omitempty"`
+}
+
+func (c EnergyConfig) tolerance() float64 {
+	if c.TolerancePercent <= 0 {
+		return 5
+	}
+	return c.TolerancePercent
+}
+
+func (c EnergyConfig) minEnergy() float64 {
+	if c.MinEnergyWh <= 0 {
+		return 100
+	}
+	return c.MinEnergyWh
+}
+
+func (c EnergyConfig) voltage() float64 {
+	if c.NominalVoltage <= 0 {
+		return 230
+	}
+	return c.NominalVoltage
+}
+
+func (c EnergyConfig) maxGap() time.Duration {
+	if c.MaxGapSeconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.MaxGapSeconds) * time.Second
+}
+
+// energyAccount integrates the EVCEM samples of a single peer
+type energyAccount struct {
+	SKI       string    `json:"ski"`
+	StartedAt time.Time `json:"startedAt"`
+	// Source is "power" or "current" (estimated with the nominal voltage)
+	Source               string    `json:"source,omitempty"`
+	Samples              int       `json:"samples"`
+	Gaps                 int       `json:"gaps"`
+	IntegratedWhPerPhase []float64 `json:"integratedWhPerPhase"`
+	IntegratedWh         float64   `json:"integratedWh"`
+	AvgPowerPerPhase     []float64 `json:"avgPowerPerPhase"`
+	CounterWh            float64   `json:"counterWh"`
+	DeviationPercent     *float64  `json:"deviationPercent,omitempty"`
+	Plausible            *bool     `json:"plausible,omitempty"`
+
+	lastSample     time.Time
+	lastPower      []float64
+	integratedSecs float64
+	counterStart   float64
+	counterLast    float64
+	counterBase    float64
+	hasCounter     bool
+}
+
+// energyStore keeps the energy accounts of all peers
+type energyStore struct {
+	mu       sync.Mutex
+	accounts map[string]*energyAccount
+}
+
+func newEnergyStore() *energyStore {
+	return &energyStore{accounts: make(map[string]*energyAccount)}
+}
+
+func (s *energyStore) account(ski string) *energyAccount {
+	a, ok := s.accounts[ski]
+	if !ok {
+		a = &energyAccount{SKI: ski, StartedAt: time.Now()}
+		s.accounts[ski] = a
+	}
+	return a
+}
+
+// integrate adds the energy since the last sample using the previous power values,
+// EVCEM values are reported on change so they hold until the next update
+func (a *energyAccount) integrate(now time.Time, maxGap time.Duration) {
+	if a.lastSample.IsZero() {
+		return
+	}
+	dt := now.Sub(a.lastSample)
+	if dt > maxGap {
+		a.Gaps++
+		return
+	}
+	for len(a.IntegratedWhPerPhase) < len(a.lastPower) {
+		a.IntegratedWhPerPhase = append(a.IntegratedWhPerPhase, 0)
+	}
+	for i, p := range a.lastPower {
+		a.IntegratedWhPerPhase[i] += p * dt.Hours()
+	}
+	a.integratedSecs += dt.Seconds()
+}
+
+func (a *energyAccount) addSample(now time.Time, source string, powerPerPhase []float64, maxGap time.Duration) {
+	// power samples take precedence over the current based estimation
+	if a.Source == "power" && source == "current" {
+		return
+	}
+	if a.Source == "current" && source == "power" {
+		a.IntegratedWhPerPhase = nil
+		a.integratedSecs = 0
+		a.lastSample = time.Time{}
+	}
+	a.Source = source
+	a.integrate(now, maxGap)
+	a.lastSample = now
+	a.lastPower = append([]float64(nil), powerPerPhase...)
+	a.Samples++
+}
+
+func (a *energyAccount) addCounter(energyWh float64) {
+	if !a.hasCounter {
+		a.counterStart = energyWh
+		a.hasCounter = true
+	} else if energyWh < a.counterLast {
+		// counter reset by the DUT
+		a.counterBase += a.counterLast - a.counterStart
+		a.counterStart = energyWh
+	}
+	a.counterLast = energyWh
+}
+
+// snapshot returns a copy of the account including the derived values up to now
+func (a *energyAccount) snapshot(now time.Time, cfg EnergyConfig) energyAccount {
+	out := *a
+	out.IntegratedWhPerPhase = append([]float64(nil), a.IntegratedWhPerPhase...)
+	secs := a.integratedSecs
+
+	// include the energy of the currently held values
+	if !a.lastSample.IsZero() {
+		if dt := now.Sub(a.lastSample); dt <= cfg.maxGap() {
+			for len(out.IntegratedWhPerPhase) < len(a.lastPower) {
+				out.IntegratedWhPerPhase = append(out.IntegratedWhPerPhase, 0)
+			}
+			for i, p := range a.lastPower {
+				out.IntegratedWhPerPhase[i] += p * dt.Hours()
+			}
+			secs += dt.Seconds()
+		}
+	}
+
+	out.IntegratedWh = 0
+	out.AvgPowerPerPhase = make([]float64, len(out.IntegratedWhPerPhase))
+	for i, wh := range out.IntegratedWhPerPhase {
+		out.IntegratedWh += wh
+		if secs > 0 {
+			out.AvgPowerPerPhase[i] = wh * 3600 / secs
+		}
+	}
+
+	out.CounterWh = a.counterBase + a.counterLast - a.counterStart
+	if a.hasCounter && out.CounterWh >= cfg.minEnergy() {
+		deviation := (out.IntegratedWh - out.CounterWh) / out.CounterWh * 100
+		plausible := math.Abs(deviation) <= cfg.tolerance()
+		out.DeviationPercent = &deviation
+		out.Plausible = &plausible
+	}
+	return out
+}
+
+func (h *hems) energyConfig() EnergyConfig {
+	if h.config == nil {
+		return EnergyConfig{}
+	}
+	return h.config.Energy
+}
+
+// energyPowerSample integrates an EVCEM power per phase update
+func (h *hems) energyPowerSample(ski string, powerPerPhase []float64) {
+	h.energySample(ski, "power", powerPerPhase)
+}
+
+// energyCurrentSample integrates an EVCEM current per phase update, estimating the power with the nominal voltage
+func (h *hems) energyCurrentSample(ski string, currentPerPhase []float64) {
+	voltage := h.energyConfig().voltage()
+	power := make([]float64, len(currentPerPhase))
+	for i, c := range currentPerPhase {
+		power[i] = c * voltage
+	}
+	h.energySample(ski, "current", power)
+}
+
+func (h *hems) energySample(ski, source string, powerPerPhase []float64) {
+	cfg := h.energyConfig()
+	now := time.Now()
+
+	h.energy.mu.Lock()
+	a := h.energy.account(ski)
+	a.addSample(now, source, powerPerPhase, cfg.maxGap())
+	h.energy.mu.Unlock()
+}
+
+// energyCounter records the DUT energy counter and flags discrepancies to the integrated energy
+func (h *hems) energyCounter(ski string, energyWh float64) {
+	cfg := h.energyConfig()
+
+	h.energy.mu.Lock()
+	a := h.energy.account(ski)
+	wasPlausible := a.Plausible == nil || *a.Plausible
+	a.addCounter(energyWh)
+	snap := a.snapshot(time.Now(), cfg)
+	a.DeviationPercent = snap.DeviationPercent
+	a.Plausible = snap.Plausible
+	h.energy.mu.Unlock()
+
+	if snap.Plausible != nil && !*snap.Plausible && wasPlausible {
+		h.Errorf("energy counter of %s deviates %.1f%% from integrated EVCEM energy (counter %.1f Wh, integrated %.1f Wh, tolerance %.1f%%)",
+			ski, *snap.DeviationPercent, snap.CounterWh, snap.IntegratedWh, cfg.tolerance())
+	}
+}
+
+// resetEnergyAccount starts a new accounting period for a peer
+func (h *hems) resetEnergyAccount(ski string) {
+	h.energy.mu.Lock()
+	delete(h.energy.accounts, ski)
+	h.energy.mu.Unlock()
+}
+
+// getEnergyAccounts returns the energy accounts of a peer (or all peers if ski is empty)
+func (h *hems) getEnergyAccounts(ski string) []energyAccount {
+	cfg := h.energyConfig()
+	now := time.Now()
+
+	h.energy.mu.Lock()
+	defer h.energy.mu.Unlock()
+
+	out := []energyAccount{}
+	for k, a := range h.energy.accounts {
+		if ski != "" && k != ski {
+			continue
+		}
+		out = append(out, a.snapshot(now, cfg))
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+// entityStore holds the discovered entities of a peer together with their JSON
+// representation. Both are replaced at once, readers get a consistent snapshot of
+// the same version while the SPINE callbacks update the store during discovery.
+type entityStore struct {
+	mu        sync.RWMutex
+	entities  []spineapi.EntityRemoteInterface
+	json      []byte
+	version   uint64
+	updatedAt time.Time
+	// classified are the entities whose DeviceClassification data was requested
+	classified map[spineapi.EntityRemoteInterface]bool
+}
+
+// entitySnapshot is a copy of the store, it is not changed by later updates
+type entitySnapshot struct {
+	Entities []spineapi.EntityRemoteInterface
+	// JSON is the entities websocket message, nil before the first update
+	JSON []byte
+	// Version increases with every update, 0 before the first one
+	Version   uint64
+	UpdatedAt time.Time
+}
+
+// update replaces the entities and their JSON, which build renders for the new
+// version. The store stays locked while building so concurrent updates can't store
+// the JSON of one discovery state with the entities of another.
+func (s *entityStore) update(entities []spineapi.EntityRemoteInterface, build func(entities []spineapi.EntityRemoteInterface, version uint64) ([]byte, error)) ([]byte, error) {
+	entities = append([]spineapi.EntityRemoteInterface(nil), entities...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := build(entities, s.version+1)
+	if err != nil {
+		return nil, err
+	}
+	// entities of a previous connection are new objects, they are requested again
+	for e := range s.classified {
+		if !containsEntity(entities, e) {
+			delete(s.classified, e)
+		}
+	}
+	s.entities = entities
+	s.json = b
+	s.version++
+	s.updatedAt = time.Now()
+	return b, nil
+}
+
+func (s *entityStore) snapshot() entitySnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return entitySnapshot{
+		Entities:  append([]spineapi.EntityRemoteInterface(nil), s.entities...),
+		JSON:      append([]byte(nil), s.json...),
+		Version:   s.version,
+		UpdatedAt: s.updatedAt,
+	}
+}
+
+// clear empties the store and returns the dropped entities. The version increases, so
+// clients holding the previous version see the change.
+func (s *entityStore) clear() []spineapi.EntityRemoteInterface {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := s.entities
+	s.entities = nil
+	s.json = nil
+	s.version++
+	s.updatedAt = time.Now()
+	return dropped
+}
+
+// claimClassification returns true once per entity, for the caller to request its
+// DeviceClassification data
+func (s *entityStore) claimClassification(entity spineapi.EntityRemoteInterface) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.classified[entity] {
+		return false
+	}
+	if s.classified == nil {
+		s.classified = make(map[spineapi.EntityRemoteInterface]bool)
+	}
+	s.classified[entity] = true
+	return true
+}
+
+func containsEntity(entities []spineapi.EntityRemoteInterface, entity spineapi.EntityRemoteInterface) bool {
+	for _, e := range entities {
+		if e == entity {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults of the power envelope test
+const (
+	defaultEnvelopeStep      = time.Minute
+	defaultEnvelopeTolerance = 100.0
+)
+
+// defaultEnvelopeSteps are the limits of the envelope test, ending with the release of the limit
+var defaultEnvelopeSteps = []envelopeStepRequest{
+	{ValueW: 11000, Active: true},
+	{ValueW: 6000, Active: true},
+	{ValueW: 4200, Active: true},
+	{ValueW: 0, Active: true},
+	{Active: false},
+}
+
+// envelopeStepRequest is a consumption limit of the envelope test, an inactive limit releases it
+type envelopeStepRequest struct {
+	ValueW float64 `json:"valueW"`
+	Active bool    `json:"active"`
+}
+
+// envelopeTestRequest starts a power envelope test
+type envelopeTestRequest struct {
+	SKI   string                `json:"ski"`
+	Steps []envelopeStepRequest `json:"steps,omitempty"`
+	// StepSeconds is the time every limit is kept, defaults to 60
+	StepSeconds float64 `json:"stepSeconds,omitempty"`
+	// ToleranceWatts is the accepted power above the limit for the power to be settled, defaults to 100
+	ToleranceWatts float64 `json:"toleranceWatts,omitempty"`
+	// MaxSettleSeconds fails a step that settles later, by default the power only has to settle within the step
+	MaxSettleSeconds float64 `json:"maxSettleSeconds,omitempty"`
+	// MaxOvershootWatts fails a step with a larger overshoot, not checked by default
+	MaxOvershootWatts float64 `json:"maxOvershootWatts,omitempty"`
+	SampleIntervalMs  int     `json:"sampleIntervalMs,omitempty"`
+	// Restore writes the limit active before the test after the last step, defaults to true
+	Restore *bool `json:"restore,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// envelopeStep is a limit of the envelope test and the measured response
+type envelopeStep struct {
+	ValueW    float64      `json:"valueW"`
+	Active    bool         `json:"active"`
+	StartedAt *time.Time   `json:"startedAt,omitempty"`
+	EndedAt   *time.Time   `json:"endedAt,omitempty"`
+	Command   string       `json:"command,omitempty"`
+	State     commandState `json:"state,omitempty"`
+	// AckSeconds is the time from sending the write until the DUT acknowledged it
+	AckSeconds *float64 `json:"ackSeconds,omitempty"`
+	// SettleSeconds is the time from the acknowledge until the power stayed within the limit
+	SettleSeconds *float64 `json:"settleSeconds,omitempty"`
+	// OvershootWatts is the largest excess over the limit after the power first reached it
+	OvershootWatts *float64 `json:"overshootWatts,omitempty"`
+	// MinW, MaxW and FinalW summarize the measured power of the step
+	MinW    *float64 `json:"minW,omitempty"`
+	MaxW    *float64 `json:"maxW,omitempty"`
+	FinalW  *float64 `json:"finalW,omitempty"`
+	Samples int      `json:"samples"`
+	Passed  bool     `json:"passed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// envelopeTestRun is an active or finished power envelope test
+type envelopeTestRun struct {
+	SKI               string     `json:"ski"`
+	Running           bool       `json:"running"`
+	StartedAt         time.Time  `json:"startedAt"`
+	EndedAt           *time.Time `json:"endedAt,omitempty"`
+	Source            string     `json:"source,omitempty"`
+	StepSeconds       float64    `json:"stepSeconds"`
+	ToleranceWatts    float64    `json:"toleranceWatts"`
+	MaxSettleSeconds  float64    `json:"maxSettleSeconds,omitempty"`
+	MaxOvershootWatts float64    `json:"maxOvershootWatts,omitempty"`
+	// RestoredLimit is the limit written after the last step
+	RestoredLimit *lpcLimitReading `json:"restoredLimit,omitempty"`
+	Steps         []envelopeStep   `json:"steps"`
+	Samples       []powerSample    `json:"samples"`
+	Passed        bool             `json:"passed"`
+	Error         string           `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// envelopeTestState holds the current or last envelope test
+type envelopeTestState struct {
+	mu  sync.Mutex
+	run *envelopeTestRun
+}
+
+// startEnvelopeTest starts a power envelope test in the background
+func (h *hems) startEnvelopeTest(req envelopeTestRequest) (*envelopeTestRun, error) {
+	if h.uceglpc == nil {
+		return nil, errors.New("LPC usecase is disabled")
+	}
+	if req.SKI == "" {
+		return nil, errors.New("ski is required")
+	}
+	if req.StepSeconds < 0 || req.ToleranceWatts < 0 || req.MaxSettleSeconds < 0 || req.MaxOvershootWatts < 0 {
+		return nil, errors.New("durations and tolerances must not be negative")
+	}
+	if _, _, ok := h.dutPower(req.SKI); !ok {
+		return nil, errors.New("no power reported by the DUT, MPC or EVCEM is required")
+	}
+	steps := defaultEnvelopeSteps
+	if len(req.Steps) > 0 {
+		steps = req.Steps
+	}
+	run := &envelopeTestRun{
+		SKI:               req.SKI,
+		Running:           true,
+		StartedAt:         time.Now(),
+		StepSeconds:       secondsOr(req.StepSeconds, defaultEnvelopeStep).Seconds(),
+		ToleranceWatts:    defaultEnvelopeTolerance,
+		MaxSettleSeconds:  req.MaxSettleSeconds,
+		MaxOvershootWatts: req.MaxOvershootWatts,
+		Metadata:          req.Metadata,
+	}
+	if req.ToleranceWatts > 0 {
+		run.ToleranceWatts = req.ToleranceWatts
+	}
+	for _, s := range steps {
+		if s.Active && s.ValueW < 0 {
+			return nil, errors.New("limit values must not be negative")
+		}
+		run.Steps = append(run.Steps, envelopeStep{ValueW: s.ValueW, Active: s.Active})
+	}
+	interval := defaultFailsafeSample
+	if req.SampleIntervalMs > 0 {
+		interval = time.Duration(req.SampleIntervalMs) * time.Millisecond
+	}
+
+	h.envelopeTests.mu.Lock()
+	if h.envelopeTests.run != nil && h.envelopeTests.run.Running {
+		h.envelopeTests.mu.Unlock()
+		return nil, errors.New("an envelope test is already running")
+	}
+	h.envelopeTests.run = run
+	snap := copyEnvelopeTestRun(run)
+	h.envelopeTests.mu.Unlock()
+
+	restore := req.Restore == nil || *req.Restore
+	go h.runEnvelopeTest(run, interval, restore)
+	h.recordEvent("envelopetest", severityInfo, req.SKI, fmt.Sprintf("envelope test with %d steps started", len(run.Steps)), nil)
+	return snap, nil
+}
+
+// runEnvelopeTest writes the limit of every step and records the measured response
+func (h *hems) runEnvelopeTest(run *envelopeTestRun, interval time.Duration, restore bool) {
+	span := h.tracer.startSpan("test envelope/lpc", spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	errText := ""
+	if readings, err := h.readLPC(run.SKI); err != nil {
+		errText = "read consumption limit: " + err.Error()
+	} else {
+		h.envelopeTests.mu.Lock()
+		run.RestoredLimit = readings[0].ConsumptionLimit
+		h.envelopeTests.mu.Unlock()
+	}
+
+	for i := 0; errText == "" && i < len(run.Steps); i++ {
+		h.envelopeTests.mu.Lock()
+		st := run.Steps[i]
+		h.envelopeTests.mu.Unlock()
+
+		name := "release"
+		if st.Active {
+			name = fmt.Sprintf("limit %.0f W", st.ValueW)
+		}
+		step := span.startSpan(name, spanKindInternal, time.Now(), attr("test.case", i+1))
+		h.runEnvelopeStep(run, i, &st, interval)
+		step.setAttrs(attr("command.id", st.Command), attr("test.passed", st.Passed))
+		step.end(time.Now(), st.Error)
+
+		h.envelopeTests.mu.Lock()
+		run.Steps[i] = st
+		h.envelopeTests.mu.Unlock()
+		h.broadcastEnvelopeTest()
+	}
+
+	if restore && run.RestoredLimit != nil {
+		limit := *run.RestoredLimit
+		payload := map[string]interface{}{"ski": run.SKI, "value": limit.Value, "isActive": limit.Active, "durationSeconds": limit.DurationSeconds}
+		durationSeconds := int64(limit.DurationSeconds)
+		if _, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+			return h.WriteLPCConsumptionLimit(run.SKI, durationSeconds, limit.Value, limit.Active)
+		}); err != nil {
+			h.Errorf("envelope test: restore limit: %v", err)
+		}
+	}
+
+	now := time.Now()
+	h.envelopeTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Error = errText
+	run.Passed = errText == ""
+	for _, st := range run.Steps {
+		if !st.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := envelopeTestResult(run)
+	h.envelopeTests.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("envelope test: %v", err)
+	} else {
+		h.envelopeTests.mu.Lock()
+		run.ResultID = result.ID
+		h.envelopeTests.mu.Unlock()
+	}
+	h.broadcastEnvelopeTest()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("envelope test %s", verdict)
+	h.recordEvent("envelopetest", severity, run.SKI, "envelope test "+verdict, nil)
+}
+
+// runEnvelopeStep writes the limit of a step and samples the power for the step duration
+func (h *hems) runEnvelopeStep(run *envelopeTestRun, index int, st *envelopeStep, interval time.Duration) {
+	start := time.Now()
+	st.StartedAt = &start
+	h.envelopeTests.mu.Lock()
+	run.Steps[index] = *st
+	h.envelopeTests.mu.Unlock()
+	h.broadcastEnvelopeTest()
+	defer func() {
+		end := time.Now()
+		st.EndedAt = &end
+	}()
+
+	payload := map[string]interface{}{"ski": run.SKI, "value": st.ValueW, "isActive": st.Active, "durationSeconds": 0}
+	value, active := st.ValueW, st.Active
+	c, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+		return h.WriteLPCConsumptionLimit(run.SKI, 0, value, active)
+	})
+	if err != nil {
+		st.Error = err.Error()
+		return
+	}
+	st.Command = c.ID
+	<-c.done
+	snap, _ := h.getCommand(c.ID)
+	st.State = snap.State
+	acked := snap.UpdatedAt
+	if !snap.startedAt.IsZero() {
+		ack := snap.UpdatedAt.Sub(snap.startedAt).Seconds()
+		st.AckSeconds = &ack
+	}
+	if snap.State != commandAcknowledged {
+		st.Error = snap.Error
+		if st.Error == "" {
+			st.Error = string(snap.State)
+		}
+		return
+	}
+
+	limit := st.ValueW + run.ToleranceWatts
+	phase := fmt.Sprintf("step %d", index+1)
+	var (
+		samples   []powerSample
+		settledAt *time.Time
+		reached   bool
+		overshoot float64
+	)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for end := start.Add(time.Duration(run.StepSeconds * float64(time.Second))); ; {
+		if power, source, ok := h.dutPower(run.SKI); ok {
+			s := powerSample{Time: time.Now(), PowerW: power, Phase: phase}
+			samples = append(samples, s)
+			h.envelopeTests.mu.Lock()
+			run.Source = source
+			run.Samples = append(run.Samples, s)
+			h.envelopeTests.mu.Unlock()
+			if st.Active {
+				if power > limit {
+					settledAt = nil
+				} else if settledAt == nil {
+					t := s.Time
+					settledAt = &t
+				}
+				if power <= limit {
+					reached = true
+				}
+				if reached {
+					overshoot = math.Max(overshoot, power-st.ValueW)
+				}
+			}
+		}
+		if !time.Now().Before(end) {
+			break
+		}
+		<-ticker.C
+	}
+
+	st.Samples = len(samples)
+	if len(samples) == 0 {
+		st.Error = "no power samples received"
+		return
+	}
+	minW, maxW := math.Inf(1), math.Inf(-1)
+	for _, s := range samples {
+		minW, maxW = math.Min(minW, s.PowerW), math.Max(maxW, s.PowerW)
+	}
+	final := samples[len(samples)-1].PowerW
+	st.MinW, st.MaxW, st.FinalW = &minW, &maxW, &final
+	if !st.Active {
+		// a released limit has no target, the step only checks the write
+		st.Passed = true
+		return
+	}
+	if settledAt == nil {
+		st.Error = fmt.Sprintf("power did not settle within %.0f W + %.0f W tolerance, final %.0f W", st.ValueW, run.ToleranceWatts, final)
+		return
+	}
+	settle := math.Max(0, settledAt.Sub(acked).Seconds())
+	st.SettleSeconds = &settle
+	st.OvershootWatts = &overshoot
+	st.Passed = true
+	if run.MaxSettleSeconds > 0 && settle > run.MaxSettleSeconds {
+		st.Passed = false
+		st.Error = fmt.Sprintf("settled after %.1f s, allowed %.0f s", settle, run.MaxSettleSeconds)
+	}
+	if run.MaxOvershootWatts > 0 && overshoot > run.MaxOvershootWatts {
+		st.Passed = false
+		st.Error = fmt.Sprintf("overshoot of %.0f W, allowed %.0f W", overshoot, run.MaxOvershootWatts)
+	}
+}
+
+// envelopeTestResult converts a finished envelope test to a stored test run, the
+// assertions are named by their step so runs with the same steps can be compared
+func envelopeTestResult(run *envelopeTestRun) *testRunResult {
+	res := &testRunResult{Plan: "envelope/lpc", SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	for i, st := range run.Steps {
+		name := fmt.Sprintf("step %d: limit %.0f W", i+1, st.ValueW)
+		if !st.Active {
+			name = fmt.Sprintf("step %d: release", i+1)
+		}
+		msg := st.Error
+		if msg == "" && st.StartedAt == nil {
+			msg = "not run"
+		}
+		res.Assertions = append(res.Assertions, testAssertion{
+			Name:            name,
+			Passed:          st.Passed,
+			Message:         msg,
+			DurationSeconds: st.SettleSeconds,
+		})
+	}
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyEnvelopeTestRun(run *envelopeTestRun) *envelopeTestRun {
+	c := *run
+	c.Steps = append([]envelopeStep(nil), run.Steps...)
+	c.Samples = append([]powerSample(nil), run.Samples...)
+	return &c
+}
+
+// getEnvelopeTest returns a copy of the current or last envelope test
+func (h *hems) getEnvelopeTest() *envelopeTestRun {
+	h.envelopeTests.mu.Lock()
+	defer h.envelopeTests.mu.Unlock()
+	if h.envelopeTests.run == nil {
+		return nil
+	}
+	return copyEnvelopeTestRun(h.envelopeTests.run)
+}
+
+// broadcastEnvelopeTest sends the progress of the envelope test to all websocket clients
+// without the samples
+func (h *hems) broadcastEnvelopeTest() {
+	run := h.getEnvelopeTest()
+	if run == nil {
+		return
+	}
+	run.Samples = nil
+	h.broadcastJSON(map[string]interface{}{
+		"type":         "envelopetest",
+		"ski":          run.SKI,
+		"envelopetest": run,
+	})
+}
+
+// envelopeTestSVG renders the measured power of an envelope test with the limit of every step
+func envelopeTestSVG(run *envelopeTestRun) []byte {
+	c := powerChart{start: run.StartedAt, end: time.Now()}
+	if run.EndedAt != nil {
+		c.end = *run.EndedAt
+	}
+	for i, st := range run.Steps {
+		if st.StartedAt == nil {
+			continue
+		}
+		end := c.end
+		if st.EndedAt != nil {
+			end = *st.EndedAt
+		}
+		fill := "#eaf7ea"
+		if !st.Passed && st.EndedAt != nil {
+			fill = "#fde8e8"
+		}
+		c.bands = append(c.bands, chartBand{label: fmt.Sprintf("%d", i+1), from: *st.StartedAt, to: end, fill: fill})
+		if st.Active {
+			c.limits = append(c.limits, chartLimit{label: fmt.Sprintf("%.0f W", st.ValueW), from: *st.StartedAt, to: end, watts: st.ValueW})
+		}
+	}
+	for _, s := range run.Samples {
+		c.points = append(c.points, chartPoint{t: s.Time, watts: s.PowerW})
+	}
+	return c.svg()
+}
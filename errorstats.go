@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// SPINE error classes of negative results
+const (
+	errorClassAccessDenied  = "accessDenied"
+	errorClassNotSupported  = "notSupported"
+	errorClassInvalidValue  = "invalidValue"
+	errorClassRejected      = "rejected"
+	errorClassTimeout       = "timeout"
+	errorClassOverload      = "overload"
+	errorClassDestination   = "destinationUnknown"
+	errorClassGeneral       = "generalError"
+	errorClassBindingNeeded = "bindingRequired"
+)
+
+// classifySpineError maps a SPINE error number and description to an error class.
+// Command rejected and general errors are refined by the description of the DUT.
+func classifySpineError(number model.ErrorNumberType, description string) string {
+	switch number {
+	case model.ErrorNumberTypeCommandNotSupported, model.ErrorNumberTypeRestrictedFunctionExchangeCombinationNotSupported:
+		return errorClassNotSupported
+	case model.ErrorNumberTypeBindingIsNecessaryForThisCommand:
+		return errorClassBindingNeeded
+	case model.ErrorNumberTypeTimeout:
+		return errorClassTimeout
+	case model.ErrorNumberTypeOverload:
+		return errorClassOverload
+	case model.ErrorNumberTypeDestinationUnknown, model.ErrorNumberTypeDestinationUnreachable:
+		return errorClassDestination
+	}
+
+	desc := strings.ToLower(description)
+	switch {
+	case strings.Contains(desc, "access") || strings.Contains(desc, "denied") ||
+		strings.Contains(desc, "permission") || strings.Contains(desc, "not allowed") ||
+		strings.Contains(desc, "unauthori"):
+		return errorClassAccessDenied
+	case strings.Contains(desc, "invalid") || strings.Contains(desc, "range") ||
+		strings.Contains(desc, "value") || strings.Contains(desc, "exceed"):
+		return errorClassInvalidValue
+	case strings.Contains(desc, "not supported") || strings.Contains(desc, "unsupported"):
+		return errorClassNotSupported
+	}
+	if number == model.ErrorNumberTypeCommandRejected {
+		return errorClassRejected
+	}
+	return errorClassGeneral
+}
+
+// functionErrorStats are the result statistics of one function of a remote feature
+type functionErrorStats struct {
+	SKI        string `json:"ski"`
+	Feature    string `json:"feature"`
+	Address    string `json:"address"`
+	Function   string `json:"function"`
+	Classifier string `json:"classifier,omitempty"`
+	// Results counts all results, Errors the negative ones
+	Results         int            `json:"results"`
+	Errors          int            `json:"errors"`
+	ByClass         map[string]int `json:"byClass"`
+	ByErrorNumber   map[uint]int   `json:"byErrorNumber"`
+	LastError       string         `json:"lastError,omitempty"`
+	LastErrorNumber *uint          `json:"lastErrorNumber,omitempty"`
+	LastErrorAt     *time.Time     `json:"lastErrorAt,omitempty"`
+}
+
+// errorStatsStore counts SPINE results per remote feature and function
+type errorStatsStore struct {
+	mu    sync.Mutex
+	stats map[string]*functionErrorStats
+}
+
+func newErrorStatsStore() *errorStatsStore {
+	return &errorStatsStore{stats: make(map[string]*functionErrorStats)}
+}
+
+// resultFunction returns the function and classifier of the sent message a result refers to
+func resultFunction(msg spineapi.ResponseMessage) (string, string) {
+	if msg.DeviceRemote == nil || msg.DeviceRemote.Sender() == nil {
+		return "unknown", ""
+	}
+	datagram, err := msg.DeviceRemote.Sender().DatagramForMsgCounter(msg.MsgCounterReference)
+	if err != nil || len(datagram.Payload.Cmd) == 0 {
+		return "unknown", ""
+	}
+	classifier := ""
+	if datagram.Header.CmdClassifier != nil {
+		classifier = string(*datagram.Header.CmdClassifier)
+	}
+	cmd := datagram.Payload.Cmd[0]
+	if data, err := cmd.Data(); err == nil && data.Function != nil {
+		return string(*data.Function), classifier
+	}
+	return cmd.DataName(), classifier
+}
+
+// recordResultStats counts a SPINE result of a remote feature
+func (h *hems) recordResultStats(msg spineapi.ResponseMessage, result model.ResultDataType) {
+	ski := ""
+	if msg.DeviceRemote != nil {
+		ski = msg.DeviceRemote.Ski()
+	}
+	feature, address := "unknown", ""
+	if msg.FeatureRemote != nil {
+		feature = string(msg.FeatureRemote.Type())
+		address = msg.FeatureRemote.Address().String()
+	}
+	function, classifier := resultFunction(msg)
+
+	var number model.ErrorNumberType
+	if result.ErrorNumber != nil {
+		number = *result.ErrorNumber
+	}
+	description := ""
+	if result.Description != nil {
+		description = string(*result.Description)
+	}
+
+	key := strings.Join([]string{ski, address, function}, "|")
+	h.errorStats.mu.Lock()
+	s, ok := h.errorStats.stats[key]
+	if !ok {
+		s = &functionErrorStats{
+			SKI:           ski,
+			Feature:       feature,
+			Address:       address,
+			Function:      function,
+			Classifier:    classifier,
+			ByClass:       make(map[string]int),
+			ByErrorNumber: make(map[uint]int),
+		}
+		h.errorStats.stats[key] = s
+	}
+	s.Results++
+	if number == model.ErrorNumberTypeNoError {
+		h.errorStats.mu.Unlock()
+		return
+	}
+	class := classifySpineError(number, description)
+	now := time.Now()
+	n := uint(number)
+	s.Errors++
+	s.ByClass[class]++
+	s.ByErrorNumber[n]++
+	s.LastError = description
+	s.LastErrorNumber = &n
+	s.LastErrorAt = &now
+	h.errorStats.mu.Unlock()
+
+	h.Debugf("SPINE error result from %s %s %s: %d (%s) %s", ski, feature, function, n, class, description)
+}
+
+// getErrorStats returns the result statistics of all remote functions with at least one error,
+// most errors first. all includes the functions without errors.
+func (h *hems) getErrorStats(ski string, all bool) []functionErrorStats {
+	h.errorStats.mu.Lock()
+	defer h.errorStats.mu.Unlock()
+
+	out := []functionErrorStats{}
+	for _, s := range h.errorStats.stats {
+		if ski != "" && s.SKI != ski {
+			continue
+		}
+		if s.Errors == 0 && !all {
+			continue
+		}
+		c := *s
+		c.ByClass = make(map[string]int, len(s.ByClass))
+		for k, v := range s.ByClass {
+			c.ByClass[k] = v
+		}
+		c.ByErrorNumber = make(map[uint]int, len(s.ByErrorNumber))
+		for k, v := range s.ByErrorNumber {
+			c.ByErrorNumber[k] = v
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Errors != out[j].Errors {
+			return out[i].Errors > out[j].Errors
+		}
+		return fmt.Sprint(out[i].SKI, out[i].Address, out[i].Function) < fmt.Sprint(out[j].SKI, out[j].Address, out[j].Function)
+	})
+	return out
+}
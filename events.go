@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxEvents is the number of timeline events kept in memory
+const maxEvents = 5000
+
+// event severities
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// timelineEvent is a single entry of the event timeline
+type timelineEvent struct {
+	ID       uint64                 `json:"id"`
+	Time     time.Time              `json:"time"`
+	Type     string                 `json:"type"`
+	Severity string                 `json:"severity"`
+	SKI      string                 `json:"ski,omitempty"`
+	Message  string                 `json:"message"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	// MsgCounter and DatagramID reference the SPINE datagram the event came from
+	MsgCounter  *uint64 `json:"msgCounter,omitempty"`
+	DatagramID  *uint64 `json:"datagramId,omitempty"`
+	Correlation string  `json:"correlation,omitempty"`
+}
+
+// eventTimeline keeps the most recent events of all peers
+type eventTimeline struct {
+	mu     sync.Mutex
+	nextID uint64
+	events []timelineEvent
+}
+
+func newEventTimeline() *eventTimeline {
+	return &eventTimeline{}
+}
+
+// recordEvent adds an event to the timeline and publishes it to the timeline subscribers
+func (h *hems) recordEvent(eventType, severity, ski, message string, data map[string]interface{}) timelineEvent {
+	return h.recordCorrelatedEvent(eventType, severity, ski, message, data, datagramRef{})
+}
+
+// recordCorrelatedEvent adds an event referencing the SPINE datagram it came from
+func (h *hems) recordCorrelatedEvent(eventType, severity, ski, message string, data map[string]interface{}, ref datagramRef) timelineEvent {
+	h.events.mu.Lock()
+	h.events.nextID++
+	ev := timelineEvent{
+		ID:          h.events.nextID,
+		Time:        time.Now(),
+		Type:        eventType,
+		Severity:    severity,
+		SKI:         ski,
+		Message:     message,
+		Data:        data,
+		MsgCounter:  ref.MsgCounter,
+		DatagramID:  ref.DatagramID,
+		Correlation: ref.Correlation,
+	}
+	h.events.events = append(h.events.events, ev)
+	if len(h.events.events) > maxEvents {
+		h.events.events = h.events.events[len(h.events.events)-maxEvents:]
+	}
+	h.events.mu.Unlock()
+
+	h.publishTimelineEvent(ev)
+	return ev
+}
+
+// eventFilter selects events of the timeline, empty fields match all events
+type eventFilter struct {
+	SKI   string
+	Type  string
+	Since time.Time
+	Until time.Time
+}
+
+func (f eventFilter) matches(ev timelineEvent) bool {
+	if f.SKI != "" && ev.SKI != f.SKI {
+		return false
+	}
+	if f.Type != "" && ev.Type != f.Type {
+		return false
+	}
+	if !f.Since.IsZero() && ev.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && ev.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// getEvents returns the matching events in chronological order
+func (h *hems) getEvents(f eventFilter) []timelineEvent {
+	h.events.mu.Lock()
+	defer h.events.mu.Unlock()
+
+	out := []timelineEvent{}
+	for _, ev := range h.events.events {
+		if f.matches(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enbility/spine-go/model"
+)
+
+// maxEvseStateEntries is the number of operating state reports kept per peer
+const maxEvseStateEntries = 1000
+
+// evseErrorStates are the EVSE operating states that are reported as errors
+var evseErrorStates = map[string]bool{
+	string(model.DeviceDiagnosisOperatingStateTypeFailure):       true,
+	string(model.DeviceDiagnosisOperatingStateTypeInAlarm):       true,
+	string(model.DeviceDiagnosisOperatingStateTypeServiceNeeded): true,
+	string(model.DeviceDiagnosisOperatingStateTypeNotReachable):  true,
+}
+
+// evseStateEntry is an EVSE operating state with its error description
+type evseStateEntry struct {
+	Time        time.Time `json:"time"`
+	State       string    `json:"state"`
+	Description string    `json:"description,omitempty"`
+	Error       bool      `json:"error,omitempty"`
+	// DurationSeconds is the time until the next entry, unset for the current state
+	DurationSeconds *float64 `json:"durationSeconds,omitempty"`
+}
+
+// evseStateHistory is the operating state history of the EVSE of a peer
+type evseStateHistory struct {
+	SKI     string           `json:"ski"`
+	Current *evseStateEntry  `json:"current,omitempty"`
+	Errors  int              `json:"errors"`
+	Entries []evseStateEntry `json:"entries"`
+}
+
+// evseStateStore keeps the EVSECC operating states of all peers
+type evseStateStore struct {
+	mu      sync.Mutex
+	entries map[string][]evseStateEntry
+	errors  map[string]int
+}
+
+func newEvseStateStore() *evseStateStore {
+	return &evseStateStore{
+		entries: make(map[string][]evseStateEntry),
+		errors:  make(map[string]int),
+	}
+}
+
+// recordEvseState adds an EVSE operating state report if the state or the error description changed.
+// Error states are recorded on the timeline so failures that clear within seconds remain visible.
+func (h *hems) recordEvseState(ski, state, description string) {
+	now := time.Now()
+	entry := evseStateEntry{
+		Time:        now,
+		State:       state,
+		Description: description,
+		Error:       evseErrorStates[state] || description != "",
+	}
+
+	h.evseStates.mu.Lock()
+	list := h.evseStates.entries[ski]
+	if n := len(list); n > 0 {
+		last := &list[n-1]
+		if last.State == state && last.Description == description {
+			h.evseStates.mu.Unlock()
+			return
+		}
+		d := now.Sub(last.Time).Seconds()
+		last.DurationSeconds = &d
+	}
+	list = append(list, entry)
+	if len(list) > maxEvseStateEntries {
+		list = list[len(list)-maxEvseStateEntries:]
+	}
+	h.evseStates.entries[ski] = list
+	if entry.Error {
+		h.evseStates.errors[ski]++
+	}
+	h.evseStates.mu.Unlock()
+
+	if entry.Error {
+		msg := "EVSE operating state " + state
+		if description != "" {
+			msg += ": " + description
+		}
+		h.recordCorrelatedEvent("evse", severityWarning, ski, msg,
+			map[string]interface{}{"state": state, "description": description}, h.nearestDatagram(ski))
+	}
+}
+
+// getEvseStateHistories returns the EVSE operating state histories, entries before since are omitted
+func (h *hems) getEvseStateHistories(ski string, since time.Time) []evseStateHistory {
+	h.evseStates.mu.Lock()
+	defer h.evseStates.mu.Unlock()
+
+	out := []evseStateHistory{}
+	for key, list := range h.evseStates.entries {
+		if ski != "" && key != ski {
+			continue
+		}
+		hist := evseStateHistory{SKI: key, Errors: h.evseStates.errors[key], Entries: []evseStateEntry{}}
+		if n := len(list); n > 0 {
+			current := list[n-1]
+			hist.Current = &current
+		}
+		for _, e := range list {
+			if !since.IsZero() && e.Time.Before(since) {
+				continue
+			}
+			hist.Entries = append(hist.Entries, e)
+		}
+		out = append(out, hist)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SKI < out[j].SKI })
+	return out
+}
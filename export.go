@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventCSVColumns are the selectable columns of the event export
+var eventCSVColumns = []string{"id", "time", "type", "severity", "ski", "message", "data"}
+
+// csvColumns returns the requested columns in the given order, empty selects all
+func csvColumns(requested string, available []string) ([]string, error) {
+	if requested == "" {
+		return available, nil
+	}
+	known := make(map[string]bool, len(available))
+	for _, c := range available {
+		known[c] = true
+	}
+	var out []string
+	for _, c := range strings.Split(requested, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !known[c] {
+			return nil, fmt.Errorf("unknown column %q", c)
+		}
+		out = append(out, c)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no columns selected")
+	}
+	return out, nil
+}
+
+// writeEventsCSV writes the matching timeline events with the selected columns
+func (h *hems) writeEventsCSV(w io.Writer, f eventFilter, columns []string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, ev := range h.getEvents(f) {
+		row := make([]string, len(columns))
+		for i, c := range columns {
+			switch c {
+			case "id":
+				row[i] = strconv.FormatUint(ev.ID, 10)
+			case "time":
+				row[i] = formatTimestamp(ev.Time)
+			case "type":
+				row[i] = ev.Type
+			case "severity":
+				row[i] = ev.Severity
+			case "ski":
+				row[i] = ev.SKI
+			case "message":
+				row[i] = ev.Message
+			case "data":
+				if len(ev.Data) > 0 {
+					b, _ := json.Marshal(ev.Data)
+					row[i] = string(b)
+				}
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeSeriesCSV writes the selected series of a peer as one column per series.
+// Every row is a point in time where at least one series changed, the other
+// columns hold the last known value.
+func (h *hems) writeSeriesCSV(w io.Writer, ski string, columns []string, since, until time.Time) error {
+	type change struct {
+		t     time.Time
+		col   int
+		value float64
+	}
+	var changes []change
+	last := make([]string, len(columns))
+	for i, name := range columns {
+		// values before the range fill the first row
+		if !since.IsZero() {
+			if before := h.seriesRange(ski, name, time.Time{}, since.Add(-time.Nanosecond)); len(before) > 0 {
+				last[i] = strconv.FormatFloat(before[len(before)-1].Value, 'f', -1, 64)
+			}
+		}
+		for _, p := range h.seriesRange(ski, name, since, until) {
+			changes = append(changes, change{t: p.Time, col: i, value: p.Value})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].t.Before(changes[j].t) })
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"time"}, columns...)); err != nil {
+		return err
+	}
+	for i := 0; i < len(changes); {
+		t := changes[i].t
+		for ; i < len(changes) && changes[i].t.Equal(t); i++ {
+			last[changes[i].col] = strconv.FormatFloat(changes[i].value, 'f', -1, 64)
+		}
+		if err := cw.Write(append([]string{formatTimestamp(t)}, last...)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/enbility/eebus-go/api"
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/spine"
+)
+
+// Extension adds use cases, API endpoints and websocket messages without editing main.go.
+// Extensions live in their own file of this package, usually behind a build tag, and
+// register themselves in init:
+//
+//	//go:build myvendor
+//
+//	func init() { registerExtension(&myVendorExtension{}) }
+//
+// Extensions that also implement spineapi.EventHandlerInterface receive all SPINE events.
+type Extension interface {
+	// Name identifies the extension in logs, events and /api/extensions
+	Name() string
+	// Setup is called after the built-in use cases were added and before the service starts
+	Setup(host *ExtensionHost) error
+}
+
+// ExtensionHost is the access of an extension to the tester
+type ExtensionHost struct {
+	h    *hems
+	name string
+	// routes registered by the extension, listed in /api/extensions
+	routes []string
+}
+
+// LocalEntity returns the main local entity use cases are added to, the CEM entity by default
+func (x *ExtensionHost) LocalEntity() spineapi.EntityLocalInterface {
+	return x.h.mainEntity()
+}
+
+// LocalDevice returns the local SPINE device
+func (x *ExtensionHost) LocalDevice() spineapi.DeviceLocalInterface {
+	return x.h.myService.LocalDevice()
+}
+
+// AddUseCase adds a use case to the service and tracks its support per peer under the name
+func (x *ExtensionHost) AddUseCase(name string, uc api.UseCaseInterface) {
+	x.h.myService.AddUseCase(uc)
+	x.h.trackUsecase(name, uc)
+	x.h.Infof("Usecase %s enabled by extension %s", name, x.name)
+}
+
+// SetUsecaseSupported reports whether the DUT of the SKI supports a use case of the extension
+func (x *ExtensionHost) SetUsecaseSupported(ski, name string, supported bool) {
+	x.h.setUsecaseSupportedForPeer(x.h.getOrCreatePeer(ski), name, supported)
+}
+
+// HandleFunc registers an API endpoint, the pattern must be below /api/ext/<name>/
+func (x *ExtensionHost) HandleFunc(pattern string, min role, handler http.HandlerFunc) (err error) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		path, method = pattern, ""
+	}
+	prefix := "/api/ext/" + x.name + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return fmt.Errorf("extension %s: route %s must be below %s", x.name, path, prefix)
+	}
+	// ServeMux panics on invalid or conflicting patterns
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("extension %s: route %s: %v", x.name, pattern, r)
+		}
+	}()
+	http.HandleFunc(pattern, x.h.requireRole(min, handler))
+	x.routes = append(x.routes, strings.TrimSpace(method+" "+path))
+	return nil
+}
+
+// Broadcast sends a websocket message of the given type to all clients
+func (x *ExtensionHost) Broadcast(msgType, ski string, payload map[string]interface{}) {
+	msg := map[string]interface{}{"type": msgType, "extension": x.name}
+	if ski != "" {
+		msg["ski"] = ski
+	}
+	for k, v := range payload {
+		if _, reserved := msg[k]; !reserved {
+			msg[k] = v
+		}
+	}
+	x.h.broadcastJSON(msg)
+}
+
+// OnUsecaseUpdate subscribes to the use case updates of all handlers, including the
+// built-in ones, fn is called synchronously and must not block
+func (x *ExtensionHost) OnUsecaseUpdate(fn func(usecaseUpdate)) {
+	x.h.bus.usecaseUpdates.subscribe("extension/"+x.name, fn)
+}
+
+// OnTimelineEvent subscribes to all recorded timeline events, fn must not block
+func (x *ExtensionHost) OnTimelineEvent(fn func(timelineEvent)) {
+	x.h.bus.timeline.subscribe("extension/"+x.name, fn)
+}
+
+// PublishUsecaseUpdate hands the data update of a use case of the extension to all
+// sinks, like the built-in handlers do at the end of their event handling
+func (x *ExtensionHost) PublishUsecaseUpdate(ski, usecase string, event api.EventType, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface) {
+	x.h.publishUsecaseUpdate(ski, usecase, event, device, entity, x.h.getOrCreatePeer(ski))
+}
+
+// RecordEvent adds an event to the timeline
+func (x *ExtensionHost) RecordEvent(severity, ski, message string, data map[string]interface{}) {
+	x.h.recordEvent("extension/"+x.name, severity, ski, message, data)
+}
+
+// Infof and Errorf write to the tester log
+func (x *ExtensionHost) Infof(format string, args ...interface{}) {
+	x.h.Infof("[%s] "+format, append([]interface{}{x.name}, args...)...)
+}
+
+func (x *ExtensionHost) Errorf(format string, args ...interface{}) {
+	x.h.Errorf("[%s] "+format, append([]interface{}{x.name}, args...)...)
+}
+
+// extensionInfo is the state of an extension in /api/extensions
+type extensionInfo struct {
+	Name   string   `json:"name"`
+	Active bool     `json:"active"`
+	Error  string   `json:"error,omitempty"`
+	Routes []string `json:"routes"`
+	// SpineEvents is set for extensions subscribed to SPINE events
+	SpineEvents bool `json:"spineEvents"`
+}
+
+var (
+	extensionsMu sync.Mutex
+	// extensions registered at init time, set up by setupExtensions
+	extensions []Extension
+	// extensionState are the setup results by name
+	extensionState = map[string]*extensionInfo{}
+)
+
+// registerExtension adds an extension, it must be called from init
+func registerExtension(ext Extension) {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	extensions = append(extensions, ext)
+}
+
+// setupExtensions sets up all registered extensions. A failing extension is reported
+// and skipped, it does not stop the tester.
+func (h *hems) setupExtensions() {
+	extensionsMu.Lock()
+	exts := append([]Extension(nil), extensions...)
+	extensionsMu.Unlock()
+
+	for _, ext := range exts {
+		name := ext.Name()
+		info := &extensionInfo{Name: name, Routes: []string{}}
+		host := &ExtensionHost{h: h, name: name}
+		if err := ext.Setup(host); err != nil {
+			info.Error = err.Error()
+			h.Errorf("extension %s: setup: %v", name, err)
+			h.recordEvent("extension/"+name, severityError, "", "extension setup failed: "+err.Error(), nil)
+		} else {
+			info.Active = true
+			if handler, ok := ext.(spineapi.EventHandlerInterface); ok {
+				_ = spine.Events.Subscribe(handler)
+				info.SpineEvents = true
+			}
+			h.Infof("Extension %s loaded", name)
+		}
+		info.Routes = append(info.Routes, host.routes...)
+		extensionsMu.Lock()
+		extensionState[name] = info
+		extensionsMu.Unlock()
+	}
+}
+
+// getExtensions returns the registered extensions
+func getExtensions() []extensionInfo {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	out := make([]extensionInfo, 0, len(extensionState))
+	for _, info := range extensionState {
+		out = append(out, *info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
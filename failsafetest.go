@@ -0,0 +1,533 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults of the failsafe test
+const (
+	defaultFailsafeBaseline = 10 * time.Second
+	// defaultFailsafeEntry is the LPC heartbeat timeout, the DUT enters the failsafe state
+	// at the latest when no heartbeat was received for 120 seconds
+	defaultFailsafeEntry     = 2 * time.Minute
+	defaultFailsafeHold      = 10 * time.Second
+	defaultFailsafeRecovery  = time.Minute
+	defaultFailsafeSample    = time.Second
+	defaultFailsafeTolerance = 100.0
+)
+
+// Phases of the failsafe test, the samples are tagged with the phase they were taken in
+const (
+	failsafePhaseBaseline = "baseline"
+	failsafePhaseEntry    = "entry"
+	failsafePhaseHold     = "hold"
+	failsafePhaseRecovery = "recovery"
+)
+
+// failsafeTestRequest starts a failsafe test
+type failsafeTestRequest struct {
+	SKI string `json:"ski"`
+	// ToleranceWatts is the accepted power above the failsafe limit, defaults to 100
+	ToleranceWatts float64 `json:"toleranceWatts,omitempty"`
+	// BaselineSeconds is the time the power is recorded before the heartbeat is stopped, defaults to 10
+	BaselineSeconds float64 `json:"baselineSeconds,omitempty"`
+	// EntrySeconds is the time the DUT gets to enter the failsafe state, defaults to 120
+	EntrySeconds float64 `json:"entrySeconds,omitempty"`
+	// HoldSeconds is the time the failsafe power must be kept, defaults to 10
+	HoldSeconds float64 `json:"holdSeconds,omitempty"`
+	// RecoverySeconds is the time the DUT gets to leave the failsafe state, defaults to 60
+	RecoverySeconds  float64 `json:"recoverySeconds,omitempty"`
+	SampleIntervalMs int     `json:"sampleIntervalMs,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// powerSample is a power value of the DUT during a test
+type powerSample struct {
+	Time   time.Time `json:"time"`
+	PowerW float64   `json:"powerW"`
+	Phase  string    `json:"phase"`
+}
+
+// failsafeTestPhase is a phase of the test for the timeline
+type failsafeTestPhase struct {
+	Name      string     `json:"name"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+}
+
+// failsafeTestRun is an active or finished failsafe test
+type failsafeTestRun struct {
+	SKI       string     `json:"ski"`
+	Running   bool       `json:"running"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	// Source is the use case the power is taken from, MPC or EVCEM
+	Source string `json:"source,omitempty"`
+	// FailsafePowerW and FailsafeDurationSeconds are the failsafe values reported by the DUT
+	FailsafePowerW          *float64 `json:"failsafePowerW,omitempty"`
+	FailsafeDurationSeconds *float64 `json:"failsafeDurationSeconds,omitempty"`
+	ToleranceWatts          float64  `json:"toleranceWatts"`
+	// RestoredLimit is the consumption limit written again to end the failsafe state
+	RestoredLimit *lpcLimitReading `json:"restoredLimit,omitempty"`
+	BaselineW     *float64         `json:"baselineW,omitempty"`
+	// EntrySeconds is the time from stopping the heartbeat until the power stayed within the failsafe limit
+	EntrySeconds *float64 `json:"entrySeconds,omitempty"`
+	// RecoverySeconds is the time from resuming the heartbeat until the power exceeded the failsafe limit
+	RecoverySeconds *float64            `json:"recoverySeconds,omitempty"`
+	Phases          []failsafeTestPhase `json:"phases"`
+	Samples         []powerSample       `json:"samples"`
+	Assertions      []testAssertion     `json:"assertions"`
+	Passed          bool                `json:"passed"`
+	Error           string              `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// failsafeTestState holds the current or last failsafe test
+type failsafeTestState struct {
+	mu  sync.Mutex
+	run *failsafeTestRun
+}
+
+// failsafeTestTimings are the phase durations of a test
+type failsafeTestTimings struct {
+	baseline, entry, hold, recovery, sample time.Duration
+}
+
+func secondsOr(s float64, def time.Duration) time.Duration {
+	if s <= 0 {
+		return def
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// dutPower returns the current power of the DUT from MPC, or the sum of the EVCEM phase
+// powers when the DUT has no MPC entity
+func (h *hems) dutPower(ski string) (float64, string, bool) {
+	if h.ucmampc != nil {
+		for _, entity := range remoteEntities(h.ucmampc.RemoteEntitiesScenarios(), ski) {
+			if power, err := h.ucmampc.Power(entity); err == nil {
+				return power, "MPC", true
+			}
+		}
+	}
+	if h.uccemevcem != nil {
+		for _, entity := range remoteEntities(h.uccemevcem.RemoteEntitiesScenarios(), ski) {
+			if phases, err := h.uccemevcem.PowerPerPhase(entity); err == nil && len(phases) > 0 {
+				var sum float64
+				for _, p := range phases {
+					sum += p
+				}
+				return sum, "EVCEM", true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// startFailsafeTest starts a failsafe test in the background. The local heartbeat is
+// stopped for all connected devices while the test runs.
+func (h *hems) startFailsafeTest(req failsafeTestRequest) (*failsafeTestRun, error) {
+	if h.uceglpc == nil {
+		return nil, errors.New("LPC usecase is disabled")
+	}
+	if req.SKI == "" {
+		return nil, errors.New("ski is required")
+	}
+	if req.ToleranceWatts < 0 {
+		return nil, errors.New("toleranceWatts must not be negative")
+	}
+	if _, _, ok := h.dutPower(req.SKI); !ok {
+		return nil, errors.New("no power reported by the DUT, MPC or EVCEM is required")
+	}
+	if status := h.heartbeat.get(); !status.Running {
+		return nil, errors.New("the local heartbeat is not running")
+	}
+	timings := failsafeTestTimings{
+		baseline: secondsOr(req.BaselineSeconds, defaultFailsafeBaseline),
+		entry:    secondsOr(req.EntrySeconds, defaultFailsafeEntry),
+		hold:     secondsOr(req.HoldSeconds, defaultFailsafeHold),
+		recovery: secondsOr(req.RecoverySeconds, defaultFailsafeRecovery),
+		sample:   defaultFailsafeSample,
+	}
+	if req.SampleIntervalMs > 0 {
+		timings.sample = time.Duration(req.SampleIntervalMs) * time.Millisecond
+	}
+	tolerance := defaultFailsafeTolerance
+	if req.ToleranceWatts > 0 {
+		tolerance = req.ToleranceWatts
+	}
+	run := &failsafeTestRun{
+		SKI:            req.SKI,
+		Running:        true,
+		StartedAt:      time.Now(),
+		ToleranceWatts: tolerance,
+		Metadata:       req.Metadata,
+	}
+
+	h.failsafeTests.mu.Lock()
+	if h.failsafeTests.run != nil && h.failsafeTests.run.Running {
+		h.failsafeTests.mu.Unlock()
+		return nil, errors.New("a failsafe test is already running")
+	}
+	h.failsafeTests.run = run
+	snap := copyFailsafeTestRun(run)
+	h.failsafeTests.mu.Unlock()
+
+	go h.runFailsafeTest(run, timings)
+	h.recordEvent("failsafetest", severityInfo, req.SKI, "failsafe test started", nil)
+	return snap, nil
+}
+
+// runFailsafeTest stops the local heartbeat, checks that the DUT limits its power to the
+// failsafe limit and that it leaves the failsafe state after the heartbeat is resumed
+// and the previous consumption limit is written again
+func (h *hems) runFailsafeTest(run *failsafeTestRun, timings failsafeTestTimings) {
+	span := h.tracer.startSpan("test failsafe/lpc", spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	errText := h.failsafeTestSteps(run, timings, span)
+
+	now := time.Now()
+	h.failsafeTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Error = errText
+	run.Passed = errText == ""
+	for _, a := range run.Assertions {
+		if !a.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := failsafeTestResult(run)
+	h.failsafeTests.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("failsafe test: %v", err)
+	} else {
+		h.failsafeTests.mu.Lock()
+		run.ResultID = result.ID
+		h.failsafeTests.mu.Unlock()
+	}
+	h.broadcastFailsafeTest()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("failsafe test %s", verdict)
+	h.recordEvent("failsafetest", severity, run.SKI, "failsafe test "+verdict, map[string]interface{}{
+		"entrySeconds":    run.EntrySeconds,
+		"recoverySeconds": run.RecoverySeconds,
+	})
+}
+
+// failsafeTestSteps runs the phases of the test, it returns an error text when the test
+// could not be carried out. The heartbeat is always resumed.
+func (h *hems) failsafeTestSteps(run *failsafeTestRun, timings failsafeTestTimings, span *traceSpan) string {
+	step := span.startSpan("read failsafe values", spanKindClient, time.Now())
+	readings, err := h.readLPC(run.SKI)
+	if err != nil {
+		step.end(time.Now(), err.Error())
+		return "read failsafe values: " + err.Error()
+	}
+	step.end(time.Now(), "")
+	reading := readings[0]
+	h.failsafeTests.mu.Lock()
+	run.FailsafePowerW = reading.FailsafePower
+	run.FailsafeDurationSeconds = reading.FailsafeDurationS
+	run.RestoredLimit = reading.ConsumptionLimit
+	h.failsafeTests.mu.Unlock()
+	if reading.FailsafePower == nil {
+		h.addFailsafeAssertion(run, "failsafe power reported", false, "the DUT reports no failsafe consumption active power limit", nil)
+		return ""
+	}
+	h.addFailsafeAssertion(run, "failsafe power reported", true, fmt.Sprintf("%.0f W", *reading.FailsafePower), nil)
+	limit := *reading.FailsafePower + run.ToleranceWatts
+
+	// baseline
+	step = span.startSpan(failsafePhaseBaseline, spanKindInternal, time.Now())
+	samples := h.sampleFailsafePower(run, failsafePhaseBaseline, timings.baseline, timings.sample, nil)
+	step.end(time.Now(), "")
+	if len(samples) == 0 {
+		return "no power samples received during the baseline"
+	}
+	baseline := meanPower(samples)
+	h.failsafeTests.mu.Lock()
+	run.BaselineW = &baseline
+	h.failsafeTests.mu.Unlock()
+	observable := baseline > limit
+
+	// stop the heartbeat, the DUT must limit itself within the entry time
+	localEntity := h.usecaseEntity("lpc")
+	hm := localEntity.HeartbeatManager()
+	if hm == nil {
+		return "the local entity has no heartbeat"
+	}
+	step = span.startSpan("heartbeat stopped", spanKindInternal, time.Now())
+	hm.StopHeartbeat()
+	stoppedAt := time.Now()
+	resumed := false
+	resume := func() error {
+		if resumed {
+			return nil
+		}
+		resumed = true
+		return hm.StartHeartbeat()
+	}
+	defer func() {
+		if err := resume(); err != nil {
+			h.Errorf("failsafe test: resume heartbeat: %v", err)
+		}
+	}()
+
+	var enteredAt *time.Time
+	h.sampleFailsafePower(run, failsafePhaseEntry, timings.entry, timings.sample, func(s powerSample) bool {
+		if s.PowerW > limit {
+			enteredAt = nil
+		} else if enteredAt == nil {
+			t := s.Time
+			enteredAt = &t
+		}
+		return false
+	})
+	hold := h.sampleFailsafePower(run, failsafePhaseHold, timings.hold, timings.sample, nil)
+	step.end(time.Now(), "")
+	if len(hold) == 0 {
+		return "no power samples received while the heartbeat was stopped"
+	}
+	maxHold := maxPower(hold)
+	entered := maxHold <= limit
+	var entrySeconds *float64
+	msg := fmt.Sprintf("max %.0f W in failsafe, limit %.0f W + %.0f W tolerance", maxHold, *reading.FailsafePower, run.ToleranceWatts)
+	if entered {
+		at := hold[0].Time
+		if enteredAt != nil {
+			at = *enteredAt
+		}
+		e := at.Sub(stoppedAt).Seconds()
+		entrySeconds = &e
+		if !observable {
+			msg += ", the baseline was within the failsafe limit already"
+		}
+	}
+	h.failsafeTests.mu.Lock()
+	run.EntrySeconds = entrySeconds
+	h.failsafeTests.mu.Unlock()
+	h.addFailsafeAssertion(run, "failsafe power kept without heartbeat", entered, msg, entrySeconds)
+
+	// resume the heartbeat and write the previous limit, which ends the failsafe state
+	step = span.startSpan("heartbeat resumed", spanKindInternal, time.Now())
+	resumedAt := time.Now()
+	if err := resume(); err != nil {
+		step.end(time.Now(), err.Error())
+		h.addFailsafeAssertion(run, "heartbeat resumed", false, err.Error(), nil)
+		return ""
+	}
+	h.addFailsafeAssertion(run, "heartbeat resumed", true, "", nil)
+	h.restoreFailsafeLimit(run)
+
+	var recoveredAt *time.Time
+	h.sampleFailsafePower(run, failsafePhaseRecovery, timings.recovery, timings.sample, func(s powerSample) bool {
+		if observable && s.PowerW > limit {
+			t := s.Time
+			recoveredAt = &t
+			return true
+		}
+		return false
+	})
+	step.end(time.Now(), "")
+	switch {
+	case !observable:
+		h.addFailsafeAssertion(run, "failsafe state left", true, "not observable, the baseline was within the failsafe limit", nil)
+	case recoveredAt == nil:
+		h.addFailsafeAssertion(run, "failsafe state left", false,
+			fmt.Sprintf("power stayed within the failsafe limit for %s after the heartbeat was resumed", timings.recovery), nil)
+	default:
+		r := recoveredAt.Sub(resumedAt).Seconds()
+		h.failsafeTests.mu.Lock()
+		run.RecoverySeconds = &r
+		h.failsafeTests.mu.Unlock()
+		h.addFailsafeAssertion(run, "failsafe state left", true, fmt.Sprintf("power above the failsafe limit after %.0f s", r), &r)
+	}
+	return ""
+}
+
+// restoreFailsafeLimit writes the consumption limit active before the test
+func (h *hems) restoreFailsafeLimit(run *failsafeTestRun) {
+	limit := lpcLimitReading{}
+	if run.RestoredLimit != nil {
+		limit = *run.RestoredLimit
+	}
+	payload := map[string]interface{}{"ski": run.SKI, "value": limit.Value, "isActive": limit.Active, "durationSeconds": limit.DurationSeconds}
+	durationSeconds := int64(limit.DurationSeconds)
+	c, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+		return h.WriteLPCConsumptionLimit(run.SKI, durationSeconds, limit.Value, limit.Active)
+	})
+	if err != nil {
+		h.addFailsafeAssertion(run, "consumption limit restored", false, err.Error(), nil)
+		return
+	}
+	<-c.done
+	snap, _ := h.getCommand(c.ID)
+	var ack *float64
+	if !snap.startedAt.IsZero() {
+		s := snap.UpdatedAt.Sub(snap.startedAt).Seconds()
+		ack = &s
+	}
+	msg := snap.Error
+	if msg == "" && snap.State != commandAcknowledged {
+		msg = string(snap.State)
+	}
+	h.addFailsafeAssertion(run, "consumption limit restored", snap.State == commandAcknowledged, msg, ack)
+}
+
+// sampleFailsafePower records the power for the duration of a phase, stop ends the phase early
+func (h *hems) sampleFailsafePower(run *failsafeTestRun, phase string, duration, interval time.Duration, stop func(powerSample) bool) []powerSample {
+	start := time.Now()
+	h.failsafeTests.mu.Lock()
+	run.Phases = append(run.Phases, failsafeTestPhase{Name: phase, StartedAt: start})
+	idx := len(run.Phases) - 1
+	h.failsafeTests.mu.Unlock()
+	h.broadcastFailsafeTest()
+
+	var samples []powerSample
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if power, source, ok := h.dutPower(run.SKI); ok {
+			s := powerSample{Time: time.Now(), PowerW: power, Phase: phase}
+			samples = append(samples, s)
+			h.failsafeTests.mu.Lock()
+			run.Source = source
+			run.Samples = append(run.Samples, s)
+			h.failsafeTests.mu.Unlock()
+			if stop != nil && stop(s) {
+				break
+			}
+		}
+		if time.Since(start) >= duration {
+			break
+		}
+		<-ticker.C
+	}
+
+	end := time.Now()
+	h.failsafeTests.mu.Lock()
+	run.Phases[idx].EndedAt = &end
+	h.failsafeTests.mu.Unlock()
+	h.broadcastFailsafeTest()
+	return samples
+}
+
+func (h *hems) addFailsafeAssertion(run *failsafeTestRun, name string, passed bool, msg string, duration *float64) {
+	h.failsafeTests.mu.Lock()
+	run.Assertions = append(run.Assertions, testAssertion{Name: name, Passed: passed, Message: msg, DurationSeconds: duration})
+	h.failsafeTests.mu.Unlock()
+	h.broadcastFailsafeTest()
+}
+
+func meanPower(samples []powerSample) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += s.PowerW
+	}
+	return sum / float64(len(samples))
+}
+
+func maxPower(samples []powerSample) float64 {
+	m := math.Inf(-1)
+	for _, s := range samples {
+		m = math.Max(m, s.PowerW)
+	}
+	return m
+}
+
+// failsafeTestResult converts a finished failsafe test to a stored test run
+func failsafeTestResult(run *failsafeTestRun) *testRunResult {
+	res := &testRunResult{Plan: "failsafe/lpc", SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	res.Assertions = append(res.Assertions, run.Assertions...)
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyFailsafeTestRun(run *failsafeTestRun) *failsafeTestRun {
+	c := *run
+	c.Phases = append([]failsafeTestPhase(nil), run.Phases...)
+	c.Samples = append([]powerSample(nil), run.Samples...)
+	c.Assertions = append([]testAssertion(nil), run.Assertions...)
+	return &c
+}
+
+// getFailsafeTest returns a copy of the current or last failsafe test
+func (h *hems) getFailsafeTest() *failsafeTestRun {
+	h.failsafeTests.mu.Lock()
+	defer h.failsafeTests.mu.Unlock()
+	if h.failsafeTests.run == nil {
+		return nil
+	}
+	return copyFailsafeTestRun(h.failsafeTests.run)
+}
+
+// broadcastFailsafeTest sends the progress of the failsafe test to all websocket clients,
+// the samples are left out and available via the API
+func (h *hems) broadcastFailsafeTest() {
+	run := h.getFailsafeTest()
+	if run == nil {
+		return
+	}
+	run.Samples = nil
+	h.broadcastJSON(map[string]interface{}{
+		"type":         "failsafetest",
+		"ski":          run.SKI,
+		"failsafetest": run,
+	})
+}
+
+// failsafeTestSVG renders the power timeline of a failsafe test with the phases and the
+// failsafe limit
+func failsafeTestSVG(run *failsafeTestRun) []byte {
+	c := powerChart{start: run.StartedAt, end: time.Now()}
+	if run.EndedAt != nil {
+		c.end = *run.EndedAt
+	}
+	fills := map[string]string{
+		failsafePhaseBaseline: "#eef5ff",
+		failsafePhaseEntry:    "#fff4e5",
+		failsafePhaseHold:     "#fde8e8",
+		failsafePhaseRecovery: "#eaf7ea",
+	}
+	for _, p := range run.Phases {
+		end := c.end
+		if p.EndedAt != nil {
+			end = *p.EndedAt
+		}
+		c.bands = append(c.bands, chartBand{label: p.Name, from: p.StartedAt, to: end, fill: fills[p.Name]})
+	}
+	if run.FailsafePowerW != nil {
+		c.limits = append(c.limits, chartLimit{
+			label: fmt.Sprintf("failsafe %.0f W", *run.FailsafePowerW),
+			from:  c.start,
+			to:    c.end,
+			watts: *run.FailsafePowerW,
+		})
+	}
+	for _, s := range run.Samples {
+		c.points = append(c.points, chartPoint{t: s.Time, watts: s.PowerW})
+	}
+	return c.svg()
+}
@@ -7,6 +7,7 @@ require (
 	github.com/enbility/ship-go v0.0.0-20250703120135-5a60c7a2e4e5
 	github.com/enbility/spine-go v0.0.0-20250703115254-5468324c5be5
 	github.com/gorilla/websocket v1.5.3
+	golang.org/x/net v0.47.0
 )
 
 require (
@@ -20,7 +21,6 @@ require (
 	github.com/rickb777/plural v1.4.7 // indirect
 	gitlab.com/c0b/go-ordered-json v0.0.0-20201030195603-febf46534d5a // indirect
 	golang.org/x/mod v0.30.0 // indirect
-	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/tools v0.39.0 // indirect
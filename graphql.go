@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The GraphQL endpoint implements the query subset dashboards need: a single read
+// only operation with aliases, arguments, variables and nested selections.
+// Mutations, fragments, directives and introspection are not supported.
+
+// gqlField is a field of a selection set
+type gqlField struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []gqlField
+}
+
+// gqlVariable is a reference to an operation variable in an argument value
+type gqlVariable string
+
+// gqlOperation is a parsed query operation
+type gqlOperation struct {
+	Name       string
+	Defaults   map[string]interface{}
+	Selections []gqlField
+}
+
+// gqlError is an error as reported in the errors list of a GraphQL response
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlObject is a result object that keeps the field order of the query
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, v interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(o.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlParser is a recursive descent parser over the query text
+type gqlParser struct {
+	src string
+	pos int
+}
+
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("syntax error at line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) && isNameByte(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// parseGraphQL parses a query document and returns its operations
+func parseGraphQL(src string) ([]gqlOperation, error) {
+	p := &gqlParser{src: src}
+	var ops []gqlOperation
+	for p.peek() != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("query contains no operation")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) operation() (gqlOperation, error) {
+	op := gqlOperation{Defaults: map[string]interface{}{}}
+	if p.peek() != '{' {
+		kind, err := p.name()
+		if err != nil {
+			return op, err
+		}
+		switch kind {
+		case "query":
+		case "mutation", "subscription":
+			return op, fmt.Errorf("%s operations are not supported, the API is read only", kind)
+		case "fragment":
+			return op, errors.New("fragments are not supported")
+		default:
+			return op, p.errorf("unexpected %q", kind)
+		}
+		if c := p.peek(); isNameByte(c, true) {
+			if op.Name, err = p.name(); err != nil {
+				return op, err
+			}
+		}
+		if p.peek() == '(' {
+			if err := p.variableDefinitions(op.Defaults); err != nil {
+				return op, err
+			}
+		}
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return op, err
+	}
+	op.Selections = sel
+	return op, nil
+}
+
+// variableDefinitions parses ($name: Type = default, ...), only the defaults are kept
+func (p *gqlParser) variableDefinitions(defaults map[string]interface{}) error {
+	p.pos++
+	for p.peek() != ')' {
+		if err := p.expect('$'); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.peek() == '=' {
+			p.pos++
+			v, err := p.value(true)
+			if err != nil {
+				return err
+			}
+			defaults[name] = v
+		}
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) typeRef() error {
+	if p.peek() == '[' {
+		p.pos++
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect(']'); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek() == '!' {
+		p.pos++
+	}
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for p.peek() != '}' {
+		switch p.peek() {
+		case 0:
+			return nil, p.errorf("unterminated selection set")
+		case '.':
+			return nil, errors.New("fragments are not supported")
+		case '@':
+			return nil, errors.New("directives are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.pos++
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	var f gqlField
+	name, err := p.name()
+	if err != nil {
+		return f, err
+	}
+	f.Alias, f.Name = name, name
+	if p.peek() == ':' {
+		p.pos++
+		if f.Name, err = p.name(); err != nil {
+			return f, err
+		}
+	}
+	if p.peek() == '(' {
+		p.pos++
+		f.Args = map[string]interface{}{}
+		for p.peek() != ')' {
+			arg, err := p.name()
+			if err != nil {
+				return f, err
+			}
+			if err := p.expect(':'); err != nil {
+				return f, err
+			}
+			if f.Args[arg], err = p.value(false); err != nil {
+				return f, err
+			}
+		}
+		p.pos++
+	}
+	if p.peek() == '{' {
+		if f.Selections, err = p.selectionSet(); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// value parses an argument value, enum values are returned as strings
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		if constant {
+			return nil, p.errorf("variables are not allowed in default values")
+		}
+		p.pos++
+		name, err := p.name()
+		return gqlVariable(name), err
+	case c == '"':
+		return p.stringValue()
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		text := p.src[start:p.pos]
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return f, nil
+	case c == '[':
+		p.pos++
+		list := []interface{}{}
+		for p.peek() != ']' {
+			if p.peek() == 0 {
+				return nil, p.errorf("unterminated list")
+			}
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.pos++
+		return list, nil
+	case c == '{':
+		p.pos++
+		obj := map[string]interface{}{}
+		for p.peek() != '}' {
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if obj[key], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		return obj, nil
+	case isNameByte(c, true):
+		name, _ := p.name()
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return name, nil
+	}
+	return nil, p.errorf("expected value")
+}
+
+func (p *gqlParser) stringValue() (string, error) {
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return sb.String(), nil
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			p.pos++
+			switch e := p.src[p.pos]; e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				if p.pos+5 > len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos+1:p.pos+5], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				sb.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				sb.WriteByte(e)
+			}
+		case '\n':
+			return "", p.errorf("unterminated string")
+		default:
+			sb.WriteByte(c)
+		}
+		p.pos++
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// gqlResolver resolves a field of a parent object. It returns the value and the
+// schema type of the value, fields of values without a type are looked up by JSON name.
+type gqlResolver func(h *hems, parent interface{}, args map[string]interface{}) (interface{}, string, error)
+
+// gqlSchema are the fields with resolvers per object type
+var gqlSchema map[string]map[string]gqlResolver
+
+func init() {
+	gqlSchema = map[string]map[string]gqlResolver{
+		"Query": {
+			"peers": func(h *hems, _ interface{}, args map[string]interface{}) (interface{}, string, error) {
+				ski := gqlString(args, "ski")
+				out := []PeerInfo{}
+				for _, p := range h.peerInfos() {
+					if ski == "" || p.SKI == ski {
+						out = append(out, p)
+					}
+				}
+				return out, "Peer", nil
+			},
+			"peer": func(h *hems, _ interface{}, args map[string]interface{}) (interface{}, string, error) {
+				ski := gqlString(args, "ski")
+				if ski == "" {
+					return nil, "", errors.New("argument ski is required")
+				}
+				for _, p := range h.peerInfos() {
+					if p.SKI == ski {
+						return p, "Peer", nil
+					}
+				}
+				return nil, "", nil
+			},
+			"events": func(h *hems, _ interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return gqlEvents(h, gqlString(args, "ski"), args)
+			},
+			"commands": func(h *hems, _ interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return gqlCommands(h, gqlString(args, "ski"), args)
+			},
+			"alerts": func(h *hems, _ interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return h.getAlerts(gqlString(args, "state"), gqlString(args, "ski")), "", nil
+			},
+			"stats": func(h *hems, _ interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return h.getStats(gqlString(args, "ski")), "", nil
+			},
+		},
+		"Peer": {
+			"usecaseData": func(h *hems, parent interface{}, _ map[string]interface{}) (interface{}, string, error) {
+				peer := h.getPeer(parent.(PeerInfo).SKI)
+				if peer == nil {
+					return nil, "", nil
+				}
+				usecaseDataMutex.Lock()
+				d := peer.usecaseData
+				usecaseDataMutex.Unlock()
+				return d, "", nil
+			},
+			"events": func(h *hems, parent interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return gqlEvents(h, parent.(PeerInfo).SKI, args)
+			},
+			"commands": func(h *hems, parent interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return gqlCommands(h, parent.(PeerInfo).SKI, args)
+			},
+			"alerts": func(h *hems, parent interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return h.getAlerts(gqlString(args, "state"), parent.(PeerInfo).SKI), "", nil
+			},
+			"states": func(h *hems, parent interface{}, args map[string]interface{}) (interface{}, string, error) {
+				return h.getStateHistories(parent.(PeerInfo).SKI, gqlString(args, "machine")), "", nil
+			},
+			"evseStates": func(h *hems, parent interface{}, _ map[string]interface{}) (interface{}, string, error) {
+				hist := h.getEvseStateHistories(parent.(PeerInfo).SKI, time.Time{})
+				if len(hist) == 0 {
+					return nil, "", nil
+				}
+				return hist[0], "", nil
+			},
+			"pairing": func(h *hems, parent interface{}, _ map[string]interface{}) (interface{}, string, error) {
+				return h.getPairing(parent.(PeerInfo).SKI), "", nil
+			},
+			"stats": func(h *hems, parent interface{}, _ map[string]interface{}) (interface{}, string, error) {
+				return h.getStats(parent.(PeerInfo).SKI), "", nil
+			},
+		},
+	}
+}
+
+func gqlString(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+// gqlLimit returns the limit argument, 0 means no limit
+func gqlLimit(args map[string]interface{}) (int, error) {
+	switch v := args["limit"].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		if v < 0 {
+			return 0, errors.New("limit must not be negative")
+		}
+		return int(v), nil
+	case float64:
+		if v < 0 || v != float64(int(v)) {
+			return 0, errors.New("limit must be a non negative integer")
+		}
+		return int(v), nil
+	}
+	return 0, errors.New("limit must be an integer")
+}
+
+// lastN returns the last n elements, all of them if n is 0
+func lastN[T any](s []T, n int) []T {
+	if n > 0 && len(s) > n {
+		return s[len(s)-n:]
+	}
+	return s
+}
+
+func gqlEvents(h *hems, ski string, args map[string]interface{}) (interface{}, string, error) {
+	f := eventFilter{SKI: ski, Type: gqlString(args, "type")}
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := gqlString(args, name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, "", errors.New(name + " must be RFC3339")
+			}
+			*dst = t
+		}
+	}
+	limit, err := gqlLimit(args)
+	if err != nil {
+		return nil, "", err
+	}
+	return lastN(h.getEvents(f), limit), "", nil
+}
+
+func gqlCommands(h *hems, ski string, args map[string]interface{}) (interface{}, string, error) {
+	limit, err := gqlLimit(args)
+	if err != nil {
+		return nil, "", err
+	}
+	out := []command{}
+	for _, c := range h.getCommands() {
+		if ski == "" || c.ski == ski {
+			out = append(out, c)
+		}
+	}
+	return lastN(out, limit), "", nil
+}
+
+// gqlExecutor executes one operation and collects field errors
+type gqlExecutor struct {
+	h         *hems
+	variables map[string]interface{}
+	errors    []gqlError
+}
+
+// executeGraphQL runs a query and returns the data and field errors. Errors in the
+// document itself are returned as error without data.
+func (h *hems) executeGraphQL(query, operationName string, variables map[string]interface{}) (interface{}, []gqlError, error) {
+	ops, err := parseGraphQL(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	var op *gqlOperation
+	switch {
+	case operationName != "":
+		for i := range ops {
+			if ops[i].Name == operationName {
+				op = &ops[i]
+			}
+		}
+		if op == nil {
+			return nil, nil, fmt.Errorf("unknown operation %q", operationName)
+		}
+	case len(ops) == 1:
+		op = &ops[0]
+	default:
+		return nil, nil, errors.New("operationName is required for documents with several operations")
+	}
+
+	vars := make(map[string]interface{}, len(op.Defaults)+len(variables))
+	for k, v := range op.Defaults {
+		vars[k] = v
+	}
+	for k, v := range variables {
+		// JSON numbers of integer arguments like limit arrive as float64
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			v = int64(f)
+		}
+		vars[k] = v
+	}
+
+	e := &gqlExecutor{h: h, variables: vars}
+	data := e.selectFields("Query", nil, op.Selections, nil)
+	return data, e.errors, nil
+}
+
+func (e *gqlExecutor) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, gqlError{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+func (e *gqlExecutor) resolveArgs(args map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		out[k] = e.resolveValue(v)
+	}
+	return out
+}
+
+func (e *gqlExecutor) resolveValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVariable:
+		return e.variables[string(v)]
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			out[i] = e.resolveValue(x)
+		}
+		return out
+	case map[string]interface{}:
+		return e.resolveArgs(v)
+	}
+	return v
+}
+
+// selectFields resolves the selected fields of an object
+func (e *gqlExecutor) selectFields(typ string, parent interface{}, fields []gqlField, path []interface{}) *gqlObject {
+	obj := &gqlObject{values: map[string]interface{}{}}
+	var generic map[string]interface{}
+	for _, f := range fields {
+		fieldPath := append(path, f.Alias)
+		if f.Name == "__typename" {
+			obj.set(f.Alias, typ)
+			continue
+		}
+
+		var value interface{}
+		childType := ""
+		if resolve, ok := gqlSchema[typ][f.Name]; ok {
+			v, t, err := resolve(e.h, parent, e.resolveArgs(f.Args))
+			if err != nil {
+				e.fail(fieldPath, err)
+				obj.set(f.Alias, nil)
+				continue
+			}
+			value, childType = v, t
+		} else if typ == "Query" {
+			e.fail(fieldPath, fmt.Errorf("unknown field %q on Query", f.Name))
+			obj.set(f.Alias, nil)
+			continue
+		} else {
+			if generic == nil {
+				generic = toGenericObject(parent)
+			}
+			value = generic[f.Name]
+		}
+		obj.set(f.Alias, e.complete(value, childType, f.Selections, fieldPath))
+	}
+	return obj
+}
+
+// complete applies the sub selection to a resolved value
+func (e *gqlExecutor) complete(v interface{}, typ string, fields []gqlField, path []interface{}) interface{} {
+	if v == nil || len(fields) == 0 {
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = e.complete(rv.Index(i).Interface(), typ, fields, append(path, i))
+		}
+		return out
+	}
+	if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Map {
+		e.fail(path, errors.New("field has no sub fields"))
+		return nil
+	}
+	return e.selectFields(typ, rv.Interface(), fields, path)
+}
+
+// toGenericObject converts a value to a map keyed by its JSON field names
+func toGenericObject(v interface{}) map[string]interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	_ = json.Unmarshal(b, &m)
+	return m
+}
+
+// graphqlRequest is the body of a GraphQL POST request
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphqlResponse is the GraphQL response envelope
+type graphqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	shipmodel "github.com/enbility/ship-go/model"
+)
+
+// maxHandshakeRuns is the number of handshakes kept per peer
+const maxHandshakeRuns = 100
+
+// SHIP connection setup phases
+const (
+	phaseConnect           = "connect" // TCP, TLS and websocket upgrade, only measurable for outgoing connections
+	phaseCMI               = "cmi"
+	phaseHello             = "hello"
+	phaseProtocol          = "protocolHandshake"
+	phasePin               = "pin"
+	phaseAccessMethods     = "accessMethods"
+	phaseDetailedDiscovery = "detailedDiscovery"
+)
+
+// handshakePhases is the order of the phases in reports
+var handshakePhases = []string{phaseConnect, phaseCMI, phaseHello, phaseProtocol, phasePin, phaseAccessMethods, phaseDetailedDiscovery}
+
+// handshakePhase is the duration of a single connection setup phase
+type handshakePhase struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs float64   `json:"durationMs"`
+	done       bool
+}
+
+// handshakeRun is a single connection setup of a peer
+type handshakeRun struct {
+	SKI       string           `json:"ski"`
+	Direction string           `json:"direction"`
+	StartedAt time.Time        `json:"startedAt"`
+	Phases    []handshakePhase `json:"phases"`
+	State     string           `json:"state"`
+	Error     string           `json:"error,omitempty"`
+	TotalMs   float64          `json:"totalMs"`
+}
+
+// handshakeStats summarizes the connection setups of a peer
+type handshakeStats struct {
+	SKI       string                  `json:"ski"`
+	Count     int                     `json:"count"`
+	Completed int                     `json:"completed"`
+	Failed    int                     `json:"failed"`
+	Phases    map[string]latencyStats `json:"phases"`
+	Total     latencyStats            `json:"total"`
+	Last      *handshakeRun           `json:"last,omitempty"`
+}
+
+// handshakeTracker times the connection setup of all peers
+type handshakeTracker struct {
+	mu     sync.Mutex
+	active map[string]*handshakeRun
+	runs   map[string][]*handshakeRun
+}
+
+func newHandshakeTracker() *handshakeTracker {
+	return &handshakeTracker{
+		active: make(map[string]*handshakeRun),
+		runs:   make(map[string][]*handshakeRun),
+	}
+}
+
+// shipStatePhase maps a SHIP message exchange state to its setup phase
+func shipStatePhase(state shipmodel.ShipMessageExchangeState) string {
+	switch {
+	case state <= shipmodel.CmiStateServerEvaluate:
+		return phaseCMI
+	case state <= shipmodel.SmeHelloStateRejected:
+		return phaseHello
+	case state <= shipmodel.SmeProtHStateServerOk:
+		return phaseProtocol
+	case state <= shipmodel.SmePinStateAskOk:
+		return phasePin
+	case state == shipmodel.SmeAccessMethodsRequest:
+		return phaseAccessMethods
+	}
+	return phaseDetailedDiscovery
+}
+
+// shipStateFailure returns a description if the state ends the handshake unsuccessfully
+func shipStateFailure(state shipmodel.ShipMessageExchangeState) string {
+	switch state {
+	case shipmodel.SmeHelloStateReadyTimeout, shipmodel.SmeHelloStatePendingTimeout:
+		return "hello timeout"
+	case shipmodel.SmeHelloStateAbort, shipmodel.SmeHelloStateAbortDone:
+		return "hello aborted"
+	case shipmodel.SmeHelloStateRemoteAbortDone:
+		return "hello aborted by remote"
+	case shipmodel.SmeHelloStateRejected:
+		return "rejected by remote"
+	case shipmodel.SmeProtHStateTimeout:
+		return "protocol handshake timeout"
+	case shipmodel.SmePinStateCheckError:
+		return "pin check error"
+	case shipmodel.SmeStateError:
+		return "handshake error"
+	}
+	return ""
+}
+
+// observeHandshakeLog extracts connection setup progress from the ship-go log output
+func (h *hems) observeHandshakeLog(args ...interface{}) {
+	if h.handshakes == nil || len(args) < 2 {
+		return
+	}
+
+	// ski, "SHIP state changed to:", state
+	if len(args) == 3 {
+		if msg, ok := args[1].(string); ok && msg == "SHIP state changed to:" {
+			ski, _ := args[0].(string)
+			if state, ok := args[2].(shipmodel.ShipMessageExchangeState); ok && ski != "" {
+				h.handshakeState(ski, state)
+			}
+			return
+		}
+	}
+
+	first, _ := args[0].(string)
+	switch first {
+	case "Recv:":
+		// "Recv:", ski, message
+		if len(args) == 3 {
+			ski, _ := args[1].(string)
+			if text, ok := args[2].(string); ok && strings.Contains(text, "nodeManagementDetailedDiscoveryData") {
+				h.handshakeDiscovery(ski)
+			}
+		}
+	case "incoming connection request from":
+		if ski, ok := args[1].(string); ok {
+			h.handshakeStart(ski, "incoming", phaseCMI)
+		}
+	}
+}
+
+// observeHandshakeLogf handles the formatted ship-go log output
+func (h *hems) observeHandshakeLogf(format string, args ...interface{}) {
+	if h.handshakes == nil || len(args) == 0 {
+		return
+	}
+	if strings.HasPrefix(format, "initiating connection to") {
+		if ski, ok := args[0].(string); ok {
+			h.handshakeStart(ski, "outgoing", phaseConnect)
+		}
+	}
+}
+
+// handshakeStart begins a new connection setup measurement
+func (h *hems) handshakeStart(ski, direction, phase string) {
+	now := time.Now()
+	h.handshakes.mu.Lock()
+	defer h.handshakes.mu.Unlock()
+
+	run := &handshakeRun{
+		SKI:       ski,
+		Direction: direction,
+		StartedAt: now,
+		State:     "inProgress",
+		Phases:    []handshakePhase{{Name: phase, StartedAt: now}},
+	}
+	h.handshakes.active[ski] = run
+}
+
+// enterPhase closes the current phase of a run and starts the next one.
+// The caller must hold the tracker mutex.
+func (r *handshakeRun) enterPhase(name string, now time.Time) {
+	if n := len(r.Phases); n > 0 {
+		last := &r.Phases[n-1]
+		if last.Name == name {
+			return
+		}
+		if !last.done {
+			last.DurationMs = float64(now.Sub(last.StartedAt)) / float64(time.Millisecond)
+			last.done = true
+		}
+	}
+	r.Phases = append(r.Phases, handshakePhase{Name: name, StartedAt: now})
+}
+
+func (h *hems) handshakeState(ski string, state shipmodel.ShipMessageExchangeState) {
+	now := time.Now()
+
+	h.handshakes.mu.Lock()
+	run, ok := h.handshakes.active[ski]
+	if !ok || (state == shipmodel.CmiStateInitStart && run.Phases[len(run.Phases)-1].Name != phaseConnect) {
+		// incoming connection or a new attempt without a logged start
+		run = &handshakeRun{SKI: ski, Direction: "incoming", StartedAt: now, State: "inProgress"}
+		h.handshakes.active[ski] = run
+	}
+	run.enterPhase(shipStatePhase(state), now)
+
+	failure := shipStateFailure(state)
+	var finished *handshakeRun
+	if failure != "" {
+		run.State = "failed"
+		run.Error = fmt.Sprintf("%s (state %d)", failure, state)
+		finished = h.finishHandshake(run, now)
+	}
+	h.handshakes.mu.Unlock()
+
+	if finished != nil {
+		h.traceHandshake(finished)
+		h.recordEvent("handshake", severityWarning, ski, "SHIP handshake failed: "+finished.Error, handshakeEventData(finished))
+	}
+}
+
+func (h *hems) handshakeDiscovery(ski string) {
+	now := time.Now()
+
+	h.handshakes.mu.Lock()
+	run, ok := h.handshakes.active[ski]
+	if !ok || run.Phases[len(run.Phases)-1].Name != phaseDetailedDiscovery {
+		h.handshakes.mu.Unlock()
+		return
+	}
+	run.State = "completed"
+	finished := h.finishHandshake(run, now)
+	h.handshakes.mu.Unlock()
+
+	h.traceHandshake(finished)
+	h.readinessDiscovered(finished)
+	h.Debugf("connection setup of %s completed in %.0f ms", ski, finished.TotalMs)
+	h.recordEvent("handshake", severityInfo, ski, fmt.Sprintf("connection setup completed in %.0f ms", finished.TotalMs), handshakeEventData(finished))
+}
+
+// finishHandshake closes a run and stores it. The caller must hold the tracker mutex.
+func (h *hems) finishHandshake(run *handshakeRun, now time.Time) *handshakeRun {
+	if n := len(run.Phases); n > 0 && !run.Phases[n-1].done {
+		last := &run.Phases[n-1]
+		last.DurationMs = float64(now.Sub(last.StartedAt)) / float64(time.Millisecond)
+		last.done = true
+	}
+	run.TotalMs = float64(now.Sub(run.StartedAt)) / float64(time.Millisecond)
+	delete(h.handshakes.active, run.SKI)
+
+	runs := append(h.handshakes.runs[run.SKI], run)
+	if len(runs) > maxHandshakeRuns {
+		runs = runs[len(runs)-maxHandshakeRuns:]
+	}
+	h.handshakes.runs[run.SKI] = runs
+	out := *run
+	out.Phases = append([]handshakePhase(nil), run.Phases...)
+	return &out
+}
+
+func handshakeEventData(run *handshakeRun) map[string]interface{} {
+	phases := make(map[string]float64, len(run.Phases))
+	for _, p := range run.Phases {
+		phases[p.Name] = p.DurationMs
+	}
+	return map[string]interface{}{"direction": run.Direction, "totalMs": run.TotalMs, "phasesMs": phases}
+}
+
+// getHandshakeStats returns the per phase durations of the connection setups per peer
+func (h *hems) getHandshakeStats(ski string) map[string]handshakeStats {
+	h.handshakes.mu.Lock()
+	defer h.handshakes.mu.Unlock()
+
+	out := make(map[string]handshakeStats)
+	for key, runs := range h.handshakes.runs {
+		if ski != "" && key != ski {
+			continue
+		}
+		stats := handshakeStats{SKI: key, Count: len(runs), Phases: make(map[string]latencyStats)}
+		samples := make(map[string][]float64)
+		var totals []float64
+		for _, r := range runs {
+			if r.State != "completed" {
+				stats.Failed++
+				continue
+			}
+			stats.Completed++
+			totals = append(totals, r.TotalMs)
+			for _, p := range r.Phases {
+				samples[p.Name] = append(samples[p.Name], p.DurationMs)
+			}
+		}
+		for _, name := range handshakePhases {
+			if s, ok := samples[name]; ok {
+				stats.Phases[name] = computeLatencyStats(s)
+			}
+		}
+		stats.Total = computeLatencyStats(totals)
+		if len(runs) > 0 {
+			last := *runs[len(runs)-1]
+			last.Phases = append([]handshakePhase(nil), last.Phases...)
+			stats.Last = &last
+		}
+		out[key] = stats
+	}
+	return out
+}
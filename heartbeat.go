@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/features/client"
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// localHeartbeatTimeout is the default heartbeat timeout the tester announces to the DUT, spine-go
+// sends the heartbeat 2 seconds before it ends
+const localHeartbeatTimeout = 30 * time.Second
+
+// localHeartbeatPoll is the interval the local heartbeat state is checked in
+const localHeartbeatPoll = time.Second
+
+// localHeartbeatStatus is the state of the heartbeat the tester sends to the DUT
+type localHeartbeatStatus struct {
+	// Available is false while the local entity has no DeviceDiagnosis heartbeat server,
+	// which is added by the LPC and LPP use cases
+	Available       bool       `json:"available"`
+	Running         bool       `json:"running"`
+	IntervalSeconds float64    `json:"intervalSeconds"`
+	TimeoutSeconds  float64    `json:"timeoutSeconds"`
+	Counter         *uint64    `json:"counter,omitempty"`
+	LastSentAt      *time.Time `json:"lastSentAt,omitempty"`
+	// Since is the time the heartbeat was last started or stopped
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// localHeartbeat tracks the local heartbeat, spine-go does not report its state changes
+type localHeartbeat struct {
+	mu     sync.Mutex
+	status localHeartbeatStatus
+}
+
+func newLocalHeartbeat(timeout time.Duration) *localHeartbeat {
+	interval := timeout
+	if interval > 2*time.Second {
+		interval -= 2 * time.Second
+	}
+	return &localHeartbeat{status: localHeartbeatStatus{
+		IntervalSeconds: interval.Seconds(),
+		TimeoutSeconds:  timeout.Seconds(),
+	}}
+}
+
+func (l *localHeartbeat) get() localHeartbeatStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+// runLocalHeartbeatMonitor polls the local heartbeat and reports when it starts or stops
+func (h *hems) runLocalHeartbeatMonitor() {
+	for range time.Tick(localHeartbeatPoll) {
+		h.checkLocalHeartbeat()
+	}
+}
+
+func (h *hems) checkLocalHeartbeat() {
+	entity := h.mainEntity()
+	if entity == nil {
+		return
+	}
+	feature := entity.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer)
+	running := entity.HeartbeatManager() != nil && entity.HeartbeatManager().IsHeartbeatRunning()
+
+	l := h.heartbeat
+	l.mu.Lock()
+	prev := l.status
+	l.status.Available = feature != nil
+	l.status.Running = running
+	if feature != nil {
+		if data, ok := feature.DataCopy(model.FunctionTypeDeviceDiagnosisHeartbeatData).(*model.DeviceDiagnosisHeartbeatDataType); ok && data != nil {
+			l.status.Counter = data.HeartbeatCounter
+			if data.Timestamp != nil {
+				if t, err := data.Timestamp.GetTime(); err == nil {
+					l.status.LastSentAt = optionalTime(t.Local())
+				}
+			}
+		}
+	}
+	changed := prev.Running != running
+	if changed {
+		now := time.Now()
+		l.status.Since = &now
+	}
+	status := l.status
+	l.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	msg := "local heartbeat stopped"
+	severity := severityWarning
+	if running {
+		msg, severity = "local heartbeat started", severityInfo
+	}
+	h.recordEvent("heartbeat", severity, "", msg, map[string]interface{}{
+		"running":         running,
+		"intervalSeconds": status.IntervalSeconds,
+		"counter":         status.Counter,
+	})
+	h.broadcastJSON(map[string]interface{}{
+		"type":      "localHeartbeat",
+		"heartbeat": status,
+	})
+}
+
+// Defaults of the remote heartbeat supervision, the timeout is the one of eebus-go
+const (
+	defaultHeartbeatSupervision = 2 * time.Minute
+	defaultHeartbeatCheck       = time.Second
+)
+
+// HeartbeatConfig configures the supervision of the heartbeat received from the DUT
+type HeartbeatConfig struct {
+	// TimeoutSeconds is the duration within which the last heartbeat must have been
+	// received to be considered ok, defaults to 120
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// CheckIntervalMs is the interval the heartbeats are re-evaluated in, defaults to 1000
+	CheckIntervalMs int `json:"checkIntervalMs,omitempty"`
+}
+
+func (c HeartbeatConfig) timeout() time.Duration {
+	if c.TimeoutSeconds <= 0 {
+		return defaultHeartbeatSupervision
+	}
+	return time.Duration(c.TimeoutSeconds * float64(time.Second))
+}
+
+func (c HeartbeatConfig) checkInterval() time.Duration {
+	if c.CheckIntervalMs <= 0 {
+		return defaultHeartbeatCheck
+	}
+	return time.Duration(c.CheckIntervalMs) * time.Millisecond
+}
+
+func (h *hems) heartbeatConfig() HeartbeatConfig {
+	if h.config == nil {
+		return HeartbeatConfig{}
+	}
+	return h.config.Heartbeat
+}
+
+// supervisedHeartbeat is the heartbeat of a remote entity for a use case of a peer
+type supervisedHeartbeat struct {
+	ski     string
+	usecase string
+	entity  spineapi.EntityRemoteInterface
+	ok      bool
+	since   time.Time
+}
+
+// heartbeatSupervisor holds the supervised remote heartbeats by SKI and use case
+type heartbeatSupervisor struct {
+	mu         sync.Mutex
+	heartbeats map[string]*supervisedHeartbeat
+}
+
+func newHeartbeatSupervisor() *heartbeatSupervisor {
+	return &heartbeatSupervisor{heartbeats: make(map[string]*supervisedHeartbeat)}
+}
+
+// heartbeatWithinTimeout reports whether the last heartbeat of the entity was received
+// within the configured supervision timeout
+func (h *hems) heartbeatWithinTimeout(entity spineapi.EntityRemoteInterface) bool {
+	localEntity := h.mainEntity()
+	dd, err := client.NewDeviceDiagnosis(localEntity, entity)
+	if err != nil {
+		return false
+	}
+	return dd.IsHeartbeatWithinDuration(h.heartbeatConfig().timeout())
+}
+
+// superviseHeartbeat is called by the use case handlers for every heartbeat update. It
+// starts supervising the entity and returns whether its heartbeat is ok.
+func (h *hems) superviseHeartbeat(ski, usecase string, entity spineapi.EntityRemoteInterface) bool {
+	ok := h.heartbeatWithinTimeout(entity)
+	s := h.heartbeats
+	s.mu.Lock()
+	key := ski + "/" + usecase
+	hb, exists := s.heartbeats[key]
+	if !exists {
+		hb = &supervisedHeartbeat{ski: ski, usecase: usecase, ok: ok, since: time.Now()}
+		s.heartbeats[key] = hb
+	}
+	hb.entity = entity
+	changed := exists && hb.ok != ok
+	if changed {
+		hb.ok, hb.since = ok, time.Now()
+	}
+	s.mu.Unlock()
+
+	if changed {
+		h.reportHeartbeatChange(ski, usecase, ok)
+	}
+	return ok
+}
+
+// runHeartbeatSupervision re-evaluates the supervised heartbeats, so a lost heartbeat is
+// detected without an incoming event
+func (h *hems) runHeartbeatSupervision() {
+	ticker := time.NewTicker(h.heartbeatConfig().checkInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		h.checkHeartbeats()
+	}
+}
+
+func (h *hems) checkHeartbeats() {
+	s := h.heartbeats
+	s.mu.Lock()
+	heartbeats := make([]*supervisedHeartbeat, 0, len(s.heartbeats))
+	for _, hb := range s.heartbeats {
+		heartbeats = append(heartbeats, hb)
+	}
+	s.mu.Unlock()
+
+	for _, hb := range heartbeats {
+		ok := h.heartbeatWithinTimeout(hb.entity)
+		s.mu.Lock()
+		changed := hb.ok != ok
+		if changed {
+			hb.ok, hb.since = ok, time.Now()
+		}
+		s.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		if peer := h.getPeer(hb.ski); peer != nil {
+			usecaseDataMutex.Lock()
+			switch hb.usecase {
+			case "LPC":
+				peer.usecaseData.LpcHeartbeatOk = ok
+			case "LPP":
+				peer.usecaseData.LppHeartbeatOk = ok
+			case "CSLPC":
+				peer.usecaseData.CsLpcHeartbeatOk = ok
+			case "CSLPP":
+				peer.usecaseData.CsLppHeartbeatOk = ok
+			}
+			usecaseDataMutex.Unlock()
+		}
+		h.reportHeartbeatChange(hb.ski, hb.usecase, ok)
+	}
+}
+
+// reportHeartbeatChange records a lost or recovered remote heartbeat
+func (h *hems) reportHeartbeatChange(ski, usecase string, ok bool) {
+	timeout := h.heartbeatConfig().timeout()
+	msg := fmt.Sprintf("%s: remote heartbeat lost, none received within %s", usecase, timeout)
+	severity := severityError
+	if ok {
+		msg, severity = fmt.Sprintf("%s: remote heartbeat recovered", usecase), severityInfo
+	}
+	h.recordEvent("heartbeat", severity, ski, msg, map[string]interface{}{
+		"usecase":        usecase,
+		"ok":             ok,
+		"timeoutSeconds": timeout.Seconds(),
+	})
+	h.broadcastJSON(map[string]interface{}{
+		"type":    "remoteHeartbeat",
+		"ski":     ski,
+		"usecase": usecase,
+		"ok":      ok,
+	})
+}
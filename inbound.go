@@ -0,0 +1,58 @@
+package main
+
+import (
+	shipapi "github.com/enbility/ship-go/api"
+)
+
+// connectionDirection returns "incoming" or "outgoing" for the current or last SHIP
+// connection setup of a SKI, empty if none was observed
+func (h *hems) connectionDirection(ski string) string {
+	h.handshakes.mu.Lock()
+	defer h.handshakes.mu.Unlock()
+	if run, ok := h.handshakes.active[ski]; ok {
+		return run.Direction
+	}
+	if runs := h.handshakes.runs[ski]; len(runs) > 0 {
+		return runs[len(runs)-1].Direction
+	}
+	return ""
+}
+
+// trackIncomingPairing surfaces a DUT that connected to the tester and waits for trust.
+// The SKI is listed as peer, even without an mDNS announcement, until it is trusted via
+// auto accept, the trust prompt or POST /api/connect.
+func (h *hems) trackIncomingPairing(ski string) {
+	peer := h.getOrCreatePeer(ski)
+	direction := h.connectionDirection(ski)
+	h.peersMu.Lock()
+	first := !peer.waitingForTrust
+	peer.waitingForTrust = true
+	peer.direction = direction
+	h.peersMu.Unlock()
+	if !first {
+		return
+	}
+	if h.config.Trust.Prompt == nil {
+		// the trust prompt records its own event
+		h.recordEvent("trust", severityInfo, ski, "incoming pairing request waiting for trust", map[string]interface{}{"direction": direction})
+	}
+	h.broadcastPeerList()
+}
+
+// updateIncomingPairing clears the waiting state once the pairing request is decided
+func (h *hems) updateIncomingPairing(ski string, state shipapi.ConnectionState) {
+	if state == shipapi.ConnectionStateReceivedPairingRequest {
+		return
+	}
+	peer := h.getPeer(ski)
+	if peer == nil {
+		return
+	}
+	h.peersMu.Lock()
+	changed := peer.waitingForTrust
+	peer.waitingForTrust = false
+	h.peersMu.Unlock()
+	if changed {
+		h.broadcastPeerList()
+	}
+}
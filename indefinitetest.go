@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults of the indefinite limit test
+const (
+	// defaultIndefiniteReboot is the time the operator gets to reboot the DUT
+	defaultIndefiniteReboot = 15 * time.Minute
+	// defaultIndefiniteSettle is the time the rebooted DUT gets to offer LPC again
+	defaultIndefiniteSettle = 2 * time.Minute
+	indefiniteTestPoll      = time.Second
+)
+
+// indefiniteTestRequest starts an indefinite limit test
+type indefiniteTestRequest struct {
+	SKI string `json:"ski"`
+	// Value is the consumption limit in W
+	Value float64 `json:"value"`
+	// RebootSeconds is the time to reboot the DUT after the limit was written, defaults to 900
+	RebootSeconds float64 `json:"rebootSeconds,omitempty"`
+	// SettleSeconds is the time the DUT gets after the reconnect to offer LPC again, defaults to 120
+	SettleSeconds float64 `json:"settleSeconds,omitempty"`
+	// Restore deactivates the limit after the test, defaults to true
+	Restore *bool `json:"restore,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// indefiniteTestRun is an active or finished indefinite limit test
+type indefiniteTestRun struct {
+	SKI       string     `json:"ski"`
+	Value     float64    `json:"value"`
+	Running   bool       `json:"running"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	// Phase is "write", "waitingForReboot", "reconnecting", "readBack" or "done"
+	Phase string `json:"phase"`
+	// Before and After are the consumption limits read before and after the reboot
+	Before         *lpcLimitReading `json:"before,omitempty"`
+	After          *lpcLimitReading `json:"after,omitempty"`
+	DisconnectedAt *time.Time       `json:"disconnectedAt,omitempty"`
+	ReconnectedAt  *time.Time       `json:"reconnectedAt,omitempty"`
+	Assertions     []testAssertion  `json:"assertions"`
+	Passed         bool             `json:"passed"`
+	Error          string           `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// indefiniteTestState holds the current or last indefinite limit test
+type indefiniteTestState struct {
+	mu  sync.Mutex
+	run *indefiniteTestRun
+}
+
+// startIndefiniteTest writes an indefinite consumption limit and checks the DUT still
+// reports it after the operator rebooted the DUT
+func (h *hems) startIndefiniteTest(req indefiniteTestRequest) (*indefiniteTestRun, error) {
+	if h.uceglpc == nil {
+		return nil, errors.New("LPC usecase is disabled")
+	}
+	if req.SKI == "" {
+		return nil, errors.New("ski is required")
+	}
+	if req.Value < 0 {
+		return nil, errors.New("value must not be negative")
+	}
+	peer := h.getPeer(req.SKI)
+	if peer == nil || !peer.connected {
+		return nil, errors.New("the DUT is not connected")
+	}
+	run := &indefiniteTestRun{
+		SKI:       req.SKI,
+		Value:     req.Value,
+		Running:   true,
+		StartedAt: time.Now(),
+		Phase:     "write",
+		Metadata:  req.Metadata,
+	}
+
+	h.indefiniteTests.mu.Lock()
+	if h.indefiniteTests.run != nil && h.indefiniteTests.run.Running {
+		h.indefiniteTests.mu.Unlock()
+		return nil, errors.New("an indefinite limit test is already running")
+	}
+	h.indefiniteTests.run = run
+	snap := copyIndefiniteTestRun(run)
+	h.indefiniteTests.mu.Unlock()
+
+	reboot := secondsOr(req.RebootSeconds, defaultIndefiniteReboot)
+	settle := secondsOr(req.SettleSeconds, defaultIndefiniteSettle)
+	restore := req.Restore == nil || *req.Restore
+	go h.runIndefiniteTest(run, reboot, settle, restore)
+	h.recordEvent("indefinitetest", severityInfo, req.SKI, "indefinite limit test started, reboot the DUT after the limit was written", nil)
+	return snap, nil
+}
+
+func (h *hems) runIndefiniteTest(run *indefiniteTestRun, reboot, settle time.Duration, restore bool) {
+	span := h.tracer.startSpan("test limits/indefinite", spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	errText := h.indefiniteTestSteps(run, reboot, settle)
+
+	if restore {
+		payload := map[string]interface{}{"ski": run.SKI, "value": run.Value, "isActive": false, "durationSeconds": 0}
+		if _, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+			return h.WriteLPCConsumptionLimit(run.SKI, 0, run.Value, false)
+		}); err != nil {
+			h.Errorf("indefinite limit test: restore limit: %v", err)
+		}
+	}
+
+	now := time.Now()
+	h.indefiniteTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Phase = "done"
+	run.Error = errText
+	run.Passed = errText == ""
+	for _, a := range run.Assertions {
+		if !a.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := indefiniteTestResult(run)
+	h.indefiniteTests.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("indefinite limit test: %v", err)
+	} else {
+		h.indefiniteTests.mu.Lock()
+		run.ResultID = result.ID
+		h.indefiniteTests.mu.Unlock()
+	}
+	h.broadcastIndefiniteTest()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("indefinite limit test %s", verdict)
+	h.recordEvent("indefinitetest", severity, run.SKI, "indefinite limit test "+verdict, nil)
+}
+
+// indefiniteTestSteps writes the limit, waits for the reboot and reads the limit back. It
+// returns an error text when the test could not be carried out.
+func (h *hems) indefiniteTestSteps(run *indefiniteTestRun, reboot, settle time.Duration) string {
+	payload := map[string]interface{}{"ski": run.SKI, "value": run.Value, "isActive": true, "durationSeconds": 0}
+	c, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+		return h.WriteLPCConsumptionLimit(run.SKI, 0, run.Value, true)
+	})
+	if err != nil {
+		return "write limit: " + err.Error()
+	}
+	<-c.done
+	snap, _ := h.getCommand(c.ID)
+	msg := snap.Error
+	if msg == "" && snap.State != commandAcknowledged {
+		msg = string(snap.State)
+	}
+	h.addIndefiniteAssertion(run, "indefinite limit acknowledged", snap.State == commandAcknowledged, msg, nil)
+	if snap.State != commandAcknowledged {
+		return ""
+	}
+
+	time.Sleep(timeTestSettle)
+	before, err := h.readIndefiniteLimit(run.SKI, 0)
+	if err != nil {
+		return "read limit: " + err.Error()
+	}
+	h.indefiniteTests.mu.Lock()
+	run.Before = before
+	h.indefiniteTests.mu.Unlock()
+	ok, msg := indefiniteLimitMatches(before, run.Value)
+	h.addIndefiniteAssertion(run, "indefinite limit reported", ok, msg, nil)
+
+	// the operator reboots the DUT, a reboot is a disconnect followed by a new connection
+	h.setIndefinitePhase(run, "waitingForReboot")
+	h.Infof("indefinite limit test: reboot the DUT %s within %s", run.SKI, reboot)
+	peer := h.getPeer(run.SKI)
+	if peer == nil {
+		return "the DUT is unknown"
+	}
+	connects := peer.connectCount
+	deadline := time.Now().Add(reboot)
+	for time.Now().Before(deadline) {
+		now := time.Now()
+		if !peer.connected && run.DisconnectedAt == nil {
+			h.indefiniteTests.mu.Lock()
+			run.DisconnectedAt = &now
+			run.Phase = "reconnecting"
+			h.indefiniteTests.mu.Unlock()
+			h.broadcastIndefiniteTest()
+		}
+		if peer.connected && peer.connectCount > connects {
+			h.indefiniteTests.mu.Lock()
+			if run.DisconnectedAt == nil {
+				run.DisconnectedAt = &now
+			}
+			run.ReconnectedAt = &now
+			h.indefiniteTests.mu.Unlock()
+			break
+		}
+		time.Sleep(indefiniteTestPoll)
+	}
+	if run.ReconnectedAt == nil {
+		h.addIndefiniteAssertion(run, "DUT rebooted", false, fmt.Sprintf("the DUT did not reconnect within %s", reboot), nil)
+		return ""
+	}
+	down := run.ReconnectedAt.Sub(*run.DisconnectedAt).Seconds()
+	h.addIndefiniteAssertion(run, "DUT rebooted", true, fmt.Sprintf("reconnected after %.0f s", down), &down)
+
+	h.setIndefinitePhase(run, "readBack")
+	after, err := h.readIndefiniteLimit(run.SKI, settle)
+	if err != nil {
+		h.addIndefiniteAssertion(run, "indefinite limit kept after reboot", false, "read limit: "+err.Error(), nil)
+		return ""
+	}
+	h.indefiniteTests.mu.Lock()
+	run.After = after
+	h.indefiniteTests.mu.Unlock()
+	ok, msg = indefiniteLimitMatches(after, run.Value)
+	h.addIndefiniteAssertion(run, "indefinite limit kept after reboot", ok, msg, nil)
+	return ""
+}
+
+// readIndefiniteLimit reads the consumption limit of the DUT, retrying until wait elapsed
+// while the rebooted DUT does not offer LPC yet
+func (h *hems) readIndefiniteLimit(ski string, wait time.Duration) (*lpcLimitReading, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		readings, err := h.readLPC(ski)
+		if err == nil && readings[0].ConsumptionLimit != nil {
+			return readings[0].ConsumptionLimit, nil
+		}
+		if err == nil {
+			err = errors.New("the DUT reports no consumption limit")
+		}
+		if !time.Now().Before(deadline) {
+			return nil, err
+		}
+		time.Sleep(indefiniteTestPoll)
+	}
+}
+
+// indefiniteLimitMatches checks that the limit is active, has the value and no duration
+func indefiniteLimitMatches(limit *lpcLimitReading, value float64) (bool, string) {
+	msg := fmt.Sprintf("%.0f W, active %t, duration %.0f s", limit.Value, limit.Active, limit.DurationSeconds)
+	switch {
+	case !limit.Active:
+		return false, msg + ", the limit is not active"
+	case math.Abs(limit.Value-value) > 0.5:
+		return false, fmt.Sprintf("%s, expected %.0f W", msg, value)
+	case limit.DurationSeconds != 0:
+		return false, msg + ", the limit has a duration"
+	}
+	return true, msg
+}
+
+func (h *hems) setIndefinitePhase(run *indefiniteTestRun, phase string) {
+	h.indefiniteTests.mu.Lock()
+	run.Phase = phase
+	h.indefiniteTests.mu.Unlock()
+	h.broadcastIndefiniteTest()
+}
+
+func (h *hems) addIndefiniteAssertion(run *indefiniteTestRun, name string, passed bool, msg string, duration *float64) {
+	h.indefiniteTests.mu.Lock()
+	run.Assertions = append(run.Assertions, testAssertion{Name: name, Passed: passed, Message: msg, DurationSeconds: duration})
+	h.indefiniteTests.mu.Unlock()
+	h.broadcastIndefiniteTest()
+}
+
+// indefiniteTestResult converts a finished indefinite limit test to a stored test run
+func indefiniteTestResult(run *indefiniteTestRun) *testRunResult {
+	res := &testRunResult{Plan: "limits/indefinite", SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	res.Assertions = append(res.Assertions, run.Assertions...)
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyIndefiniteTestRun(run *indefiniteTestRun) *indefiniteTestRun {
+	c := *run
+	c.Assertions = append([]testAssertion(nil), run.Assertions...)
+	return &c
+}
+
+// getIndefiniteTest returns a copy of the current or last indefinite limit test
+func (h *hems) getIndefiniteTest() *indefiniteTestRun {
+	h.indefiniteTests.mu.Lock()
+	defer h.indefiniteTests.mu.Unlock()
+	if h.indefiniteTests.run == nil {
+		return nil
+	}
+	return copyIndefiniteTestRun(h.indefiniteTests.run)
+}
+
+// broadcastIndefiniteTest sends the progress of the indefinite limit test to all websocket clients
+func (h *hems) broadcastIndefiniteTest() {
+	run := h.getIndefiniteTest()
+	if run == nil {
+		return
+	}
+	h.broadcastJSON(map[string]interface{}{
+		"type":           "indefinitetest",
+		"ski":            run.SKI,
+		"indefinitetest": run,
+	})
+}
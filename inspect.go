@@ -0,0 +1,810 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/features/client"
+	shiputil "github.com/enbility/ship-go/util"
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+	"github.com/enbility/spine-go/util"
+)
+
+// inspectionClientFeatures are added to the local CEM entity so the inspection endpoints
+// can read the server features of the DUT, independent of the enabled use cases
+var inspectionClientFeatures = []model.FeatureTypeType{
+	model.FeatureTypeTypeDeviceDiagnosis,
+	model.FeatureTypeTypeDeviceClassification,
+	model.FeatureTypeTypeElectricalConnection,
+	model.FeatureTypeTypeMeasurement,
+	model.FeatureTypeTypeLoadControl,
+}
+
+// addInspectionClients adds the client features of the inspection endpoints, it must be
+// called before the service starts so they are part of the detailed discovery
+func addInspectionClients(localEntity spineapi.EntityLocalInterface) {
+	for _, featureType := range inspectionClientFeatures {
+		localEntity.GetOrAddFeature(featureType, model.RoleTypeClient)
+	}
+}
+
+// entitiesWithServerFeature returns the discovered remote entities with a server feature
+// of the type, of all peers or only those of one SKI, sorted by SKI and address
+func (h *hems) entitiesWithServerFeature(ski string, featureType model.FeatureTypeType) []spineapi.EntityRemoteInterface {
+	ski = shiputil.NormalizeSKI(ski)
+	var out []spineapi.EntityRemoteInterface
+	for peerSKI, peer := range h.getAllPeers() {
+		if ski != "" && shiputil.NormalizeSKI(peerSKI) != ski {
+			continue
+		}
+		for _, entity := range peer.entities.snapshot().Entities {
+			if entity != nil && entity.FeatureOfTypeAndRole(featureType, model.RoleTypeServer) != nil {
+				out = append(out, entity)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if a, b := out[i].Device().Ski(), out[j].Device().Ski(); a != b {
+			return a < b
+		}
+		return compareEntityAddress(out[i], out[j])
+	})
+	return out
+}
+
+// readEntities reads all entities in parallel
+func readEntities[T any](entities []spineapi.EntityRemoteInterface, read func(spineapi.EntityRemoteInterface) T) []T {
+	readings := make([]T, len(entities))
+	var wg sync.WaitGroup
+	for i, entity := range entities {
+		wg.Add(1)
+		go func(i int, entity spineapi.EntityRemoteInterface) {
+			defer wg.Done()
+			readings[i] = read(entity)
+		}(i, entity)
+	}
+	wg.Wait()
+	return readings
+}
+
+// durationSeconds converts a SPINE duration, nil if it is not set or invalid
+func durationSeconds(d *model.DurationType) *float64 {
+	if d == nil {
+		return nil
+	}
+	duration, err := d.GetTimeDuration()
+	if err != nil {
+		return nil
+	}
+	seconds := duration.Seconds()
+	return &seconds
+}
+
+func stringValue[T ~string](v *T) *string {
+	if v == nil {
+		return nil
+	}
+	s := string(*v)
+	return &s
+}
+
+// heartbeatReading is the DeviceDiagnosis heartbeat data of the DUT
+type heartbeatReading struct {
+	Counter        *uint64  `json:"counter"`
+	TimeoutSeconds *float64 `json:"timeoutSeconds"`
+	Timestamp      *string  `json:"timestamp,omitempty"`
+	// WithinTimeout reports whether the last heartbeat was received within its timeout
+	WithinTimeout bool `json:"withinTimeout"`
+}
+
+// diagnosisReading is the DeviceDiagnosis data read from one remote entity
+type diagnosisReading struct {
+	SKI                  string            `json:"ski"`
+	Entity               string            `json:"entity"`
+	EntityType           string            `json:"entityType"`
+	ReadAt               time.Time         `json:"readAt"`
+	OperatingState       *string           `json:"operatingState"`
+	PowerSupplyCondition *string           `json:"powerSupplyCondition"`
+	LastErrorCode        *string           `json:"lastErrorCode"`
+	VendorStateCode      *string           `json:"vendorStateCode,omitempty"`
+	UpTimeSeconds        *float64          `json:"upTimeSeconds,omitempty"`
+	TotalUpTimeSeconds   *float64          `json:"totalUpTimeSeconds,omitempty"`
+	Timestamp            *string           `json:"timestamp,omitempty"`
+	Heartbeat            *heartbeatReading `json:"heartbeat"`
+	Errors               map[string]string `json:"errors,omitempty"`
+}
+
+// readDiagnosis actively reads the DeviceDiagnosis state and heartbeat of all remote
+// entities with a DeviceDiagnosis server, optionally only those of one SKI
+func (h *hems) readDiagnosis(ski string) ([]diagnosisReading, error) {
+	entities := h.entitiesWithServerFeature(ski, model.FeatureTypeTypeDeviceDiagnosis)
+	if len(entities) == 0 {
+		return nil, errNoEntity
+	}
+	localEntity := h.mainEntity()
+	return readEntities(entities, func(entity spineapi.EntityRemoteInterface) diagnosisReading {
+		return h.readDiagnosisEntity(localEntity, entity)
+	}), nil
+}
+
+func (h *hems) readDiagnosisEntity(localEntity spineapi.EntityLocalInterface, entity spineapi.EntityRemoteInterface) diagnosisReading {
+	dd, ddErr := client.NewDeviceDiagnosis(localEntity, entity)
+	requests := []readRequest{
+		featureRead("deviceDiagnosisStateData", dd, ddErr, dd.RequestState),
+		featureRead("deviceDiagnosisHeartbeatData", dd, ddErr, dd.RequestHeartbeat),
+	}
+
+	errs := h.readFeatures(requests)
+	reading := diagnosisReading{
+		SKI:        entity.Device().Ski(),
+		Entity:     fmt.Sprint(entity.Address()),
+		EntityType: fmt.Sprint(entity.EntityType()),
+		ReadAt:     time.Now(),
+		Errors:     errs,
+	}
+	if ddErr != nil {
+		return reading
+	}
+
+	// the replies updated the remote feature data, notified data is used when a read failed
+	if state, err := dd.GetState(); err == nil {
+		reading.OperatingState = stringValue(state.OperatingState)
+		reading.PowerSupplyCondition = stringValue(state.PowerSupplyCondition)
+		reading.LastErrorCode = stringValue(state.LastErrorCode)
+		reading.VendorStateCode = stringValue(state.VendorStateCode)
+		reading.UpTimeSeconds = durationSeconds(state.UpTime)
+		reading.TotalUpTimeSeconds = durationSeconds(state.TotalUpTime)
+		reading.Timestamp = state.Timestamp
+	} else if _, ok := errs["deviceDiagnosisStateData"]; !ok {
+		errs["state"] = err.Error()
+	}
+
+	feature := entity.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer)
+	if heartbeat, ok := feature.DataCopy(model.FunctionTypeDeviceDiagnosisHeartbeatData).(*model.DeviceDiagnosisHeartbeatDataType); ok && heartbeat != nil {
+		reading.Heartbeat = &heartbeatReading{
+			Counter:        heartbeat.HeartbeatCounter,
+			TimeoutSeconds: durationSeconds(heartbeat.HeartbeatTimeout),
+		}
+		if heartbeat.Timestamp != nil {
+			if t, err := heartbeat.Timestamp.GetTime(); err == nil {
+				ts := formatTimestamp(t)
+				reading.Heartbeat.Timestamp = &ts
+			}
+		}
+		if reading.Heartbeat.TimeoutSeconds != nil {
+			timeout := time.Duration(*reading.Heartbeat.TimeoutSeconds * float64(time.Second))
+			reading.Heartbeat.WithinTimeout = dd.IsHeartbeatWithinDuration(timeout)
+		}
+	}
+	if len(errs) == 0 {
+		reading.Errors = nil
+	}
+	return reading
+}
+
+// entityManufacturer is the DeviceClassification manufacturer data of a remote entity,
+// multi-entity DUTs report different values per entity
+type entityManufacturer struct {
+	Brand            string `json:"brand,omitempty"`
+	Model            string `json:"model,omitempty"`
+	DeviceCode       string `json:"deviceCode,omitempty"`
+	Serial           string `json:"serial,omitempty"`
+	SoftwareRevision string `json:"softwareRevision,omitempty"`
+	HardwareRevision string `json:"hardwareRevision,omitempty"`
+	VendorName       string `json:"vendorName,omitempty"`
+	VendorCode       string `json:"vendorCode,omitempty"`
+	PowerSource      string `json:"powerSource,omitempty"`
+	Label            string `json:"label,omitempty"`
+}
+
+// manufacturerOfEntity returns the received manufacturer data of the entity, nil if it
+// has no DeviceClassification server or did not send the data yet
+func manufacturerOfEntity(entity spineapi.EntityRemoteInterface) *entityManufacturer {
+	feature := entity.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceClassification, model.RoleTypeServer)
+	if feature == nil {
+		return nil
+	}
+	data, ok := feature.DataCopy(model.FunctionTypeDeviceClassificationManufacturerData).(*model.DeviceClassificationManufacturerDataType)
+	if !ok || data == nil {
+		return nil
+	}
+	str := func(v *model.DeviceClassificationStringType) string {
+		if v == nil {
+			return ""
+		}
+		return string(*v)
+	}
+	m := &entityManufacturer{
+		Brand:            str(data.BrandName),
+		Model:            str(data.DeviceName),
+		DeviceCode:       str(data.DeviceCode),
+		Serial:           str(data.SerialNumber),
+		SoftwareRevision: str(data.SoftwareRevision),
+		HardwareRevision: str(data.HardwareRevision),
+		VendorName:       str(data.VendorName),
+		VendorCode:       str(data.VendorCode),
+	}
+	if data.PowerSource != nil {
+		m.PowerSource = string(*data.PowerSource)
+	}
+	if data.ManufacturerLabel != nil {
+		m.Label = string(*data.ManufacturerLabel)
+	}
+	return m
+}
+
+// requestClassifications reads the manufacturer data of new entities with a DeviceClassification
+// server that did not send it yet, the entities are re-sent once a reply arrived
+func (h *hems) requestClassifications(ski string, device spineapi.DeviceRemoteInterface, peer *peerData, entities []spineapi.EntityRemoteInterface) {
+	localEntity := h.mainEntity()
+	for _, entity := range entities {
+		if entity == nil || entity.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceClassification, model.RoleTypeServer) == nil {
+			continue
+		}
+		if manufacturerOfEntity(entity) != nil || !peer.entities.claimClassification(entity) {
+			continue
+		}
+		go func(entity spineapi.EntityRemoteInterface) {
+			cl, err := client.NewDeviceClassification(localEntity, entity)
+			err = h.readFeature(featureRead("deviceClassificationManufacturerData", cl, err, cl.RequestManufacturerDetails))
+			if err != nil {
+				h.Errorf("read DeviceClassification of %s entity %v: %v", ski, entity.Address().Entity, err)
+				return
+			}
+			h.updateEntitiesFromDevice(ski, device, peer)
+		}(entity)
+	}
+}
+
+// remoteFunctionData returns a copy of the function data of the server feature of the
+// entity, nil if the entity has no such feature or the DUT did not send the data
+func remoteFunctionData[T any](entity spineapi.EntityRemoteInterface, featureType model.FeatureTypeType, function model.FunctionType) *T {
+	feature := entity.FeatureOfTypeAndRole(featureType, model.RoleTypeServer)
+	if feature == nil {
+		return nil
+	}
+	data, _ := feature.DataCopy(function).(*T)
+	return data
+}
+
+// valueRange is a permitted range, Min or Max is nil if it is open
+type valueRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// scaledValue converts a SPINE scaled number, nil if it is not set
+func scaledValue(n *model.ScaledNumberType) *float64 {
+	if n == nil {
+		return nil
+	}
+	v := n.GetValue()
+	return &v
+}
+
+// ecParameter joins a parameter description with its permitted values and characteristics,
+// which is what a datasheet lists per phase
+type ecParameter struct {
+	ElectricalConnectionID uint               `json:"electricalConnectionId"`
+	ParameterID            uint               `json:"parameterId"`
+	MeasurementID          *uint              `json:"measurementId,omitempty"`
+	ScopeType              *string            `json:"scopeType,omitempty"`
+	VoltageType            *string            `json:"voltageType,omitempty"`
+	MeasuredPhases         *string            `json:"acMeasuredPhases,omitempty"`
+	MeasuredInReferenceTo  *string            `json:"acMeasuredInReferenceTo,omitempty"`
+	MeasurementType        *string            `json:"acMeasurementType,omitempty"`
+	MeasurementVariant     *string            `json:"acMeasurementVariant,omitempty"`
+	PermittedValues        []float64          `json:"permittedValues,omitempty"`
+	PermittedRanges        []valueRange       `json:"permittedRanges,omitempty"`
+	Characteristics        []ecCharacteristic `json:"characteristics,omitempty"`
+}
+
+// ecCharacteristic is a characteristic of an electrical connection parameter, e.g. its nominal maximum
+type ecCharacteristic struct {
+	ID      uint     `json:"characteristicId"`
+	Context *string  `json:"context,omitempty"`
+	Type    *string  `json:"type,omitempty"`
+	Value   *float64 `json:"value,omitempty"`
+	Unit    *string  `json:"unit,omitempty"`
+}
+
+// electricalConnectionDump is the ElectricalConnection description data of one remote entity,
+// the lists are the data as sent by the DUT, Parameters is the joined view
+type electricalConnectionDump struct {
+	SKI                   string                                                   `json:"ski"`
+	Entity                string                                                   `json:"entity"`
+	EntityType            string                                                   `json:"entityType"`
+	ReadAt                time.Time                                                `json:"readAt"`
+	Descriptions          []model.ElectricalConnectionDescriptionDataType          `json:"descriptions"`
+	ParameterDescriptions []model.ElectricalConnectionParameterDescriptionDataType `json:"parameterDescriptions"`
+	Characteristics       []model.ElectricalConnectionCharacteristicDataType       `json:"characteristics"`
+	PermittedValueSets    []model.ElectricalConnectionPermittedValueSetDataType    `json:"permittedValueSets"`
+	Parameters            []ecParameter                                            `json:"parameters"`
+	Errors                map[string]string                                        `json:"errors,omitempty"`
+}
+
+// readElectricalConnection actively reads the ElectricalConnection descriptions of all remote
+// entities with an ElectricalConnection server, optionally only those of one SKI
+func (h *hems) readElectricalConnection(ski string) ([]electricalConnectionDump, error) {
+	entities := h.entitiesWithServerFeature(ski, model.FeatureTypeTypeElectricalConnection)
+	if len(entities) == 0 {
+		return nil, errNoEntity
+	}
+	localEntity := h.mainEntity()
+	return readEntities(entities, func(entity spineapi.EntityRemoteInterface) electricalConnectionDump {
+		return h.readElectricalConnectionEntity(localEntity, entity)
+	}), nil
+}
+
+func (h *hems) readElectricalConnectionEntity(localEntity spineapi.EntityLocalInterface, entity spineapi.EntityRemoteInterface) electricalConnectionDump {
+	ec, ecErr := client.NewElectricalConnection(localEntity, entity)
+	requests := []readRequest{
+		featureRead("electricalConnectionDescriptionListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestDescriptions(nil, nil)
+		}),
+		featureRead("electricalConnectionParameterDescriptionListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestParameterDescriptions(nil, nil)
+		}),
+		featureRead("electricalConnectionCharacteristicListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestCharacteristics(nil, nil)
+		}),
+		featureRead("electricalConnectionPermittedValueSetListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestPermittedValueSets(nil, nil)
+		}),
+	}
+
+	errs := h.readFeatures(requests)
+	dump := electricalConnectionDump{
+		SKI:                   entity.Device().Ski(),
+		Entity:                fmt.Sprint(entity.Address()),
+		EntityType:            fmt.Sprint(entity.EntityType()),
+		ReadAt:                time.Now(),
+		Descriptions:          []model.ElectricalConnectionDescriptionDataType{},
+		ParameterDescriptions: []model.ElectricalConnectionParameterDescriptionDataType{},
+		Characteristics:       []model.ElectricalConnectionCharacteristicDataType{},
+		PermittedValueSets:    []model.ElectricalConnectionPermittedValueSetDataType{},
+		Parameters:            []ecParameter{},
+		Errors:                errs,
+	}
+
+	// notified data is used when a read failed
+	featureType := model.FeatureTypeTypeElectricalConnection
+	if d := remoteFunctionData[model.ElectricalConnectionDescriptionListDataType](entity, featureType, model.FunctionTypeElectricalConnectionDescriptionListData); d != nil {
+		dump.Descriptions = append(dump.Descriptions, d.ElectricalConnectionDescriptionData...)
+	}
+	if d := remoteFunctionData[model.ElectricalConnectionParameterDescriptionListDataType](entity, featureType, model.FunctionTypeElectricalConnectionParameterDescriptionListData); d != nil {
+		dump.ParameterDescriptions = append(dump.ParameterDescriptions, d.ElectricalConnectionParameterDescriptionData...)
+	}
+	if d := remoteFunctionData[model.ElectricalConnectionCharacteristicListDataType](entity, featureType, model.FunctionTypeElectricalConnectionCharacteristicListData); d != nil {
+		dump.Characteristics = append(dump.Characteristics, d.ElectricalConnectionCharacteristicData...)
+	}
+	if d := remoteFunctionData[model.ElectricalConnectionPermittedValueSetListDataType](entity, featureType, model.FunctionTypeElectricalConnectionPermittedValueSetListData); d != nil {
+		dump.PermittedValueSets = append(dump.PermittedValueSets, d.ElectricalConnectionPermittedValueSetData...)
+	}
+	dump.Parameters = joinECParameters(dump)
+
+	if len(errs) == 0 {
+		dump.Errors = nil
+	}
+	return dump
+}
+
+func uintValue[T ~uint](v *T) uint {
+	if v == nil {
+		return 0
+	}
+	return uint(*v)
+}
+
+// joinECParameters resolves the permitted values and characteristics of each parameter
+func joinECParameters(dump electricalConnectionDump) []ecParameter {
+	params := make([]ecParameter, 0, len(dump.ParameterDescriptions))
+	for _, pd := range dump.ParameterDescriptions {
+		p := ecParameter{
+			ElectricalConnectionID: uintValue(pd.ElectricalConnectionId),
+			ParameterID:            uintValue(pd.ParameterId),
+			ScopeType:              stringValue(pd.ScopeType),
+			VoltageType:            stringValue(pd.VoltageType),
+			MeasuredPhases:         stringValue(pd.AcMeasuredPhases),
+			MeasuredInReferenceTo:  stringValue(pd.AcMeasuredInReferenceTo),
+			MeasurementType:        stringValue(pd.AcMeasurementType),
+			MeasurementVariant:     stringValue(pd.AcMeasurementVariant),
+		}
+		if pd.MeasurementId != nil {
+			id := uint(*pd.MeasurementId)
+			p.MeasurementID = &id
+		}
+		for _, pvs := range dump.PermittedValueSets {
+			if uintValue(pvs.ElectricalConnectionId) != p.ElectricalConnectionID || uintValue(pvs.ParameterId) != p.ParameterID {
+				continue
+			}
+			for _, set := range pvs.PermittedValueSet {
+				for i := range set.Value {
+					p.PermittedValues = append(p.PermittedValues, set.Value[i].GetValue())
+				}
+				for _, r := range set.Range {
+					p.PermittedRanges = append(p.PermittedRanges, valueRange{Min: scaledValue(r.Min), Max: scaledValue(r.Max)})
+				}
+			}
+		}
+		for _, c := range dump.Characteristics {
+			if uintValue(c.ElectricalConnectionId) != p.ElectricalConnectionID || uintValue(c.ParameterId) != p.ParameterID {
+				continue
+			}
+			p.Characteristics = append(p.Characteristics, ecCharacteristic{
+				ID:      uintValue(c.CharacteristicId),
+				Context: stringValue(c.CharacteristicContext),
+				Type:    stringValue(c.CharacteristicType),
+				Value:   scaledValue(c.Value),
+				Unit:    stringValue(c.Unit),
+			})
+		}
+		params = append(params, p)
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].ElectricalConnectionID != params[j].ElectricalConnectionID {
+			return params[i].ElectricalConnectionID < params[j].ElectricalConnectionID
+		}
+		return params[i].ParameterID < params[j].ParameterID
+	})
+	return params
+}
+
+// measurementInfo joins a measurement description with its constraints, its last value and
+// the ElectricalConnection parameters referencing it, which is how EVCEM and MPC find it
+type measurementInfo struct {
+	MeasurementID   uint        `json:"measurementId"`
+	MeasurementType *string     `json:"measurementType,omitempty"`
+	CommodityType   *string     `json:"commodityType,omitempty"`
+	Unit            *string     `json:"unit,omitempty"`
+	ScopeType       *string     `json:"scopeType,omitempty"`
+	Label           *string     `json:"label,omitempty"`
+	Range           *valueRange `json:"valueRange,omitempty"`
+	StepSize        *float64    `json:"valueStepSize,omitempty"`
+	Value           *float64    `json:"value,omitempty"`
+	ValueState      *string     `json:"valueState,omitempty"`
+	// Parameters are the ElectricalConnection parameters with this measurement id
+	Parameters []ecParameter `json:"electricalConnectionParameters,omitempty"`
+}
+
+// measurementDump is the Measurement description data of one remote entity
+type measurementDump struct {
+	SKI          string                                 `json:"ski"`
+	Entity       string                                 `json:"entity"`
+	EntityType   string                                 `json:"entityType"`
+	ReadAt       time.Time                              `json:"readAt"`
+	Descriptions []model.MeasurementDescriptionDataType `json:"descriptions"`
+	Constraints  []model.MeasurementConstraintsDataType `json:"constraints"`
+	Measurements []measurementInfo                      `json:"measurements"`
+	// DanglingReferences are ElectricalConnection parameters referencing a measurement id
+	// without a description, the use cases can't interpret the values of these
+	DanglingReferences []ecParameter     `json:"danglingReferences"`
+	Errors             map[string]string `json:"errors,omitempty"`
+}
+
+// readMeasurements actively reads the Measurement descriptions and constraints of all remote
+// entities with a Measurement server, optionally only those of one SKI
+func (h *hems) readMeasurements(ski string) ([]measurementDump, error) {
+	entities := h.entitiesWithServerFeature(ski, model.FeatureTypeTypeMeasurement)
+	if len(entities) == 0 {
+		return nil, errNoEntity
+	}
+	localEntity := h.mainEntity()
+	return readEntities(entities, func(entity spineapi.EntityRemoteInterface) measurementDump {
+		return h.readMeasurementEntity(localEntity, entity)
+	}), nil
+}
+
+func (h *hems) readMeasurementEntity(localEntity spineapi.EntityLocalInterface, entity spineapi.EntityRemoteInterface) measurementDump {
+	m, mErr := client.NewMeasurement(localEntity, entity)
+	requests := []readRequest{
+		featureRead("measurementDescriptionListData", m, mErr, func() (*model.MsgCounterType, error) {
+			return m.RequestDescriptions(nil, nil)
+		}),
+		featureRead("measurementConstraintsListData", m, mErr, func() (*model.MsgCounterType, error) {
+			return m.RequestConstraints(nil, nil)
+		}),
+	}
+	// the parameter descriptions link measurements to phases, entities without an
+	// ElectricalConnection server just have no links
+	if entity.FeatureOfTypeAndRole(model.FeatureTypeTypeElectricalConnection, model.RoleTypeServer) != nil {
+		ec, ecErr := client.NewElectricalConnection(localEntity, entity)
+		requests = append(requests, featureRead("electricalConnectionParameterDescriptionListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestParameterDescriptions(nil, nil)
+		}))
+	}
+
+	errs := h.readFeatures(requests)
+	dump := measurementDump{
+		SKI:                entity.Device().Ski(),
+		Entity:             fmt.Sprint(entity.Address()),
+		EntityType:         fmt.Sprint(entity.EntityType()),
+		ReadAt:             time.Now(),
+		Descriptions:       []model.MeasurementDescriptionDataType{},
+		Constraints:        []model.MeasurementConstraintsDataType{},
+		Measurements:       []measurementInfo{},
+		DanglingReferences: []ecParameter{},
+		Errors:             errs,
+	}
+
+	featureType := model.FeatureTypeTypeMeasurement
+	if d := remoteFunctionData[model.MeasurementDescriptionListDataType](entity, featureType, model.FunctionTypeMeasurementDescriptionListData); d != nil {
+		dump.Descriptions = append(dump.Descriptions, d.MeasurementDescriptionData...)
+	}
+	if d := remoteFunctionData[model.MeasurementConstraintsListDataType](entity, featureType, model.FunctionTypeMeasurementConstraintsListData); d != nil {
+		dump.Constraints = append(dump.Constraints, d.MeasurementConstraintsData...)
+	}
+	var values []model.MeasurementDataType
+	if d := remoteFunctionData[model.MeasurementListDataType](entity, featureType, model.FunctionTypeMeasurementListData); d != nil {
+		values = d.MeasurementData
+	}
+	var params []ecParameter
+	if d := remoteFunctionData[model.ElectricalConnectionParameterDescriptionListDataType](entity, model.FeatureTypeTypeElectricalConnection, model.FunctionTypeElectricalConnectionParameterDescriptionListData); d != nil {
+		params = joinECParameters(electricalConnectionDump{ParameterDescriptions: d.ElectricalConnectionParameterDescriptionData})
+	}
+
+	described := make(map[uint]bool)
+	for _, desc := range dump.Descriptions {
+		info := measurementInfo{
+			MeasurementID:   uintValue(desc.MeasurementId),
+			MeasurementType: stringValue(desc.MeasurementType),
+			CommodityType:   stringValue(desc.CommodityType),
+			Unit:            stringValue(desc.Unit),
+			ScopeType:       stringValue(desc.ScopeType),
+			Label:           stringValue(desc.Label),
+		}
+		described[info.MeasurementID] = true
+		for _, c := range dump.Constraints {
+			if uintValue(c.MeasurementId) != info.MeasurementID {
+				continue
+			}
+			if c.ValueRangeMin != nil || c.ValueRangeMax != nil {
+				info.Range = &valueRange{Min: scaledValue(c.ValueRangeMin), Max: scaledValue(c.ValueRangeMax)}
+			}
+			info.StepSize = scaledValue(c.ValueStepSize)
+		}
+		for _, v := range values {
+			if uintValue(v.MeasurementId) == info.MeasurementID {
+				info.Value = scaledValue(v.Value)
+				info.ValueState = stringValue(v.ValueState)
+			}
+		}
+		for _, p := range params {
+			if p.MeasurementID != nil && *p.MeasurementID == info.MeasurementID {
+				info.Parameters = append(info.Parameters, p)
+			}
+		}
+		dump.Measurements = append(dump.Measurements, info)
+	}
+	for _, p := range params {
+		if p.MeasurementID != nil && !described[*p.MeasurementID] {
+			dump.DanglingReferences = append(dump.DanglingReferences, p)
+		}
+	}
+	sort.Slice(dump.Measurements, func(i, j int) bool {
+		return dump.Measurements[i].MeasurementID < dump.Measurements[j].MeasurementID
+	})
+
+	if len(errs) == 0 {
+		dump.Errors = nil
+	}
+	return dump
+}
+
+// limitWriteTarget is how a write use case selects the limit descriptions it writes, the
+// filters are those of eebus-go
+type limitWriteTarget struct {
+	usecase string
+	filter  model.LoadControlLimitDescriptionDataType
+	// single is set for use cases that only write when exactly one description matches
+	single bool
+}
+
+var limitWriteTargets = []limitWriteTarget{
+	{usecase: "LPC", single: true, filter: model.LoadControlLimitDescriptionDataType{
+		LimitType:      util.Ptr(model.LoadControlLimitTypeTypeSignDependentAbsValueLimit),
+		LimitDirection: util.Ptr(model.EnergyDirectionTypeConsume),
+		ScopeType:      util.Ptr(model.ScopeTypeTypeActivePowerLimit),
+	}},
+	{usecase: "LPP", single: true, filter: model.LoadControlLimitDescriptionDataType{
+		LimitType:      util.Ptr(model.LoadControlLimitTypeTypeSignDependentAbsValueLimit),
+		LimitDirection: util.Ptr(model.EnergyDirectionTypeProduce),
+		ScopeType:      util.Ptr(model.ScopeTypeTypeActivePowerLimit),
+	}},
+	{usecase: "OPEV", filter: model.LoadControlLimitDescriptionDataType{
+		LimitType:     util.Ptr(model.LoadControlLimitTypeTypeMaxValueLimit),
+		LimitCategory: util.Ptr(model.LoadControlCategoryTypeObligation),
+		Unit:          util.Ptr(model.UnitOfMeasurementTypeA),
+		ScopeType:     util.Ptr(model.ScopeTypeTypeOverloadProtection),
+	}},
+	{usecase: "OSCEV", filter: model.LoadControlLimitDescriptionDataType{
+		LimitType:     util.Ptr(model.LoadControlLimitTypeTypeMaxValueLimit),
+		LimitCategory: util.Ptr(model.LoadControlCategoryTypeRecommendation),
+		Unit:          util.Ptr(model.UnitOfMeasurementTypeA),
+		ScopeType:     util.Ptr(model.ScopeTypeTypeSelfConsumption),
+	}},
+}
+
+// matches reports whether all fields set in the filter are equal in the description
+func (t limitWriteTarget) matches(d model.LoadControlLimitDescriptionDataType) bool {
+	eq := func(filter, value *string) bool { return filter == nil || (value != nil && *filter == *value) }
+	return eq(stringValue(t.filter.LimitType), stringValue(d.LimitType)) &&
+		eq(stringValue(t.filter.LimitCategory), stringValue(d.LimitCategory)) &&
+		eq(stringValue(t.filter.LimitDirection), stringValue(d.LimitDirection)) &&
+		eq(stringValue(t.filter.Unit), stringValue(d.Unit)) &&
+		eq(stringValue(t.filter.ScopeType), stringValue(d.ScopeType))
+}
+
+// limitInfo joins a limit description with its constraints and current limit data
+type limitInfo struct {
+	LimitID        uint        `json:"limitId"`
+	LimitType      *string     `json:"limitType,omitempty"`
+	LimitCategory  *string     `json:"limitCategory,omitempty"`
+	LimitDirection *string     `json:"limitDirection,omitempty"`
+	MeasurementID  *uint       `json:"measurementId,omitempty"`
+	Unit           *string     `json:"unit,omitempty"`
+	ScopeType      *string     `json:"scopeType,omitempty"`
+	Label          *string     `json:"label,omitempty"`
+	Range          *valueRange `json:"valueRange,omitempty"`
+	StepSize       *float64    `json:"valueStepSize,omitempty"`
+	Value          *float64    `json:"value,omitempty"`
+	Active         *bool       `json:"isLimitActive,omitempty"`
+	Changeable     *bool       `json:"isLimitChangeable,omitempty"`
+	// Phases is the phase of the measurement of the limit, how OPEV/OSCEV map limits to phases
+	Phases *string `json:"acMeasuredPhases,omitempty"`
+	// TargetedBy are the write use cases whose filter matches the description
+	TargetedBy []string `json:"targetedBy"`
+}
+
+// limitTargetInfo are the limit ids a write use case addresses on the entity
+type limitTargetInfo struct {
+	Usecase  string `json:"usecase"`
+	LimitIDs []uint `json:"limitIds"`
+	// Problem explains why a write of the use case will fail or may address the wrong limit
+	Problem string `json:"problem,omitempty"`
+}
+
+// loadControlDump is the LoadControl limit description data of one remote entity
+type loadControlDump struct {
+	SKI          string                                      `json:"ski"`
+	Entity       string                                      `json:"entity"`
+	EntityType   string                                      `json:"entityType"`
+	ReadAt       time.Time                                   `json:"readAt"`
+	Descriptions []model.LoadControlLimitDescriptionDataType `json:"descriptions"`
+	Constraints  []model.LoadControlLimitConstraintsDataType `json:"constraints"`
+	Limits       []limitInfo                                 `json:"limits"`
+	WriteTargets []limitTargetInfo                           `json:"writeTargets"`
+	Errors       map[string]string                           `json:"errors,omitempty"`
+}
+
+// readLoadControl actively reads the LoadControl limit descriptions and constraints of all
+// remote entities with a LoadControl server, optionally only those of one SKI
+func (h *hems) readLoadControl(ski string) ([]loadControlDump, error) {
+	entities := h.entitiesWithServerFeature(ski, model.FeatureTypeTypeLoadControl)
+	if len(entities) == 0 {
+		return nil, errNoEntity
+	}
+	localEntity := h.mainEntity()
+	return readEntities(entities, func(entity spineapi.EntityRemoteInterface) loadControlDump {
+		return h.readLoadControlEntity(localEntity, entity)
+	}), nil
+}
+
+func (h *hems) readLoadControlEntity(localEntity spineapi.EntityLocalInterface, entity spineapi.EntityRemoteInterface) loadControlDump {
+	lc, lcErr := client.NewLoadControl(localEntity, entity)
+	requests := []readRequest{
+		featureRead("loadControlLimitDescriptionListData", lc, lcErr, func() (*model.MsgCounterType, error) {
+			return lc.RequestLimitDescriptions(nil, nil)
+		}),
+		featureRead("loadControlLimitConstraintsListData", lc, lcErr, func() (*model.MsgCounterType, error) {
+			return lc.RequestLimitConstraints(nil, nil)
+		}),
+	}
+
+	errs := h.readFeatures(requests)
+	dump := loadControlDump{
+		SKI:          entity.Device().Ski(),
+		Entity:       fmt.Sprint(entity.Address()),
+		EntityType:   fmt.Sprint(entity.EntityType()),
+		ReadAt:       time.Now(),
+		Descriptions: []model.LoadControlLimitDescriptionDataType{},
+		Constraints:  []model.LoadControlLimitConstraintsDataType{},
+		Limits:       []limitInfo{},
+		WriteTargets: []limitTargetInfo{},
+		Errors:       errs,
+	}
+
+	featureType := model.FeatureTypeTypeLoadControl
+	if d := remoteFunctionData[model.LoadControlLimitDescriptionListDataType](entity, featureType, model.FunctionTypeLoadControlLimitDescriptionListData); d != nil {
+		dump.Descriptions = append(dump.Descriptions, d.LoadControlLimitDescriptionData...)
+	}
+	if d := remoteFunctionData[model.LoadControlLimitConstraintsListDataType](entity, featureType, model.FunctionTypeLoadControlLimitConstraintsListData); d != nil {
+		dump.Constraints = append(dump.Constraints, d.LoadControlLimitConstraintsData...)
+	}
+	var values []model.LoadControlLimitDataType
+	if d := remoteFunctionData[model.LoadControlLimitListDataType](entity, featureType, model.FunctionTypeLoadControlLimitListData); d != nil {
+		values = d.LoadControlLimitData
+	}
+	phases := make(map[uint]string)
+	if d := remoteFunctionData[model.ElectricalConnectionParameterDescriptionListDataType](entity, model.FeatureTypeTypeElectricalConnection, model.FunctionTypeElectricalConnectionParameterDescriptionListData); d != nil {
+		for _, p := range d.ElectricalConnectionParameterDescriptionData {
+			if p.MeasurementId != nil && p.AcMeasuredPhases != nil {
+				phases[uint(*p.MeasurementId)] = string(*p.AcMeasuredPhases)
+			}
+		}
+	}
+
+	targets := make(map[string][]uint)
+	for _, desc := range dump.Descriptions {
+		info := limitInfo{
+			LimitID:        uintValue(desc.LimitId),
+			LimitType:      stringValue(desc.LimitType),
+			LimitCategory:  stringValue(desc.LimitCategory),
+			LimitDirection: stringValue(desc.LimitDirection),
+			Unit:           stringValue(desc.Unit),
+			ScopeType:      stringValue(desc.ScopeType),
+			Label:          stringValue(desc.Label),
+			TargetedBy:     []string{},
+		}
+		if desc.MeasurementId != nil {
+			id := uint(*desc.MeasurementId)
+			info.MeasurementID = &id
+			if phase, ok := phases[id]; ok {
+				info.Phases = &phase
+			}
+		}
+		for _, c := range dump.Constraints {
+			if uintValue(c.LimitId) != info.LimitID {
+				continue
+			}
+			if c.ValueRangeMin != nil || c.ValueRangeMax != nil {
+				info.Range = &valueRange{Min: scaledValue(c.ValueRangeMin), Max: scaledValue(c.ValueRangeMax)}
+			}
+			info.StepSize = scaledValue(c.ValueStepSize)
+		}
+		for _, v := range values {
+			if uintValue(v.LimitId) == info.LimitID {
+				info.Value = scaledValue(v.Value)
+				info.Active = v.IsLimitActive
+				info.Changeable = v.IsLimitChangeable
+			}
+		}
+		for _, t := range limitWriteTargets {
+			if t.matches(desc) {
+				info.TargetedBy = append(info.TargetedBy, t.usecase)
+				targets[t.usecase] = append(targets[t.usecase], info.LimitID)
+			}
+		}
+		dump.Limits = append(dump.Limits, info)
+	}
+	sort.Slice(dump.Limits, func(i, j int) bool { return dump.Limits[i].LimitID < dump.Limits[j].LimitID })
+
+	for _, t := range limitWriteTargets {
+		target := limitTargetInfo{Usecase: t.usecase, LimitIDs: targets[t.usecase]}
+		if target.LimitIDs == nil {
+			target.LimitIDs = []uint{}
+		}
+		switch {
+		case len(target.LimitIDs) == 0:
+			target.Problem = "no limit description matches, writes of this use case fail"
+		case t.single && len(target.LimitIDs) > 1:
+			target.Problem = fmt.Sprintf("%d limit descriptions match, the use case requires exactly one and does not write", len(target.LimitIDs))
+		}
+		for _, id := range target.LimitIDs {
+			for _, l := range dump.Limits {
+				if l.LimitID == id && l.Changeable != nil && !*l.Changeable && target.Problem == "" {
+					target.Problem = fmt.Sprintf("limit %d is not changeable", id)
+				}
+			}
+		}
+		dump.WriteTargets = append(dump.WriteTargets, target)
+	}
+
+	if len(errs) == 0 {
+		dump.Errors = nil
+	}
+	return dump
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	cemopev "github.com/enbility/eebus-go/usecases/cem/opev"
+	cemoscev "github.com/enbility/eebus-go/usecases/cem/oscev"
+	eglpc "github.com/enbility/eebus-go/usecases/eg/lpc"
+	eglpp "github.com/enbility/eebus-go/usecases/eg/lpp"
+)
+
+// maxLatencySamples is the number of samples kept per command type and measurement
+const maxLatencySamples = 1000
+
+// dataUpdateTimeout is the time a write waits for its data update before it is dropped
+const dataUpdateTimeout = time.Minute
+
+// latencyDataEvents maps write commands to the data update event that confirms them
+var latencyDataEvents = map[string]api.EventType{
+	"writeLPCConsumptionLimit":    eglpc.DataUpdateLimit,
+	"writeLPCFailsafeDuration":    eglpc.DataUpdateFailsafeDurationMinimum,
+	"writeLPCFailsafeValue":       eglpc.DataUpdateFailsafeConsumptionActivePowerLimit,
+	"writeLPPProductionLimit":     eglpp.DataUpdateLimit,
+	"writeLPPFailsafeDuration":    eglpp.DataUpdateFailsafeDurationMinimum,
+	"writeLPPFailsafeValue":       eglpp.DataUpdateFailsafeProductionActivePowerLimit,
+	"writeOSCEVLoadControlLimits": cemoscev.DataUpdateLimit,
+	"writeOPEVLoadControlLimits":  cemopev.DataUpdateLimit,
+}
+
+// latencyBucketsMs are the upper bounds of the latency histogram
+var latencyBucketsMs = []float64{50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// latencyStats is the distribution of measured latencies
+type latencyStats struct {
+	Count  int     `json:"count"`
+	MinMs  float64 `json:"minMs"`
+	MaxMs  float64 `json:"maxMs"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P95Ms  float64 `json:"p95Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	// Histogram counts the samples up to the bucket bound in ms, "inf" holds the rest
+	Histogram map[string]int `json:"histogram"`
+	LastMs    float64        `json:"lastMs"`
+}
+
+// commandLatency holds the latencies of one command type
+type commandLatency struct {
+	// Result is the time from sending the write to the SPINE result
+	Result latencyStats `json:"result"`
+	// DataUpdate is the time from sending the write to the corresponding data update
+	DataUpdate latencyStats `json:"dataUpdate"`
+	// DataUpdateTimeouts counts the writes without a data update within dataUpdateTimeout
+	DataUpdateTimeouts int `json:"dataUpdateTimeouts"`
+}
+
+type latencySamples struct {
+	result   []float64
+	data     []float64
+	timeouts int
+}
+
+type awaitingUpdate struct {
+	cmd    string
+	sentAt time.Time
+}
+
+// latencyTracker records write round-trip latencies per command type
+type latencyTracker struct {
+	mu       sync.Mutex
+	samples  map[string]*latencySamples
+	awaiting map[string][]awaitingUpdate
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		samples:  make(map[string]*latencySamples),
+		awaiting: make(map[string][]awaitingUpdate),
+	}
+}
+
+func (t *latencyTracker) series(cmd string) *latencySamples {
+	s, ok := t.samples[cmd]
+	if !ok {
+		s = &latencySamples{}
+		t.samples[cmd] = s
+	}
+	return s
+}
+
+func appendLatency(samples []float64, ms float64) []float64 {
+	samples = append(samples, ms)
+	if len(samples) > maxLatencySamples {
+		samples = samples[len(samples)-maxLatencySamples:]
+	}
+	return samples
+}
+
+// recordResultLatency records the SPINE result latency of the last attempt of a finished command
+func (h *hems) recordResultLatency(c command) {
+	if c.State != commandAcknowledged && c.State != commandRejected {
+		return
+	}
+	if len(c.Attempts) == 0 {
+		return
+	}
+	a := c.Attempts[len(c.Attempts)-1]
+	ms := float64(a.EndedAt.Sub(a.StartedAt)) / float64(time.Millisecond)
+
+	h.latency.mu.Lock()
+	s := h.latency.series(c.Cmd)
+	s.result = appendLatency(s.result, ms)
+	h.latency.mu.Unlock()
+}
+
+// awaitDataUpdate registers a sent write, the next matching data update of the peers completes the measurement
+func (h *hems) awaitDataUpdate(cmd string, skis []string, sentAt time.Time) {
+	event, ok := latencyDataEvents[cmd]
+	if !ok {
+		return
+	}
+
+	h.latency.mu.Lock()
+	defer h.latency.mu.Unlock()
+	h.latency.expireAwaiting(sentAt)
+	for _, ski := range skis {
+		key := ski + "/" + string(event)
+		h.latency.awaiting[key] = append(h.latency.awaiting[key], awaitingUpdate{cmd: cmd, sentAt: sentAt})
+	}
+}
+
+// observeDataUpdate completes pending data update measurements for a usecase event of a peer
+func (h *hems) observeDataUpdate(ski string, event api.EventType) {
+	now := time.Now()
+	key := ski + "/" + string(event)
+
+	h.latency.mu.Lock()
+	defer h.latency.mu.Unlock()
+
+	pending, ok := h.latency.awaiting[key]
+	if !ok {
+		return
+	}
+	delete(h.latency.awaiting, key)
+	for _, p := range pending {
+		if now.Sub(p.sentAt) > dataUpdateTimeout {
+			h.latency.series(p.cmd).timeouts++
+			continue
+		}
+		s := h.latency.series(p.cmd)
+		s.data = appendLatency(s.data, float64(now.Sub(p.sentAt))/float64(time.Millisecond))
+	}
+}
+
+// expireAwaiting drops the writes that got no data update within dataUpdateTimeout and
+// counts them as timeouts, a DUT that never notifies would otherwise grow the list. The
+// caller holds the lock.
+func (t *latencyTracker) expireAwaiting(now time.Time) {
+	for key, pending := range t.awaiting {
+		kept := pending[:0]
+		for _, p := range pending {
+			if now.Sub(p.sentAt) > dataUpdateTimeout {
+				t.series(p.cmd).timeouts++
+				continue
+			}
+			kept = append(kept, p)
+		}
+		if len(kept) == 0 {
+			delete(t.awaiting, key)
+		} else {
+			t.awaiting[key] = kept
+		}
+	}
+}
+
+func computeLatencyStats(samples []float64) latencyStats {
+	stats := latencyStats{Histogram: make(map[string]int)}
+	if len(samples) == 0 {
+		return stats
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+		bucket := "inf"
+		for _, b := range latencyBucketsMs {
+			if v <= b {
+				bucket = strconv.FormatFloat(b, 'f', -1, 64)
+				break
+			}
+		}
+		stats.Histogram[bucket]++
+	}
+	percentile := func(p float64) float64 {
+		idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return sorted[idx]
+	}
+	stats.Count = len(sorted)
+	stats.MinMs = sorted[0]
+	stats.MaxMs = sorted[len(sorted)-1]
+	stats.MeanMs = sum / float64(len(sorted))
+	stats.P50Ms = percentile(50)
+	stats.P90Ms = percentile(90)
+	stats.P95Ms = percentile(95)
+	stats.P99Ms = percentile(99)
+	stats.LastMs = samples[len(samples)-1]
+	return stats
+}
+
+// getLatencies returns the latency distributions per command type, optionally for one command
+func (h *hems) getLatencies(cmd string) map[string]commandLatency {
+	h.latency.mu.Lock()
+	defer h.latency.mu.Unlock()
+
+	out := make(map[string]commandLatency)
+	for name, s := range h.latency.samples {
+		if cmd != "" && name != cmd {
+			continue
+		}
+		out[name] = commandLatency{
+			Result:             computeLatencyStats(s.result),
+			DataUpdate:         computeLatencyStats(s.data),
+			DataUpdateTimeouts: s.timeouts,
+		}
+	}
+	return out
+}
+
+// resetLatencies drops all recorded latency samples, including the response times
+func (h *hems) resetLatencies() {
+	h.latency.mu.Lock()
+	h.latency.samples = make(map[string]*latencySamples)
+	h.latency.awaiting = make(map[string][]awaitingUpdate)
+	h.latency.mu.Unlock()
+	h.resetResponseLatencies()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// localUsecaseNames are the use case names of the usecases config section
+var localUsecaseNames = []string{
+	"cevc", "evcem", "evcc", "evsecc", "lpc", "lpp", "mpc", "mgcp", "opev", "oscev", "evsoc", "cslpc", "cslpp",
+}
+
+// LocalEntityConfig is an additional local entity after the main entities
+type LocalEntityConfig struct {
+	// Type is the SPINE entity type, e.g. CEM, SubMeterElectricity or GridGuard
+	Type string `json:"type"`
+	// Usecases are attached to this entity instead of the main entity, by their name in
+	// the usecases section
+	Usecases []string `json:"usecases,omitempty"`
+}
+
+// localDeviceType returns the configured SPINE device type, EnergyManagementSystem by default
+func localDeviceType(info DeviceInfo) model.DeviceTypeType {
+	if info.DeviceType != "" {
+		return model.DeviceTypeType(info.DeviceType)
+	}
+	return model.DeviceTypeTypeEnergyManagementSystem
+}
+
+// mainEntityTypes returns the configured types of the main entities, CEM by default
+func mainEntityTypes(info DeviceInfo) []model.EntityTypeType {
+	if len(info.EntityTypes) == 0 {
+		return []model.EntityTypeType{model.EntityTypeTypeCEM}
+	}
+	types := make([]model.EntityTypeType, 0, len(info.EntityTypes))
+	for _, t := range info.EntityTypes {
+		types = append(types, model.EntityTypeType(t))
+	}
+	return types
+}
+
+// localEntityTypes returns the types of the local entities: the main entities, the first
+// keeps the use cases not attached elsewhere, followed by the configured entities
+func localEntityTypes(main []model.EntityTypeType, entities []LocalEntityConfig) ([]model.EntityTypeType, error) {
+	for i, t := range main {
+		if t == "" || t == model.EntityTypeTypeDeviceInformation {
+			return nil, fmt.Errorf("deviceInfo.entityTypes[%d]: invalid entity type %q", i, t)
+		}
+	}
+	types := append([]model.EntityTypeType(nil), main...)
+	attached := make(map[string]bool)
+	for i, e := range entities {
+		if e.Type == "" {
+			return nil, fmt.Errorf("entities[%d]: type is required", i)
+		}
+		if model.EntityTypeType(e.Type) == model.EntityTypeTypeDeviceInformation {
+			return nil, fmt.Errorf("entities[%d]: the DeviceInformation entity is created by the stack", i)
+		}
+		for _, name := range e.Usecases {
+			name = strings.ToLower(name)
+			known := false
+			for _, n := range localUsecaseNames {
+				known = known || n == name
+			}
+			if !known {
+				return nil, fmt.Errorf("entities[%d]: unknown usecase %q", i, name)
+			}
+			if attached[name] {
+				return nil, fmt.Errorf("entities[%d]: usecase %q is attached to another entity", i, name)
+			}
+			attached[name] = true
+		}
+		types = append(types, model.EntityTypeType(e.Type))
+	}
+	return types, nil
+}
+
+// setupLocalEntities maps the use cases to the local entities created by the service,
+// in the order of localEntityTypes
+func (h *hems) setupLocalEntities() error {
+	for _, e := range h.myService.LocalDevice().Entities() {
+		if e.EntityType() != model.EntityTypeTypeDeviceInformation {
+			h.localEntities = append(h.localEntities, e)
+		}
+	}
+	main := len(mainEntityTypes(h.config.DeviceInfo))
+	if expected := main + len(h.config.Entities); len(h.localEntities) != expected {
+		return fmt.Errorf("expected %d local entities, the service created %d", expected, len(h.localEntities))
+	}
+	h.usecaseEntities = make(map[string]int)
+	for i, e := range h.config.Entities {
+		for _, name := range e.Usecases {
+			h.usecaseEntities[strings.ToLower(name)] = main + i
+		}
+	}
+	return nil
+}
+
+// mainEntity returns the first main entity, which hosts the client features of the
+// inspection endpoints and the use cases not attached elsewhere
+func (h *hems) mainEntity() spineapi.EntityLocalInterface {
+	if len(h.localEntities) == 0 {
+		return nil
+	}
+	return h.localEntities[0]
+}
+
+// usecaseEntity returns the local entity a use case is attached to
+func (h *hems) usecaseEntity(name string) spineapi.EntityLocalInterface {
+	if i, ok := h.usecaseEntities[name]; ok {
+		return h.localEntities[i]
+	}
+	return h.localEntities[0]
+}
+
+// usecaseEnabled reports whether the use case is enabled in the config, the controllable
+// system use cases are disabled by default and all others enabled
+func (h *hems) usecaseEnabled(name string) bool {
+	if cfg, ok := h.config.Usecases[name]; ok {
+		return cfg.Enabled
+	}
+	return name != "cslpc" && name != "cslpp"
+}
+
+// localEntityInfo is a local entity with the enabled use cases attached to it
+type localEntityInfo struct {
+	Address  string   `json:"address"`
+	Type     string   `json:"type"`
+	Usecases []string `json:"usecases"`
+}
+
+// localDeviceInfo is the local device type with its entities
+type localDeviceInfo struct {
+	DeviceType string            `json:"deviceType"`
+	Entities   []localEntityInfo `json:"entities"`
+}
+
+// getLocalDevice returns the local device type and entities
+func (h *hems) getLocalDevice() localDeviceInfo {
+	return localDeviceInfo{DeviceType: string(localDeviceType(h.config.DeviceInfo)), Entities: h.getLocalEntities()}
+}
+
+// getLocalEntities returns the local entities in address order
+func (h *hems) getLocalEntities() []localEntityInfo {
+	out := make([]localEntityInfo, 0, len(h.localEntities))
+	for _, e := range h.localEntities {
+		parts := make([]string, 0, len(e.Address().Entity))
+		for _, a := range e.Address().Entity {
+			parts = append(parts, fmt.Sprint(a))
+		}
+		out = append(out, localEntityInfo{Address: strings.Join(parts, "."), Type: string(e.EntityType()), Usecases: []string{}})
+	}
+	for _, name := range localUsecaseNames {
+		if !h.usecaseEnabled(name) || len(out) == 0 {
+			continue
+		}
+		i := h.usecaseEntities[name]
+		out[i].Usecases = append(out[i].Usecases, name)
+	}
+	for i := range out {
+		sort.Strings(out[i].Usecases)
+	}
+	return out
+}
@@ -6,15 +6,18 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -46,9 +49,40 @@ import (
 
 // Config represents the application configuration
 type Config struct {
-	Usecases   map[string]UsecaseConfig `json:"usecases"`
-	Logging    LoggingConfig            `json:"logging"`
-	DeviceInfo DeviceInfo               `json:"deviceInfo"`
+	Usecases      map[string]UsecaseConfig `json:"usecases"`
+	Logging       LoggingConfig            `json:"logging"`
+	DeviceInfo    DeviceInfo               `json:"deviceInfo"`
+	Auth          AuthConfig               `json:"auth"`
+	Limits        LimitsConfig             `json:"limits"`
+	Retry         RetryConfig              `json:"retry"`
+	Timeouts      TimeoutsConfig           `json:"timeouts"`
+	Approval      ApprovalConfig           `json:"approval"`
+	Energy        EnergyConfig             `json:"energy"`
+	StateMachines StateMachineConfig       `json:"stateMachines"`
+	Alerts        AlertsConfig             `json:"alerts"`
+	Soak          SoakConfig               `json:"soak"`
+	Monitor       MonitorConfig            `json:"monitor"`
+	Watchdog      WatchdogConfig           `json:"watchdog"`
+	Network       NetworkConfig            `json:"network"`
+	Trust         TrustConfig              `json:"trust"`
+	Websocket     WebsocketConfig          `json:"websocket"`
+	TestRuns      TestRunsConfig           `json:"testRuns"`
+	Tracing       TracingConfig            `json:"tracing"`
+	Heartbeat     HeartbeatConfig          `json:"heartbeat"`
+	ShipChecks    ShipChecksConfig         `json:"shipChecks"`
+	Cevc          CevcConfig               `json:"cevc"`
+	Anonymization AnonymizationConfig      `json:"anonymization"`
+	Notifiers     []NotifierConfig         `json:"notifiers,omitempty"`
+	// RegressionWatch compares the DUT configuration before and after reconnects
+	RegressionWatch RegressionWatchConfig `json:"regressionWatch"`
+	DUTRegistry     DUTRegistryConfig     `json:"dutRegistry"`
+	// Simulator enables the EVSE/EV simulator mode
+	Simulator *SimulatorConfig    `json:"simulator,omitempty"`
+	Entities  []LocalEntityConfig `json:"entities,omitempty"`
+	Timezone  string              `json:"timezone,omitempty"`
+
+	// BehaviorProfile selects a preset energy guard behavior, e.g. fnn-steuerbox
+	BehaviorProfile string `json:"behaviorProfile,omitempty"`
 }
 
 // UsecaseConfig represents configuration for a single usecase
@@ -69,11 +103,22 @@ type DeviceInfo struct {
 	Brand      string `json:"brand,omitempty"`
 	DeviceName string `json:"deviceName,omitempty"`
 	Identifier string `json:"identifier,omitempty"`
+	// DeviceType is the SPINE device type, defaults to EnergyManagementSystem
+	DeviceType string `json:"deviceType,omitempty"`
+	// AlternateIdentifier is the SHIP and mDNS ID of the tester, defaults to the identifier
+	AlternateIdentifier string `json:"alternateIdentifier,omitempty"`
+	// MdnsServiceName is the announced mDNS instance name, defaults to brand-model-serial
+	MdnsServiceName string `json:"mdnsServiceName,omitempty"`
+	// EntityTypes are the SPINE types of the main entities, defaults to CEM. The first
+	// one hosts the use cases not attached to an entity of the entities section.
+	EntityTypes []string `json:"entityTypes,omitempty"`
 }
 
+// configPath is the configuration file in the working directory
+const configPath = "config.json"
+
 // loadConfig loads the config.json file or returns default config if file doesn't exist
 func loadConfig() (*Config, error) {
-	configPath := "config.json"
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -108,6 +153,8 @@ func getDefaultConfig() *Config {
 			"evsoc":  {Enabled: true, Description: "EV State Of Charge (CEM)"},
 			"mpc":    {Enabled: true, Description: "Monitoring of Power Consumption (MA)"},
 			"mgcp":   {Enabled: true, Description: "Monitoring of Grid Connection Point (MA)"},
+			"cslpc":  {Enabled: false, Description: "Limitation of Power Consumption (CS)"},
+			"cslpp":  {Enabled: false, Description: "Limitation of Power Production (CS)"},
 		},
 		Logging: LoggingConfig{
 			EnableDebug: true,
@@ -123,33 +170,40 @@ func getDefaultConfig() *Config {
 }
 
 func writePEMFiles(certificate tls.Certificate, certPath, keyPath string) error {
-	// Certificate PEM
+	certPEM, keyPEM, err := encodePEM(certificate)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("writing cert: %w", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+
+	return nil
+}
+
+// encodePEM returns the PEM encoded certificate and ECDSA private key
+func encodePEM(certificate tls.Certificate) (certPEM, keyPEM []byte, err error) {
 	if len(certificate.Certificate) == 0 {
-		return fmt.Errorf("no certificate data available")
+		return nil, nil, fmt.Errorf("no certificate data available")
 	}
-	certPEM := pem.EncodeToMemory(&pem.Block{
+	certPEM = pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certificate.Certificate[0],
 	})
-	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
-		return fmt.Errorf("writing cert: %w", err)
-	}
 
-	// Private key PEM (ECDSA)
 	privKey, ok := certificate.PrivateKey.(*ecdsa.PrivateKey)
 	if !ok {
-		return fmt.Errorf("private key is not ECDSA")
+		return nil, nil, fmt.Errorf("private key is not ECDSA")
 	}
 	b, err := x509.MarshalECPrivateKey(privKey)
 	if err != nil {
-		return fmt.Errorf("marshal EC private key: %w", err)
+		return nil, nil, fmt.Errorf("marshal EC private key: %w", err)
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
-	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
-		return fmt.Errorf("writing key: %w", err)
-	}
-
-	return nil
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+	return certPEM, keyPEM, nil
 }
 
 type usecaseData struct {
@@ -161,7 +215,7 @@ type usecaseData struct {
 	LpcLimitActive                bool          `json:"lpcLimitActive"`
 	LpcConsumptionLimitNominalMax float64       `json:"lpcConsumptionLimitNominalMax,omitempty"`
 	LpcHeartbeatOk                bool          `json:"lpcHeartbeatOk"`
-	LpcHeartbeatTimestamp         time.Time     `json:"lpcHeartbeatTimestamp,omitempty"`
+	LpcHeartbeatTimestamp         *time.Time    `json:"lpcHeartbeatTimestamp,omitempty"`
 	// LPP usecase data
 	LppFailsafeDur        time.Duration `json:"lppFailsafeDurMinutes,omitempty"`
 	LppFailsafeValue      float64       `json:"lppFailsafeValue,omitempty"`
@@ -169,7 +223,7 @@ type usecaseData struct {
 	LppLimitDuration      time.Duration `json:"lppLimitDurationSeconds,omitempty"`
 	LppLimitActive        bool          `json:"lppLimitActive"`
 	LppHeartbeatOk        bool          `json:"lppHeartbeatOk"`
-	LppHeartbeatTimestamp time.Time     `json:"lppHeartbeatTimestamp,omitempty"`
+	LppHeartbeatTimestamp *time.Time    `json:"lppHeartbeatTimestamp,omitempty"`
 	// EVSECC usecase data
 	EvseccManufacturerData          ucapi.ManufacturerData `json:"evseccManufacturerData,omitempty"`
 	EvseccOperatingState            string                 `json:"evseccOperatingState,omitempty"`
@@ -225,23 +279,44 @@ type usecaseData struct {
 	CevcIncentiveConstraints  ucapi.IncentiveSlotConstraints `json:"cevcIncentiveConstraints,omitempty"`
 	CevcChargePlanConstraints []ucapi.DurationSlotValue      `json:"cevcChargePlanConstraints,omitempty"`
 	CevcChargePlan            ucapi.ChargePlan               `json:"cevcChargePlan,omitempty"`
+	// CS LPC usecase data (limits received from the energy guard)
+	CsLpcFailsafePower   float64       `json:"csLpcFailsafePower,omitempty"`
+	CsLpcFailsafeDur     time.Duration `json:"csLpcFailsafeDurMinutes,omitempty"`
+	CsLpcLimitValue      float64       `json:"csLpcLimitValue,omitempty"`
+	CsLpcLimitDurSeconds time.Duration `json:"csLpcLimitDurSeconds,omitempty"`
+	CsLpcLimitActive     bool          `json:"csLpcLimitActive"`
+	CsLpcHeartbeatOk     bool          `json:"csLpcHeartbeatOk"`
+	// CS LPP usecase data (limits received from the energy guard)
+	CsLppFailsafePower   float64       `json:"csLppFailsafePower,omitempty"`
+	CsLppFailsafeDur     time.Duration `json:"csLppFailsafeDurMinutes,omitempty"`
+	CsLppLimitValue      float64       `json:"csLppLimitValue,omitempty"`
+	CsLppLimitDurSeconds time.Duration `json:"csLppLimitDurSeconds,omitempty"`
+	CsLppLimitActive     bool          `json:"csLppLimitActive"`
+	CsLppHeartbeatOk     bool          `json:"csLppHeartbeatOk"`
 }
 
 // peerData holds all data for a single peer connection
 type peerData struct {
-	usecaseData      usecaseData
-	entities         []spineapi.EntityRemoteInterface
-	lastEntitiesJSON []byte
-	usecaseState     map[string]bool
-	connected        bool
-	ski              string
-	lastSeen         time.Time
-	deviceName       string
-	brand            string
-	model            string
-	deviceType       string
-	serial           string
-	identifier       string
+	usecaseData usecaseData
+	// entities are the discovered entities of the peer, updated by the SPINE callbacks
+	entities entityStore
+	// usecases is the use case support per remote entity
+	usecases     *usecaseSupportStore
+	connected    bool
+	ski          string
+	lastSeen     time.Time
+	connectCount int
+	deviceName   string
+	brand        string
+	model        string
+	deviceType   string
+	serial       string
+	identifier   string
+
+	// direction is "incoming" or "outgoing" for the last SHIP connection
+	direction string
+	// waitingForTrust is set while an incoming pairing request of the peer is undecided
+	waitingForTrust bool
 }
 
 // PeerInfo represents peer information for API responses
@@ -256,6 +331,9 @@ type PeerInfo struct {
 	DeviceType string          `json:"deviceType"`
 	Serial     string          `json:"serial"`
 	Identifier string          `json:"identifier"`
+	// Direction is "incoming" for DUTs that connected to the tester, "outgoing" otherwise
+	Direction       string `json:"direction,omitempty"`
+	WaitingForTrust bool   `json:"waitingForTrust,omitempty"`
 }
 
 type hems struct {
@@ -272,6 +350,12 @@ type hems struct {
 	uccemcevc   ucapi.CemCEVCInterface
 	ucmampc     ucapi.MaMPCInterface
 	ucmamgrp    ucapi.MaMGCPInterface
+	uccslpc     ucapi.CsLPCInterface
+	uccslpp     ucapi.CsLPPInterface
+
+	// local entities, the CEM entity first, and the index of the entity per use case name
+	localEntities   []spineapi.EntityLocalInterface
+	usecaseEntities map[string]int
 
 	// in-memory log buffer for trace/debug/info output
 	logMu   sync.Mutex
@@ -279,16 +363,161 @@ type hems struct {
 	maxLogs int
 
 	// websocket clients
-	wsMu    sync.Mutex
-	wsConns map[*websocket.Conn]struct{}
+	wsMu        sync.Mutex
+	wsConns     map[*wsClient]struct{}
+	wsPerClient map[string]int
+	wsCoalesce  wsCoalescer
+	wsSchema    wsSchemaState
 
 	// peers management
-	peers              map[string]*peerData
-	peersMu            sync.Mutex
-	globalUseCaseState map[string]bool
+	peers   map[string]*peerData
+	peersMu sync.Mutex
+	// trackedUsecases are the local use cases whose support is tracked per peer and entity
+	trackedUsecases map[string]api.UseCaseBaseInterface
 
 	// configuration
 	config *Config
+	// anonKey keys the pseudonyms of anonymized exports without a configured secret
+	anonKey []byte
+
+	// certificate of the local SHIP service, part of state snapshots
+	certificate tls.Certificate
+	// snapshotPath is the file written on exit and by POST /api/snapshot
+	snapshotPath string
+	// shipPort is the port the SHIP server listens on, selected at startup
+	shipPort int
+	// SHIP IDs of the paired services, persisted across restarts
+	shipIDs *shipIDStore
+
+	// queued write commands
+	commands *commandQueue
+
+	// charging sessions detected from EVCC/EVCEM
+	sessions *sessionTracker
+
+	// energy accounting derived from EVCEM measurements
+	energy *energyStore
+
+	// EVCC charge state and EVSECC operating state history
+	states *stateTracker
+
+	// use case updates and timeline events, delivered to the websocket, series, latency and extension sinks
+	bus *eventBus
+
+	// OTLP span export, nil unless tracing.endpoint is configured
+	tracer *tracer
+	// OpenID Connect login and the API tokens issued with it, nil without an issuer
+	oidc *oidcProvider
+	// Slack, Telegram and e-mail notifications of failures, nil without notifiers
+	notifiers *notifierSet
+
+	// state of the heartbeat sent to the DUT and supervision of the DUT heartbeats
+	heartbeat  *localHeartbeat
+	heartbeats *heartbeatSupervisor
+
+	// event timeline and fired alerts
+	events *eventTimeline
+	alerts *alertStore
+
+	// limit changes for the reaction time allowance of the compliance check
+	compliance *complianceTracker
+
+	// long-run soak test
+	soak soakState
+	// continuous monitoring for field trials
+	monitor monitorState
+	// recovery of a wedged SHIP/SPINE service
+	watchdog watchdogState
+	// device under test selected via /api/remote-ski
+	remoteSKI remoteSKIState
+
+	// DST and duration boundary tests
+	timeTests timeTestState
+
+	// failsafe entry and recovery test
+	failsafeTests failsafeTestState
+	// indefinite limit test across a DUT reboot
+	indefiniteTests indefiniteTestState
+	// rapid-write stress test
+	stressTests stressTestState
+	// reconnect storm test
+	reconnectTests reconnectTestState
+	// replay of an uploaded limit profile
+	profiles profileState
+	// preset energy guard behavior
+	behavior behaviorProfileState
+	// TLS probes of the SHIP servers of DUTs
+	tlsInfo tlsInspector
+
+	// limit step sequence test
+	envelopeTests envelopeTestState
+
+	// CEVC time-of-use plan and re-plan test
+	touTests touTestState
+
+	// CEVC incentive table and power limits sent to EVs
+	tariffs tariffState
+
+	// CEVC charge plans with the constraints they were planned with
+	cevcPlans *cevcPlanStore
+
+	// user test scripts
+	scripts scriptState
+
+	// write round-trip latencies
+	latency *latencyTracker
+	// response times of the remote functions to reads and acknowledged writes
+	responseTimes *responseTimeTracker
+	// datagram counts per peer, function and cmdClassifier
+	messageCounts *messageCounter
+	// reconnects and restarts of the DUTs
+	restarts *restartDetector
+	// connection intervals of the DUTs for the availability figures
+	availability *availabilityTracker
+	// configuration of the DUTs before their last disconnect, compared after reconnects
+	regressions *regressionWatch
+	// registry of the devices under test
+	duts *dutRegistry
+	// virtual EV of the simulator mode, nil unless configured
+	simulator *evSimulator
+
+	// SHIP connection setup timing
+	handshakes *handshakeTracker
+	readiness  *readinessTracker
+
+	// raw mDNS announcements of SHIP nodes
+	mdns *mdnsInspector
+
+	// EEBUS services reported by ship-go with their announcement history
+	remoteServices *remoteServiceTracker
+	trustPrompts   *trustPromptStore
+
+	// numeric usecase values over time
+	series *seriesStore
+
+	// SPINE result statistics per remote feature and function
+	errorStats *errorStatsStore
+
+	// captured SPINE datagrams for event correlation
+	capture *datagramCapture
+	// captured SHIP frames and the SHIP violations of the DUTs
+	shipChecks *shipInspector
+	// validation of the received SPINE payloads against the data model
+	spineChecks *spineValidator
+	// msgCounter duplicates, gaps and repeated notifies of the received datagrams
+	msgCounters *msgCounterTracker
+
+	// EVSECC operating states with error descriptions
+	evseStates *evseStateStore
+
+	// trust decisions for remote services
+	trust *trustState
+
+	// pairing state transitions per SKI
+	pairing *pairingTracker
+
+	// limit writes awaiting approval in controllable system mode
+	approvals *approvalStore
 }
 
 // getOrCreatePeer gets an existing peer or creates a new one
@@ -306,22 +535,14 @@ func (h *hems) getOrCreatePeer(ski string) *peerData {
 	}
 
 	peer := &peerData{
-		usecaseData:  usecaseData{},
-		entities:     nil,
-		usecaseState: make(map[string]bool),
-		connected:    false,
-		ski:          ski,
-		lastSeen:     time.Now(),
+		usecaseData: usecaseData{},
+		usecases:    newUsecaseSupportStore(),
+		connected:   false,
+		ski:         ski,
+		lastSeen:    time.Now(),
 	}
 	h.peers[ski] = peer
 
-	// Initialize usecase states from global state
-	ucMu.Lock()
-	for uc, supported := range h.globalUseCaseState {
-		peer.usecaseState[uc] = supported
-	}
-	ucMu.Unlock()
-
 	return peer
 }
 
@@ -372,17 +593,21 @@ var ucMu sync.Mutex
 // usecaseDataMutex for thread-safe access to peer usecase data
 var usecaseDataMutex sync.Mutex
 
-func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
-	var err error
-	var certificate tls.Certificate
-
+// defaultCertPaths returns the certificate and key paths next to the executable
+func defaultCertPaths() (string, string) {
 	exePath, err := os.Executable()
 	if err != nil {
 		exePath = "."
 	}
 	exeDir := filepath.Dir(exePath)
-	defaultCertPath := filepath.Join(exeDir, "cert.pem")
-	defaultKeyPath := filepath.Join(exeDir, "key.pem")
+	return filepath.Join(exeDir, "cert.pem"), filepath.Join(exeDir, "key.pem")
+}
+
+func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
+	var err error
+	var certificate tls.Certificate
+
+	defaultCertPath, defaultKeyPath := defaultCertPaths()
 
 	// If user provided cert/key via flags, prefer them
 	userCertPath := strings.TrimSpace(certPathFlag)
@@ -440,6 +665,8 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 		}
 	}
 
+	h.certificate = certificate
+
 	// Prepare device info for service configuration
 	vendor := "DemoVendor"
 	brand := "DemoBrand"
@@ -460,17 +687,40 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 		}
 	}
 
+	var deviceInfo DeviceInfo
+	var extraEntities []LocalEntityConfig
+	if h.config != nil {
+		deviceInfo, extraEntities = h.config.DeviceInfo, h.config.Entities
+	}
+	entityTypes, err := localEntityTypes(mainEntityTypes(deviceInfo), extraEntities)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	configuration, err := api.NewConfiguration(
 		vendor, brand, deviceName, configIdentifier,
 		[]shipapi.DeviceCategoryType{shipapi.DeviceCategoryTypeEMobility},
-		model.DeviceTypeTypeEnergyManagementSystem,
-		[]model.EntityTypeType{model.EntityTypeTypeCEM},
-		port, certificate, time.Second*30)
+		localDeviceType(deviceInfo),
+		entityTypes,
+		port, certificate, h.localHeartbeatTimeout())
 	if err != nil {
 		log.Fatal(err)
 	}
-	if configIdentifier != "" {
-		configuration.SetAlternateIdentifier(configIdentifier)
+	alternateIdentifier := configIdentifier
+	if deviceInfo.AlternateIdentifier != "" {
+		alternateIdentifier = deviceInfo.AlternateIdentifier
+	}
+	if alternateIdentifier != "" {
+		configuration.SetAlternateIdentifier(alternateIdentifier)
+	}
+	if deviceInfo.MdnsServiceName != "" {
+		configuration.SetAlternateMdnsServiceName(deviceInfo.MdnsServiceName)
+	}
+	if h.config != nil {
+		if err := h.config.Network.apply(configuration); err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
 
 	h.myService = service.NewService(configuration, h)
@@ -485,8 +735,43 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 	h.maxLogs = 1000
 	h.logs = make([]string, 0, 200)
 
-	// initialize global usecase state map
-	h.globalUseCaseState = make(map[string]bool)
+	// initialize the tracked use cases
+	h.trackedUsecases = make(map[string]api.UseCaseBaseInterface)
+
+	// initialize write command queue
+	h.commands = newCommandQueue()
+	h.sessions = newSessionTracker()
+	h.energy = newEnergyStore()
+	h.states = newStateTracker()
+	h.events = newEventTimeline()
+	h.alerts = newAlertStore()
+	h.compliance = newComplianceTracker()
+	h.cevcPlans = newCevcPlanStore()
+	h.latency = newLatencyTracker()
+	h.responseTimes = newResponseTimeTracker()
+	h.messageCounts = newMessageCounter()
+	h.restarts = newRestartDetector()
+	h.availability = newAvailabilityTracker()
+	h.regressions = newRegressionWatch()
+	h.anonKey = newAnonymizationKey()
+	h.handshakes = newHandshakeTracker()
+	h.readiness = newReadinessTracker()
+	h.mdns = newMdnsInspector()
+	h.remoteServices = newRemoteServiceTracker()
+	h.trustPrompts = newTrustPromptStore()
+	h.series = newSeriesStore()
+	h.errorStats = newErrorStatsStore()
+	h.capture = newDatagramCapture()
+	h.shipChecks = newShipInspector()
+	h.spineChecks = newSpineValidator()
+	h.msgCounters = newMsgCounterTracker()
+	h.evseStates = newEvseStateStore()
+	h.trust = newTrustState()
+	h.pairing = newPairingTracker()
+	h.heartbeat = newLocalHeartbeat(h.localHeartbeatTimeout())
+	h.heartbeats = newHeartbeatSupervisor()
+	h.bus = newEventBus()
+	h.subscribeBuiltinSinks()
 
 	// load configuration
 	h.config, err = loadConfig()
@@ -494,22 +779,26 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 		fmt.Printf("Error loading config: %v\n", err)
 		log.Fatal(err)
 	}
+	h.tracer = newTracer(h, h.config.Tracing, h.myService.LocalService().SKI())
+	h.oidc = newOIDCProvider(h.config.Auth.OIDC)
+	if h.notifiers, err = newNotifierSet(h.config.Notifiers); err != nil {
+		log.Fatal(err)
+	}
+	h.loadTariffFile()
 
-	localEntity := h.myService.LocalDevice().EntityForType(model.EntityTypeTypeCEM)
+	if err := h.setupLocalEntities(); err != nil {
+		log.Fatal(err)
+	}
+	localEntity := h.mainEntity()
 
 	// Helper function to check if usecase is enabled
-	isEnabled := func(name string) bool {
-		if cfg, ok := h.config.Usecases[name]; ok {
-			return cfg.Enabled
-		}
-		return true // default to enabled if not in config
-	}
+	isEnabled := h.usecaseEnabled
 
 	// CEVC
 	if isEnabled("cevc") {
-		h.uccemcevc = cemcevc.NewCEVC(localEntity, h.HandleEgCevc)
+		h.uccemcevc = cemcevc.NewCEVC(h.usecaseEntity("cevc"), h.HandleEgCevc)
 		h.myService.AddUseCase(h.uccemcevc)
-		h.setUsecaseSupported("CEVC", false)
+		h.trackUsecase("CEVC", h.uccemcevc)
 		fmt.Println("Usecase CEVC enabled")
 	} else {
 		fmt.Println("Usecase CEVC disabled by config")
@@ -517,9 +806,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// EVCEM
 	if isEnabled("evcem") {
-		h.uccemevcem = cemevcem.NewEVCEM(h.myService, localEntity, h.HandleEgEvcem)
+		h.uccemevcem = cemevcem.NewEVCEM(h.myService, h.usecaseEntity("evcem"), h.HandleEgEvcem)
 		h.myService.AddUseCase(h.uccemevcem)
-		h.setUsecaseSupported("EVCEM", false)
+		h.trackUsecase("EVCEM", h.uccemevcem)
 		fmt.Println("Usecase EVCEM enabled")
 	} else {
 		fmt.Println("Usecase EVCEM disabled by config")
@@ -527,13 +816,13 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// EVCS
 	// TODO: add evcs once supported
-	h.setUsecaseSupported("EVCS", false)
+	h.trackUsecase("EVCS", nil)
 
 	// EVCC
 	if isEnabled("evcc") {
-		h.uccemevcc = cemevcc.NewEVCC(h.myService, localEntity, h.HandleEgEvcc)
+		h.uccemevcc = cemevcc.NewEVCC(h.myService, h.usecaseEntity("evcc"), h.HandleEgEvcc)
 		h.myService.AddUseCase(h.uccemevcc)
-		h.setUsecaseSupported("EVCC", false)
+		h.trackUsecase("EVCC", h.uccemevcc)
 		fmt.Println("Usecase EVCC enabled")
 	} else {
 		fmt.Println("Usecase EVCC disabled by config")
@@ -541,9 +830,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// EVSECC
 	if isEnabled("evsecc") {
-		h.uccemevsecc = cemevsecc.NewEVSECC(localEntity, h.HandleEgEvsecc)
+		h.uccemevsecc = cemevsecc.NewEVSECC(h.usecaseEntity("evsecc"), h.HandleEgEvsecc)
 		h.myService.AddUseCase(h.uccemevsecc)
-		h.setUsecaseSupported("EVSECC", false)
+		h.trackUsecase("EVSECC", h.uccemevsecc)
 		fmt.Println("Usecase EVSECC enabled")
 	} else {
 		fmt.Println("Usecase EVSECC disabled by config")
@@ -551,9 +840,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// LPC
 	if isEnabled("lpc") {
-		h.uceglpc = eglpc.NewLPC(localEntity, h.HandleEgLPC)
+		h.uceglpc = eglpc.NewLPC(h.usecaseEntity("lpc"), h.HandleEgLPC)
 		h.myService.AddUseCase(h.uceglpc)
-		h.setUsecaseSupported("LPC", false)
+		h.trackUsecase("LPC", h.uceglpc)
 		fmt.Println("Usecase LPC enabled")
 	} else {
 		fmt.Println("Usecase LPC disabled by config")
@@ -561,9 +850,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// LPP
 	if isEnabled("lpp") {
-		h.uceglpp = eglpp.NewLPP(localEntity, h.HandleEgLPP)
+		h.uceglpp = eglpp.NewLPP(h.usecaseEntity("lpp"), h.HandleEgLPP)
 		h.myService.AddUseCase(h.uceglpp)
-		h.setUsecaseSupported("LPP", false)
+		h.trackUsecase("LPP", h.uceglpp)
 		fmt.Println("Usecase LPP enabled")
 	} else {
 		fmt.Println("Usecase LPP disabled by config")
@@ -571,9 +860,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// MPC
 	if isEnabled("mpc") {
-		h.ucmampc = mampc.NewMPC(localEntity, h.HandleMaMpc)
+		h.ucmampc = mampc.NewMPC(h.usecaseEntity("mpc"), h.HandleMaMpc)
 		h.myService.AddUseCase(h.ucmampc)
-		h.setUsecaseSupported("MPC", false)
+		h.trackUsecase("MPC", h.ucmampc)
 		fmt.Println("Usecase MPC enabled")
 	} else {
 		fmt.Println("Usecase MPC disabled by config")
@@ -581,9 +870,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// MGCP
 	if isEnabled("mgcp") {
-		h.ucmamgrp = mamgrp.NewMGCP(localEntity, h.HandleMaMGCP)
+		h.ucmamgrp = mamgrp.NewMGCP(h.usecaseEntity("mgcp"), h.HandleMaMGCP)
 		h.myService.AddUseCase(h.ucmamgrp)
-		h.setUsecaseSupported("MGCP", false)
+		h.trackUsecase("MGCP", h.ucmamgrp)
 		fmt.Println("Usecase MGCP enabled")
 	} else {
 		fmt.Println("Usecase MGCP disabled by config")
@@ -591,9 +880,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// OPEV
 	if isEnabled("opev") {
-		h.uccemopev = cemopev.NewOPEV(localEntity, h.HandleCemOpev)
+		h.uccemopev = cemopev.NewOPEV(h.usecaseEntity("opev"), h.HandleCemOpev)
 		h.myService.AddUseCase(h.uccemopev)
-		h.setUsecaseSupported("OPEV", false)
+		h.trackUsecase("OPEV", h.uccemopev)
 		fmt.Println("Usecase OPEV enabled")
 	} else {
 		fmt.Println("Usecase OPEV disabled by config")
@@ -601,9 +890,9 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// OSCEV
 	if isEnabled("oscev") {
-		h.uccemoscev = cemoscev.NewOSCEV(localEntity, h.HandleCemOscev)
+		h.uccemoscev = cemoscev.NewOSCEV(h.usecaseEntity("oscev"), h.HandleCemOscev)
 		h.myService.AddUseCase(h.uccemoscev)
-		h.setUsecaseSupported("OSCEV", false)
+		h.trackUsecase("OSCEV", h.uccemoscev)
 		fmt.Println("Usecase OSCEV enabled")
 	} else {
 		fmt.Println("Usecase OSCEV disabled by config")
@@ -611,15 +900,43 @@ func (h *hems) run(port int, certPathFlag, keyPathFlag string) {
 
 	// EVSOC
 	if isEnabled("evsoc") {
-		h.uccemevsoc = cemevsoc.NewEVSOC(localEntity, h.HandleCemEvsoc)
+		h.uccemevsoc = cemevsoc.NewEVSOC(h.usecaseEntity("evsoc"), h.HandleCemEvsoc)
 		h.myService.AddUseCase(h.uccemevsoc)
-		h.setUsecaseSupported("EVSOC", false)
+		h.trackUsecase("EVSOC", h.uccemevsoc)
 		fmt.Println("Usecase EVSOC enabled")
 	} else {
 		fmt.Println("Usecase EVSOC disabled by config")
 	}
 
+	// CS LPC / CS LPP (controllable system mode, disabled unless configured)
+	h.setupControllableSystem()
+
+	// EVSE/EV simulator mode, disabled unless configured
+	if err := h.setupSimulator(); err != nil {
+		log.Fatal(err)
+	}
+
+	// client features of the device inspection endpoints
+	addInspectionClients(localEntity)
+
+	// use cases and endpoints of compiled-in extensions
+	h.setupExtensions()
+	h.setupUsecaseDeclarations()
+
+	// track SPINE results of sent write commands
+	h.registerResultCallbacks()
+	go h.runCommandQueue()
+	go h.runAlerts()
+
+	h.setupTrust()
+	h.loadShipIDs()
+	h.loadDUTs()
 	h.myService.Start()
+	h.Infof("SHIP server listening on port %d", port)
+	h.startMdnsInspector()
+	go h.runLocalHeartbeatMonitor()
+	go h.runHeartbeatSupervision()
+	go h.runWatchdog()
 
 	// start web interface in background
 	go h.startWebInterface()
@@ -633,11 +950,11 @@ func (h *hems) HandleEgLPP(ski string, device spineapi.DeviceRemoteInterface, en
 	peer := h.getOrCreatePeer(ski)
 
 	if event == eglpp.UseCaseSupportUpdate {
-		h.setUsecaseSupportedForPeer(peer, "LPP", true)
+		h.updateUsecaseSupport(peer, "LPP")
 	}
 	switch event {
 	case eglpp.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "LPP", true)
+		h.updateUsecaseSupport(peer, "LPP")
 	case eglpp.DataUpdateFailsafeDurationMinimum:
 		minDur, err := h.uceglpp.FailsafeDurationMinimum(entity)
 		if err != nil {
@@ -662,10 +979,10 @@ func (h *hems) HandleEgLPP(ski string, device spineapi.DeviceRemoteInterface, en
 			peer.usecaseData.LppLimitActive = limit.IsActive
 		}
 	case eglpp.DataUpdateHeartbeat:
-		peer.usecaseData.LppHeartbeatOk = h.uceglpp.IsHeartbeatWithinDuration(entity)
-		peer.usecaseData.LppHeartbeatTimestamp = time.Now()
+		peer.usecaseData.LppHeartbeatOk = h.superviseHeartbeat(ski, "LPP", entity)
+		peer.usecaseData.LppHeartbeatTimestamp = optionalTime(time.Now())
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "LPP", event, device, entity, peer)
 }
 
 // HandleEgLPC Energy Guard LPC Handler
@@ -676,7 +993,8 @@ func (h *hems) HandleEgLPC(ski string, device spineapi.DeviceRemoteInterface, en
 
 	switch event {
 	case eglpc.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "LPC", true)
+		h.updateUsecaseSupport(peer, "LPC")
+		h.applyBehaviorProfile(ski)
 	case eglpc.DataUpdateLimit:
 		limit, err := h.uceglpc.ConsumptionLimit(entity)
 		if err != nil {
@@ -701,8 +1019,8 @@ func (h *hems) HandleEgLPC(ski string, device spineapi.DeviceRemoteInterface, en
 			peer.usecaseData.LpcFailsafePower = powerLimit
 		}
 	case eglpc.DataUpdateHeartbeat:
-		peer.usecaseData.LpcHeartbeatOk = h.uceglpc.IsHeartbeatWithinDuration(entity)
-		peer.usecaseData.LpcHeartbeatTimestamp = time.Now()
+		peer.usecaseData.LpcHeartbeatOk = h.superviseHeartbeat(ski, "LPC", entity)
+		peer.usecaseData.LpcHeartbeatTimestamp = optionalTime(time.Now())
 	default:
 		nominal, err := h.uceglpc.ConsumptionNominalMax(entity)
 		if err != nil {
@@ -711,7 +1029,7 @@ func (h *hems) HandleEgLPC(ski string, device spineapi.DeviceRemoteInterface, en
 			peer.usecaseData.LpcConsumptionLimitNominalMax = nominal
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "LPC", event, device, entity, peer)
 }
 
 // HandleEgEvcc Energy Guard EVCC Handler
@@ -722,7 +1040,7 @@ func (h *hems) HandleEgEvcc(ski string, device spineapi.DeviceRemoteInterface, e
 
 	switch event {
 	case cemevcc.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "EVCC", true)
+		h.updateUsecaseSupport(peer, "EVCC")
 	case cemevcc.DataUpdateManufacturerData:
 		manufacturer, err := h.uccemevcc.ManufacturerData(entity)
 		if err != nil {
@@ -736,6 +1054,7 @@ func (h *hems) HandleEgEvcc(ski string, device spineapi.DeviceRemoteInterface, e
 			fmt.Println("Error getting ChargeState:", err)
 		} else {
 			peer.usecaseData.EvccChargeState = string(chargeState)
+			h.trackState(ski, machineEvccChargeState, string(chargeState))
 		}
 	case cemevcc.DataUpdateAsymmetricChargingSupport:
 		support, err := h.uccemevcc.AsymmetricChargingSupport(entity)
@@ -766,6 +1085,7 @@ func (h *hems) HandleEgEvcc(ski string, device spineapi.DeviceRemoteInterface, e
 			fmt.Println("Error getting Identifications:", err)
 		} else {
 			peer.usecaseData.EvccIdentifications = identifications
+			h.sessionIdentifications(ski, identifications)
 		}
 
 	case cemevcc.DataUpdateIsInSleepMode:
@@ -778,11 +1098,15 @@ func (h *hems) HandleEgEvcc(ski string, device spineapi.DeviceRemoteInterface, e
 	case cemevcc.EvConnected:
 		fmt.Println("EVCC Connected")
 		peer.usecaseData.EvccEvConnected = true
+		h.sessionStarted(ski)
+		h.resetEnergyAccount(ski)
 	case cemevcc.EvDisconnected:
 		fmt.Println("EVCC Disconnected")
 		peer.usecaseData.EvccEvConnected = false
+		h.sessionEnded(ski, "evDisconnected")
+		h.trackState(ski, machineEvccChargeState, string(ucapi.EVChargeStateTypeUnplugged))
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "EVCC", event, device, entity, peer)
 }
 
 // HandleEgEvcem Energy Guard EVCEM Handler
@@ -793,13 +1117,14 @@ func (h *hems) HandleEgEvcem(ski string, device spineapi.DeviceRemoteInterface,
 
 	switch event {
 	case cemevcem.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "EVCEM", true)
+		h.updateUsecaseSupport(peer, "EVCEM")
 	case cemevcem.DataUpdateCurrentPerPhase:
 		currentArray, err := h.uccemevcem.CurrentPerPhase(entity)
 		if err != nil {
 			fmt.Println("Error getting CurrentPerPhase:", err)
 		} else {
 			peer.usecaseData.EvcemCurrentPerPhase = currentArray
+			h.energyCurrentSample(ski, currentArray)
 		}
 	case cemevcem.DataUpdatePhasesConnected:
 		phasesConnected, err := h.uccemevcem.PhasesConnected(entity)
@@ -814,6 +1139,8 @@ func (h *hems) HandleEgEvcem(ski string, device spineapi.DeviceRemoteInterface,
 			fmt.Println("Error getting EnergyCharged:", err)
 		} else {
 			peer.usecaseData.EvcemEnergyCharged = energyCharged
+			h.sessionEnergy(ski, energyCharged)
+			h.energyCounter(ski, energyCharged)
 		}
 	case cemevcem.DataUpdatePowerPerPhase:
 		powerPerPhaseArray, err := h.uccemevcem.PowerPerPhase(entity)
@@ -821,9 +1148,11 @@ func (h *hems) HandleEgEvcem(ski string, device spineapi.DeviceRemoteInterface,
 			fmt.Println("Error getting PowerPerPhase:", err)
 		} else {
 			peer.usecaseData.EvcemPowerPerPhase = powerPerPhaseArray
+			h.sessionPower(ski, powerPerPhaseArray)
+			h.energyPowerSample(ski, powerPerPhaseArray)
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "EVCEM", event, device, entity, peer)
 }
 
 // HandleEgEvsecc Energy Guard EVSECC Handler
@@ -834,7 +1163,7 @@ func (h *hems) HandleEgEvsecc(ski string, device spineapi.DeviceRemoteInterface,
 
 	switch event {
 	case cemevsecc.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "EVSECC", true)
+		h.updateUsecaseSupport(peer, "EVSECC")
 	case cemevsecc.DataUpdateManufacturerData:
 		manufacturer, err := h.uccemevsecc.ManufacturerData(entity)
 		if err != nil {
@@ -849,9 +1178,11 @@ func (h *hems) HandleEgEvsecc(ski string, device spineapi.DeviceRemoteInterface,
 		} else {
 			peer.usecaseData.EvseccOperatingState = string(operatingState)
 			peer.usecaseData.EvseccOperatingStateDescription = errorMessage
+			h.trackState(ski, machineEvseccOperatingState, string(operatingState))
+			h.recordEvseState(ski, string(operatingState), errorMessage)
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "EVSECC", event, device, entity, peer)
 }
 
 // HandleEgCevc Energy Guard CEVC Handler
@@ -862,7 +1193,7 @@ func (h *hems) HandleEgCevc(ski string, device spineapi.DeviceRemoteInterface, e
 
 	switch event {
 	case cemcevc.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "CEVC", true)
+		h.updateUsecaseSupport(peer, "CEVC")
 	case cemcevc.DataUpdateEnergyDemand:
 		demand, err := h.uccemcevc.EnergyDemand(entity)
 		if err != nil {
@@ -897,6 +1228,7 @@ func (h *hems) HandleEgCevc(ski string, device spineapi.DeviceRemoteInterface, e
 		} else {
 			fmt.Println("ChargePlanConstraints: ", planConstraints)
 			peer.usecaseData.CevcChargePlanConstraints = planConstraints
+			h.recordChargePlanConstraints(ski, planConstraints)
 		}
 	case cemcevc.DataUpdateChargePlan:
 		plan, err := h.uccemcevc.ChargePlan(entity)
@@ -905,28 +1237,17 @@ func (h *hems) HandleEgCevc(ski string, device spineapi.DeviceRemoteInterface, e
 		} else {
 			fmt.Println("ChargePlan: ", plan)
 			peer.usecaseData.CevcChargePlan = plan
+			h.recordChargePlan(ski, plan)
 		}
 	case cemcevc.DataRequestedPowerLimitsAndIncentives:
-		fmt.Println("CEVC: EV requested power limits and incentives - sending defaults")
-		// Send default power limits (max possible for 7 days)
-		err := h.uccemcevc.WritePowerLimits(entity, nil)
-		if err != nil {
-			fmt.Println("Error writing default PowerLimits:", err)
-		}
-		// Send default incentives (same price for 7 days)
-		err = h.uccemcevc.WriteIncentives(entity, nil)
-		if err != nil {
-			fmt.Println("Error writing default Incentives:", err)
-		}
+		// without a configured tariff eebus-go sends the EV maximum and the same price for 7 days
+		fmt.Println("CEVC: EV requested power limits and incentives")
+		h.publishTariff(entity, false, true)
 	case cemcevc.DataRequestedIncentiveTableDescription:
 		fmt.Println("CEVC: EV requested incentive table description")
-		// This would require setting up tariff descriptions - using nil for defaults
-		err := h.uccemcevc.WriteIncentiveTableDescriptions(entity, nil)
-		if err != nil {
-			fmt.Println("Error writing IncentiveTableDescriptions:", err)
-		}
+		h.publishTariff(entity, true, false)
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "CEVC", event, device, entity, peer)
 }
 
 // HandleMaMpc MaMPC Handler
@@ -938,7 +1259,7 @@ func (h *hems) HandleMaMpc(ski string, device spineapi.DeviceRemoteInterface, en
 
 	switch event {
 	case mampc.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "MPC", true)
+		h.updateUsecaseSupport(peer, "MPC")
 	case mampc.DataUpdatePowerPerPhase:
 		power, err := h.ucmampc.PowerPerPhase(entity)
 		if err != nil {
@@ -989,7 +1310,7 @@ func (h *hems) HandleMaMpc(ski string, device spineapi.DeviceRemoteInterface, en
 			peer.usecaseData.MpcVoltagePerPhase = voltages
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "MPC", event, device, entity, peer)
 }
 
 // HandleMaMGCP MaMGCP Handler (Monitoring of Grid Connection Point)
@@ -1000,7 +1321,7 @@ func (h *hems) HandleMaMGCP(ski string, device spineapi.DeviceRemoteInterface, e
 
 	switch event {
 	case mamgrp.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "MGCP", true)
+		h.updateUsecaseSupport(peer, "MGCP")
 	case mamgrp.DataUpdatePowerLimitationFactor:
 		factor, err := h.ucmamgrp.PowerLimitationFactor(entity)
 		if err != nil {
@@ -1051,7 +1372,7 @@ func (h *hems) HandleMaMGCP(ski string, device spineapi.DeviceRemoteInterface, e
 			peer.usecaseData.MgcFrequency = frequency
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "MGCP", event, device, entity, peer)
 }
 
 func (h *hems) HandleCemOpev(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
@@ -1061,7 +1382,7 @@ func (h *hems) HandleCemOpev(ski string, device spineapi.DeviceRemoteInterface,
 
 	switch event {
 	case cemopev.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "OPEV", true)
+		h.updateUsecaseSupport(peer, "OPEV")
 	case cemopev.DataUpdateLimit:
 		loadlimit, err := h.uccemopev.LoadControlLimits(entity)
 		if err != nil {
@@ -1081,7 +1402,7 @@ func (h *hems) HandleCemOpev(ski string, device spineapi.DeviceRemoteInterface,
 			peer.usecaseData.OpevCurrentLimitDefault = currentlimitDefault
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "OPEV", event, device, entity, peer)
 
 }
 
@@ -1093,7 +1414,7 @@ func (h *hems) HandleCemOscev(ski string, device spineapi.DeviceRemoteInterface,
 
 	switch event {
 	case cemoscev.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "OSCEV", true)
+		h.updateUsecaseSupport(peer, "OSCEV")
 	case cemoscev.DataUpdateLimit:
 		loadlimit, err := h.uccemoscev.LoadControlLimits(entity)
 		if err != nil {
@@ -1111,7 +1432,7 @@ func (h *hems) HandleCemOscev(ski string, device spineapi.DeviceRemoteInterface,
 			peer.usecaseData.OscevCurrentLimitDefault = currentlimitDefault
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "OSCEV", event, device, entity, peer)
 }
 
 // HandleCemEvsoc CEM EVSOC Handler (EV State Of Charge)
@@ -1122,7 +1443,7 @@ func (h *hems) HandleCemEvsoc(ski string, device spineapi.DeviceRemoteInterface,
 
 	switch event {
 	case cemevsoc.UseCaseSupportUpdate:
-		h.setUsecaseSupportedForPeer(peer, "EVSOC", true)
+		h.updateUsecaseSupport(peer, "EVSOC")
 	case cemevsoc.DataUpdateStateOfCharge:
 		soc, err := h.uccemevsoc.StateOfCharge(entity)
 		if err != nil {
@@ -1131,76 +1452,105 @@ func (h *hems) HandleCemEvsoc(ski string, device spineapi.DeviceRemoteInterface,
 			peer.usecaseData.EvsocStateOfCharge = soc
 		}
 	}
-	h.updateEntitiesFromDevice(ski, device, peer)
+	h.publishUsecaseUpdate(ski, "EVSOC", event, device, entity, peer)
 }
 
 // Write Functions
 
-func (h *hems) WriteLPCConsumptionLimit(durationSeconds int64, value float64, active bool) error {
+// writeEntities returns the remote entities a write goes to, those of all connected DUTs
+// if ski is empty
+func writeEntities(scenarios []api.RemoteEntityScenarios, ski string) ([]spineapi.EntityRemoteInterface, error) {
+	entities := remoteEntities(scenarios, ski)
+	if ski != "" && len(entities) == 0 {
+		return nil, fmt.Errorf("%w of %s", errNoEntity, ski)
+	}
+	return entities, nil
+}
+
+func (h *hems) WriteLPCConsumptionLimit(ski string, durationSeconds int64, value float64, active bool) ([]sentMessage, error) {
 	// iterate remote entities and write the provided consumption limit
-	entities := h.uceglpc.RemoteEntitiesScenarios()
+	entities, err := writeEntities(h.uceglpc.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("Writing LPC Consumption Limit:", durationSeconds, value, active)
 	fmt.Println("Found entities:", entities)
-	var errs []string
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uceglpc.WriteConsumptionLimit(entity.Entity, ucapi.LoadLimit{
+		msgCounter, err := h.uceglpc.WriteConsumptionLimit(entity, ucapi.LoadLimit{
 			Duration:     time.Duration(durationSeconds) * time.Second,
 			IsChangeable: false,
 			IsActive:     active,
 			Value:        value,
+			// a limit without duration is indefinite, the time period of the previous limit
+			// would otherwise stay in effect
+			DeleteDuration: durationSeconds == 0,
 		}, nil)
 		if err != nil {
-			errStr := fmt.Sprintf("%v: %v", entity, err)
-			err = fmt.Errorf(errStr)
-			errs = append(errs, errStr)
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing consumption limit:", err)
 		} else {
 			fmt.Println("Wrote consumption limit to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("errors: %s", strings.Join(errs, "; "))
-	}
-	return nil
+	return sent, sendErrors(sent)
 }
 
-func (h *hems) WriteLPCFailsafeDuration(minDuration time.Duration) {
+func (h *hems) WriteLPCFailsafeDuration(ski string, minDuration time.Duration) ([]sentMessage, error) {
 	// iterate remote entities and write the failsafe duration
-	entities := h.uceglpc.RemoteEntitiesScenarios()
+	entities, err := writeEntities(h.uceglpc.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Writing LPC Failsafe Duration:", minDuration)
 	fmt.Println("Found entities:", entities)
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uceglpc.WriteFailsafeDurationMinimum(entity.Entity, minDuration)
+		msgCounter, err := h.uceglpc.WriteFailsafeDurationMinimum(entity, minDuration)
 		if err != nil {
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing failsafeDurationMinimum:", err)
 		} else {
 			fmt.Println("Wrote failsafeDurationMinimum to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
+	return sent, sendErrors(sent)
 }
-func (h *hems) WriteLPCFailsafeValue(failsafePowerLimit float64) {
+func (h *hems) WriteLPCFailsafeValue(ski string, failsafePowerLimit float64) ([]sentMessage, error) {
 	// iterate remote entities and write the failsafe power limit
-	entities := h.uceglpc.RemoteEntitiesScenarios()
+	entities, err := writeEntities(h.uceglpc.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Writing LPC Failsafe Power Limit:", failsafePowerLimit)
 	fmt.Println("Found entities:", entities)
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uceglpc.WriteFailsafeConsumptionActivePowerLimit(entity.Entity, failsafePowerLimit)
+		msgCounter, err := h.uceglpc.WriteFailsafeConsumptionActivePowerLimit(entity, failsafePowerLimit)
 		if err != nil {
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing FailsafeConsumptionActivePowerLimit:", err)
 		} else {
 			fmt.Println("Wrote FailsafeConsumptionActivePowerLimit to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
+	return sent, sendErrors(sent)
 }
 
-func (h *hems) WriteLPPProductionLimit(durationSeconds int64, value float64, active bool) error {
+func (h *hems) WriteLPPProductionLimit(ski string, durationSeconds int64, value float64, active bool) ([]sentMessage, error) {
 	// Ensure the value is always negative for Production Limits (LPP)
 	// per EEBus sign convention: negative values limit production.
 	forcedNegativeValue := -math.Abs(value)
 
 	// iterate remote entities and write the provided production limit
-	entities := h.uceglpp.RemoteEntitiesScenarios()
+	entities, err := writeEntities(h.uceglpp.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("Writing LPP Production Limit:", durationSeconds, forcedNegativeValue, active)
 
@@ -1208,10 +1558,11 @@ func (h *hems) WriteLPPProductionLimit(durationSeconds int64, value float64, act
 		Duration: time.Duration(durationSeconds) * time.Second,
 		IsActive: active,
 		Value:    forcedNegativeValue,
+		// indefinite limit, see WriteLPCConsumptionLimit
+		DeleteDuration: durationSeconds == 0,
 	}
 
 	fmt.Println("Found entities:", entities)
-	var errs []string
 	resultCB := func(msg model.ResultDataType) {
 		if *msg.ErrorNumber == model.ErrorNumberTypeNoError {
 			fmt.Println("Production limit accepted.")
@@ -1220,115 +1571,150 @@ func (h *hems) WriteLPPProductionLimit(durationSeconds int64, value float64, act
 		}
 	}
 
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uceglpp.WriteProductionLimit(entity.Entity, limit, resultCB)
+		msgCounter, err := h.uceglpp.WriteProductionLimit(entity, limit, resultCB)
 		if err != nil {
-			errStr := fmt.Sprintf("%v: %v", entity, err)
-			errs = append(errs, errStr)
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing production limit:", err)
 		} else {
 			fmt.Println("Wrote production limit to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("errors: %s", strings.Join(errs, "; "))
-	}
-	return nil
+	return sent, sendErrors(sent)
 }
 
-func (h *hems) WriteLPPFailsafeDuration(minDuration time.Duration) {
+func (h *hems) WriteLPPFailsafeDuration(ski string, minDuration time.Duration) ([]sentMessage, error) {
 	// iterate remote entities and write the failsafe duration
-	entities := h.uceglpp.RemoteEntitiesScenarios()
+	entities, err := writeEntities(h.uceglpp.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Writing LPP Failsafe Duration:", minDuration)
 	fmt.Println("Found entities:", entities)
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uceglpp.WriteFailsafeDurationMinimum(entity.Entity, minDuration)
+		msgCounter, err := h.uceglpp.WriteFailsafeDurationMinimum(entity, minDuration)
 		if err != nil {
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing failsafeDurationMinimum:", err)
 		} else {
 			fmt.Println("Wrote failsafeDurationMinimum to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
+	return sent, sendErrors(sent)
 }
 
-func (h *hems) WriteLPPFailsafeValue(failsafePowerLimit float64) {
+func (h *hems) WriteLPPFailsafeValue(ski string, failsafePowerLimit float64) ([]sentMessage, error) {
 	// iterate remote entities and write the failsafe power limit
-	entities := h.uceglpp.RemoteEntitiesScenarios()
+	entities, err := writeEntities(h.uceglpp.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Writing LPP Failsafe Power Limit:", failsafePowerLimit)
 	fmt.Println("Found entities:", entities)
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uceglpp.WriteFailsafeProductionActivePowerLimit(entity.Entity, failsafePowerLimit)
+		msgCounter, err := h.uceglpp.WriteFailsafeProductionActivePowerLimit(entity, failsafePowerLimit)
 		if err != nil {
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing FailsafeProductionActivePowerLimit:", err)
 		} else {
 			fmt.Println("Wrote FailsafeProductionActivePowerLimit to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
+	return sent, sendErrors(sent)
 }
 
 // OSCEV Write Functions
 
-func (h *hems) WriteOSCEVLoadControlLimits(limits []ucapi.LoadLimitsPhase) error {
-	entities := h.uccemoscev.RemoteEntitiesScenarios()
+func (h *hems) WriteOSCEVLoadControlLimits(ski string, limits []ucapi.LoadLimitsPhase) ([]sentMessage, error) {
+	entities, err := writeEntities(h.uccemoscev.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Writing OSCEV Load Control Limits:", limits)
 	fmt.Println("Found entities:", entities)
-	var errs []string
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uccemoscev.WriteLoadControlLimits(entity.Entity, limits, nil)
+		msgCounter, err := h.uccemoscev.WriteLoadControlLimits(entity, limits, nil)
 		if err != nil {
-			errStr := fmt.Sprintf("%v: %v", entity, err)
-			errs = append(errs, errStr)
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing OSCEV LoadControlLimits:", err)
 		} else {
 			fmt.Println("Wrote OSCEV LoadControlLimits to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("errors: %s", strings.Join(errs, "; "))
-	}
-	return nil
+	return sent, sendErrors(sent)
 }
 
 // WriteOPEVLoadControlLimits sends load control limits to OPEV entities
-func (h *hems) WriteOPEVLoadControlLimits(limits []ucapi.LoadLimitsPhase) error {
-	entities := h.uccemopev.RemoteEntitiesScenarios()
+func (h *hems) WriteOPEVLoadControlLimits(ski string, limits []ucapi.LoadLimitsPhase) ([]sentMessage, error) {
+	entities, err := writeEntities(h.uccemopev.RemoteEntitiesScenarios(), ski)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Writing OPEV Load Control Limits:", limits)
 	fmt.Println("Found entities:", entities)
-	var errs []string
+	var sent []sentMessage
 	for _, entity := range entities {
-		_, err := h.uccemopev.WriteLoadControlLimits(entity.Entity, limits, nil)
+		msgCounter, err := h.uccemopev.WriteLoadControlLimits(entity, limits, nil)
 		if err != nil {
-			errStr := fmt.Sprintf("%v: %v", entity, err)
-			errs = append(errs, errStr)
+			sent = appendSendError(sent, entity, err)
 			fmt.Println("Error writing OPEV LoadControlLimits:", err)
 		} else {
 			fmt.Println("Wrote OPEV LoadControlLimits to entity", entity)
+			sent = appendSent(sent, entity, msgCounter)
 		}
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("errors: %s", strings.Join(errs, "; "))
-	}
-	return nil
+	return sent, sendErrors(sent)
 }
 
 // EEBUSServiceHandler
 
 func (h *hems) RemoteSKIConnected(service api.ServiceInterface, ski string) {
 	fmt.Printf("Remote SKI connected: %s\n", ski)
+	if h.rejectDeniedSKI(ski) {
+		return
+	}
 	peer := h.getOrCreatePeer(ski)
+	direction := h.connectionDirection(ski)
+	h.peersMu.Lock()
 	peer.connected = true
+	peer.connectCount++
 	peer.lastSeen = time.Now()
+	peer.direction = direction
+	peer.waitingForTrust = false
+	h.peersMu.Unlock()
 	h.broadcastPeerList()
+	h.recordEvent("connection", severityInfo, ski, "remote SKI connected", nil)
+	h.restartConnected(ski)
+	h.availabilityConnected(ski)
+	h.regressionConnected(ski)
 }
 
 func (h *hems) RemoteSKIDisconnected(service api.ServiceInterface, ski string) {
 	fmt.Printf("Remote SKI disconnected: %s\n", ski)
 	peer := h.getPeer(ski)
 	if peer != nil {
+		h.peersMu.Lock()
 		peer.connected = false
+		h.peersMu.Unlock()
 		h.broadcastPeerList()
 	}
+	h.sessionEnded(ski, "peerDisconnected")
+	h.readinessDisconnected(ski)
+	h.resetBehaviorProfile(ski)
+	h.restartDisconnected(ski, h.shipConnectionClosed(ski))
+	h.availabilityDisconnected(ski)
+	h.regressionDisconnected(ski)
+	h.resetMsgCounters(ski)
+	h.recordEvent("connection", severityWarning, ski, "remote SKI disconnected", nil)
 }
 
 func (h *hems) VisibleRemoteServicesUpdated(service api.ServiceInterface, entries []shipapi.RemoteService) {
@@ -1344,16 +1730,30 @@ func (h *hems) VisibleRemoteServicesUpdated(service api.ServiceInterface, entrie
 		peer.deviceType = entry.Type
 		peer.serial = entry.Serial
 		peer.identifier = entry.Identifier
-		peer.connected = false // Will be updated when actually connected
+		// the connection state is tracked by RemoteSKIConnected/RemoteSKIDisconnected, an
+		// mDNS update must not mark a connected peer as disconnected
 	}
 
 	// Broadcast peer list to frontend
 	h.broadcastPeerList()
+	h.trackRemoteServices(entries)
 }
 
-// broadcastPeerList sends the current peer list to all WebSocket clients
-func (h *hems) broadcastPeerList() {
+// broadcastJSON marshals a message and sends it to all WebSocket clients
+func (h *hems) broadcastJSON(msg interface{}) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		h.Errorf("marshal websocket message: %v", err)
+		return
+	}
+
+	h.broadcastWebsocket(b)
+}
+
+// peerInfos returns the summary of all known peers
+func (h *hems) peerInfos() []PeerInfo {
 	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
 	peers := make([]PeerInfo, 0, len(h.peers))
 	for ski, peer := range h.peers {
 		info := PeerInfo{
@@ -1367,17 +1767,23 @@ func (h *hems) broadcastPeerList() {
 			DeviceType: peer.deviceType,
 			Serial:     peer.serial,
 			Identifier: peer.identifier,
+
+			Direction:       peer.direction,
+			WaitingForTrust: peer.waitingForTrust,
 		}
-		for uc, supported := range peer.usecaseState {
+		for uc, supported := range h.usecaseSupportOf(peer) {
 			info.Usecases[uc] = supported
 		}
 		peers = append(peers, info)
 	}
-	h.peersMu.Unlock()
+	return peers
+}
 
+// broadcastPeerList sends the current peer list to all WebSocket clients
+func (h *hems) broadcastPeerList() {
 	msg := map[string]interface{}{
 		"type":  "peers",
-		"peers": peers,
+		"peers": h.peerInfos(),
 	}
 	b, err := json.Marshal(msg)
 	if err != nil {
@@ -1385,31 +1791,40 @@ func (h *hems) broadcastPeerList() {
 		return
 	}
 
-	h.wsMu.Lock()
-	defer h.wsMu.Unlock()
-	for c := range h.wsConns {
-		if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
-			c.Close()
-			delete(h.wsConns, c)
-		}
-	}
+	h.broadcastCoalesced("peers", b)
 }
 
-func (h *hems) ServiceShipIDUpdate(ski string, shipdID string) {}
+func (h *hems) ServiceShipIDUpdate(ski string, shipdID string) {
+	h.storeShipID(ski, shipdID)
+}
 
 func (h *hems) ServicePairingDetailUpdate(ski string, detail *shipapi.ConnectionStateDetail) {
 	fmt.Printf("Pairing detail update for %s: state=%v\n", ski, detail.State())
+	h.trackPairingDetail(ski, detail)
+	h.updateIncomingPairing(ski, detail.State())
 
 	if detail.State() == shipapi.ConnectionStateRemoteDeniedTrust {
 		fmt.Printf("The remote service %s denied trust.\n", ski)
 		h.myService.CancelPairingWithSKI(ski)
 		h.myService.UnregisterRemoteSKI(ski)
+		h.forgetAutoAccept(ski)
+		h.forgetShipID(ski)
 		// Don't exit - just log the error for this peer
 		// The application continues running for other peers
 	}
 }
 
 func (h *hems) AllowWaitingForTrust(ski string) bool {
+	if ok, reason := h.skiPermitted(ski); !ok {
+		h.recordEvent("trust", severityWarning, ski, "pairing request refused: "+reason, nil)
+		return false
+	}
+	// SKIs configured for auto accept are trusted right away, others are listed as
+	// waiting for trust and wait for the operator
+	if !h.autoAcceptTrust(ski) {
+		h.trackIncomingPairing(ski)
+		h.promptTrust(ski)
+	}
 	// Allow waiting for trust for all SKIs initially
 	return true
 }
@@ -1424,14 +1839,23 @@ func (h *hems) HandleEVSEDeviceState(ski string, failure bool, errorCode string)
 // main app
 func usage() {
 	fmt.Println("Usage:")
-	fmt.Println("  ./device-tester [-p <serverport>] [-c <cert.pem>] [-k <key.pem>] [-h]")
+	fmt.Println("  ./device-tester [-p <serverport>] [-c <cert.pem>] [-k <key.pem>] [-r <remote ski>] [-soak <duration>] [-snapshot <file>] [-restore <file>] [-h]")
 	fmt.Println()
 	fmt.Println("Flags:")
-	fmt.Println("  -p   Server port for EEBUS (default: 4815)")
+	fmt.Println("  -p   Server port for EEBUS (default: 4815), 0 selects a free port or the first free one of network.portRange")
 	fmt.Println("  -c   Path to certificate PEM file (optional)")
 	fmt.Println("  -k   Path to private key PEM file (optional)")
+	fmt.Println("  -r   SKI of the device under test to pair on startup (optional), without it the tester waits for pairing")
+	fmt.Println("  -soak  Start a soak run of the given duration, e.g. 72h (optional)")
+	fmt.Println("  -snapshot  Write a state snapshot (identity, settings, paired SKIs, DUT data) to the file on exit (optional)")
+	fmt.Println("  -restore   Restore a state snapshot on startup, overwrites config.json and the certificate (optional)")
 	fmt.Println("  -h   Show this help and exit")
 	fmt.Println()
+	fmt.Println("  ./device-tester test -plan <time/dst|time/durations> [-ski <ski>] [-value <W>] [-output text|json]")
+	fmt.Println("  Runs a single test against the DUT and exits 0 if all assertions passed, 1 if one failed,")
+	fmt.Println("  2 on invalid flags or config and 3 if the DUT did not connect or the test timed out.")
+	fmt.Println("  The summary is printed to stdout, progress and log output to stderr. Run ./device-tester test -h for all flags.")
+	fmt.Println()
 	fmt.Println("The tool will automatically discover EEBUS devices on the network.")
 	fmt.Println("Use the web interface at http://localhost:8080 to view and connect to peers.")
 	fmt.Println()
@@ -1443,17 +1867,45 @@ func usage() {
 }
 
 func main() {
-	portFlag := flag.Int("p", 4815, "server port for EEBUS (default 4815)")
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(runTestCommand(os.Args[2:]))
+	}
+
+	portFlag := flag.Int("p", 4815, "server port for EEBUS (default 4815, 0 selects a free port)")
+	flag.IntVar(portFlag, "port", 4815, "alias of -p")
 	certFlag := flag.String("c", "", "path to cert.pem (optional)")
 	keyFlag := flag.String("k", "", "path to key.pem (optional)")
 	helpFlag := flag.Bool("h", false, "show help")
+	remoteFlag := flag.String("r", "", "SKI of the device under test to pair on startup (optional)")
+	soakFlag := flag.Duration("soak", 0, "start a soak run of the given duration, e.g. 72h (optional)")
+	snapshotFlag := flag.String("snapshot", "", "write a state snapshot to this file on exit and on POST /api/snapshot (optional)")
+	restoreFlag := flag.String("restore", "", "restore the state snapshot from this file on startup (optional)")
 	flag.Parse()
-	h := hems{}
+	h := hems{snapshotPath: *snapshotFlag}
 	if *helpFlag {
 		usage()
 		return
 	}
 
+	// a restored snapshot replaces config.json and the certificate before they are loaded
+	var restored *testerSnapshot
+	if *restoreFlag != "" {
+		snap, err := readSnapshot(*restoreFlag)
+		if err != nil {
+			fmt.Printf("Error restoring snapshot: %v\n", err)
+			os.Exit(1)
+		}
+		certPath, keyPath := defaultCertPaths()
+		if *certFlag != "" && *keyFlag != "" {
+			certPath, keyPath = *certFlag, *keyFlag
+		}
+		if err := restoreSnapshotFiles(snap, certPath, keyPath); err != nil {
+			fmt.Printf("Error restoring snapshot: %v\n", err)
+			os.Exit(1)
+		}
+		restored = snap
+	}
+
 	// load config early so defaults are available inside run()
 	var err error
 	h.config, err = loadConfig()
@@ -1461,19 +1913,84 @@ func main() {
 		fmt.Printf("Error loading config: %v\n", err)
 		os.Exit(1)
 	}
+	if err := applyTimezone(h.config.Timezone); err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if p, err := h.config.behaviorProfile(); err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
+		os.Exit(1)
+	} else if p != nil {
+		fmt.Printf("Behavior profile %s: %s\n", p.Name, p.Description)
+	}
+	if h.config.Auth.Enabled {
+		fmt.Printf("Web API authentication enabled (%d users)\n", len(h.config.Auth.Users))
+	}
+
+	portSet := false
+	flag.Visit(func(f *flag.Flag) {
+		portSet = portSet || f.Name == "p" || f.Name == "port"
+	})
+	port, err := h.config.Network.shipPort(*portFlag, portSet)
+	if err != nil {
+		fmt.Printf("Error selecting the SHIP port: %v\n", err)
+		os.Exit(1)
+	}
+	if port != *portFlag {
+		fmt.Printf("SHIP port %d selected\n", port)
+	}
+	h.shipPort = port
+
+	h.run(port, *certFlag, *keyFlag)
+
+	if restored != nil {
+		h.restoreSnapshotPeers(restored)
+	}
+
+	// without a remote SKI the tester keeps running and waits for the DUT to initiate
+	// pairing or for a SKI set via PUT /api/remote-ski
+	if *remoteFlag != "" {
+		if _, err := h.switchRemoteSKI(*remoteFlag, "command line"); err != nil {
+			fmt.Printf("Error pairing remote SKI: %v\n", err)
+		}
+	} else {
+		h.Infof("No remote SKI given, waiting for pairing initiated by the DUT or via the API")
+	}
+
+	if h.config.Monitor.Enabled {
+		if err := h.startMonitor(h.config.Monitor); err != nil {
+			fmt.Printf("Error starting monitoring: %v\n", err)
+		}
+	}
 
-	h.run(*portFlag, *certFlag, *keyFlag)
+	if *soakFlag > 0 {
+		cfg := h.config.Soak
+		cfg.DurationHours = soakFlag.Hours()
+		if err := h.startSoak(cfg); err != nil {
+			fmt.Printf("Error starting soak run: %v\n", err)
+		}
+	}
 
 	// Clean exit to make sure mdns shutdown is invoked
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	<-sig
 	// User exit
+	h.tracer.flush()
+	if h.snapshotPath != "" {
+		if err := h.saveSnapshot(h.snapshotPath); err != nil {
+			fmt.Printf("Error writing snapshot: %v\n", err)
+		}
+	}
 }
 
 // Logging interface
 
 func (h *hems) Trace(args ...interface{}) {
+	h.observeHandshakeLog(args...)
+	h.captureDatagramLog(args...)
+	h.inspectShipFrame(args...)
+
 	// Always broadcast trace messages to frontend, even if tracing is disabled for stdout
 	value := fmt.Sprintln(args...)
 
@@ -1506,6 +2023,8 @@ func (h *hems) Tracef(format string, args ...interface{}) {
 }
 
 func (h *hems) Debug(args ...interface{}) {
+	h.observeHandshakeLog(args...)
+
 	// Always broadcast debug messages to frontend
 	value := fmt.Sprintln(args...)
 
@@ -1524,6 +2043,8 @@ func (h *hems) Debug(args ...interface{}) {
 }
 
 func (h *hems) Debugf(format string, args ...interface{}) {
+	h.observeHandshakeLogf(format, args...)
+
 	// Always broadcast formatted debug messages to frontend
 	value := fmt.Sprintf(format, args...)
 
@@ -1604,7 +2125,7 @@ func (h *hems) extractSKIFromMessage(msg string) string {
 }
 
 func (h *hems) currentTimestamp() string {
-	return time.Now().Format("2006-01-02 15:04:05")
+	return formatTimestamp(time.Now())
 }
 
 func (h *hems) appendLog(line string) {
@@ -1620,16 +2141,8 @@ func (h *hems) appendLog(line string) {
 	}
 	h.logs = append(h.logs, line)
 
-	// broadcast to websocket clients (non-blocking)
-	h.wsMu.Lock()
-	defer h.wsMu.Unlock()
-	for c := range h.wsConns {
-		if err := c.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
-			// remove broken client
-			c.Close()
-			delete(h.wsConns, c)
-		}
-	}
+	// queue for the websocket clients, slow clients do not block logging
+	h.broadcastWebsocket([]byte(line))
 }
 
 func (h *hems) getLogs() []string {
@@ -1665,93 +2178,18 @@ func (h *hems) printFormat(msgType, format string, args ...interface{}) {
 	h.appendLog(line)
 }
 
-// setUsecaseSupported updates the global state and broadcasts the change
-func (h *hems) setUsecaseSupported(name string, supported bool) {
-	ucMu.Lock()
-	defer ucMu.Unlock()
-
-	// Update global state
-	if old, ok := h.globalUseCaseState[name]; ok && old == supported {
-		return
-	}
-	h.globalUseCaseState[name] = supported
-
-	// Update all peers
-	h.peersMu.Lock()
-	for _, peer := range h.peers {
-		peer.usecaseState[name] = supported
-	}
-	h.peersMu.Unlock()
-
-	// Broadcast per-peer usecase messages to websocket clients so frontend
-	// receives updates including the peer SKI (multi-peer aware)
-	h.wsMu.Lock()
-	defer h.wsMu.Unlock()
-	for ski := range h.peers {
-		msg := map[string]interface{}{"type": "usecase", "name": name, "supported": supported, "ski": ski}
-		b, err := json.Marshal(msg)
-		if err != nil {
-			h.Errorf("marshal usecase update: %v", err)
-			continue
-		}
-		for c := range h.wsConns {
-			if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
-				c.Close()
-				delete(h.wsConns, c)
-			}
-		}
-	}
-}
-
-// setUsecaseSupportedForPeer sets usecase support for a specific peer
-func (h *hems) setUsecaseSupportedForPeer(peer *peerData, name string, supported bool) {
-	if peer == nil {
-		return
-	}
-
-	peer.usecaseState[name] = supported
-
-	// Also update global state
-	ucMu.Lock()
-	h.globalUseCaseState[name] = supported
-	ucMu.Unlock()
-
-	// broadcast a json message to websocket clients
-	msg := map[string]interface{}{
-		"type":      "usecase",
-		"name":      name,
-		"supported": supported,
-		"ski":       peer.ski,
-	}
-	b, err := json.Marshal(msg)
-	if err != nil {
-		h.Errorf("marshal usecase update: %v", err)
-		return
-	}
-
-	h.wsMu.Lock()
-	defer h.wsMu.Unlock()
-	for c := range h.wsConns {
-		if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
-			c.Close()
-			delete(h.wsConns, c)
-		}
-	}
-}
-
 // updateEntitiesFromDevice updates the entities for a specific peer
 func (h *hems) updateEntitiesFromDevice(ski string, device spineapi.DeviceRemoteInterface, peer *peerData) {
 	if peer == nil || device == nil {
 		return
 	}
 
-	// update peer's entities slice
-	peer.entities = device.Entities()
-
 	// build JSON-friendly representation
 	type OpInfo struct {
 		Op   interface{} `json:"op"`
 		Name string      `json:"name"`
+		// Data is the last function data received from the DUT, only for readable functions
+		Data interface{} `json:"data,omitempty"`
 	}
 	type FeatureInfo struct {
 		ID         interface{} `json:"id,omitempty"`
@@ -1760,64 +2198,70 @@ func (h *hems) updateEntitiesFromDevice(ski string, device spineapi.DeviceRemote
 		Operations []OpInfo    `json:"operations,omitempty"`
 	}
 	type EntityInfo struct {
-		Address    string        `json:"address"`
-		EntityType string        `json:"entityType"`
-		Features   []FeatureInfo `json:"features"`
-	}
-
-	var out []EntityInfo
-	for _, e := range peer.entities {
-		var ent EntityInfo
-		// Address and entity type
-		if e != nil {
-			ent.Address = fmt.Sprint(e.Address())
-			ent.EntityType = fmt.Sprint(e.EntityType())
-			// features - e.Features() seems to be an indexed map/array; iterate keys
-			for t := range e.Features() {
-				f := e.Features()[t]
-				if f == nil {
-					continue
-				}
-				var fi FeatureInfo
-				// try to include ID if available, otherwise the String()
-				fi.Name = fmt.Sprint(f.String())
-				// Role() might return a value
-				fi.Roles = fmt.Sprint(f.Role())
-				// include operations
-				for op := range f.Operations() {
-					opVal := f.Operations()[op]
-					fi.Operations = append(fi.Operations, OpInfo{Op: op, Name: fmt.Sprint(opVal.String())})
+		Address      string              `json:"address"`
+		EntityType   string              `json:"entityType"`
+		Manufacturer *entityManufacturer `json:"manufacturer,omitempty"`
+		Features     []FeatureInfo       `json:"features"`
+	}
+
+	b, err := peer.entities.update(device.Entities(), func(entities []spineapi.EntityRemoteInterface, version uint64) ([]byte, error) {
+		var out []EntityInfo
+		for _, e := range entities {
+			var ent EntityInfo
+			// Address and entity type
+			if e != nil {
+				ent.Address = fmt.Sprint(e.Address())
+				ent.EntityType = fmt.Sprint(e.EntityType())
+				ent.Manufacturer = manufacturerOfEntity(e)
+				// features - e.Features() seems to be an indexed map/array; iterate keys
+				for t := range e.Features() {
+					f := e.Features()[t]
+					if f == nil {
+						continue
+					}
+					var fi FeatureInfo
+					// try to include ID if available, otherwise the String()
+					fi.Name = fmt.Sprint(f.String())
+					// Role() might return a value
+					fi.Roles = fmt.Sprint(f.Role())
+					// include operations, sorted so unchanged entities render the same JSON
+					functions := make([]model.FunctionType, 0, len(f.Operations()))
+					for op := range f.Operations() {
+						functions = append(functions, op)
+					}
+					sort.Slice(functions, func(i, j int) bool { return functions[i] < functions[j] })
+					for _, op := range functions {
+						opVal := f.Operations()[op]
+						info := OpInfo{Op: op, Name: fmt.Sprint(opVal.String())}
+						if opVal.Read() {
+							info.Data = f.DataCopy(op)
+						}
+						fi.Operations = append(fi.Operations, info)
+					}
+					// append to ent.Features
+					ent.Features = append(ent.Features, fi)
 				}
-				// append to ent.Features
-				ent.Features = append(ent.Features, fi)
 			}
+			out = append(out, ent)
 		}
-		out = append(out, ent)
-	}
 
-	// marshal and broadcast
-	msg := map[string]interface{}{
-		"type":     "entities",
-		"ski":      ski,
-		"entities": out,
-	}
-	b, err := json.Marshal(msg)
+		// the JSON is cached in the store together with the entities it was built from
+		return json.Marshal(map[string]interface{}{
+			"type":     "entities",
+			"ski":      ski,
+			"version":  version,
+			"entities": out,
+		})
+	})
 	if err != nil {
 		h.Errorf("marshal entities: %v", err)
 		return
 	}
 
-	// cache last entities json for this peer
-	peer.lastEntitiesJSON = b
+	// every usecase event re-sends the full entity list, bursts are merged
+	h.broadcastCoalesced("entities/"+ski, b)
 
-	h.wsMu.Lock()
-	defer h.wsMu.Unlock()
-	for c := range h.wsConns {
-		if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
-			c.Close()
-			delete(h.wsConns, c)
-		}
-	}
+	h.requestClassifications(ski, device, peer, device.Entities())
 }
 
 // startWebInterface starts a small HTTP server to trigger writes and show logs
@@ -1836,7 +2280,7 @@ func (h *hems) startWebInterface() {
 
 	// initialize wsConns map
 	h.wsMu.Lock()
-	h.wsConns = make(map[*websocket.Conn]struct{})
+	h.wsConns = make(map[*wsClient]struct{})
 	h.wsMu.Unlock()
 
 	// determine executable directory (used as base for web assets)
@@ -1862,8 +2306,7 @@ func (h *hems) startWebInterface() {
 		data, err := os.ReadFile(indexPath)
 		if err != nil {
 			h.Errorf("failed to read web template %s: %v", indexPath, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte("internal error"))
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "internal error")
 			return
 		}
 		if _, err := w.Write(data); err != nil {
@@ -1872,38 +2315,65 @@ func (h *hems) startWebInterface() {
 	})
 
 	// websocket endpoint for logs
-	var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-	http.HandleFunc("/ws/logs", func(w http.ResponseWriter, r *http.Request) {
+	var upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+		// permessage-deflate is negotiated with clients that offer it
+		EnableCompression: h.config != nil && h.config.Websocket.Compression,
+		Subprotocols:      wsSubprotocols,
+	}
+	http.HandleFunc("/ws/logs", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		schema := r.URL.Query().Get("schema")
+		if schema != "" && schema != wsSchemaLegacy && schema != wsSchemaEnvelope {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "schema must be legacy or envelope")
+			return
+		}
+		client := clientKey(r)
+		if !h.acquireWebsocketSlot(client) {
+			h.Infof("websocket connection limit reached for client %s", client)
+			writeAPIError(w, http.StatusTooManyRequests, errCodeRateLimited, "too many websocket connections")
+			return
+		}
+		defer h.releaseWebsocketSlot(client)
+
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			h.Errorf("ws upgrade: %v", err)
 			return
 		}
-		// add to map
-		h.wsMu.Lock()
-		h.wsConns[c] = struct{}{}
-		h.wsMu.Unlock()
+		// register before the snapshot so no message gets lost, broadcasts are
+		// queued until the writer starts
+		wc := h.registerWebsocket(c, schema)
 
 		// send existing logs as initial snapshot
 		logs := h.getLogs()
 		for _, line := range logs {
-			if err := c.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			if err := wc.writeSnapshot([]byte(line)); err != nil {
 				break
 			}
 		}
 
 		// send per-peer usecase state snapshot so new websocket clients
-		// receive usecase support messages that include the peer SKI.
+		// receive usecase support messages that include the peer SKI. The messages are
+		// built under the lock and written after it, a slow client must not block the
+		// peer updates.
+		var usecaseMsgs [][]byte
 		h.peersMu.Lock()
 		for ski, peer := range h.peers {
-			for name, supported := range peer.usecaseState {
+			for name, supported := range h.usecaseSupportOf(peer) {
 				msg := map[string]interface{}{"type": "usecase", "name": name, "supported": supported, "ski": ski}
 				if b, err := json.Marshal(msg); err == nil {
-					_ = c.WriteMessage(websocket.TextMessage, b)
+					usecaseMsgs = append(usecaseMsgs, b)
 				}
 			}
 		}
 		h.peersMu.Unlock()
+		for _, b := range usecaseMsgs {
+			if err := wc.writeSnapshot(b); err != nil {
+				break
+			}
+		}
+
+		h.startWebsocketWriter(wc)
 
 		// send current peer list
 		h.broadcastPeerList()
@@ -1912,169 +2382,1598 @@ func (h *hems) startWebInterface() {
 		for {
 			if _, _, err := c.ReadMessage(); err != nil {
 				// client closed or error
-				c.Close()
-				h.wsMu.Lock()
-				delete(h.wsConns, c)
-				h.wsMu.Unlock()
+				h.unregisterWebsocket(wc)
 				return
 			}
 		}
-	})
+	}))
 
-	// API endpoint that supports multiple commands as JSON payload
-	http.HandleFunc("/api/write", func(w http.ResponseWriter, r *http.Request) {
+	// API endpoint that supports multiple commands as JSON payload.
+	// Writes are queued and executed asynchronously, the response contains
+	// the command id whose state can be queried at /api/commands/{id}.
+	// Deprecated: use the resources below /api/v1/usecases (writeapi.go).
+	http.HandleFunc("/api/write", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
 			return
 		}
 		var payload map[string]interface{}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("invalid json"))
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
 			return
 		}
 		cmd, _ := payload["cmd"].(string)
-		switch cmd {
-		case "writeLPCConsumptionLimit":
-			// expect: durationSeconds (int), value (float), isActive (bool)
-			var durSec int64
-			var val float64
-			var isActive bool
-			if d, ok := payload["durationSeconds"].(float64); ok {
-				durSec = int64(d)
-			}
-			if v, ok := payload["value"].(float64); ok {
-				val = v
-			}
-			if a, ok := payload["isActive"].(bool); ok {
-				isActive = a
-			}
-			if err := h.WriteLPCConsumptionLimit(durSec, val, isActive); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte(err.Error()))
-				return
-			}
-			_, _ = w.Write([]byte("ok"))
+		schema, ok := writeSchemas[cmd]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, errCodeUnknownCommand, "unknown command")
 			return
-		case "writeLPCFailsafeDuration":
-			// expect: durationMinutes (int)
-			var minutes int64
-			if d, ok := payload["durationMinutes"].(float64); ok {
-				minutes = int64(d)
-			}
-			minDuration := time.Duration(minutes) * time.Minute
-			h.WriteLPCFailsafeDuration(minDuration)
-			_, _ = w.Write([]byte("ok"))
-			return
-		case "writeLPCFailsafeValue":
-			// expect: failsafePower (float)
-			var limit float64
-			if l, ok := payload["failsafePower"].(float64); ok {
-				limit = l
-			}
-			h.WriteLPCFailsafeValue(limit)
-			_, _ = w.Write([]byte("ok"))
-			return
-		case "writeLPPProductionLimit":
-			// expect: durationSeconds (int), value (float), isActive (bool)
-			var durSec int64
-			var val float64
-			var isActive bool
-			if d, ok := payload["durationSeconds"].(float64); ok {
-				durSec = int64(d)
-			}
-			if v, ok := payload["value"].(float64); ok {
-				val = v
-			}
-			if a, ok := payload["isActive"].(bool); ok {
-				isActive = a
-			}
-			if err := h.WriteLPPProductionLimit(durSec, val, isActive); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte(err.Error()))
-				return
-			}
-			_, _ = w.Write([]byte("ok"))
+		}
+		w.Header().Set("Deprecation", "true")
+		if successor := writeCommandSuccessor[cmd]; successor != "" {
+			w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		}
+		if fields := schema.validate("", payload); len(fields) > 0 {
+			writeAPIFieldErrors(w, fields)
 			return
-		case "writeLPPFailsafeDuration":
-			// expect: durationMinutes (int)
-			var minutes int64
-			if d, ok := payload["durationMinutes"].(float64); ok {
-				minutes = int64(d)
-			}
-			minDuration := time.Duration(minutes) * time.Minute
-			h.WriteLPPFailsafeDuration(minDuration)
-			_, _ = w.Write([]byte("ok"))
-			return
-		case "writeLPPFailsafeValue":
-			// expect: failsafePower (float)
-			var limit float64
-			if l, ok := payload["failsafePower"].(float64); ok {
-				limit = l
-			}
-			h.WriteLPPFailsafeValue(limit)
-			_, _ = w.Write([]byte("ok"))
+		}
+		if !h.writeTargetConnected(payload) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "the DUT is not connected")
 			return
-		case "writeOSCEVLoadControlLimits":
-			// Simple interface: accept value and isActive, build limits array for all phases
-			value, ok := payload["value"].(float64)
-			if !ok {
-				w.WriteHeader(http.StatusBadRequest)
-				_, _ = w.Write([]byte("value must be a number"))
-				return
-			}
-			isActive, ok := payload["isActive"].(bool)
-			if !ok {
-				isActive = true // default to active
-			}
-			// Build limits for all three phases
-			limits := []ucapi.LoadLimitsPhase{
-				{Phase: model.ElectricalConnectionPhaseNameTypeA, Value: value, IsActive: isActive},
-				{Phase: model.ElectricalConnectionPhaseNameTypeB, Value: value, IsActive: isActive},
-				{Phase: model.ElectricalConnectionPhaseNameTypeC, Value: value, IsActive: isActive},
-			}
-			if err := h.WriteOSCEVLoadControlLimits(limits); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte(err.Error()))
-				return
-			}
-			_, _ = w.Write([]byte("ok"))
+		}
+		exec, err := h.writeCommandExec(cmd, payload)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeUnknownCommand, err.Error())
 			return
-		case "writeOPEVLoadControlLimits":
-			// Simple interface: accept value and isActive, build limits array for all phases
-			value, ok := payload["value"].(float64)
-			if !ok {
-				w.WriteHeader(http.StatusBadRequest)
-				_, _ = w.Write([]byte("value must be a number"))
-				return
-			}
-			isActive, ok := payload["isActive"].(bool)
-			if !ok {
-				isActive = true // default to active
-			}
-			// Build limits for all three phases
-			limits := []ucapi.LoadLimitsPhase{
-				{Phase: model.ElectricalConnectionPhaseNameTypeA, Value: value, IsActive: isActive},
-				{Phase: model.ElectricalConnectionPhaseNameTypeB, Value: value, IsActive: isActive},
-				{Phase: model.ElectricalConnectionPhaseNameTypeC, Value: value, IsActive: isActive},
-			}
-			if err := h.WriteOPEVLoadControlLimits(limits); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte(err.Error()))
-				return
+		}
+
+		retry, err := h.retryPolicy(payload)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRetry, "invalid retry policy: "+err.Error())
+			return
+		}
+
+		c, err := h.enqueueCommand(cmd, payload, retry, exec)
+		if err != nil {
+			writeAPIError(w, http.StatusServiceUnavailable, errCodeUnavailable, err.Error())
+			return
+		}
+		h.writeCommandResponse(w, r, c)
+	}))
+
+	// resource oriented write endpoints, e.g. PUT /api/v1/usecases/lpc/limit
+	h.registerWriteAPI()
+
+	// endpoint: JSON schemas of the /api/write payloads by command
+	http.HandleFunc("GET /api/write/schema", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(writeSchemas); err != nil {
+			h.Errorf("encode write schemas: %v", err)
+		}
+	}))
+
+	// endpoint: list recent write commands
+	http.HandleFunc("GET /api/commands", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getCommands()); err != nil {
+			h.Errorf("encode commands: %v", err)
+		}
+	}))
+
+	// endpoint: return the state of a single write command
+	http.HandleFunc("GET /api/commands/{id}", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		c, ok := h.getCommand(r.PathValue("id"))
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "command not found")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(c); err != nil {
+			h.Errorf("encode command: %v", err)
+		}
+	}))
+
+	// endpoint: list detected charging sessions, optionally filtered by ?ski=, &anonymize=true
+	http.HandleFunc("GET /api/sessions", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		anon, err := h.requestAnonymizer(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		out := anon.wrap(w)
+		if err := json.NewEncoder(out).Encode(h.getSessions(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode sessions: %v", err)
+		}
+		if err := out.Close(); err != nil {
+			h.Errorf("write sessions: %v", err)
+		}
+	}))
+
+	// endpoint: return the summary of a single charging session (?anonymize=true)
+	http.HandleFunc("GET /api/sessions/{id}", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		anon, err := h.requestAnonymizer(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		s, ok := h.getSession(r.PathValue("id"))
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "session not found")
+			return
+		}
+		out := anon.wrap(w)
+		if err := json.NewEncoder(out).Encode(s); err != nil {
+			h.Errorf("encode session: %v", err)
+		}
+		if err := out.Close(); err != nil {
+			h.Errorf("write session: %v", err)
+		}
+	}))
+
+	// endpoint: energy accounting derived from EVCEM samples, optionally filtered by ?ski=
+	http.HandleFunc("GET /api/energy", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getEnergyAccounts(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode energy accounts: %v", err)
+		}
+	}))
+
+	// endpoint: restart the energy accounting of a peer
+	http.HandleFunc("POST /api/energy/reset", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ski := r.URL.Query().Get("ski")
+		if ski == "" {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "ski required")
+			return
+		}
+		h.resetEnergyAccount(ski)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: state transition history of EVCC charge state and EVSECC operating state
+	// Query: ?ski=...&machine=evccChargeState|evseccOperatingState
+	http.HandleFunc("GET /api/states", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		if err := json.NewEncoder(w).Encode(h.getStateHistories(q.Get("ski"), q.Get("machine"))); err != nil {
+			h.Errorf("encode state histories: %v", err)
+		}
+	}))
+
+	// endpoint: EVSECC operating state history with error descriptions
+	// Query: ?ski=...&since=RFC3339
+	http.HandleFunc("GET /api/evsecc/operating-states", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		var since time.Time
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "since must be RFC3339")
+				return
+			}
+			since = t
+		}
+		if err := json.NewEncoder(w).Encode(h.getEvseStateHistories(q.Get("ski"), since)); err != nil {
+			h.Errorf("encode EVSE operating states: %v", err)
+		}
+	}))
+
+	// endpoint: time series of the numeric usecase values
+	// Query: ?ski=...&name=...&since=RFC3339&until=RFC3339&bucket=<duration>|points=<n>
+	// Without ski and name the available series are listed. bucket or points aggregate
+	// the values to min/max/avg per bucket.
+	http.HandleFunc("GET /api/series", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		ski, name := q.Get("ski"), q.Get("name")
+		if ski == "" || name == "" {
+			json.NewEncoder(w).Encode(h.seriesNames(ski))
+			return
+		}
+		var since, until time.Time
+		for param, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+			if v := q.Get(param); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, param+" must be RFC3339")
+					return
+				}
+				*dst = t
+			}
+		}
+		points := h.seriesRange(ski, name, since, until)
+
+		var width time.Duration
+		if v := q.Get("bucket"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "bucket must be a positive duration, e.g. 60s")
+				return
+			}
+			width = d
+		} else if v := q.Get("points"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "points must be a positive number")
+				return
+			}
+			width = bucketWidth(points, n)
+		} else {
+			width = bucketWidth(points, maxSeriesResponsePoints)
+		}
+
+		resp := map[string]interface{}{"ski": ski, "name": name, "count": len(points)}
+		if width > 0 {
+			resp["bucketSeconds"] = width.Seconds()
+			resp["buckets"] = downsampleSeries(points, width)
+		} else {
+			resp["points"] = points
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			h.Errorf("encode series: %v", err)
+		}
+	}))
+
+	// endpoint: CSV export of measurement series or the event timeline
+	// Query: ?kind=series|events&ski=...&columns=a,b&since=RFC3339&until=RFC3339&anonymize=true (events also &type=...)
+	http.HandleFunc("GET /api/export/csv", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		fail := func(msg string) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, msg)
+		}
+		anon, err := h.requestAnonymizer(q)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		var since, until time.Time
+		for param, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+			if v := q.Get(param); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					fail(param + " must be RFC3339")
+					return
+				}
+				*dst = t
+			}
+		}
+
+		kind := q.Get("kind")
+		if kind == "" {
+			kind = "series"
+		}
+		ski := q.Get("ski")
+		filename := fmt.Sprintf("%s-%s.csv", kind, time.Now().Format("20060102-150405"))
+
+		switch kind {
+		case "events":
+			columns, err := csvColumns(q.Get("columns"), eventCSVColumns)
+			if err != nil {
+				fail(err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+			f := eventFilter{SKI: ski, Type: q.Get("type"), Since: since, Until: until}
+			out := anon.wrap(w)
+			if err := h.writeEventsCSV(out, f, columns); err != nil {
+				h.Errorf("export events csv: %v", err)
+			}
+			if err := out.Close(); err != nil {
+				h.Errorf("export events csv: %v", err)
+			}
+		case "series":
+			if ski == "" {
+				fail("ski parameter required")
+				return
+			}
+			columns, err := csvColumns(q.Get("columns"), h.seriesNames(ski)[ski])
+			if err != nil {
+				fail(err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+			out := anon.wrap(w)
+			if err := h.writeSeriesCSV(out, ski, columns, since, until); err != nil {
+				h.Errorf("export series csv: %v", err)
+			}
+			if err := out.Close(); err != nil {
+				h.Errorf("export series csv: %v", err)
+			}
+		default:
+			fail("kind must be series or events")
+		}
+	}))
+
+	// endpoint: event timeline
+	// Query: ?ski=...&type=...&since=RFC3339&until=RFC3339
+	http.HandleFunc("GET /api/events", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		f := eventFilter{SKI: q.Get("ski"), Type: q.Get("type")}
+		for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+			if v := q.Get(name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, name+" must be RFC3339")
+					return
+				}
+				*dst = t
+			}
+		}
+		if err := json.NewEncoder(w).Encode(h.getEvents(f)); err != nil {
+			h.Errorf("encode events: %v", err)
+		}
+	}))
+
+	// endpoint: clear collected data without restarting or re-pairing
+	// Query: ?scope=logs,events,series,entities (default all)&ski=...
+	http.HandleFunc("POST /api/reset", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		scopes, err := parseResetScopes(q.Get("scope"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		user, _ := h.authenticate(r)
+		cleared := h.resetCollectedData(scopes, q.Get("ski"), user.Name)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "cleared": cleared}); err != nil {
+			h.Errorf("encode reset: %v", err)
+		}
+	}))
+
+	// endpoint: zip with logs, redacted config (admins only), version info, entities, events, statistics and
+	// captured messages for issue reports
+	// Query: ?ski=...&since=RFC3339&anonymize=true
+	http.HandleFunc("GET /api/diagnostics/bundle", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		anon, err := h.requestAnonymizer(q)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		var since time.Time
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "since must be RFC3339")
+				return
+			}
+			since = t
+		}
+		user, _ := h.authenticate(r)
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename="+anon.applyString(diagnosticBundleName(q.Get("ski"), time.Now())))
+		if err := h.writeDiagnosticBundle(w, q.Get("ski"), since, anon, user.role >= roleAdmin); err != nil {
+			h.Errorf("write diagnostic bundle: %v", err)
+		}
+	}))
+
+	// endpoint: fired alerts, newest first
+	// Query: ?state=firing|resolved|fired&ski=...
+	http.HandleFunc("GET /api/alerts", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		if err := json.NewEncoder(w).Encode(h.getAlerts(q.Get("state"), q.Get("ski"))); err != nil {
+			h.Errorf("encode alerts: %v", err)
+		}
+	}))
+
+	// endpoint: configuration baselines of the DUTs and the last comparison after a reconnect (?ski=...)
+	http.HandleFunc("GET /api/regressions", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getRegressions(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode regressions: %v", err)
+		}
+	}))
+
+	// endpoint: configured notifiers with their conditions and delivery counts
+	http.HandleFunc("GET /api/notifiers", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getNotifiers()); err != nil {
+			h.Errorf("encode notifiers: %v", err)
+		}
+	}))
+
+	// endpoint: send a test notification to check the channel settings
+	http.HandleFunc("POST /api/notifiers/{name}/test", h.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := h.testNotifier(r.PathValue("name")); err != nil {
+			status, code := http.StatusBadGateway, errCodeUnavailable
+			if errors.Is(err, errUnknownNotifier) {
+				status, code = http.StatusNotFound, errCodeNotFound
+			}
+			writeAPIError(w, status, code, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
+			h.Errorf("encode notifier test: %v", err)
+		}
+	}))
+
+	// endpoint: active LPC/LPP limits compared with the measured power per limitExceeded rule (?ski=...)
+	http.HandleFunc("GET /api/compliance", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getCompliance(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode compliance: %v", err)
+		}
+	}))
+
+	// endpoint: state of the current or last soak run (?samples=true includes all samples)
+	http.HandleFunc("GET /api/soak", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getSoak(r.URL.Query().Get("samples") == "true")); err != nil {
+			h.Errorf("encode soak run: %v", err)
+		}
+	}))
+
+	// endpoint: start a soak run, the body overrides the configured soak settings
+	http.HandleFunc("POST /api/soak/start", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		cfg := h.config.Soak
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid soak settings: "+err.Error())
+				return
+			}
+		}
+		if err := h.startSoak(cfg); err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(h.getSoak(false))
+	}))
+
+	// endpoint: stop the active soak run and return its summary
+	http.HandleFunc("POST /api/soak/stop", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		summary, err := h.stopSoak()
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(summary)
+	}))
+
+	// endpoint: watchdog settings and the recoveries it performed
+	http.HandleFunc("GET /api/watchdog", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.watchdogStatus()); err != nil {
+			h.Errorf("encode watchdog: %v", err)
+		}
+	}))
+
+	// endpoint: state of the continuous monitoring and its last report
+	http.HandleFunc("GET /api/monitor", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getMonitor()); err != nil {
+			h.Errorf("encode monitor: %v", err)
+		}
+	}))
+
+	// endpoint: start continuous monitoring, the body overrides the configured monitor settings
+	http.HandleFunc("POST /api/monitor/start", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		cfg := h.config.Monitor
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid monitor settings: "+err.Error())
+				return
+			}
+		}
+		if err := h.startMonitor(cfg); err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(h.getMonitor())
+	}))
+
+	// endpoint: write the report of the current period now and start the next period
+	http.HandleFunc("POST /api/monitor/report", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		report, err := h.reportMonitorNow()
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	// endpoint: stop monitoring and write the report of the partial period
+	http.HandleFunc("POST /api/monitor/stop", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		report, err := h.stopMonitor()
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	// endpoint: start a time handling test (DST crossing or duration boundaries)
+	http.HandleFunc("POST /api/tests/time", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req timeTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startTimeTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last time test
+	http.HandleFunc("GET /api/tests/time", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		run := h.getTimeTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no time test run yet")
+			return
+		}
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: start a failsafe test, the local heartbeat is stopped until the DUT limited itself
+	http.HandleFunc("POST /api/tests/failsafe", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req failsafeTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startFailsafeTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last failsafe test
+	// Query: ?format=json|svg, svg renders the power timeline
+	http.HandleFunc("GET /api/tests/failsafe", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		run := h.getFailsafeTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no failsafe test run yet")
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			if err := json.NewEncoder(w).Encode(run); err != nil {
+				h.Errorf("encode failsafe test: %v", err)
+			}
+		case "svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			_, _ = w.Write(failsafeTestSVG(run))
+		default:
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "format must be json or svg")
+		}
+	}))
+
+	// endpoint: start an indefinite limit test, the operator reboots the DUT while it runs
+	http.HandleFunc("POST /api/tests/indefinite", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req indefiniteTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startIndefiniteTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last indefinite limit test
+	http.HandleFunc("GET /api/tests/indefinite", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		run := h.getIndefiniteTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no indefinite limit test run yet")
+			return
+		}
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: start a rapid-write stress test, many limit writes in quick succession
+	http.HandleFunc("POST /api/tests/stress", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req stressTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startStressTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last stress test with the result of every write
+	http.HandleFunc("GET /api/tests/stress", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		run := h.getStressTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no stress test run yet")
+			return
+		}
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: start a reconnect storm test, the DUT is disconnected repeatedly and has to
+	// reconnect with the same state every time
+	http.HandleFunc("POST /api/tests/reconnect", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req reconnectTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startReconnectTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last reconnect storm test with every cycle
+	http.HandleFunc("GET /api/tests/reconnect", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		run := h.getReconnectTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no reconnect storm test run yet")
+			return
+		}
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: replay an uploaded CSV or JSON time/value profile as limit writes,
+	// query parameters ski, usecase (lpc or lpp), speed and restore
+	http.HandleFunc("POST /api/tests/profile", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		p, err := readLimitProfile(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		q := r.URL.Query()
+		speed := 1.0
+		if v := q.Get("speed"); v != "" {
+			if speed, err = strconv.ParseFloat(v, 64); err != nil || speed <= 0 {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "speed must be a positive number")
+				return
+			}
+		}
+		restore := true
+		if v := q.Get("restore"); v != "" {
+			if restore, err = strconv.ParseBool(v); err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "restore must be true or false")
+				return
+			}
+		}
+		if name := q.Get("name"); name != "" {
+			p.Name = name
+		}
+		meta, err := h.newTestRunMetadata(r, testRunMetadataFromQuery(q))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		run, err := h.startProfile(p, q.Get("ski"), q.Get("usecase"), speed, restore, meta)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last profile replay with the result of every write
+	http.HandleFunc("GET /api/tests/profile", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		run := h.getProfile()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no profile replay yet")
+			return
+		}
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: abort the running profile replay
+	http.HandleFunc("POST /api/tests/profile/stop", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !h.stopProfile() {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, "no profile replay is running")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopping"})
+	}))
+
+	// endpoint: start a power envelope test, a sequence of consumption limits with the measured response
+	http.HandleFunc("POST /api/tests/envelope", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req envelopeTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startEnvelopeTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last envelope test
+	// Query: ?format=json|svg, svg renders the power and the step limits
+	http.HandleFunc("GET /api/tests/envelope", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		run := h.getEnvelopeTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no envelope test run yet")
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			if err := json.NewEncoder(w).Encode(run); err != nil {
+				h.Errorf("encode envelope test: %v", err)
+			}
+		case "svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			_, _ = w.Write(envelopeTestSVG(run))
+		default:
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "format must be json or svg")
+		}
+	}))
+
+	// endpoint: start a time-of-use charging test, publishes a tariff, waits for the EV's plan
+	// and verifies the re-plan after the power limits changed
+	http.HandleFunc("POST /api/tests/tou", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req touTestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startTouTest(req)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state of the current or last time-of-use test
+	http.HandleFunc("GET /api/tests/tou", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		run := h.getTouTest()
+		if run == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no time-of-use test run yet")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(run); err != nil {
+			h.Errorf("encode time-of-use test: %v", err)
+		}
+	}))
+
+	// endpoint: write round-trip latency distributions per command type (?cmd=...)
+	http.HandleFunc("GET /api/latency", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getLatencies(r.URL.Query().Get("cmd"))); err != nil {
+			h.Errorf("encode latencies: %v", err)
+		}
+	}))
+
+	// endpoint: drop all recorded latency samples
+	http.HandleFunc("POST /api/latency/reset", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		h.resetLatencies()
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: connection statistics, handshake phase durations and SPINE errors per peer (?ski=...)
+	http.HandleFunc("GET /api/stats", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getStats(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode stats: %v", err)
+		}
+	}))
+
+	// endpoint: time from connection setup to detailed discovery and to each use case being supported (?ski=...)
+	http.HandleFunc("GET /api/stats/readiness", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getReadinessStats(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode readiness: %v", err)
+		}
+	}))
+
+	// endpoint: SPINE error results per remote feature and function (?ski=...&all=true)
+	http.HandleFunc("GET /api/stats/errors", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		if err := json.NewEncoder(w).Encode(h.getErrorStats(q.Get("ski"), q.Get("all") == "true")); err != nil {
+			h.Errorf("encode error stats: %v", err)
+		}
+	}))
+
+	// endpoint: response times per remote feature and function, slowest p95 first
+	// Query: ?ski=...&function=...
+	http.HandleFunc("GET /api/stats/latency", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		if err := json.NewEncoder(w).Encode(h.getResponseLatencies(q.Get("ski"), q.Get("function"))); err != nil {
+			h.Errorf("encode response latencies: %v", err)
+		}
+	}))
+
+	// endpoint: datagram counts per peer, function and cmdClassifier, chattiest function first (?ski=...)
+	http.HandleFunc("GET /api/stats/messages", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getMessageHistograms(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode message histograms: %v", err)
+		}
+	}))
+
+	// endpoint: drop all datagram counts
+	http.HandleFunc("POST /api/stats/messages/reset", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		h.resetMessageHistograms()
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: captured SPINE datagrams, oldest first
+	// Query: ?ski=...&direction=send|recv&msgCounter=...&reference=...&since=RFC3339&limit=...
+	http.HandleFunc("GET /api/datagrams", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		f := datagramFilter{SKI: q.Get("ski"), Direction: q.Get("direction")}
+		if f.Direction != "" && f.Direction != datagramSent && f.Direction != datagramReceived {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "direction must be send or recv")
+			return
+		}
+		for name, dst := range map[string]**uint64{"msgCounter": &f.MsgCounter, "reference": &f.Reference} {
+			if v := q.Get(name); v != "" {
+				n, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, name+" must be a number")
+					return
+				}
+				*dst = &n
+			}
+		}
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "since must be RFC3339")
+				return
+			}
+			f.Since = t
+		}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "limit must be a positive number")
+				return
+			}
+			f.Limit = n
+		}
+		if err := json.NewEncoder(w).Encode(h.getDatagrams(f)); err != nil {
+			h.Errorf("encode datagrams: %v", err)
+		}
+	}))
+
+	// endpoint: a single captured datagram, the target of the datagramId of events and write results
+	http.HandleFunc("GET /api/datagrams/{id}", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid datagram id")
+			return
+		}
+		dg, ok := h.getDatagram(id)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "datagram not found")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(dg); err != nil {
+			h.Errorf("encode datagram: %v", err)
+		}
+	}))
+
+	// endpoint: SPINE data model validation of the received datagrams (?ski=...): counts per
+	// peer and the datagrams with unknown fields, wrong types or missing mandatory elements
+	http.HandleFunc("GET /api/spine/validation", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getSpineValidation(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode spine validation: %v", err)
+		}
+	}))
+
+	// endpoint: msgCounter statistics per peer of the current connection with the duplicates,
+	// gaps, out-of-order datagrams and repeated identical notifies (?ski=...)
+	http.HandleFunc("GET /api/spine/msgcounters", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getMsgCounterStats(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode msgcounter stats: %v", err)
+		}
+	}))
+
+	// endpoint: connection counts per DUT and the reconnects, newest first, classified as
+	// restart by msgCounter reset, changed device address and missing close (?ski=...)
+	http.HandleFunc("GET /api/restarts", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getRestarts(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode restarts: %v", err)
+		}
+	}))
+
+	// endpoint: SHIP spec violations of the DUTs, newest first (?ski=...&check=hello|pinState|close|frameSize)
+	http.HandleFunc("GET /api/ship/violations", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		if err := json.NewEncoder(w).Encode(h.getShipViolations(q.Get("ski"), q.Get("check"))); err != nil {
+			h.Errorf("encode ship violations: %v", err)
+		}
+	}))
+
+	// endpoint: captured SHIP frames, oldest first, the targets of the frameIds of violations
+	// Query: ?ski=...&ids=1,2&limit=...
+	http.HandleFunc("GET /api/ship/frames", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		var ids []uint64
+		if v := q.Get("ids"); v != "" {
+			for _, s := range strings.Split(v, ",") {
+				id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "ids must be numbers")
+					return
+				}
+				ids = append(ids, id)
+			}
+		}
+		limit := 0
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "limit must be a positive number")
+				return
+			}
+			limit = n
+		}
+		if err := json.NewEncoder(w).Encode(h.getShipFrames(q.Get("ski"), ids, limit)); err != nil {
+			h.Errorf("encode ship frames: %v", err)
+		}
+	}))
+
+	// endpoint: EEBUS services reported by ship-go with appearance and re-announce times
+	http.HandleFunc("GET /api/remote-services", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.remoteServices.list()); err != nil {
+			h.Errorf("encode remote services: %v", err)
+		}
+	}))
+
+	// endpoint: raw mDNS/DNS-SD announcements of SHIP nodes with spec violations (?ski=...)
+	http.HandleFunc("GET /api/mdns", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getMdnsAnnouncements(r.URL.Query().Get("ski"))); err != nil {
+			h.Errorf("encode mdns announcements: %v", err)
+		}
+	}))
+
+	// endpoint: negotiated TLS version, cipher suite, certificate chain and SHIP deviations
+	// of the SHIP server of a DUT (?ski=..., defaults to the remote SKI, &refresh=true probes again)
+	http.HandleFunc("GET /api/connection/tls", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		ski := q.Get("ski")
+		if ski == "" {
+			ski = h.currentRemoteSKI()
+		}
+		if ski == "" {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "ski parameter required")
+			return
+		}
+		info, err := h.getTLSInfo(ski, q.Get("refresh") == "true")
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			h.Errorf("encode tls info: %v", err)
+		}
+	}))
+
+	// endpoint: send an mDNS query for SHIP nodes
+	http.HandleFunc("POST /api/mdns/query", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := h.queryMdns(); err != nil {
+			writeAPIError(w, http.StatusServiceUnavailable, errCodeUnavailable, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: effective network settings and local interfaces
+	http.HandleFunc("GET /api/network", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		info, err := h.getNetworkInfo()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(info)
+	}))
+
+	// endpoint: trust configuration and the loaded SKI allow/deny lists
+	http.HandleFunc("GET /api/trust", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(h.trustStatus())
+	}))
+
+	// endpoint: reload the SKI list file
+	http.HandleFunc("POST /api/trust/reload", h.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if h.config.Trust.SkiListFile == "" {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "no skiListFile configured")
+			return
+		}
+		if _, err := h.loadSkiList(true); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(h.trustStatus())
+	}))
+
+	// endpoint: pairing requests waiting for or decided by the operator
+	http.HandleFunc("GET /api/trust/prompts", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getTrustPrompts()); err != nil {
+			h.Errorf("encode trust prompts: %v", err)
+		}
+	}))
+
+	// endpoint: accept or reject a pending pairing request
+	// Body: {"accept": true|false}
+	http.HandleFunc("POST /api/trust/prompts/{ski}", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var payload struct {
+			Accept *bool `json:"accept"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Accept == nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "accept (bool) required")
+			return
+		}
+
+		user, _ := h.authenticate(r)
+		if err := h.decideTrust(r.PathValue("ski"), *payload.Accept, user.Name); err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: connected websocket clients with their send queue usage
+	http.HandleFunc("GET /api/websockets", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(h.websocketStats())
+	}))
+
+	// endpoint: GraphQL queries over peers, use case data, events, commands, alerts and stats
+	// POST {"query": "...", "variables": {...}, "operationName": "..."} or GET ?query=...&variables=...
+	graphql := h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req graphqlRequest
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(graphqlResponse{Errors: []gqlError{{Message: "invalid request body: " + err.Error()}}})
+				return
+			}
+		} else {
+			q := r.URL.Query()
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(graphqlResponse{Errors: []gqlError{{Message: "variables must be a JSON object"}}})
+					return
+				}
+			}
+		}
+		data, fieldErrors, err := h.executeGraphQL(req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(graphqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+			return
+		}
+		if err := json.NewEncoder(w).Encode(graphqlResponse{Data: data, Errors: fieldErrors}); err != nil {
+			h.Errorf("encode graphql response: %v", err)
+		}
+	})
+	http.HandleFunc("GET /api/graphql", graphql)
+	http.HandleFunc("POST /api/graphql", graphql)
+
+	// endpoint: download a state snapshot, it contains the private key of the tester
+	http.HandleFunc("GET /api/snapshot", h.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		snap, err := h.snapshot()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="device-tester-snapshot.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(snap); err != nil {
+			h.Errorf("encode snapshot: %v", err)
+		}
+	}))
+
+	// endpoint: write a state snapshot to the file given with -snapshot
+	http.HandleFunc("POST /api/snapshot", h.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if h.snapshotPath == "" {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, "no snapshot file configured, start with -snapshot <file>")
+			return
+		}
+		if err := h.saveSnapshot(h.snapshotPath); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "written", "path": h.snapshotPath})
+	}))
+
+	// endpoint: registered devices under test
+	http.HandleFunc("GET /api/duts", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		duts, err := h.getDUTs()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(duts); err != nil {
+			h.Errorf("encode duts: %v", err)
+		}
+	}))
+
+	// endpoint: register a device under test
+	// Body: {"name": "Wallbox lab 1", "vendor": "", "model": "", "firmware": "1.2.3", "ski": "...", "notes": ""}
+	http.HandleFunc("POST /api/duts", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req dutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid request body")
+			return
+		}
+		e, err := h.createDUT(req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+	}))
+
+	// endpoint: a device under test with its charging sessions and stored test runs
+	http.HandleFunc("GET /api/duts/{id}", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		d, err := h.getDUT(r.PathValue("id"))
+		if errors.Is(err, errUnknownDUT) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(d); err != nil {
+			h.Errorf("encode dut: %v", err)
+		}
+	}))
+
+	// endpoint: change a device under test, omitted fields are kept
+	http.HandleFunc("PUT /api/duts/{id}", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req dutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid request body")
+			return
+		}
+		e, err := h.updateDUT(r.PathValue("id"), req)
+		if errors.Is(err, errUnknownDUT) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(e)
+	}))
+
+	// endpoint: remove a device under test and its recorded sessions
+	http.HandleFunc("DELETE /api/duts/{id}", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := h.deleteDUT(r.PathValue("id")); errors.Is(err, errUnknownDUT) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: stored test run results, newest first
+	// Query: ?dut=...&campaign=...&tag=...&operator=...&firmware=...
+	http.HandleFunc("GET /api/testruns", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		runs, err := h.listTestRuns()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		runs = filterTestRuns(runs, testRunFilterFromQuery(r.URL.Query()))
+		if err := json.NewEncoder(w).Encode(runs); err != nil {
+			h.Errorf("encode test runs: %v", err)
+		}
+	}))
+
+	// endpoint: stored test runs grouped by campaign, filtered like /api/testruns
+	http.HandleFunc("GET /api/testruns/campaigns", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		runs, err := h.listTestRuns()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		campaigns := groupTestRunCampaigns(filterTestRuns(runs, testRunFilterFromQuery(r.URL.Query())))
+		if err := json.NewEncoder(w).Encode(campaigns); err != nil {
+			h.Errorf("encode test run campaigns: %v", err)
+		}
+	}))
+
+	// endpoint: compare two stored runs of the same plan
+	// Query: ?base=<id>&target=<id>
+	http.HandleFunc("GET /api/testruns/compare", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := r.URL.Query()
+		var runs [2]*testRunResult
+		for i, name := range []string{"base", "target"} {
+			res, err := h.loadTestRun(q.Get(name))
+			if err != nil {
+				status, code := http.StatusBadRequest, errCodeInvalidRequest
+				if errors.Is(err, os.ErrNotExist) {
+					status, code = http.StatusNotFound, errCodeNotFound
+				}
+				writeAPIError(w, status, code, name+": "+err.Error())
+				return
+			}
+			runs[i] = res
+		}
+		cmp, err := compareTestRuns(runs[0], runs[1], h.config.TestRuns)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(cmp); err != nil {
+			h.Errorf("encode test run comparison: %v", err)
+		}
+	}))
+
+	// endpoint: test protocol of the stored runs of a DUT for certification documents
+	// Query: ?ids=a,b or ?ski=...&plan=...&since=RFC3339&campaign=...&tag=..., &format=json|csv&operator=...&laboratory=...&anonymize=true
+	http.HandleFunc("GET /api/testruns/protocol", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		anon, err := h.requestAnonymizer(q)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		f := testProtocolFilter{SKI: q.Get("ski"), Plan: q.Get("plan"), Campaign: q.Get("campaign"), Tag: q.Get("tag")}
+		if ids := q.Get("ids"); ids != "" {
+			f.IDs = strings.Split(ids, ",")
+		}
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "since must be RFC3339")
+				return
+			}
+			f.Since = t
+		}
+		p, err := h.buildTestProtocol(f, q.Get("operator"), q.Get("laboratory"))
+		if err != nil {
+			status, code := http.StatusBadRequest, errCodeInvalidRequest
+			if errors.Is(err, os.ErrNotExist) {
+				status, code = http.StatusNotFound, errCodeNotFound
+			}
+			writeAPIError(w, status, code, err.Error())
+			return
+		}
+		if p.Operator == "" && h.config.Auth.Enabled {
+			// no operator was stored with the runs
+			user, _ := h.authenticate(r)
+			p.Operator = user.Name
+		}
+		if anon != nil {
+			// the CSV has no field names the identifying values could be learned from
+			anon.addKnown("serial", p.Device.Serial)
+			anon.addKnown("id", p.Device.Identifier)
+		}
+		filename := fmt.Sprintf("test-protocol-%s", time.Now().Format("20060102-150405"))
+		out := anon.wrap(w)
+		switch q.Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename+".json")
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(p); err != nil {
+				h.Errorf("encode test protocol: %v", err)
+			}
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+			if err := writeTestProtocolCSV(out, p); err != nil {
+				h.Errorf("export test protocol csv: %v", err)
+			}
+		default:
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "format must be json or csv")
+			return
+		}
+		if err := out.Close(); err != nil {
+			h.Errorf("write test protocol: %v", err)
+		}
+	}))
+
+	// endpoint: a single stored test run
+	http.HandleFunc("GET /api/testruns/{id}", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		res, err := h.loadTestRun(r.PathValue("id"))
+		if err != nil {
+			status, code := http.StatusBadRequest, errCodeInvalidRequest
+			if errors.Is(err, os.ErrNotExist) {
+				status, code = http.StatusNotFound, errCodeNotFound
 			}
-			_, _ = w.Write([]byte("ok"))
+			writeAPIError(w, status, code, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			h.Errorf("encode test run: %v", err)
+		}
+	}))
+
+	// endpoint: run a test script, see script.go for the syntax
+	// Body: {"name": "lpc-scenario3", "ski": "...", "script": "...", "timeoutSeconds": 600}
+	http.HandleFunc("POST /api/scripts/run", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req scriptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid request body")
+			return
+		}
+		meta, err := h.newTestRunMetadata(r, req.Metadata)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		req.Metadata = meta
+		run, err := h.startScript(req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 			return
-		default:
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("unknown command"))
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: state, log and assertions of the current or last script run
+	http.HandleFunc("GET /api/scripts/run", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getScript()); err != nil {
+			h.Errorf("encode script run: %v", err)
+		}
+	}))
+
+	// endpoint: abort the running script
+	http.HandleFunc("POST /api/scripts/stop", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !h.stopScript() {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, "no script is running")
 			return
 		}
-	})
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopping"})
+	}))
+
+	// endpoint: compiled-in extensions with their setup state and routes
+	http.HandleFunc("GET /api/extensions", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(getExtensions()); err != nil {
+			h.Errorf("encode extensions: %v", err)
+		}
+	}))
+
+	// endpoint: list limit writes that required an approval (CS mode)
+	http.HandleFunc("GET /api/approvals", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getApprovals()); err != nil {
+			h.Errorf("encode approvals: %v", err)
+		}
+	}))
+
+	// endpoint: accept or reject a pending limit write
+	// Body: {"approve": true|false, "reason": "optional"}
+	http.HandleFunc("POST /api/approvals/{id}", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		var payload struct {
+			Approve *bool  `json:"approve"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Approve == nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "approve (bool) required")
+			return
+		}
+
+		user, _ := h.authenticate(r)
+		if err := h.decideApproval(r.PathValue("id"), *payload.Approve, payload.Reason, user.Name); err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}))
+
+	// endpoint: state of the virtual EV in simulator mode
+	http.HandleFunc("GET /api/simulator", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		state, err := h.getSimulator()
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			h.Errorf("encode simulator: %v", err)
+		}
+	}))
+
+	// endpoint: change the virtual EV, see SimulatorUpdate for the fields
+	// Body: {"plug": true, "chargeState": "active", "communicationStandard": "iso15118-2ed1", "soc": 40, "currents": [16, 16, 16], "evseState": "normalOperation"}
+	http.HandleFunc("POST /api/simulator/ev", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var u SimulatorUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid request body")
+			return
+		}
+		h.writeSimulatorUpdate(w, u)
+	}))
+
+	// endpoint: plug the virtual EV in
+	http.HandleFunc("POST /api/simulator/plug", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		plug := true
+		h.writeSimulatorUpdate(w, SimulatorUpdate{Plug: &plug})
+	}))
+
+	// endpoint: unplug the virtual EV
+	http.HandleFunc("POST /api/simulator/unplug", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		plug := false
+		h.writeSimulatorUpdate(w, SimulatorUpdate{Plug: &plug})
+	}))
+
+	// endpoint: configured drive-cycle profiles of the simulator
+	http.HandleFunc("GET /api/simulator/profiles", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		profiles, err := h.getSimulatorProfiles()
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(profiles); err != nil {
+			h.Errorf("encode simulator profiles: %v", err)
+		}
+	}))
+
+	// endpoint: run a configured profile or the given steps, a running profile is stopped
+	// Body: {"name": "commute"} or {"steps": [{"plug": true}, {"afterSeconds": 60, "chargeState": "paused"}]}
+	http.HandleFunc("POST /api/simulator/profile/run", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var req simulatorProfileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid request body")
+			return
+		}
+		run, err := h.startSimulatorProfile(req)
+		if errors.Is(err, errSimulatorDisabled) {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	}))
+
+	// endpoint: stop the running simulator profile, the EV keeps its current state
+	http.HandleFunc("POST /api/simulator/profile/stop", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !h.stopSimulatorProfile() {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, "no simulator profile is running")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopping"})
+	}))
 
 	// endpoint: return usecaseData (current values) in JSON-friendly units
 	// Updated to support ski parameter for specific peer
-	http.HandleFunc("/api/usecasedata", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/usecasedata", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 		ski := r.URL.Query().Get("ski")
@@ -2096,7 +3995,8 @@ func (h *hems) startWebInterface() {
 					} else {
 						base = make(map[string]interface{})
 					}
-					base["usecaseSupport"] = peer.usecaseState
+					base["usecaseSupport"] = h.usecaseSupportOf(peer)
+					base["usecaseEntities"] = peer.usecases.list()
 					if err := json.NewEncoder(w).Encode(base); err != nil {
 						h.Errorf("encode usecasedata: %v", err)
 					}
@@ -2114,17 +4014,16 @@ func (h *hems) startWebInterface() {
 
 		peer := h.getPeer(ski)
 		if peer == nil {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "peer not found"})
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "peer not found")
 			return
 		}
 
 		if err := json.NewEncoder(w).Encode(peer.usecaseData); err != nil {
 			h.Errorf("encode usecasedata: %v", err)
 		}
-	})
+	}))
 
-	http.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/logs", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		logs := h.getLogs()
 		type Resp struct {
@@ -2134,82 +4033,339 @@ func (h *hems) startWebInterface() {
 		if err := json.NewEncoder(w).Encode(enc); err != nil {
 			h.Errorf("encode logs: %v", err)
 		}
-	})
+	}))
 
 	// new endpoint: return usecase support state
-	http.HandleFunc("/api/usecases", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/usecases", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		ucMu.Lock()
-		defer ucMu.Unlock()
 		type UC struct {
 			Name      string `json:"name"`
 			Supported bool   `json:"supported"`
 		}
+		// a use case is supported if any entity of any peer supports it, see
+		// /api/devices/{ski}/usecases for the support per entity
+		supported := make(map[string]bool)
+		for _, peer := range h.getAllPeers() {
+			for name, ok := range h.usecaseSupportOf(peer) {
+				supported[name] = supported[name] || ok
+			}
+		}
 		var out []UC
-		for name, supported := range h.globalUseCaseState {
-			out = append(out, UC{Name: name, Supported: supported})
+		for _, name := range h.trackedUsecaseNames() {
+			out = append(out, UC{Name: name, Supported: supported[name]})
 		}
 		if err := json.NewEncoder(w).Encode(out); err != nil {
 			h.Errorf("encode usecases: %v", err)
 		}
-	})
+	}))
+
+	// endpoint: use case support of a peer per remote entity, with detection and withdrawal times
+	http.HandleFunc("GET /api/devices/{ski}/usecases", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		peer := h.getPeer(r.PathValue("ski"))
+		if peer == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "unknown peer")
+			return
+		}
+		out := map[string]interface{}{
+			"ski":          peer.ski,
+			"supported":    h.usecaseSupportOf(peer),
+			"entities":     peer.usecases.list(),
+			"declarations": peer.usecases.declarations(),
+		}
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			h.Errorf("encode device usecases: %v", err)
+		}
+	}))
+
+	// endpoint: check the declared use case scenarios against the server features and functions of the entities
+	http.HandleFunc("GET /api/devices/{ski}/usecases/validation", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		peer := h.getPeer(r.PathValue("ski"))
+		if peer == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "unknown peer")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(h.validateUsecaseFeatures(peer)); err != nil {
+			h.Errorf("encode usecase validation: %v", err)
+		}
+	}))
+
+	// endpoint: actively read the LPC limit, nominal max and failsafe values from the DUT (?ski=...)
+	http.HandleFunc("GET /api/usecases/lpc/read", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		readings, err := h.readLPC(r.URL.Query().Get("ski"))
+		if err != nil {
+			status, code := http.StatusServiceUnavailable, errCodeUnavailable
+			if errors.Is(err, errNoEntity) {
+				status, code = http.StatusNotFound, errCodeNotFound
+			}
+			writeAPIError(w, status, code, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(readings); err != nil {
+			h.Errorf("encode LPC readings: %v", err)
+		}
+	}))
+
+	// endpoint: actively re-read the EVCC data of the connected EV (?ski=...)
+	http.HandleFunc("GET /api/usecases/evcc/read", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		readings, err := h.readEVCC(r.URL.Query().Get("ski"))
+		if err != nil {
+			status, code := http.StatusServiceUnavailable, errCodeUnavailable
+			if errors.Is(err, errNoEntity) {
+				status, code = http.StatusNotFound, errCodeNotFound
+			}
+			writeAPIError(w, status, code, err.Error())
+			return
+		}
+		if err := json.NewEncoder(w).Encode(readings); err != nil {
+			h.Errorf("encode EVCC readings: %v", err)
+		}
+	}))
+
+	// endpoint: CEVC tariff sent to EVs (incentive table and power limits)
+	http.HandleFunc("GET /api/usecases/cevc/tariff", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getTariff()); err != nil {
+			h.Errorf("encode tariff: %v", err)
+		}
+	}))
+
+	// endpoint: replace the CEVC tariff and publish it to the EVs (?ski=... for one peer)
+	http.HandleFunc("PUT /api/usecases/cevc/tariff", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		var t cevcTariff
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		status, err := h.setTariff(&t, r.URL.Query().Get("ski"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			h.Errorf("encode tariff: %v", err)
+		}
+	}))
+
+	// endpoint: restore the eebus-go default tariff and publish it to the EVs (?ski=...)
+	http.HandleFunc("DELETE /api/usecases/cevc/tariff", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		status, err := h.setTariff(nil, r.URL.Query().Get("ski"))
+		if err != nil {
+			writeAPIError(w, http.StatusServiceUnavailable, errCodeUnavailable, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			h.Errorf("encode tariff: %v", err)
+		}
+	}))
+
+	// endpoint: CEVC charge plans as slot lists with the sent power limits and incentives
+	// Query: ?ski=... returns the plan of one peer
+	http.HandleFunc("GET /api/usecases/cevc/plan", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		var out interface{} = h.getChargePlans()
+		if ski := r.URL.Query().Get("ski"); ski != "" {
+			plan := h.getChargePlan(ski)
+			if plan == nil {
+				writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no charge plan received from this peer")
+				return
+			}
+			out = plan
+		}
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			h.Errorf("encode charge plans: %v", err)
+		}
+	}))
+
+	// endpoint: local device type and entities with the use cases attached to them
+	http.HandleFunc("GET /api/local/entities", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getLocalDevice()); err != nil {
+			h.Errorf("encode local entities: %v", err)
+		}
+	}))
+
+	// endpoint: state of the heartbeat the tester sends to the DUT
+	http.HandleFunc("GET /api/heartbeat/local", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.heartbeat.get()); err != nil {
+			h.Errorf("encode local heartbeat: %v", err)
+		}
+	}))
+
+	// endpoint: actively read the DeviceDiagnosis state and heartbeat of all entities (?ski=...)
+	http.HandleFunc("GET /api/device/diagnosis", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		readings, err := h.readDiagnosis(r.URL.Query().Get("ski"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no remote entity with a DeviceDiagnosis server")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(readings); err != nil {
+			h.Errorf("encode diagnosis readings: %v", err)
+		}
+	}))
+
+	// endpoint: actively read the ElectricalConnection descriptions, parameter descriptions,
+	// characteristics and permitted value sets of all entities (?ski=...)
+	http.HandleFunc("GET /api/device/electrical-connection", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		dumps, err := h.readElectricalConnection(r.URL.Query().Get("ski"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no remote entity with an ElectricalConnection server")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(dumps); err != nil {
+			h.Errorf("encode electrical connection data: %v", err)
+		}
+	}))
+
+	// endpoint: actively read the Measurement descriptions and constraints of all entities (?ski=...)
+	http.HandleFunc("GET /api/device/measurements", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		dumps, err := h.readMeasurements(r.URL.Query().Get("ski"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no remote entity with a Measurement server")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(dumps); err != nil {
+			h.Errorf("encode measurement descriptions: %v", err)
+		}
+	}))
+
+	// endpoint: actively read the LoadControl limit descriptions of all entities and the limits
+	// the LPC, LPP, OPEV and OSCEV writes address (?ski=...)
+	http.HandleFunc("GET /api/device/loadcontrol", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		dumps, err := h.readLoadControl(r.URL.Query().Get("ski"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "no remote entity with a LoadControl server")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(dumps); err != nil {
+			h.Errorf("encode load control descriptions: %v", err)
+		}
+	}))
 
 	// new endpoint: return entities for a specific peer
-	http.HandleFunc("/api/entities", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/entities", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 		ski := r.URL.Query().Get("ski")
 		if ski == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "ski parameter required"})
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "ski parameter required")
 			return
 		}
 
 		peer := h.getPeer(ski)
-		if peer == nil || peer.lastEntitiesJSON == nil {
+		if peer == nil {
 			// return empty array
 			_, _ = w.Write([]byte("[]"))
 			return
 		}
+		snap := peer.entities.snapshot()
+		if snap.JSON == nil {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
 
-		_, _ = w.Write(peer.lastEntitiesJSON)
-	})
+		// the version allows clients to skip unchanged entity lists
+		etag := fmt.Sprintf(`"%d"`, snap.Version)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Entities-Version", strconv.FormatUint(snap.Version, 10))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(snap.JSON)
+	}))
+
+	// endpoint: export the remote device/entity/feature tree of a peer
+	// Query: ?ski=...&format=dot|svg&functions=true
+	http.HandleFunc("GET /api/topology", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ski := q.Get("ski")
+		peer := h.getPeer(ski)
+		if ski == "" || peer == nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "ski of a known peer required")
+			return
+		}
+
+		root := buildTopology(ski, peer.entities.snapshot().Entities, q.Get("functions") == "true")
+		switch q.Get("format") {
+		case "", "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", ski+".dot"))
+			_, _ = w.Write(topologyDOT(root))
+		case "svg":
+			out, err := topologySVG(root)
+			if err != nil {
+				h.Errorf("render topology: %v", err)
+				writeAPIError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "image/svg+xml")
+			_, _ = w.Write(out)
+		default:
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "format must be dot or svg")
+		}
+	}))
 
 	// new endpoint: return all discovered peers
-	http.HandleFunc("/api/peers", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/peers", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-		h.peersMu.Lock()
-		peers := make([]PeerInfo, 0, len(h.peers))
-		for ski, peer := range h.peers {
-			info := PeerInfo{
-				SKI:        ski,
-				Connected:  peer.connected,
-				LastSeen:   peer.lastSeen,
-				Usecases:   make(map[string]bool),
-				DeviceName: peer.deviceName,
-				Brand:      peer.brand,
-				Model:      peer.model,
-				DeviceType: peer.deviceType,
-				Serial:     peer.serial,
-				Identifier: peer.identifier,
-			}
-			for uc, supported := range peer.usecaseState {
-				info.Usecases[uc] = supported
-			}
-			peers = append(peers, info)
+		if err := json.NewEncoder(w).Encode(h.peerInfos()); err != nil {
+			h.Errorf("encode peers: %v", err)
 		}
-		h.peersMu.Unlock()
+	}))
 
-		if err := json.NewEncoder(w).Encode(peers); err != nil {
-			h.Errorf("encode peers: %v", err)
+	// endpoint: current pairing state and ConnectionStateDetail transitions of a SKI
+	http.HandleFunc("GET /api/peers/{ski}/pairing", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(h.getPairing(r.PathValue("ski")))
+	}))
+
+	// endpoint: unregister a SKI and forget its trust
+	http.HandleFunc("POST /api/peers/{ski}/unpair", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ski := r.PathValue("ski")
+		h.unpairSKI(ski)
+		json.NewEncoder(w).Encode(h.getPairing(ski))
+	}))
+
+	// endpoint: trust a SKI and initiate pairing
+	http.HandleFunc("POST /api/peers/{ski}/pair", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ski := r.PathValue("ski")
+		if err := h.pairSKI(ski); err != nil {
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, err.Error())
+			return
 		}
-	})
+		json.NewEncoder(w).Encode(h.getPairing(ski))
+	}))
+
+	// endpoint: unpair and pair a SKI again, e.g. after a DUT factory reset
+	http.HandleFunc("POST /api/peers/{ski}/repair", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ski := r.PathValue("ski")
+		if err := h.repairSKI(ski); err != nil {
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(h.getPairing(ski))
+	}))
 
 	// new endpoint: connect to a discovered peer
-	http.HandleFunc("/api/connect", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/connect", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
 			return
 		}
 
@@ -2217,32 +4373,217 @@ func (h *hems) startWebInterface() {
 			SKI string `json:"ski"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "invalid json"})
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
 			return
 		}
 
 		if payload.SKI == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "ski parameter required"})
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "ski parameter required")
 			return
 		}
 
 		// Register the remote SKI to initiate connection
-		h.myService.RegisterRemoteSKI(payload.SKI, "")
+		if err := h.pairSKI(payload.SKI); err != nil {
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, err.Error())
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		json.NewEncoder(w).Encode(map[string]string{"status": "connecting", "ski": payload.SKI})
-	})
+	}))
+
+	// endpoint: current remote SKI (device under test) and its changes
+	http.HandleFunc("GET /api/remote-ski", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.getRemoteSKI()); err != nil {
+			h.Errorf("encode remote ski: %v", err)
+		}
+	}))
+
+	// endpoint: switch the device under test, unpairs the current SKI and pairs the new one.
+	// Collected data of the previous SKI is kept.
+	http.HandleFunc("PUT /api/remote-ski", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			SKI string `json:"ski"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		if payload.SKI == "" {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "ski parameter required")
+			return
+		}
+		user, _ := h.authenticate(r)
+		change, err := h.switchRemoteSKI(payload.SKI, user.Name)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(change); err != nil {
+			h.Errorf("encode remote ski change: %v", err)
+		}
+	}))
+
+	// endpoint: configured behavior profile and dimming state
+	http.HandleFunc("GET /api/behavior-profile", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(h.behaviorProfileStatus()); err != nil {
+			h.Errorf("encode behavior profile: %v", err)
+		}
+	}))
+
+	// endpoint: start or end dimming to the limit of the behavior profile, {"active": true}
+	http.HandleFunc("POST /api/behavior-profile/dim", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Active bool `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		user, _ := h.authenticate(r)
+		commands, err := h.setDimming(req.Active, user.Name)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+			return
+		}
+		h.writeCommandsResponse(w, r, commands)
+	}))
 
 	// new endpoint: return config to frontend
-	http.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/config", h.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if err := json.NewEncoder(w).Encode(h.config); err != nil {
+		if err := json.NewEncoder(w).Encode(h.config.redacted()); err != nil {
 			h.Errorf("encode config: %v", err)
 		}
+	}))
+
+	// endpoint: return the authenticated user and its role
+	http.HandleFunc("/api/auth/me", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		user, _ := h.authenticate(r)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":        user.Name,
+			"role":        user.Role,
+			"authEnabled": h.config.Auth.Enabled,
+		}); err != nil {
+			h.Errorf("encode auth user: %v", err)
+		}
+	}))
+
+	// endpoint: login methods for clients that are not logged in yet, no authentication
+	http.HandleFunc("GET /api/auth/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		resp := map[string]interface{}{"authEnabled": h.config.Auth.Enabled, "oidc": h.oidc != nil}
+		if h.oidc != nil {
+			resp["loginUrl"] = "/api/auth/oidc/login"
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			h.Errorf("encode auth config: %v", err)
+		}
+	})
+
+	// endpoint: start the OIDC login, redirects to the IdP
+	// Query: ?redirect=/local/path to return to after the login
+	http.HandleFunc("GET /api/auth/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		if h.oidc == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "oidc login not configured")
+			return
+		}
+		target, err := h.oidc.loginURL(r.URL.Query().Get("redirect"))
+		if err != nil {
+			h.Errorf("oidc login: %v", err)
+			writeAPIError(w, http.StatusBadGateway, errCodeUnavailable, err.Error())
+			return
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+
+	// endpoint: OIDC redirect URL, issues an API token and returns to the UI with
+	// the token in the URL fragment
+	http.HandleFunc("GET /api/auth/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		if h.oidc == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "oidc login not configured")
+			return
+		}
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, "login failed: "+e+" "+q.Get("error_description"))
+			return
+		}
+		token, t, redirect, err := h.oidc.callback(q.Get("state"), q.Get("code"))
+		if err != nil {
+			h.Infof("oidc login failed: %v", err)
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, err.Error())
+			return
+		}
+		h.Infof("oidc login of %s (%s)", t.user.Name, t.user.Role)
+		// the fragment is not sent to servers, so the token does not end up in access logs
+		http.Redirect(w, r, localRedirect(redirect)+"#token="+url.QueryEscape(token), http.StatusFound)
 	})
 
+	// endpoint: derive an additional API token from an OIDC login, e.g. for scripts, it
+	// expires with the login at the latest and is revoked on its logout
+	// Body: {"name": "ci", "ttlSeconds": 86400}
+	http.HandleFunc("POST /api/auth/tokens", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if h.oidc == nil {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "oidc login not configured")
+			return
+		}
+		var req struct {
+			Name       string `json:"name"`
+			TTLSeconds int    `json:"ttlSeconds"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, err.Error())
+				return
+			}
+		}
+		if req.TTLSeconds < 0 {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "ttlSeconds must not be negative")
+			return
+		}
+		ttl := h.oidc.cfg.tokenTTL()
+		if req.TTLSeconds > 0 {
+			ttl = min(time.Duration(req.TTLSeconds)*time.Second, maxOIDCTokenTTL)
+		}
+		if req.Name == "" {
+			req.Name = "api"
+		}
+		token, t, err := h.oidc.derive(requestToken(r), req.Name, ttl)
+		if err != nil {
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, err.Error())
+			return
+		}
+		h.Infof("api token %q issued for %s until %s", t.name, t.user.Name, formatTimestamp(t.expires))
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":     token,
+			"name":      t.name,
+			"user":      t.user.Name,
+			"role":      t.user.Role,
+			"expiresAt": t.expires,
+		}); err != nil {
+			h.Errorf("encode api token: %v", err)
+		}
+	}))
+
+	// endpoint: revoke the API token of the request issued by an OIDC login and the tokens
+	// derived from it
+	http.HandleFunc("POST /api/auth/logout", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !h.oidc.revoke(requestToken(r)) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, "only tokens of an oidc login can be revoked")
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
+			h.Errorf("encode logout: %v", err)
+		}
+	}))
+
 	// Serve static /web assets from disk on every request with no-cache headers.
 	fsDir := filepath.Join(exePath, "web")
 	http.HandleFunc("/web/", func(w http.ResponseWriter, r *http.Request) {
@@ -2301,7 +4642,7 @@ func (h *hems) startWebInterface() {
 
 	addr := fmt.Sprintf("%s:%d", webAddr, webPort)
 	h.Infof("Starting web interface on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := http.ListenAndServe(addr, h.limitRequests(http.DefaultServeMux)); err != nil {
 		h.Errorf("web interface stopped: %v", err)
 	}
 }
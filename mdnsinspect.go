@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// shipServiceName is the DNS-SD service type of SHIP nodes (SHIP 7.3)
+const shipServiceName = "_ship._tcp.local."
+
+// mandatoryTxtKeys must be present in every SHIP TXT record (SHIP 7.3.2)
+var mandatoryTxtKeys = []string{"txtvers", "id", "path", "ski", "register"}
+
+// knownTxtKeys are the TXT keys defined by SHIP 7.3.2
+var knownTxtKeys = map[string]bool{
+	"txtvers": true, "id": true, "path": true, "ski": true, "register": true,
+	"brand": true, "type": true, "model": true, "serial": true, "cat": true,
+}
+
+var skiPattern = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// mdnsAnnouncement is the raw DNS-SD announcement of a SHIP node as seen on the network
+type mdnsAnnouncement struct {
+	Instance   string            `json:"instance"`
+	Host       string            `json:"host,omitempty"`
+	Port       uint16            `json:"port,omitempty"`
+	Addresses  []string          `json:"addresses,omitempty"`
+	Source     string            `json:"source"`
+	TXT        []string          `json:"txt"`
+	Records    map[string]string `json:"records"`
+	SKI        string            `json:"ski,omitempty"`
+	TTL        uint32            `json:"ttl"`
+	FirstSeen  time.Time         `json:"firstSeen"`
+	LastSeen   time.Time         `json:"lastSeen"`
+	Removed    bool              `json:"removed"`
+	Violations []string          `json:"violations"`
+}
+
+// mdnsInspector listens to the mDNS traffic of SHIP nodes independently of ship-go,
+// which drops announcements with invalid TXT records silently
+type mdnsInspector struct {
+	mu      sync.Mutex
+	conns   []*net.UDPConn
+	entries map[string]*mdnsAnnouncement
+	// hosts maps SRV target hosts to their addresses
+	hosts map[string]map[string]bool
+}
+
+func newMdnsInspector() *mdnsInspector {
+	return &mdnsInspector{
+		entries: make(map[string]*mdnsAnnouncement),
+		hosts:   make(map[string]map[string]bool),
+	}
+}
+
+// startMdnsInspector joins the mDNS multicast groups on the configured interfaces and sends an initial query
+func (h *hems) startMdnsInspector() {
+	groups := []struct{ network, addr string }{
+		{"udp4", "224.0.0.251:5353"},
+	}
+	if !h.config.Network.DisableIPv6 {
+		groups = append(groups, struct{ network, addr string }{"udp6", "[ff02::fb]:5353"})
+	}
+	ifaces, err := h.config.Network.interfaces()
+	if err != nil {
+		h.Errorf("mdns inspector: %v", err)
+		return
+	}
+	if ifaces == nil {
+		// listen on the default multicast interface
+		ifaces = []net.Interface{{}}
+	}
+
+	for _, iface := range ifaces {
+		var ifi *net.Interface
+		if iface.Name != "" {
+			ifi = &iface
+		}
+		for _, g := range groups {
+			addr, err := net.ResolveUDPAddr(g.network, g.addr)
+			if err != nil {
+				continue
+			}
+			conn, err := net.ListenMulticastUDP(g.network, ifi, addr)
+			if err != nil {
+				h.Debugf("mdns inspector: listen %s on %q: %v", g.addr, iface.Name, err)
+				continue
+			}
+			h.mdns.mu.Lock()
+			h.mdns.conns = append(h.mdns.conns, conn)
+			h.mdns.mu.Unlock()
+			go h.readMdns(conn)
+		}
+	}
+	h.queryMdns()
+}
+
+func (h *hems) readMdns(conn *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			h.Debugf("mdns inspector: read: %v", err)
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Header.Response {
+			continue
+		}
+		h.processMdnsMessage(msg, src.IP.String())
+	}
+}
+
+// queryMdns asks all SHIP nodes to announce themselves, the answers are sent to the multicast group
+func (h *hems) queryMdns() error {
+	name, err := dnsmessage.NewName(shipServiceName)
+	if err != nil {
+		return err
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	h.mdns.mu.Lock()
+	conns := append([]*net.UDPConn(nil), h.mdns.conns...)
+	h.mdns.mu.Unlock()
+	if len(conns) == 0 {
+		return fmt.Errorf("mdns inspector not listening")
+	}
+
+	var sent bool
+	for _, conn := range conns {
+		group := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+		if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+			group = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+		}
+		if _, err := conn.WriteToUDP(b, group); err != nil {
+			h.Debugf("mdns inspector: query %s: %v", group, err)
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return fmt.Errorf("mdns query could not be sent")
+	}
+	return nil
+}
+
+func isShipInstance(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), "."+shipServiceName)
+}
+
+// processMdnsMessage updates the announcements with the records of a response
+func (h *hems) processMdnsMessage(msg dnsmessage.Message, source string) {
+	now := time.Now()
+	records := append(msg.Answers, msg.Additionals...)
+
+	h.mdns.mu.Lock()
+	changed := make(map[string]*mdnsAnnouncement)
+	entry := func(instance string) *mdnsAnnouncement {
+		key := strings.ToLower(instance)
+		e, ok := h.mdns.entries[key]
+		if !ok {
+			e = &mdnsAnnouncement{Instance: instance, FirstSeen: now, Records: map[string]string{}}
+			h.mdns.entries[key] = e
+		}
+		e.Source = source
+		e.LastSeen = now
+		changed[key] = e
+		return e
+	}
+
+	// addresses first, SRV targets may reference them in the same message
+	for _, r := range records {
+		host := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.AResource:
+			h.mdns.addHost(host, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			h.mdns.addHost(host, net.IP(body.AAAA[:]).String())
+		}
+	}
+
+	for _, r := range records {
+		name := r.Header.Name.String()
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if !strings.EqualFold(name, shipServiceName) {
+				continue
+			}
+			e := entry(body.PTR.String())
+			e.TTL = r.Header.TTL
+			e.Removed = r.Header.TTL == 0
+		case *dnsmessage.SRVResource:
+			if !isShipInstance(name) {
+				continue
+			}
+			e := entry(name)
+			e.Host = body.Target.String()
+			e.Port = body.Port
+		case *dnsmessage.TXTResource:
+			if !isShipInstance(name) {
+				continue
+			}
+			e := entry(name)
+			e.TXT = append([]string(nil), body.TXT...)
+		}
+	}
+
+	type violationChange struct {
+		ski, instance string
+		violations    []string
+	}
+	var changes []violationChange
+	for _, e := range changed {
+		if e.Host != "" {
+			e.Addresses = h.mdns.hostAddresses(e.Host)
+		}
+		previous := strings.Join(e.Violations, "\n")
+		e.Records, e.Violations = validateShipTxt(e.TXT)
+		if e.Host == "" {
+			e.Violations = append(e.Violations, "no SRV record")
+		}
+		e.SKI = strings.ToLower(e.Records["ski"])
+		if strings.Join(e.Violations, "\n") != previous && len(e.Violations) > 0 {
+			changes = append(changes, violationChange{ski: e.SKI, instance: e.Instance, violations: append([]string(nil), e.Violations...)})
+		}
+	}
+	h.mdns.mu.Unlock()
+
+	for _, c := range changes {
+		h.recordEvent("mdns", severityWarning, c.ski, fmt.Sprintf("mDNS announcement of %s violates SHIP 7.3: %s", c.instance, strings.Join(c.violations, "; ")),
+			map[string]interface{}{"instance": c.instance, "violations": c.violations})
+	}
+}
+
+func (m *mdnsInspector) addHost(host, addr string) {
+	if m.hosts[host] == nil {
+		m.hosts[host] = make(map[string]bool)
+	}
+	m.hosts[host][addr] = true
+}
+
+func (m *mdnsInspector) hostAddresses(host string) []string {
+	var out []string
+	for addr := range m.hosts[strings.ToLower(host)] {
+		out = append(out, addr)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// validateShipTxt parses TXT strings into key/value records and lists the SHIP 7.3.2 violations
+func validateShipTxt(txt []string) (map[string]string, []string) {
+	records := make(map[string]string)
+	violations := []string{}
+	if len(txt) == 0 || (len(txt) == 1 && txt[0] == "") {
+		return records, append(violations, "no TXT record")
+	}
+
+	for _, item := range txt {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			violations = append(violations, fmt.Sprintf("TXT entry %q is not a key=value pair", item))
+			continue
+		}
+		if key != strings.ToLower(key) {
+			violations = append(violations, fmt.Sprintf("TXT key %q is not lower case", key))
+			key = strings.ToLower(key)
+		}
+		if _, dup := records[key]; dup {
+			violations = append(violations, fmt.Sprintf("duplicate TXT key %q", key))
+		}
+		if !knownTxtKeys[key] {
+			violations = append(violations, fmt.Sprintf("unknown TXT key %q", key))
+		}
+		records[key] = value
+	}
+
+	for _, key := range mandatoryTxtKeys {
+		if _, ok := records[key]; !ok {
+			violations = append(violations, fmt.Sprintf("missing mandatory TXT key %q", key))
+		}
+	}
+	if v, ok := records["txtvers"]; ok && v != "1" {
+		violations = append(violations, fmt.Sprintf("txtvers is %q, expected \"1\"", v))
+	}
+	if v, ok := records["ski"]; ok && !skiPattern.MatchString(v) {
+		violations = append(violations, fmt.Sprintf("ski %q is not 40 hex characters", v))
+	}
+	if v, ok := records["register"]; ok && v != "true" && v != "false" {
+		violations = append(violations, fmt.Sprintf("register %q is not a text boolean", v))
+	}
+	if v, ok := records["path"]; ok && !strings.HasPrefix(v, "/") {
+		violations = append(violations, fmt.Sprintf("path %q does not start with /", v))
+	}
+	if v, ok := records["id"]; ok && v == "" {
+		violations = append(violations, "id is empty")
+	}
+	if v, ok := records["cat"]; ok {
+		for _, c := range strings.Split(v, ",") {
+			if c == "" || strings.Trim(c, "0123456789") != "" {
+				violations = append(violations, fmt.Sprintf("cat %q is not a comma separated list of numbers", v))
+				break
+			}
+		}
+	}
+	return records, violations
+}
+
+// getMdnsAnnouncements returns the seen SHIP announcements, optionally only the ones of a SKI
+func (h *hems) getMdnsAnnouncements(ski string) []mdnsAnnouncement {
+	h.mdns.mu.Lock()
+	defer h.mdns.mu.Unlock()
+
+	out := make([]mdnsAnnouncement, 0, len(h.mdns.entries))
+	for _, e := range h.mdns.entries {
+		if ski != "" && !strings.EqualFold(e.SKI, ski) {
+			continue
+		}
+		c := *e
+		c.TXT = append([]string(nil), e.TXT...)
+		c.Violations = append([]string(nil), e.Violations...)
+		records := make(map[string]string, len(e.Records))
+		for k, v := range e.Records {
+			records[k] = v
+		}
+		c.Records = records
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Instance < out[j].Instance })
+	return out
+}
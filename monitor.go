@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MonitorConfig configures the continuous monitoring mode for field trials
+type MonitorConfig struct {
+	// Enabled starts monitoring at startup
+	Enabled bool `json:"enabled,omitempty"`
+	// ReportIntervalHours is the report period, defaults to 24. Periods dividing a day
+	// start at local midnight.
+	ReportIntervalHours float64 `json:"reportIntervalHours,omitempty"`
+	// SampleSeconds is the interval connections are sampled and captured data is
+	// written, defaults to 60
+	SampleSeconds int `json:"sampleSeconds,omitempty"`
+	// Dir is the directory of the report and capture files, defaults to "monitor"
+	Dir string `json:"dir,omitempty"`
+	// KeepReports is the number of periods whose files are kept, defaults to 14
+	KeepReports int `json:"keepReports,omitempty"`
+	// CaptureData writes the events and SPINE datagrams of each period next to the
+	// report, defaults to true
+	CaptureData *bool `json:"captureData,omitempty"`
+}
+
+func (c MonitorConfig) interval() time.Duration {
+	if c.ReportIntervalHours <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.ReportIntervalHours * float64(time.Hour))
+}
+
+func (c MonitorConfig) sampleInterval() time.Duration {
+	if c.SampleSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.SampleSeconds) * time.Second
+}
+
+func (c MonitorConfig) dir() string {
+	if c.Dir == "" {
+		return "monitor"
+	}
+	return c.Dir
+}
+
+func (c MonitorConfig) keepReports() int {
+	if c.KeepReports <= 0 {
+		return 14
+	}
+	return c.KeepReports
+}
+
+func (c MonitorConfig) captureData() bool {
+	return c.CaptureData == nil || *c.CaptureData
+}
+
+// nextReport returns the end of the period that contains now
+func (c MonitorConfig) nextReport(now time.Time) time.Time {
+	interval := c.interval()
+	if interval > 24*time.Hour || (24*time.Hour)%interval != 0 {
+		return now.Add(interval)
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return midnight.Add((now.Sub(midnight)/interval + 1) * interval)
+}
+
+// monitorPeerReport is the behaviour of a peer during a report period
+type monitorPeerReport struct {
+	SKI                 string  `json:"ski"`
+	AvailabilityPercent float64 `json:"availabilityPercent"`
+	Reconnects          int     `json:"reconnects"`
+	// HeartbeatGaps counts the remote heartbeat losses, gaps still open at the end of
+	// the period are included up to its end
+	HeartbeatGaps              int     `json:"heartbeatGaps"`
+	HeartbeatGapSeconds        float64 `json:"heartbeatGapSeconds"`
+	LongestHeartbeatGapSeconds float64 `json:"longestHeartbeatGapSeconds"`
+	LimitViolations            int     `json:"limitViolations"`
+	// Availability is measured from the connect and disconnect times, not the samples
+	Availability *availabilityStats `json:"availability,omitempty"`
+	// Readiness covers the connections set up during the period
+	Readiness *readinessStats `json:"readiness,omitempty"`
+}
+
+// monitorReport is the summary written at the end of every period
+type monitorReport struct {
+	PeriodStart     time.Time           `json:"periodStart"`
+	PeriodEnd       time.Time           `json:"periodEnd"`
+	DurationSeconds float64             `json:"durationSeconds"`
+	Samples         int                 `json:"samples"`
+	Peers           []monitorPeerReport `json:"peers"`
+	Events          int                 `json:"events"`
+	ErrorEvents     int                 `json:"errorEvents"`
+	Datagrams       int                 `json:"datagrams"`
+	// Files are the report and capture files of the period
+	Files []string `json:"files"`
+}
+
+// monitorSample is the connection state of the peers at a sample time
+type monitorSample struct {
+	Time      time.Time
+	Connected map[string]bool
+	Connects  map[string]int
+}
+
+// monitorGap is a remote heartbeat gap of a peer and use case within the period
+type monitorGap struct {
+	ski     string
+	seconds float64
+}
+
+// monitorRun is the active or last monitoring run
+type monitorRun struct {
+	Running      bool           `json:"running"`
+	Config       MonitorConfig  `json:"config"`
+	StartedAt    time.Time      `json:"startedAt"`
+	EndedAt      *time.Time     `json:"endedAt,omitempty"`
+	PeriodStart  time.Time      `json:"periodStart"`
+	NextReportAt time.Time      `json:"nextReportAt"`
+	Reports      int            `json:"reports"`
+	LastReport   *monitorReport `json:"lastReport,omitempty"`
+	Error        string         `json:"error,omitempty"`
+
+	samples   []monitorSample
+	gapSince  map[string]time.Time
+	gaps      []monitorGap
+	lastEvent uint64
+	lastDg    uint64
+	events    int
+	errors    int
+	datagrams int
+	eventFile *os.File
+	dgFile    *os.File
+	stop      chan struct{}
+	done      chan struct{}
+	report    chan chan *monitorReport
+}
+
+// monitorState holds the current or last monitoring run
+type monitorState struct {
+	mu  sync.Mutex
+	run *monitorRun
+}
+
+// startMonitor starts continuous monitoring, an active run has to be stopped first
+func (h *hems) startMonitor(cfg MonitorConfig) error {
+	if err := os.MkdirAll(cfg.dir(), 0755); err != nil {
+		return fmt.Errorf("monitor dir: %w", err)
+	}
+	h.monitor.mu.Lock()
+	if h.monitor.run != nil && h.monitor.run.Running {
+		h.monitor.mu.Unlock()
+		return fmt.Errorf("monitoring already active since %s", formatTimestamp(h.monitor.run.StartedAt))
+	}
+	now := time.Now()
+	run := &monitorRun{
+		Running:      true,
+		Config:       cfg,
+		StartedAt:    now,
+		PeriodStart:  now,
+		NextReportAt: cfg.nextReport(now),
+		gapSince:     make(map[string]time.Time),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		report:       make(chan chan *monitorReport),
+	}
+	// only data captured from now on belongs to the run
+	if evs := h.getEvents(eventFilter{}); len(evs) > 0 {
+		run.lastEvent = evs[len(evs)-1].ID
+	}
+	if dgs := h.getDatagrams(datagramFilter{Limit: 1}); len(dgs) > 0 {
+		run.lastDg = dgs[0].ID
+	}
+	h.monitor.run = run
+	h.monitor.mu.Unlock()
+
+	h.Infof("monitoring started (report every %s to %s, next %s)", cfg.interval(), cfg.dir(), formatTimestamp(run.NextReportAt))
+	h.recordEvent("monitor", severityInfo, "", "monitoring started", map[string]interface{}{"dir": cfg.dir()})
+
+	go h.runMonitor(run)
+	return nil
+}
+
+// stopMonitor ends monitoring and writes the report of the partial period
+func (h *hems) stopMonitor() (*monitorReport, error) {
+	h.monitor.mu.Lock()
+	run := h.monitor.run
+	if run == nil || !run.Running {
+		h.monitor.mu.Unlock()
+		return nil, fmt.Errorf("no active monitoring")
+	}
+	run.Running = false
+	h.monitor.mu.Unlock()
+
+	close(run.stop)
+	<-run.done
+	report := h.finishMonitorPeriod(run, time.Now(), true)
+	h.recordEvent("monitor", severityInfo, "", "monitoring stopped", nil)
+	return report, nil
+}
+
+// reportMonitorNow ends the current period early and writes its report
+func (h *hems) reportMonitorNow() (*monitorReport, error) {
+	h.monitor.mu.Lock()
+	run := h.monitor.run
+	if run == nil || !run.Running {
+		h.monitor.mu.Unlock()
+		return nil, fmt.Errorf("no active monitoring")
+	}
+	h.monitor.mu.Unlock()
+
+	res := make(chan *monitorReport)
+	select {
+	case run.report <- res:
+		return <-res, nil
+	case <-run.done:
+		return nil, fmt.Errorf("no active monitoring")
+	}
+}
+
+func (h *hems) runMonitor(run *monitorRun) {
+	defer close(run.done)
+	ticker := time.NewTicker(run.Config.sampleInterval())
+	defer ticker.Stop()
+	timer := time.NewTimer(time.Until(run.NextReportAt))
+	defer timer.Stop()
+
+	h.sampleMonitor(run)
+	for {
+		select {
+		case <-ticker.C:
+			h.sampleMonitor(run)
+		case <-timer.C:
+			h.finishMonitorPeriod(run, time.Now(), false)
+			timer.Reset(time.Until(run.NextReportAt))
+		case res := <-run.report:
+			res <- h.finishMonitorPeriod(run, time.Now(), false)
+			timer.Reset(time.Until(run.NextReportAt))
+		case <-run.stop:
+			return
+		}
+	}
+}
+
+// sampleMonitor samples the connections and writes the data captured since the last sample
+func (h *hems) sampleMonitor(run *monitorRun) {
+	sample := monitorSample{Time: time.Now(), Connected: make(map[string]bool), Connects: make(map[string]int)}
+	for ski, peer := range h.getAllPeers() {
+		sample.Connected[ski] = peer.connected
+		sample.Connects[ski] = peer.connectCount
+	}
+
+	var evs []timelineEvent
+	for _, ev := range h.getEvents(eventFilter{}) {
+		if ev.ID > run.lastEvent {
+			evs = append(evs, ev)
+		}
+	}
+	var dgs []capturedDatagram
+	if run.Config.captureData() {
+		for _, dg := range h.getDatagrams(datagramFilter{}) {
+			if dg.ID > run.lastDg {
+				dgs = append(dgs, dg)
+			}
+		}
+	}
+
+	h.monitor.mu.Lock()
+	defer h.monitor.mu.Unlock()
+	run.samples = append(run.samples, sample)
+	for _, ev := range evs {
+		run.lastEvent = ev.ID
+		run.events++
+		if ev.Severity == severityError {
+			run.errors++
+		}
+		if ev.Type == "heartbeat" && ev.SKI != "" {
+			run.trackHeartbeat(ev)
+		}
+	}
+	if len(dgs) > 0 {
+		run.lastDg = dgs[len(dgs)-1].ID
+		run.datagrams += len(dgs)
+	}
+	if !run.Config.captureData() {
+		return
+	}
+	if err := run.writeCapture(evs, dgs); err != nil && run.Error == "" {
+		run.Error = err.Error()
+		h.Errorf("monitor capture: %v", err)
+	}
+}
+
+// trackHeartbeat follows the lost and recovered heartbeat events of the peers. The
+// caller holds the monitor mutex.
+func (run *monitorRun) trackHeartbeat(ev timelineEvent) {
+	ok, _ := ev.Data["ok"].(bool)
+	usecase, _ := ev.Data["usecase"].(string)
+	key := ev.SKI + "/" + usecase
+	since, open := run.gapSince[key]
+	switch {
+	case !ok && !open:
+		run.gapSince[key] = ev.Time
+	case ok && open:
+		if since.Before(run.PeriodStart) {
+			since = run.PeriodStart
+		}
+		run.gaps = append(run.gaps, monitorGap{ski: ev.SKI, seconds: ev.Time.Sub(since).Seconds()})
+		delete(run.gapSince, key)
+	}
+}
+
+// periodStamp names the files of the current period
+func (run *monitorRun) periodStamp() string {
+	return run.PeriodStart.Format("20060102-150405")
+}
+
+func (run *monitorRun) periodFile(suffix string) string {
+	return filepath.Join(run.Config.dir(), "monitor-"+run.periodStamp()+suffix)
+}
+
+// writeCapture appends events and datagrams as JSON lines to the files of the period.
+// The caller holds the monitor mutex.
+func (run *monitorRun) writeCapture(evs []timelineEvent, dgs []capturedDatagram) error {
+	var err error
+	if run.eventFile == nil {
+		if run.eventFile, err = os.OpenFile(run.periodFile("-events.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+	}
+	if run.dgFile == nil {
+		if run.dgFile, err = os.OpenFile(run.periodFile("-datagrams.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(run.eventFile)
+	for _, ev := range evs {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	enc = json.NewEncoder(run.dgFile)
+	for _, dg := range dgs {
+		if err := enc.Encode(dg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishMonitorPeriod writes the report of the current period, rotates the files of old
+// periods and starts the next period unless the run ends
+func (h *hems) finishMonitorPeriod(run *monitorRun, end time.Time, last bool) *monitorReport {
+	h.sampleMonitor(run)
+
+	h.monitor.mu.Lock()
+	report := h.buildMonitorReport(run, end)
+	if run.eventFile != nil {
+		run.eventFile.Close()
+		report.Files = append(report.Files, run.eventFile.Name())
+		run.eventFile = nil
+	}
+	if run.dgFile != nil {
+		run.dgFile.Close()
+		report.Files = append(report.Files, run.dgFile.Name())
+		run.dgFile = nil
+	}
+	name := run.periodFile(".json")
+	report.Files = append([]string{name}, report.Files...)
+
+	run.Reports++
+	run.LastReport = report
+	run.PeriodStart = end
+	run.NextReportAt = run.Config.nextReport(end)
+	if len(run.samples) > 0 {
+		run.samples = run.samples[len(run.samples)-1:]
+	}
+	run.gaps, run.events, run.errors, run.datagrams = nil, 0, 0, 0
+	if last {
+		run.EndedAt = &end
+	}
+	cfg := run.Config
+	h.monitor.mu.Unlock()
+
+	if b, err := json.MarshalIndent(report, "", "  "); err != nil {
+		h.Errorf("monitor report: %v", err)
+	} else if err := os.WriteFile(name, b, 0644); err != nil {
+		h.Errorf("write monitor report: %v", err)
+	}
+	h.rotateMonitorFiles(cfg)
+
+	h.Infof("monitor report written to %s (%d peers, %d events)", name, len(report.Peers), report.Events)
+	h.recordEvent("monitor", severityInfo, "", "monitor report written", map[string]interface{}{"file": name})
+	h.broadcastJSON(map[string]interface{}{"type": "monitorReport", "report": report})
+	return report
+}
+
+// buildMonitorReport summarizes the period of a run. The caller holds the monitor mutex.
+func (h *hems) buildMonitorReport(run *monitorRun, end time.Time) *monitorReport {
+	r := &monitorReport{
+		PeriodStart:     run.PeriodStart,
+		PeriodEnd:       end,
+		DurationSeconds: end.Sub(run.PeriodStart).Seconds(),
+		Samples:         len(run.samples),
+		Peers:           []monitorPeerReport{},
+		Events:          run.events,
+		ErrorEvents:     run.errors,
+		Datagrams:       run.datagrams,
+		Files:           []string{},
+	}
+	peers := make(map[string]*monitorPeerReport)
+	peer := func(ski string) *monitorPeerReport {
+		if p, ok := peers[ski]; ok {
+			return p
+		}
+		p := &monitorPeerReport{SKI: ski}
+		peers[ski] = p
+		return p
+	}
+
+	if len(run.samples) > 0 {
+		first, last := run.samples[0], run.samples[len(run.samples)-1]
+		for ski, connects := range last.Connects {
+			up := 0
+			for _, s := range run.samples {
+				if s.Connected[ski] {
+					up++
+				}
+			}
+			p := peer(ski)
+			p.AvailabilityPercent = float64(up) / float64(len(run.samples)) * 100
+			p.Reconnects = connects - first.Connects[ski]
+			// the initial connect of a peer appearing during the period is no reconnect
+			if _, known := first.Connects[ski]; !known && p.Reconnects > 0 {
+				p.Reconnects--
+			}
+		}
+	}
+
+	gaps := append([]monitorGap(nil), run.gaps...)
+	for key, since := range run.gapSince {
+		if since.Before(run.PeriodStart) {
+			since = run.PeriodStart
+		}
+		gaps = append(gaps, monitorGap{ski: key[:strings.Index(key, "/")], seconds: end.Sub(since).Seconds()})
+	}
+	for _, g := range gaps {
+		p := peer(g.ski)
+		p.HeartbeatGaps++
+		p.HeartbeatGapSeconds += g.seconds
+		if g.seconds > p.LongestHeartbeatGapSeconds {
+			p.LongestHeartbeatGapSeconds = g.seconds
+		}
+	}
+
+	for _, a := range h.getAlerts("", "") {
+		if a.Type == alertLimitExceeded && a.SKI != "" && !a.FiredAt.Before(run.PeriodStart) && !a.FiredAt.After(end) {
+			peer(a.SKI).LimitViolations++
+		}
+	}
+
+	for _, ski := range h.availabilitySKIs() {
+		if a, ok := h.availabilityOf(ski, run.PeriodStart, end); ok {
+			peer(ski).Availability = &a
+		}
+		if rd, ok := h.readinessOf(ski, run.PeriodStart, end); ok {
+			peer(ski).Readiness = &rd
+		}
+	}
+
+	for _, p := range peers {
+		r.Peers = append(r.Peers, *p)
+	}
+	sort.Slice(r.Peers, func(i, j int) bool { return r.Peers[i].SKI < r.Peers[j].SKI })
+	return r
+}
+
+// rotateMonitorFiles removes the files of all but the last keepReports periods
+func (h *hems) rotateMonitorFiles(cfg MonitorConfig) {
+	entries, err := os.ReadDir(cfg.dir())
+	if err != nil {
+		h.Errorf("monitor rotate: %v", err)
+		return
+	}
+	const stampLen = len("20060102-150405")
+	periods := make(map[string][]string)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "monitor-") || len(name) < len("monitor-")+stampLen {
+			continue
+		}
+		stamp := name[len("monitor-") : len("monitor-")+stampLen]
+		periods[stamp] = append(periods[stamp], name)
+	}
+	stamps := make([]string, 0, len(periods))
+	for stamp := range periods {
+		stamps = append(stamps, stamp)
+	}
+	sort.Strings(stamps)
+	for len(stamps) > cfg.keepReports() {
+		for _, name := range periods[stamps[0]] {
+			if err := os.Remove(filepath.Join(cfg.dir(), name)); err != nil {
+				h.Errorf("monitor rotate: %v", err)
+			}
+		}
+		stamps = stamps[1:]
+	}
+}
+
+// getMonitor returns a copy of the current or last monitoring run
+func (h *hems) getMonitor() *monitorRun {
+	h.monitor.mu.Lock()
+	defer h.monitor.mu.Unlock()
+	if h.monitor.run == nil {
+		return nil
+	}
+	out := *h.monitor.run
+	return &out
+}
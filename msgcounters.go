@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// Limits of the msgCounter tracking
+const (
+	// maxSeenMsgCounters is the number of recent msgCounters kept per peer to detect duplicates
+	maxSeenMsgCounters  = 1000
+	maxCounterAnomalies = 500
+	// notifyRepeatWindow is the time within which an identical notify counts as repeated
+	notifyRepeatWindow = 10 * time.Second
+)
+
+// Kinds of msgCounter anomalies
+const (
+	anomalyDuplicate      = "duplicate"
+	anomalyGap            = "gap"
+	anomalyOutOfOrder     = "outOfOrder"
+	anomalyRepeatedNotify = "repeatedNotify"
+)
+
+// counterAnomaly is a duplicate, gap, out-of-order delivery or repeated notify of a peer
+type counterAnomaly struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	MsgCounter uint64    `json:"msgCounter"`
+	// Previous is the highest msgCounter received before, for repeated notifies the
+	// msgCounter of the first identical notify
+	Previous   uint64   `json:"previous"`
+	Missing    uint64   `json:"missing,omitempty"`
+	Repeats    int      `json:"repeats,omitempty"`
+	Functions  []string `json:"functions,omitempty"`
+	DatagramID uint64   `json:"datagramId"`
+	Message    string   `json:"message"`
+}
+
+// counterStats summarizes the msgCounters received from a peer in the current connection
+type counterStats struct {
+	SKI              string `json:"ski"`
+	Received         int    `json:"received"`
+	LastMsgCounter   uint64 `json:"lastMsgCounter"`
+	Duplicates       int    `json:"duplicates"`
+	Gaps             int    `json:"gaps"`
+	Missing          uint64 `json:"missing"`
+	OutOfOrder       int    `json:"outOfOrder"`
+	RepeatedNotifies int    `json:"repeatedNotifies"`
+	// ConnectedAt is the start of the tracking, the counters restart with every connection
+	ConnectedAt time.Time        `json:"connectedAt"`
+	Anomalies   []counterAnomaly `json:"anomalies"`
+}
+
+// lastNotify is the last notify of a function from a source address
+type lastNotify struct {
+	hash       [32]byte
+	time       time.Time
+	msgCounter uint64
+	repeats    int
+}
+
+// peerCounters is the msgCounter state of a peer
+type peerCounters struct {
+	stats   counterStats
+	seen    map[uint64]bool
+	order   []uint64
+	notifys map[string]*lastNotify
+}
+
+// msgCounterTracker tracks the msgCounters of the received datagrams per peer
+type msgCounterTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerCounters
+}
+
+func newMsgCounterTracker() *msgCounterTracker {
+	return &msgCounterTracker{peers: make(map[string]*peerCounters)}
+}
+
+// notifyIdentity returns the source and function key and the payload hash of a notify
+func notifyIdentity(dg capturedDatagram) (string, [32]byte, bool) {
+	var d struct {
+		Datagram struct {
+			Header struct {
+				AddressSource json.RawMessage `json:"addressSource"`
+			} `json:"header"`
+			Payload json.RawMessage `json:"payload"`
+		} `json:"datagram"`
+	}
+	if dg.CmdClassifier != "notify" || json.Unmarshal(dg.Datagram, &d) != nil {
+		return "", [32]byte{}, false
+	}
+	key := string(d.Datagram.Header.AddressSource) + "|" + strings.Join(dg.Functions, ",")
+	return key, sha256.Sum256(d.Datagram.Payload), true
+}
+
+// trackMsgCounter checks a received datagram for msgCounter anomalies
+func (h *hems) trackMsgCounter(dg capturedDatagram) {
+	if h.msgCounters == nil || dg.MsgCounter == nil {
+		return
+	}
+	n := *dg.MsgCounter
+	t := h.msgCounters
+	t.mu.Lock()
+	p := t.peers[dg.SKI]
+	if p == nil {
+		p = &peerCounters{
+			stats:   counterStats{SKI: dg.SKI, ConnectedAt: dg.Time, Anomalies: []counterAnomaly{}},
+			seen:    make(map[uint64]bool),
+			notifys: make(map[string]*lastNotify),
+		}
+		t.peers[dg.SKI] = p
+	}
+	s := &p.stats
+	var found []counterAnomaly
+	anomaly := func(kind, msg string) *counterAnomaly {
+		found = append(found, counterAnomaly{Time: dg.Time, Kind: kind, MsgCounter: n, Previous: s.LastMsgCounter, Functions: dg.Functions, DatagramID: dg.ID, Message: msg})
+		return &found[len(found)-1]
+	}
+
+	switch {
+	case p.seen[n]:
+		s.Duplicates++
+		anomaly(anomalyDuplicate, fmt.Sprintf("msgCounter %d received again", n))
+	case s.Received > 0 && n < s.LastMsgCounter:
+		s.OutOfOrder++
+		anomaly(anomalyOutOfOrder, fmt.Sprintf("msgCounter %d after %d", n, s.LastMsgCounter))
+	case s.Received > 0 && n > s.LastMsgCounter+1:
+		missing := n - s.LastMsgCounter - 1
+		s.Gaps++
+		s.Missing += missing
+		a := anomaly(anomalyGap, fmt.Sprintf("%d msgCounters skipped between %d and %d", missing, s.LastMsgCounter, n))
+		a.Missing = missing
+	}
+	if !p.seen[n] {
+		p.seen[n] = true
+		p.order = append(p.order, n)
+		if len(p.order) > maxSeenMsgCounters {
+			delete(p.seen, p.order[0])
+			p.order = p.order[1:]
+		}
+	}
+	if n > s.LastMsgCounter || s.Received == 0 {
+		s.LastMsgCounter = n
+	}
+	s.Received++
+
+	if key, hash, ok := notifyIdentity(dg); ok {
+		last := p.notifys[key]
+		if last != nil && last.hash == hash && dg.Time.Sub(last.time) <= notifyRepeatWindow {
+			last.repeats++
+			s.RepeatedNotifies++
+			a := anomaly(anomalyRepeatedNotify, fmt.Sprintf("identical notify of %s repeated %d times", strings.Join(dg.Functions, ", "), last.repeats))
+			a.Previous, a.Repeats = last.msgCounter, last.repeats
+		} else {
+			last = &lastNotify{hash: hash, msgCounter: n}
+			p.notifys[key] = last
+		}
+		last.time = dg.Time
+	}
+
+	s.Anomalies = append(s.Anomalies, found...)
+	if len(s.Anomalies) > maxCounterAnomalies {
+		s.Anomalies = s.Anomalies[len(s.Anomalies)-maxCounterAnomalies:]
+	}
+	t.mu.Unlock()
+
+	for _, a := range found {
+		// gaps are expected when the DUT talks to other controllers too, bursts of repeated
+		// notifies are recorded once
+		if a.Kind == anomalyGap || (a.Kind == anomalyRepeatedNotify && a.Repeats > 1) {
+			continue
+		}
+		h.recordEvent("msgCounter", severityWarning, dg.SKI, a.Message, map[string]interface{}{
+			"kind": a.Kind, "msgCounter": a.MsgCounter, "datagramId": a.DatagramID, "functions": a.Functions,
+		})
+	}
+}
+
+// resetMsgCounters starts the tracking of a peer anew, the DUT may restart its msgCounter
+// with a new connection
+func (h *hems) resetMsgCounters(ski string) {
+	h.msgCounters.mu.Lock()
+	delete(h.msgCounters.peers, shiputil.NormalizeSKI(ski))
+	h.msgCounters.mu.Unlock()
+}
+
+// getMsgCounterStats returns the msgCounter statistics and anomalies per peer
+func (h *hems) getMsgCounterStats(ski string) map[string]counterStats {
+	ski = shiputil.NormalizeSKI(ski)
+	h.msgCounters.mu.Lock()
+	defer h.msgCounters.mu.Unlock()
+	out := make(map[string]counterStats)
+	for key, p := range h.msgCounters.peers {
+		if ski != "" && key != ski {
+			continue
+		}
+		s := p.stats
+		s.Anomalies = append([]counterAnomaly(nil), p.stats.Anomalies...)
+		out[key] = s
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// functionMessageCounts counts the datagrams of one function by direction and cmdClassifier
+type functionMessageCounts struct {
+	Function string         `json:"function"`
+	Total    int            `json:"total"`
+	Received map[string]int `json:"received"`
+	Sent     map[string]int `json:"sent"`
+}
+
+// messageHistogram summarizes the SPINE datagrams exchanged with a peer
+type messageHistogram struct {
+	SKI   string    `json:"ski"`
+	Since time.Time `json:"since"`
+	Total int       `json:"total"`
+	// ByClassifier counts the functions of the received datagrams per cmdClassifier
+	ByClassifier map[string]int `json:"byClassifier"`
+	// Functions are sorted by total count, the chattiest function first
+	Functions []functionMessageCounts `json:"functions"`
+}
+
+type peerMessageCounts struct {
+	since     time.Time
+	total     int
+	functions map[string]*functionMessageCounts
+}
+
+// messageCounter counts the captured datagrams per peer, function and cmdClassifier
+type messageCounter struct {
+	mu    sync.Mutex
+	peers map[string]*peerMessageCounts
+}
+
+func newMessageCounter() *messageCounter {
+	return &messageCounter{peers: make(map[string]*peerMessageCounts)}
+}
+
+// countMessage counts every cmd of a captured datagram under its function
+func (h *hems) countMessage(dg capturedDatagram) {
+	if h.messageCounts == nil {
+		return
+	}
+	classifier := dg.CmdClassifier
+	if classifier == "" {
+		classifier = "unknown"
+	}
+	h.messageCounts.mu.Lock()
+	defer h.messageCounts.mu.Unlock()
+	p := h.messageCounts.peers[dg.SKI]
+	if p == nil {
+		p = &peerMessageCounts{since: dg.Time, functions: make(map[string]*functionMessageCounts)}
+		h.messageCounts.peers[dg.SKI] = p
+	}
+	p.total++
+	for _, fn := range dg.Functions {
+		f := p.functions[fn]
+		if f == nil {
+			f = &functionMessageCounts{Function: fn, Received: make(map[string]int), Sent: make(map[string]int)}
+			p.functions[fn] = f
+		}
+		f.Total++
+		if dg.Direction == datagramReceived {
+			f.Received[classifier]++
+		} else {
+			f.Sent[classifier]++
+		}
+	}
+}
+
+// getMessageHistograms returns the message counts per peer, optionally for one SKI
+func (h *hems) getMessageHistograms(ski string) []messageHistogram {
+	ski = shiputil.NormalizeSKI(ski)
+	h.messageCounts.mu.Lock()
+	defer h.messageCounts.mu.Unlock()
+
+	out := []messageHistogram{}
+	for key, p := range h.messageCounts.peers {
+		if ski != "" && key != ski {
+			continue
+		}
+		hist := messageHistogram{SKI: key, Since: p.since, Total: p.total, ByClassifier: make(map[string]int), Functions: []functionMessageCounts{}}
+		for _, f := range p.functions {
+			c := functionMessageCounts{Function: f.Function, Total: f.Total, Received: make(map[string]int, len(f.Received)), Sent: make(map[string]int, len(f.Sent))}
+			for k, v := range f.Received {
+				c.Received[k] = v
+				hist.ByClassifier[k] += v
+			}
+			for k, v := range f.Sent {
+				c.Sent[k] = v
+			}
+			hist.Functions = append(hist.Functions, c)
+		}
+		sort.Slice(hist.Functions, func(i, j int) bool {
+			if hist.Functions[i].Total != hist.Functions[j].Total {
+				return hist.Functions[i].Total > hist.Functions[j].Total
+			}
+			return hist.Functions[i].Function < hist.Functions[j].Function
+		})
+		out = append(out, hist)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SKI < out[j].SKI })
+	return out
+}
+
+// resetMessageHistograms drops all message counts
+func (h *hems) resetMessageHistograms() {
+	h.messageCounts.mu.Lock()
+	h.messageCounts.peers = make(map[string]*peerMessageCounts)
+	h.messageCounts.mu.Unlock()
+}
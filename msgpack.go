@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// jsonToMsgpack converts a JSON document to MessagePack. Plain text messages
+// like log lines are not JSON and are encoded as a MessagePack string.
+func jsonToMsgpack(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if !json.Valid(b) {
+		writeMsgpackString(&buf, string(b))
+		return buf.Bytes(), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if err := writeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMsgpack encodes a decoded JSON value, map keys are sorted
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, n)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			_ = binary.Write(buf, binary.BigEndian, u)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xcb)
+			_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeMsgpackString(buf, v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := writeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(buf, len(v), 0x80, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeMsgpackString(buf, k)
+			if err := writeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// writeMsgpackHeader writes the header of an array or map with n elements
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix, code16, code32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+// writeMsgpackInt writes an integer in the smallest MessagePack format
+func writeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n < 128:
+		buf.WriteByte(byte(n))
+	case n >= -32 && n < 0:
+		buf.WriteByte(byte(0xe0 | (n + 32)))
+	case n >= 0 && n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	case n >= 0:
+		buf.WriteByte(0xcf)
+		_ = binary.Write(buf, binary.BigEndian, uint64(n))
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, n)
+	}
+}
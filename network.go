@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/enbility/eebus-go/api"
+	"github.com/enbility/ship-go/mdns"
+)
+
+// NetworkConfig restricts the network interfaces and IP families used for mDNS and SHIP
+type NetworkConfig struct {
+	// Interfaces limits mDNS announcement and browsing to these interface names, empty uses all
+	Interfaces []string `json:"interfaces,omitempty"`
+	// DisableIPv6 stops the mDNS inspector from using IPv6. ship-go has no IP family
+	// selection, its mDNS provider and SHIP server keep listening on IPv6 as well
+	DisableIPv6 bool `json:"disableIPv6,omitempty"`
+	// MdnsProvider is "auto" (default, avahi if available), "avahi" or "zeroconf"
+	MdnsProvider string `json:"mdnsProvider,omitempty"`
+	// PortRange is searched for a free SHIP port unless a port is set with -p
+	PortRange *PortRange `json:"portRange,omitempty"`
+}
+
+// PortRange is an inclusive range of TCP ports
+type PortRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// portFree reports whether the TCP port can be listened on. The port is released again,
+// another process can still take it before the SHIP server listens on it.
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
+
+// shipPort selects the SHIP port: an explicit non-zero port is used as is, otherwise the
+// first free port of the port range or, without a range, a free port chosen by the OS
+func (c NetworkConfig) shipPort(port int, explicit bool) (int, error) {
+	if port != 0 && (explicit || c.PortRange == nil) {
+		return port, nil
+	}
+	if r := c.PortRange; r != nil {
+		if r.From < 1 || r.To > 65535 || r.From > r.To {
+			return 0, fmt.Errorf("invalid portRange %d-%d", r.From, r.To)
+		}
+		for p := r.From; p <= r.To; p++ {
+			if portFree(p) {
+				return p, nil
+			}
+		}
+		return 0, fmt.Errorf("no free port in portRange %d-%d", r.From, r.To)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, fmt.Errorf("select a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (c NetworkConfig) mdnsProvider() (mdns.MdnsProviderSelection, error) {
+	switch strings.ToLower(c.MdnsProvider) {
+	case "", "auto":
+		return mdns.MdnsProviderSelectionAll, nil
+	case "avahi":
+		return mdns.MdnsProviderSelectionAvahiOnly, nil
+	case "zeroconf":
+		return mdns.MdnsProviderSelectionGoZeroConfOnly, nil
+	}
+	return mdns.MdnsProviderSelectionAll, fmt.Errorf("invalid mdnsProvider %q, expected auto, avahi or zeroconf", c.MdnsProvider)
+}
+
+// interfaces resolves the configured interface names, nil means all interfaces
+func (c NetworkConfig) interfaces() ([]net.Interface, error) {
+	if len(c.Interfaces) == 0 {
+		return nil, nil
+	}
+	ifaces := make([]net.Interface, 0, len(c.Interfaces))
+	for _, name := range c.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("network interface %q: %w", name, err)
+		}
+		if iface.Flags&net.FlagMulticast == 0 {
+			return nil, fmt.Errorf("network interface %q does not support multicast", name)
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+// apply validates the network settings and applies them to the service configuration
+func (c NetworkConfig) apply(configuration *api.Configuration) error {
+	if _, err := c.interfaces(); err != nil {
+		return err
+	}
+	provider, err := c.mdnsProvider()
+	if err != nil {
+		return err
+	}
+	if len(c.Interfaces) > 0 {
+		configuration.SetInterfaces(c.Interfaces)
+	}
+	configuration.SetMdnsProviderSelection(provider)
+	return nil
+}
+
+// networkInterface describes a local interface for the network API
+type networkInterface struct {
+	Name      string   `json:"name"`
+	Index     int      `json:"index"`
+	Up        bool     `json:"up"`
+	Multicast bool     `json:"multicast"`
+	Loopback  bool     `json:"loopback"`
+	Addresses []string `json:"addresses"`
+	Used      bool     `json:"used"`
+}
+
+// getNetworkInfo returns the effective network settings and the local interfaces
+func (h *hems) getNetworkInfo() (map[string]interface{}, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	cfg := h.config.Network
+	selected := make(map[string]bool, len(cfg.Interfaces))
+	for _, name := range cfg.Interfaces {
+		selected[name] = true
+	}
+
+	list := make([]networkInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		info := networkInterface{
+			Name:      iface.Name,
+			Index:     iface.Index,
+			Up:        iface.Flags&net.FlagUp != 0,
+			Multicast: iface.Flags&net.FlagMulticast != 0,
+			Loopback:  iface.Flags&net.FlagLoopback != 0,
+			Addresses: []string{},
+		}
+		info.Used = info.Up && info.Multicast && (len(selected) == 0 || selected[iface.Name])
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && cfg.DisableIPv6 && ipnet.IP.To4() == nil {
+					continue
+				}
+				info.Addresses = append(info.Addresses, a.String())
+			}
+		}
+		list = append(list, info)
+	}
+
+	provider := cfg.MdnsProvider
+	if provider == "" {
+		provider = "auto"
+	}
+	return map[string]interface{}{
+		"shipPort":     h.shipPort,
+		"portRange":    cfg.PortRange,
+		"interfaces":   cfg.Interfaces,
+		"disableIPv6":  cfg.DisableIPv6,
+		"mdnsProvider": provider,
+		"local":        list,
+	}, nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier types
+const (
+	notifierSlack    = "slack"
+	notifierTelegram = "telegram"
+	notifierEmail    = "email"
+)
+
+// Notifier conditions, matched against the timeline events
+const (
+	notifyTestRunCompleted = "testRunCompleted"
+	notifyAssertionFailed  = "assertionFailed"
+	notifyDisconnect       = "disconnect"
+	notifyHeartbeatLost    = "heartbeatLost"
+	notifyAlertFired       = "alertFired"
+	// notifyEventPrefix followed by an event type matches its warning and error events
+	notifyEventPrefix = "event:"
+)
+
+// errUnknownNotifier is returned for test notifications of notifiers that are not configured
+var errUnknownNotifier = errors.New("unknown notifier")
+
+// defaultNotifyConditions are used when a notifier has no conditions configured
+var defaultNotifyConditions = []string{notifyAssertionFailed, notifyDisconnect, notifyHeartbeatLost}
+
+// defaultNotifyInterval is the minimum time between two notifications of the same condition
+// and DUT, a flapping connection must not flood the channel overnight
+const defaultNotifyInterval = time.Minute
+
+// NotifierConfig configures a channel that is notified of failures
+type NotifierConfig struct {
+	Name string `json:"name"`
+	// Type is slack, telegram or email
+	Type string `json:"type"`
+	// On are the conditions that notify: testRunCompleted, assertionFailed, disconnect,
+	// heartbeatLost, alertFired or event:<type>, defaults to assertionFailed, disconnect
+	// and heartbeatLost
+	On []string `json:"on,omitempty"`
+	// MinIntervalSeconds suppresses repeated notifications of a condition and DUT except
+	// for test runs, defaults to 60, a negative value sends all
+	MinIntervalSeconds int `json:"minIntervalSeconds,omitempty"`
+
+	// WebhookURL is the incoming webhook of the Slack channel (slack)
+	WebhookURL string `json:"webhookUrl,omitempty"`
+	// BotToken and ChatID address the Telegram chat (telegram)
+	BotToken string `json:"botToken,omitempty"`
+	ChatID   string `json:"chatId,omitempty"`
+	// SMTP is the mail server and the recipients (email)
+	SMTP *SMTPConfig `json:"smtp,omitempty"`
+}
+
+// SMTPConfig configures the mail server of e-mail notifications
+type SMTPConfig struct {
+	Host string `json:"host"`
+	// Port defaults to 587 with STARTTLS, 465 uses implicit TLS
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+func (c NotifierConfig) conditions() []string {
+	if len(c.On) == 0 {
+		return defaultNotifyConditions
+	}
+	return c.On
+}
+
+func (c NotifierConfig) minInterval() time.Duration {
+	if c.MinIntervalSeconds == 0 {
+		return defaultNotifyInterval
+	}
+	return time.Duration(c.MinIntervalSeconds) * time.Second
+}
+
+// validate checks that the notifier has everything its type needs
+func (c NotifierConfig) validate() error {
+	switch c.Type {
+	case notifierSlack:
+		if c.WebhookURL == "" {
+			return fmt.Errorf("notifier %s: webhookUrl required", c.Name)
+		}
+	case notifierTelegram:
+		if c.BotToken == "" || c.ChatID == "" {
+			return fmt.Errorf("notifier %s: botToken and chatId required", c.Name)
+		}
+	case notifierEmail:
+		if c.SMTP == nil || c.SMTP.Host == "" || c.SMTP.From == "" || len(c.SMTP.To) == 0 {
+			return fmt.Errorf("notifier %s: smtp host, from and to required", c.Name)
+		}
+	default:
+		return fmt.Errorf("notifier %s: unknown type %q, expected slack, telegram or email", c.Name, c.Type)
+	}
+	for _, cond := range c.conditions() {
+		switch {
+		case cond == notifyTestRunCompleted, cond == notifyAssertionFailed, cond == notifyDisconnect,
+			cond == notifyHeartbeatLost, cond == notifyAlertFired:
+		case strings.HasPrefix(cond, notifyEventPrefix) && len(cond) > len(notifyEventPrefix):
+		default:
+			return fmt.Errorf("notifier %s: unknown condition %q", c.Name, cond)
+		}
+	}
+	return nil
+}
+
+// notifyConditions returns the conditions a timeline event meets
+func notifyConditions(ev timelineEvent) []string {
+	var out []string
+	switch ev.Type {
+	case "testrun":
+		// the more specific condition first, it names the notification
+		if failed, _ := ev.Data["failed"].(int); failed > 0 {
+			out = append(out, notifyAssertionFailed)
+		}
+		out = append(out, notifyTestRunCompleted)
+	case "connection":
+		if ev.Severity != severityInfo {
+			out = append(out, notifyDisconnect)
+		}
+	case "heartbeat":
+		// remote heartbeats report ok, the local heartbeat reports running
+		if ok, found := ev.Data["ok"].(bool); found && !ok {
+			out = append(out, notifyHeartbeatLost)
+		}
+	case "alert":
+		if ev.Severity != severityInfo {
+			out = append(out, notifyAlertFired)
+		}
+	}
+	if ev.Severity != severityInfo {
+		out = append(out, notifyEventPrefix+ev.Type)
+	}
+	return out
+}
+
+// notifierStatus is the delivery state of a notifier for the API
+type notifierStatus struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	On         []string   `json:"on"`
+	Sent       int        `json:"sent"`
+	Failed     int        `json:"failed"`
+	Suppressed int        `json:"suppressed"`
+	LastSentAt *time.Time `json:"lastSentAt,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+type notifier struct {
+	cfg NotifierConfig
+	// the fields below are guarded by notifierSet.mu
+	status notifierStatus
+	// last notification and the suppressed ones since, per condition and SKI
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// notifierSet delivers the timeline events matching the notifier conditions
+type notifierSet struct {
+	mu        sync.Mutex
+	notifiers []*notifier
+}
+
+// newNotifierSet returns nil without notifiers, invalid notifiers stop the startup
+func newNotifierSet(cfgs []NotifierConfig) (*notifierSet, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	s := &notifierSet{}
+	for i, c := range cfgs {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s-%d", c.Type, i+1)
+		}
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		s.notifiers = append(s.notifiers, &notifier{
+			cfg:        c,
+			status:     notifierStatus{Name: c.Name, Type: c.Type, On: c.conditions()},
+			last:       make(map[string]time.Time),
+			suppressed: make(map[string]int),
+		})
+	}
+	return s, nil
+}
+
+// notifyTimelineEvent sends a timeline event to the notifiers whose conditions it meets
+func (h *hems) notifyTimelineEvent(ev timelineEvent) {
+	s := h.notifiers
+	if s == nil {
+		return
+	}
+	conds := notifyConditions(ev)
+	if len(conds) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.notifiers {
+		idx := slices.IndexFunc(conds, func(c string) bool { return slices.Contains(n.cfg.conditions(), c) })
+		if idx < 0 {
+			continue
+		}
+		key := conds[idx] + "/" + ev.SKI
+		// every test run is reported, the interval is meant for flapping conditions
+		throttled := ev.Type != "testrun"
+		if last, ok := n.last[key]; ok && throttled && ev.Time.Sub(last) < n.cfg.minInterval() {
+			n.suppressed[key]++
+			n.status.Suppressed++
+			continue
+		}
+		n.last[key] = ev.Time
+		suppressed := n.suppressed[key]
+		delete(n.suppressed, key)
+		subject, text := h.notificationText(conds[idx], ev, suppressed)
+		go h.deliverNotification(n, subject, text)
+	}
+}
+
+// notificationText formats a notification, the tester name tells apart the lab instances
+func (h *hems) notificationText(cond string, ev timelineEvent, suppressed int) (string, string) {
+	titles := map[string]string{
+		notifyTestRunCompleted: "Test run completed",
+		notifyAssertionFailed:  "Test run failed",
+		notifyDisconnect:       "DUT disconnected",
+		notifyHeartbeatLost:    "Heartbeat lost",
+		notifyAlertFired:       "Alert fired",
+		"test":                 "Test notification",
+	}
+	title, ok := titles[cond]
+	if !ok {
+		title = fmt.Sprintf("%s %s", ev.Type, ev.Severity)
+	}
+	tester := "device-tester"
+	if h.config != nil && h.config.DeviceInfo.DeviceName != "" {
+		tester = h.config.DeviceInfo.DeviceName
+	}
+	subject := fmt.Sprintf("[%s] %s", tester, title)
+
+	var b strings.Builder
+	b.WriteString(ev.Message)
+	if ev.SKI != "" {
+		b.WriteString("\nDUT: " + ev.SKI)
+	}
+	if failed, ok := ev.Data["failedAssertions"].([]string); ok && len(failed) > 0 {
+		b.WriteString("\nFailed: " + strings.Join(failed, "; "))
+	}
+	b.WriteString("\nTime: " + formatTimestamp(ev.Time))
+	if suppressed > 0 {
+		fmt.Fprintf(&b, "\n%d similar notifications suppressed", suppressed)
+	}
+	return subject, b.String()
+}
+
+// deliverNotification sends a notification and records the outcome
+func (h *hems) deliverNotification(n *notifier, subject, text string) {
+	err := sendNotification(n.cfg, subject, text)
+	h.notifiers.mu.Lock()
+	if err != nil {
+		n.status.Failed++
+		n.status.LastError = err.Error()
+	} else {
+		now := time.Now()
+		n.status.Sent++
+		n.status.LastSentAt = &now
+		n.status.LastError = ""
+	}
+	h.notifiers.mu.Unlock()
+	if err != nil {
+		h.Errorf("notifier %s: %v", n.cfg.Name, err)
+	}
+}
+
+func sendNotification(cfg NotifierConfig, subject, text string) error {
+	switch cfg.Type {
+	case notifierSlack:
+		return postWebhook(cfg.WebhookURL, map[string]string{"text": "*" + subject + "*\n" + text})
+	case notifierTelegram:
+		return postWebhook("https://api.telegram.org/bot"+cfg.BotToken+"/sendMessage", map[string]string{
+			"chat_id": cfg.ChatID,
+			"text":    subject + "\n" + text,
+		})
+	case notifierEmail:
+		return sendMail(*cfg.SMTP, subject, text)
+	}
+	return fmt.Errorf("unknown notifier type %q", cfg.Type)
+}
+
+// sendMail sends a plain text mail, with STARTTLS if the server offers it or implicit
+// TLS on port 465
+func sendMail(cfg SMTPConfig, subject, text string) error {
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	if port != 465 {
+		return smtp.SendMail(addr, auth, cfg.From, cfg.To, []byte(msg.String()))
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: notifyTimeout}, "tcp", addr, &tls.Config{ServerName: cfg.Host})
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(notifyTimeout))
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// getNotifiers returns the delivery state of the notifiers
+func (h *hems) getNotifiers() []notifierStatus {
+	out := []notifierStatus{}
+	if h.notifiers == nil {
+		return out
+	}
+	h.notifiers.mu.Lock()
+	defer h.notifiers.mu.Unlock()
+	for _, n := range h.notifiers.notifiers {
+		st := n.status
+		st.On = append([]string(nil), st.On...)
+		out = append(out, st)
+	}
+	return out
+}
+
+// testNotifier sends a test notification synchronously, so the caller sees the error
+func (h *hems) testNotifier(name string) error {
+	if h.notifiers == nil {
+		return fmt.Errorf("%w: %s", errUnknownNotifier, name)
+	}
+	h.notifiers.mu.Lock()
+	var n *notifier
+	for _, candidate := range h.notifiers.notifiers {
+		if candidate.cfg.Name == name {
+			n = candidate
+		}
+	}
+	h.notifiers.mu.Unlock()
+	if n == nil {
+		return fmt.Errorf("%w: %s", errUnknownNotifier, name)
+	}
+	subject, text := h.notificationText("test", timelineEvent{Type: "test", Severity: severityInfo, Message: "Test notification of the device tester", Time: time.Now()}, 0)
+	return sendNotification(n.cfg, subject, text)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// MQTTConfig configures publishing of notifications to an MQTT broker
+type MQTTConfig struct {
+	// Broker is the broker URL, e.g. tcp://localhost:1883 or tls://broker:8883
+	Broker   string `json:"broker"`
+	Topic    string `json:"topic,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Retain   bool   `json:"retain,omitempty"`
+}
+
+const notifyTimeout = 5 * time.Second
+
+// postWebhook sends a JSON payload to a webhook URL
+func postWebhook(target string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// publishMQTT publishes a single QoS 0 message using MQTT 3.1.1.
+// A new connection is used for every message as notifications are rare.
+func publishMQTT(cfg MQTTConfig, topic string, payload []byte) error {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return fmt.Errorf("invalid broker url: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt", "":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "tls", "ssl", "mqtts":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("device-tester-%d", time.Now().UnixNano()%1000000)
+	}
+
+	// CONNECT
+	var vh bytes.Buffer
+	writeMQTTString(&vh, "MQTT")
+	vh.WriteByte(4) // protocol level 3.1.1
+	flags := byte(0x02)
+	if cfg.Username != "" {
+		flags |= 0x80
+		if cfg.Password != "" {
+			flags |= 0x40
+		}
+	}
+	vh.WriteByte(flags)
+	_ = binary.Write(&vh, binary.BigEndian, uint16(30))
+	writeMQTTString(&vh, clientID)
+	if cfg.Username != "" {
+		writeMQTTString(&vh, cfg.Username)
+		if cfg.Password != "" {
+			writeMQTTString(&vh, cfg.Password)
+		}
+	}
+	if err := writeMQTTPacket(conn, 0x10, vh.Bytes()); err != nil {
+		return err
+	}
+
+	// CONNACK
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(bufio.NewReader(conn), ack); err != nil {
+		return fmt.Errorf("read connack: %w", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		return fmt.Errorf("broker refused connection (code %d)", ack[3])
+	}
+
+	// PUBLISH
+	var pub bytes.Buffer
+	writeMQTTString(&pub, topic)
+	pub.Write(payload)
+	header := byte(0x30)
+	if cfg.Retain {
+		header |= 0x01
+	}
+	if err := writeMQTTPacket(conn, header, pub.Bytes()); err != nil {
+		return err
+	}
+
+	// DISCONNECT
+	return writeMQTTPacket(conn, 0xE0, nil)
+}
+
+func writeMQTTString(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	if len(body) > 268435455 {
+		return errors.New("mqtt packet too large")
+	}
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+	_, err := w.Write(packet)
+	return err
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Defaults and limits of the OIDC login
+const (
+	oidcTimeout = 10 * time.Second
+	// oidcLoginTimeout is the time a user has to complete the login at the IdP
+	oidcLoginTimeout    = 10 * time.Minute
+	defaultOIDCTokenTTL = 8 * time.Hour
+	// maxOIDCTokenTTL caps the lifetime of derived API tokens
+	maxOIDCTokenTTL = 30 * 24 * time.Hour
+	// oidcClockSkew is the tolerated clock difference to the IdP
+	oidcClockSkew = time.Minute
+)
+
+// OIDCConfig configures the OpenID Connect login of the web interface. Users log in at
+// the IdP and get an API token of the tester with the role mapped from their claims.
+type OIDCConfig struct {
+	// Issuer is the issuer URL, the discovery document is read from
+	// <issuer>/.well-known/openid-configuration
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// RedirectURL is the callback registered at the IdP, e.g.
+	// https://tester.lab.example/api/auth/oidc/callback
+	RedirectURL string `json:"redirectUrl"`
+	// Scopes default to openid, profile and email
+	Scopes []string `json:"scopes,omitempty"`
+	// UsernameClaim names the user, defaults to preferred_username with email and sub as fallback
+	UsernameClaim string `json:"usernameClaim,omitempty"`
+	// RoleClaim holds the groups or roles of the user, defaults to groups
+	RoleClaim string `json:"roleClaim,omitempty"`
+	// Roles maps claim values to tester roles (viewer, operator, admin), the highest role wins
+	Roles map[string]string `json:"roles,omitempty"`
+	// DefaultRole is given to users without a mapped claim value, without it they are rejected
+	DefaultRole string `json:"defaultRole,omitempty"`
+	// TokenTTLSeconds is the lifetime of the API token issued at login, defaults to 8 hours
+	TokenTTLSeconds int `json:"tokenTtlSeconds,omitempty"`
+}
+
+func (c OIDCConfig) scopes() []string {
+	if len(c.Scopes) == 0 {
+		return []string{"openid", "profile", "email"}
+	}
+	for _, s := range c.Scopes {
+		if s == "openid" {
+			return c.Scopes
+		}
+	}
+	return append([]string{"openid"}, c.Scopes...)
+}
+
+func (c OIDCConfig) roleClaim() string {
+	if c.RoleClaim == "" {
+		return "groups"
+	}
+	return c.RoleClaim
+}
+
+func (c OIDCConfig) tokenTTL() time.Duration {
+	if c.TokenTTLSeconds <= 0 {
+		return defaultOIDCTokenTTL
+	}
+	return min(time.Duration(c.TokenTTLSeconds)*time.Second, maxOIDCTokenTTL)
+}
+
+// oidcDiscovery is the part of the discovery document the login needs
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a login waiting for the callback of the IdP
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	redirect string
+	created  time.Time
+}
+
+// oidcToken is an API token issued for a user logged in via OIDC
+type oidcToken struct {
+	user authUser
+	name string
+	// parent is the key of the login token a derived token was issued from
+	parent  string
+	expires time.Time
+}
+
+// oidcProvider runs the authorization code flow with PKCE against the IdP and keeps the
+// issued API tokens. Tokens are only kept in memory, users log in again after a restart.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	logins    map[string]oidcLogin
+	// tokens are keyed by the SHA-256 of the token
+	tokens map[string]oidcToken
+}
+
+// newOIDCProvider returns nil without an issuer, the IdP is contacted on the first login
+// so the tester starts while the IdP is unreachable
+func newOIDCProvider(cfg *OIDCConfig) *oidcProvider {
+	if cfg == nil || cfg.Issuer == "" {
+		return nil
+	}
+	return &oidcProvider{
+		cfg:    *cfg,
+		client: &http.Client{Timeout: oidcTimeout},
+		keys:   make(map[string]crypto.PublicKey),
+		logins: make(map[string]oidcLogin),
+		tokens: make(map[string]oidcToken),
+	}
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *oidcProvider) getJSON(rawURL string, v interface{}) error {
+	resp, err := p.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover reads the discovery document once
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = &oidcDiscovery{}
+	if err := p.getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: document lacks endpoints")
+	}
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// localRedirect returns redirect if it is a path of the web UI and "/" otherwise, so a
+// login can not be used to send the browser, and the new token, to another host.
+func localRedirect(redirect string) string {
+	unsafe := func(r rune) bool { return r == '\\' || unicode.IsControl(r) }
+	if strings.ContainsFunc(redirect, unsafe) {
+		return "/"
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.User != nil {
+		return "/"
+	}
+	if unescaped, err := url.PathUnescape(u.EscapedPath()); err != nil || strings.ContainsFunc(unescaped, unsafe) {
+		return "/"
+	}
+	if u.Path != "/" && u.Path != "/index.html" && (!strings.HasPrefix(u.Path, "/web/") || path.Clean(u.Path) != u.Path) {
+		return "/"
+	}
+	return (&url.URL{Path: u.Path, RawQuery: u.RawQuery}).String()
+}
+
+// loginURL starts a login and returns the authorization URL of the IdP. redirect is the
+// local path the browser returns to.
+func (p *oidcProvider) loginURL(redirect string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	redirect = localRedirect(redirect)
+	state, login := randomToken(24), oidcLogin{nonce: randomToken(24), verifier: randomToken(32), redirect: redirect, created: time.Now()}
+	p.mu.Lock()
+	for k, l := range p.logins {
+		if time.Since(l.created) > oidcLoginTimeout {
+			delete(p.logins, k)
+		}
+	}
+	p.logins[state] = login
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.scopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", login.nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// callback completes a login: it exchanges the code, verifies the ID token and issues an
+// API token. It returns the token and the local path to return to.
+func (p *oidcProvider) callback(state, code string) (string, oidcToken, string, error) {
+	p.mu.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+	if !ok || time.Since(login.created) > oidcLoginTimeout {
+		return "", oidcToken{}, "", errors.New("unknown or expired login, please log in again")
+	}
+	d, err := p.discover()
+	if err != nil {
+		return "", oidcToken{}, "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", login.verifier)
+	form.Set("client_id", p.cfg.ClientID)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", oidcToken{}, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", oidcToken{}, "", fmt.Errorf("oidc token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tr); err != nil {
+		return "", oidcToken{}, "", fmt.Errorf("oidc token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.IDToken == "" {
+		return "", oidcToken{}, "", fmt.Errorf("oidc token request: %s %s %s", resp.Status, tr.Error, tr.ErrorDescription)
+	}
+
+	claims, err := p.verifyIDToken(d, tr.IDToken, login.nonce)
+	if err != nil {
+		return "", oidcToken{}, "", err
+	}
+	user, err := p.userOf(claims)
+	if err != nil {
+		return "", oidcToken{}, "", err
+	}
+	token, t := p.issue(user, "login", p.cfg.tokenTTL())
+	return token, t, login.redirect, nil
+}
+
+// userOf maps the claims of an ID token to a tester user
+func (p *oidcProvider) userOf(claims map[string]interface{}) (authUser, error) {
+	name := ""
+	for _, c := range []string{p.cfg.UsernameClaim, "preferred_username", "email", "sub"} {
+		if v, ok := claims[c].(string); ok && c != "" && v != "" {
+			name = v
+			break
+		}
+	}
+
+	var values []string
+	switch v := claims[p.cfg.roleClaim()].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	rl := roleNone
+	for _, v := range values {
+		if mapped := parseRole(p.cfg.Roles[v]); mapped > rl {
+			rl = mapped
+		}
+	}
+	if rl == roleNone {
+		rl = parseRole(p.cfg.DefaultRole)
+	}
+	if rl == roleNone {
+		return authUser{}, fmt.Errorf("user %s has no tester role", name)
+	}
+	return authUser{Name: name, Role: rl.String(), role: rl}, nil
+}
+
+// issue creates the API token of a login
+func (p *oidcProvider) issue(user authUser, name string, ttl time.Duration) (string, oidcToken) {
+	t := oidcToken{user: user, name: name, expires: time.Now().Add(ttl)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.store(t), t
+}
+
+// derive issues an additional API token from the token of a login. The derived token
+// expires with the login at the latest and is revoked with it, derived tokens can not
+// derive further tokens.
+func (p *oidcProvider) derive(login, name string, ttl time.Duration) (string, oidcToken, error) {
+	if p == nil {
+		return "", oidcToken{}, errors.New("api tokens can only be derived from an oidc login")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := tokenHash(login)
+	parent, ok := p.tokens[key]
+	if !ok || time.Now().After(parent.expires) {
+		return "", oidcToken{}, errors.New("api tokens can only be derived from an oidc login")
+	}
+	if parent.parent != "" {
+		return "", oidcToken{}, errors.New("api tokens can not be derived from a derived token")
+	}
+	t := oidcToken{user: parent.user, name: name, parent: key, expires: time.Now().Add(ttl)}
+	if t.expires.After(parent.expires) {
+		t.expires = parent.expires
+	}
+	return p.store(t), t, nil
+}
+
+// store keeps an issued token and drops expired ones, p.mu must be held
+func (p *oidcProvider) store(t oidcToken) string {
+	token := randomToken(32)
+	for k, existing := range p.tokens {
+		if time.Now().After(existing.expires) {
+			delete(p.tokens, k)
+		}
+	}
+	p.tokens[tokenHash(token)] = t
+	return token
+}
+
+// lookup resolves an issued API token
+func (p *oidcProvider) lookup(token string) (oidcToken, bool) {
+	if p == nil || token == "" {
+		return oidcToken{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := tokenHash(token)
+	t, ok := p.tokens[key]
+	if !ok {
+		return oidcToken{}, false
+	}
+	if time.Now().After(t.expires) {
+		delete(p.tokens, key)
+		return oidcToken{}, false
+	}
+	return t, true
+}
+
+// revoke drops an issued API token and the tokens derived from it
+func (p *oidcProvider) revoke(token string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := tokenHash(token)
+	_, ok := p.tokens[key]
+	delete(p.tokens, key)
+	for k, t := range p.tokens {
+		if t.parent == key {
+			delete(p.tokens, k)
+		}
+	}
+	return ok
+}
+
+// verifyIDToken checks the signature, issuer, audience, validity period and nonce of an ID token
+// and returns its claims
+func (p *oidcProvider) verifyIDToken(d *oidcDiscovery, raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %w", err)
+	}
+	key, err := p.key(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+	issuer := d.Issuer
+	if issuer == "" {
+		issuer = p.cfg.Issuer
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("id token issued by %q", iss)
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == p.cfg.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == p.cfg.ClientID {
+				audience = true
+			}
+		}
+	}
+	if !audience {
+		return nil, errors.New("id token not issued for this client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("id token expired")
+	}
+	// tokens issued or valid only in the future point to a wrong clock or a forged token
+	for _, c := range []string{"nbf", "iat"} {
+		if v, ok := claims[c].(float64); ok && time.Unix(int64(v), 0).After(time.Now().Add(oidcClockSkew)) {
+			return nil, fmt.Errorf("id token not valid yet (%s in the future)", c)
+		}
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the signing key of the IdP, the key set is read again once for unknown key
+// IDs as IdPs rotate their keys
+func (p *oidcProvider) key(d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	lookup := func() crypto.PublicKey {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if k, ok := p.keys[kid]; ok {
+			return k
+		}
+		// key sets with a single key may omit the key ID
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return nil
+	}
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc key set: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("id token signed with unknown key %q", kid)
+}
+
+// verifyJWTSignature checks a JWS signature of the RS, PS and ES algorithm families
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("id token algorithm %q not supported", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("id token algorithm %q not supported", alg)
+	}
+	hf := hash.New()
+	hf.Write([]byte(signed))
+	digest := hf.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") && len(sig)%2 == 0 {
+			r := new(big.Int).SetBytes(sig[:len(sig)/2])
+			s := new(big.Int).SetBytes(sig[len(sig)/2:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return errors.New("id token signature invalid")
+		}
+	}
+	return fmt.Errorf("id token algorithm %q does not match the key", alg)
+}
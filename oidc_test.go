@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		redirect string
+		want     string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/?tab=write", "/?tab=write"},
+		{"/index.html#token=x", "/index.html"},
+		{"/web/app.js", "/web/app.js"},
+		{"/web/../api/config", "/"},
+		{"/api/config", "/"},
+		{"//evil.example", "/"},
+		{"/\\evil.example", "/"},
+		{"/%5Cevil.example", "/"},
+		{"/%5cevil.example", "/"},
+		{"https://evil.example/", "/"},
+		{"javascript:alert(1)", "/"},
+		{"evil.example", "/"},
+		{"/\tevil.example", "/"},
+		{"/%0d%0aLocation:%20https://evil.example", "/"},
+	}
+	for _, tt := range tests {
+		if got := localRedirect(tt.redirect); got != tt.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", tt.redirect, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCDeriveToken(t *testing.T) {
+	p := newOIDCProvider(&OIDCConfig{Issuer: "https://idp.example"})
+	user := authUser{Name: "alice", Role: roleOperator.String(), role: roleOperator}
+	login, lt := p.issue(user, "login", time.Hour)
+
+	child, ct, err := p.derive(login, "ci", maxOIDCTokenTTL)
+	if err != nil {
+		t.Fatalf("derive from login: %v", err)
+	}
+	if !ct.expires.Equal(lt.expires) {
+		t.Errorf("derived token expires %s, want the login expiry %s", ct.expires, lt.expires)
+	}
+	if _, _, err := p.derive(child, "chained", time.Hour); err == nil {
+		t.Error("derive from a derived token succeeded")
+	}
+	if _, _, err := p.derive("unknown", "ci", time.Hour); err == nil {
+		t.Error("derive from an unknown token succeeded")
+	}
+
+	if !p.revoke(login) {
+		t.Fatal("revoke login failed")
+	}
+	if _, ok := p.lookup(child); ok {
+		t.Error("derived token survived the logout of its login")
+	}
+}
+
+func TestOIDCVerifyIDTokenTimes(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newOIDCProvider(&OIDCConfig{Issuer: "https://idp.example", ClientID: "tester"})
+	p.keys["k"] = &key.PublicKey
+	d := &oidcDiscovery{Issuer: "https://idp.example"}
+	sign := func(claims map[string]interface{}) string {
+		enc := func(v interface{}) string {
+			b, _ := json.Marshal(v)
+			return base64.RawURLEncoding.EncodeToString(b)
+		}
+		signed := enc(map[string]string{"alg": "ES256", "kid": "k"}) + "." + enc(claims)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name  string
+		extra map[string]interface{}
+		ok    bool
+	}{
+		{"valid", map[string]interface{}{"iat": now.Unix(), "nbf": now.Unix()}, true},
+		{"within skew", map[string]interface{}{"iat": now.Add(oidcClockSkew / 2).Unix()}, true},
+		{"issued in the future", map[string]interface{}{"iat": now.Add(time.Hour).Unix()}, false},
+		{"not valid yet", map[string]interface{}{"iat": now.Unix(), "nbf": now.Add(time.Hour).Unix()}, false},
+	}
+	for _, tt := range tests {
+		claims := map[string]interface{}{"iss": "https://idp.example", "aud": "tester", "exp": now.Add(time.Hour).Unix(), "nonce": "n"}
+		for k, v := range tt.extra {
+			claims[k] = v
+		}
+		_, err := p.verifyIDToken(d, sign(claims), "n")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
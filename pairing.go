@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// maxPairingTransitions is the number of pairing state changes kept per SKI
+const maxPairingTransitions = 200
+
+// repairDelay is the time between unpairing and pairing again, so the
+// remote service sees the closed connection first
+const repairDelay = 2 * time.Second
+
+// connectionStateNames are the API names of the ship-go connection states
+var connectionStateNames = map[shipapi.ConnectionState]string{
+	shipapi.ConnectionStateNone:                   "none",
+	shipapi.ConnectionStateQueued:                 "queued",
+	shipapi.ConnectionStateInitiated:              "initiated",
+	shipapi.ConnectionStateReceivedPairingRequest: "receivedPairingRequest",
+	shipapi.ConnectionStateInProgress:             "inProgress",
+	shipapi.ConnectionStateTrusted:                "trusted",
+	shipapi.ConnectionStatePin:                    "pin",
+	shipapi.ConnectionStateCompleted:              "completed",
+	shipapi.ConnectionStateRemoteDeniedTrust:      "remoteDeniedTrust",
+	shipapi.ConnectionStateError:                  "error",
+}
+
+func connectionStateName(state shipapi.ConnectionState) string {
+	if name, ok := connectionStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
+// pairingTransition is a single ConnectionStateDetail update of a SKI
+type pairingTransition struct {
+	Time  time.Time `json:"time"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	// Action is set for transitions caused by the pairing API (pair, unpair, repair)
+	Action string `json:"action,omitempty"`
+	// SincePreviousSeconds is the time since the previous transition of the SKI
+	SincePreviousSeconds *float64 `json:"sincePreviousSeconds,omitempty"`
+	// SinceStartSeconds is the time since the pairing attempt started, i.e. the API action
+	// or the first state after none, error or remoteDeniedTrust
+	SinceStartSeconds *float64 `json:"sinceStartSeconds,omitempty"`
+}
+
+// pairingAttemptEnded reports whether a new pairing attempt starts after the state
+func pairingAttemptEnded(state string) bool {
+	return state == "" || state == "none" || state == "error" || state == "remoteDeniedTrust"
+}
+
+// pairingTracker records the pairing state changes per SKI
+type pairingTracker struct {
+	mu      sync.Mutex
+	history map[string][]pairingTransition
+	// started is the start of the current pairing attempt per SKI
+	started map[string]time.Time
+}
+
+func newPairingTracker() *pairingTracker {
+	return &pairingTracker{history: make(map[string][]pairingTransition), started: make(map[string]time.Time)}
+}
+
+// add appends a transition with its timing and returns it with the previous one. Updates
+// repeating the previous state and error are dropped, ok is false for them.
+func (t *pairingTracker) add(ski string, tr pairingTransition) (added, previous pairingTransition, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ski = shiputil.NormalizeSKI(ski)
+	list := t.history[ski]
+	if len(list) > 0 {
+		previous = list[len(list)-1]
+		if tr.Action == "" && previous.Action == "" && previous.State == tr.State && previous.Error == tr.Error {
+			return tr, previous, false
+		}
+		since := tr.Time.Sub(previous.Time).Seconds()
+		tr.SincePreviousSeconds = &since
+	}
+	if tr.Action != "" || pairingAttemptEnded(previous.State) {
+		t.started[ski] = tr.Time
+	} else if start, found := t.started[ski]; found {
+		since := tr.Time.Sub(start).Seconds()
+		tr.SinceStartSeconds = &since
+	}
+	list = append(list, tr)
+	if len(list) > maxPairingTransitions {
+		list = list[len(list)-maxPairingTransitions:]
+	}
+	t.history[ski] = list
+	return tr, previous, true
+}
+
+// trackPairingDetail records a pairing detail update of ship-go as `pairing` timeline
+// event and broadcasts it as {"type":"pairing","ski":..,"transition":{..}}
+func (h *hems) trackPairingDetail(ski string, detail *shipapi.ConnectionStateDetail) {
+	tr := pairingTransition{Time: time.Now(), State: connectionStateName(detail.State())}
+	if err := detail.Error(); err != nil {
+		tr.Error = err.Error()
+	}
+	tr, previous, ok := h.pairing.add(ski, tr)
+	if !ok {
+		return
+	}
+
+	msg := "pairing state " + tr.State
+	if previous.State != "" {
+		msg = fmt.Sprintf("pairing state %s -> %s", previous.State, tr.State)
+	}
+	if tr.SinceStartSeconds != nil {
+		msg += fmt.Sprintf(" after %.1f s", *tr.SinceStartSeconds)
+	}
+	severity := severityInfo
+	if tr.Error != "" {
+		msg += ": " + tr.Error
+	}
+	if tr.State == "error" || tr.State == "remoteDeniedTrust" {
+		severity = severityWarning
+	}
+	data := map[string]interface{}{"state": tr.State, "previous": previous.State}
+	if tr.Error != "" {
+		data["error"] = tr.Error
+	}
+	if tr.SinceStartSeconds != nil {
+		data["sinceStartSeconds"] = *tr.SinceStartSeconds
+	}
+	h.recordEvent("pairing", severity, ski, msg, data)
+	h.broadcastJSON(map[string]interface{}{"type": "pairing", "ski": shiputil.NormalizeSKI(ski), "transition": tr})
+}
+
+// markPairingAction records a pairing API action in the transition history
+func (h *hems) markPairingAction(ski, action string) {
+	tr := pairingTransition{Time: time.Now(), Action: action}
+	if detail := h.myService.PairingDetailForSki(ski); detail != nil {
+		tr.State = connectionStateName(detail.State())
+	}
+	h.pairing.add(ski, tr)
+}
+
+// unpairSKI drops the trust of a SKI and closes its connection
+func (h *hems) unpairSKI(ski string) {
+	h.markPairingAction(ski, "unpair")
+	h.myService.CancelPairingWithSKI(ski)
+	h.myService.UnregisterRemoteSKI(ski)
+	h.forgetAutoAccept(ski)
+	h.forgetShipID(ski)
+	h.recordEvent("trust", severityInfo, ski, "SKI unpaired via API", nil)
+}
+
+// pairSKI trusts a SKI and initiates the connection
+func (h *hems) pairSKI(ski string) error {
+	if ok, reason := h.skiPermitted(ski); !ok {
+		return fmt.Errorf("%s", reason)
+	}
+	h.markPairingAction(ski, "pair")
+	h.myService.RegisterRemoteSKI(ski, "")
+	h.recordEvent("trust", severityInfo, ski, "pairing initiated via API", nil)
+	return nil
+}
+
+// repairSKI unpairs a SKI and pairs it again after a short delay, e.g. after a DUT factory reset
+func (h *hems) repairSKI(ski string) error {
+	if ok, reason := h.skiPermitted(ski); !ok {
+		return fmt.Errorf("%s", reason)
+	}
+	h.unpairSKI(ski)
+	go func() {
+		time.Sleep(repairDelay)
+		if err := h.pairSKI(ski); err != nil {
+			h.Errorf("re-pair %s: %v", ski, err)
+		}
+	}()
+	return nil
+}
+
+// getPairing returns the current pairing state and the transition history of a SKI
+func (h *hems) getPairing(ski string) map[string]interface{} {
+	ski = shiputil.NormalizeSKI(ski)
+	out := map[string]interface{}{"ski": ski}
+	if detail := h.myService.PairingDetailForSki(ski); detail != nil {
+		out["state"] = connectionStateName(detail.State())
+		if err := detail.Error(); err != nil {
+			out["error"] = err.Error()
+		}
+	}
+	if service := h.myService.RemoteServiceForSKI(ski); service != nil {
+		out["trusted"] = service.Trusted()
+	}
+
+	h.pairing.mu.Lock()
+	out["transitions"] = append([]pairingTransition{}, h.pairing.history[ski]...)
+	h.pairing.mu.Unlock()
+	return out
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// maxProfilePoints is the maximum number of limit writes of a profile
+const maxProfilePoints = 10000
+
+// limitProfilePoint is a limit of an uploaded profile, written offsetSeconds after the
+// replay started
+type limitProfilePoint struct {
+	OffsetSeconds float64 `json:"offsetSeconds"`
+	// Time is an alternative to OffsetSeconds, the offsets are relative to the first point
+	Time   *time.Time `json:"time,omitempty"`
+	Value  float64    `json:"value"`
+	Active *bool      `json:"active,omitempty"`
+	// DurationSeconds is the limit duration, 0 for an indefinite limit
+	DurationSeconds int64 `json:"durationSeconds,omitempty"`
+}
+
+// limitProfile is the JSON form of a profile
+type limitProfile struct {
+	Name   string              `json:"name,omitempty"`
+	Points []limitProfilePoint `json:"points"`
+}
+
+// parseLimitProfile reads a profile from JSON or CSV. JSON is an object with "points"
+// or a plain array of points. CSV rows are "offset or RFC 3339 time,value[,active[,durationSeconds]]",
+// a header row and empty lines are skipped.
+func parseLimitProfile(body []byte, contentType string) (limitProfile, error) {
+	var p limitProfile
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case strings.Contains(contentType, "json") || bytes.HasPrefix(trimmed, []byte("{")):
+		if err := json.Unmarshal(trimmed, &p); err != nil {
+			return p, fmt.Errorf("invalid json: %v", err)
+		}
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &p.Points); err != nil {
+			return p, fmt.Errorf("invalid json: %v", err)
+		}
+	default:
+		points, err := parseLimitProfileCSV(trimmed)
+		if err != nil {
+			return p, err
+		}
+		p.Points = points
+	}
+	if err := p.normalize(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// readLimitProfile parses the profile uploaded in the request body
+func readLimitProfile(r *http.Request) (limitProfile, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return limitProfile{}, fmt.Errorf("read body: %v", err)
+	}
+	return parseLimitProfile(body, r.Header.Get("Content-Type"))
+}
+
+func parseLimitProfileCSV(body []byte) ([]limitProfilePoint, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	var points []limitProfilePoint
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %v", err)
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("line %d: time and value required", line)
+		}
+		var pt limitProfilePoint
+		if offset, err := strconv.ParseFloat(rec[0], 64); err == nil {
+			pt.OffsetSeconds = offset
+		} else if t, err := time.Parse(time.RFC3339, rec[0]); err == nil {
+			pt.Time = &t
+		} else if line == 1 {
+			// header row
+			continue
+		} else {
+			return nil, fmt.Errorf("line %d: %q is neither an offset in seconds nor an RFC 3339 time", line, rec[0])
+		}
+		value, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q", line, rec[1])
+		}
+		pt.Value = value
+		if len(rec) > 2 && rec[2] != "" {
+			active, err := strconv.ParseBool(rec[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid active flag %q", line, rec[2])
+			}
+			pt.Active = &active
+		}
+		if len(rec) > 3 && rec[3] != "" {
+			d, err := strconv.ParseInt(rec[3], 10, 64)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("line %d: invalid duration %q", line, rec[3])
+			}
+			pt.DurationSeconds = d
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// normalize converts times to offsets, sorts the points and validates them
+func (p *limitProfile) normalize() error {
+	if len(p.Points) == 0 {
+		return errors.New("the profile has no points")
+	}
+	if len(p.Points) > maxProfilePoints {
+		return fmt.Errorf("the profile has more than %d points", maxProfilePoints)
+	}
+	var first *time.Time
+	for _, pt := range p.Points {
+		if pt.Time != nil && (first == nil || pt.Time.Before(*first)) {
+			first = pt.Time
+		}
+	}
+	for i := range p.Points {
+		pt := &p.Points[i]
+		if pt.Time != nil {
+			pt.OffsetSeconds = pt.Time.Sub(*first).Seconds()
+		} else if first != nil {
+			return errors.New("points must either all have a time or all have an offset")
+		}
+		if pt.OffsetSeconds < 0 || pt.Value < 0 || pt.DurationSeconds < 0 {
+			return fmt.Errorf("point %d: offset, value and duration must not be negative", i+1)
+		}
+	}
+	sort.SliceStable(p.Points, func(i, j int) bool { return p.Points[i].OffsetSeconds < p.Points[j].OffsetSeconds })
+	return nil
+}
+
+// profileWrite is a replayed point and the result of its write
+type profileWrite struct {
+	limitProfilePoint
+	ScheduledAt time.Time    `json:"scheduledAt"`
+	SentAt      *time.Time   `json:"sentAt,omitempty"`
+	Command     string       `json:"command,omitempty"`
+	State       commandState `json:"state,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	// AckSeconds is the time from executing the write until the DUT answered
+	AckSeconds *float64 `json:"ackSeconds,omitempty"`
+}
+
+// profileRun is an active or finished profile replay
+type profileRun struct {
+	Name      string     `json:"name,omitempty"`
+	SKI       string     `json:"ski"`
+	Usecase   string     `json:"usecase"`
+	Speed     float64    `json:"speed"`
+	Running   bool       `json:"running"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	// Next is the index of the next point to write
+	Next       int             `json:"next"`
+	Writes     []profileWrite  `json:"writes"`
+	Assertions []testAssertion `json:"assertions"`
+	Passed     bool            `json:"passed"`
+	Error      string          `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished replay
+	ResultID string `json:"resultId,omitempty"`
+
+	stop     chan struct{}
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// profileState holds the current or last profile replay
+type profileState struct {
+	mu  sync.Mutex
+	run *profileRun
+}
+
+// startProfile replays the profile as limit writes in the background. speed > 1 replays
+// faster than recorded, restore deactivates the limit after the last point.
+func (h *hems) startProfile(p limitProfile, ski, usecase string, speed float64, restore bool, meta *testRunMetadata) (*profileRun, error) {
+	ski = shiputil.NormalizeSKI(ski)
+	if ski == "" {
+		return nil, errors.New("ski is required")
+	}
+	switch usecase {
+	case "", "lpc":
+		usecase = "lpc"
+		if h.uceglpc == nil {
+			return nil, errors.New("LPC usecase is disabled")
+		}
+	case "lpp":
+		if h.uceglpp == nil {
+			return nil, errors.New("LPP usecase is disabled")
+		}
+	default:
+		return nil, errors.New("usecase must be lpc or lpp")
+	}
+	if speed < 0 {
+		return nil, errors.New("speed must be positive")
+	}
+	if speed == 0 {
+		speed = 1
+	}
+	now := time.Now()
+	run := &profileRun{
+		Name:      p.Name,
+		SKI:       ski,
+		Usecase:   usecase,
+		Speed:     speed,
+		Running:   true,
+		StartedAt: now,
+		Metadata:  meta,
+		stop:      make(chan struct{}),
+	}
+	for _, pt := range p.Points {
+		at := now.Add(time.Duration(pt.OffsetSeconds / speed * float64(time.Second)))
+		run.Writes = append(run.Writes, profileWrite{limitProfilePoint: pt, ScheduledAt: at})
+	}
+
+	h.profiles.mu.Lock()
+	if h.profiles.run != nil && h.profiles.run.Running {
+		h.profiles.mu.Unlock()
+		return nil, errors.New("a profile replay is already running")
+	}
+	h.profiles.run = run
+	snap := copyProfileRun(run)
+	h.profiles.mu.Unlock()
+
+	go h.runProfile(run, restore)
+	last := p.Points[len(p.Points)-1].OffsetSeconds / speed
+	h.recordEvent("profile", severityInfo, ski, fmt.Sprintf("%s profile replay started: %d points over %.0f s", usecase, len(p.Points), last), nil)
+	return snap, nil
+}
+
+// stopProfile aborts the running replay, it returns false if none is running
+func (h *hems) stopProfile() bool {
+	h.profiles.mu.Lock()
+	defer h.profiles.mu.Unlock()
+	run := h.profiles.run
+	if run == nil || !run.Running {
+		return false
+	}
+	select {
+	case <-run.stop:
+	default:
+		close(run.stop)
+	}
+	return true
+}
+
+func (h *hems) runProfile(run *profileRun, restore bool) {
+	span := h.tracer.startSpan("test profile/"+run.Usecase, spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	cmd, write := "writeLPCConsumptionLimit", h.WriteLPCConsumptionLimit
+	if run.Usecase == "lpp" {
+		cmd, write = "writeLPPProductionLimit", h.WriteLPPProductionLimit
+	}
+
+	errText := ""
+	var wg sync.WaitGroup
+	for i := range run.Writes {
+		h.profiles.mu.Lock()
+		pt := run.Writes[i]
+		h.profiles.mu.Unlock()
+		timer := time.NewTimer(time.Until(pt.ScheduledAt))
+		select {
+		case <-run.stop:
+			timer.Stop()
+			errText = fmt.Sprintf("stopped after %d of %d points", i, len(run.Writes))
+		case <-timer.C:
+		}
+		if errText != "" {
+			break
+		}
+
+		active := pt.Active == nil || *pt.Active
+		value, duration := pt.Value, pt.DurationSeconds
+		payload := map[string]interface{}{"ski": run.SKI, "value": value, "isActive": active, "durationSeconds": float64(duration)}
+		c, err := h.enqueueCommand(cmd, payload, nil, func() ([]sentMessage, error) {
+			return write(run.SKI, duration, value, active)
+		})
+		now := time.Now()
+		h.profiles.mu.Lock()
+		w := &run.Writes[i]
+		w.SentAt = &now
+		run.Next = i + 1
+		if c != nil {
+			w.Command = c.ID
+		}
+		if err != nil {
+			w.State, w.Error = commandFailed, err.Error()
+		}
+		h.profiles.mu.Unlock()
+		h.broadcastProfile()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c *command) {
+			defer wg.Done()
+			<-c.done
+			snap, _ := h.getCommand(c.ID)
+			h.profiles.mu.Lock()
+			w := &run.Writes[i]
+			w.State, w.Error = snap.State, snap.Error
+			if !snap.startedAt.IsZero() && snap.State != commandFailed {
+				s := snap.UpdatedAt.Sub(snap.startedAt).Seconds()
+				w.AckSeconds = &s
+			}
+			h.profiles.mu.Unlock()
+		}(i, c)
+	}
+	wg.Wait()
+
+	if restore {
+		last := run.Writes[len(run.Writes)-1]
+		payload := map[string]interface{}{"ski": run.SKI, "value": last.Value, "isActive": false, "durationSeconds": 0}
+		if _, err := h.enqueueCommand(cmd, payload, nil, func() ([]sentMessage, error) {
+			return write(run.SKI, 0, last.Value, false)
+		}); err != nil {
+			h.Errorf("profile replay: restore limit: %v", err)
+		}
+	}
+
+	now := time.Now()
+	h.profiles.mu.Lock()
+	acked, written := 0, 0
+	var failures []string
+	for i, w := range run.Writes {
+		if w.SentAt == nil {
+			continue
+		}
+		written++
+		if w.State == commandAcknowledged {
+			acked++
+		} else if len(failures) < 5 {
+			failures = append(failures, fmt.Sprintf("point %d at %.0f s: %s", i+1, w.OffsetSeconds, w.State))
+		}
+	}
+	msg := fmt.Sprintf("%d of %d writes acknowledged", acked, written)
+	if len(failures) > 0 {
+		msg += ", " + strings.Join(failures, ", ")
+	}
+	run.Assertions = append(run.Assertions, testAssertion{Name: "all writes acknowledged", Passed: acked == written, Message: msg})
+	run.Running = false
+	run.EndedAt = &now
+	run.Error = errText
+	run.Passed = errText == "" && acked == written
+	passed := run.Passed
+	result := profileResult(run)
+	h.profiles.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("profile replay: %v", err)
+	} else {
+		h.profiles.mu.Lock()
+		run.ResultID = result.ID
+		h.profiles.mu.Unlock()
+	}
+	h.broadcastProfile()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("profile replay %s", verdict)
+	h.recordEvent("profile", severity, run.SKI, "profile replay "+verdict+": "+msg, nil)
+}
+
+// profileResult converts a finished replay to a stored test run
+func profileResult(run *profileRun) *testRunResult {
+	res := &testRunResult{Plan: "profile/" + run.Usecase, SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	res.Assertions = append(res.Assertions, run.Assertions...)
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyProfileRun(run *profileRun) *profileRun {
+	c := *run
+	c.Writes = append([]profileWrite(nil), run.Writes...)
+	c.Assertions = append([]testAssertion(nil), run.Assertions...)
+	return &c
+}
+
+// getProfile returns a copy of the current or last profile replay
+func (h *hems) getProfile() *profileRun {
+	h.profiles.mu.Lock()
+	defer h.profiles.mu.Unlock()
+	if h.profiles.run == nil {
+		return nil
+	}
+	return copyProfileRun(h.profiles.run)
+}
+
+// broadcastProfile sends the progress of the replay to all websocket clients, the writes
+// are left out and available via the API
+func (h *hems) broadcastProfile() {
+	run := h.getProfile()
+	if run == nil {
+		return
+	}
+	run.Writes = nil
+	h.broadcastJSON(map[string]interface{}{
+		"type":    "profile",
+		"ski":     run.SKI,
+		"profile": run,
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitsConfig configures request limits for the web API
+type LimitsConfig struct {
+	// RequestsPerSecond limits all /api/* requests per client, 0 disables the limit
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	// Burst is the number of requests a client may issue at once, defaults to 2x the rate
+	Burst int `json:"burst,omitempty"`
+	// WritesPerSecond additionally limits state changing requests (POST/PUT/DELETE) per client
+	WritesPerSecond float64 `json:"writesPerSecond,omitempty"`
+	// MaxBodyBytes is the maximum size of a request body, defaults to 1 MiB
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+	// MaxWebsocketsPerClient limits concurrent websocket connections per client, 0 disables the limit
+	MaxWebsocketsPerClient int `json:"maxWebsocketsPerClient,omitempty"`
+	// WebsocketQueueSize is the number of messages buffered per websocket client, defaults to 1024
+	WebsocketQueueSize int `json:"websocketQueueSize,omitempty"`
+	// SlowWebsocketPolicy is applied when the queue of a client is full: "disconnect" (default) or "drop"
+	SlowWebsocketPolicy string `json:"slowWebsocketPolicy,omitempty"`
+}
+
+const defaultMaxBodyBytes = 1 << 20
+
+func (c LimitsConfig) maxBodyBytes() int64 {
+	if c.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+// tokenBucket is a simple token bucket rate limiter
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	rate     float64
+	capacity float64
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	capacity := float64(burst)
+	if capacity <= 0 {
+		capacity = math.Max(1, math.Ceil(rate*2))
+	}
+	return &tokenBucket{tokens: capacity, last: time.Now(), rate: rate, capacity: capacity}
+}
+
+// allow takes a token from the bucket and returns false together with the
+// time until the next token is available if the bucket is empty
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// rateLimiter keeps one token bucket per client
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	clients map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, clients: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// drop clients that have been idle long enough to have a full bucket again
+	if len(l.clients) > 1000 {
+		for k, b := range l.clients {
+			if now.Sub(b.last) > 10*time.Minute {
+				delete(l.clients, k)
+			}
+		}
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst)
+		l.clients[client] = b
+	}
+	return b.allow(now)
+}
+
+// clientKey identifies the client of a request by its remote IP
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitRequests applies the configured rate and body size limits to all /api/* requests
+func (h *hems) limitRequests(next http.Handler) http.Handler {
+	var cfg LimitsConfig
+	if h.config != nil {
+		cfg = h.config.Limits
+	}
+
+	var all, writes *rateLimiter
+	if cfg.RequestsPerSecond > 0 {
+		all = newRateLimiter(cfg.RequestsPerSecond, cfg.Burst)
+	}
+	if cfg.WritesPerSecond > 0 {
+		writes = newRateLimiter(cfg.WritesPerSecond, 0)
+	}
+	maxBody := cfg.maxBodyBytes()
+
+	tooMany := func(w http.ResponseWriter, wait time.Duration) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeAPIError(w, http.StatusTooManyRequests, errCodeRateLimited, "rate limit exceeded")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := clientKey(r)
+		if all != nil {
+			if ok, wait := all.allow(client); !ok {
+				tooMany(w, wait)
+				return
+			}
+		}
+		if writes != nil && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if ok, wait := writes.allow(client); !ok {
+				h.Infof("write rate limit exceeded for client %s: %s %s", client, r.Method, r.URL.Path)
+				tooMany(w, wait)
+				return
+			}
+		}
+
+		if r.ContentLength > maxBody {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquireWebsocketSlot reserves a websocket connection for a client and
+// returns false if the client already has the maximum number of connections
+func (h *hems) acquireWebsocketSlot(client string) bool {
+	max := 0
+	if h.config != nil {
+		max = h.config.Limits.MaxWebsocketsPerClient
+	}
+
+	h.wsMu.Lock()
+	defer h.wsMu.Unlock()
+	if h.wsPerClient == nil {
+		h.wsPerClient = make(map[string]int)
+	}
+	if max > 0 && h.wsPerClient[client] >= max {
+		return false
+	}
+	h.wsPerClient[client]++
+	return true
+}
+
+// releaseWebsocketSlot frees a websocket connection slot of a client
+func (h *hems) releaseWebsocketSlot(client string) {
+	h.wsMu.Lock()
+	defer h.wsMu.Unlock()
+	if h.wsPerClient[client] <= 1 {
+		delete(h.wsPerClient, client)
+		return
+	}
+	h.wsPerClient[client]--
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxReadinessRuns is the number of connections kept per peer
+const maxReadinessRuns = 100
+
+// readinessRun is the time to ready of a single connection of a peer, measured from
+// the start of the connection setup (TCP connect for outgoing connections)
+type readinessRun struct {
+	SKI         string    `json:"ski"`
+	Direction   string    `json:"direction"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// DiscoveryMs is the time until the detailed discovery completed
+	DiscoveryMs float64 `json:"discoveryMs"`
+	// UsecasesMs is the time until each use case was first reported as supported
+	UsecasesMs map[string]float64 `json:"usecasesMs"`
+	// ReadyMs is the time until the last of these use cases was reported as supported
+	ReadyMs *float64 `json:"readyMs,omitempty"`
+	// Active is set while the connection is up
+	Active bool `json:"active"`
+}
+
+// readinessStats summarizes the time to ready of the connections of a peer
+type readinessStats struct {
+	SKI         string                  `json:"ski"`
+	Connections int                     `json:"connections"`
+	Discovery   latencyStats            `json:"discovery"`
+	Usecases    map[string]latencyStats `json:"usecases"`
+	Ready       latencyStats            `json:"ready"`
+	// Last is the current or last connection
+	Last *readinessRun `json:"last,omitempty"`
+}
+
+// readinessTracker times the DUTs from connection setup to discovery and use case support
+type readinessTracker struct {
+	mu   sync.Mutex
+	runs map[string][]*readinessRun
+}
+
+func newReadinessTracker() *readinessTracker {
+	return &readinessTracker{runs: make(map[string][]*readinessRun)}
+}
+
+// active returns the run of the current connection, the caller holds the lock
+func (t *readinessTracker) active(ski string) *readinessRun {
+	runs := t.runs[ski]
+	if len(runs) == 0 || !runs[len(runs)-1].Active {
+		return nil
+	}
+	return runs[len(runs)-1]
+}
+
+func (r *readinessRun) copy() readinessRun {
+	c := *r
+	c.UsecasesMs = make(map[string]float64, len(r.UsecasesMs))
+	for name, ms := range r.UsecasesMs {
+		c.UsecasesMs[name] = ms
+	}
+	if r.ReadyMs != nil {
+		v := *r.ReadyMs
+		c.ReadyMs = &v
+	}
+	return c
+}
+
+// readinessDiscovered opens the readiness run of a connection whose setup completed
+// with the detailed discovery
+func (h *hems) readinessDiscovered(run *handshakeRun) {
+	if h.readiness == nil {
+		return
+	}
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+	if prev := h.readiness.active(run.SKI); prev != nil {
+		prev.Active = false
+	}
+	runs := append(h.readiness.runs[run.SKI], &readinessRun{
+		SKI:         run.SKI,
+		Direction:   run.Direction,
+		ConnectedAt: run.StartedAt,
+		DiscoveryMs: run.TotalMs,
+		UsecasesMs:  make(map[string]float64),
+		Active:      true,
+	})
+	if len(runs) > maxReadinessRuns {
+		runs = runs[len(runs)-maxReadinessRuns:]
+	}
+	h.readiness.runs[run.SKI] = runs
+}
+
+// readinessUsecase records the first support of a use case on the current connection
+// and returns the time since the connection start
+func (h *hems) readinessUsecase(ski, name string, now time.Time) (float64, bool) {
+	if h.readiness == nil {
+		return 0, false
+	}
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+	run := h.readiness.active(ski)
+	if run == nil {
+		return 0, false
+	}
+	if _, ok := run.UsecasesMs[name]; ok {
+		return 0, false
+	}
+	ms := float64(now.Sub(run.ConnectedAt)) / float64(time.Millisecond)
+	run.UsecasesMs[name] = ms
+	if run.ReadyMs == nil || ms > *run.ReadyMs {
+		run.ReadyMs = &ms
+	}
+	return ms, true
+}
+
+// readinessDisconnected closes the run of the connection
+func (h *hems) readinessDisconnected(ski string) {
+	if h.readiness == nil {
+		return
+	}
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+	if run := h.readiness.active(ski); run != nil {
+		run.Active = false
+	}
+}
+
+// summarizeReadiness computes the statistics of the runs of a peer, the caller holds the lock
+func summarizeReadiness(ski string, runs []*readinessRun) readinessStats {
+	stats := readinessStats{SKI: ski, Connections: len(runs), Usecases: make(map[string]latencyStats)}
+	var discovery, ready []float64
+	usecases := make(map[string][]float64)
+	for _, r := range runs {
+		discovery = append(discovery, r.DiscoveryMs)
+		if r.ReadyMs != nil {
+			ready = append(ready, *r.ReadyMs)
+		}
+		for name, ms := range r.UsecasesMs {
+			usecases[name] = append(usecases[name], ms)
+		}
+	}
+	for name, samples := range usecases {
+		stats.Usecases[name] = computeLatencyStats(samples)
+	}
+	stats.Discovery = computeLatencyStats(discovery)
+	stats.Ready = computeLatencyStats(ready)
+	if len(runs) > 0 {
+		last := runs[len(runs)-1].copy()
+		stats.Last = &last
+	}
+	return stats
+}
+
+// getReadinessStats returns the time to discovery and to use case support per peer
+func (h *hems) getReadinessStats(ski string) map[string]readinessStats {
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+
+	out := make(map[string]readinessStats)
+	for key, runs := range h.readiness.runs {
+		if ski != "" && key != ski {
+			continue
+		}
+		out[key] = summarizeReadiness(key, runs)
+	}
+	return out
+}
+
+// readinessOf returns the statistics of the connections of a peer set up between from
+// and to, false if there were none
+func (h *hems) readinessOf(ski string, from, to time.Time) (readinessStats, bool) {
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+
+	var runs []*readinessRun
+	for _, r := range h.readiness.runs[ski] {
+		if !r.ConnectedAt.Before(from) && !r.ConnectedAt.After(to) {
+			runs = append(runs, r)
+		}
+	}
+	if len(runs) == 0 {
+		return readinessStats{}, false
+	}
+	return summarizeReadiness(ski, runs), true
+}
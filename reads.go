@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	"github.com/enbility/eebus-go/features/client"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	shiputil "github.com/enbility/ship-go/util"
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// errNoEntity is returned if no remote entity supports the usecase
+var errNoEntity = errors.New("no remote entity supports the usecase")
+
+// readRequest is a single read of a remote feature
+type readRequest struct {
+	name    string
+	feature responseCallbackFeature
+	send    func() (*model.MsgCounterType, error)
+}
+
+// featureRead returns the read request of a remote feature, err is the error of creating the feature helper
+func featureRead(name string, feature responseCallbackFeature, err error, send func() (*model.MsgCounterType, error)) readRequest {
+	if err != nil {
+		return readRequest{name: name}
+	}
+	return readRequest{name: name, feature: feature, send: send}
+}
+
+// readFeatures sends all read requests in parallel and waits for their replies.
+// It returns the errors per request name, requests without an error got a reply.
+func (h *hems) readFeatures(requests []readRequest) map[string]string {
+	var mu sync.Mutex
+	errs := make(map[string]string)
+	var wg sync.WaitGroup
+	for _, req := range requests {
+		wg.Add(1)
+		go func(req readRequest) {
+			defer wg.Done()
+			if err := h.readFeature(req); err != nil {
+				mu.Lock()
+				errs[req.name] = err.Error()
+				mu.Unlock()
+			}
+		}(req)
+	}
+	wg.Wait()
+	return errs
+}
+
+// readFeature sends a read request and waits for the reply. A result instead
+// of a reply means the DUT rejected the read.
+func (h *hems) readFeature(req readRequest) error {
+	if req.feature == nil {
+		return errors.New("feature not available")
+	}
+	msgCounter, err := req.send()
+	if err != nil {
+		return err
+	}
+	msg, err := h.awaitResponse(req.feature, msgCounter)
+	if err != nil {
+		return err
+	}
+	if result, ok := msg.Data.(*model.ResultDataType); ok && result != nil {
+		if result.ErrorNumber != nil && *result.ErrorNumber != model.ErrorNumberTypeNoError {
+			description := ""
+			if result.Description != nil {
+				description = string(*result.Description)
+			}
+			return fmt.Errorf("read rejected with error %d: %s", *result.ErrorNumber, description)
+		}
+	}
+	return nil
+}
+
+// remoteEntities returns the remote entities of the usecase scenarios, optionally only those of one SKI
+func remoteEntities(scenarios []api.RemoteEntityScenarios, ski string) []spineapi.EntityRemoteInterface {
+	ski = shiputil.NormalizeSKI(ski)
+	var out []spineapi.EntityRemoteInterface
+	for _, s := range scenarios {
+		if s.Entity == nil || s.Entity.Device() == nil {
+			continue
+		}
+		if ski != "" && shiputil.NormalizeSKI(s.Entity.Device().Ski()) != ski {
+			continue
+		}
+		out = append(out, s.Entity)
+	}
+	return out
+}
+
+// lpcLimitReading is the active consumption limit read from the DUT
+type lpcLimitReading struct {
+	Active          bool    `json:"active"`
+	Changeable      bool    `json:"changeable"`
+	Value           float64 `json:"value"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Indefinite is set for limits without a time period
+	Indefinite bool `json:"indefinite"`
+}
+
+// lpcReading is the LPC data read from one remote entity
+type lpcReading struct {
+	SKI               string            `json:"ski"`
+	Entity            string            `json:"entity"`
+	ReadAt            time.Time         `json:"readAt"`
+	ConsumptionLimit  *lpcLimitReading  `json:"consumptionLimit"`
+	NominalMax        *float64          `json:"consumptionNominalMax"`
+	FailsafePower     *float64          `json:"failsafeConsumptionActivePowerLimit"`
+	FailsafeDurationS *float64          `json:"failsafeDurationMinimumSeconds"`
+	Errors            map[string]string `json:"errors,omitempty"`
+}
+
+// readLPC actively reads the consumption limit, nominal max and failsafe values
+// of all LPC entities of the DUT, optionally only those of one SKI
+func (h *hems) readLPC(ski string) ([]lpcReading, error) {
+	if h.uceglpc == nil {
+		return nil, errors.New("LPC usecase is disabled")
+	}
+	entities := remoteEntities(h.uceglpc.RemoteEntitiesScenarios(), ski)
+	if len(entities) == 0 {
+		return nil, errNoEntity
+	}
+	localEntity := h.usecaseEntity("lpc")
+
+	readings := make([]lpcReading, len(entities))
+	var wg sync.WaitGroup
+	for i, entity := range entities {
+		wg.Add(1)
+		go func(i int, entity spineapi.EntityRemoteInterface) {
+			defer wg.Done()
+			readings[i] = h.readLPCEntity(localEntity, entity)
+		}(i, entity)
+	}
+	wg.Wait()
+	return readings, nil
+}
+
+func (h *hems) readLPCEntity(localEntity spineapi.EntityLocalInterface, entity spineapi.EntityRemoteInterface) lpcReading {
+	lc, lcErr := client.NewLoadControl(localEntity, entity)
+	dc, dcErr := client.NewDeviceConfiguration(localEntity, entity)
+	ec, ecErr := client.NewElectricalConnection(localEntity, entity)
+	requests := []readRequest{
+		featureRead("loadControlLimitListData", lc, lcErr, func() (*model.MsgCounterType, error) {
+			return lc.RequestLimitData(nil, nil)
+		}),
+		featureRead("deviceConfigurationKeyValueListData", dc, dcErr, func() (*model.MsgCounterType, error) {
+			return dc.RequestKeyValues(nil, nil)
+		}),
+		featureRead("electricalConnectionCharacteristicListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestCharacteristics(nil, nil)
+		}),
+	}
+
+	errs := h.readFeatures(requests)
+	reading := lpcReading{
+		SKI:    entity.Device().Ski(),
+		Entity: fmt.Sprint(entity.Address()),
+		ReadAt: time.Now(),
+		Errors: errs,
+	}
+
+	// the replies updated the remote feature data, the usecase getters interpret it
+	if limit, err := h.uceglpc.ConsumptionLimit(entity); err == nil {
+		reading.ConsumptionLimit = &lpcLimitReading{
+			Active:          limit.IsActive,
+			Changeable:      limit.IsChangeable,
+			Value:           limit.Value,
+			DurationSeconds: limit.Duration.Seconds(),
+			Indefinite:      limit.Duration == 0,
+		}
+	} else if _, ok := errs["loadControlLimitListData"]; !ok {
+		errs["consumptionLimit"] = err.Error()
+	}
+	if nominal, err := h.uceglpc.ConsumptionNominalMax(entity); err == nil {
+		reading.NominalMax = &nominal
+	} else if _, ok := errs["electricalConnectionCharacteristicListData"]; !ok {
+		errs["consumptionNominalMax"] = err.Error()
+	}
+	if power, err := h.uceglpc.FailsafeConsumptionActivePowerLimit(entity); err == nil {
+		reading.FailsafePower = &power
+	} else if _, ok := errs["deviceConfigurationKeyValueListData"]; !ok {
+		errs["failsafeConsumptionActivePowerLimit"] = err.Error()
+	}
+	if duration, err := h.uceglpc.FailsafeDurationMinimum(entity); err == nil {
+		seconds := duration.Seconds()
+		reading.FailsafeDurationS = &seconds
+	} else if _, ok := errs["deviceConfigurationKeyValueListData"]; !ok {
+		errs["failsafeDurationMinimum"] = err.Error()
+	}
+	if len(errs) == 0 {
+		reading.Errors = nil
+	}
+	return reading
+}
+
+// evccPowerLimits are the charging power limits of the EV
+type evccPowerLimits struct {
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Standby float64 `json:"standby"`
+}
+
+// evccIdentification is an identification of the EV, e.g. its MAC or EVCC ID
+type evccIdentification struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// evccReading is the EVCC data read from one EV entity
+type evccReading struct {
+	SKI                       string                  `json:"ski"`
+	Entity                    string                  `json:"entity"`
+	ReadAt                    time.Time               `json:"readAt"`
+	EVConnected               bool                    `json:"evConnected"`
+	CommunicationStandard     *string                 `json:"communicationStandard"`
+	AsymmetricChargingSupport *bool                   `json:"asymmetricChargingSupport"`
+	Identifications           []evccIdentification    `json:"identifications"`
+	Manufacturer              *ucapi.ManufacturerData `json:"manufacturer"`
+	PowerLimits               *evccPowerLimits        `json:"powerLimits"`
+	SleepMode                 *bool                   `json:"sleepMode"`
+	Errors                    map[string]string       `json:"errors,omitempty"`
+}
+
+// readEVCC actively reads the EVCC data of all connected EVs, optionally only those of one SKI.
+// Some DUTs send it only once at plug-in.
+func (h *hems) readEVCC(ski string) ([]evccReading, error) {
+	if h.uccemevcc == nil {
+		return nil, errors.New("EVCC usecase is disabled")
+	}
+	var entities []spineapi.EntityRemoteInterface
+	for _, entity := range remoteEntities(h.uccemevcc.RemoteEntitiesScenarios(), ski) {
+		if h.uccemevcc.EVConnected(entity) {
+			entities = append(entities, entity)
+		}
+	}
+	if len(entities) == 0 {
+		return nil, errNoEntity
+	}
+	localEntity := h.usecaseEntity("evcc")
+
+	readings := make([]evccReading, len(entities))
+	var wg sync.WaitGroup
+	for i, entity := range entities {
+		wg.Add(1)
+		go func(i int, entity spineapi.EntityRemoteInterface) {
+			defer wg.Done()
+			readings[i] = h.readEVCCEntity(localEntity, entity)
+		}(i, entity)
+	}
+	wg.Wait()
+	return readings, nil
+}
+
+func (h *hems) readEVCCEntity(localEntity spineapi.EntityLocalInterface, entity spineapi.EntityRemoteInterface) evccReading {
+	dc, dcErr := client.NewDeviceConfiguration(localEntity, entity)
+	id, idErr := client.NewIdentification(localEntity, entity)
+	cl, clErr := client.NewDeviceClassification(localEntity, entity)
+	ec, ecErr := client.NewElectricalConnection(localEntity, entity)
+	dd, ddErr := client.NewDeviceDiagnosis(localEntity, entity)
+	requests := []readRequest{
+		featureRead("deviceConfigurationKeyValueListData", dc, dcErr, func() (*model.MsgCounterType, error) {
+			return dc.RequestKeyValues(nil, nil)
+		}),
+		featureRead("identificationListData", id, idErr, id.RequestValues),
+		featureRead("deviceClassificationManufacturerData", cl, clErr, cl.RequestManufacturerDetails),
+		featureRead("electricalConnectionParameterDescriptionListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestParameterDescriptions(nil, nil)
+		}),
+		featureRead("electricalConnectionPermittedValueSetListData", ec, ecErr, func() (*model.MsgCounterType, error) {
+			return ec.RequestPermittedValueSets(nil, nil)
+		}),
+		featureRead("deviceDiagnosisStateData", dd, ddErr, dd.RequestState),
+	}
+
+	errs := h.readFeatures(requests)
+	reading := evccReading{
+		SKI:             entity.Device().Ski(),
+		Entity:          fmt.Sprint(entity.Address()),
+		ReadAt:          time.Now(),
+		EVConnected:     h.uccemevcc.EVConnected(entity),
+		Identifications: []evccIdentification{},
+		Errors:          errs,
+	}
+
+	// the replies updated the remote feature data, the usecase getters interpret it
+	if standard, err := h.uccemevcc.CommunicationStandard(entity); err == nil {
+		value := string(standard)
+		reading.CommunicationStandard = &value
+	} else if _, ok := errs["deviceConfigurationKeyValueListData"]; !ok {
+		errs["communicationStandard"] = err.Error()
+	}
+	if asymmetric, err := h.uccemevcc.AsymmetricChargingSupport(entity); err == nil {
+		reading.AsymmetricChargingSupport = &asymmetric
+	} else if _, ok := errs["deviceConfigurationKeyValueListData"]; !ok {
+		errs["asymmetricChargingSupport"] = err.Error()
+	}
+	if items, err := h.uccemevcc.Identifications(entity); err == nil {
+		for _, item := range items {
+			reading.Identifications = append(reading.Identifications, evccIdentification{Value: item.Value, Type: string(item.ValueType)})
+		}
+	} else if _, ok := errs["identificationListData"]; !ok {
+		errs["identifications"] = err.Error()
+	}
+	if manufacturer, err := h.uccemevcc.ManufacturerData(entity); err == nil {
+		reading.Manufacturer = &manufacturer
+	} else if _, ok := errs["deviceClassificationManufacturerData"]; !ok {
+		errs["manufacturer"] = err.Error()
+	}
+	if minimum, maximum, standby, err := h.uccemevcc.ChargingPowerLimits(entity); err == nil {
+		reading.PowerLimits = &evccPowerLimits{Min: minimum, Max: maximum, Standby: standby}
+	} else if _, ok := errs["electricalConnectionPermittedValueSetListData"]; !ok {
+		errs["powerLimits"] = err.Error()
+	}
+	if sleeping, err := h.uccemevcc.IsInSleepMode(entity); err == nil {
+		reading.SleepMode = &sleeping
+	} else if _, ok := errs["deviceDiagnosisStateData"]; !ok {
+		errs["sleepMode"] = err.Error()
+	}
+	if len(errs) == 0 {
+		reading.Errors = nil
+	}
+	return reading
+}
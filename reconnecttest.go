@@ -0,0 +1,527 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// Defaults of the reconnect storm test
+const (
+	defaultReconnectCycles = 10
+	maxReconnectCycles     = 500
+	// defaultReconnectInterval is the pause between the disconnect and waiting for the reconnect
+	defaultReconnectInterval = 2 * time.Second
+	// defaultReconnectTimeout is the time the DUT gets to disconnect and to connect again
+	defaultReconnectTimeout = 30 * time.Second
+	// defaultReconnectSettle is the time a new connection gets before the DUT state is read
+	defaultReconnectSettle = 5 * time.Second
+	reconnectTestPoll      = 100 * time.Millisecond
+)
+
+// reconnectTestRequest starts a reconnect storm test
+type reconnectTestRequest struct {
+	SKI string `json:"ski"`
+	// Cycles is the number of disconnects, defaults to 10
+	Cycles int `json:"cycles,omitempty"`
+	// IntervalSeconds is the pause after each disconnect, defaults to 2
+	IntervalSeconds float64 `json:"intervalSeconds,omitempty"`
+	// TimeoutSeconds is the time the DUT gets to reconnect per cycle, defaults to 30
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// SettleSeconds is the time after each reconnect before the DUT state is read, defaults to 5
+	SettleSeconds float64 `json:"settleSeconds,omitempty"`
+	// Value is an indefinite consumption limit in W written before the first cycle, the
+	// limit the DUT reports is checked without it
+	Value *float64 `json:"value,omitempty"`
+	// Restore deactivates the written limit after the test, defaults to true
+	Restore *bool `json:"restore,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// reconnectState is the state of the DUT that has to survive every reconnect
+type reconnectState struct {
+	ReadAt            time.Time        `json:"readAt"`
+	Limit             *lpcLimitReading `json:"limit,omitempty"`
+	FailsafePower     *float64         `json:"failsafePower,omitempty"`
+	FailsafeDurationS *float64         `json:"failsafeDurationSeconds,omitempty"`
+	// Subscriptions and Bindings are the entries the local device holds for the DUT
+	Subscriptions int `json:"subscriptions"`
+	Bindings      int `json:"bindings"`
+	// Error is set when the LPC state could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// reconnectCycle is a single disconnect of a reconnect storm test
+type reconnectCycle struct {
+	Index          int        `json:"index"`
+	DisconnectedAt *time.Time `json:"disconnectedAt,omitempty"`
+	ReconnectedAt  *time.Time `json:"reconnectedAt,omitempty"`
+	// ReconnectSeconds is the time from the disconnect until the DUT was connected again
+	ReconnectSeconds *float64 `json:"reconnectSeconds,omitempty"`
+	Direction        string   `json:"direction,omitempty"`
+	// Connections counts the connections of the cycle until the state was read, 1 is expected
+	Connections int             `json:"connections"`
+	State       *reconnectState `json:"state,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// reconnectTestRun is an active or finished reconnect storm test
+type reconnectTestRun struct {
+	SKI             string     `json:"ski"`
+	Cycles          int        `json:"cycles"`
+	IntervalSeconds float64    `json:"intervalSeconds"`
+	Running         bool       `json:"running"`
+	StartedAt       time.Time  `json:"startedAt"`
+	EndedAt         *time.Time `json:"endedAt,omitempty"`
+	// Baseline is the state before the first cycle, every cycle is compared with it
+	Baseline    *reconnectState  `json:"baseline,omitempty"`
+	Records     []reconnectCycle `json:"records"`
+	Reconnected int              `json:"reconnected"`
+	Assertions  []testAssertion  `json:"assertions"`
+	Passed      bool             `json:"passed"`
+	Error       string           `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// reconnectTestState holds the current or last reconnect storm test
+type reconnectTestState struct {
+	mu  sync.Mutex
+	run *reconnectTestRun
+}
+
+// startReconnectTest disconnects the DUT repeatedly in the background and checks it
+// reconnects every time with the same state
+func (h *hems) startReconnectTest(req reconnectTestRequest) (*reconnectTestRun, error) {
+	if h.myService == nil {
+		return nil, errors.New("the EEBUS service is not running")
+	}
+	if req.SKI == "" {
+		return nil, errors.New("ski is required")
+	}
+	req.SKI = shiputil.NormalizeSKI(req.SKI)
+	if req.Cycles <= 0 {
+		req.Cycles = defaultReconnectCycles
+	}
+	if req.Cycles > maxReconnectCycles {
+		return nil, fmt.Errorf("cycles must not exceed %d", maxReconnectCycles)
+	}
+	if req.IntervalSeconds < 0 || req.TimeoutSeconds < 0 || req.SettleSeconds < 0 {
+		return nil, errors.New("intervalSeconds, timeoutSeconds and settleSeconds must not be negative")
+	}
+	if req.Value != nil {
+		if h.uceglpc == nil {
+			return nil, errors.New("LPC usecase is disabled")
+		}
+		if *req.Value < 0 {
+			return nil, errors.New("value must not be negative")
+		}
+	}
+	if connected, _, _ := h.reconnectPeer(req.SKI); !connected {
+		return nil, errors.New("the DUT is not connected")
+	}
+	run := &reconnectTestRun{
+		SKI:             req.SKI,
+		Cycles:          req.Cycles,
+		IntervalSeconds: secondsOr(req.IntervalSeconds, defaultReconnectInterval).Seconds(),
+		Running:         true,
+		StartedAt:       time.Now(),
+		Metadata:        req.Metadata,
+	}
+
+	h.reconnectTests.mu.Lock()
+	if h.reconnectTests.run != nil && h.reconnectTests.run.Running {
+		h.reconnectTests.mu.Unlock()
+		return nil, errors.New("a reconnect storm test is already running")
+	}
+	h.reconnectTests.run = run
+	snap := copyReconnectTestRun(run)
+	h.reconnectTests.mu.Unlock()
+
+	go h.runReconnectTest(run, req)
+	h.recordEvent("reconnecttest", severityInfo, req.SKI, fmt.Sprintf("reconnect storm test started: %d cycles", req.Cycles), nil)
+	return snap, nil
+}
+
+func (h *hems) runReconnectTest(run *reconnectTestRun, req reconnectTestRequest) {
+	span := h.tracer.startSpan("test reconnect/storm", spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	errText := h.reconnectTestSteps(run, req)
+
+	if req.Value != nil && (req.Restore == nil || *req.Restore) {
+		value := *req.Value
+		payload := map[string]interface{}{"ski": run.SKI, "value": value, "isActive": false, "durationSeconds": 0}
+		if _, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+			return h.WriteLPCConsumptionLimit(run.SKI, 0, value, false)
+		}); err != nil {
+			h.Errorf("reconnect storm test: restore limit: %v", err)
+		}
+	}
+
+	now := time.Now()
+	h.reconnectTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Error = errText
+	run.Passed = errText == ""
+	for _, a := range run.Assertions {
+		if !a.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := reconnectTestResult(run)
+	counts := map[string]interface{}{"cycles": run.Cycles, "reconnected": run.Reconnected}
+	h.reconnectTests.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("reconnect storm test: %v", err)
+	} else {
+		h.reconnectTests.mu.Lock()
+		run.ResultID = result.ID
+		h.reconnectTests.mu.Unlock()
+	}
+	h.broadcastReconnectTest()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("reconnect storm test %s", verdict)
+	h.recordEvent("reconnecttest", severity, run.SKI, "reconnect storm test "+verdict, counts)
+}
+
+// reconnectTestSteps optionally writes the limit, reads the baseline and runs the cycles.
+// It returns an error text when the test could not be carried out.
+func (h *hems) reconnectTestSteps(run *reconnectTestRun, req reconnectTestRequest) string {
+	if req.Value != nil {
+		value := *req.Value
+		payload := map[string]interface{}{"ski": run.SKI, "value": value, "isActive": true, "durationSeconds": 0}
+		c, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+			return h.WriteLPCConsumptionLimit(run.SKI, 0, value, true)
+		})
+		if err != nil {
+			return "write limit: " + err.Error()
+		}
+		<-c.done
+		snap, _ := h.getCommand(c.ID)
+		msg := snap.Error
+		if msg == "" && snap.State != commandAcknowledged {
+			msg = string(snap.State)
+		}
+		h.addReconnectAssertion(run, "limit acknowledged", snap.State == commandAcknowledged, msg, nil)
+		if snap.State != commandAcknowledged {
+			return ""
+		}
+		time.Sleep(timeTestSettle)
+	}
+
+	base := h.readReconnectState(run.SKI)
+	h.reconnectTests.mu.Lock()
+	run.Baseline = base
+	h.reconnectTests.mu.Unlock()
+	h.broadcastReconnectTest()
+	if req.Value != nil {
+		if base.Limit == nil {
+			h.addReconnectAssertion(run, "limit reported", false, "the DUT reports no consumption limit", nil)
+			return ""
+		}
+		ok, msg := indefiniteLimitMatches(base.Limit, *req.Value)
+		h.addReconnectAssertion(run, "limit reported", ok, msg, nil)
+	}
+
+	interval := secondsOr(req.IntervalSeconds, defaultReconnectInterval)
+	timeout := secondsOr(req.TimeoutSeconds, defaultReconnectTimeout)
+	settle := secondsOr(req.SettleSeconds, defaultReconnectSettle)
+	for i := 0; i < req.Cycles; i++ {
+		rec := h.reconnectCycle(run.SKI, i, interval, timeout, settle)
+		h.reconnectTests.mu.Lock()
+		run.Records = append(run.Records, rec)
+		if rec.ReconnectedAt != nil {
+			run.Reconnected++
+		}
+		h.reconnectTests.mu.Unlock()
+		h.broadcastReconnectTest()
+		if rec.ReconnectedAt == nil {
+			// the DUT stopped accepting connections, further cycles would only time out
+			break
+		}
+	}
+
+	h.reconnectTests.mu.Lock()
+	records := append([]reconnectCycle(nil), run.Records...)
+	reconnected := run.Reconnected
+	h.reconnectTests.mu.Unlock()
+	h.reconnectAssertions(run, base, records, reconnected, req.Cycles)
+	return ""
+}
+
+// reconnectCycle disconnects the DUT, waits for the new connection and reads its state
+func (h *hems) reconnectCycle(ski string, index int, interval, timeout, settle time.Duration) reconnectCycle {
+	rec := reconnectCycle{Index: index}
+	_, connects, _ := h.reconnectPeer(ski)
+	start := time.Now()
+	h.myService.DisconnectSKI(ski, "reconnect storm test")
+
+	deadline := start.Add(timeout)
+	for {
+		// a fast reconnect may complete between two polls
+		if connected, count, _ := h.reconnectPeer(ski); !connected || count > connects {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			rec.Error = fmt.Sprintf("the DUT was still connected %s after the disconnect", timeout)
+			return rec
+		}
+		time.Sleep(reconnectTestPoll)
+	}
+	disconnected := time.Now()
+	rec.DisconnectedAt = &disconnected
+
+	time.Sleep(interval)
+	deadline = time.Now().Add(timeout)
+	for {
+		connected, count, direction := h.reconnectPeer(ski)
+		if connected && count > connects {
+			now := time.Now()
+			s := now.Sub(disconnected).Seconds()
+			rec.ReconnectedAt, rec.ReconnectSeconds, rec.Direction = &now, &s, direction
+			break
+		}
+		if !time.Now().Before(deadline) {
+			rec.Error = fmt.Sprintf("the DUT did not reconnect within %s", timeout)
+			return rec
+		}
+		time.Sleep(reconnectTestPoll)
+	}
+
+	time.Sleep(settle)
+	connected, count, _ := h.reconnectPeer(ski)
+	rec.Connections = count - connects
+	if !connected {
+		rec.Error = "the DUT disconnected again before its state was read"
+		return rec
+	}
+	rec.State = h.readReconnectState(ski)
+	return rec
+}
+
+// reconnectAssertions checks the cycles against the baseline
+func (h *hems) reconnectAssertions(run *reconnectTestRun, base *reconnectState, records []reconnectCycle, reconnected, cycles int) {
+	var times []float64
+	for _, rec := range records {
+		if rec.ReconnectSeconds != nil {
+			times = append(times, *rec.ReconnectSeconds)
+		}
+	}
+	msg := fmt.Sprintf("%d of %d cycles reconnected", reconnected, cycles)
+	var longest *float64
+	if len(times) > 0 {
+		sum, slowest := 0.0, 0.0
+		for _, t := range times {
+			sum += t
+			slowest = math.Max(slowest, t)
+		}
+		msg += fmt.Sprintf(", reconnect %.1f s average, %.1f s max", sum/float64(len(times)), slowest)
+		longest = &slowest
+	}
+	if n := len(records); n > 0 && records[n-1].Error != "" {
+		msg += fmt.Sprintf(", cycle %d: %s", n, records[n-1].Error)
+	}
+	h.addReconnectAssertion(run, "DUT accepted every reconnect", reconnected == cycles, msg, longest)
+
+	var extra []string
+	for _, rec := range records {
+		if rec.ReconnectedAt != nil && rec.Connections != 1 {
+			extra = append(extra, fmt.Sprintf("cycle %d: %d connections", rec.Index+1, rec.Connections))
+		}
+	}
+	msg = fmt.Sprintf("%d cycles with one connection each", reconnected)
+	if len(extra) > 0 {
+		msg = summarizeReconnectFailures(extra)
+	}
+	h.addReconnectAssertion(run, "one connection per cycle", len(extra) == 0, msg, nil)
+
+	var leaks []string
+	for _, rec := range records {
+		if rec.State == nil {
+			continue
+		}
+		if rec.State.Subscriptions > base.Subscriptions || rec.State.Bindings > base.Bindings {
+			leaks = append(leaks, fmt.Sprintf("cycle %d: %d subscriptions, %d bindings", rec.Index+1, rec.State.Subscriptions, rec.State.Bindings))
+		}
+	}
+	msg = fmt.Sprintf("baseline %d subscriptions, %d bindings", base.Subscriptions, base.Bindings)
+	if len(leaks) > 0 {
+		msg += "; " + summarizeReconnectFailures(leaks)
+	}
+	h.addReconnectAssertion(run, "no leaked subscriptions or bindings", len(leaks) == 0, msg, nil)
+
+	if base.Limit == nil && base.FailsafePower == nil && base.FailsafeDurationS == nil {
+		// the DUT offers no LPC state to compare
+		if base.Error != "" {
+			h.Infof("reconnect storm test: limit and failsafe state not checked: %s", base.Error)
+		}
+		return
+	}
+	var lost, failsafe []string
+	for _, rec := range records {
+		if rec.State == nil {
+			continue
+		}
+		if ok, desc := reconnectLimitRetained(base.Limit, rec.State.Limit); !ok {
+			lost = append(lost, fmt.Sprintf("cycle %d: %s", rec.Index+1, desc))
+		}
+		if !reconnectValueRetained(base.FailsafePower, rec.State.FailsafePower) ||
+			!reconnectValueRetained(base.FailsafeDurationS, rec.State.FailsafeDurationS) {
+			failsafe = append(failsafe, fmt.Sprintf("cycle %d: %s W, %s s", rec.Index+1,
+				formatReconnectValue(rec.State.FailsafePower), formatReconnectValue(rec.State.FailsafeDurationS)))
+		}
+	}
+	if base.Limit != nil {
+		msg = fmt.Sprintf("baseline %.0f W, active %t", base.Limit.Value, base.Limit.Active)
+		if len(lost) > 0 {
+			msg += "; " + summarizeReconnectFailures(lost)
+		}
+		h.addReconnectAssertion(run, "limit retained", len(lost) == 0, msg, nil)
+	}
+	msg = fmt.Sprintf("baseline %s W, %s s", formatReconnectValue(base.FailsafePower), formatReconnectValue(base.FailsafeDurationS))
+	if len(failsafe) > 0 {
+		msg += "; " + summarizeReconnectFailures(failsafe)
+	}
+	h.addReconnectAssertion(run, "failsafe values retained", len(failsafe) == 0, msg, nil)
+}
+
+// summarizeReconnectFailures joins the first failures of the cycles for an assertion message
+func summarizeReconnectFailures(failures []string) string {
+	const maxListed = 5
+	if len(failures) <= maxListed {
+		return strings.Join(failures, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(failures[:maxListed], ", "), len(failures)-maxListed)
+}
+
+// reconnectLimitRetained compares the limit of a cycle with the baseline, the duration of
+// a timed limit counts down and is not compared
+func reconnectLimitRetained(base, cur *lpcLimitReading) (bool, string) {
+	switch {
+	case base == nil:
+		return true, ""
+	case cur == nil:
+		return false, "no consumption limit"
+	}
+	desc := fmt.Sprintf("%.0f W, active %t", cur.Value, cur.Active)
+	if cur.Active != base.Active || math.Abs(cur.Value-base.Value) > 0.5 || cur.Indefinite != base.Indefinite {
+		return false, desc
+	}
+	return true, desc
+}
+
+// reconnectValueRetained compares an optional failsafe value with the baseline
+func reconnectValueRetained(base, cur *float64) bool {
+	if base == nil {
+		return true
+	}
+	return cur != nil && math.Abs(*cur-*base) <= 0.5
+}
+
+// formatReconnectValue formats an optional failsafe value, - if the DUT reports none
+func formatReconnectValue(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f", *v)
+}
+
+// reconnectPeer returns whether the DUT is connected, its connection count and the
+// direction of the last connection
+func (h *hems) reconnectPeer(ski string) (bool, int, string) {
+	peer := h.getPeer(ski)
+	if peer == nil {
+		return false, 0, ""
+	}
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	return peer.connected, peer.connectCount, peer.direction
+}
+
+// readReconnectState reads the LPC limit and failsafe values of the DUT and counts the
+// subscriptions and bindings the local device holds for it
+func (h *hems) readReconnectState(ski string) *reconnectState {
+	s := &reconnectState{ReadAt: time.Now()}
+	if readings, err := h.readLPC(ski); err != nil {
+		s.Error = err.Error()
+	} else {
+		s.Limit = readings[0].ConsumptionLimit
+		s.FailsafePower = readings[0].FailsafePower
+		s.FailsafeDurationS = readings[0].FailsafeDurationS
+	}
+	local := h.myService.LocalDevice()
+	if remote := local.RemoteDeviceForSki(ski); remote != nil {
+		s.Subscriptions = len(local.SubscriptionManager().SubscriptionsForRemoteDevice(remote))
+		s.Bindings = len(local.BindingManager().BindingsForRemoteDevice(remote))
+	}
+	return s
+}
+
+func (h *hems) addReconnectAssertion(run *reconnectTestRun, name string, passed bool, msg string, duration *float64) {
+	h.reconnectTests.mu.Lock()
+	run.Assertions = append(run.Assertions, testAssertion{Name: name, Passed: passed, Message: msg, DurationSeconds: duration})
+	h.reconnectTests.mu.Unlock()
+	h.broadcastReconnectTest()
+}
+
+// reconnectTestResult converts a finished reconnect storm test to a stored test run
+func reconnectTestResult(run *reconnectTestRun) *testRunResult {
+	res := &testRunResult{Plan: "reconnect/storm", SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	res.Assertions = append(res.Assertions, run.Assertions...)
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyReconnectTestRun(run *reconnectTestRun) *reconnectTestRun {
+	c := *run
+	c.Records = append([]reconnectCycle(nil), run.Records...)
+	c.Assertions = append([]testAssertion(nil), run.Assertions...)
+	return &c
+}
+
+// getReconnectTest returns a copy of the current or last reconnect storm test
+func (h *hems) getReconnectTest() *reconnectTestRun {
+	h.reconnectTests.mu.Lock()
+	defer h.reconnectTests.mu.Unlock()
+	if h.reconnectTests.run == nil {
+		return nil
+	}
+	return copyReconnectTestRun(h.reconnectTests.run)
+}
+
+// broadcastReconnectTest sends the progress of the reconnect storm test to all websocket
+// clients, the cycles are left out and available via the API
+func (h *hems) broadcastReconnectTest() {
+	run := h.getReconnectTest()
+	if run == nil {
+		return
+	}
+	run.Records = nil
+	h.broadcastJSON(map[string]interface{}{
+		"type":          "reconnecttest",
+		"ski":           run.SKI,
+		"reconnecttest": run,
+	})
+}
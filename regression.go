@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// defaultRegressionSettle is the time the DUT gets after a reconnect to announce its
+// entities, use cases and failsafe values before they are compared
+const defaultRegressionSettle = 30 * time.Second
+
+// RegressionWatchConfig configures the comparison of the DUT configuration across reconnects
+type RegressionWatchConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// SettleSeconds is the time after a connection until the comparison, defaults to 30
+	SettleSeconds float64 `json:"settleSeconds,omitempty"`
+}
+
+func (c RegressionWatchConfig) settle() time.Duration {
+	if c.SettleSeconds <= 0 {
+		return defaultRegressionSettle
+	}
+	return time.Duration(c.SettleSeconds * float64(time.Second))
+}
+
+// regressionSnapshot is the configuration of a DUT that has to survive a reconnect
+type regressionSnapshot struct {
+	TakenAt time.Time `json:"takenAt"`
+	// Usecases are the declared scenarios per actor/use case@entity
+	Usecases map[string][]uint `json:"usecases"`
+	// Entities are the entity types per entity address
+	Entities map[string]string `json:"entities"`
+	// Features are the feature types and roles per entity/feature address
+	Features map[string]string `json:"features"`
+	// Failsafe are the failsafe values per use case/entity/value
+	Failsafe map[string]float64 `json:"failsafe"`
+}
+
+// regressionItem is a part of the configuration that disappeared or changed
+type regressionItem struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	// Change is missing or changed
+	Change   string `json:"change"`
+	Previous string `json:"previous,omitempty"`
+	Current  string `json:"current,omitempty"`
+}
+
+// regressionCheck is the result of the comparison after a reconnect
+type regressionCheck struct {
+	SKI        string           `json:"ski"`
+	CheckedAt  time.Time        `json:"checkedAt"`
+	BaselineAt time.Time        `json:"baselineAt"`
+	Regressed  bool             `json:"regressed"`
+	Items      []regressionItem `json:"items"`
+}
+
+type regressionPeer struct {
+	baseline *regressionSnapshot
+	// settled is set once the current connection was checked, only a settled connection
+	// may replace the baseline
+	settled bool
+	timer   *time.Timer
+	last    *regressionCheck
+}
+
+// regressionWatch compares the configuration of the DUTs before and after reconnects
+type regressionWatch struct {
+	mu    sync.Mutex
+	peers map[string]*regressionPeer
+}
+
+func newRegressionWatch() *regressionWatch {
+	return &regressionWatch{peers: make(map[string]*regressionPeer)}
+}
+
+func (w *regressionWatch) peer(ski string) *regressionPeer {
+	p := w.peers[ski]
+	if p == nil {
+		p = &regressionPeer{}
+		w.peers[ski] = p
+	}
+	return p
+}
+
+func (h *hems) regressionConfig() RegressionWatchConfig {
+	if h.config == nil {
+		return RegressionWatchConfig{}
+	}
+	return h.config.RegressionWatch
+}
+
+// snapshotRegressionState collects the use case declarations, entities, features and
+// failsafe values the tester currently knows of a DUT
+func (h *hems) snapshotRegressionState(ski string) *regressionSnapshot {
+	s := &regressionSnapshot{
+		TakenAt:  time.Now(),
+		Usecases: make(map[string][]uint),
+		Entities: make(map[string]string),
+		Features: make(map[string]string),
+		Failsafe: make(map[string]float64),
+	}
+	if peer := h.getPeer(ski); peer != nil {
+		for _, d := range peer.usecases.declarations() {
+			s.Usecases[d.Actor+"/"+d.Name+"@"+d.Entity] = slices.Clone(d.Scenarios)
+		}
+	}
+	if h.myService == nil {
+		return s
+	}
+	device := h.myService.LocalDevice().RemoteDeviceForSki(ski)
+	if device == nil {
+		return s
+	}
+	for _, e := range device.Entities() {
+		addr := entityAddressString(e)
+		s.Entities[addr] = string(e.EntityType())
+		for _, f := range e.Features() {
+			if f.Address() == nil || f.Address().Feature == nil {
+				continue
+			}
+			s.Features[fmt.Sprintf("%s/%d", addr, *f.Address().Feature)] = fmt.Sprintf("%s %s", f.Type(), f.Role())
+		}
+	}
+	if h.uceglpc != nil {
+		for _, e := range remoteEntities(h.uceglpc.RemoteEntitiesScenarios(), ski) {
+			addr := entityAddressString(e)
+			if v, err := h.uceglpc.FailsafeConsumptionActivePowerLimit(e); err == nil {
+				s.Failsafe["lpc/"+addr+"/power"] = v
+			}
+			if d, err := h.uceglpc.FailsafeDurationMinimum(e); err == nil {
+				s.Failsafe["lpc/"+addr+"/durationSeconds"] = d.Seconds()
+			}
+		}
+	}
+	if h.uceglpp != nil {
+		for _, e := range remoteEntities(h.uceglpp.RemoteEntitiesScenarios(), ski) {
+			addr := entityAddressString(e)
+			if v, err := h.uceglpp.FailsafeProductionActivePowerLimit(e); err == nil {
+				s.Failsafe["lpp/"+addr+"/power"] = v
+			}
+			if d, err := h.uceglpp.FailsafeDurationMinimum(e); err == nil {
+				s.Failsafe["lpp/"+addr+"/durationSeconds"] = d.Seconds()
+			}
+		}
+	}
+	return s
+}
+
+// mergeRegressionSnapshot keeps the parts of the previous snapshot that are empty in the
+// current one. The DUT's data may already be dropped when the disconnect is reported.
+func mergeRegressionSnapshot(prev, cur *regressionSnapshot) *regressionSnapshot {
+	if prev == nil {
+		return cur
+	}
+	if len(cur.Usecases) == 0 {
+		cur.Usecases = prev.Usecases
+	}
+	if len(cur.Entities) == 0 {
+		cur.Entities, cur.Features = prev.Entities, prev.Features
+	}
+	if len(cur.Failsafe) == 0 {
+		cur.Failsafe = prev.Failsafe
+	}
+	return cur
+}
+
+// compareRegressionSnapshots returns what disappeared or changed from base to cur
+func compareRegressionSnapshots(base, cur *regressionSnapshot) []regressionItem {
+	items := []regressionItem{}
+	for key, scenarios := range base.Usecases {
+		now, ok := cur.Usecases[key]
+		if !ok {
+			items = append(items, regressionItem{Kind: "usecase", Key: key, Change: "missing", Previous: fmt.Sprint(scenarios)})
+			continue
+		}
+		var lost []uint
+		for _, sc := range scenarios {
+			if !slices.Contains(now, sc) {
+				lost = append(lost, sc)
+			}
+		}
+		if len(lost) > 0 {
+			items = append(items, regressionItem{Kind: "scenario", Key: key, Change: "missing", Previous: fmt.Sprint(scenarios), Current: fmt.Sprint(now)})
+		}
+	}
+	for addr, typ := range base.Entities {
+		if _, ok := cur.Entities[addr]; !ok {
+			items = append(items, regressionItem{Kind: "entity", Key: addr, Change: "missing", Previous: typ})
+		}
+	}
+	for key, desc := range base.Features {
+		entity, _, _ := strings.Cut(key, "/")
+		if _, ok := cur.Entities[entity]; !ok {
+			// reported with the entity
+			continue
+		}
+		if now, ok := cur.Features[key]; !ok {
+			items = append(items, regressionItem{Kind: "feature", Key: key, Change: "missing", Previous: desc})
+		} else if now != desc {
+			items = append(items, regressionItem{Kind: "feature", Key: key, Change: "changed", Previous: desc, Current: now})
+		}
+	}
+	for key, v := range base.Failsafe {
+		now, ok := cur.Failsafe[key]
+		switch {
+		case !ok:
+			items = append(items, regressionItem{Kind: "failsafe", Key: key, Change: "missing", Previous: fmt.Sprint(v)})
+		case now != v:
+			items = append(items, regressionItem{Kind: "failsafe", Key: key, Change: "changed", Previous: fmt.Sprint(v), Current: fmt.Sprint(now)})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Kind != items[j].Kind {
+			return items[i].Kind < items[j].Kind
+		}
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
+// regressionConnected schedules the comparison of a new connection with the baseline
+func (h *hems) regressionConnected(ski string) {
+	cfg := h.regressionConfig()
+	if cfg.Disabled {
+		return
+	}
+	h.regressions.mu.Lock()
+	defer h.regressions.mu.Unlock()
+	p := h.regressions.peer(shiputil.NormalizeSKI(ski))
+	p.settled = false
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(cfg.settle(), func() { h.checkRegression(ski) })
+}
+
+// regressionDisconnected stores the configuration before the disconnect as baseline
+func (h *hems) regressionDisconnected(ski string) {
+	h.regressions.mu.Lock()
+	p := h.regressions.peer(shiputil.NormalizeSKI(ski))
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	settled := p.settled
+	p.settled = false
+	h.regressions.mu.Unlock()
+	if !settled {
+		// a connection that dropped before it settled may be incomplete, the baseline
+		// of the last settled connection stays
+		return
+	}
+	snap := h.snapshotRegressionState(ski)
+	h.regressions.mu.Lock()
+	p.baseline = mergeRegressionSnapshot(p.baseline, snap)
+	h.regressions.mu.Unlock()
+}
+
+// checkRegression compares the settled connection with the baseline and records a
+// regression event if something disappeared
+func (h *hems) checkRegression(ski string) {
+	if peer := h.getPeer(ski); peer == nil || !peer.connected {
+		return
+	}
+	cur := h.snapshotRegressionState(ski)
+	key := shiputil.NormalizeSKI(ski)
+	h.regressions.mu.Lock()
+	p := h.regressions.peer(key)
+	base := p.baseline
+	p.settled = true
+	p.timer = nil
+	// a regression is reported once, the next reconnect is compared with this state
+	p.baseline = cur
+	if base == nil {
+		h.regressions.mu.Unlock()
+		return
+	}
+	check := &regressionCheck{SKI: key, CheckedAt: cur.TakenAt, BaselineAt: base.TakenAt, Items: compareRegressionSnapshots(base, cur)}
+	check.Regressed = len(check.Items) > 0
+	p.last = check
+	h.regressions.mu.Unlock()
+
+	if !check.Regressed {
+		h.Infof("regression watch: configuration of %s unchanged after reconnect", ski)
+		return
+	}
+	parts := make([]string, 0, len(check.Items))
+	for _, it := range check.Items {
+		parts = append(parts, fmt.Sprintf("%s %s %s", it.Kind, it.Key, it.Change))
+	}
+	h.recordEvent("regression", severityWarning, ski, fmt.Sprintf("configuration lost over reconnect: %s", strings.Join(parts, ", ")),
+		map[string]interface{}{"items": check.Items, "baselineAt": base.TakenAt})
+}
+
+// getRegressions returns the baseline and the last comparison per DUT
+func (h *hems) getRegressions(ski string) map[string]interface{} {
+	ski = shiputil.NormalizeSKI(ski)
+	h.regressions.mu.Lock()
+	defer h.regressions.mu.Unlock()
+	baselines := make(map[string]*regressionSnapshot)
+	checks := []regressionCheck{}
+	for key, p := range h.regressions.peers {
+		if ski != "" && key != ski {
+			continue
+		}
+		if p.baseline != nil {
+			baselines[key] = p.baseline
+		}
+		if p.last != nil {
+			c := *p.last
+			c.Items = append([]regressionItem(nil), p.last.Items...)
+			checks = append(checks, c)
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].SKI < checks[j].SKI })
+	return map[string]interface{}{"baselines": baselines, "checks": checks}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+)
+
+// remoteServiceState is an EEBUS service seen via mDNS with its announcement history
+type remoteServiceState struct {
+	SKI        string     `json:"ski"`
+	Name       string     `json:"name,omitempty"`
+	Identifier string     `json:"identifier,omitempty"`
+	Brand      string     `json:"brand,omitempty"`
+	Model      string     `json:"model,omitempty"`
+	Type       string     `json:"type,omitempty"`
+	Serial     string     `json:"serial,omitempty"`
+	Visible    bool       `json:"visible"`
+	FirstSeen  time.Time  `json:"firstSeen"`
+	AppearedAt *time.Time `json:"appearedAt,omitempty"`
+	// DisappearedAt is the last time the service was no longer announced
+	DisappearedAt *time.Time `json:"disappearedAt,omitempty"`
+	// Appearances counts the announcements after an absence, including the first one
+	Appearances int `json:"appearances"`
+	// ReannounceSeconds is the duration of the last absence, e.g. a DUT reboot
+	ReannounceSeconds *float64 `json:"reannounceSeconds,omitempty"`
+}
+
+// remoteServiceTracker diffs the visible remote service lists reported by ship-go
+type remoteServiceTracker struct {
+	mu       sync.Mutex
+	services map[string]*remoteServiceState
+}
+
+func newRemoteServiceTracker() *remoteServiceTracker {
+	return &remoteServiceTracker{services: make(map[string]*remoteServiceState)}
+}
+
+// update applies a visible service list and returns the SKIs that appeared and disappeared
+func (t *remoteServiceTracker) update(entries []shipapi.RemoteService, now time.Time) (appeared, disappeared []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.Ski] = true
+		s, ok := t.services[e.Ski]
+		if !ok {
+			s = &remoteServiceState{SKI: e.Ski, FirstSeen: now}
+			t.services[e.Ski] = s
+		}
+		s.Name, s.Identifier, s.Brand, s.Model, s.Type, s.Serial = e.Name, e.Identifier, e.Brand, e.Model, e.Type, e.Serial
+		if s.Visible {
+			continue
+		}
+		s.Visible = true
+		s.AppearedAt = &now
+		s.Appearances++
+		if s.DisappearedAt != nil {
+			absence := now.Sub(*s.DisappearedAt).Seconds()
+			s.ReannounceSeconds = &absence
+		}
+		appeared = append(appeared, e.Ski)
+	}
+	for ski, s := range t.services {
+		if s.Visible && !seen[ski] {
+			s.Visible = false
+			s.DisappearedAt = &now
+			disappeared = append(disappeared, ski)
+		}
+	}
+	sort.Strings(appeared)
+	sort.Strings(disappeared)
+	return appeared, disappeared
+}
+
+// get returns a copy of the service with the SKI
+func (t *remoteServiceTracker) get(ski string) (remoteServiceState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.services[ski]
+	if !ok {
+		return remoteServiceState{}, false
+	}
+	return *s, true
+}
+
+// list returns copies of all services ever seen, sorted by SKI
+func (t *remoteServiceTracker) list() []remoteServiceState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]remoteServiceState, 0, len(t.services))
+	for _, s := range t.services {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SKI < out[j].SKI })
+	return out
+}
+
+// trackRemoteServices records appearing and disappearing services on the timeline and
+// broadcasts the list as {"type":"remoteServices",..}
+func (h *hems) trackRemoteServices(entries []shipapi.RemoteService) {
+	appeared, disappeared := h.remoteServices.update(entries, time.Now())
+	for _, ski := range appeared {
+		s, _ := h.remoteServices.get(ski)
+		msg := fmt.Sprintf("service %s appeared", s.Name)
+		data := map[string]interface{}{"name": s.Name, "appearances": s.Appearances}
+		if s.ReannounceSeconds != nil {
+			msg = fmt.Sprintf("service %s re-announced after %.1f s", s.Name, *s.ReannounceSeconds)
+			data["reannounceSeconds"] = *s.ReannounceSeconds
+		}
+		h.recordEvent("mdns", severityInfo, ski, msg, data)
+	}
+	for _, ski := range disappeared {
+		s, _ := h.remoteServices.get(ski)
+		h.recordEvent("mdns", severityInfo, ski, fmt.Sprintf("service %s disappeared", s.Name), map[string]interface{}{"name": s.Name})
+	}
+	if appeared == nil {
+		appeared = []string{}
+	}
+	if disappeared == nil {
+		disappeared = []string{}
+	}
+	h.broadcastJSON(map[string]interface{}{
+		"type":        "remoteServices",
+		"services":    h.remoteServices.list(),
+		"appeared":    appeared,
+		"disappeared": disappeared,
+	})
+}
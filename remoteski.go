@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// maxRemoteSKIChanges is the number of remote SKI changes kept
+const maxRemoteSKIChanges = 50
+
+// remoteSKIChange is a switch of the device under test
+type remoteSKIChange struct {
+	Time     time.Time `json:"time"`
+	Previous string    `json:"previous,omitempty"`
+	SKI      string    `json:"ski"`
+	By       string    `json:"by,omitempty"`
+}
+
+// remoteSKIState tracks the SKI of the device under test set via the API
+type remoteSKIState struct {
+	mu      sync.Mutex
+	current string
+	since   time.Time
+	history []remoteSKIChange
+}
+
+// currentRemoteSKI returns the SKI of the device under test. Until one is set via the
+// API the only connected peer is used, empty if there is none or several.
+func (h *hems) currentRemoteSKI() string {
+	h.remoteSKI.mu.Lock()
+	current := h.remoteSKI.current
+	h.remoteSKI.mu.Unlock()
+	if current != "" {
+		return current
+	}
+	peers := h.getAllPeers()
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+	for ski, peer := range peers {
+		if !peer.connected {
+			continue
+		}
+		if current != "" {
+			return ""
+		}
+		current = ski
+	}
+	return current
+}
+
+// switchRemoteSKI unpairs the current device under test and pairs the new SKI without
+// a restart. The data collected for the previous SKI is kept.
+func (h *hems) switchRemoteSKI(ski, by string) (remoteSKIChange, error) {
+	ski = shiputil.NormalizeSKI(ski)
+	if b, err := hex.DecodeString(ski); err != nil || len(b) != 20 {
+		return remoteSKIChange{}, fmt.Errorf("ski must be 40 hex digits")
+	}
+	if ok, reason := h.skiPermitted(ski); !ok {
+		return remoteSKIChange{}, fmt.Errorf("%s", reason)
+	}
+	previous := h.currentRemoteSKI()
+	if previous == ski {
+		return remoteSKIChange{}, fmt.Errorf("%s is already the remote SKI", ski)
+	}
+
+	now := time.Now()
+	if previous != "" {
+		h.unpairSKI(previous)
+		h.watchdog.mu.Lock()
+		delete(h.watchdog.recovered, previous)
+		delete(h.watchdog.connectedSince, previous)
+		h.watchdog.mu.Unlock()
+		h.trustPrompts.mu.Lock()
+		delete(h.trustPrompts.prompts, previous)
+		h.trustPrompts.mu.Unlock()
+	}
+	if err := h.pairSKI(ski); err != nil {
+		return remoteSKIChange{}, err
+	}
+
+	c := remoteSKIChange{Time: now, Previous: previous, SKI: ski, By: by}
+	h.remoteSKI.mu.Lock()
+	h.remoteSKI.current, h.remoteSKI.since = ski, now
+	h.remoteSKI.history = append(h.remoteSKI.history, c)
+	if len(h.remoteSKI.history) > maxRemoteSKIChanges {
+		h.remoteSKI.history = h.remoteSKI.history[len(h.remoteSKI.history)-maxRemoteSKIChanges:]
+	}
+	h.remoteSKI.mu.Unlock()
+
+	msg := "remote SKI set to " + ski
+	if previous != "" {
+		msg = fmt.Sprintf("remote SKI changed from %s to %s", previous, ski)
+	}
+	h.Infof("%s", msg)
+	h.recordEvent("trust", severityInfo, ski, msg, map[string]interface{}{"previous": previous, "by": by})
+	h.broadcastJSON(map[string]interface{}{"type": "remoteSki", "change": c})
+	h.broadcastPeerList()
+	return c, nil
+}
+
+// getRemoteSKI returns the current remote SKI and the history of changes, newest first
+func (h *hems) getRemoteSKI() map[string]interface{} {
+	current := h.currentRemoteSKI()
+	connected := h.dutConnected(current)
+	h.remoteSKI.mu.Lock()
+	defer h.remoteSKI.mu.Unlock()
+	history := make([]remoteSKIChange, 0, len(h.remoteSKI.history))
+	for i := len(h.remoteSKI.history) - 1; i >= 0; i-- {
+		history = append(history, h.remoteSKI.history[i])
+	}
+	return map[string]interface{}{
+		"ski":       current,
+		"since":     optionalTime(h.remoteSKI.since),
+		"connected": connected,
+		// waitingForPairing is set while no device under test is selected or the selected
+		// one is not connected
+		"waitingForPairing": !connected,
+		"history":           history,
+	}
+}
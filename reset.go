@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// Scopes of POST /api/reset
+const (
+	resetScopeLogs     = "logs"
+	resetScopeEvents   = "events"
+	resetScopeSeries   = "series"
+	resetScopeEntities = "entities"
+)
+
+// resetScopes are cleared when no scope is given
+var resetScopes = []string{resetScopeLogs, resetScopeEvents, resetScopeSeries, resetScopeEntities}
+
+// parseResetScopes parses a comma separated scope list, empty selects all scopes
+func parseResetScopes(v string) ([]string, error) {
+	if v == "" {
+		return resetScopes, nil
+	}
+	var scopes []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if !slices.Contains(resetScopes, s) {
+			return nil, fmt.Errorf("unknown scope %q, expected %s", s, strings.Join(resetScopes, ", "))
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// resetCollectedData clears the selected data so a test run starts from a clean slate
+// without restarting the tester. Events, series and entities can be limited to one SKI,
+// the log buffer is not kept per peer and always cleared entirely. It returns the number
+// of cleared items per scope.
+func (h *hems) resetCollectedData(scopes []string, ski string, by string) map[string]int {
+	ski = shiputil.NormalizeSKI(ski)
+	cleared := make(map[string]int)
+	for _, scope := range scopes {
+		switch scope {
+		case resetScopeLogs:
+			cleared[scope] = h.clearLogs()
+		case resetScopeEvents:
+			cleared[scope] = h.clearEvents(ski)
+		case resetScopeSeries:
+			cleared[scope] = h.clearSeries(ski)
+		case resetScopeEntities:
+			cleared[scope] = h.clearEntities(ski)
+		}
+	}
+
+	// the reset is the first event of the new timeline
+	h.recordEvent("reset", severityInfo, ski, fmt.Sprintf("collected data cleared by %s: %s", by, strings.Join(scopes, ", ")),
+		map[string]interface{}{"scopes": scopes, "cleared": cleared})
+	h.broadcastJSON(map[string]interface{}{"type": "reset", "ski": ski, "scopes": scopes})
+	return cleared
+}
+
+func (h *hems) clearLogs() int {
+	h.logMu.Lock()
+	defer h.logMu.Unlock()
+	n := len(h.logs)
+	h.logs = make([]string, 0, 200)
+	return n
+}
+
+// clearEvents drops the events of the timeline, the event IDs keep increasing
+func (h *hems) clearEvents(ski string) int {
+	h.events.mu.Lock()
+	defer h.events.mu.Unlock()
+	if ski == "" {
+		n := len(h.events.events)
+		h.events.events = nil
+		return n
+	}
+	kept := h.events.events[:0]
+	for _, ev := range h.events.events {
+		if shiputil.NormalizeSKI(ev.SKI) != ski {
+			kept = append(kept, ev)
+		}
+	}
+	n := len(h.events.events) - len(kept)
+	h.events.events = kept
+	return n
+}
+
+// clearSeries drops the recorded series points
+func (h *hems) clearSeries(ski string) int {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	n := 0
+	for key, peerSeries := range h.series.series {
+		if ski != "" && key != ski {
+			continue
+		}
+		for _, points := range peerSeries {
+			n += len(points)
+		}
+		delete(h.series.series, key)
+	}
+	return n
+}
+
+// clearEntities drops the cached entity snapshots. Connected peers get a fresh snapshot
+// of their current entities, the snapshots of disconnected peers are emptied.
+func (h *hems) clearEntities(ski string) int {
+	h.peersMu.Lock()
+	peers := make(map[string]*peerData)
+	for key, peer := range h.peers {
+		if ski == "" || shiputil.NormalizeSKI(key) == ski {
+			peers[key] = peer
+		}
+	}
+	h.peersMu.Unlock()
+
+	n := 0
+	for key, peer := range peers {
+		n += len(peer.entities.clear())
+		if peer.connected && h.myService != nil {
+			if device := h.myService.LocalDevice().RemoteDeviceForSki(key); device != nil {
+				h.updateEntitiesFromDevice(key, device, peer)
+				continue
+			}
+		}
+		h.broadcastCoalesced("entities/"+key, []byte(fmt.Sprintf(`{"type":"entities","ski":%q,"entities":[]}`, key)))
+	}
+	return n
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+	"github.com/enbility/spine-go/model"
+)
+
+// maxPendingRequests bounds the sent requests awaiting a reply or result of all peers
+const maxPendingRequests = 5000
+
+// functionLatency is the response time distribution of one function of a remote feature
+type functionLatency struct {
+	SKI        string `json:"ski"`
+	Feature    string `json:"feature"`
+	Address    string `json:"address"`
+	Function   string `json:"function"`
+	Classifier string `json:"classifier"`
+	// Unanswered counts the requests without reply or result within dataUpdateTimeout
+	Unanswered int          `json:"unanswered"`
+	Latency    latencyStats `json:"latency"`
+}
+
+type pendingRequest struct {
+	key    string
+	sentAt time.Time
+}
+
+type functionSamples struct {
+	stats   functionLatency
+	address model.FeatureAddressType
+	samples []float64
+}
+
+// responseTimeTracker measures the time from a sent read, or a write or call with
+// acknowledgement request, to the reply or result of the peer per remote function
+type responseTimeTracker struct {
+	mu        sync.Mutex
+	pending   map[string]pendingRequest
+	functions map[string]*functionSamples
+}
+
+func newResponseTimeTracker() *responseTimeTracker {
+	return &responseTimeTracker{
+		pending:   make(map[string]pendingRequest),
+		functions: make(map[string]*functionSamples),
+	}
+}
+
+// trackResponseTime registers sent requests and completes them with the received replies
+// and results. A request is attributed to the function of its first cmd.
+func (h *hems) trackResponseTime(dg capturedDatagram) {
+	if h.responseTimes == nil {
+		return
+	}
+	t := h.responseTimes
+	if dg.Direction == datagramReceived {
+		if dg.MsgCounterReference == nil || (dg.CmdClassifier != string(model.CmdClassifierTypeReply) && dg.CmdClassifier != string(model.CmdClassifierTypeResult)) {
+			return
+		}
+		id := resultKey(dg.SKI, model.MsgCounterType(*dg.MsgCounterReference))
+		t.mu.Lock()
+		if p, ok := t.pending[id]; ok {
+			delete(t.pending, id)
+			if f := t.functions[p.key]; f != nil {
+				f.samples = appendLatency(f.samples, float64(dg.Time.Sub(p.sentAt))/float64(time.Millisecond))
+			}
+		}
+		t.mu.Unlock()
+		return
+	}
+
+	if dg.MsgCounter == nil || len(dg.Functions) == 0 {
+		return
+	}
+	var spine model.Datagram
+	if err := json.Unmarshal(dg.Datagram, &spine); err != nil {
+		return
+	}
+	header := spine.Datagram.Header
+	switch model.CmdClassifierType(dg.CmdClassifier) {
+	case model.CmdClassifierTypeRead:
+	case model.CmdClassifierTypeWrite, model.CmdClassifierTypeCall:
+		// without ackRequest the peer answers a write only with a data change
+		if header.AckRequest == nil || !*header.AckRequest {
+			return
+		}
+	default:
+		return
+	}
+	if header.AddressDestination == nil {
+		return
+	}
+	address := *header.AddressDestination
+	key := strings.Join([]string{dg.SKI, address.String(), dg.Functions[0], dg.CmdClassifier}, "|")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.functions[key]
+	if f == nil {
+		f = &functionSamples{
+			stats:   functionLatency{SKI: dg.SKI, Address: address.String(), Function: dg.Functions[0], Classifier: dg.CmdClassifier},
+			address: address,
+		}
+		t.functions[key] = f
+	}
+	t.pending[resultKey(dg.SKI, model.MsgCounterType(*dg.MsgCounter))] = pendingRequest{key: key, sentAt: dg.Time}
+	if len(t.pending) > maxPendingRequests {
+		t.expirePending(dg.Time)
+	}
+}
+
+// expirePending drops the requests unanswered for longer than dataUpdateTimeout
+func (t *responseTimeTracker) expirePending(now time.Time) {
+	for id, p := range t.pending {
+		if now.Sub(p.sentAt) <= dataUpdateTimeout {
+			continue
+		}
+		delete(t.pending, id)
+		if f := t.functions[p.key]; f != nil {
+			f.stats.Unanswered++
+		}
+	}
+}
+
+// getResponseLatencies returns the response time distributions per remote function,
+// slowest p95 first, optionally for one SKI and function
+func (h *hems) getResponseLatencies(ski, function string) []functionLatency {
+	ski = shiputil.NormalizeSKI(ski)
+	h.responseTimes.mu.Lock()
+	h.responseTimes.expirePending(time.Now())
+	var selected []*functionSamples
+	out := []functionLatency{}
+	for _, f := range h.responseTimes.functions {
+		if (ski != "" && f.stats.SKI != ski) || (function != "" && f.stats.Function != function) {
+			continue
+		}
+		s := f.stats
+		s.Latency = computeLatencyStats(f.samples)
+		selected = append(selected, f)
+		out = append(out, s)
+	}
+	h.responseTimes.mu.Unlock()
+
+	// the feature types are resolved outside of the trace hook that records the samples
+	for i, f := range selected {
+		out[i].Feature = "unknown"
+		if h.myService == nil {
+			continue
+		}
+		if device := h.myService.LocalDevice().RemoteDeviceForSki(f.stats.SKI); device != nil {
+			address := f.address
+			if address.Device == nil {
+				address.Device = device.Address()
+			}
+			if feature := device.FeatureByAddress(&address); feature != nil {
+				out[i].Feature = string(feature.Type())
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Latency.P95Ms != out[j].Latency.P95Ms {
+			return out[i].Latency.P95Ms > out[j].Latency.P95Ms
+		}
+		return strings.Join([]string{out[i].SKI, out[i].Address, out[i].Function, out[i].Classifier}, "|") <
+			strings.Join([]string{out[j].SKI, out[j].Address, out[j].Function, out[j].Classifier}, "|")
+	})
+	return out
+}
+
+// resetResponseLatencies drops all response time samples and pending requests
+func (h *hems) resetResponseLatencies() {
+	h.responseTimes.mu.Lock()
+	h.responseTimes.pending = make(map[string]pendingRequest)
+	h.responseTimes.functions = make(map[string]*functionSamples)
+	h.responseTimes.mu.Unlock()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+	"github.com/enbility/spine-go/model"
+)
+
+// maxRemoteRestarts is the number of reconnects and restarts kept for the API
+const maxRemoteRestarts = 500
+
+// Kinds of reconnects of a DUT
+const (
+	reconnectPlain   = "reconnect"
+	reconnectRestart = "restart"
+)
+
+// remoteRestart is a reconnect of a DUT, classified as restart by the evidence
+// of the first received datagram of the new connection
+type remoteRestart struct {
+	Time            time.Time `json:"time"`
+	SKI             string    `json:"ski"`
+	Kind            string    `json:"kind"`
+	DisconnectedAt  time.Time `json:"disconnectedAt"`
+	DowntimeSeconds float64   `json:"downtimeSeconds"`
+	Evidence        []string  `json:"evidence"`
+}
+
+// restartStats counts the connections of a DUT
+type restartStats struct {
+	Connections   int        `json:"connections"`
+	Reconnects    int        `json:"reconnects"`
+	Restarts      int        `json:"restarts"`
+	LastRestartAt *time.Time `json:"lastRestartAt,omitempty"`
+}
+
+type restartPeer struct {
+	stats restartStats
+	// last msgCounter and SPINE device address of the current or previous connection
+	msgCounter    *uint64
+	deviceAddress string
+	// pending is the reconnect waiting for the first received datagram
+	pending        *remoteRestart
+	disconnectedAt time.Time
+	closeAnnounced bool
+}
+
+// restartDetector detects reboots of the DUTs from their reconnects
+type restartDetector struct {
+	mu       sync.Mutex
+	peers    map[string]*restartPeer
+	restarts []remoteRestart
+}
+
+func newRestartDetector() *restartDetector {
+	return &restartDetector{peers: make(map[string]*restartPeer)}
+}
+
+func (d *restartDetector) peer(ski string) *restartPeer {
+	p := d.peers[ski]
+	if p == nil {
+		p = &restartPeer{}
+		d.peers[ski] = p
+	}
+	return p
+}
+
+// restartConnected counts a connection of a DUT, every connection after a disconnect
+// is a reconnect that is classified with its first received datagram
+func (h *hems) restartConnected(ski string) {
+	ski = shiputil.NormalizeSKI(ski)
+	h.restarts.mu.Lock()
+	defer h.restarts.mu.Unlock()
+	p := h.restarts.peer(ski)
+	p.stats.Connections++
+	if p.disconnectedAt.IsZero() {
+		return
+	}
+	now := time.Now()
+	p.pending = &remoteRestart{Time: now, SKI: ski, Kind: reconnectPlain, DisconnectedAt: p.disconnectedAt, DowntimeSeconds: now.Sub(p.disconnectedAt).Seconds(), Evidence: []string{}}
+	if !p.closeAnnounced {
+		p.pending.Evidence = append(p.pending.Evidence, "previous connection dropped without SHIP connectionClose")
+	}
+}
+
+// restartDisconnected remembers how the connection of a DUT ended
+func (h *hems) restartDisconnected(ski string, closeAnnounced bool) {
+	ski = shiputil.NormalizeSKI(ski)
+	h.restarts.mu.Lock()
+	p := h.restarts.peer(ski)
+	// a reconnect without any datagram is reported with the evidence known so far
+	pending := p.pending
+	p.pending = nil
+	p.disconnectedAt = time.Now()
+	p.closeAnnounced = closeAnnounced
+	h.restarts.mu.Unlock()
+	if pending != nil {
+		h.finishReconnect(p, *pending)
+	}
+}
+
+// observeRestartDatagram tracks the msgCounter and device address of the received datagrams
+// and classifies a pending reconnect with the first of them. SPINE devices start their
+// msgCounter anew when they restart, a changed device address indicates a new configuration.
+func (h *hems) observeRestartDatagram(dg capturedDatagram) {
+	if h.restarts == nil || dg.MsgCounter == nil {
+		return
+	}
+	h.restarts.mu.Lock()
+	p := h.restarts.peer(dg.SKI)
+	pending := p.pending
+	if pending == nil && p.deviceAddress != "" {
+		n := *dg.MsgCounter
+		p.msgCounter = &n
+		h.restarts.mu.Unlock()
+		return
+	}
+
+	address := ""
+	var spine model.Datagram
+	if err := json.Unmarshal(dg.Datagram, &spine); err == nil && spine.Datagram.Header.AddressSource != nil && spine.Datagram.Header.AddressSource.Device != nil {
+		address = string(*spine.Datagram.Header.AddressSource.Device)
+	}
+	if pending != nil {
+		p.pending = nil
+		counterReset := p.msgCounter != nil && *dg.MsgCounter < *p.msgCounter
+		addressChanged := p.deviceAddress != "" && address != "" && address != p.deviceAddress
+		if counterReset {
+			pending.Evidence = append(pending.Evidence, fmt.Sprintf("msgCounter restarted at %d after %d", *dg.MsgCounter, *p.msgCounter))
+		}
+		if addressChanged {
+			pending.Evidence = append(pending.Evidence, fmt.Sprintf("SPINE device address changed from %s to %s", p.deviceAddress, address))
+		}
+		// a counter reset alone also happens when the DUT reconnects gracefully, as
+		// stacks keep the msgCounter per connection
+		if addressChanged || (counterReset && !p.closeAnnounced) {
+			pending.Kind = reconnectRestart
+		}
+	}
+	n := *dg.MsgCounter
+	p.msgCounter = &n
+	if address != "" {
+		p.deviceAddress = address
+	}
+	h.restarts.mu.Unlock()
+	if pending != nil {
+		h.finishReconnect(p, *pending)
+	}
+}
+
+// finishReconnect stores a classified reconnect and marks it on the timeline
+func (h *hems) finishReconnect(p *restartPeer, r remoteRestart) {
+	h.restarts.mu.Lock()
+	p.stats.Reconnects++
+	if r.Kind == reconnectRestart {
+		p.stats.Restarts++
+		t := r.Time
+		p.stats.LastRestartAt = &t
+	}
+	h.restarts.restarts = append(h.restarts.restarts, r)
+	if len(h.restarts.restarts) > maxRemoteRestarts {
+		h.restarts.restarts = h.restarts.restarts[len(h.restarts.restarts)-maxRemoteRestarts:]
+	}
+	h.restarts.mu.Unlock()
+
+	data := map[string]interface{}{"kind": r.Kind, "downtimeSeconds": r.DowntimeSeconds, "evidence": r.Evidence}
+	if r.Kind == reconnectRestart {
+		h.recordEvent("restart", severityWarning, r.SKI, "DUT restarted: "+strings.Join(r.Evidence, ", "), data)
+		return
+	}
+	h.recordEvent("restart", severityInfo, r.SKI, fmt.Sprintf("DUT reconnected after %.1f s", r.DowntimeSeconds), data)
+}
+
+// getRestarts returns the connection counts per DUT and the reconnects, newest first
+func (h *hems) getRestarts(ski string) map[string]interface{} {
+	ski = shiputil.NormalizeSKI(ski)
+	h.restarts.mu.Lock()
+	defer h.restarts.mu.Unlock()
+	stats := make(map[string]restartStats)
+	for key, p := range h.restarts.peers {
+		if ski == "" || key == ski {
+			stats[key] = p.stats
+		}
+	}
+	restarts := []remoteRestart{}
+	for i := len(h.restarts.restarts) - 1; i >= 0; i-- {
+		r := h.restarts.restarts[i]
+		if ski != "" && r.SKI != ski {
+			continue
+		}
+		r.Evidence = append([]string(nil), r.Evidence...)
+		restarts = append(restarts, r)
+	}
+	return map[string]interface{}{"stats": stats, "restarts": restarts}
+}
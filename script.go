@@ -0,0 +1,1004 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// Test scripts are small line based programs for conditional test logic:
+//
+//	# comment
+//	let limit = 4200
+//	if supports("LPC") && scenario("LPC", 3)
+//	  write lpc value=limit duration=120
+//	  assert write.state == "acknowledged", "limit accepted"
+//	  wait 2
+//	  read lpc
+//	  assert lpc.consumptionLimit.value == limit, "limit read back"
+//	else
+//	  log "LPC scenario 3 not supported"
+//	end
+//
+// Expressions support numbers, strings, true/false/null, variables with dotted paths
+// into read results, the operators || && ! == != < <= > >= + - * / and the functions
+// supports(uc), scenario(uc, n), scenarios(uc), connected(), len(x), abs(x) and now().
+
+// defaultScriptTimeout is the time a script may run
+const defaultScriptTimeout = 30 * time.Minute
+
+// maxScriptLog is the number of log lines kept per script run
+const maxScriptLog = 500
+
+// scriptStmt is a statement of a test script
+type scriptStmt struct {
+	line     int
+	kind     string
+	target   string
+	expr     scriptExpr
+	args     map[string]scriptExpr
+	message  string
+	source   string
+	body     []scriptStmt
+	elseBody []scriptStmt
+}
+
+// parseScript parses a test script into statements
+func parseScript(src string) ([]scriptStmt, error) {
+	lines := strings.Split(src, "\n")
+	pos := 0
+	stmts, end, err := parseScriptBlock(lines, &pos)
+	if err != nil {
+		return nil, err
+	}
+	if end != "" {
+		return nil, fmt.Errorf("line %d: %s without if", pos, end)
+	}
+	return stmts, nil
+}
+
+// parseScriptBlock parses statements until else, end or the end of the script and returns the terminator
+func parseScriptBlock(lines []string, pos *int) ([]scriptStmt, string, error) {
+	var stmts []scriptStmt
+	for *pos < len(lines) {
+		raw := strings.TrimSpace(lines[*pos])
+		*pos++
+		lineNo := *pos
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(raw, " ")
+		rest = strings.TrimSpace(rest)
+		st := scriptStmt{line: lineNo, kind: keyword, source: raw}
+		var err error
+		switch keyword {
+		case "else", "end":
+			if rest != "" {
+				return nil, "", fmt.Errorf("line %d: unexpected %q after %s", lineNo, rest, keyword)
+			}
+			return stmts, keyword, nil
+		case "if":
+			if st.expr, err = parseScriptExpr(rest); err != nil {
+				break
+			}
+			var term string
+			if st.body, term, err = parseScriptBlock(lines, pos); err != nil {
+				return nil, "", err
+			}
+			if term == "else" {
+				if st.elseBody, term, err = parseScriptBlock(lines, pos); err != nil {
+					return nil, "", err
+				}
+			}
+			if term != "end" {
+				return nil, "", fmt.Errorf("line %d: if without end", lineNo)
+			}
+		case "let":
+			name, expr, ok := strings.Cut(rest, "=")
+			st.target = strings.TrimSpace(name)
+			if !ok || !isScriptIdent(st.target) {
+				err = errors.New("expected let <name> = <expression>")
+				break
+			}
+			st.expr, err = parseScriptExpr(expr)
+		case "read":
+			st.target = rest
+			if rest != "lpc" && rest != "evcc" {
+				err = errors.New("read supports lpc and evcc")
+			}
+		case "write":
+			fields := strings.Fields(rest)
+			if len(fields) == 0 || (fields[0] != "lpc" && fields[0] != "lpp") {
+				err = errors.New("write supports lpc and lpp")
+				break
+			}
+			st.target = fields[0]
+			st.args = map[string]scriptExpr{}
+			for _, f := range fields[1:] {
+				key, value, ok := strings.Cut(f, "=")
+				if !ok || (key != "value" && key != "duration" && key != "active") {
+					err = fmt.Errorf("invalid write argument %q, use value=, duration= and active=", f)
+					break
+				}
+				if st.args[key], err = parseScriptExpr(value); err != nil {
+					break
+				}
+			}
+			if err == nil && st.args["value"] == nil {
+				err = errors.New("write requires value=")
+			}
+		case "assert":
+			st.expr, st.message, err = parseScriptAssert(rest)
+		case "wait", "log":
+			st.expr, err = parseScriptExpr(rest)
+		default:
+			err = fmt.Errorf("unknown statement %q", keyword)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		stmts = append(stmts, st)
+	}
+	return stmts, "", nil
+}
+
+// parseScriptAssert parses `<expression>[, "message"]`
+func parseScriptAssert(src string) (scriptExpr, string, error) {
+	p := &scriptParser{src: src}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, "", err
+	}
+	message := ""
+	if p.peekByte() == ',' {
+		p.pos++
+		p.skipSpace()
+		if p.peekByte() != '"' {
+			return nil, "", errors.New("expected message string after ,")
+		}
+		if message, err = p.parseString(); err != nil {
+			return nil, "", err
+		}
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, "", fmt.Errorf("unexpected %q", p.src[p.pos:])
+	}
+	return expr, message, nil
+}
+
+func isScriptIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// scriptEnv is the state an expression is evaluated in
+type scriptEnv struct {
+	h    *hems
+	ski  string
+	vars map[string]interface{}
+}
+
+// scriptExpr is an evaluable expression
+type scriptExpr interface {
+	eval(env *scriptEnv) (interface{}, error)
+}
+
+type scriptLiteral struct{ value interface{} }
+
+func (e scriptLiteral) eval(*scriptEnv) (interface{}, error) { return e.value, nil }
+
+// scriptPath is a variable with an optional dotted path into maps and lists
+type scriptPath struct{ parts []string }
+
+func (e scriptPath) eval(env *scriptEnv) (interface{}, error) {
+	v, ok := env.vars[e.parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %q", e.parts[0])
+	}
+	for _, part := range e.parts[1:] {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			v = c[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				v = nil
+			} else {
+				v = c[i]
+			}
+		default:
+			v = nil
+		}
+	}
+	return v, nil
+}
+
+type scriptUnary struct {
+	op string
+	x  scriptExpr
+}
+
+func (e scriptUnary) eval(env *scriptEnv) (interface{}, error) {
+	v, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !scriptTruthy(v), nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %v", v)
+	}
+	return -f, nil
+}
+
+type scriptBinary struct {
+	op   string
+	l, r scriptExpr
+}
+
+func (e scriptBinary) eval(env *scriptEnv) (interface{}, error) {
+	l, err := e.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// short circuit, so `supports("LPC") && lpc.x` does not need lpc
+	switch e.op {
+	case "&&":
+		if !scriptTruthy(l) {
+			return false, nil
+		}
+		r, err := e.r.eval(env)
+		return scriptTruthy(r), err
+	case "||":
+		if scriptTruthy(l) {
+			return true, nil
+		}
+		r, err := e.r.eval(env)
+		return scriptTruthy(r), err
+	}
+	r, err := e.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return scriptEqual(l, r), nil
+	case "!=":
+		return !scriptEqual(l, r), nil
+	}
+	if ls, ok := l.(string); ok && e.op == "+" {
+		return ls + fmt.Sprint(scriptDisplay(r)), nil
+	}
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("operator %s needs numbers, got %v and %v", e.op, scriptDisplay(l), scriptDisplay(r))
+	}
+	switch e.op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	case ">=":
+		return lf >= rf, nil
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return lf / rf, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", e.op)
+}
+
+type scriptCall struct {
+	name string
+	args []scriptExpr
+}
+
+func (e scriptCall) eval(env *scriptEnv) (interface{}, error) {
+	args := make([]interface{}, len(e.args))
+	for i, a := range e.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	argc := map[string]int{"supports": 1, "scenario": 2, "scenarios": 1, "connected": 0, "len": 1, "abs": 1, "now": 0}
+	n, ok := argc[e.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", e.name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d arguments", e.name, n)
+	}
+
+	switch e.name {
+	case "supports":
+		return len(env.h.scriptScenarios(args[0], env.ski)) > 0, nil
+	case "scenario":
+		want, ok := args[1].(float64)
+		if !ok {
+			return nil, errors.New("scenario number must be a number")
+		}
+		for _, s := range env.h.scriptScenarios(args[0], env.ski) {
+			if float64(s) == want {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "scenarios":
+		out := []interface{}{}
+		for _, s := range env.h.scriptScenarios(args[0], env.ski) {
+			out = append(out, float64(s))
+		}
+		return out, nil
+	case "connected":
+		peer := env.h.testRunPeer(env.ski)
+		if peer == nil {
+			return false, nil
+		}
+		env.h.peersMu.Lock()
+		defer env.h.peersMu.Unlock()
+		return peer.connected, nil
+	case "len":
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return float64(0), nil
+	case "abs":
+		f, ok := args[0].(float64)
+		if !ok {
+			return nil, errors.New("abs needs a number")
+		}
+		return math.Abs(f), nil
+	}
+	return float64(time.Now().UnixMilli()) / 1000, nil
+}
+
+func scriptTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func scriptEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case float64, string, bool:
+		return a == b
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// scriptDisplay formats a value for log lines and assertion messages
+func scriptDisplay(v interface{}) interface{} {
+	if v == nil {
+		return "null"
+	}
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return v
+}
+
+// scriptParser parses expressions by precedence climbing
+type scriptParser struct {
+	src string
+	pos int
+}
+
+func parseScriptExpr(src string) (scriptExpr, error) {
+	p := &scriptParser{src: src}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q", p.src[p.pos:])
+	}
+	return expr, nil
+}
+
+func (p *scriptParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\r') {
+		p.pos++
+	}
+}
+
+func (p *scriptParser) peekByte() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// accept consumes the first of the operators the input starts with
+func (p *scriptParser) accept(ops ...string) string {
+	p.skipSpace()
+	for _, op := range ops {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			// do not take < from <= or ! from !=
+			if (op == "<" || op == ">" || op == "!") && strings.HasPrefix(p.src[p.pos+1:], "=") {
+				continue
+			}
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *scriptParser) parseBinary(next func() (scriptExpr, error), ops ...string) (scriptExpr, error) {
+	l, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.accept(ops...)
+		if op == "" {
+			return l, nil
+		}
+		r, err := next()
+		if err != nil {
+			return nil, err
+		}
+		l = scriptBinary{op: op, l: l, r: r}
+	}
+}
+
+func (p *scriptParser) parseOr() (scriptExpr, error) { return p.parseBinary(p.parseAnd, "||") }
+func (p *scriptParser) parseAnd() (scriptExpr, error) {
+	return p.parseBinary(p.parseCompare, "&&")
+}
+func (p *scriptParser) parseCompare() (scriptExpr, error) {
+	return p.parseBinary(p.parseSum, "==", "!=", "<=", ">=", "<", ">")
+}
+func (p *scriptParser) parseSum() (scriptExpr, error) { return p.parseBinary(p.parseProduct, "+", "-") }
+func (p *scriptParser) parseProduct() (scriptExpr, error) {
+	return p.parseBinary(p.parseUnary, "*", "/")
+}
+
+func (p *scriptParser) parseUnary() (scriptExpr, error) {
+	if op := p.accept("!", "-"); op != "" {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return scriptUnary{op: op, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *scriptParser) parsePrimary() (scriptExpr, error) {
+	c := p.peekByte()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekByte() != ')' {
+			return nil, errors.New("expected )")
+		}
+		p.pos++
+		return x, nil
+	case c == '"':
+		s, err := p.parseString()
+		return scriptLiteral{s}, err
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.' || p.src[p.pos] == 'e') {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return scriptLiteral{f}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && (isScriptIdent(p.src[p.pos:p.pos+1]) || p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if name == "" {
+		return nil, fmt.Errorf("unexpected %q", p.src[p.pos:])
+	}
+	switch name {
+	case "true":
+		return scriptLiteral{true}, nil
+	case "false":
+		return scriptLiteral{false}, nil
+	case "null":
+		return scriptLiteral{nil}, nil
+	}
+	if p.peekByte() == '(' {
+		p.pos++
+		call := scriptCall{name: name}
+		for p.peekByte() != ')' {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.peekByte() == ',' {
+				p.pos++
+			} else if p.peekByte() != ')' {
+				return nil, fmt.Errorf("expected , or ) in call of %s", name)
+			}
+		}
+		p.pos++
+		return call, nil
+	}
+	parts := strings.Split(name, ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid variable %q", name)
+		}
+	}
+	if !isScriptIdent(parts[0]) {
+		return nil, fmt.Errorf("invalid variable %q", name)
+	}
+	return scriptPath{parts: parts}, nil
+}
+
+func (p *scriptParser) parseString() (string, error) {
+	p.skipSpace()
+	end := p.pos + 1
+	for end < len(p.src) && p.src[end] != '"' {
+		if p.src[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.src) {
+		return "", errors.New("unterminated string")
+	}
+	s, err := strconv.Unquote(p.src[p.pos : end+1])
+	p.pos = end + 1
+	return s, err
+}
+
+// scriptScenarios returns the scenarios the DUT supports for a use case name like "LPC"
+func (h *hems) scriptScenarios(name interface{}, ski string) []uint {
+	uc := h.usecaseByName(fmt.Sprint(name))
+	if uc == nil {
+		return nil
+	}
+	ski = shiputil.NormalizeSKI(ski)
+	var out []uint
+	for _, s := range uc.RemoteEntitiesScenarios() {
+		if s.Entity == nil || s.Entity.Device() == nil {
+			continue
+		}
+		if ski != "" && shiputil.NormalizeSKI(s.Entity.Device().Ski()) != ski {
+			continue
+		}
+		out = append(out, s.Scenarios...)
+	}
+	return out
+}
+
+// usecaseByName returns the enabled local use case implementation by its short name
+func (h *hems) usecaseByName(name string) api.UseCaseBaseInterface {
+	var uc api.UseCaseBaseInterface
+	switch strings.ToUpper(name) {
+	case "LPC":
+		if h.uceglpc != nil {
+			uc = h.uceglpc
+		}
+	case "LPP":
+		if h.uceglpp != nil {
+			uc = h.uceglpp
+		}
+	case "EVCC":
+		if h.uccemevcc != nil {
+			uc = h.uccemevcc
+		}
+	case "EVCEM":
+		if h.uccemevcem != nil {
+			uc = h.uccemevcem
+		}
+	case "EVSECC":
+		if h.uccemevsecc != nil {
+			uc = h.uccemevsecc
+		}
+	case "OPEV":
+		if h.uccemopev != nil {
+			uc = h.uccemopev
+		}
+	case "OSCEV":
+		if h.uccemoscev != nil {
+			uc = h.uccemoscev
+		}
+	case "EVSOC":
+		if h.uccemevsoc != nil {
+			uc = h.uccemevsoc
+		}
+	case "CEVC":
+		if h.uccemcevc != nil {
+			uc = h.uccemcevc
+		}
+	case "MPC":
+		if h.ucmampc != nil {
+			uc = h.ucmampc
+		}
+	case "MGCP":
+		if h.ucmamgrp != nil {
+			uc = h.ucmamgrp
+		}
+	}
+	return uc
+}
+
+// scriptRequest starts a test script
+type scriptRequest struct {
+	// Name identifies the script, runs of the same name are compared as one plan
+	Name           string  `json:"name"`
+	SKI            string  `json:"ski,omitempty"`
+	Script         string  `json:"script"`
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// scriptRun is an active or finished script execution
+type scriptRun struct {
+	Name       string          `json:"name"`
+	SKI        string          `json:"ski,omitempty"`
+	Running    bool            `json:"running"`
+	StartedAt  time.Time       `json:"startedAt"`
+	EndedAt    *time.Time      `json:"endedAt,omitempty"`
+	Line       int             `json:"line,omitempty"`
+	Log        []string        `json:"log"`
+	Assertions []testAssertion `json:"assertions"`
+	// Error is set when the script aborted, e.g. on a failed read
+	Error    string           `json:"error,omitempty"`
+	Passed   bool             `json:"passed"`
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// scriptState holds the current or last script run
+type scriptState struct {
+	mu   sync.Mutex
+	run  *scriptRun
+	stop chan struct{}
+}
+
+// startScript parses a script and executes it in the background
+func (h *hems) startScript(req scriptRequest) (*scriptRun, error) {
+	if !isScriptIdent(strings.ReplaceAll(req.Name, "-", "_")) {
+		return nil, errors.New("name must consist of letters, digits, - and _")
+	}
+	stmts, err := parseScript(req.Script)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultScriptTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds * float64(time.Second))
+	}
+
+	run := &scriptRun{Name: req.Name, SKI: req.SKI, Running: true, StartedAt: time.Now(), Log: []string{}, Assertions: []testAssertion{}, Metadata: req.Metadata}
+	h.scripts.mu.Lock()
+	if h.scripts.run != nil && h.scripts.run.Running {
+		h.scripts.mu.Unlock()
+		return nil, errors.New("a script is already running")
+	}
+	h.scripts.run = run
+	stop := make(chan struct{})
+	h.scripts.stop = stop
+	snap := copyScriptRun(run)
+	h.scripts.mu.Unlock()
+
+	go h.runScript(run, stmts, timeout, stop)
+	h.recordEvent("script", severityInfo, req.SKI, "script "+req.Name+" started", nil)
+	return snap, nil
+}
+
+// stopScript aborts the running script
+func (h *hems) stopScript() bool {
+	h.scripts.mu.Lock()
+	defer h.scripts.mu.Unlock()
+	if h.scripts.run == nil || !h.scripts.run.Running || h.scripts.stop == nil {
+		return false
+	}
+	close(h.scripts.stop)
+	h.scripts.stop = nil
+	return true
+}
+
+func (h *hems) runScript(run *scriptRun, stmts []scriptStmt, timeout time.Duration, stop chan struct{}) {
+	env := &scriptEnv{h: h, ski: run.SKI, vars: map[string]interface{}{"ski": run.SKI}}
+	x := &scriptExecution{h: h, run: run, env: env, deadline: time.Now().Add(timeout), stop: stop}
+	x.span = h.tracer.startSpan("test script/"+run.Name, spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	err := x.exec(stmts)
+
+	now := time.Now()
+	h.scripts.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Passed = err == nil
+	if err != nil {
+		run.Error = err.Error()
+	}
+	for _, a := range run.Assertions {
+		if !a.Passed {
+			run.Passed = false
+		}
+	}
+	result := &testRunResult{Plan: "script/" + run.Name, SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata, EndedAt: now,
+		Assertions: append([]testAssertion(nil), run.Assertions...)}
+	if err != nil {
+		// an aborted script fails even if all assertions so far passed
+		result.Assertions = append(result.Assertions, testAssertion{Name: "script completed", Message: err.Error()})
+	}
+	passed := run.Passed
+	h.scripts.mu.Unlock()
+
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("script: %v", err)
+	} else {
+		h.scripts.mu.Lock()
+		run.ResultID = result.ID
+		h.scripts.mu.Unlock()
+	}
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if err != nil {
+			spanErr = err.Error()
+		}
+	}
+	x.span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	x.span.end(now, spanErr)
+	h.Infof("script %s %s", run.Name, verdict)
+	h.recordEvent("script", severity, run.SKI, "script "+run.Name+" "+verdict, nil)
+}
+
+// scriptExecution executes the statements of one run
+type scriptExecution struct {
+	h        *hems
+	run      *scriptRun
+	env      *scriptEnv
+	deadline time.Time
+	stop     chan struct{}
+	// span of the run, the traced statements are its children
+	span *traceSpan
+}
+
+func (x *scriptExecution) logf(format string, args ...interface{}) {
+	line := formatTimestamp(time.Now()) + " " + fmt.Sprintf(format, args...)
+	x.h.scripts.mu.Lock()
+	x.run.Log = append(x.run.Log, line)
+	if len(x.run.Log) > maxScriptLog {
+		x.run.Log = x.run.Log[len(x.run.Log)-maxScriptLog:]
+	}
+	x.h.scripts.mu.Unlock()
+}
+
+func (x *scriptExecution) exec(stmts []scriptStmt) error {
+	for _, st := range stmts {
+		select {
+		case <-x.stop:
+			return errors.New("stopped")
+		default:
+		}
+		if time.Now().After(x.deadline) {
+			return errors.New("timeout")
+		}
+		x.h.scripts.mu.Lock()
+		x.run.Line = st.line
+		asserted := len(x.run.Assertions)
+		x.h.scripts.mu.Unlock()
+
+		// statements talking to the DUT or checking it are test steps
+		var step *traceSpan
+		switch st.kind {
+		case "read", "write", "wait", "assert":
+			step = x.span.startSpan("script "+st.kind, spanKindInternal, time.Now(),
+				attr("script.line", st.line), attr("script.source", strings.TrimSpace(st.source)))
+		}
+		err := x.execStmt(st)
+		if step != nil {
+			errText := ""
+			if err != nil {
+				errText = err.Error()
+			}
+			x.h.scripts.mu.Lock()
+			if st.kind == "assert" && len(x.run.Assertions) > asserted && !x.run.Assertions[asserted].Passed {
+				errText = x.run.Assertions[asserted].Message
+			}
+			x.h.scripts.mu.Unlock()
+			if w, ok := x.env.vars["write"].(map[string]interface{}); ok && st.kind == "write" && err == nil {
+				step.setAttrs(attr("command.id", w["id"]), attr("command.state", w["state"]))
+			}
+			step.end(time.Now(), errText)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", st.line, err)
+		}
+	}
+	return nil
+}
+
+func (x *scriptExecution) execStmt(st scriptStmt) error {
+	switch st.kind {
+	case "let":
+		v, err := st.expr.eval(x.env)
+		if err != nil {
+			return err
+		}
+		x.env.vars[st.target] = v
+	case "if":
+		v, err := st.expr.eval(x.env)
+		if err != nil {
+			return err
+		}
+		if scriptTruthy(v) {
+			return x.exec(st.body)
+		}
+		return x.exec(st.elseBody)
+	case "log":
+		v, err := st.expr.eval(x.env)
+		if err != nil {
+			return err
+		}
+		x.logf("%v", scriptDisplay(v))
+	case "wait":
+		v, err := st.expr.eval(x.env)
+		if err != nil {
+			return err
+		}
+		seconds, ok := v.(float64)
+		if !ok || seconds < 0 {
+			return errors.New("wait needs a non negative number of seconds")
+		}
+		select {
+		case <-time.After(time.Duration(seconds * float64(time.Second))):
+		case <-x.stop:
+			return errors.New("stopped")
+		}
+	case "assert":
+		v, err := st.expr.eval(x.env)
+		if err != nil {
+			return err
+		}
+		a := testAssertion{Name: st.message, Passed: scriptTruthy(v)}
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("line %d: %s", st.line, strings.TrimSpace(strings.TrimPrefix(st.source, "assert")))
+		}
+		if !a.Passed {
+			a.Message = "assertion failed: " + strings.TrimSpace(strings.TrimPrefix(st.source, "assert"))
+		}
+		x.h.scripts.mu.Lock()
+		x.run.Assertions = append(x.run.Assertions, a)
+		x.h.scripts.mu.Unlock()
+		x.logf("assert %s: %t", a.Name, a.Passed)
+	case "read":
+		return x.read(st.target)
+	case "write":
+		return x.write(st)
+	}
+	return nil
+}
+
+// read reads the use case data of the first entity into the variable named like the use case
+func (x *scriptExecution) read(target string) error {
+	var v interface{}
+	switch target {
+	case "lpc":
+		readings, err := x.h.readLPC(x.env.ski)
+		if err != nil {
+			return fmt.Errorf("read lpc: %w", err)
+		}
+		v = readings[0]
+	case "evcc":
+		readings, err := x.h.readEVCC(x.env.ski)
+		if err != nil {
+			return fmt.Errorf("read evcc: %w", err)
+		}
+		v = readings[0]
+	}
+	x.env.vars[target] = toGenericObject(v)
+	x.logf("read %s", target)
+	return nil
+}
+
+// write sends a limit through the command queue and stores its outcome in the variable write
+func (x *scriptExecution) write(st scriptStmt) error {
+	args := map[string]interface{}{"duration": float64(0), "active": true}
+	for key, expr := range st.args {
+		v, err := expr.eval(x.env)
+		if err != nil {
+			return err
+		}
+		args[key] = v
+	}
+	value, ok := args["value"].(float64)
+	if !ok {
+		return errors.New("write value must be a number")
+	}
+	duration, ok := args["duration"].(float64)
+	if !ok || duration < 0 {
+		return errors.New("write duration must be a non negative number")
+	}
+	active := scriptTruthy(args["active"])
+
+	cmd, write := "writeLPCConsumptionLimit", x.h.WriteLPCConsumptionLimit
+	if st.target == "lpp" {
+		cmd, write = "writeLPPProductionLimit", x.h.WriteLPPProductionLimit
+	}
+	payload := map[string]interface{}{"ski": x.env.ski, "value": value, "isActive": active, "durationSeconds": duration}
+	c, err := x.h.enqueueCommand(cmd, payload, nil, func() ([]sentMessage, error) {
+		return write(x.env.ski, int64(duration), value, active)
+	})
+	if err != nil {
+		return fmt.Errorf("write %s: %w", st.target, err)
+	}
+	<-c.done
+	snap, _ := x.h.getCommand(c.ID)
+	x.env.vars["write"] = map[string]interface{}{"id": snap.ID, "state": string(snap.State), "error": snap.Error}
+	x.logf("write %s value=%g duration=%g active=%t: %s", st.target, value, duration, active, snap.State)
+	return nil
+}
+
+func copyScriptRun(run *scriptRun) *scriptRun {
+	c := *run
+	c.Log = append([]string(nil), run.Log...)
+	c.Assertions = append([]testAssertion(nil), run.Assertions...)
+	return &c
+}
+
+// getScript returns a copy of the current or last script run
+func (h *hems) getScript() *scriptRun {
+	h.scripts.mu.Lock()
+	defer h.scripts.mu.Unlock()
+	if h.scripts.run == nil {
+		return nil
+	}
+	return copyScriptRun(h.scripts.run)
+}
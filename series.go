@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSeriesPoints is the number of points kept per peer and series
+const maxSeriesPoints = 100000
+
+// maxSeriesResponsePoints limits raw responses, larger ranges are downsampled automatically
+const maxSeriesResponsePoints = 20000
+
+// seriesPoint is a single measurement value
+type seriesPoint struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// seriesBucket aggregates the points of one time bucket
+type seriesBucket struct {
+	Time  time.Time `json:"t"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+	Count int       `json:"count"`
+}
+
+// seriesStore keeps the numeric usecase values of all peers over time
+type seriesStore struct {
+	mu sync.Mutex
+	// series maps ski -> series name -> points in time order
+	series map[string]map[string][]seriesPoint
+}
+
+func newSeriesStore() *seriesStore {
+	return &seriesStore{series: make(map[string]map[string][]seriesPoint)}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// seriesValues flattens the numeric fields of the usecase data into series values,
+// named by their JSON name, per phase values get an index suffix, e.g. "mpcPowerPerPhase.0"
+func seriesValues(data usecaseData) map[string]float64 {
+	values := make(map[string]float64)
+	v := reflect.ValueOf(data)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || field.Type == durationType {
+			continue
+		}
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.Float64:
+			values[name] = fv.Float()
+		case reflect.Uint:
+			values[name] = float64(fv.Uint())
+		case reflect.Bool:
+			if fv.Bool() {
+				values[name] = 1
+			} else {
+				values[name] = 0
+			}
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() != reflect.Float64 {
+				continue
+			}
+			for j := 0; j < fv.Len(); j++ {
+				values[fmt.Sprintf("%s.%d", name, j)] = fv.Index(j).Float()
+			}
+		}
+	}
+	return values
+}
+
+// recordSeries appends the changed usecase values of a peer to its series
+func (h *hems) recordSeries(ski string, peer *peerData) {
+	now := time.Now()
+	values := seriesValues(peer.usecaseData)
+
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	peerSeries, ok := h.series.series[ski]
+	if !ok {
+		peerSeries = make(map[string][]seriesPoint)
+		h.series.series[ski] = peerSeries
+	}
+	for name, value := range values {
+		points := peerSeries[name]
+		if n := len(points); n > 0 && points[n-1].Value == value {
+			continue
+		}
+		if len(points) == 0 && value == 0 {
+			// fields that were never reported
+			continue
+		}
+		points = append(points, seriesPoint{Time: now, Value: value})
+		if len(points) > maxSeriesPoints {
+			points = points[len(points)-maxSeriesPoints:]
+		}
+		peerSeries[name] = points
+	}
+}
+
+// seriesNames returns the names of the recorded series per peer
+func (h *hems) seriesNames(ski string) map[string][]string {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	out := make(map[string][]string)
+	for key, peerSeries := range h.series.series {
+		if ski != "" && key != ski {
+			continue
+		}
+		names := make([]string, 0, len(peerSeries))
+		for name := range peerSeries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out[key] = names
+	}
+	return out
+}
+
+// seriesRange returns a copy of the points of a series within [since, until], zero times are open
+func (h *hems) seriesRange(ski, name string, since, until time.Time) []seriesPoint {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	points := h.series.series[ski][name]
+	start := 0
+	if !since.IsZero() {
+		start = sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(since) })
+	}
+	end := len(points)
+	if !until.IsZero() {
+		end = sort.Search(len(points), func(i int) bool { return points[i].Time.After(until) })
+	}
+	if start >= end {
+		return []seriesPoint{}
+	}
+	return append([]seriesPoint(nil), points[start:end]...)
+}
+
+// downsampleSeries aggregates points into buckets of the given width, aligned to the bucket width
+func downsampleSeries(points []seriesPoint, width time.Duration) []seriesBucket {
+	buckets := []seriesBucket{}
+	if width <= 0 {
+		return buckets
+	}
+	var sum float64
+	for _, p := range points {
+		start := p.Time.Truncate(width)
+		n := len(buckets)
+		if n == 0 || !buckets[n-1].Time.Equal(start) {
+			if n > 0 {
+				buckets[n-1].Avg = sum / float64(buckets[n-1].Count)
+			}
+			buckets = append(buckets, seriesBucket{Time: start, Min: math.Inf(1), Max: math.Inf(-1)})
+			sum = 0
+			n++
+		}
+		b := &buckets[n-1]
+		b.Min = math.Min(b.Min, p.Value)
+		b.Max = math.Max(b.Max, p.Value)
+		b.Last = p.Value
+		b.Count++
+		sum += p.Value
+	}
+	if n := len(buckets); n > 0 {
+		buckets[n-1].Avg = sum / float64(buckets[n-1].Count)
+	}
+	return buckets
+}
+
+// bucketWidth returns the bucket width to get at most maxPoints buckets for the range
+func bucketWidth(points []seriesPoint, maxPoints int) time.Duration {
+	if len(points) < 2 || maxPoints <= 0 || len(points) <= maxPoints {
+		return 0
+	}
+	span := points[len(points)-1].Time.Sub(points[0].Time)
+	width := span / time.Duration(maxPoints)
+	// round up to full seconds so the bucket count stays below maxPoints
+	if r := width % time.Second; r != 0 || width == 0 {
+		width += time.Second - r
+	}
+	return width
+}
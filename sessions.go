@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// maxSessions is the number of charging sessions kept in memory
+const maxSessions = 200
+
+// chargingSession summarizes a single charging session of an EV at a peer,
+// detected from EVCC connect/disconnect events and EVCEM measurements
+type chargingSession struct {
+	ID  string `json:"id"`
+	SKI string `json:"ski"`
+	// DUT is the registry entry of the SKI when the session started
+	DUT               string     `json:"dut,omitempty"`
+	Active            bool       `json:"active"`
+	StartedAt         time.Time  `json:"startedAt"`
+	EndedAt           *time.Time `json:"endedAt,omitempty"`
+	DurationSeconds   int64      `json:"durationSeconds"`
+	EnergyDeliveredWh float64    `json:"energyDeliveredWh"`
+	MaxPowerW         float64    `json:"maxPowerW"`
+	Identifications   []string   `json:"identifications,omitempty"`
+	EndReason         string     `json:"endReason,omitempty"`
+
+	// energy counter bookkeeping, the EVCEM counter may be reset by the DUT
+	energyStart float64
+	energyLast  float64
+	energyBase  float64
+	hasEnergy   bool
+}
+
+// sessionTracker keeps the charging sessions of all peers
+type sessionTracker struct {
+	mu       sync.Mutex
+	nextID   int
+	sessions []*chargingSession
+	active   map[string]*chargingSession
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{active: make(map[string]*chargingSession)}
+}
+
+func (s *chargingSession) snapshot(now time.Time) chargingSession {
+	out := *s
+	end := now
+	if s.EndedAt != nil {
+		end = *s.EndedAt
+	}
+	out.DurationSeconds = int64(end.Sub(s.StartedAt) / time.Second)
+	out.Identifications = append([]string(nil), s.Identifications...)
+	return out
+}
+
+// sessionStarted opens a new session for a peer when an EV connects
+func (h *hems) sessionStarted(ski string) {
+	dut := h.dutForSKI(ski)
+	h.sessions.mu.Lock()
+	if _, ok := h.sessions.active[ski]; ok {
+		h.sessions.mu.Unlock()
+		return
+	}
+	h.sessions.nextID++
+	now := time.Now()
+	s := &chargingSession{
+		ID:        fmt.Sprintf("s%d", h.sessions.nextID),
+		SKI:       ski,
+		DUT:       dut,
+		Active:    true,
+		StartedAt: now,
+	}
+	h.sessions.active[ski] = s
+	h.sessions.sessions = append(h.sessions.sessions, s)
+	if len(h.sessions.sessions) > maxSessions {
+		h.sessions.sessions = h.sessions.sessions[len(h.sessions.sessions)-maxSessions:]
+	}
+	snap := s.snapshot(now)
+	h.sessions.mu.Unlock()
+
+	h.Infof("charging session %s started for %s", snap.ID, ski)
+	h.broadcastSession(snap)
+}
+
+// sessionEnded closes the active session of a peer
+func (h *hems) sessionEnded(ski, reason string) {
+	h.sessions.mu.Lock()
+	s, ok := h.sessions.active[ski]
+	if !ok {
+		h.sessions.mu.Unlock()
+		return
+	}
+	delete(h.sessions.active, ski)
+	now := time.Now()
+	s.Active = false
+	s.EndedAt = &now
+	s.EndReason = reason
+	snap := s.snapshot(now)
+	h.sessions.mu.Unlock()
+
+	h.Infof("charging session %s ended for %s (%s): %.0f s, %.1f Wh", snap.ID, ski, reason, float64(snap.DurationSeconds), snap.EnergyDeliveredWh)
+	h.broadcastSession(snap)
+	h.dutSessionEnded(snap)
+}
+
+// sessionEnergy updates the delivered energy of the active session from the EVCEM energy counter
+func (h *hems) sessionEnergy(ski string, energyWh float64) {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+
+	s, ok := h.sessions.active[ski]
+	if !ok {
+		return
+	}
+	if !s.hasEnergy {
+		s.energyStart = energyWh
+		s.hasEnergy = true
+	} else if energyWh < s.energyLast {
+		// counter reset, keep the energy delivered so far
+		s.energyBase += s.energyLast - s.energyStart
+		s.energyStart = energyWh
+	}
+	s.energyLast = energyWh
+	s.EnergyDeliveredWh = s.energyBase + s.energyLast - s.energyStart
+}
+
+// sessionPower tracks the maximum total power of the active session
+func (h *hems) sessionPower(ski string, powerPerPhase []float64) {
+	total := 0.0
+	for _, p := range powerPerPhase {
+		total += p
+	}
+
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+	if s, ok := h.sessions.active[ski]; ok && total > s.MaxPowerW {
+		s.MaxPowerW = total
+	}
+}
+
+// sessionIdentifications records the identifications used in the active session
+func (h *hems) sessionIdentifications(ski string, items []ucapi.IdentificationItem) {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+
+	s, ok := h.sessions.active[ski]
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		if item.Value == "" {
+			continue
+		}
+		id := fmt.Sprintf("%s:%s", item.ValueType, item.Value)
+		known := false
+		for _, existing := range s.Identifications {
+			if existing == id {
+				known = true
+				break
+			}
+		}
+		if !known {
+			s.Identifications = append(s.Identifications, id)
+		}
+	}
+}
+
+// getSessions returns the sessions of a peer (or all peers if ski is empty), newest first
+func (h *hems) getSessions(ski string) []chargingSession {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+
+	now := time.Now()
+	out := []chargingSession{}
+	for _, s := range h.sessions.sessions {
+		if ski != "" && s.SKI != ski {
+			continue
+		}
+		out = append(out, s.snapshot(now))
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+// getSession returns a single session by its id
+func (h *hems) getSession(id string) (chargingSession, bool) {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+
+	for _, s := range h.sessions.sessions {
+		if s.ID == id {
+			return s.snapshot(time.Now()), true
+		}
+	}
+	return chargingSession{}, false
+}
+
+func (h *hems) broadcastSession(s chargingSession) {
+	h.broadcastJSON(map[string]interface{}{
+		"type":    "session",
+		"ski":     s.SKI,
+		"session": s,
+	})
+}
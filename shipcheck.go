@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	shipmodel "github.com/enbility/ship-go/model"
+	"github.com/enbility/ship-go/ship"
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// Limits of the SHIP frame capture and the stored violations
+const (
+	maxShipFrames     = 2000
+	maxShipViolations = 1000
+	// defaultMaxFrameBytes is the default size above which a received frame is reported
+	defaultMaxFrameBytes = 65536
+)
+
+// SHIP 13.4.4.1.3: T_hello_init, the longest a hello phase may be announced to wait
+const helloInitTimeout = 60 * time.Second
+
+// helloTimingTolerance is added to the waiting time a DUT announced before its next
+// hello is reported as late
+const helloTimingTolerance = time.Second
+
+// Checks of the SHIP violation detection
+const (
+	shipCheckHello     = "hello"
+	shipCheckPin       = "pinState"
+	shipCheckClose     = "close"
+	shipCheckFrameSize = "frameSize"
+)
+
+// ShipChecksConfig configures the detection of SHIP violations of the DUT
+type ShipChecksConfig struct {
+	// MaxFrameBytes is the size above which a received frame is reported, defaults to 65536
+	MaxFrameBytes int `json:"maxFrameBytes,omitempty"`
+}
+
+func (c ShipChecksConfig) maxFrameBytes() int {
+	if c.MaxFrameBytes <= 0 {
+		return defaultMaxFrameBytes
+	}
+	return c.MaxFrameBytes
+}
+
+// shipFrame is a SHIP message sent to or received from a peer. Data frames are kept
+// without their payload, which is in the datagram capture.
+type shipFrame struct {
+	ID        uint64          `json:"id"`
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	SKI       string          `json:"ski"`
+	Type      string          `json:"type"`
+	Size      int             `json:"size"`
+	Message   json.RawMessage `json:"message,omitempty"`
+	// Text is the raw trace of a frame that is no valid SHIP message
+	Text string `json:"text,omitempty"`
+	// DatagramID references the captured SPINE datagram of a data frame
+	DatagramID *uint64 `json:"datagramId,omitempty"`
+}
+
+// shipViolation is a SHIP spec violation of the DUT with the frames it was detected in
+type shipViolation struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	SKI      string    `json:"ski"`
+	Check    string    `json:"check"`
+	Message  string    `json:"message"`
+	FrameIDs []uint64  `json:"frameIds"`
+}
+
+// shipConnCheck is the state of the checks of the current connection of a peer
+type shipConnCheck struct {
+	frames []uint64
+	// started is set once a frame after the CMI init was seen
+	started bool
+	// lastHello is the frame of the last hello of the DUT, waiting the time it announced
+	lastHello     *shipFrame
+	waiting       time.Duration
+	remoteReady   bool
+	shakeDone     bool
+	pinSeen       bool
+	pinReported   bool
+	localClose    *shipFrame
+	remoteClose   *shipFrame
+	remoteConfirm bool
+}
+
+// shipInspector keeps the SHIP frames and the detected violations
+type shipInspector struct {
+	mu         sync.Mutex
+	nextFrame  uint64
+	frames     []shipFrame
+	nextID     uint64
+	violations []shipViolation
+	conns      map[string]*shipConnCheck
+}
+
+func newShipInspector() *shipInspector {
+	return &shipInspector{conns: make(map[string]*shipConnCheck)}
+}
+
+// shipMessageType returns the name of the top level element of a SHIP message
+func shipMessageType(text string) (string, json.RawMessage) {
+	if text == "ship init" {
+		return "init", nil
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(ship.JsonFromEEBUSJson([]byte(text)), &msg); err != nil || len(msg) != 1 {
+		return "unknown", nil
+	}
+	for name, body := range msg {
+		return name, body
+	}
+	return "unknown", nil
+}
+
+// inspectShipFrame captures the ship-go "Send:" and "Recv:" traces and checks the frames
+// of the DUT
+func (h *hems) inspectShipFrame(args ...interface{}) {
+	if h.shipChecks == nil || len(args) < 3 {
+		return
+	}
+	prefix, _ := args[0].(string)
+	var direction string
+	switch prefix {
+	case "Send:":
+		direction = datagramSent
+	case "Recv:":
+		direction = datagramReceived
+	default:
+		return
+	}
+	ski, _ := args[1].(string)
+	text, _ := args[2].(string)
+	ski = shiputil.NormalizeSKI(ski)
+
+	// the trace omits the leading message type byte
+	f := shipFrame{Time: time.Now(), Direction: direction, SKI: ski, Size: len(text) + 1}
+	var body json.RawMessage
+	f.Type, body = shipMessageType(text)
+	switch f.Type {
+	case "init":
+	case "data":
+		f.DatagramID = h.findDatagram(datagramFilter{SKI: ski, Direction: direction, Since: f.Time.Add(-time.Second)})
+	case "unknown":
+		f.Text = text
+	default:
+		f.Message = json.RawMessage(ship.JsonFromEEBUSJson([]byte(text)))
+	}
+
+	s := h.shipChecks
+	s.mu.Lock()
+	s.nextFrame++
+	f.ID = s.nextFrame
+	s.frames = append(s.frames, f)
+	if len(s.frames) > maxShipFrames {
+		s.frames = s.frames[len(s.frames)-maxShipFrames:]
+	}
+	c := s.conns[ski]
+	if c == nil || (f.Type == "init" && c.started) {
+		// a new connection starts with the CMI init
+		c = &shipConnCheck{}
+		s.conns[ski] = c
+	}
+	c.frames = append(c.frames, f.ID)
+	c.started = c.started || f.Type != "init"
+	found := h.checkShipFrame(c, &f, body)
+	s.mu.Unlock()
+
+	for _, v := range found {
+		h.addShipViolation(v)
+	}
+}
+
+// checkShipFrame applies the checks to a frame. The caller must hold the inspector mutex.
+func (h *hems) checkShipFrame(c *shipConnCheck, f *shipFrame, body json.RawMessage) []shipViolation {
+	var found []shipViolation
+	add := func(check, msg string, frames ...uint64) {
+		found = append(found, shipViolation{Time: f.Time, SKI: f.SKI, Check: check, Message: msg, FrameIDs: append(frames, f.ID)})
+	}
+
+	if f.Direction == datagramSent {
+		if f.Type == "connectionClose" {
+			var cc shipmodel.ConnectionCloseType
+			if json.Unmarshal(body, &cc) == nil && cc.Phase == shipmodel.ConnectionClosePhaseTypeAnnounce {
+				c.localClose = f
+			}
+		}
+		return found
+	}
+
+	if max := h.config.ShipChecks.maxFrameBytes(); f.Size > max {
+		add(shipCheckFrameSize, fmt.Sprintf("%s frame of %d bytes exceeds %d bytes", f.Type, f.Size, max))
+	}
+	if c.remoteClose != nil && f.Type != "connectionClose" {
+		add(shipCheckClose, f.Type+" received after the DUT announced to close the connection", c.remoteClose.ID)
+	}
+
+	switch f.Type {
+	case "connectionHello":
+		var hello shipmodel.ConnectionHelloType
+		if err := json.Unmarshal(body, &hello); err != nil {
+			add(shipCheckHello, "invalid connectionHello: "+err.Error())
+			break
+		}
+		if c.shakeDone {
+			add(shipCheckHello, "connectionHello after the hello phase ended")
+		}
+		if c.lastHello != nil && c.waiting > 0 && !c.remoteReady {
+			if late := f.Time.Sub(c.lastHello.Time); late > c.waiting+helloTimingTolerance {
+				add(shipCheckHello, fmt.Sprintf("hello %.1f s after the previous one, which announced waiting %.1f s", late.Seconds(), c.waiting.Seconds()), c.lastHello.ID)
+			}
+		}
+		switch hello.Phase {
+		case shipmodel.ConnectionHelloPhaseTypeReady:
+			c.remoteReady = true
+		case shipmodel.ConnectionHelloPhaseTypePending:
+			if c.remoteReady {
+				add(shipCheckHello, "hello phase pending after the DUT was ready")
+			}
+			if hello.Waiting == nil && (hello.ProlongationRequest == nil || !*hello.ProlongationRequest) {
+				add(shipCheckHello, "pending hello without waiting time")
+			}
+		case shipmodel.ConnectionHelloPhaseTypeAborted:
+		default:
+			add(shipCheckHello, fmt.Sprintf("invalid hello phase %q", hello.Phase))
+		}
+		if hello.Waiting != nil {
+			c.waiting = time.Duration(*hello.Waiting) * time.Millisecond
+			if c.waiting > helloInitTimeout {
+				add(shipCheckHello, fmt.Sprintf("waiting %d ms exceeds T_hello_init of %.0f s", *hello.Waiting, helloInitTimeout.Seconds()))
+			}
+		}
+		c.lastHello = f
+	case "messageProtocolHandshake", "messageProtocolHandshakeError":
+		c.shakeDone = true
+	case "connectionPinState":
+		c.pinSeen = true
+		var pin shipmodel.ConnectionPinStateType
+		if err := json.Unmarshal(body, &pin); err != nil {
+			add(shipCheckPin, "invalid connectionPinState: "+err.Error())
+			break
+		}
+		switch pin.PinState {
+		case shipmodel.PinStateTypeRequired, shipmodel.PinStateTypeOptional:
+		case shipmodel.PinStateTypePinOk, shipmodel.PinStateTypeNone:
+			if pin.InputPermission != nil {
+				add(shipCheckPin, fmt.Sprintf("inputPermission sent with pin state %q", pin.PinState))
+			}
+		default:
+			add(shipCheckPin, fmt.Sprintf("invalid pin state %q", pin.PinState))
+		}
+	case "accessMethodsRequest", "accessMethods", "data":
+		if c.shakeDone && !c.pinSeen && !c.pinReported {
+			c.pinReported = true
+			add(shipCheckPin, f.Type+" received before the DUT sent its connectionPinState")
+		}
+	case "connectionClose":
+		var cc shipmodel.ConnectionCloseType
+		if err := json.Unmarshal(body, &cc); err != nil {
+			add(shipCheckClose, "invalid connectionClose: "+err.Error())
+			break
+		}
+		switch cc.Phase {
+		case shipmodel.ConnectionClosePhaseTypeAnnounce:
+			c.remoteClose = f
+		case shipmodel.ConnectionClosePhaseTypeConfirm:
+			if c.localClose == nil {
+				add(shipCheckClose, "connectionClose confirm without a close announcement")
+			}
+			c.remoteConfirm = true
+		default:
+			add(shipCheckClose, fmt.Sprintf("invalid close phase %q", cc.Phase))
+		}
+	}
+	return found
+}
+
+// shipConnectionClosed checks the close sequence when the connection of a peer ended and
+// reports whether one side announced the close
+func (h *hems) shipConnectionClosed(ski string) bool {
+	if h.shipChecks == nil {
+		return false
+	}
+	ski = shiputil.NormalizeSKI(ski)
+	s := h.shipChecks
+	s.mu.Lock()
+	c := s.conns[ski]
+	delete(s.conns, ski)
+	s.mu.Unlock()
+	if c == nil {
+		return false
+	}
+	announced := c.localClose != nil || c.remoteClose != nil
+	if !c.shakeDone || len(c.frames) == 0 {
+		return announced
+	}
+
+	v := shipViolation{Time: time.Now(), SKI: ski, Check: shipCheckClose}
+	switch {
+	case c.localClose == nil && c.remoteClose == nil:
+		v.Message = "connection closed without connectionClose announcement"
+		v.FrameIDs = []uint64{c.frames[len(c.frames)-1]}
+	case c.localClose != nil && c.remoteClose == nil && !c.remoteConfirm:
+		v.Message = "close announcement of the tester was not confirmed"
+		v.FrameIDs = []uint64{c.localClose.ID}
+	default:
+		return announced
+	}
+	h.addShipViolation(v)
+	return announced
+}
+
+func (h *hems) addShipViolation(v shipViolation) {
+	s := h.shipChecks
+	s.mu.Lock()
+	s.nextID++
+	v.ID = s.nextID
+	s.violations = append(s.violations, v)
+	if len(s.violations) > maxShipViolations {
+		s.violations = s.violations[len(s.violations)-maxShipViolations:]
+	}
+	s.mu.Unlock()
+
+	h.recordEvent("shipViolation", severityWarning, v.SKI, "SHIP violation ("+v.Check+"): "+v.Message,
+		map[string]interface{}{"check": v.Check, "frameIds": v.FrameIDs})
+	h.broadcastJSON(map[string]interface{}{"type": "shipViolation", "ski": v.SKI, "violation": v})
+}
+
+// getShipViolations returns the violations, optionally of a SKI or a check, newest first
+func (h *hems) getShipViolations(ski, check string) []shipViolation {
+	ski = shiputil.NormalizeSKI(ski)
+	h.shipChecks.mu.Lock()
+	defer h.shipChecks.mu.Unlock()
+	out := []shipViolation{}
+	for i := len(h.shipChecks.violations) - 1; i >= 0; i-- {
+		v := h.shipChecks.violations[i]
+		if (ski != "" && v.SKI != ski) || (check != "" && v.Check != check) {
+			continue
+		}
+		v.FrameIDs = append([]uint64(nil), v.FrameIDs...)
+		out = append(out, v)
+	}
+	return out
+}
+
+// getShipFrames returns the captured frames of a SKI or the given frame IDs, oldest first
+func (h *hems) getShipFrames(ski string, ids []uint64, limit int) []shipFrame {
+	ski = shiputil.NormalizeSKI(ski)
+	want := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	h.shipChecks.mu.Lock()
+	defer h.shipChecks.mu.Unlock()
+	out := []shipFrame{}
+	for _, f := range h.shipChecks.frames {
+		if (ski != "" && f.SKI != ski) || (len(want) > 0 && !want[f.ID]) {
+			continue
+		}
+		out = append(out, f)
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultShipIDFile keeps the SHIP IDs of the paired services in the working directory
+const defaultShipIDFile = "shipids.json"
+
+// shipIDEntry is the SHIP ID a paired service reported in the handshake
+type shipIDEntry struct {
+	ShipID    string    `json:"shipId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// shipIDStore persists the SHIP IDs of paired services, they are registered again on
+// startup so the pairings survive a restart with a stable identity
+type shipIDStore struct {
+	mu   sync.Mutex
+	path string
+	ids  map[string]shipIDEntry
+}
+
+func (c TrustConfig) shipIDFile() string {
+	if c.ShipIDFile != "" {
+		return c.ShipIDFile
+	}
+	return defaultShipIDFile
+}
+
+// loadShipIDs reads the SHIP ID file and registers the stored services as paired
+func (h *hems) loadShipIDs() {
+	h.shipIDs = &shipIDStore{path: h.config.Trust.shipIDFile(), ids: make(map[string]shipIDEntry)}
+	data, err := os.ReadFile(h.shipIDs.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.Errorf("ship ids: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &h.shipIDs.ids); err != nil {
+		h.Errorf("ship ids %s: %v", h.shipIDs.path, err)
+		return
+	}
+	for ski, e := range h.shipIDs.ids {
+		if ok, reason := h.skiPermitted(ski); !ok {
+			h.Infof("Not restoring the pairing of %s: %s", ski, reason)
+			continue
+		}
+		h.myService.RegisterRemoteSKI(ski, e.ShipID)
+	}
+	h.Infof("%d paired services restored from %s", len(h.shipIDs.ids), h.shipIDs.path)
+}
+
+// save writes the SHIP IDs, the caller holds the lock
+func (s *shipIDStore) save() error {
+	b, err := json.MarshalIndent(s.ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, b, 0644); err != nil {
+		return fmt.Errorf("write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// storeShipID persists the SHIP ID reported by a service once the handshake completed
+func (h *hems) storeShipID(ski, shipID string) {
+	if h.shipIDs == nil || shipID == "" {
+		return
+	}
+	h.shipIDs.mu.Lock()
+	prev, known := h.shipIDs.ids[ski]
+	if known && prev.ShipID == shipID {
+		h.shipIDs.mu.Unlock()
+		return
+	}
+	h.shipIDs.ids[ski] = shipIDEntry{ShipID: shipID, UpdatedAt: time.Now()}
+	err := h.shipIDs.save()
+	h.shipIDs.mu.Unlock()
+	if err != nil {
+		h.Errorf("ship ids: %v", err)
+	}
+
+	msg := "SHIP ID " + shipID + " stored"
+	if known {
+		msg = fmt.Sprintf("SHIP ID changed from %s to %s", prev.ShipID, shipID)
+	}
+	h.recordEvent("trust", severityInfo, ski, msg, map[string]interface{}{"shipId": shipID})
+}
+
+// forgetShipID removes an unpaired service, it is not registered again on the next start
+func (h *hems) forgetShipID(ski string) {
+	if h.shipIDs == nil {
+		return
+	}
+	h.shipIDs.mu.Lock()
+	defer h.shipIDs.mu.Unlock()
+	if _, ok := h.shipIDs.ids[ski]; !ok {
+		return
+	}
+	delete(h.shipIDs.ids, ski)
+	if err := h.shipIDs.save(); err != nil {
+		h.Errorf("ship ids: %v", err)
+	}
+}
+
+// shipIDInfo is a stored SHIP ID for the trust API
+type shipIDInfo struct {
+	SKI string `json:"ski"`
+	shipIDEntry
+}
+
+// shipIDList returns the stored SHIP IDs sorted by SKI
+func (h *hems) shipIDList() []shipIDInfo {
+	out := []shipIDInfo{}
+	if h.shipIDs == nil {
+		return out
+	}
+	h.shipIDs.mu.Lock()
+	defer h.shipIDs.mu.Unlock()
+	for ski, e := range h.shipIDs.ids {
+		out = append(out, shipIDInfo{SKI: ski, shipIDEntry: e})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SKI < out[j].SKI })
+	return out
+}
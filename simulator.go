@@ -0,0 +1,968 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+	"github.com/enbility/spine-go/spine"
+	"github.com/enbility/spine-go/util"
+)
+
+// simulatorTick is the step the simulated EV advances its measurements with. The energy
+// and SoC are integrated with the fixed step, so a profile always yields the same values.
+const simulatorTick = time.Second
+
+var errSimulatorDisabled = errors.New("simulator mode is not enabled")
+
+// SimulatorConfig enables the EVSE/EV simulator mode. The tester then presents a local
+// EVSE entity with a virtual EV that is plugged, unplugged and charged via the API or
+// scripted profiles, so CEM implementations can be tested without a real charger.
+type SimulatorConfig struct {
+	EV SimulatedEVConfig `json:"ev"`
+	// PluggedIn plugs the EV in at startup
+	PluggedIn bool `json:"pluggedIn,omitempty"`
+	// VoltageV is the phase voltage the power is calculated with, defaults to 230
+	VoltageV float64 `json:"voltageV,omitempty"`
+	// Profiles are scripted drive-cycle profiles by name
+	Profiles map[string][]SimulatorStep `json:"profiles,omitempty"`
+}
+
+// SimulatedEVConfig describes the virtual EV
+type SimulatedEVConfig struct {
+	// CommunicationStandard is iec61851, iso15118-2ed1 or iso15118-2ed2, defaults to iso15118-2ed1
+	CommunicationStandard string `json:"communicationStandard,omitempty"`
+	AsymmetricCharging    bool   `json:"asymmetricCharging,omitempty"`
+	// Identification is the EVCC ID (EUI-48), none is reported if empty
+	Identification string `json:"identification,omitempty"`
+	// Phases is the number of connected phases, defaults to 3
+	Phases uint `json:"phases,omitempty"`
+	// MinCurrentA and MaxCurrentA are the permitted charging currents per phase, default to 6 and 16
+	MinCurrentA   float64 `json:"minCurrentA,omitempty"`
+	MaxCurrentA   float64 `json:"maxCurrentA,omitempty"`
+	StandbyPowerW float64 `json:"standbyPowerW,omitempty"`
+	// CapacityWh is the usable battery capacity the SoC is calculated with, defaults to 60000
+	CapacityWh float64 `json:"capacityWh,omitempty"`
+	// SoC is the state of charge in percent when the EV is plugged in the first time
+	SoC          float64 `json:"soc,omitempty"`
+	Brand        string  `json:"brand,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	SerialNumber string  `json:"serialNumber,omitempty"`
+}
+
+func (c SimulatorConfig) voltage() float64 {
+	if c.VoltageV <= 0 {
+		return 230
+	}
+	return c.VoltageV
+}
+
+func (c SimulatedEVConfig) phases() uint {
+	if c.Phases == 0 || c.Phases > 3 {
+		return 3
+	}
+	return c.Phases
+}
+
+func (c SimulatedEVConfig) minCurrent() float64 {
+	if c.MinCurrentA <= 0 {
+		return 6
+	}
+	return c.MinCurrentA
+}
+
+func (c SimulatedEVConfig) maxCurrent() float64 {
+	if c.MaxCurrentA <= 0 {
+		return 16
+	}
+	return c.MaxCurrentA
+}
+
+func (c SimulatedEVConfig) capacity() float64 {
+	if c.CapacityWh <= 0 {
+		return 60000
+	}
+	return c.CapacityWh
+}
+
+// SimulatorUpdate changes the virtual EV, unset fields keep their value
+type SimulatorUpdate struct {
+	// Plug plugs the EV in (true) or out (false)
+	Plug *bool `json:"plug,omitempty"`
+	// ChargeState is active, paused, finished or error
+	ChargeState           string `json:"chargeState,omitempty"`
+	CommunicationStandard string `json:"communicationStandard,omitempty"`
+	// SoC sets the state of charge in percent
+	SoC *float64 `json:"soc,omitempty"`
+	// Currents are the per phase currents the EV draws while charging, a single value
+	// applies to all phases
+	Currents []float64 `json:"currents,omitempty"`
+	// EnergyWh resets the energy charged in the current session
+	EnergyWh *float64 `json:"energyWh,omitempty"`
+	// EvseState is the operating state of the EVSE: normalOperation, standby or failure
+	EvseState string `json:"evseState,omitempty"`
+}
+
+// SimulatorStep is a step of a drive-cycle profile
+type SimulatorStep struct {
+	// AfterSeconds is the time after the previous step
+	AfterSeconds float64 `json:"afterSeconds,omitempty"`
+	SimulatorUpdate
+}
+
+// simulatorChargeStates maps the charge states to the operating state of the EV
+var simulatorChargeStates = map[string]model.DeviceDiagnosisOperatingStateType{
+	"active":   model.DeviceDiagnosisOperatingStateTypeNormalOperation,
+	"paused":   model.DeviceDiagnosisOperatingStateTypeStandby,
+	"finished": model.DeviceDiagnosisOperatingStateTypeFinished,
+	"error":    model.DeviceDiagnosisOperatingStateTypeFailure,
+}
+
+var simulatorEvseStates = map[string]model.DeviceDiagnosisOperatingStateType{
+	"normalOperation": model.DeviceDiagnosisOperatingStateTypeNormalOperation,
+	"standby":         model.DeviceDiagnosisOperatingStateTypeStandby,
+	"failure":         model.DeviceDiagnosisOperatingStateTypeFailure,
+}
+
+var simulatorPhases = []model.ElectricalConnectionPhaseNameType{
+	model.ElectricalConnectionPhaseNameTypeA,
+	model.ElectricalConnectionPhaseNameTypeB,
+	model.ElectricalConnectionPhaseNameTypeC,
+}
+
+// The feature data of the EV uses fixed ids: the current measurements per phase are
+// 0-2, the power measurements 3-5. The parameters of the electrical connection use the
+// ids of their measurements, the total power parameter carries the charging power limits.
+// The OPEV limits are 0-2, the OSCEV limits 3-5.
+const (
+	simMeasurementPower  = 3
+	simMeasurementEnergy = 6
+	simMeasurementSoC    = 7
+	simParameterTotal    = 8
+	simLimitRecommended  = 3
+)
+
+// simulatorLimit is a current limit the CEM wrote to the EV
+type simulatorLimit struct {
+	// Usecase is OPEV (obligation) or OSCEV (recommendation)
+	Usecase string  `json:"usecase"`
+	Phase   string  `json:"phase"`
+	Value   float64 `json:"value"`
+	Active  bool    `json:"active"`
+}
+
+// simulatorProfileRun is the current or last run of a drive-cycle profile
+type simulatorProfileRun struct {
+	Name      string     `json:"name"`
+	Running   bool       `json:"running"`
+	Step      int        `json:"step"`
+	Steps     int        `json:"steps"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+
+	stop chan struct{}
+}
+
+// simulatorState is the state of the virtual EV reported by the API
+type simulatorState struct {
+	EvseEntity            string     `json:"evseEntity"`
+	EvseState             string     `json:"evseState"`
+	PluggedIn             bool       `json:"pluggedIn"`
+	PluggedAt             *time.Time `json:"pluggedAt,omitempty"`
+	EVEntity              string     `json:"evEntity,omitempty"`
+	ChargeState           string     `json:"chargeState"`
+	CommunicationStandard string     `json:"communicationStandard"`
+	SoC                   float64    `json:"soc"`
+	// RequestedCurrents are the currents the EV draws without limits
+	RequestedCurrents []float64 `json:"requestedCurrents"`
+	// Currents and Powers are the measured values after the limits of the CEM
+	Currents []float64            `json:"currents"`
+	Powers   []float64            `json:"powers"`
+	EnergyWh float64              `json:"energyWh"`
+	Limits   []simulatorLimit     `json:"limits"`
+	Profile  *simulatorProfileRun `json:"profile,omitempty"`
+}
+
+// evSimulator holds the virtual EV of the simulator mode
+type evSimulator struct {
+	mu     sync.Mutex
+	config SimulatorConfig
+	evse   spineapi.EntityLocalInterface
+	// ev is the EV entity while the EV is plugged in
+	ev    spineapi.EntityLocalInterface
+	state simulatorState
+	// published are the measurement values last sent, to notify only on changes
+	published []float64
+	profile   *simulatorProfileRun
+}
+
+// setupSimulator adds the EVSE features and starts the simulation if the simulator
+// section is configured. The EV is attached to the first local EVSE entity.
+func (h *hems) setupSimulator() error {
+	cfg := h.config.Simulator
+	if cfg == nil {
+		return nil
+	}
+	var evse spineapi.EntityLocalInterface
+	for _, e := range h.localEntities {
+		if e.EntityType() == model.EntityTypeTypeEVSE {
+			evse = e
+			break
+		}
+	}
+	if evse == nil {
+		return fmt.Errorf("simulator: no local EVSE entity, add EVSE to deviceInfo.entityTypes or the entities section")
+	}
+	if cfg.EV.CommunicationStandard == "" {
+		cfg.EV.CommunicationStandard = string(model.DeviceConfigurationKeyValueStringTypeISO151182ED1)
+	}
+	for name, steps := range cfg.Profiles {
+		for i, step := range steps {
+			if err := validateSimulatorUpdate(step.SimulatorUpdate); err != nil {
+				return fmt.Errorf("simulator.profiles.%s[%d]: %w", name, i, err)
+			}
+		}
+	}
+
+	phases := int(cfg.EV.phases())
+	sim := &evSimulator{
+		config: *cfg,
+		evse:   evse,
+		state: simulatorState{
+			EvseEntity:            entityAddressString(evse),
+			EvseState:             "normalOperation",
+			ChargeState:           "active",
+			CommunicationStandard: cfg.EV.CommunicationStandard,
+			SoC:                   cfg.EV.SoC,
+			RequestedCurrents:     make([]float64, phases),
+			Currents:              make([]float64, phases),
+			Powers:                make([]float64, phases),
+			Limits:                []simulatorLimit{},
+		},
+	}
+	for i := range sim.state.RequestedCurrents {
+		sim.state.RequestedCurrents[i] = cfg.EV.maxCurrent()
+	}
+	h.simulator = sim
+
+	h.setupSimulatedEVSE(sim)
+	if cfg.PluggedIn {
+		sim.mu.Lock()
+		h.plugSimulatedEV(sim)
+		sim.mu.Unlock()
+	}
+	go h.runSimulator(sim)
+	fmt.Printf("Simulator mode: EV at EVSE entity %s\n", sim.state.EvseEntity)
+	return nil
+}
+
+// setupSimulatedEVSE adds the EVSECC server features to the EVSE entity
+func (h *hems) setupSimulatedEVSE(sim *evSimulator) {
+	info := h.config.DeviceInfo
+	f := sim.evse.GetOrAddFeature(model.FeatureTypeTypeDeviceClassification, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeDeviceClassificationManufacturerData, true, false)
+	f.SetData(model.FunctionTypeDeviceClassificationManufacturerData, manufacturerData(info.Brand, info.DeviceName, info.Identifier))
+
+	f = sim.evse.GetOrAddFeature(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeDeviceDiagnosisStateData, true, false)
+	f.SetData(model.FunctionTypeDeviceDiagnosisStateData, &model.DeviceDiagnosisStateDataType{
+		OperatingState: util.Ptr(simulatorEvseStates[sim.state.EvseState]),
+	})
+
+	sim.evse.AddUseCaseSupport(model.UseCaseActorTypeEVSE, model.UseCaseNameTypeEVSECommissioningAndConfiguration,
+		"1.0.1", "release", true, []model.UseCaseScenarioSupportType{1, 2})
+}
+
+func manufacturerData(brand, name, serial string) *model.DeviceClassificationManufacturerDataType {
+	data := &model.DeviceClassificationManufacturerDataType{}
+	if brand != "" {
+		data.BrandName = util.Ptr(model.DeviceClassificationStringType(brand))
+	}
+	if name != "" {
+		data.DeviceName = util.Ptr(model.DeviceClassificationStringType(name))
+	}
+	if serial != "" {
+		data.SerialNumber = util.Ptr(model.DeviceClassificationStringType(serial))
+	}
+	return data
+}
+
+// simulatedEVUsecases are the use cases the EV entity declares as EV actor
+var simulatedEVUsecases = []struct {
+	name      model.UseCaseNameType
+	version   model.SpecificationVersionType
+	revision  string
+	scenarios []model.UseCaseScenarioSupportType
+}{
+	{model.UseCaseNameTypeEVCommissioningAndConfiguration, "1.0.1", "release", []model.UseCaseScenarioSupportType{1, 2, 3, 4, 5, 6, 7, 8}},
+	{model.UseCaseNameTypeMeasurementOfElectricityDuringEVCharging, "1.0.1", "release", []model.UseCaseScenarioSupportType{1, 2, 3}},
+	{model.UseCaseNameTypeOverloadProtectionByEVChargingCurrentCurtailment, "1.0.1b", "release", []model.UseCaseScenarioSupportType{1, 2, 3}},
+	{model.UseCaseNameTypeOptimizationOfSelfConsumptionDuringEVCharging, "1.0.1b", "release", []model.UseCaseScenarioSupportType{1, 2, 3}},
+	{model.UseCaseNameTypeEVStateOfCharge, "1.0.0", "RC1", []model.UseCaseScenarioSupportType{1}},
+}
+
+// plugSimulatedEV adds the EV entity with its features below the EVSE entity, adding the
+// entity notifies the connected CEMs. sim.mu has to be held.
+func (h *hems) plugSimulatedEV(sim *evSimulator) {
+	if sim.ev != nil {
+		return
+	}
+	device := h.myService.LocalDevice()
+	addr := append(slices.Clone(sim.evse.Address().Entity), 1)
+	ev := spine.NewEntityLocal(device, model.EntityTypeTypeEV, addr, h.localHeartbeatTimeout())
+	cfg := sim.config.EV
+	phases := int(cfg.phases())
+	voltage := sim.config.voltage()
+
+	f := ev.GetOrAddFeature(model.FeatureTypeTypeDeviceConfiguration, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeDeviceConfigurationKeyValueDescriptionListData, true, false)
+	f.AddFunctionType(model.FunctionTypeDeviceConfigurationKeyValueListData, true, false)
+	f.SetData(model.FunctionTypeDeviceConfigurationKeyValueDescriptionListData, &model.DeviceConfigurationKeyValueDescriptionListDataType{
+		DeviceConfigurationKeyValueDescriptionData: []model.DeviceConfigurationKeyValueDescriptionDataType{
+			{
+				KeyId:     util.Ptr(model.DeviceConfigurationKeyIdType(0)),
+				KeyName:   util.Ptr(model.DeviceConfigurationKeyNameTypeCommunicationsStandard),
+				ValueType: util.Ptr(model.DeviceConfigurationKeyValueTypeTypeString),
+			},
+			{
+				KeyId:     util.Ptr(model.DeviceConfigurationKeyIdType(1)),
+				KeyName:   util.Ptr(model.DeviceConfigurationKeyNameTypeAsymmetricChargingSupported),
+				ValueType: util.Ptr(model.DeviceConfigurationKeyValueTypeTypeBoolean),
+			},
+		},
+	})
+	f.SetData(model.FunctionTypeDeviceConfigurationKeyValueListData, simulatorConfigurationData(sim.state.CommunicationStandard, cfg.AsymmetricCharging))
+
+	if cfg.Identification != "" {
+		f = ev.GetOrAddFeature(model.FeatureTypeTypeIdentification, model.RoleTypeServer)
+		f.AddFunctionType(model.FunctionTypeIdentificationListData, true, false)
+		f.SetData(model.FunctionTypeIdentificationListData, &model.IdentificationListDataType{
+			IdentificationData: []model.IdentificationDataType{{
+				IdentificationId:    util.Ptr(model.IdentificationIdType(0)),
+				IdentificationType:  util.Ptr(model.IdentificationTypeTypeEui48),
+				IdentificationValue: util.Ptr(model.IdentificationValueType(cfg.Identification)),
+			}},
+		})
+	}
+
+	f = ev.GetOrAddFeature(model.FeatureTypeTypeDeviceClassification, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeDeviceClassificationManufacturerData, true, false)
+	f.SetData(model.FunctionTypeDeviceClassificationManufacturerData, manufacturerData(cfg.Brand, cfg.Model, cfg.SerialNumber))
+
+	f = ev.GetOrAddFeature(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeDeviceDiagnosisStateData, true, false)
+	f.SetData(model.FunctionTypeDeviceDiagnosisStateData, &model.DeviceDiagnosisStateDataType{
+		OperatingState: util.Ptr(simulatorChargeStates[sim.state.ChargeState]),
+	})
+
+	// electrical connection: the measured phases of the measurements and the permitted values
+	var params []model.ElectricalConnectionParameterDescriptionDataType
+	var permitted []model.ElectricalConnectionPermittedValueSetDataType
+	for i := 0; i < phases; i++ {
+		for _, id := range []int{i, simMeasurementPower + i} {
+			params = append(params, model.ElectricalConnectionParameterDescriptionDataType{
+				ElectricalConnectionId:  util.Ptr(model.ElectricalConnectionIdType(0)),
+				ParameterId:             util.Ptr(model.ElectricalConnectionParameterIdType(id)),
+				MeasurementId:           util.Ptr(model.MeasurementIdType(id)),
+				VoltageType:             util.Ptr(model.ElectricalConnectionVoltageTypeTypeAc),
+				AcMeasuredPhases:        util.Ptr(simulatorPhases[i]),
+				AcMeasuredInReferenceTo: util.Ptr(model.ElectricalConnectionPhaseNameTypeNeutral),
+				AcMeasurementType:       util.Ptr(model.ElectricalConnectionAcMeasurementTypeTypeReal),
+				AcMeasurementVariant:    util.Ptr(model.ElectricalConnectionMeasurandVariantTypeRms),
+			})
+		}
+		permitted = append(permitted, model.ElectricalConnectionPermittedValueSetDataType{
+			ElectricalConnectionId: util.Ptr(model.ElectricalConnectionIdType(0)),
+			ParameterId:            util.Ptr(model.ElectricalConnectionParameterIdType(i)),
+			PermittedValueSet: []model.ScaledNumberSetType{{
+				Range: []model.ScaledNumberRangeType{{
+					Min: model.NewScaledNumberType(cfg.minCurrent()),
+					Max: model.NewScaledNumberType(cfg.maxCurrent()),
+				}},
+			}},
+		})
+	}
+	params = append(params, model.ElectricalConnectionParameterDescriptionDataType{
+		ElectricalConnectionId: util.Ptr(model.ElectricalConnectionIdType(0)),
+		ParameterId:            util.Ptr(model.ElectricalConnectionParameterIdType(simParameterTotal)),
+		VoltageType:            util.Ptr(model.ElectricalConnectionVoltageTypeTypeAc),
+		AcMeasuredPhases:       util.Ptr(model.ElectricalConnectionPhaseNameTypeAbc),
+		ScopeType:              util.Ptr(model.ScopeTypeTypeACPowerTotal),
+	})
+	permitted = append(permitted, model.ElectricalConnectionPermittedValueSetDataType{
+		ElectricalConnectionId: util.Ptr(model.ElectricalConnectionIdType(0)),
+		ParameterId:            util.Ptr(model.ElectricalConnectionParameterIdType(simParameterTotal)),
+		PermittedValueSet: []model.ScaledNumberSetType{{
+			Value: []model.ScaledNumberType{*model.NewScaledNumberType(cfg.StandbyPowerW)},
+			Range: []model.ScaledNumberRangeType{{
+				Min: model.NewScaledNumberType(cfg.minCurrent() * voltage * float64(phases)),
+				Max: model.NewScaledNumberType(cfg.maxCurrent() * voltage * float64(phases)),
+			}},
+		}},
+	})
+	f = ev.GetOrAddFeature(model.FeatureTypeTypeElectricalConnection, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeElectricalConnectionDescriptionListData, true, false)
+	f.AddFunctionType(model.FunctionTypeElectricalConnectionParameterDescriptionListData, true, false)
+	f.AddFunctionType(model.FunctionTypeElectricalConnectionPermittedValueSetListData, true, false)
+	f.SetData(model.FunctionTypeElectricalConnectionDescriptionListData, &model.ElectricalConnectionDescriptionListDataType{
+		ElectricalConnectionDescriptionData: []model.ElectricalConnectionDescriptionDataType{{
+			ElectricalConnectionId:  util.Ptr(model.ElectricalConnectionIdType(0)),
+			PowerSupplyType:         util.Ptr(model.ElectricalConnectionVoltageTypeTypeAc),
+			AcConnectedPhases:       util.Ptr(uint(phases)),
+			PositiveEnergyDirection: util.Ptr(model.EnergyDirectionTypeConsume),
+		}},
+	})
+	f.SetData(model.FunctionTypeElectricalConnectionParameterDescriptionListData, &model.ElectricalConnectionParameterDescriptionListDataType{
+		ElectricalConnectionParameterDescriptionData: params,
+	})
+	f.SetData(model.FunctionTypeElectricalConnectionPermittedValueSetListData, &model.ElectricalConnectionPermittedValueSetListDataType{
+		ElectricalConnectionPermittedValueSetData: permitted,
+	})
+
+	var descs []model.MeasurementDescriptionDataType
+	measurement := func(id int, typ model.MeasurementTypeType, unit model.UnitOfMeasurementType, scope model.ScopeTypeType) {
+		descs = append(descs, model.MeasurementDescriptionDataType{
+			MeasurementId:   util.Ptr(model.MeasurementIdType(id)),
+			MeasurementType: util.Ptr(typ),
+			CommodityType:   util.Ptr(model.CommodityTypeTypeElectricity),
+			Unit:            util.Ptr(unit),
+			ScopeType:       util.Ptr(scope),
+		})
+	}
+	for i := 0; i < phases; i++ {
+		measurement(i, model.MeasurementTypeTypeCurrent, model.UnitOfMeasurementTypeA, model.ScopeTypeTypeACCurrent)
+	}
+	for i := 0; i < phases; i++ {
+		measurement(simMeasurementPower+i, model.MeasurementTypeTypePower, model.UnitOfMeasurementTypeW, model.ScopeTypeTypeACPower)
+	}
+	measurement(simMeasurementEnergy, model.MeasurementTypeTypeEnergy, model.UnitOfMeasurementTypeWh, model.ScopeTypeTypeCharge)
+	measurement(simMeasurementSoC, model.MeasurementTypeTypePercentage, model.UnitOfMeasurementTypepct, model.ScopeTypeTypeStateOfCharge)
+	f = ev.GetOrAddFeature(model.FeatureTypeTypeMeasurement, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeMeasurementDescriptionListData, true, false)
+	f.AddFunctionType(model.FunctionTypeMeasurementListData, true, false)
+	f.SetData(model.FunctionTypeMeasurementDescriptionListData, &model.MeasurementDescriptionListDataType{MeasurementDescriptionData: descs})
+
+	// load control: the OPEV obligations and OSCEV recommendations per phase, writable by the CEM
+	var limitDescs []model.LoadControlLimitDescriptionDataType
+	var limits []model.LoadControlLimitDataType
+	for _, l := range []struct {
+		offset   int
+		category model.LoadControlCategoryType
+		scope    model.ScopeTypeType
+	}{
+		{0, model.LoadControlCategoryTypeObligation, model.ScopeTypeTypeOverloadProtection},
+		{simLimitRecommended, model.LoadControlCategoryTypeRecommendation, model.ScopeTypeTypeSelfConsumption},
+	} {
+		for i := 0; i < phases; i++ {
+			id := util.Ptr(model.LoadControlLimitIdType(l.offset + i))
+			limitDescs = append(limitDescs, model.LoadControlLimitDescriptionDataType{
+				LimitId:       id,
+				LimitType:     util.Ptr(model.LoadControlLimitTypeTypeMaxValueLimit),
+				LimitCategory: util.Ptr(l.category),
+				MeasurementId: util.Ptr(model.MeasurementIdType(i)),
+				Unit:          util.Ptr(model.UnitOfMeasurementTypeA),
+				ScopeType:     util.Ptr(l.scope),
+			})
+			limits = append(limits, model.LoadControlLimitDataType{
+				LimitId:           id,
+				IsLimitChangeable: util.Ptr(true),
+				IsLimitActive:     util.Ptr(false),
+				Value:             model.NewScaledNumberType(cfg.maxCurrent()),
+			})
+		}
+	}
+	f = ev.GetOrAddFeature(model.FeatureTypeTypeLoadControl, model.RoleTypeServer)
+	f.AddFunctionType(model.FunctionTypeLoadControlLimitDescriptionListData, true, false)
+	f.AddFunctionType(model.FunctionTypeLoadControlLimitListData, true, true)
+	f.SetData(model.FunctionTypeLoadControlLimitDescriptionListData, &model.LoadControlLimitDescriptionListDataType{LoadControlLimitDescriptionData: limitDescs})
+	f.SetData(model.FunctionTypeLoadControlLimitListData, &model.LoadControlLimitListDataType{LoadControlLimitData: limits})
+
+	for _, uc := range simulatedEVUsecases {
+		ev.AddUseCaseSupport(model.UseCaseActorTypeEV, uc.name, uc.version, uc.revision, true, uc.scenarios)
+	}
+
+	sim.ev = ev
+	sim.published = nil
+	now := time.Now()
+	sim.state.PluggedIn = true
+	sim.state.PluggedAt = &now
+	sim.state.EVEntity = entityAddressString(ev)
+	sim.state.EnergyWh = 0
+	sim.state.Limits = []simulatorLimit{}
+	h.publishSimulatorMeasurements(sim)
+	device.AddEntity(ev)
+}
+
+// unplugSimulatedEV removes the EV entity. sim.mu has to be held.
+func (h *hems) unplugSimulatedEV(sim *evSimulator) {
+	if sim.ev == nil {
+		return
+	}
+	// RemoveEntity drops the use cases of the entity without publishing the changed
+	// node management data, they are removed explicitly first
+	filters := make([]model.UseCaseFilterType, 0, len(simulatedEVUsecases))
+	for _, uc := range simulatedEVUsecases {
+		filters = append(filters, model.UseCaseFilterType{Actor: model.UseCaseActorTypeEV, UseCaseName: uc.name})
+	}
+	sim.ev.RemoveUseCaseSupports(filters)
+	h.myService.LocalDevice().RemoveEntity(sim.ev)
+	sim.ev = nil
+	sim.state.PluggedIn = false
+	sim.state.PluggedAt = nil
+	sim.state.EVEntity = ""
+	sim.state.Limits = []simulatorLimit{}
+	for i := range sim.state.Currents {
+		sim.state.Currents[i], sim.state.Powers[i] = 0, 0
+	}
+}
+
+func simulatorConfigurationData(standard string, asymmetric bool) *model.DeviceConfigurationKeyValueListDataType {
+	return &model.DeviceConfigurationKeyValueListDataType{
+		DeviceConfigurationKeyValueData: []model.DeviceConfigurationKeyValueDataType{
+			{
+				KeyId: util.Ptr(model.DeviceConfigurationKeyIdType(0)),
+				Value: &model.DeviceConfigurationKeyValueValueType{
+					String: util.Ptr(model.DeviceConfigurationKeyValueStringType(standard)),
+				},
+			},
+			{
+				KeyId:             util.Ptr(model.DeviceConfigurationKeyIdType(1)),
+				Value:             &model.DeviceConfigurationKeyValueValueType{Boolean: util.Ptr(asymmetric)},
+				IsValueChangeable: util.Ptr(false),
+			},
+		},
+	}
+}
+
+// validateSimulatorUpdate checks the values of an update or profile step
+func validateSimulatorUpdate(u SimulatorUpdate) error {
+	if u.ChargeState != "" {
+		if _, ok := simulatorChargeStates[u.ChargeState]; !ok {
+			return fmt.Errorf("chargeState must be active, paused, finished or error")
+		}
+	}
+	if u.EvseState != "" {
+		if _, ok := simulatorEvseStates[u.EvseState]; !ok {
+			return fmt.Errorf("evseState must be normalOperation, standby or failure")
+		}
+	}
+	switch model.DeviceConfigurationKeyValueStringType(u.CommunicationStandard) {
+	case "", model.DeviceConfigurationKeyValueStringTypeIEC61851,
+		model.DeviceConfigurationKeyValueStringTypeISO151182ED1, model.DeviceConfigurationKeyValueStringTypeISO151182ED2:
+	default:
+		return fmt.Errorf("communicationStandard must be iec61851, iso15118-2ed1 or iso15118-2ed2")
+	}
+	if u.SoC != nil && (*u.SoC < 0 || *u.SoC > 100) {
+		return fmt.Errorf("soc must be between 0 and 100")
+	}
+	if len(u.Currents) > 3 {
+		return fmt.Errorf("currents has at most 3 phases")
+	}
+	for _, c := range u.Currents {
+		if c < 0 {
+			return fmt.Errorf("currents must not be negative")
+		}
+	}
+	if u.EnergyWh != nil && *u.EnergyWh < 0 {
+		return fmt.Errorf("energyWh must not be negative")
+	}
+	return nil
+}
+
+// updateSimulator applies an update of the API or a profile step
+func (h *hems) updateSimulator(u SimulatorUpdate) (simulatorState, error) {
+	sim := h.simulator
+	if sim == nil {
+		return simulatorState{}, errSimulatorDisabled
+	}
+	if err := validateSimulatorUpdate(u); err != nil {
+		return simulatorState{}, err
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	var changes []string
+	if u.Plug != nil && *u.Plug != sim.state.PluggedIn {
+		if *u.Plug {
+			h.plugSimulatedEV(sim)
+			changes = append(changes, "plugged in")
+		} else {
+			h.unplugSimulatedEV(sim)
+			changes = append(changes, "unplugged")
+		}
+	}
+	if u.EvseState != "" && u.EvseState != sim.state.EvseState {
+		sim.state.EvseState = u.EvseState
+		if f := sim.evse.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer); f != nil {
+			f.SetData(model.FunctionTypeDeviceDiagnosisStateData, &model.DeviceDiagnosisStateDataType{
+				OperatingState: util.Ptr(simulatorEvseStates[u.EvseState]),
+			})
+		}
+		changes = append(changes, "EVSE "+u.EvseState)
+	}
+	if u.ChargeState != "" && u.ChargeState != sim.state.ChargeState {
+		sim.state.ChargeState = u.ChargeState
+		if sim.ev != nil {
+			if f := sim.ev.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer); f != nil {
+				f.SetData(model.FunctionTypeDeviceDiagnosisStateData, &model.DeviceDiagnosisStateDataType{
+					OperatingState: util.Ptr(simulatorChargeStates[u.ChargeState]),
+				})
+			}
+		}
+		changes = append(changes, "charge state "+u.ChargeState)
+	}
+	if u.CommunicationStandard != "" && u.CommunicationStandard != sim.state.CommunicationStandard {
+		sim.state.CommunicationStandard = u.CommunicationStandard
+		if sim.ev != nil {
+			if f := sim.ev.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceConfiguration, model.RoleTypeServer); f != nil {
+				f.SetData(model.FunctionTypeDeviceConfigurationKeyValueListData,
+					simulatorConfigurationData(u.CommunicationStandard, sim.config.EV.AsymmetricCharging))
+			}
+		}
+		changes = append(changes, "communication standard "+u.CommunicationStandard)
+	}
+	if u.SoC != nil {
+		sim.state.SoC = *u.SoC
+		changes = append(changes, fmt.Sprintf("SoC %.1f %%", *u.SoC))
+	}
+	if u.EnergyWh != nil {
+		sim.state.EnergyWh = *u.EnergyWh
+	}
+	if len(u.Currents) > 0 {
+		for i := range sim.state.RequestedCurrents {
+			c := u.Currents[len(u.Currents)-1]
+			if i < len(u.Currents) {
+				c = u.Currents[i]
+			}
+			sim.state.RequestedCurrents[i] = math.Min(c, sim.config.EV.maxCurrent())
+		}
+		changes = append(changes, fmt.Sprintf("currents %v A", sim.state.RequestedCurrents))
+	}
+	h.advanceSimulator(sim, 0)
+	if len(changes) > 0 {
+		h.Infof("simulator: %s", strings.Join(changes, ", "))
+		h.recordEvent("simulator", severityInfo, "", "simulated EV: "+strings.Join(changes, ", "),
+			map[string]interface{}{"pluggedIn": sim.state.PluggedIn, "chargeState": sim.state.ChargeState, "soc": sim.state.SoC})
+	}
+	return sim.snapshot(), nil
+}
+
+// simulatorLimits reads the limits the CEM wrote to the load control feature
+func (sim *evSimulator) simulatorLimits() []simulatorLimit {
+	out := []simulatorLimit{}
+	if sim.ev == nil {
+		return out
+	}
+	f := sim.ev.FeatureOfTypeAndRole(model.FeatureTypeTypeLoadControl, model.RoleTypeServer)
+	if f == nil {
+		return out
+	}
+	data, ok := f.DataCopy(model.FunctionTypeLoadControlLimitListData).(*model.LoadControlLimitListDataType)
+	if !ok || data == nil {
+		return out
+	}
+	for _, l := range data.LoadControlLimitData {
+		if l.LimitId == nil || l.Value == nil {
+			continue
+		}
+		id := int(*l.LimitId)
+		limit := simulatorLimit{Usecase: "OPEV", Value: l.Value.GetValue(), Active: l.IsLimitActive != nil && *l.IsLimitActive}
+		if id >= simLimitRecommended {
+			limit.Usecase = "OSCEV"
+			id -= simLimitRecommended
+		}
+		if id >= len(simulatorPhases) {
+			continue
+		}
+		limit.Phase = string(simulatorPhases[id])
+		out = append(out, limit)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Usecase != out[j].Usecase {
+			return out[i].Usecase < out[j].Usecase
+		}
+		return out[i].Phase < out[j].Phase
+	})
+	return out
+}
+
+// advanceSimulator applies the limits and advances energy and SoC by dt. A full battery
+// finishes the charging. sim.mu has to be held.
+func (h *hems) advanceSimulator(sim *evSimulator, dt time.Duration) {
+	limits := sim.simulatorLimits()
+	prevActive := 0
+	for _, l := range sim.state.Limits {
+		if l.Active {
+			prevActive++
+		}
+	}
+	sim.state.Limits = limits
+	voltage := sim.config.voltage()
+	charging := sim.state.PluggedIn && sim.state.ChargeState == "active" && sim.state.EvseState == "normalOperation"
+	total := 0.0
+	active := 0
+	for i := range sim.state.Currents {
+		c := 0.0
+		if charging {
+			c = sim.state.RequestedCurrents[i]
+			for _, l := range limits {
+				if l.Active && l.Phase == string(simulatorPhases[i]) {
+					c = math.Min(c, l.Value)
+				}
+			}
+			// below the minimum current the EV pauses the charging
+			if c < sim.config.EV.minCurrent() {
+				c = 0
+			}
+		}
+		sim.state.Currents[i] = c
+		sim.state.Powers[i] = c * voltage
+		total += sim.state.Powers[i]
+	}
+	for _, l := range limits {
+		if l.Active {
+			active++
+		}
+	}
+	if active != prevActive {
+		h.Infof("simulator: %d active current limits of the CEM", active)
+	}
+
+	if dt > 0 && total > 0 {
+		wh := total * dt.Hours()
+		sim.state.EnergyWh += wh
+		sim.state.SoC = math.Min(100, sim.state.SoC+wh/sim.config.EV.capacity()*100)
+		if sim.state.SoC >= 100 {
+			// sim.mu is held, the charge state is set here instead of via updateSimulator
+			sim.state.ChargeState = "finished"
+			if sim.ev != nil {
+				if f := sim.ev.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceDiagnosis, model.RoleTypeServer); f != nil {
+					f.SetData(model.FunctionTypeDeviceDiagnosisStateData, &model.DeviceDiagnosisStateDataType{
+						OperatingState: util.Ptr(model.DeviceDiagnosisOperatingStateTypeFinished),
+					})
+				}
+			}
+			h.recordEvent("simulator", severityInfo, "", "simulated EV: battery full, charging finished", nil)
+			h.advanceSimulator(sim, 0)
+			return
+		}
+	}
+	h.publishSimulatorMeasurements(sim)
+}
+
+// publishSimulatorMeasurements sets the measurement data of the EV if a value changed.
+// sim.mu has to be held.
+func (h *hems) publishSimulatorMeasurements(sim *evSimulator) {
+	if sim.ev == nil {
+		return
+	}
+	values := append(append(slices.Clone(sim.state.Currents), sim.state.Powers...),
+		math.Round(sim.state.EnergyWh), math.Round(sim.state.SoC*10)/10)
+	if slices.Equal(values, sim.published) {
+		return
+	}
+	sim.published = values
+	phases := len(sim.state.Currents)
+	now := model.NewAbsoluteOrRelativeTimeTypeFromTime(time.Now())
+	data := make([]model.MeasurementDataType, 0, len(values))
+	for i, v := range values {
+		id := i
+		switch {
+		case i >= 2*phases+1:
+			id = simMeasurementSoC
+		case i == 2*phases:
+			id = simMeasurementEnergy
+		case i >= phases:
+			id = simMeasurementPower + i - phases
+		}
+		data = append(data, model.MeasurementDataType{
+			MeasurementId: util.Ptr(model.MeasurementIdType(id)),
+			ValueType:     util.Ptr(model.MeasurementValueTypeTypeValue),
+			Timestamp:     now,
+			Value:         model.NewScaledNumberType(v),
+			ValueSource:   util.Ptr(model.MeasurementValueSourceTypeMeasuredValue),
+		})
+	}
+	if f := sim.ev.FeatureOfTypeAndRole(model.FeatureTypeTypeMeasurement, model.RoleTypeServer); f != nil {
+		f.SetData(model.FunctionTypeMeasurementListData, &model.MeasurementListDataType{MeasurementData: data})
+	}
+}
+
+// runSimulator advances the EV every tick
+func (h *hems) runSimulator(sim *evSimulator) {
+	ticker := time.NewTicker(simulatorTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		sim.mu.Lock()
+		h.advanceSimulator(sim, simulatorTick)
+		sim.mu.Unlock()
+	}
+}
+
+// snapshot returns a copy of the state. sim.mu has to be held.
+func (sim *evSimulator) snapshot() simulatorState {
+	s := sim.state
+	s.RequestedCurrents = slices.Clone(sim.state.RequestedCurrents)
+	s.Currents = slices.Clone(sim.state.Currents)
+	s.Powers = slices.Clone(sim.state.Powers)
+	s.Limits = slices.Clone(sim.state.Limits)
+	s.SoC = math.Round(s.SoC*10) / 10
+	s.EnergyWh = math.Round(s.EnergyWh*10) / 10
+	if sim.profile != nil {
+		p := *sim.profile
+		s.Profile = &p
+	}
+	return s
+}
+
+// getSimulator returns the state of the virtual EV
+func (h *hems) getSimulator() (simulatorState, error) {
+	if h.simulator == nil {
+		return simulatorState{}, errSimulatorDisabled
+	}
+	h.simulator.mu.Lock()
+	defer h.simulator.mu.Unlock()
+	return h.simulator.snapshot(), nil
+}
+
+// getSimulatorProfiles returns the configured profiles
+func (h *hems) getSimulatorProfiles() (map[string][]SimulatorStep, error) {
+	if h.simulator == nil {
+		return nil, errSimulatorDisabled
+	}
+	profiles := h.simulator.config.Profiles
+	if profiles == nil {
+		profiles = map[string][]SimulatorStep{}
+	}
+	return profiles, nil
+}
+
+// simulatorProfileRequest starts a configured profile by name or the given steps
+type simulatorProfileRequest struct {
+	Name  string          `json:"name"`
+	Steps []SimulatorStep `json:"steps,omitempty"`
+}
+
+// startSimulatorProfile runs a drive-cycle profile, a running profile is stopped first
+func (h *hems) startSimulatorProfile(req simulatorProfileRequest) (*simulatorProfileRun, error) {
+	sim := h.simulator
+	if sim == nil {
+		return nil, errSimulatorDisabled
+	}
+	steps := req.Steps
+	if len(steps) == 0 {
+		var ok bool
+		if steps, ok = sim.config.Profiles[req.Name]; !ok {
+			return nil, fmt.Errorf("unknown profile %q", req.Name)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("profile has no steps")
+	}
+	for i, step := range steps {
+		if err := validateSimulatorUpdate(step.SimulatorUpdate); err != nil {
+			return nil, fmt.Errorf("steps[%d]: %w", i, err)
+		}
+		if step.AfterSeconds < 0 {
+			return nil, fmt.Errorf("steps[%d]: afterSeconds must not be negative", i)
+		}
+	}
+	name := req.Name
+	if name == "" {
+		name = "inline"
+	}
+	h.stopSimulatorProfile()
+
+	run := &simulatorProfileRun{Name: name, Running: true, Steps: len(steps), StartedAt: time.Now(), stop: make(chan struct{})}
+	sim.mu.Lock()
+	sim.profile = run
+	sim.mu.Unlock()
+	h.Infof("simulator: profile %s started (%d steps)", name, len(steps))
+	h.recordEvent("simulator", severityInfo, "", fmt.Sprintf("simulator profile %s started", name), map[string]interface{}{"profile": name})
+	go h.runSimulatorProfile(run, steps)
+	return run, nil
+}
+
+func (h *hems) runSimulatorProfile(run *simulatorProfileRun, steps []SimulatorStep) {
+	sim := h.simulator
+	finish := func(msg string) {
+		sim.mu.Lock()
+		now := time.Now()
+		run.Running = false
+		run.EndedAt = &now
+		run.Error = msg
+		sim.mu.Unlock()
+	}
+	for i, step := range steps {
+		if step.AfterSeconds > 0 {
+			timer := time.NewTimer(time.Duration(step.AfterSeconds * float64(time.Second)))
+			select {
+			case <-run.stop:
+				timer.Stop()
+				finish("stopped")
+				return
+			case <-timer.C:
+			}
+		}
+		select {
+		case <-run.stop:
+			finish("stopped")
+			return
+		default:
+		}
+		if _, err := h.updateSimulator(step.SimulatorUpdate); err != nil {
+			finish(fmt.Sprintf("step %d: %v", i, err))
+			return
+		}
+		sim.mu.Lock()
+		run.Step = i + 1
+		sim.mu.Unlock()
+	}
+	finish("")
+	h.Infof("simulator: profile %s finished", run.Name)
+}
+
+// stopSimulatorProfile stops the running profile, it reports whether one was running
+func (h *hems) stopSimulatorProfile() bool {
+	sim := h.simulator
+	if sim == nil {
+		return false
+	}
+	sim.mu.Lock()
+	run := sim.profile
+	running := run != nil && run.Running
+	if running {
+		// Running is reset by the profile goroutine, stop is closed only once
+		run.Running = false
+	}
+	sim.mu.Unlock()
+	if running {
+		close(run.stop)
+	}
+	return running
+}
+
+// writeSimulatorUpdate applies an update and writes the new state or the error
+func (h *hems) writeSimulatorUpdate(w http.ResponseWriter, u SimulatorUpdate) {
+	state, err := h.updateSimulator(u)
+	if errors.Is(err, errSimulatorDisabled) {
+		writeAPIError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+		return
+	}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		h.Errorf("encode simulator: %v", err)
+	}
+}
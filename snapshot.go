@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// snapshotVersion is the format version of state snapshots
+const snapshotVersion = 1
+
+// testerSnapshot is the state needed to rebuild a tester on another host: the SHIP
+// identity, the settings and the paired SKIs with their last known DUT data
+type testerSnapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// SKI of the local service, derived from the certificate
+	SKI string `json:"ski"`
+	// CertificatePEM and PrivateKeyPEM keep the SKI, so DUTs keep trusting the tester
+	CertificatePEM string         `json:"certificatePem"`
+	PrivateKeyPEM  string         `json:"privateKeyPem"`
+	Config         *Config        `json:"config"`
+	Peers          []snapshotPeer `json:"peers"`
+}
+
+// snapshotPeer is a remote service known to the tester
+type snapshotPeer struct {
+	SKI    string `json:"ski"`
+	ShipID string `json:"shipId,omitempty"`
+	// Paired is set for SKIs trusted by the tester, they are registered again on restore
+	Paired      bool            `json:"paired"`
+	LastSeen    time.Time       `json:"lastSeen"`
+	DeviceName  string          `json:"deviceName,omitempty"`
+	Brand       string          `json:"brand,omitempty"`
+	Model       string          `json:"model,omitempty"`
+	DeviceType  string          `json:"deviceType,omitempty"`
+	Serial      string          `json:"serial,omitempty"`
+	Identifier  string          `json:"identifier,omitempty"`
+	Usecases    map[string]bool `json:"usecases,omitempty"`
+	UsecaseData usecaseData     `json:"usecaseData"`
+}
+
+// snapshot captures the current tester state
+func (h *hems) snapshot() (*testerSnapshot, error) {
+	certPEM, keyPEM, err := encodePEM(h.certificate)
+	if err != nil {
+		return nil, err
+	}
+	snap := &testerSnapshot{
+		Version:        snapshotVersion,
+		CreatedAt:      time.Now(),
+		SKI:            h.myService.LocalService().SKI(),
+		CertificatePEM: string(certPEM),
+		PrivateKeyPEM:  string(keyPEM),
+		Config:         h.config,
+		Peers:          []snapshotPeer{},
+	}
+
+	// SKIs the pairing API or ship-go reported on, which may not have connected yet
+	skis := map[string]bool{}
+	h.pairing.mu.Lock()
+	for ski := range h.pairing.history {
+		skis[ski] = true
+	}
+	h.pairing.mu.Unlock()
+
+	peers := h.getAllPeers()
+	for ski := range peers {
+		skis[shiputil.NormalizeSKI(ski)] = true
+	}
+
+	for ski := range skis {
+		sp := snapshotPeer{SKI: ski}
+		if details := h.myService.RemoteServiceForSKI(ski); details != nil {
+			sp.Paired = details.Trusted()
+			sp.ShipID = details.ShipID()
+		}
+		if peer, ok := peers[ski]; ok {
+			usecaseDataMutex.Lock()
+			sp.UsecaseData = peer.usecaseData
+			usecaseDataMutex.Unlock()
+			h.peersMu.Lock()
+			sp.LastSeen = peer.lastSeen
+			sp.DeviceName = peer.deviceName
+			sp.Brand = peer.brand
+			sp.Model = peer.model
+			sp.DeviceType = peer.deviceType
+			sp.Serial = peer.serial
+			sp.Identifier = peer.identifier
+			sp.Usecases = h.usecaseSupportOf(peer)
+			h.peersMu.Unlock()
+			// a SHIP connection is only established with trust
+			if peer.connectCount > 0 {
+				sp.Paired = true
+			}
+		} else if !sp.Paired {
+			continue
+		}
+		snap.Peers = append(snap.Peers, sp)
+	}
+	sort.Slice(snap.Peers, func(i, j int) bool { return snap.Peers[i].SKI < snap.Peers[j].SKI })
+	return snap, nil
+}
+
+// saveSnapshot writes the current tester state to a file, the file contains the private key
+func (h *hems) saveSnapshot(path string) error {
+	snap, err := h.snapshot()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	h.Infof("State snapshot with %d peers written to %s", len(snap.Peers), path)
+	return nil
+}
+
+// readSnapshot reads and validates a snapshot file
+func readSnapshot(path string) (*testerSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	var snap testerSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("parsing snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	if snap.Config == nil {
+		return nil, errors.New("snapshot contains no config")
+	}
+	if snap.CertificatePEM == "" || snap.PrivateKeyPEM == "" {
+		return nil, errors.New("snapshot contains no certificate")
+	}
+	return &snap, nil
+}
+
+// restoreSnapshotFiles writes the config, certificate and key of a snapshot, so the
+// following startup uses the identity and settings of the snapshotted tester
+func restoreSnapshotFiles(snap *testerSnapshot, certPath, keyPath string) error {
+	b, err := json.MarshalIndent(snap.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(configPath, b, 0644); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	if err := os.WriteFile(certPath, []byte(snap.CertificatePEM), 0644); err != nil {
+		return fmt.Errorf("writing cert: %w", err)
+	}
+	if err := os.WriteFile(keyPath, []byte(snap.PrivateKeyPEM), 0600); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+	fmt.Printf("Restored config, certificate and key of SKI %s from snapshot of %s\n", snap.SKI, formatTimestamp(snap.CreatedAt))
+	return nil
+}
+
+// restoreSnapshotPeers recreates the known peers with their last known data and
+// registers the paired SKIs again
+func (h *hems) restoreSnapshotPeers(snap *testerSnapshot) {
+	paired := 0
+	for _, sp := range snap.Peers {
+		peer := h.getOrCreatePeer(sp.SKI)
+		h.peersMu.Lock()
+		peer.lastSeen = sp.LastSeen
+		peer.deviceName = sp.DeviceName
+		peer.brand = sp.Brand
+		peer.model = sp.Model
+		peer.deviceType = sp.DeviceType
+		peer.serial = sp.Serial
+		peer.identifier = sp.Identifier
+		for uc, supported := range sp.Usecases {
+			peer.usecases.setSupported(uc, supported, sp.LastSeen)
+		}
+		h.peersMu.Unlock()
+		usecaseDataMutex.Lock()
+		peer.usecaseData = sp.UsecaseData
+		usecaseDataMutex.Unlock()
+
+		if !sp.Paired {
+			continue
+		}
+		if ok, reason := h.skiPermitted(sp.SKI); !ok {
+			h.recordEvent("trust", severityWarning, sp.SKI, "snapshot SKI not registered: "+reason, nil)
+			continue
+		}
+		h.myService.RegisterRemoteSKI(sp.SKI, sp.ShipID)
+		paired++
+	}
+	h.recordEvent("snapshot", severityInfo, "", fmt.Sprintf("state restored from snapshot of %s, %d paired SKIs registered", formatTimestamp(snap.CreatedAt), paired), nil)
+	h.broadcastPeerList()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSoakSamples limits the samples kept for a soak run
+const maxSoakSamples = 10000
+
+// SoakConfig configures the long-run soak test mode
+type SoakConfig struct {
+	// IntervalSeconds is the sampling interval, defaults to 60
+	IntervalSeconds int `json:"intervalSeconds,omitempty"`
+	// DurationHours ends the soak run automatically, 0 runs until stopped
+	DurationHours float64 `json:"durationHours,omitempty"`
+	// GoroutineGrowthPerHour is the goroutine trend flagged as leak, defaults to 10
+	GoroutineGrowthPerHour float64 `json:"goroutineGrowthPerHour,omitempty"`
+	// HeapGrowthMBPerHour is the heap trend flagged as leak, defaults to 5
+	HeapGrowthMBPerHour float64 `json:"heapGrowthMBPerHour,omitempty"`
+	// MaxReconnectsPerHour is the number of reconnects of a peer within an hour that is flagged, defaults to 3
+	MaxReconnectsPerHour int `json:"maxReconnectsPerHour,omitempty"`
+	// SummaryDir is the directory the summary is written to when the run ends, defaults to the working directory
+	SummaryDir string `json:"summaryDir,omitempty"`
+}
+
+func (c SoakConfig) interval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+func (c SoakConfig) goroutineGrowth() float64 {
+	if c.GoroutineGrowthPerHour <= 0 {
+		return 10
+	}
+	return c.GoroutineGrowthPerHour
+}
+
+func (c SoakConfig) heapGrowth() float64 {
+	if c.HeapGrowthMBPerHour <= 0 {
+		return 5
+	}
+	return c.HeapGrowthMBPerHour
+}
+
+func (c SoakConfig) maxReconnects() int {
+	if c.MaxReconnectsPerHour <= 0 {
+		return 3
+	}
+	return c.MaxReconnectsPerHour
+}
+
+// soakSample is a single measurement of the tester and the DUT connections
+type soakSample struct {
+	Time           time.Time       `json:"time"`
+	Goroutines     int             `json:"goroutines"`
+	HeapAllocBytes uint64          `json:"heapAllocBytes"`
+	SysBytes       uint64          `json:"sysBytes"`
+	NumGC          uint32          `json:"numGC"`
+	Connected      map[string]bool `json:"connected"`
+	Connects       map[string]int  `json:"connects"`
+}
+
+// soakAnomaly is an irregularity detected during the soak run
+type soakAnomaly struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	SKI     string    `json:"ski,omitempty"`
+	Message string    `json:"message"`
+}
+
+// soakPeerSummary is the connection stability of a peer during the soak run
+type soakPeerSummary struct {
+	SKI           string  `json:"ski"`
+	Reconnects    int     `json:"reconnects"`
+	UptimePercent float64 `json:"uptimePercent"`
+}
+
+// soakSummary is the stability summary of a soak run
+type soakSummary struct {
+	StartedAt             time.Time         `json:"startedAt"`
+	EndedAt               time.Time         `json:"endedAt"`
+	DurationSeconds       float64           `json:"durationSeconds"`
+	Samples               int               `json:"samples"`
+	GoroutinesStart       int               `json:"goroutinesStart"`
+	GoroutinesEnd         int               `json:"goroutinesEnd"`
+	GoroutinesMax         int               `json:"goroutinesMax"`
+	GoroutineTrendPerHour float64           `json:"goroutineTrendPerHour"`
+	HeapStartBytes        uint64            `json:"heapStartBytes"`
+	HeapEndBytes          uint64            `json:"heapEndBytes"`
+	HeapMaxBytes          uint64            `json:"heapMaxBytes"`
+	HeapTrendMBPerHour    float64           `json:"heapTrendMBPerHour"`
+	Peers                 []soakPeerSummary `json:"peers"`
+	Anomalies             []soakAnomaly     `json:"anomalies"`
+	Stable                bool              `json:"stable"`
+}
+
+// soakRun is an active or finished soak test
+type soakRun struct {
+	Running   bool          `json:"running"`
+	Config    SoakConfig    `json:"config"`
+	StartedAt time.Time     `json:"startedAt"`
+	EndedAt   *time.Time    `json:"endedAt,omitempty"`
+	Samples   []soakSample  `json:"samples,omitempty"`
+	Anomalies []soakAnomaly `json:"anomalies"`
+	Summary   *soakSummary  `json:"summary,omitempty"`
+	File      string        `json:"file,omitempty"`
+
+	// anomaly kinds currently present, to record each occurrence only once
+	flagged map[string]bool
+	stop    chan struct{}
+}
+
+// soakState holds the current or last soak run
+type soakState struct {
+	mu  sync.Mutex
+	run *soakRun
+}
+
+// startSoak starts a new soak run, an active run has to be stopped first
+func (h *hems) startSoak(cfg SoakConfig) error {
+	h.soak.mu.Lock()
+	if h.soak.run != nil && h.soak.run.Running {
+		h.soak.mu.Unlock()
+		return fmt.Errorf("soak run already active since %s", formatTimestamp(h.soak.run.StartedAt))
+	}
+	run := &soakRun{
+		Running:   true,
+		Config:    cfg,
+		StartedAt: time.Now(),
+		Anomalies: []soakAnomaly{},
+		flagged:   make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+	h.soak.run = run
+	h.soak.mu.Unlock()
+
+	h.Infof("soak run started (interval %s, duration %.1f h)", cfg.interval(), cfg.DurationHours)
+	h.recordEvent("soak", severityInfo, "", "soak run started", nil)
+
+	go h.runSoak(run)
+	return nil
+}
+
+// stopSoak ends the active soak run and returns its summary
+func (h *hems) stopSoak() (*soakSummary, error) {
+	h.soak.mu.Lock()
+	run := h.soak.run
+	if run == nil || !run.Running {
+		h.soak.mu.Unlock()
+		return nil, fmt.Errorf("no active soak run")
+	}
+	h.soak.mu.Unlock()
+
+	close(run.stop)
+	return h.finishSoak(run), nil
+}
+
+func (h *hems) runSoak(run *soakRun) {
+	ticker := time.NewTicker(run.Config.interval())
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if run.Config.DurationHours > 0 {
+		timer := time.NewTimer(time.Duration(run.Config.DurationHours * float64(time.Hour)))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	h.takeSoakSample(run)
+	for {
+		select {
+		case <-ticker.C:
+			h.takeSoakSample(run)
+		case <-deadline:
+			h.finishSoak(run)
+			return
+		case <-run.stop:
+			return
+		}
+	}
+}
+
+func (h *hems) takeSoakSample(run *soakRun) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	sample := soakSample{
+		Time:           time.Now(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: mem.HeapAlloc,
+		SysBytes:       mem.Sys,
+		NumGC:          mem.NumGC,
+		Connected:      make(map[string]bool),
+		Connects:       make(map[string]int),
+	}
+	for ski, peer := range h.getAllPeers() {
+		sample.Connected[ski] = peer.connected
+		sample.Connects[ski] = peer.connectCount
+	}
+
+	h.soak.mu.Lock()
+	if !run.Running {
+		h.soak.mu.Unlock()
+		return
+	}
+	run.Samples = append(run.Samples, sample)
+	if len(run.Samples) > maxSoakSamples {
+		run.Samples = run.Samples[len(run.Samples)-maxSoakSamples:]
+	}
+	found := detectSoakAnomalies(run, sample)
+	var added []soakAnomaly
+	current := make(map[string]bool)
+	for _, a := range found {
+		key := a.Kind + "/" + a.SKI
+		current[key] = true
+		if !run.flagged[key] {
+			run.Anomalies = append(run.Anomalies, a)
+			added = append(added, a)
+		}
+	}
+	run.flagged = current
+	h.soak.mu.Unlock()
+
+	for _, a := range added {
+		h.Errorf("soak anomaly %s: %s", a.Kind, a.Message)
+		h.recordEvent("soak", severityWarning, a.SKI, a.Message, map[string]interface{}{"kind": a.Kind})
+	}
+}
+
+// detectSoakAnomalies checks the samples of a run for resource growth and
+// unstable connections. The caller must hold the soak mutex.
+func detectSoakAnomalies(run *soakRun, sample soakSample) []soakAnomaly {
+	cfg := run.Config
+	var out []soakAnomaly
+
+	// trends need some history to not flag the warm-up phase
+	if len(run.Samples) >= 10 {
+		if slope := soakTrend(run.Samples, func(s soakSample) float64 { return float64(s.Goroutines) }); slope > cfg.goroutineGrowth() {
+			out = append(out, soakAnomaly{Time: sample.Time, Kind: "goroutineGrowth",
+				Message: fmt.Sprintf("goroutine count growing by %.1f/h (now %d)", slope, sample.Goroutines)})
+		}
+		if slope := soakTrend(run.Samples, func(s soakSample) float64 { return float64(s.HeapAllocBytes) / (1 << 20) }); slope > cfg.heapGrowth() {
+			out = append(out, soakAnomaly{Time: sample.Time, Kind: "heapGrowth",
+				Message: fmt.Sprintf("heap growing by %.1f MB/h (now %.1f MB)", slope, float64(sample.HeapAllocBytes)/(1<<20))})
+		}
+	}
+
+	// reconnects within the last hour
+	var hourAgo *soakSample
+	for i := range run.Samples {
+		if sample.Time.Sub(run.Samples[i].Time) <= time.Hour {
+			hourAgo = &run.Samples[i]
+			break
+		}
+	}
+	for ski, connects := range sample.Connects {
+		if hourAgo != nil {
+			if n := connects - hourAgo.Connects[ski]; n > cfg.maxReconnects() {
+				out = append(out, soakAnomaly{Time: sample.Time, Kind: "reconnects", SKI: ski,
+					Message: fmt.Sprintf("%s reconnected %d times within the last hour", ski, n)})
+			}
+		}
+		if first := run.Samples[0]; first.Connected[ski] && !sample.Connected[ski] {
+			out = append(out, soakAnomaly{Time: sample.Time, Kind: "peerDown", SKI: ski,
+				Message: fmt.Sprintf("%s is disconnected", ski)})
+		}
+	}
+	return out
+}
+
+// soakTrend returns the linear regression slope of a value per hour
+func soakTrend(samples []soakSample, value func(soakSample) float64) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	t0 := samples[0].Time
+	var sx, sy, sxx, sxy float64
+	n := float64(len(samples))
+	for _, s := range samples {
+		x := s.Time.Sub(t0).Hours()
+		y := value(s)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
+
+// finishSoak ends a run, builds the summary and writes it to a file
+func (h *hems) finishSoak(run *soakRun) *soakSummary {
+	h.soak.mu.Lock()
+	if !run.Running {
+		summary := run.Summary
+		h.soak.mu.Unlock()
+		return summary
+	}
+	now := time.Now()
+	run.Running = false
+	run.EndedAt = &now
+	summary := buildSoakSummary(run, now)
+	run.Summary = summary
+	h.soak.mu.Unlock()
+
+	name := fmt.Sprintf("soak-%s.json", run.StartedAt.Format("20060102-150405"))
+	if run.Config.SummaryDir != "" {
+		name = run.Config.SummaryDir + string(os.PathSeparator) + name
+	}
+	if b, err := json.MarshalIndent(summary, "", "  "); err == nil {
+		if err := os.WriteFile(name, b, 0644); err != nil {
+			h.Errorf("write soak summary: %v", err)
+		} else {
+			h.soak.mu.Lock()
+			run.File = name
+			h.soak.mu.Unlock()
+		}
+	}
+
+	verdict := "stable"
+	if !summary.Stable {
+		verdict = "unstable"
+	}
+	h.Infof("soak run finished after %s: %s, %d anomalies", time.Duration(summary.DurationSeconds)*time.Second, verdict, len(summary.Anomalies))
+	h.recordEvent("soak", severityInfo, "", "soak run finished: "+verdict, map[string]interface{}{"anomalies": len(summary.Anomalies)})
+	return summary
+}
+
+// buildSoakSummary summarizes a run. The caller must hold the soak mutex.
+func buildSoakSummary(run *soakRun, end time.Time) *soakSummary {
+	s := &soakSummary{
+		StartedAt:       run.StartedAt,
+		EndedAt:         end,
+		DurationSeconds: end.Sub(run.StartedAt).Seconds(),
+		Samples:         len(run.Samples),
+		Peers:           []soakPeerSummary{},
+		Anomalies:       append([]soakAnomaly{}, run.Anomalies...),
+	}
+	if len(run.Samples) > 0 {
+		first, last := run.Samples[0], run.Samples[len(run.Samples)-1]
+		s.GoroutinesStart, s.GoroutinesEnd = first.Goroutines, last.Goroutines
+		s.HeapStartBytes, s.HeapEndBytes = first.HeapAllocBytes, last.HeapAllocBytes
+		for _, sample := range run.Samples {
+			if sample.Goroutines > s.GoroutinesMax {
+				s.GoroutinesMax = sample.Goroutines
+			}
+			if sample.HeapAllocBytes > s.HeapMaxBytes {
+				s.HeapMaxBytes = sample.HeapAllocBytes
+			}
+		}
+		s.GoroutineTrendPerHour = soakTrend(run.Samples, func(x soakSample) float64 { return float64(x.Goroutines) })
+		s.HeapTrendMBPerHour = soakTrend(run.Samples, func(x soakSample) float64 { return float64(x.HeapAllocBytes) / (1 << 20) })
+
+		for ski, connects := range last.Connects {
+			up := 0
+			for _, sample := range run.Samples {
+				if sample.Connected[ski] {
+					up++
+				}
+			}
+			p := soakPeerSummary{
+				SKI:           ski,
+				Reconnects:    connects - first.Connects[ski],
+				UptimePercent: float64(up) / float64(len(run.Samples)) * 100,
+			}
+			// the initial connect of a peer appearing during the run is no reconnect
+			if _, known := first.Connects[ski]; !known && p.Reconnects > 0 {
+				p.Reconnects--
+			}
+			s.Peers = append(s.Peers, p)
+		}
+		sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].SKI < s.Peers[j].SKI })
+	}
+	s.Stable = len(s.Anomalies) == 0
+	return s
+}
+
+// getSoak returns a copy of the current or last soak run, samples are only included on request
+func (h *hems) getSoak(withSamples bool) *soakRun {
+	h.soak.mu.Lock()
+	defer h.soak.mu.Unlock()
+
+	if h.soak.run == nil {
+		return nil
+	}
+	out := *h.soak.run
+	out.Anomalies = append([]soakAnomaly{}, h.soak.run.Anomalies...)
+	if withSamples {
+		out.Samples = append([]soakSample(nil), h.soak.run.Samples...)
+	} else {
+		out.Samples = nil
+	}
+	if out.Running {
+		out.Summary = buildSoakSummary(h.soak.run, time.Now())
+	}
+	return &out
+}
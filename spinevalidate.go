@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	shipmodel "github.com/enbility/ship-go/model"
+	"github.com/enbility/ship-go/ship"
+	shiputil "github.com/enbility/ship-go/util"
+	"github.com/enbility/spine-go/model"
+)
+
+// Limits of the SPINE validation results
+const (
+	maxSpineValidations      = 1000
+	maxFindingsPerValidation = 50
+)
+
+// Kinds of SPINE validation findings
+const (
+	findingUnknownField   = "unknownField"
+	findingWrongType      = "wrongType"
+	findingMissingElement = "missingElement"
+	findingInvalidValue   = "invalidValue"
+)
+
+// spineFinding is a deviation of a received payload from the SPINE data model
+type spineFinding struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// spineValidation is the validation result of a received datagram with findings
+type spineValidation struct {
+	DatagramID    uint64         `json:"datagramId"`
+	Time          time.Time      `json:"time"`
+	SKI           string         `json:"ski"`
+	MsgCounter    *uint64        `json:"msgCounter,omitempty"`
+	CmdClassifier string         `json:"cmdClassifier,omitempty"`
+	Functions     []string       `json:"functions,omitempty"`
+	Findings      []spineFinding `json:"findings"`
+}
+
+// spineValidationStats counts the validated datagrams of a peer
+type spineValidationStats struct {
+	Validated int `json:"validated"`
+	Invalid   int `json:"invalid"`
+}
+
+// spineValidator keeps the validation results of the received datagrams
+type spineValidator struct {
+	mu          sync.Mutex
+	validations []spineValidation
+	stats       map[string]*spineValidationStats
+	// reported holds the SKI, kind and path combinations already recorded as event
+	reported map[string]bool
+}
+
+func newSpineValidator() *spineValidator {
+	return &spineValidator{stats: make(map[string]*spineValidationStats), reported: make(map[string]bool)}
+}
+
+// datagramType is the data model the received payloads are validated against
+var datagramType = reflect.TypeOf(model.Datagram{})
+
+// validateDatagram checks a received SHIP data message against the SPINE data model.
+// eebus-go decodes with encoding/json, which ignores unknown fields, matches names case
+// insensitively and accepts missing elements, so these are only visible here.
+func (h *hems) validateDatagram(dg capturedDatagram, text string) {
+	if h.spineChecks == nil {
+		return
+	}
+	var data shipmodel.ShipData
+	if err := json.Unmarshal(ship.JsonFromEEBUSJson([]byte(text)), &data); err != nil {
+		return
+	}
+	var raw interface{}
+	d := json.NewDecoder(strings.NewReader(string(data.Data.Payload)))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return
+	}
+
+	var findings []spineFinding
+	add := func(kind, path, msg string) {
+		if len(findings) < maxFindingsPerValidation {
+			findings = append(findings, spineFinding{Kind: kind, Path: path, Message: msg})
+		}
+	}
+	walkSpineValue(raw, datagramType, "", add)
+	checkSpineDatagram(raw, add)
+
+	v := spineValidation{
+		DatagramID:    dg.ID,
+		Time:          dg.Time,
+		SKI:           dg.SKI,
+		MsgCounter:    dg.MsgCounter,
+		CmdClassifier: dg.CmdClassifier,
+		Functions:     dg.Functions,
+		Findings:      findings,
+	}
+	s := h.spineChecks
+	var report []spineFinding
+	s.mu.Lock()
+	stats := s.stats[dg.SKI]
+	if stats == nil {
+		stats = &spineValidationStats{}
+		s.stats[dg.SKI] = stats
+	}
+	stats.Validated++
+	if len(findings) > 0 {
+		stats.Invalid++
+		s.validations = append(s.validations, v)
+		if len(s.validations) > maxSpineValidations {
+			s.validations = s.validations[len(s.validations)-maxSpineValidations:]
+		}
+		for _, f := range findings {
+			key := dg.SKI + "|" + f.Kind + "|" + f.Path
+			if !s.reported[key] {
+				s.reported[key] = true
+				report = append(report, f)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	// every kind of finding is recorded once per path, the API lists all messages
+	for _, f := range report {
+		h.recordEvent("spineValidation", severityWarning, dg.SKI, fmt.Sprintf("SPINE %s at %s: %s", f.Kind, f.Path, f.Message),
+			map[string]interface{}{"datagramId": dg.ID, "functions": dg.Functions})
+	}
+}
+
+// walkSpineValue compares a decoded JSON value with the Go type of the data model
+func walkSpineValue(v interface{}, t reflect.Type, path string, add func(kind, path, msg string)) {
+	if v == nil {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	at := path
+	if at == "" {
+		at = "/"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			add(findingWrongType, at, "expected an object, got "+jsonKind(v))
+			return
+		}
+		fields := spineFields(t)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f, ok := fields[k]
+			if !ok {
+				msg := "not part of " + t.Name()
+				for name := range fields {
+					if strings.EqualFold(name, k) {
+						msg += fmt.Sprintf(", did you mean %q?", name)
+						break
+					}
+				}
+				add(findingUnknownField, path+"/"+k, msg)
+				continue
+			}
+			walkSpineValue(obj[k], f.Type, path+"/"+k, add)
+		}
+	case reflect.Slice, reflect.Array:
+		arr, ok := v.([]interface{})
+		if !ok {
+			add(findingWrongType, at, "expected an array, got "+jsonKind(v))
+			return
+		}
+		for i, e := range arr {
+			walkSpineValue(e, t.Elem(), fmt.Sprintf("%s/%d", path, i), add)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			add(findingWrongType, at, "expected a string, got "+jsonKind(v))
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			add(findingWrongType, at, "expected a boolean, got "+jsonKind(v))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(json.Number)
+		if !ok {
+			add(findingWrongType, at, "expected an integer, got "+jsonKind(v))
+			return
+		}
+		f, err := n.Float64()
+		if err != nil || f != math.Trunc(f) {
+			add(findingWrongType, at, fmt.Sprintf("expected an integer, got %s", n))
+			return
+		}
+		if overflows(t, f) {
+			add(findingInvalidValue, at, fmt.Sprintf("%s is out of range of %s", n, t.Kind()))
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(json.Number); !ok {
+			add(findingWrongType, at, "expected a number, got "+jsonKind(v))
+		}
+	}
+}
+
+// spineFields maps the JSON names of a struct to its fields
+func spineFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func overflows(t reflect.Type, f float64) bool {
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return f < 0 || (t.Bits() < 64 && f > float64(uint64(1)<<t.Bits()-1))
+	}
+	return t.Bits() < 64 && (f > float64(int64(1)<<(t.Bits()-1)-1) || f < -float64(int64(1)<<(t.Bits()-1)))
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// cmdOptionFields are the CmdType elements that are not a data choice
+var cmdOptionFields = map[string]bool{"function": true, "filter": true, "manufacturerSpecificExtension": true, "lastUpdateAt": true}
+
+// checkSpineDatagram checks the mandatory header elements (SPINE protocol 5.2.3) and that
+// every cmd carries exactly one data element
+func checkSpineDatagram(raw interface{}, add func(kind, path, msg string)) {
+	root, _ := raw.(map[string]interface{})
+	dg, _ := root["datagram"].(map[string]interface{})
+	if dg == nil {
+		add(findingMissingElement, "/datagram", "datagram element missing")
+		return
+	}
+	header, _ := dg["header"].(map[string]interface{})
+	if header == nil {
+		add(findingMissingElement, "/datagram/header", "header element missing")
+		return
+	}
+	for _, name := range []string{"specificationVersion", "addressSource", "addressDestination", "msgCounter", "cmdClassifier"} {
+		if _, ok := header[name]; !ok {
+			add(findingMissingElement, "/datagram/header/"+name, "mandatory header element missing")
+		}
+	}
+	for _, addr := range []string{"addressSource", "addressDestination"} {
+		a, ok := header[addr].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		elements := []string{"entity", "feature"}
+		if addr == "addressSource" {
+			elements = append([]string{"device"}, elements...)
+		}
+		for _, name := range elements {
+			if _, ok := a[name]; !ok {
+				add(findingMissingElement, "/datagram/header/"+addr+"/"+name, "address element missing")
+			}
+		}
+	}
+	classifier, _ := header["cmdClassifier"].(string)
+	switch model.CmdClassifierType(classifier) {
+	case model.CmdClassifierTypeReply, model.CmdClassifierTypeResult:
+		if _, ok := header["msgCounterReference"]; !ok {
+			add(findingMissingElement, "/datagram/header/msgCounterReference", "mandatory for cmdClassifier "+classifier)
+		}
+	case model.CmdClassifierTypeRead, model.CmdClassifierTypeNotify, model.CmdClassifierTypeWrite, model.CmdClassifierTypeCall:
+	default:
+		if _, ok := header["cmdClassifier"]; ok {
+			add(findingInvalidValue, "/datagram/header/cmdClassifier", fmt.Sprintf("unknown cmdClassifier %q", classifier))
+		}
+	}
+
+	payload, _ := dg["payload"].(map[string]interface{})
+	cmds, _ := payload["cmd"].([]interface{})
+	if len(cmds) == 0 {
+		add(findingMissingElement, "/datagram/payload/cmd", "payload without cmd")
+		return
+	}
+	for i, c := range cmds {
+		cmd, _ := c.(map[string]interface{})
+		n := 0
+		for k := range cmd {
+			if !cmdOptionFields[k] {
+				n++
+			}
+		}
+		if n != 1 {
+			add(findingInvalidValue, fmt.Sprintf("/datagram/payload/cmd/%d", i), fmt.Sprintf("cmd carries %d data elements, expected exactly one", n))
+		}
+	}
+}
+
+// getSpineValidation returns the validation counts per peer and the datagrams with
+// findings, newest first
+func (h *hems) getSpineValidation(ski string) map[string]interface{} {
+	ski = shiputil.NormalizeSKI(ski)
+	h.spineChecks.mu.Lock()
+	defer h.spineChecks.mu.Unlock()
+	stats := make(map[string]spineValidationStats)
+	for key, s := range h.spineChecks.stats {
+		if ski == "" || key == ski {
+			stats[key] = *s
+		}
+	}
+	messages := []spineValidation{}
+	for i := len(h.spineChecks.validations) - 1; i >= 0; i-- {
+		v := h.spineChecks.validations[i]
+		if ski != "" && v.SKI != ski {
+			continue
+		}
+		v.Findings = append([]spineFinding(nil), v.Findings...)
+		messages = append(messages, v)
+	}
+	return map[string]interface{}{"stats": stats, "messages": messages}
+}
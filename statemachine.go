@@ -0,0 +1,210 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// names of the tracked state machines
+const (
+	machineEvccChargeState      = "evccChargeState"
+	machineEvseccOperatingState = "evseccOperatingState"
+)
+
+// maxStateTransitions is the number of transitions kept per peer and state machine
+const maxStateTransitions = 1000
+
+// StateMachineConfig configures the validation of tracked state machines.
+// Keys are the state machine names (evccChargeState, evseccOperatingState).
+type StateMachineConfig struct {
+	// ExpectedStates lists states that have to be reported at least once
+	ExpectedStates map[string][]string `json:"expectedStates,omitempty"`
+	// InvalidTransitions lists transitions in the form "from->to" that are flagged
+	InvalidTransitions map[string][]string `json:"invalidTransitions,omitempty"`
+}
+
+var defaultExpectedStates = map[string][]string{
+	machineEvccChargeState:      {"unplugged", "active", "paused", "finished"},
+	machineEvseccOperatingState: {"normalOperation", "standby"},
+}
+
+var defaultInvalidTransitions = map[string][]string{
+	machineEvccChargeState: {"unplugged->finished"},
+}
+
+func (c StateMachineConfig) expected(machine string) []string {
+	if v, ok := c.ExpectedStates[machine]; ok {
+		return v
+	}
+	return defaultExpectedStates[machine]
+}
+
+func (c StateMachineConfig) invalid(machine, from, to string) bool {
+	list, ok := c.InvalidTransitions[machine]
+	if !ok {
+		list = defaultInvalidTransitions[machine]
+	}
+	for _, t := range list {
+		parts := strings.SplitN(t, "->", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		f, n := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if (f == "*" || f == from) && (n == "*" || n == to) {
+			return true
+		}
+	}
+	return false
+}
+
+// stateTransition is a single change of a tracked state
+type stateTransition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+	// DurationSeconds is the time spent in the previous state
+	DurationSeconds float64 `json:"durationSeconds"`
+	Invalid         bool    `json:"invalid,omitempty"`
+	// the last datagram received from the peer, usually the notify that changed the state
+	datagramRef
+}
+
+// stateHistory is the transition history of one state machine of a peer
+type stateHistory struct {
+	SKI                string             `json:"ski"`
+	Machine            string             `json:"machine"`
+	State              string             `json:"state"`
+	Since              time.Time          `json:"since"`
+	SecondsInState     float64            `json:"secondsInState"`
+	Transitions        []stateTransition  `json:"transitions"`
+	TimeInState        map[string]float64 `json:"timeInStateSeconds"`
+	StatesSeen         []string           `json:"statesSeen"`
+	MissingStates      []string           `json:"missingStates"`
+	InvalidTransitions int                `json:"invalidTransitions"`
+}
+
+// stateTracker keeps the state histories of all peers
+type stateTracker struct {
+	mu        sync.Mutex
+	histories map[string]*stateHistory
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{histories: make(map[string]*stateHistory)}
+}
+
+func (h *hems) stateMachineConfig() StateMachineConfig {
+	if h.config == nil {
+		return StateMachineConfig{}
+	}
+	return h.config.StateMachines
+}
+
+// trackState records a new state of a state machine, repeated reports of the same state are ignored
+func (h *hems) trackState(ski, machine, state string) {
+	if state == "" {
+		return
+	}
+	cfg := h.stateMachineConfig()
+	now := time.Now()
+	ref := h.nearestDatagram(ski)
+
+	h.states.mu.Lock()
+	key := ski + "/" + machine
+	hist, ok := h.states.histories[key]
+	if !ok {
+		hist = &stateHistory{SKI: ski, Machine: machine, TimeInState: make(map[string]float64)}
+		h.states.histories[key] = hist
+	}
+	if hist.State == state {
+		h.states.mu.Unlock()
+		return
+	}
+
+	t := stateTransition{From: hist.State, To: state, At: now, datagramRef: ref}
+	if hist.State != "" {
+		t.DurationSeconds = now.Sub(hist.Since).Seconds()
+		hist.TimeInState[hist.State] += t.DurationSeconds
+		t.Invalid = cfg.invalid(machine, hist.State, state)
+	}
+	if t.Invalid {
+		hist.InvalidTransitions++
+	}
+	hist.Transitions = append(hist.Transitions, t)
+	if len(hist.Transitions) > maxStateTransitions {
+		hist.Transitions = hist.Transitions[len(hist.Transitions)-maxStateTransitions:]
+	}
+	hist.State = state
+	hist.Since = now
+	h.states.mu.Unlock()
+
+	if t.Invalid {
+		h.Errorf("invalid %s transition for %s: %s -> %s", machine, ski, t.From, t.To)
+	} else {
+		h.Debugf("%s of %s: %s -> %s", machine, ski, t.From, t.To)
+	}
+	h.broadcastJSON(map[string]interface{}{
+		"type":       "state",
+		"ski":        ski,
+		"machine":    machine,
+		"transition": t,
+	})
+}
+
+// snapshot returns a copy of the history including the derived values up to now
+func (s *stateHistory) snapshot(now time.Time, cfg StateMachineConfig) stateHistory {
+	out := *s
+	out.Transitions = append([]stateTransition(nil), s.Transitions...)
+	out.TimeInState = make(map[string]float64, len(s.TimeInState)+1)
+	for k, v := range s.TimeInState {
+		out.TimeInState[k] = v
+	}
+	if s.State != "" {
+		out.SecondsInState = now.Sub(s.Since).Seconds()
+		out.TimeInState[s.State] += out.SecondsInState
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range s.Transitions {
+		seen[t.To] = true
+	}
+	out.StatesSeen = make([]string, 0, len(seen))
+	for state := range seen {
+		out.StatesSeen = append(out.StatesSeen, state)
+	}
+	sort.Strings(out.StatesSeen)
+
+	out.MissingStates = []string{}
+	for _, state := range cfg.expected(s.Machine) {
+		if !seen[state] {
+			out.MissingStates = append(out.MissingStates, state)
+		}
+	}
+	return out
+}
+
+// getStateHistories returns the state histories filtered by peer and state machine (empty matches all)
+func (h *hems) getStateHistories(ski, machine string) []stateHistory {
+	cfg := h.stateMachineConfig()
+	now := time.Now()
+
+	h.states.mu.Lock()
+	defer h.states.mu.Unlock()
+
+	out := []stateHistory{}
+	for _, hist := range h.states.histories {
+		if (ski != "" && hist.SKI != ski) || (machine != "" && hist.Machine != machine) {
+			continue
+		}
+		out = append(out, hist.snapshot(now, cfg))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SKI != out[j].SKI {
+			return out[i].SKI < out[j].SKI
+		}
+		return out[i].Machine < out[j].Machine
+	})
+	return out
+}
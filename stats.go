@@ -0,0 +1,12 @@
+package main
+
+// getStats returns the connection statistics sections of /api/stats, optionally for one SKI
+func (h *hems) getStats(ski string) map[string]interface{} {
+	return map[string]interface{}{
+		"handshakes":   h.getHandshakeStats(ski),
+		"errors":       h.getErrorStats(ski, false),
+		"latency":      h.getResponseLatencies(ski, ""),
+		"availability": h.getAvailability(ski),
+		"readiness":    h.getReadinessStats(ski),
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// Defaults of the rapid-write stress test
+const (
+	defaultStressCount  = 20
+	defaultStressRate   = 10.0
+	defaultStressMin    = 1000.0
+	defaultStressMax    = 4000.0
+	defaultStressSettle = 5 * time.Second
+	maxStressCount      = 1000
+)
+
+// stressTestRequest starts a rapid-write stress test
+type stressTestRequest struct {
+	SKI string `json:"ski"`
+	// Usecase is "lpc" (default) or "lpp"
+	Usecase string `json:"usecase,omitempty"`
+	// Count is the number of limit writes, defaults to 20
+	Count int `json:"count,omitempty"`
+	// RatePerSecond is the write rate, defaults to 10
+	RatePerSecond float64 `json:"ratePerSecond,omitempty"`
+	// MinValue and MaxValue are the limit range in W, the writes ramp from min to max so
+	// every write differs and the last one writes MaxValue. Default 1000 and 4000.
+	MinValue float64 `json:"minValue,omitempty"`
+	MaxValue float64 `json:"maxValue,omitempty"`
+	// DurationSeconds is the limit duration, 0 for indefinite limits
+	DurationSeconds int64 `json:"durationSeconds,omitempty"`
+	// SettleSeconds is the time after the last result before the final state is read, defaults to 5
+	SettleSeconds float64 `json:"settleSeconds,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// stressWrite is a single write of a stress test and its result
+type stressWrite struct {
+	Index      int          `json:"index"`
+	Value      float64      `json:"value"`
+	SentAt     time.Time    `json:"sentAt"`
+	Command    string       `json:"command,omitempty"`
+	State      commandState `json:"state,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	MsgCounter *uint64      `json:"msgCounter,omitempty"`
+	// ResultDatagramID is the captured result of the DUT, used to check the result order
+	ResultDatagramID *uint64 `json:"resultDatagramId,omitempty"`
+	// AckSeconds is the time from executing the write until the DUT answered
+	AckSeconds *float64 `json:"ackSeconds,omitempty"`
+}
+
+// stressTestRun is an active or finished stress test
+type stressTestRun struct {
+	SKI           string        `json:"ski"`
+	Usecase       string        `json:"usecase"`
+	Count         int           `json:"count"`
+	RatePerSecond float64       `json:"ratePerSecond"`
+	Running       bool          `json:"running"`
+	StartedAt     time.Time     `json:"startedAt"`
+	EndedAt       *time.Time    `json:"endedAt,omitempty"`
+	Writes        []stressWrite `json:"writes"`
+	// Acknowledged, Rejected and Failed count the final write states, Failed includes timeouts
+	Acknowledged int `json:"acknowledged"`
+	Rejected     int `json:"rejected"`
+	Failed       int `json:"failed"`
+	// OutOfOrder counts results the DUT sent before the result of an earlier write
+	OutOfOrder int `json:"outOfOrder"`
+	// FinalLimit is the limit the DUT reports after the last write
+	FinalLimit *lpcLimitReading `json:"finalLimit,omitempty"`
+	Assertions []testAssertion  `json:"assertions"`
+	Passed     bool             `json:"passed"`
+	Error      string           `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// stressTestState holds the current or last stress test
+type stressTestState struct {
+	mu  sync.Mutex
+	run *stressTestRun
+}
+
+// startStressTest issues limit writes at a fixed rate in the background
+func (h *hems) startStressTest(req stressTestRequest) (*stressTestRun, error) {
+	if req.SKI == "" {
+		return nil, errors.New("ski is required")
+	}
+	req.SKI = shiputil.NormalizeSKI(req.SKI)
+	switch req.Usecase {
+	case "", "lpc":
+		req.Usecase = "lpc"
+		if h.uceglpc == nil {
+			return nil, errors.New("LPC usecase is disabled")
+		}
+	case "lpp":
+		if h.uceglpp == nil {
+			return nil, errors.New("LPP usecase is disabled")
+		}
+	default:
+		return nil, errors.New("usecase must be lpc or lpp")
+	}
+	if req.Count <= 0 {
+		req.Count = defaultStressCount
+	}
+	if req.Count > maxStressCount {
+		return nil, fmt.Errorf("count must not exceed %d", maxStressCount)
+	}
+	if req.RatePerSecond < 0 || req.MinValue < 0 || req.MaxValue < 0 || req.DurationSeconds < 0 {
+		return nil, errors.New("ratePerSecond, minValue, maxValue and durationSeconds must not be negative")
+	}
+	if req.RatePerSecond == 0 {
+		req.RatePerSecond = defaultStressRate
+	}
+	if req.MinValue == 0 && req.MaxValue == 0 {
+		req.MinValue, req.MaxValue = defaultStressMin, defaultStressMax
+	}
+	run := &stressTestRun{
+		SKI:           req.SKI,
+		Usecase:       req.Usecase,
+		Count:         req.Count,
+		RatePerSecond: req.RatePerSecond,
+		Running:       true,
+		StartedAt:     time.Now(),
+		Metadata:      req.Metadata,
+	}
+
+	h.stressTests.mu.Lock()
+	if h.stressTests.run != nil && h.stressTests.run.Running {
+		h.stressTests.mu.Unlock()
+		return nil, errors.New("a stress test is already running")
+	}
+	h.stressTests.run = run
+	snap := copyStressTestRun(run)
+	h.stressTests.mu.Unlock()
+
+	go h.runStressTest(run, req)
+	h.recordEvent("stresstest", severityInfo, req.SKI, fmt.Sprintf("stress test started: %d %s writes at %.1f/s", req.Count, req.Usecase, req.RatePerSecond), nil)
+	return snap, nil
+}
+
+// stressValue returns the limit of the i-th write, ramping from min to max
+func stressValue(req stressTestRequest, i int) float64 {
+	if req.Count == 1 {
+		return req.MaxValue
+	}
+	return math.Round(req.MinValue + (req.MaxValue-req.MinValue)*float64(i)/float64(req.Count-1))
+}
+
+func (h *hems) runStressTest(run *stressTestRun, req stressTestRequest) {
+	span := h.tracer.startSpan("test stress/"+run.Usecase, spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	errText := h.stressTestSteps(run, req)
+
+	now := time.Now()
+	h.stressTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Error = errText
+	run.Passed = errText == ""
+	for _, a := range run.Assertions {
+		if !a.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := stressTestResult(run)
+	counts := map[string]interface{}{
+		"acknowledged": run.Acknowledged, "rejected": run.Rejected, "failed": run.Failed, "outOfOrder": run.OutOfOrder,
+	}
+	h.stressTests.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("stress test: %v", err)
+	} else {
+		h.stressTests.mu.Lock()
+		run.ResultID = result.ID
+		h.stressTests.mu.Unlock()
+	}
+	h.broadcastStressTest()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("stress test %s", verdict)
+	h.recordEvent("stresstest", severity, run.SKI, "stress test "+verdict, counts)
+}
+
+// stressTestSteps queues the writes at the configured rate, waits for all results and
+// reads the final state of the DUT
+func (h *hems) stressTestSteps(run *stressTestRun, req stressTestRequest) string {
+	cmd, write := "writeLPCConsumptionLimit", h.WriteLPCConsumptionLimit
+	if run.Usecase == "lpp" {
+		cmd, write = "writeLPPProductionLimit", h.WriteLPPProductionLimit
+	}
+	interval := time.Duration(float64(time.Second) / req.RatePerSecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	commands := make([]*command, req.Count)
+	for i := 0; i < req.Count; i++ {
+		if i > 0 {
+			<-ticker.C
+		}
+		value := stressValue(req, i)
+		w := stressWrite{Index: i, Value: value, SentAt: time.Now()}
+		payload := map[string]interface{}{"ski": run.SKI, "value": value, "isActive": true, "durationSeconds": float64(req.DurationSeconds)}
+		c, err := h.enqueueCommand(cmd, payload, nil, func() ([]sentMessage, error) {
+			return write(run.SKI, req.DurationSeconds, value, true)
+		})
+		if c != nil {
+			w.Command = c.ID
+		}
+		if err != nil {
+			w.State, w.Error = commandFailed, err.Error()
+		} else {
+			commands[i] = c
+		}
+		h.stressTests.mu.Lock()
+		run.Writes = append(run.Writes, w)
+		h.stressTests.mu.Unlock()
+		if i%10 == 0 {
+			h.broadcastStressTest()
+		}
+	}
+
+	// collect the results, the commands end acknowledged, rejected or timed out
+	var lastResult uint64
+	for i, c := range commands {
+		if c == nil {
+			continue
+		}
+		<-c.done
+		snap, _ := h.getCommand(c.ID)
+		h.stressTests.mu.Lock()
+		w := &run.Writes[i]
+		w.State, w.Error = snap.State, snap.Error
+		if !snap.startedAt.IsZero() && snap.State.final() && snap.State != commandFailed {
+			s := snap.UpdatedAt.Sub(snap.startedAt).Seconds()
+			w.AckSeconds = &s
+		}
+		for _, m := range snap.Messages {
+			if m.ski != run.SKI || !m.wasSent() {
+				continue
+			}
+			n := m.MsgCounter
+			w.MsgCounter = &n
+			w.ResultDatagramID = m.ResultDatagramID
+			if m.ResultDatagramID != nil {
+				if *m.ResultDatagramID < lastResult {
+					run.OutOfOrder++
+				} else {
+					lastResult = *m.ResultDatagramID
+				}
+			}
+		}
+		h.stressTests.mu.Unlock()
+	}
+
+	h.stressTests.mu.Lock()
+	for _, w := range run.Writes {
+		switch w.State {
+		case commandAcknowledged:
+			run.Acknowledged++
+		case commandRejected:
+			run.Rejected++
+		default:
+			run.Failed++
+		}
+	}
+	acked, rejected, failed, outOfOrder := run.Acknowledged, run.Rejected, run.Failed, run.OutOfOrder
+	h.stressTests.mu.Unlock()
+	h.broadcastStressTest()
+
+	h.addStressAssertion(run, "all writes acknowledged", acked == req.Count,
+		fmt.Sprintf("%d of %d acknowledged, %d rejected, %d failed or timed out", acked, req.Count, rejected, failed))
+	h.addStressAssertion(run, "results in write order", outOfOrder == 0,
+		fmt.Sprintf("%d results received before the result of an earlier write", outOfOrder))
+
+	time.Sleep(secondsOr(req.SettleSeconds, defaultStressSettle))
+	final, err := h.stressFinalLimit(run)
+	if err != nil {
+		h.addStressAssertion(run, "final limit is the last write", false, err.Error())
+		return ""
+	}
+	h.stressTests.mu.Lock()
+	run.FinalLimit = final
+	h.stressTests.mu.Unlock()
+	last := stressValue(req, req.Count-1)
+	ok := final.Active && math.Abs(math.Abs(final.Value)-last) <= 0.5
+	h.addStressAssertion(run, "final limit is the last write", ok,
+		fmt.Sprintf("DUT reports %.0f W (active %t), last write %.0f W", math.Abs(final.Value), final.Active, last))
+	return ""
+}
+
+// stressFinalLimit reads the LPC limit back from the DUT, the LPP limit is taken from the
+// data the DUT reported
+func (h *hems) stressFinalLimit(run *stressTestRun) (*lpcLimitReading, error) {
+	if run.Usecase == "lpc" {
+		readings, err := h.readLPC(run.SKI)
+		if err != nil {
+			return nil, err
+		}
+		if readings[0].ConsumptionLimit == nil {
+			return nil, errors.New("the DUT reports no consumption limit")
+		}
+		return readings[0].ConsumptionLimit, nil
+	}
+	for _, entity := range remoteEntities(h.uceglpp.RemoteEntitiesScenarios(), run.SKI) {
+		if limit, err := h.uceglpp.ProductionLimit(entity); err == nil {
+			return &lpcLimitReading{
+				Active:          limit.IsActive,
+				Changeable:      limit.IsChangeable,
+				Value:           limit.Value,
+				DurationSeconds: limit.Duration.Seconds(),
+				Indefinite:      limit.Duration == 0,
+			}, nil
+		}
+	}
+	return nil, errors.New("the DUT reports no production limit")
+}
+
+func (h *hems) addStressAssertion(run *stressTestRun, name string, passed bool, msg string) {
+	h.stressTests.mu.Lock()
+	run.Assertions = append(run.Assertions, testAssertion{Name: name, Passed: passed, Message: msg})
+	h.stressTests.mu.Unlock()
+	h.broadcastStressTest()
+}
+
+// stressTestResult converts a finished stress test to a stored test run
+func stressTestResult(run *stressTestRun) *testRunResult {
+	res := &testRunResult{Plan: "stress/" + run.Usecase, SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	res.Assertions = append(res.Assertions, run.Assertions...)
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyStressTestRun(run *stressTestRun) *stressTestRun {
+	c := *run
+	c.Writes = append([]stressWrite(nil), run.Writes...)
+	c.Assertions = append([]testAssertion(nil), run.Assertions...)
+	return &c
+}
+
+// getStressTest returns a copy of the current or last stress test
+func (h *hems) getStressTest() *stressTestRun {
+	h.stressTests.mu.Lock()
+	defer h.stressTests.mu.Unlock()
+	if h.stressTests.run == nil {
+		return nil
+	}
+	return copyStressTestRun(h.stressTests.run)
+}
+
+// broadcastStressTest sends the progress of the stress test to all websocket clients, the
+// writes are left out and available via the API
+func (h *hems) broadcastStressTest() {
+	run := h.getStressTest()
+	if run == nil {
+		return
+	}
+	run.Writes = nil
+	h.broadcastJSON(map[string]interface{}{
+		"type":       "stresstest",
+		"ski":        run.SKI,
+		"stresstest": run,
+	})
+}
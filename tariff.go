@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// CevcConfig configures the energy broker side of CEVC
+type CevcConfig struct {
+	// TariffFile is a JSON tariff sent to EVs instead of the eebus-go defaults
+	TariffFile string `json:"tariffFile,omitempty"`
+}
+
+// cevcSlot is a slot of a price curve or power limit curve, the slots follow each other
+// starting when the tariff is sent
+type cevcSlot struct {
+	DurationSeconds float64 `json:"durationSeconds"`
+	Value           float64 `json:"value"`
+}
+
+// cevcTariff is the incentive table and the power limits published to the EVs
+type cevcTariff struct {
+	// Currency defaults to EUR
+	Currency string `json:"currency,omitempty"`
+	// IncentiveType is absoluteCost, relativeCost, renewableEnergyPercentage or co2Emission,
+	// defaults to absoluteCost
+	IncentiveType string `json:"incentiveType,omitempty"`
+	// TierType is fixedCost or dynamicCost, defaults to dynamicCost
+	TierType string `json:"tierType,omitempty"`
+	// Incentives is the price curve, e.g. the price per kWh of every hour
+	Incentives []cevcSlot `json:"incentives"`
+	// PowerLimits are the maximum power in W per slot, the EV maximum for 7 days if empty
+	PowerLimits []cevcSlot `json:"powerLimits,omitempty"`
+}
+
+// validate checks the tariff and sets the defaults
+func (t *cevcTariff) validate() error {
+	if t.Currency == "" {
+		t.Currency = string(model.CurrencyTypeEur)
+	}
+	t.Currency = strings.ToUpper(t.Currency)
+	if t.IncentiveType == "" {
+		t.IncentiveType = string(model.IncentiveTypeTypeAbsoluteCost)
+	}
+	switch model.IncentiveTypeType(t.IncentiveType) {
+	case model.IncentiveTypeTypeAbsoluteCost, model.IncentiveTypeTypeRelativeCost,
+		model.IncentiveTypeTypeRenewableEnergyPercentage, model.IncentiveTypeTypeCo2Emission:
+	default:
+		return fmt.Errorf("unknown incentiveType %q", t.IncentiveType)
+	}
+	if t.TierType == "" {
+		t.TierType = string(model.TierTypeTypeDynamicCost)
+	}
+	switch model.TierTypeType(t.TierType) {
+	case model.TierTypeTypeFixedCost, model.TierTypeTypeDynamicCost:
+	default:
+		return fmt.Errorf("unknown tierType %q", t.TierType)
+	}
+	if len(t.Incentives) == 0 {
+		return errors.New("incentives must contain at least one slot")
+	}
+	for i, s := range t.Incentives {
+		if s.DurationSeconds <= 0 {
+			return fmt.Errorf("incentives[%d]: durationSeconds must be positive", i)
+		}
+	}
+	for i, s := range t.PowerLimits {
+		if s.DurationSeconds <= 0 {
+			return fmt.Errorf("powerLimits[%d]: durationSeconds must be positive", i)
+		}
+		if s.Value < 0 {
+			return fmt.Errorf("powerLimits[%d]: value must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// descriptions is the incentive table description of the tariff: one tier with one
+// power boundary and one incentive, the only layout eebus-go writes incentives for
+func (t *cevcTariff) descriptions() []ucapi.IncentiveTariffDescription {
+	incentive := ucapi.IncentiveDescription{Id: 0, Type: model.IncentiveTypeType(t.IncentiveType)}
+	if incentive.Type == model.IncentiveTypeTypeAbsoluteCost || incentive.Type == model.IncentiveTypeTypeRelativeCost {
+		incentive.Currency = model.CurrencyType(t.Currency)
+	}
+	return []ucapi.IncentiveTariffDescription{{
+		Tiers: []ucapi.IncentiveTableDescriptionTier{{
+			Id:   0,
+			Type: model.TierTypeType(t.TierType),
+			Boundaries: []ucapi.TierBoundaryDescription{{
+				Id:   0,
+				Type: model.TierBoundaryTypeTypePowerBoundary,
+				Unit: model.UnitOfMeasurementTypeW,
+			}},
+			Incentives: []ucapi.IncentiveDescription{incentive},
+		}},
+	}}
+}
+
+func durationSlots(slots []cevcSlot) []ucapi.DurationSlotValue {
+	out := make([]ucapi.DurationSlotValue, 0, len(slots))
+	for _, s := range slots {
+		out = append(out, ucapi.DurationSlotValue{
+			Duration: time.Duration(s.DurationSeconds * float64(time.Second)),
+			Value:    s.Value,
+		})
+	}
+	return out
+}
+
+// tariffState is the tariff sent to EVs, nil for the eebus-go defaults
+type tariffState struct {
+	mu        sync.Mutex
+	tariff    *cevcTariff
+	source    string
+	updatedAt time.Time
+}
+
+// tariffStatus is the response of the tariff endpoints
+type tariffStatus struct {
+	Tariff *cevcTariff `json:"tariff,omitempty"`
+	// Source is file, api or default
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	// Results are the writes of the last publish to the EVs
+	Results []tariffWriteResult `json:"results,omitempty"`
+}
+
+// tariffWriteResult is the outcome of publishing the tariff to one EV entity
+type tariffWriteResult struct {
+	SKI    string `json:"ski"`
+	Entity string `json:"entity"`
+	// Errors of the incentiveTableDescription, incentives and powerLimits writes
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// loadTariffFile loads the tariff configured with cevc.tariffFile
+func (h *hems) loadTariffFile() {
+	if h.config == nil || h.config.Cevc.TariffFile == "" {
+		return
+	}
+	path := h.config.Cevc.TariffFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		h.Errorf("cevc tariff: %v", err)
+		return
+	}
+	var t cevcTariff
+	if err := json.Unmarshal(data, &t); err != nil {
+		h.Errorf("cevc tariff %s: %v", path, err)
+		return
+	}
+	if err := t.validate(); err != nil {
+		h.Errorf("cevc tariff %s: %v", path, err)
+		return
+	}
+	h.tariffs.mu.Lock()
+	h.tariffs.tariff, h.tariffs.source, h.tariffs.updatedAt = &t, "file", time.Now()
+	h.tariffs.mu.Unlock()
+	h.Infof("cevc tariff loaded from %s with %d incentive slots", path, len(t.Incentives))
+}
+
+// currentTariff returns the tariff sent to EVs, nil for the eebus-go defaults
+func (h *hems) currentTariff() *cevcTariff {
+	h.tariffs.mu.Lock()
+	defer h.tariffs.mu.Unlock()
+	return h.tariffs.tariff
+}
+
+func (h *hems) getTariff() tariffStatus {
+	h.tariffs.mu.Lock()
+	defer h.tariffs.mu.Unlock()
+	if h.tariffs.tariff == nil {
+		return tariffStatus{Source: "default"}
+	}
+	return tariffStatus{Tariff: h.tariffs.tariff, Source: h.tariffs.source, UpdatedAt: optionalTime(h.tariffs.updatedAt)}
+}
+
+// setTariff replaces the tariff, nil restores the defaults, and publishes it to the
+// CEVC entities of all peers or the one with the SKI
+func (h *hems) setTariff(t *cevcTariff, ski string) (tariffStatus, error) {
+	if h.uccemcevc == nil {
+		return tariffStatus{}, errors.New("CEVC usecase is disabled")
+	}
+	if t != nil {
+		if err := t.validate(); err != nil {
+			return tariffStatus{}, err
+		}
+	}
+	h.tariffs.mu.Lock()
+	h.tariffs.tariff, h.tariffs.source, h.tariffs.updatedAt = t, "api", time.Now()
+	h.tariffs.mu.Unlock()
+
+	msg := "cevc tariff reset to the defaults"
+	if t != nil {
+		msg = fmt.Sprintf("cevc tariff set with %d incentive slots", len(t.Incentives))
+	}
+	h.recordEvent("tariff", severityInfo, ski, msg, nil)
+
+	status := h.getTariff()
+	for _, entity := range remoteEntities(h.uccemcevc.RemoteEntitiesScenarios(), ski) {
+		status.Results = append(status.Results, h.publishTariff(entity, true, true))
+	}
+	return status, nil
+}
+
+// publishTariff writes the incentive table description and/or the incentives and power
+// limits of the current tariff to an EV
+func (h *hems) publishTariff(entity spineapi.EntityRemoteInterface, descriptions, slots bool) tariffWriteResult {
+	res := tariffWriteResult{Entity: fmt.Sprint(entity.Address()), Errors: map[string]string{}}
+	if entity.Device() != nil {
+		res.SKI = entity.Device().Ski()
+	}
+	t := h.currentTariff()
+	var desc []ucapi.IncentiveTariffDescription
+	var incentives, limits []ucapi.DurationSlotValue
+	if t != nil {
+		desc, incentives, limits = t.descriptions(), durationSlots(t.Incentives), durationSlots(t.PowerLimits)
+	}
+	if descriptions {
+		if err := h.uccemcevc.WriteIncentiveTableDescriptions(entity, desc); err != nil {
+			res.Errors["incentiveTableDescription"] = err.Error()
+		}
+	}
+	if slots {
+		if err := h.uccemcevc.WritePowerLimits(entity, limits); err != nil {
+			res.Errors["powerLimits"] = err.Error()
+		}
+		if err := h.uccemcevc.WriteIncentives(entity, incentives); err != nil {
+			res.Errors["incentives"] = err.Error()
+		}
+	}
+	if slots && len(res.Errors) == 0 {
+		h.recordSentSlots(res.SKI, limits, incentives)
+	}
+	for name, e := range res.Errors {
+		h.Errorf("cevc tariff: write %s to %s: %s", name, res.Entity, e)
+	}
+	if len(res.Errors) == 0 {
+		res.Errors = nil
+	}
+	return res
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of the test subcommand
+const (
+	testExitPassed = 0
+	// testExitFailed is returned when at least one assertion failed
+	testExitFailed = 1
+	// testExitUsage is returned for invalid flags, config or a service that did not start
+	testExitUsage = 2
+	// testExitTimeout is returned when the DUT did not connect or the test did not finish in time
+	testExitTimeout = 3
+)
+
+// testPollInterval is the interval the test subcommand checks connection and test progress
+const testPollInterval = time.Second
+
+// runTestCommand implements `device-tester test`: it starts the service, waits for the
+// DUT, runs one test and prints the summary to stdout. Progress and the service log go
+// to stderr, so the output can be parsed in CI pipelines.
+func runTestCommand(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	port := fs.Int("p", 4815, "server port for EEBUS")
+	certPath := fs.String("c", "", "path to cert.pem (optional)")
+	keyPath := fs.String("k", "", "path to key.pem (optional)")
+	plan := fs.String("plan", "", "test to run: time/dst or time/durations")
+	ski := fs.String("ski", "", "SKI of the DUT, it is paired if needed (optional, any connected DUT otherwise)")
+	value := fs.Float64("value", 0, "consumption limit in W written by the test")
+	durations := fs.String("durations", "", "comma separated limit durations in seconds for time/durations (optional)")
+	tolerance := fs.Float64("tolerance", 0, "accepted deviation in seconds (optional)")
+	connectTimeout := fs.Duration("connect-timeout", 2*time.Minute, "time to wait for the DUT to connect")
+	timeout := fs.Duration("timeout", 30*time.Minute, "time the test may take")
+	output := fs.String("output", "text", "summary format: text or json")
+	operator := fs.String("operator", "", "operator stored with the result (optional)")
+	firmware := fs.String("firmware", "", "firmware version of the DUT stored with the result (optional)")
+	campaign := fs.String("campaign", "", "test campaign stored with the result (optional)")
+	tags := fs.String("tags", "", "comma separated tags stored with the result (optional)")
+	if err := fs.Parse(args); err != nil {
+		return testExitUsage
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "output must be text or json")
+		return testExitUsage
+	}
+
+	req := timeTestRequest{SKI: *ski, Value: *value, ToleranceSeconds: *tolerance}
+	meta := &testRunMetadata{Operator: *operator, Firmware: *firmware, Campaign: *campaign}
+	if *tags != "" {
+		meta.Tags = strings.Split(*tags, ",")
+	}
+	var err error
+	if req.Metadata, err = meta.normalized(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return testExitUsage
+	}
+	switch *plan {
+	case "time/" + timeTestDST:
+		req.Test = timeTestDST
+	case "time/" + timeTestDurations:
+		req.Test = timeTestDurations
+	default:
+		fmt.Fprintf(os.Stderr, "unknown plan %q, use time/%s or time/%s\n", *plan, timeTestDST, timeTestDurations)
+		return testExitUsage
+	}
+	if *durations != "" {
+		for _, d := range strings.Split(*durations, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(d), 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid duration %q\n", d)
+				return testExitUsage
+			}
+			req.DurationsSeconds = append(req.DurationsSeconds, v)
+		}
+	}
+
+	// everything printed by the service goes to stderr, stdout only carries the summary
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+
+	h := hems{}
+	if h.config, err = loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return testExitUsage
+	}
+	if err := applyTimezone(h.config.Timezone); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return testExitUsage
+	}
+	h.run(*port, *certPath, *keyPath)
+	if h.myService == nil || !h.myService.IsRunning() {
+		fmt.Fprintln(os.Stderr, "EEBUS service did not start")
+		return testExitUsage
+	}
+	defer h.myService.Shutdown()
+	defer h.tracer.flush()
+
+	progress := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "[test] "+format+"\n", args...)
+	}
+
+	if *ski != "" {
+		if peer := h.getPeer(*ski); peer == nil || !peer.connected {
+			if err := h.pairSKI(*ski); err != nil {
+				progress("pairing %s refused: %v", *ski, err)
+				return testExitUsage
+			}
+		}
+	}
+	progress("waiting up to %s for the DUT to connect", *connectTimeout)
+	peer := h.waitForTestPeer(*ski, *connectTimeout)
+	if peer == nil {
+		progress("DUT did not connect within %s", *connectTimeout)
+		return testExitTimeout
+	}
+	progress("DUT %s connected", peer.ski)
+	// the DUT needs a moment to announce its use cases before it can be written
+	time.Sleep(5 * testPollInterval)
+
+	run, err := h.startTimeTest(req)
+	if err != nil {
+		progress("test not started: %v", err)
+		return testExitUsage
+	}
+	progress("%s started with %d cases", *plan, len(run.Cases))
+
+	deadline := time.Now().Add(*timeout)
+	reported := 0
+	for {
+		run = h.getTimeTest()
+		for ; reported < len(run.Cases) && (run.Cases[reported].Passed || run.Cases[reported].Error != ""); reported++ {
+			tc := run.Cases[reported]
+			verdict := "passed"
+			if !tc.Passed {
+				verdict = "failed: " + tc.Error
+			}
+			progress("case %d/%d (%gs) %s", reported+1, len(run.Cases), tc.DurationSeconds, verdict)
+		}
+		if !run.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			progress("test did not finish within %s", *timeout)
+			return testExitTimeout
+		}
+		time.Sleep(testPollInterval)
+	}
+
+	res := timeTestResult(run)
+	if run.ResultID != "" {
+		if stored, err := h.loadTestRun(run.ResultID); err == nil {
+			res = stored
+		}
+	}
+	res.Passed = run.Passed
+	if err := writeTestSummary(stdout, res, *output); err != nil {
+		progress("writing summary: %v", err)
+	}
+	if !res.Passed {
+		return testExitFailed
+	}
+	return testExitPassed
+}
+
+// waitForTestPeer waits for the DUT with the SKI, or any DUT without SKI, to connect
+func (h *hems) waitForTestPeer(ski string, timeout time.Duration) *peerData {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for key, peer := range h.getAllPeers() {
+			h.peersMu.Lock()
+			connected := peer.connected
+			h.peersMu.Unlock()
+			if connected && (ski == "" || strings.EqualFold(key, ski)) {
+				return peer
+			}
+		}
+		time.Sleep(testPollInterval)
+	}
+	return nil
+}
+
+// writeTestSummary prints the test result as JSON or as one line per assertion
+func writeTestSummary(w io.Writer, res *testRunResult, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	failed := 0
+	for _, a := range res.Assertions {
+		status := "PASS"
+		if !a.Passed {
+			status = "FAIL"
+			failed++
+		}
+		line := fmt.Sprintf("%s  %s", status, a.Name)
+		if a.Message != "" {
+			line += "  (" + a.Message + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	verdict := "PASSED"
+	if !res.Passed {
+		verdict = "FAILED"
+	}
+	_, err := fmt.Fprintf(w, "%s %s: %d/%d assertions passed\n", res.Plan, verdict, len(res.Assertions)-failed, len(res.Assertions))
+	return err
+}
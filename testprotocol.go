@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// testProtocolFormat identifies the layout of the exported protocol
+const testProtocolFormat = "eebus-device-tester/test-protocol/v1"
+
+// testProtocolTester identifies the tester that executed the tests
+type testProtocolTester struct {
+	Vendor     string `json:"vendor,omitempty"`
+	Brand      string `json:"brand,omitempty"`
+	DeviceName string `json:"deviceName,omitempty"`
+	SKI        string `json:"ski,omitempty"`
+}
+
+// testProtocolDevice identifies the device under test
+type testProtocolDevice struct {
+	testRunDevice
+	SKI string `json:"ski,omitempty"`
+	// Usecases are the use case declarations of the DUT in the latest run
+	Usecases map[string]bool `json:"usecases,omitempty"`
+}
+
+// testProtocolStep is a checked expectation of a scenario
+type testProtocolStep struct {
+	Number  int    `json:"number"`
+	Name    string `json:"name"`
+	Verdict string `json:"verdict"`
+	Message string `json:"message,omitempty"`
+	// ReactionTimeSeconds is the measured timing, e.g. until the DUT acknowledged a write
+	ReactionTimeSeconds *float64 `json:"reactionTimeSeconds,omitempty"`
+}
+
+// testProtocolScenario is a stored test run in the protocol
+type testProtocolScenario struct {
+	Number          int                `json:"number"`
+	RunID           string             `json:"runId"`
+	Plan            string             `json:"plan"`
+	StartedAt       time.Time          `json:"startedAt"`
+	EndedAt         time.Time          `json:"endedAt"`
+	DurationSeconds float64            `json:"durationSeconds"`
+	Verdict         string             `json:"verdict"`
+	Steps           []testProtocolStep `json:"steps"`
+	// Metadata was given at the start of the run
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// testProtocolSummary counts the scenario verdicts
+type testProtocolSummary struct {
+	Scenarios int `json:"scenarios"`
+	Passed    int `json:"passed"`
+	Failed    int `json:"failed"`
+}
+
+// testProtocol is the export of test results in the layout of certification protocol
+// templates: metadata, the device under test and one entry per scenario
+type testProtocol struct {
+	Format      string    `json:"format"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	Date        string    `json:"date"`
+	Operator    string    `json:"operator,omitempty"`
+	Laboratory  string    `json:"laboratory,omitempty"`
+	// Campaign lists the campaigns of the scenarios
+	Campaign  string                 `json:"campaign,omitempty"`
+	Tester    testProtocolTester     `json:"tester"`
+	Device    testProtocolDevice     `json:"device"`
+	Verdict   string                 `json:"verdict"`
+	Summary   testProtocolSummary    `json:"summary"`
+	Scenarios []testProtocolScenario `json:"scenarios"`
+	// Availability of the DUT from the start of the first to the end of the last scenario,
+	// unset when the tester did not see the DUT connected within that time
+	Availability *availabilityStats `json:"availability,omitempty"`
+}
+
+// testProtocolFilter selects the stored test runs of a protocol
+type testProtocolFilter struct {
+	IDs   []string
+	SKI   string
+	Plan  string
+	Since time.Time
+	// Campaign and Tag select by the metadata of the runs
+	Campaign string
+	Tag      string
+}
+
+func verdictOf(passed bool) string {
+	if passed {
+		return "passed"
+	}
+	return "failed"
+}
+
+// buildTestProtocol collects the selected test runs of a single DUT, oldest first. Without
+// an operator the operators stored with the runs are listed.
+func (h *hems) buildTestProtocol(f testProtocolFilter, operator, laboratory string) (*testProtocol, error) {
+	var runs []*testRunResult
+	if len(f.IDs) > 0 {
+		for _, id := range f.IDs {
+			res, err := h.loadTestRun(id)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", id, err)
+			}
+			runs = append(runs, res)
+		}
+	} else {
+		if f.SKI == "" {
+			return nil, errors.New("ids or ski required")
+		}
+		summaries, err := h.listTestRuns()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range summaries {
+			if s.SKI != f.SKI || (f.Plan != "" && s.Plan != f.Plan) || s.StartedAt.Before(f.Since) ||
+				!(testRunFilter{Campaign: f.Campaign, Tag: f.Tag}).matches(s) {
+				continue
+			}
+			res, err := h.loadTestRun(s.ID)
+			if err != nil {
+				return nil, err
+			}
+			runs = append(runs, res)
+		}
+	}
+	if len(runs) == 0 {
+		return nil, errors.New("no matching test runs")
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+	for _, res := range runs[1:] {
+		if res.SKI != runs[0].SKI {
+			return nil, fmt.Errorf("test runs of different devices (%s, %s)", runs[0].SKI, res.SKI)
+		}
+	}
+
+	latest := runs[len(runs)-1]
+	p := &testProtocol{
+		Format:      testProtocolFormat,
+		GeneratedAt: time.Now(),
+		Date:        runs[0].StartedAt.Format("2006-01-02"),
+		Operator:    operator,
+		Laboratory:  laboratory,
+		Device:      testProtocolDevice{testRunDevice: latest.Device, SKI: latest.SKI, Usecases: latest.Usecases},
+		Scenarios:   []testProtocolScenario{},
+	}
+	if h.config != nil {
+		p.Tester = testProtocolTester{Vendor: h.config.DeviceInfo.Vendor, Brand: h.config.DeviceInfo.Brand, DeviceName: h.config.DeviceInfo.DeviceName}
+	}
+	if h.myService != nil {
+		p.Tester.SKI = h.myService.LocalService().SKI()
+	}
+	for i, res := range runs {
+		sc := testProtocolScenario{
+			Number:          i + 1,
+			RunID:           res.ID,
+			Plan:            res.Plan,
+			StartedAt:       res.StartedAt,
+			EndedAt:         res.EndedAt,
+			DurationSeconds: res.EndedAt.Sub(res.StartedAt).Seconds(),
+			Verdict:         verdictOf(res.Passed),
+			Steps:           []testProtocolStep{},
+			Metadata:        res.Metadata,
+		}
+		for j, a := range res.Assertions {
+			sc.Steps = append(sc.Steps, testProtocolStep{
+				Number:              j + 1,
+				Name:                a.Name,
+				Verdict:             verdictOf(a.Passed),
+				Message:             a.Message,
+				ReactionTimeSeconds: a.DurationSeconds,
+			})
+		}
+		p.Scenarios = append(p.Scenarios, sc)
+		p.Summary.Scenarios++
+		if res.Passed {
+			p.Summary.Passed++
+		} else {
+			p.Summary.Failed++
+		}
+	}
+	p.Verdict = verdictOf(p.Summary.Failed == 0)
+	var operators, campaigns []string
+	for _, res := range runs {
+		if m := res.Metadata; m != nil {
+			if m.Operator != "" && !slices.Contains(operators, m.Operator) {
+				operators = append(operators, m.Operator)
+			}
+			if m.Campaign != "" && !slices.Contains(campaigns, m.Campaign) {
+				campaigns = append(campaigns, m.Campaign)
+			}
+		}
+	}
+	if p.Operator == "" {
+		p.Operator = strings.Join(operators, ", ")
+	}
+	p.Campaign = strings.Join(campaigns, ", ")
+	if a, ok := h.availabilityOf(latest.SKI, runs[0].StartedAt, latest.EndedAt); ok {
+		p.Availability = &a
+	}
+	return p, nil
+}
+
+// testProtocolCSVColumns are the columns of the CSV protocol, one row per step
+var testProtocolCSVColumns = []string{
+	"date", "operator", "laboratory", "tester_ski",
+	"dut_brand", "dut_model", "dut_serial", "dut_ski",
+	"scenario", "run_id", "plan", "started_at", "scenario_verdict",
+	"step", "assertion", "verdict", "reaction_time_s", "message",
+	"campaign", "firmware", "tags",
+}
+
+// writeTestProtocolCSV writes the protocol as flat rows that can be merged into documents
+func writeTestProtocolCSV(w io.Writer, p *testProtocol) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(testProtocolCSVColumns); err != nil {
+		return err
+	}
+	for _, sc := range p.Scenarios {
+		for _, st := range sc.Steps {
+			reaction := ""
+			meta := sc.Metadata
+			if meta == nil {
+				meta = &testRunMetadata{}
+			}
+			if st.ReactionTimeSeconds != nil {
+				reaction = strconv.FormatFloat(*st.ReactionTimeSeconds, 'f', 3, 64)
+			}
+			row := []string{
+				p.Date, p.Operator, p.Laboratory, p.Tester.SKI,
+				p.Device.Brand, p.Device.Model, p.Device.Serial, p.Device.SKI,
+				strconv.Itoa(sc.Number), sc.RunID, sc.Plan, formatTimestamp(sc.StartedAt), sc.Verdict,
+				strconv.Itoa(st.Number), st.Name, st.Verdict, reaction, strings.TrimSpace(st.Message),
+				meta.Campaign, meta.Firmware, strings.Join(meta.Tags, ";"),
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
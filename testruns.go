@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultTestRunDir is the directory finished test runs are stored in
+const defaultTestRunDir = "testruns"
+
+// Defaults of the timing regression detection of test run comparisons
+const (
+	defaultTimingRegressionPercent = 20
+	defaultTimingRegressionSeconds = 0.5
+)
+
+// TestRunsConfig configures the storage and comparison of test run results
+type TestRunsConfig struct {
+	// Dir is the directory results are stored in, defaults to testruns
+	Dir string `json:"dir,omitempty"`
+	// An assertion regressed when it takes TimingRegressionPercent longer than in the base
+	// run and at least TimingRegressionSeconds more, defaults 20 % and 0.5 s
+	TimingRegressionPercent float64 `json:"timingRegressionPercent,omitempty"`
+	TimingRegressionSeconds float64 `json:"timingRegressionSeconds,omitempty"`
+}
+
+func (c TestRunsConfig) dir() string {
+	if c.Dir == "" {
+		return defaultTestRunDir
+	}
+	return c.Dir
+}
+
+func (c TestRunsConfig) timingRegression() (percent, seconds float64) {
+	percent, seconds = defaultTimingRegressionPercent, defaultTimingRegressionSeconds
+	if c.TimingRegressionPercent > 0 {
+		percent = c.TimingRegressionPercent
+	}
+	if c.TimingRegressionSeconds > 0 {
+		seconds = c.TimingRegressionSeconds
+	}
+	return percent, seconds
+}
+
+// testAssertion is a single checked expectation of a test run
+type testAssertion struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+	// DurationSeconds is the measured timing of the assertion, e.g. the write round trip
+	DurationSeconds *float64 `json:"durationSeconds,omitempty"`
+}
+
+// testRunDevice identifies the DUT of a test run
+type testRunDevice struct {
+	DeviceName string `json:"deviceName,omitempty"`
+	Brand      string `json:"brand,omitempty"`
+	Model      string `json:"model,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+}
+
+// Limits of the tags of a test run
+const (
+	maxTestRunTags   = 20
+	maxTestRunTagLen = 64
+)
+
+// testRunMetadata is attached to a test run at start and stored with its result, so
+// results can be filtered and grouped by campaign
+type testRunMetadata struct {
+	// Operator defaults to the authenticated user
+	Operator string `json:"operator,omitempty"`
+	// Firmware defaults to the firmware of the DUT registry entry
+	Firmware string   `json:"firmware,omitempty"`
+	Campaign string   `json:"campaign,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// normalized trims the metadata, sorts the tags and drops duplicates, nil when nothing is set
+func (m *testRunMetadata) normalized() (*testRunMetadata, error) {
+	if m == nil {
+		return nil, nil
+	}
+	out := &testRunMetadata{
+		Operator: strings.TrimSpace(m.Operator),
+		Firmware: strings.TrimSpace(m.Firmware),
+		Campaign: strings.TrimSpace(m.Campaign),
+	}
+	for _, tag := range m.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || slices.Contains(out.Tags, tag) {
+			continue
+		}
+		if len(tag) > maxTestRunTagLen || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("invalid tag %q: at most %d characters and no commas", tag, maxTestRunTagLen)
+		}
+		out.Tags = append(out.Tags, tag)
+	}
+	if len(out.Tags) > maxTestRunTags {
+		return nil, fmt.Errorf("at most %d tags", maxTestRunTags)
+	}
+	sort.Strings(out.Tags)
+	if out.Operator == "" && out.Firmware == "" && out.Campaign == "" && len(out.Tags) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// newTestRunMetadata validates the metadata of a test start request, the operator
+// defaults to the authenticated user
+func (h *hems) newTestRunMetadata(r *http.Request, m *testRunMetadata) (*testRunMetadata, error) {
+	out := &testRunMetadata{}
+	if m != nil {
+		*out = *m
+	}
+	if strings.TrimSpace(out.Operator) == "" && h.config != nil && h.config.Auth.Enabled {
+		if user, ok := h.authenticate(r); ok {
+			out.Operator = user.Name
+		}
+	}
+	return out.normalized()
+}
+
+// testRunMetadataFromQuery reads the metadata of a test start from ?operator=, ?firmware=,
+// ?campaign= and the comma separated ?tags=
+func testRunMetadataFromQuery(q url.Values) *testRunMetadata {
+	m := &testRunMetadata{Operator: q.Get("operator"), Firmware: q.Get("firmware"), Campaign: q.Get("campaign")}
+	if v := q.Get("tags"); v != "" {
+		m.Tags = strings.Split(v, ",")
+	}
+	return m
+}
+
+// hasTag reports whether the metadata carries the tag
+func (m *testRunMetadata) hasTag(tag string) bool {
+	return m != nil && slices.Contains(m.Tags, tag)
+}
+
+// testRunResult is a stored result of a finished test run
+type testRunResult struct {
+	ID string `json:"id"`
+	// Plan names the test, results are only comparable for the same plan
+	Plan string `json:"plan"`
+	SKI  string `json:"ski,omitempty"`
+	// DUT is the registry entry of the SKI
+	DUT       string        `json:"dut,omitempty"`
+	Device    testRunDevice `json:"device"`
+	StartedAt time.Time     `json:"startedAt"`
+	EndedAt   time.Time     `json:"endedAt"`
+	Passed    bool          `json:"passed"`
+	// Usecases are the use case declarations of the DUT during the run
+	Usecases   map[string]bool `json:"usecases,omitempty"`
+	Assertions []testAssertion `json:"assertions"`
+	// Metadata was given at the start of the run
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// testRunSummary is the list entry of a stored test run
+type testRunSummary struct {
+	ID         string    `json:"id"`
+	Plan       string    `json:"plan"`
+	SKI        string    `json:"ski,omitempty"`
+	DUT        string    `json:"dut,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	Passed     bool      `json:"passed"`
+	Assertions int       `json:"assertions"`
+	Failed     int       `json:"failed"`
+	// Metadata was given at the start of the run
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// storeTestRun completes a finished test run with the DUT data and writes it to the result directory
+func (h *hems) storeTestRun(res *testRunResult) error {
+	res.ID = fmt.Sprintf("%s-%s", strings.ReplaceAll(res.Plan, "/", "-"), res.StartedAt.Format("20060102-150405"))
+	if peer := h.testRunPeer(res.SKI); peer != nil {
+		h.peersMu.Lock()
+		res.SKI = peer.ski
+		res.Device = testRunDevice{
+			DeviceName: peer.deviceName,
+			Brand:      peer.brand,
+			Model:      peer.model,
+			Serial:     peer.serial,
+			Identifier: peer.identifier,
+		}
+		res.Usecases = h.usecaseSupportOf(peer)
+		h.peersMu.Unlock()
+	}
+	res.DUT = h.dutForSKI(res.SKI)
+	if firmware := h.dutFirmware(res.DUT); firmware != "" && (res.Metadata == nil || res.Metadata.Firmware == "") {
+		if res.Metadata == nil {
+			res.Metadata = &testRunMetadata{}
+		}
+		res.Metadata.Firmware = firmware
+	}
+	res.Passed = true
+	var failed []string
+	for _, a := range res.Assertions {
+		if !a.Passed {
+			res.Passed = false
+			failed = append(failed, a.Name)
+		}
+	}
+
+	dir := h.config.TestRuns.dir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating test run directory: %w", err)
+	}
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, res.ID+".json"), b, 0644); err != nil {
+		return fmt.Errorf("writing test run: %w", err)
+	}
+
+	// the completion of a run is on the timeline for the notifiers
+	msg, severity := fmt.Sprintf("test run %s passed", res.ID), severityInfo
+	if !res.Passed {
+		msg, severity = fmt.Sprintf("test run %s failed: %d of %d assertions failed", res.ID, len(failed), len(res.Assertions)), severityError
+	}
+	data := map[string]interface{}{
+		"id":               res.ID,
+		"plan":             res.Plan,
+		"passed":           res.Passed,
+		"assertions":       len(res.Assertions),
+		"failed":           len(failed),
+		"failedAssertions": failed,
+	}
+	if res.Metadata != nil {
+		data["metadata"] = res.Metadata
+	}
+	h.recordEvent("testrun", severity, res.SKI, msg, data)
+	return nil
+}
+
+// testRunPeer returns the peer a test ran against, the only connected peer when no SKI was given
+func (h *hems) testRunPeer(ski string) *peerData {
+	if ski != "" {
+		return h.getPeer(ski)
+	}
+	var found *peerData
+	for _, peer := range h.getAllPeers() {
+		h.peersMu.Lock()
+		connected := peer.connected
+		h.peersMu.Unlock()
+		if connected {
+			if found != nil {
+				return nil
+			}
+			found = peer
+		}
+	}
+	return found
+}
+
+// loadTestRun reads a stored test run
+func (h *hems) loadTestRun(id string) (*testRunResult, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, errors.New("invalid test run id")
+	}
+	b, err := os.ReadFile(filepath.Join(h.config.TestRuns.dir(), id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	var res testRunResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("parsing test run %s: %w", id, err)
+	}
+	return &res, nil
+}
+
+// listTestRuns returns the stored test runs, newest first
+func (h *hems) listTestRuns() ([]testRunSummary, error) {
+	entries, err := os.ReadDir(h.config.TestRuns.dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []testRunSummary{}, nil
+		}
+		return nil, err
+	}
+	out := []testRunSummary{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		res, err := h.loadTestRun(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		out = append(out, summarizeTestRun(res))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out, nil
+}
+
+// testRunFilter selects stored test runs by DUT and metadata, empty fields match all
+type testRunFilter struct {
+	DUT      string
+	Campaign string
+	Tag      string
+	Operator string
+	Firmware string
+}
+
+func testRunFilterFromQuery(q url.Values) testRunFilter {
+	return testRunFilter{DUT: q.Get("dut"), Campaign: q.Get("campaign"), Tag: q.Get("tag"), Operator: q.Get("operator"), Firmware: q.Get("firmware")}
+}
+
+func (f testRunFilter) matches(s testRunSummary) bool {
+	m := s.Metadata
+	if m == nil {
+		m = &testRunMetadata{}
+	}
+	return (f.DUT == "" || s.DUT == f.DUT) &&
+		(f.Campaign == "" || m.Campaign == f.Campaign) &&
+		(f.Tag == "" || m.hasTag(f.Tag)) &&
+		(f.Operator == "" || m.Operator == f.Operator) &&
+		(f.Firmware == "" || m.Firmware == f.Firmware)
+}
+
+// filterTestRuns returns the runs matching the filter in their order
+func filterTestRuns(runs []testRunSummary, f testRunFilter) []testRunSummary {
+	out := []testRunSummary{}
+	for _, run := range runs {
+		if f.matches(run) {
+			out = append(out, run)
+		}
+	}
+	return out
+}
+
+// testRunCampaign groups the stored test runs of a campaign
+type testRunCampaign struct {
+	Campaign string    `json:"campaign"`
+	Runs     int       `json:"runs"`
+	Passed   int       `json:"passed"`
+	Failed   int       `json:"failed"`
+	FirstAt  time.Time `json:"firstAt"`
+	LastAt   time.Time `json:"lastAt"`
+	// DUTs, Plans, Operators, Firmware and Tags are the distinct values of the runs
+	DUTs      []string `json:"duts"`
+	Plans     []string `json:"plans"`
+	Operators []string `json:"operators"`
+	Firmware  []string `json:"firmware"`
+	Tags      []string `json:"tags"`
+}
+
+// groupTestRunCampaigns groups the runs with a campaign, the most recent campaign first
+func groupTestRunCampaigns(runs []testRunSummary) []testRunCampaign {
+	byName := map[string]*testRunCampaign{}
+	add := func(list []string, v string) []string {
+		if v == "" || slices.Contains(list, v) {
+			return list
+		}
+		return append(list, v)
+	}
+	for _, run := range runs {
+		if run.Metadata == nil || run.Metadata.Campaign == "" {
+			continue
+		}
+		c := byName[run.Metadata.Campaign]
+		if c == nil {
+			c = &testRunCampaign{Campaign: run.Metadata.Campaign, FirstAt: run.StartedAt, LastAt: run.StartedAt,
+				DUTs: []string{}, Plans: []string{}, Operators: []string{}, Firmware: []string{}, Tags: []string{}}
+			byName[c.Campaign] = c
+		}
+		c.Runs++
+		if run.Passed {
+			c.Passed++
+		} else {
+			c.Failed++
+		}
+		if run.StartedAt.Before(c.FirstAt) {
+			c.FirstAt = run.StartedAt
+		}
+		if run.StartedAt.After(c.LastAt) {
+			c.LastAt = run.StartedAt
+		}
+		dut := run.DUT
+		if dut == "" {
+			dut = run.SKI
+		}
+		c.DUTs = add(c.DUTs, dut)
+		c.Plans = add(c.Plans, run.Plan)
+		c.Operators = add(c.Operators, run.Metadata.Operator)
+		c.Firmware = add(c.Firmware, run.Metadata.Firmware)
+		for _, tag := range run.Metadata.Tags {
+			c.Tags = add(c.Tags, tag)
+		}
+	}
+	out := make([]testRunCampaign, 0, len(byName))
+	for _, c := range byName {
+		for _, list := range [][]string{c.DUTs, c.Plans, c.Operators, c.Firmware, c.Tags} {
+			sort.Strings(list)
+		}
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastAt.After(out[j].LastAt) })
+	return out
+}
+
+// assertionChange is an assertion whose verdict changed between two runs
+type assertionChange struct {
+	Name          string `json:"name"`
+	BaseMessage   string `json:"baseMessage,omitempty"`
+	TargetMessage string `json:"targetMessage,omitempty"`
+}
+
+// timingRegression is an assertion that became slower
+type timingRegression struct {
+	Name          string  `json:"name"`
+	BaseSeconds   float64 `json:"baseSeconds"`
+	TargetSeconds float64 `json:"targetSeconds"`
+	// IncreasePercent is the slowdown relative to the base run
+	IncreasePercent float64 `json:"increasePercent"`
+}
+
+// usecaseChange is a use case declaration that differs between two runs
+type usecaseChange struct {
+	Usecase string `json:"usecase"`
+	// Base and Target are unset when the DUT did not declare the use case at all
+	Base   *bool `json:"base,omitempty"`
+	Target *bool `json:"target,omitempty"`
+}
+
+// testRunComparison is the difference of a target run to a base run of the same plan
+type testRunComparison struct {
+	Plan              string             `json:"plan"`
+	Base              testRunSummary     `json:"base"`
+	Target            testRunSummary     `json:"target"`
+	BaseDevice        testRunDevice      `json:"baseDevice"`
+	TargetDevice      testRunDevice      `json:"targetDevice"`
+	NewlyFailing      []assertionChange  `json:"newlyFailing"`
+	NewlyPassing      []assertionChange  `json:"newlyPassing"`
+	Added             []string           `json:"added"`
+	Removed           []string           `json:"removed"`
+	TimingRegressions []timingRegression `json:"timingRegressions"`
+	UsecaseChanges    []usecaseChange    `json:"usecaseChanges"`
+	// Regressed is set when an assertion started failing or became slower
+	Regressed bool `json:"regressed"`
+}
+
+func summarizeTestRun(res *testRunResult) testRunSummary {
+	s := testRunSummary{ID: res.ID, Plan: res.Plan, SKI: res.SKI, DUT: res.DUT, StartedAt: res.StartedAt, Passed: res.Passed, Assertions: len(res.Assertions), Metadata: res.Metadata}
+	for _, a := range res.Assertions {
+		if !a.Passed {
+			s.Failed++
+		}
+	}
+	return s
+}
+
+// compareTestRuns compares two results of the same plan, assertions are matched by name
+func compareTestRuns(base, target *testRunResult, cfg TestRunsConfig) (*testRunComparison, error) {
+	if base.Plan != target.Plan {
+		return nil, fmt.Errorf("test runs use different plans (%s, %s)", base.Plan, target.Plan)
+	}
+	cmp := &testRunComparison{
+		Plan:              base.Plan,
+		Base:              summarizeTestRun(base),
+		Target:            summarizeTestRun(target),
+		BaseDevice:        base.Device,
+		TargetDevice:      target.Device,
+		NewlyFailing:      []assertionChange{},
+		NewlyPassing:      []assertionChange{},
+		Added:             []string{},
+		Removed:           []string{},
+		TimingRegressions: []timingRegression{},
+		UsecaseChanges:    []usecaseChange{},
+	}
+
+	baseByName := make(map[string]testAssertion, len(base.Assertions))
+	for _, a := range base.Assertions {
+		baseByName[a.Name] = a
+	}
+	percent, seconds := cfg.timingRegression()
+	seen := map[string]bool{}
+	for _, t := range target.Assertions {
+		seen[t.Name] = true
+		b, ok := baseByName[t.Name]
+		if !ok {
+			cmp.Added = append(cmp.Added, t.Name)
+			continue
+		}
+		change := assertionChange{Name: t.Name, BaseMessage: b.Message, TargetMessage: t.Message}
+		switch {
+		case b.Passed && !t.Passed:
+			cmp.NewlyFailing = append(cmp.NewlyFailing, change)
+		case !b.Passed && t.Passed:
+			cmp.NewlyPassing = append(cmp.NewlyPassing, change)
+		}
+		if b.DurationSeconds != nil && t.DurationSeconds != nil && *b.DurationSeconds > 0 {
+			increase := *t.DurationSeconds - *b.DurationSeconds
+			pct := increase / *b.DurationSeconds * 100
+			if increase >= seconds && pct >= percent {
+				cmp.TimingRegressions = append(cmp.TimingRegressions, timingRegression{
+					Name:            t.Name,
+					BaseSeconds:     *b.DurationSeconds,
+					TargetSeconds:   *t.DurationSeconds,
+					IncreasePercent: math.Round(pct*10) / 10,
+				})
+			}
+		}
+	}
+	for _, b := range base.Assertions {
+		if !seen[b.Name] {
+			cmp.Removed = append(cmp.Removed, b.Name)
+		}
+	}
+
+	usecases := map[string]bool{}
+	for uc := range base.Usecases {
+		usecases[uc] = true
+	}
+	for uc := range target.Usecases {
+		usecases[uc] = true
+	}
+	for uc := range usecases {
+		bv, bok := base.Usecases[uc]
+		tv, tok := target.Usecases[uc]
+		if bok == tok && bv == tv {
+			continue
+		}
+		change := usecaseChange{Usecase: uc}
+		if bok {
+			change.Base = &bv
+		}
+		if tok {
+			change.Target = &tv
+		}
+		cmp.UsecaseChanges = append(cmp.UsecaseChanges, change)
+	}
+	sort.Slice(cmp.UsecaseChanges, func(i, j int) bool { return cmp.UsecaseChanges[i].Usecase < cmp.UsecaseChanges[j].Usecase })
+
+	cmp.Regressed = len(cmp.NewlyFailing) > 0 || len(cmp.TimingRegressions) > 0
+	return cmp, nil
+}
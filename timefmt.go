@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timestampLayout is used for all timestamps in logs, API and websocket
+// messages: RFC3339 with millisecond precision and the numeric zone offset
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// formatTimestamp formats a time in the display timezone
+func formatTimestamp(t time.Time) string {
+	return t.In(time.Local).Format(timestampLayout)
+}
+
+// applyTimezone sets the display timezone for all timestamps.
+// An empty name keeps the system timezone, "UTC" and IANA names like
+// "Europe/Berlin" are supported.
+func applyTimezone(name string) error {
+	if name == "" || name == "Local" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", name, err)
+	}
+	// time.Now() and JSON encoding of time values use time.Local
+	time.Local = loc
+	return nil
+}
+
+// optionalTime returns nil for the zero time, so it is omitted in JSON
+// instead of being encoded as 0001-01-01T00:00:00Z
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// TimeoutsConfig configures how long to wait for SPINE responses of the remote device
+type TimeoutsConfig struct {
+	// WriteMs is the time to wait for the result of a write, defaults to 10000
+	WriteMs int `json:"writeMs,omitempty"`
+	// ReadMs is the time to wait for the reply to a read, defaults to 10000
+	ReadMs int `json:"readMs,omitempty"`
+}
+
+const defaultResponseTimeout = 10 * time.Second
+
+// errResponseTimeout is returned if the remote device did not answer in time
+var errResponseTimeout = errors.New("no response within timeout")
+
+func (h *hems) writeTimeout() time.Duration {
+	if h.config == nil || h.config.Timeouts.WriteMs <= 0 {
+		return defaultResponseTimeout
+	}
+	return time.Duration(h.config.Timeouts.WriteMs) * time.Millisecond
+}
+
+func (h *hems) readTimeout() time.Duration {
+	if h.config == nil || h.config.Timeouts.ReadMs <= 0 {
+		return defaultResponseTimeout
+	}
+	return time.Duration(h.config.Timeouts.ReadMs) * time.Millisecond
+}
+
+// responseCallbackFeature is implemented by the eebus-go client features
+type responseCallbackFeature interface {
+	AddResponseCallback(msgCounterReference model.MsgCounterType, function func(msg spineapi.ResponseMessage)) error
+}
+
+// awaitResponse waits for the reply or result to a sent read request.
+// It returns errResponseTimeout if nothing arrived within the read timeout.
+func (h *hems) awaitResponse(feature responseCallbackFeature, msgCounter *model.MsgCounterType) (spineapi.ResponseMessage, error) {
+	if msgCounter == nil {
+		return spineapi.ResponseMessage{}, errors.New("no message sent")
+	}
+
+	ch := make(chan spineapi.ResponseMessage, 1)
+	if err := feature.AddResponseCallback(*msgCounter, func(msg spineapi.ResponseMessage) {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}); err != nil {
+		return spineapi.ResponseMessage{}, err
+	}
+
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-time.After(h.readTimeout()):
+		return spineapi.ResponseMessage{}, errResponseTimeout
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Time test kinds
+const (
+	// timeTestDST writes a limit whose duration ends after the next DST change of the display timezone
+	timeTestDST = "dst"
+	// timeTestDurations writes limits with very short and very long durations
+	timeTestDurations = "durations"
+)
+
+// defaultTimeTestDurations are the limit durations of the durations test: the
+// shortest duration, values around minute/hour/day boundaries, 30 days and one year
+var defaultTimeTestDurations = []float64{1, 59, 61, 3599, 3601, 86400, 30 * 86400, 365 * 86400}
+
+// defaultTimeTestTolerance is the accepted difference between the expected and the read back remaining duration
+const defaultTimeTestTolerance = 5 * time.Second
+
+// timeTestSettle is the time the DUT gets to publish a written limit before it is read back
+const timeTestSettle = time.Second
+
+// timeTestRequest starts a time test
+type timeTestRequest struct {
+	Test string `json:"test"`
+	SKI  string `json:"ski,omitempty"`
+	// Value is the consumption limit in W written in every case
+	Value float64 `json:"value"`
+	// DurationsSeconds overrides the durations of the durations test
+	DurationsSeconds []float64 `json:"durationsSeconds,omitempty"`
+	ToleranceSeconds float64   `json:"toleranceSeconds,omitempty"`
+	// Restore deactivates the limit after the test, defaults to true
+	Restore *bool `json:"restore,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// timeTestCase is a single limit write of a time test and the read back duration
+type timeTestCase struct {
+	DurationSeconds float64      `json:"durationSeconds"`
+	EndsAt          time.Time    `json:"endsAt"`
+	Command         string       `json:"command,omitempty"`
+	State           commandState `json:"state,omitempty"`
+	Error           string       `json:"error,omitempty"`
+	// ExpectedSeconds is the remaining duration at read back time, ReadBackSeconds the one reported by the DUT
+	ExpectedSeconds  *float64 `json:"expectedSeconds,omitempty"`
+	ReadBackSeconds  *float64 `json:"readBackSeconds,omitempty"`
+	DeviationSeconds *float64 `json:"deviationSeconds,omitempty"`
+	// AckSeconds is the time from sending the write until the DUT acknowledged it
+	AckSeconds *float64 `json:"ackSeconds,omitempty"`
+	Passed     bool     `json:"passed"`
+}
+
+// timeTestRun is an active or finished time test
+type timeTestRun struct {
+	Test      string     `json:"test"`
+	SKI       string     `json:"ski,omitempty"`
+	Value     float64    `json:"value"`
+	Running   bool       `json:"running"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	Timezone  string     `json:"timezone"`
+	// DSTChange is the DST transition crossed by the dst test
+	DSTChange        *time.Time     `json:"dstChange,omitempty"`
+	ToleranceSeconds float64        `json:"toleranceSeconds"`
+	Cases            []timeTestCase `json:"cases"`
+	Passed           bool           `json:"passed"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// timeTestState holds the current or last time test
+type timeTestState struct {
+	mu  sync.Mutex
+	run *timeTestRun
+}
+
+// nextDSTChange returns the next change of the UTC offset of the location within a year
+func nextDSTChange(loc *time.Location, from time.Time) (time.Time, bool) {
+	_, offset := from.In(loc).Zone()
+	prev := from
+	for t := from.Add(time.Hour); t.Before(from.AddDate(1, 0, 0)); t = t.Add(time.Hour) {
+		if _, o := t.In(loc).Zone(); o != offset {
+			// narrow down to the second, transitions are not always at full hours
+			lo, hi := prev, t
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, o := mid.In(loc).Zone(); o == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			return hi.Truncate(time.Second), true
+		}
+		prev = t
+	}
+	return time.Time{}, false
+}
+
+// startTimeTest starts a time test in the background
+func (h *hems) startTimeTest(req timeTestRequest) (*timeTestRun, error) {
+	if h.uceglpc == nil {
+		return nil, errors.New("LPC usecase is disabled")
+	}
+	if req.Value < 0 {
+		return nil, errors.New("value must not be negative")
+	}
+	now := time.Now()
+	tolerance := defaultTimeTestTolerance
+	if req.ToleranceSeconds > 0 {
+		tolerance = time.Duration(req.ToleranceSeconds * float64(time.Second))
+	}
+	run := &timeTestRun{
+		Test:             req.Test,
+		SKI:              req.SKI,
+		Value:            req.Value,
+		Running:          true,
+		StartedAt:        now,
+		Timezone:         time.Local.String(),
+		ToleranceSeconds: tolerance.Seconds(),
+		Metadata:         req.Metadata,
+	}
+
+	var durations []float64
+	switch req.Test {
+	case timeTestDST:
+		change, ok := nextDSTChange(time.Local, now)
+		if !ok {
+			return nil, fmt.Errorf("timezone %s has no DST change within a year, configure e.g. \"timezone\": \"Europe/Berlin\"", time.Local)
+		}
+		run.DSTChange = &change
+		// end one hour after the change, so wall clock and elapsed time differ by the offset change
+		durations = []float64{math.Ceil(change.Add(time.Hour).Sub(now).Seconds())}
+	case timeTestDurations:
+		durations = defaultTimeTestDurations
+		if len(req.DurationsSeconds) > 0 {
+			durations = req.DurationsSeconds
+		}
+		for _, d := range durations {
+			if d <= 0 {
+				return nil, errors.New("durations must be positive")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown test %q, use %s or %s", req.Test, timeTestDST, timeTestDurations)
+	}
+	for _, d := range durations {
+		run.Cases = append(run.Cases, timeTestCase{DurationSeconds: d})
+	}
+
+	h.timeTests.mu.Lock()
+	if h.timeTests.run != nil && h.timeTests.run.Running {
+		h.timeTests.mu.Unlock()
+		return nil, errors.New("a time test is already running")
+	}
+	h.timeTests.run = run
+	snap := copyTimeTestRun(run)
+	h.timeTests.mu.Unlock()
+
+	restore := req.Restore == nil || *req.Restore
+	go h.runTimeTest(run, tolerance, restore)
+	h.recordEvent("timetest", severityInfo, req.SKI, "time test "+req.Test+" started", nil)
+	return snap, nil
+}
+
+// runTimeTest writes the limit of every case and compares the read back remaining duration
+func (h *hems) runTimeTest(run *timeTestRun, tolerance time.Duration, restore bool) {
+	span := h.tracer.startSpan("test time/"+run.Test, spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	for i := range run.Cases {
+		h.timeTests.mu.Lock()
+		tc := run.Cases[i]
+		h.timeTests.mu.Unlock()
+
+		step := span.startSpan(fmt.Sprintf("case %gs", tc.DurationSeconds), spanKindInternal, time.Now(), attr("test.case", i+1))
+		h.runTimeTestCase(run, &tc, tolerance)
+		step.setAttrs(attr("command.id", tc.Command), attr("test.passed", tc.Passed))
+		step.end(time.Now(), tc.Error)
+
+		h.timeTests.mu.Lock()
+		run.Cases[i] = tc
+		h.timeTests.mu.Unlock()
+		h.broadcastTimeTest()
+	}
+
+	if restore {
+		payload := map[string]interface{}{"ski": run.SKI, "value": run.Value, "isActive": false, "durationSeconds": 0}
+		if _, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+			return h.WriteLPCConsumptionLimit(run.SKI, 0, run.Value, false)
+		}); err != nil {
+			h.Errorf("time test: restore limit: %v", err)
+		}
+	}
+
+	now := time.Now()
+	h.timeTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Passed = true
+	for _, tc := range run.Cases {
+		if !tc.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := timeTestResult(run)
+	h.timeTests.mu.Unlock()
+	h.broadcastTimeTest()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("time test: %v", err)
+	} else {
+		h.timeTests.mu.Lock()
+		run.ResultID = result.ID
+		h.timeTests.mu.Unlock()
+	}
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("time test %s %s", run.Test, verdict)
+	h.recordEvent("timetest", severity, run.SKI, "time test "+run.Test+" "+verdict, nil)
+}
+
+func (h *hems) runTimeTestCase(run *timeTestRun, tc *timeTestCase, tolerance time.Duration) {
+	duration := time.Duration(tc.DurationSeconds * float64(time.Second))
+	payload := map[string]interface{}{"ski": run.SKI, "value": run.Value, "isActive": true, "durationSeconds": tc.DurationSeconds}
+	durationSeconds := int64(tc.DurationSeconds)
+	c, err := h.enqueueCommand("writeLPCConsumptionLimit", payload, nil, func() ([]sentMessage, error) {
+		return h.WriteLPCConsumptionLimit(run.SKI, durationSeconds, run.Value, true)
+	})
+	if err != nil {
+		tc.Error = err.Error()
+		return
+	}
+	tc.Command = c.ID
+	<-c.done
+	snap, _ := h.getCommand(c.ID)
+	tc.State = snap.State
+	// the DUT starts the duration when it receives the write
+	written := snap.UpdatedAt
+	if !snap.startedAt.IsZero() {
+		written = snap.startedAt
+	}
+	tc.EndsAt = written.Add(duration)
+	if !snap.startedAt.IsZero() {
+		ack := snap.UpdatedAt.Sub(snap.startedAt).Seconds()
+		tc.AckSeconds = &ack
+	}
+	if snap.State != commandAcknowledged {
+		tc.Error = snap.Error
+		return
+	}
+
+	time.Sleep(timeTestSettle)
+	readings, err := h.readLPC(run.SKI)
+	if err != nil {
+		tc.Error = "read back: " + err.Error()
+		return
+	}
+	if len(readings) == 0 || readings[0].ConsumptionLimit == nil {
+		tc.Error = "read back: no consumption limit reported"
+		return
+	}
+	readBack := readings[0].ConsumptionLimit.DurationSeconds
+	// short durations may have expired already
+	expected := math.Max(0, time.Until(tc.EndsAt).Seconds())
+	deviation := readBack - expected
+	tc.ReadBackSeconds = &readBack
+	tc.ExpectedSeconds = &expected
+	tc.DeviationSeconds = &deviation
+	tc.Passed = math.Abs(deviation) <= tolerance.Seconds()
+	if !tc.Passed {
+		tc.Error = fmt.Sprintf("remaining duration deviates by %.0f s", deviation)
+	}
+}
+
+// timeTestResult converts a finished time test to a stored test run, cases are
+// named by their duration so runs of the durations test can be compared
+func timeTestResult(run *timeTestRun) *testRunResult {
+	res := &testRunResult{Plan: "time/" + run.Test, SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	for _, tc := range run.Cases {
+		name := fmt.Sprintf("duration %gs", tc.DurationSeconds)
+		if run.Test == timeTestDST {
+			name = "limit across DST change"
+		}
+		res.Assertions = append(res.Assertions, testAssertion{
+			Name:            name,
+			Passed:          tc.Passed,
+			Message:         tc.Error,
+			DurationSeconds: tc.AckSeconds,
+		})
+	}
+	return res
+}
+
+func copyTimeTestRun(run *timeTestRun) *timeTestRun {
+	c := *run
+	c.Cases = append([]timeTestCase(nil), run.Cases...)
+	return &c
+}
+
+// getTimeTest returns a copy of the current or last time test
+func (h *hems) getTimeTest() *timeTestRun {
+	h.timeTests.mu.Lock()
+	defer h.timeTests.mu.Unlock()
+	if h.timeTests.run == nil {
+		return nil
+	}
+	return copyTimeTestRun(h.timeTests.run)
+}
+
+// broadcastTimeTest sends the progress of the time test to all websocket clients
+func (h *hems) broadcastTimeTest() {
+	run := h.getTimeTest()
+	if run == nil {
+		return
+	}
+	h.broadcastJSON(map[string]interface{}{
+		"type":     "timetest",
+		"ski":      run.SKI,
+		"timetest": run,
+	})
+}
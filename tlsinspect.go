@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/enbility/ship-go/cert"
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// tlsProbeTimeout bounds the dial and TLS handshake of a probe
+const tlsProbeTimeout = 10 * time.Second
+
+// tlsCertificateInfo describes a certificate of the chain presented by the DUT
+type tlsCertificateInfo struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	SerialNumber       string    `json:"serialNumber"`
+	NotBefore          time.Time `json:"notBefore"`
+	NotAfter           time.Time `json:"notAfter"`
+	SubjectKeyID       string    `json:"subjectKeyId,omitempty"`
+	PublicKey          string    `json:"publicKey"`
+	SignatureAlgorithm string    `json:"signatureAlgorithm"`
+	SHA256Fingerprint  string    `json:"sha256Fingerprint"`
+	SelfSigned         bool      `json:"selfSigned"`
+}
+
+// tlsConnectionInfo is the result of a TLS handshake with the SHIP server of a DUT
+type tlsConnectionInfo struct {
+	SKI       string    `json:"ski"`
+	Address   string    `json:"address"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// HandshakeSeconds is the time from dialing until the TLS handshake completed
+	HandshakeSeconds float64              `json:"handshakeSeconds,omitempty"`
+	Version          string               `json:"version,omitempty"`
+	CipherSuite      string               `json:"cipherSuite,omitempty"`
+	Curve            string               `json:"curve,omitempty"`
+	Certificates     []tlsCertificateInfo `json:"certificates"`
+	// Warnings are deviations from SHIP 9 and 12.1, e.g. legacy versions or a wrong key type
+	Warnings []string `json:"warnings"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// tlsInspector keeps the last TLS probe per SKI
+type tlsInspector struct {
+	mu     sync.Mutex
+	probes map[string]*tlsConnectionInfo
+}
+
+// getTLSInfo returns the last probe of a SKI, probing when there is none or refresh is set
+func (h *hems) getTLSInfo(ski string, refresh bool) (*tlsConnectionInfo, error) {
+	ski = shiputil.NormalizeSKI(ski)
+	if !refresh {
+		h.tlsInfo.mu.Lock()
+		info := h.tlsInfo.probes[ski]
+		h.tlsInfo.mu.Unlock()
+		if info != nil {
+			return info, nil
+		}
+	}
+	return h.probeTLS(ski)
+}
+
+// probeTLS performs a TLS handshake with the SHIP server of the DUT at the address of its
+// mDNS announcement. ship-go does not expose the TLS state of its connections, so the
+// probe uses a separate connection with the tester certificate and the SHIP cipher suites
+// and closes it without upgrading to a websocket.
+func (h *hems) probeTLS(ski string) (*tlsConnectionInfo, error) {
+	var address string
+	for _, a := range h.getMdnsAnnouncements(ski) {
+		if a.Removed || a.Port == 0 || len(a.Addresses) == 0 {
+			continue
+		}
+		address = net.JoinHostPort(a.Addresses[0], strconv.Itoa(int(a.Port)))
+		break
+	}
+	if address == "" {
+		return nil, errors.New("no mDNS announcement with an address for " + ski)
+	}
+
+	info := &tlsConnectionInfo{SKI: ski, Address: address, CheckedAt: time.Now(), Certificates: []tlsCertificateInfo{}, Warnings: []string{}}
+	dialer := &net.Dialer{Timeout: tlsProbeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{h.certificate},
+		// SHIP 12.1: all certificates are locally signed, legacy versions are accepted to
+		// report them
+		InsecureSkipVerify: true, // #nosec G402
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       cert.CipherSuites,
+	})
+	if err != nil {
+		info.Error = err.Error()
+		h.storeTLSInfo(info)
+		return info, nil
+	}
+	info.HandshakeSeconds = time.Since(info.CheckedAt).Seconds()
+	state := conn.ConnectionState()
+	_ = conn.Close()
+
+	info.Version = tls.VersionName(state.Version)
+	info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	if state.CurveID != 0 {
+		info.Curve = state.CurveID.String()
+	}
+	for _, c := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, certificateInfo(c))
+	}
+	info.Warnings = tlsWarnings(state, ski, info.CheckedAt)
+	h.storeTLSInfo(info)
+	return info, nil
+}
+
+func (h *hems) storeTLSInfo(info *tlsConnectionInfo) {
+	h.tlsInfo.mu.Lock()
+	if h.tlsInfo.probes == nil {
+		h.tlsInfo.probes = make(map[string]*tlsConnectionInfo)
+	}
+	h.tlsInfo.probes[info.SKI] = info
+	h.tlsInfo.mu.Unlock()
+
+	switch {
+	case info.Error != "":
+		h.recordEvent("tls", severityWarning, info.SKI, "TLS handshake with "+info.Address+" failed: "+info.Error, nil)
+	case len(info.Warnings) > 0:
+		h.recordEvent("tls", severityWarning, info.SKI, fmt.Sprintf("TLS of %s deviates from SHIP: %v", info.Address, info.Warnings),
+			map[string]interface{}{"version": info.Version, "cipherSuite": info.CipherSuite, "warnings": info.Warnings})
+	}
+}
+
+func certificateInfo(c *x509.Certificate) tlsCertificateInfo {
+	sum := sha256.Sum256(c.Raw)
+	info := tlsCertificateInfo{
+		Subject:            c.Subject.String(),
+		Issuer:             c.Issuer.String(),
+		SerialNumber:       c.SerialNumber.String(),
+		NotBefore:          c.NotBefore,
+		NotAfter:           c.NotAfter,
+		SignatureAlgorithm: c.SignatureAlgorithm.String(),
+		SHA256Fingerprint:  hex.EncodeToString(sum[:]),
+		SelfSigned:         c.CheckSignatureFrom(c) == nil,
+		PublicKey:          c.PublicKeyAlgorithm.String(),
+	}
+	if len(c.SubjectKeyId) > 0 {
+		info.SubjectKeyID = hex.EncodeToString(c.SubjectKeyId)
+	}
+	switch k := c.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		info.PublicKey += " " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		info.PublicKey += fmt.Sprintf(" %d bit", k.N.BitLen())
+	}
+	return info
+}
+
+// tlsWarnings lists the deviations of a handshake from SHIP 9 (TLS 1.2, the SHIP cipher
+// suites) and 12.1 (self-signed ECDSA P-256 certificate with a 20 byte SKI)
+func tlsWarnings(state tls.ConnectionState, ski string, now time.Time) []string {
+	warnings := []string{}
+	if state.Version < tls.VersionTLS12 {
+		warnings = append(warnings, "legacy TLS version "+tls.VersionName(state.Version)+", SHIP requires TLS 1.2")
+	}
+	if !slices.Contains(cert.CipherSuites, state.CipherSuite) {
+		warnings = append(warnings, "cipher suite "+tls.CipherSuiteName(state.CipherSuite)+" is not a SHIP cipher suite")
+	}
+	if state.CurveID != 0 && state.CurveID != tls.CurveP256 {
+		warnings = append(warnings, "key exchange uses "+state.CurveID.String()+", SHIP uses secp256r1")
+	}
+	if len(state.PeerCertificates) == 0 {
+		return append(warnings, "no certificate presented")
+	}
+	if len(state.PeerCertificates) > 1 {
+		warnings = append(warnings, fmt.Sprintf("chain of %d certificates, SHIP expects a single self-signed certificate", len(state.PeerCertificates)))
+	}
+	leaf := state.PeerCertificates[0]
+	if k, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || k.Curve.Params().Name != "P-256" {
+		warnings = append(warnings, "certificate key is not ECDSA P-256")
+	}
+	if leaf.CheckSignatureFrom(leaf) != nil {
+		warnings = append(warnings, "certificate is not self-signed")
+	}
+	if now.Before(leaf.NotBefore) {
+		warnings = append(warnings, "certificate is not valid before "+formatTimestamp(leaf.NotBefore))
+	}
+	if now.After(leaf.NotAfter) {
+		warnings = append(warnings, "certificate expired at "+formatTimestamp(leaf.NotAfter))
+	}
+	if certSKI, err := cert.SkiFromCertificate(leaf); err != nil {
+		warnings = append(warnings, err.Error())
+	} else if shiputil.NormalizeSKI(certSKI) != shiputil.NormalizeSKI(ski) {
+		warnings = append(warnings, "certificate SKI "+certSKI+" differs from the announced SKI")
+	}
+	return warnings
+}
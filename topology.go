@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os/exec"
+	"sort"
+	"strings"
+
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+// topologyNode is a device, entity or feature of the remote entity tree
+type topologyNode struct {
+	ID       string
+	Label    []string
+	Kind     string
+	Children []*topologyNode
+}
+
+func entityAddressString(e spineapi.EntityInterface) string {
+	if e == nil || e.Address() == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(e.Address().Entity))
+	for _, a := range e.Address().Entity {
+		parts = append(parts, fmt.Sprint(a))
+	}
+	return strings.Join(parts, ".")
+}
+
+// buildTopology builds the device/entity/feature tree of a peer with a stable
+// ordering, so exports of different firmware versions can be diffed
+func buildTopology(ski string, entities []spineapi.EntityRemoteInterface, withFunctions bool) *topologyNode {
+	root := &topologyNode{ID: "device", Kind: "device", Label: []string{"Device", ski}}
+
+	sorted := make([]spineapi.EntityRemoteInterface, 0, len(entities))
+	for _, e := range entities {
+		if e != nil {
+			sorted = append(sorted, e)
+		}
+	}
+	if len(sorted) > 0 {
+		if d := sorted[0].Device(); d != nil {
+			if d.Address() != nil {
+				root.Label = append(root.Label, string(*d.Address()))
+			}
+			if d.DeviceType() != nil {
+				root.Label = append(root.Label, string(*d.DeviceType()))
+			}
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareEntityAddress(sorted[i], sorted[j])
+	})
+
+	// entities are nested by their address, e.g. [1,1] is a child of [1]
+	nodes := make(map[string]*topologyNode)
+	for _, e := range sorted {
+		addr := entityAddressString(e)
+		node := &topologyNode{
+			ID:    "e" + strings.ReplaceAll(addr, ".", "_"),
+			Kind:  "entity",
+			Label: []string{"Entity [" + addr + "]", fmt.Sprint(e.EntityType())},
+		}
+		nodes[addr] = node
+
+		features := append([]spineapi.FeatureRemoteInterface(nil), e.Features()...)
+		sort.Slice(features, func(i, j int) bool {
+			return featureID(features[i]) < featureID(features[j])
+		})
+		for _, f := range features {
+			if f == nil {
+				continue
+			}
+			fn := &topologyNode{
+				ID:    fmt.Sprintf("%s_f%d", node.ID, featureID(f)),
+				Kind:  "feature",
+				Label: []string{fmt.Sprintf("%s (%s)", f.Type(), f.Role())},
+			}
+			if withFunctions {
+				functions := make([]string, 0, len(f.Operations()))
+				for fct, op := range f.Operations() {
+					functions = append(functions, fmt.Sprintf("%s %s", fct, op.String()))
+				}
+				sort.Strings(functions)
+				fn.Label = append(fn.Label, functions...)
+			}
+			node.Children = append(node.Children, fn)
+		}
+
+		parent := root
+		if i := strings.LastIndex(addr, "."); i > 0 {
+			if p, ok := nodes[addr[:i]]; ok {
+				parent = p
+			}
+		}
+		// entities are listed before the features of their parent entity
+		parent.Children = append(parent.Children, node)
+	}
+	return root
+}
+
+func featureID(f spineapi.FeatureRemoteInterface) uint {
+	if f.Address() == nil || f.Address().Feature == nil {
+		return 0
+	}
+	return uint(*f.Address().Feature)
+}
+
+func compareEntityAddress(a, b spineapi.EntityRemoteInterface) bool {
+	aa, ba := a.Address(), b.Address()
+	if aa == nil || ba == nil {
+		return aa == nil && ba != nil
+	}
+	for i := 0; i < len(aa.Entity) && i < len(ba.Entity); i++ {
+		if aa.Entity[i] != ba.Entity[i] {
+			return aa.Entity[i] < ba.Entity[i]
+		}
+	}
+	return len(aa.Entity) < len(ba.Entity)
+}
+
+// topologyDOT renders the tree in Graphviz DOT format
+func topologyDOT(root *topologyNode) []byte {
+	var b bytes.Buffer
+	b.WriteString("digraph eebus {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+
+	var walk func(n *topologyNode)
+	walk = func(n *topologyNode) {
+		shape, style := "box", "rounded"
+		switch n.Kind {
+		case "device":
+			shape, style = "box", "bold"
+		case "feature":
+			shape, style = "note", "solid"
+		}
+		escaped := make([]string, len(n.Label))
+		for i, l := range n.Label {
+			escaped[i] = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(l)
+		}
+		fmt.Fprintf(&b, "  %s [label=\"%s\", shape=%s, style=%s];\n", n.ID, strings.Join(escaped, `\n`), shape, style)
+		for _, c := range n.Children {
+			walk(c)
+			fmt.Fprintf(&b, "  %s -> %s;\n", n.ID, c.ID)
+		}
+	}
+	walk(root)
+
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// topologySVG renders the tree as SVG. Graphviz is used if installed, otherwise
+// a simple indented tree is drawn.
+func topologySVG(root *topologyNode) ([]byte, error) {
+	if path, err := exec.LookPath("dot"); err == nil {
+		cmd := exec.Command(path, "-Tsvg")
+		cmd.Stdin = bytes.NewReader(topologyDOT(root))
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("graphviz: %w", err)
+		}
+		return out, nil
+	}
+
+	const (
+		lineHeight = 14
+		indent     = 28
+		padding    = 6
+	)
+	type row struct {
+		node  *topologyNode
+		depth int
+	}
+	var rows []row
+	var walk func(n *topologyNode, depth int)
+	walk = func(n *topologyNode, depth int) {
+		rows = append(rows, row{n, depth})
+		for _, c := range n.Children {
+			walk(c, depth+1)
+		}
+	}
+	walk(root, 0)
+
+	var body bytes.Buffer
+	y, width := 10, 0
+	for _, r := range rows {
+		x := 10 + r.depth*indent
+		w := 0
+		for _, l := range r.node.Label {
+			if len(l) > w {
+				w = len(l)
+			}
+		}
+		w = w*7 + 2*padding
+		h := len(r.node.Label)*lineHeight + padding
+		fill := "#eef5ff"
+		switch r.node.Kind {
+		case "device":
+			fill = "#dde8d8"
+		case "feature":
+			fill = "#ffffff"
+		}
+		if r.depth > 0 {
+			fmt.Fprintf(&body, `<path d="M%d %d V%d H%d" fill="none" stroke="#999"/>`+"\n", x-indent/2, y-padding, y+h/2, x)
+		}
+		fmt.Fprintf(&body, `<rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="%s" stroke="#666"/>`+"\n", x, y, w, h, fill)
+		for i, l := range r.node.Label {
+			fmt.Fprintf(&body, `<text x="%d" y="%d">%s</text>`+"\n", x+padding, y+(i+1)*lineHeight, html.EscapeString(l))
+		}
+		if x+w > width {
+			width = x + w
+		}
+		y += h + padding
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="11">`+"\n", width+10, y+10)
+	b.Write(body.Bytes())
+	b.WriteString("</svg>\n")
+	return b.Bytes(), nil
+}
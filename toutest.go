@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the time-of-use charging test
+const (
+	defaultTouPlanTimeout   = 2 * time.Minute
+	defaultTouReplanTimeout = time.Minute
+	defaultTouTolerance     = 100.0
+	touPollInterval         = 500 * time.Millisecond
+)
+
+// defaultTouTariff is the tariff published first: expensive energy for the first two
+// hours and a reduced power limit in the second hour
+var defaultTouTariff = cevcTariff{
+	Incentives: []cevcSlot{
+		{DurationSeconds: 7200, Value: 0.35},
+		{DurationSeconds: 7200, Value: 0.15},
+		{DurationSeconds: 72000, Value: 0.30},
+	},
+	PowerLimits: []cevcSlot{
+		{DurationSeconds: 3600, Value: 11000},
+		{DurationSeconds: 3600, Value: 4200},
+		{DurationSeconds: 79200, Value: 11000},
+	},
+}
+
+// defaultTouReplanTariff replaces the first tariff mid-session: cheap energy right away
+// with a reduced power limit for the first hour
+var defaultTouReplanTariff = cevcTariff{
+	Incentives: []cevcSlot{
+		{DurationSeconds: 7200, Value: 0.15},
+		{DurationSeconds: 7200, Value: 0.35},
+		{DurationSeconds: 72000, Value: 0.30},
+	},
+	PowerLimits: []cevcSlot{
+		{DurationSeconds: 3600, Value: 3700},
+		{DurationSeconds: 82800, Value: 11000},
+	},
+}
+
+// touTestRequest starts a time-of-use charging test
+type touTestRequest struct {
+	SKI string `json:"ski"`
+	// Tariff is published first, Replan replaces it once the EV planned, both use the
+	// body format of PUT /api/usecases/cevc/tariff
+	Tariff *cevcTariff `json:"tariff,omitempty"`
+	Replan *cevcTariff `json:"replan,omitempty"`
+	// PlanTimeoutSeconds is the time the EV has for the first plan, defaults to 120
+	PlanTimeoutSeconds float64 `json:"planTimeoutSeconds,omitempty"`
+	// ReplanSeconds is the time the EV has to re-plan after the change, defaults to 60
+	ReplanSeconds float64 `json:"replanSeconds,omitempty"`
+	// ToleranceWatts is the accepted plan power above a sent power limit, defaults to 100
+	ToleranceWatts float64 `json:"toleranceWatts,omitempty"`
+	// Restore publishes the tariff active before the test at the end, defaults to true
+	Restore *bool `json:"restore,omitempty"`
+	// Metadata is stored with the result
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// touStage is a published tariff and the charge plan the EV answered with
+type touStage struct {
+	Name           string     `json:"name"`
+	TimeoutSeconds float64    `json:"timeoutSeconds"`
+	PublishedAt    *time.Time `json:"publishedAt,omitempty"`
+	// Revision is the charge plan revision received after the publish
+	Revision       int        `json:"revision,omitempty"`
+	PlanReceivedAt *time.Time `json:"planReceivedAt,omitempty"`
+	// PlanSeconds is the time from the publish until the plan was received
+	PlanSeconds *float64 `json:"planSeconds,omitempty"`
+	Slots       int      `json:"slots"`
+	// Excess lists the plan slots above the sent power limits plus the tolerance
+	Excess []planExcess `json:"excess,omitempty"`
+	Passed bool         `json:"passed"`
+	Error  string       `json:"error,omitempty"`
+
+	tariff *cevcTariff
+}
+
+// touTestRun is an active or finished time-of-use charging test
+type touTestRun struct {
+	SKI            string     `json:"ski"`
+	Running        bool       `json:"running"`
+	StartedAt      time.Time  `json:"startedAt"`
+	EndedAt        *time.Time `json:"endedAt,omitempty"`
+	ToleranceWatts float64    `json:"toleranceWatts"`
+	Stages         []touStage `json:"stages"`
+	// Plan is the last charge plan received during the test
+	Plan   *cevcPlan `json:"plan,omitempty"`
+	Passed bool      `json:"passed"`
+	Error  string    `json:"error,omitempty"`
+	// ResultID is the stored test run of the finished test
+	ResultID string           `json:"resultId,omitempty"`
+	Metadata *testRunMetadata `json:"metadata,omitempty"`
+}
+
+// touTestState holds the current or last time-of-use test
+type touTestState struct {
+	mu  sync.Mutex
+	run *touTestRun
+}
+
+// startTouTest starts a time-of-use charging test in the background
+func (h *hems) startTouTest(req touTestRequest) (*touTestRun, error) {
+	if h.uccemcevc == nil {
+		return nil, errors.New("CEVC usecase is disabled")
+	}
+	if req.SKI == "" {
+		return nil, errors.New("ski is required")
+	}
+	if req.PlanTimeoutSeconds < 0 || req.ReplanSeconds < 0 || req.ToleranceWatts < 0 {
+		return nil, errors.New("durations and tolerances must not be negative")
+	}
+	if len(remoteEntities(h.uccemcevc.RemoteEntitiesScenarios(), req.SKI)) == 0 {
+		return nil, errors.New("no CEVC entity of the DUT, an EV has to be connected")
+	}
+	first, replan := defaultTouTariff, defaultTouReplanTariff
+	if req.Tariff != nil {
+		first = *req.Tariff
+	}
+	if req.Replan != nil {
+		replan = *req.Replan
+	}
+	if err := first.validate(); err != nil {
+		return nil, fmt.Errorf("tariff: %w", err)
+	}
+	if err := replan.validate(); err != nil {
+		return nil, fmt.Errorf("replan: %w", err)
+	}
+	run := &touTestRun{
+		SKI:            req.SKI,
+		Running:        true,
+		StartedAt:      time.Now(),
+		ToleranceWatts: defaultTouTolerance,
+		Stages: []touStage{
+			{Name: "plan", TimeoutSeconds: secondsOr(req.PlanTimeoutSeconds, defaultTouPlanTimeout).Seconds(), tariff: &first},
+			{Name: "replan", TimeoutSeconds: secondsOr(req.ReplanSeconds, defaultTouReplanTimeout).Seconds(), tariff: &replan},
+		},
+		Metadata: req.Metadata,
+	}
+	if req.ToleranceWatts > 0 {
+		run.ToleranceWatts = req.ToleranceWatts
+	}
+
+	h.touTests.mu.Lock()
+	if h.touTests.run != nil && h.touTests.run.Running {
+		h.touTests.mu.Unlock()
+		return nil, errors.New("a time-of-use test is already running")
+	}
+	h.touTests.run = run
+	snap := copyTouTestRun(run)
+	h.touTests.mu.Unlock()
+
+	restore := req.Restore == nil || *req.Restore
+	go h.runTouTest(run, restore)
+	h.recordEvent("toutest", severityInfo, req.SKI, "time-of-use test started", nil)
+	return snap, nil
+}
+
+// runTouTest publishes the tariffs one after the other and checks the plan of the EV
+func (h *hems) runTouTest(run *touTestRun, restore bool) {
+	span := h.tracer.startSpan("test tou/cevc", spanKindInternal, nil, run.StartedAt, attr("eebus.remote.ski", run.SKI))
+	previous := h.getTariff()
+
+	errText := ""
+	for i := range run.Stages {
+		h.touTests.mu.Lock()
+		st := run.Stages[i]
+		h.touTests.mu.Unlock()
+
+		step := span.startSpan(st.Name, spanKindInternal, time.Now(), attr("test.case", i+1))
+		h.runTouStage(run, i, &st)
+		step.setAttrs(attr("plan.revision", st.Revision), attr("test.passed", st.Passed))
+		step.end(time.Now(), st.Error)
+
+		h.touTests.mu.Lock()
+		run.Stages[i] = st
+		h.touTests.mu.Unlock()
+		h.broadcastTouTest()
+		if st.PlanReceivedAt == nil {
+			// without a plan there is nothing to re-plan
+			break
+		}
+	}
+
+	if restore {
+		if _, err := h.setTariff(previous.Tariff, run.SKI); err != nil {
+			errText = "restore tariff: " + err.Error()
+		} else if previous.Source == "file" {
+			h.tariffs.mu.Lock()
+			h.tariffs.source = previous.Source
+			h.tariffs.mu.Unlock()
+		}
+	}
+
+	now := time.Now()
+	h.touTests.mu.Lock()
+	run.Running = false
+	run.EndedAt = &now
+	run.Error = errText
+	run.Passed = errText == ""
+	for _, st := range run.Stages {
+		if !st.Passed {
+			run.Passed = false
+		}
+	}
+	passed := run.Passed
+	result := touTestResult(run)
+	h.touTests.mu.Unlock()
+	if err := h.storeTestRun(result); err != nil {
+		h.Errorf("time-of-use test: %v", err)
+	} else {
+		h.touTests.mu.Lock()
+		run.ResultID = result.ID
+		h.touTests.mu.Unlock()
+	}
+	h.broadcastTouTest()
+
+	verdict, severity, spanErr := "passed", severityInfo, ""
+	if !passed {
+		verdict, severity, spanErr = "failed", severityWarning, "test failed"
+		if errText != "" {
+			spanErr = errText
+		}
+	}
+	span.setAttrs(attr("test.passed", passed), attr("test.result", result.ID))
+	span.end(now, spanErr)
+	h.Infof("time-of-use test %s", verdict)
+	h.recordEvent("toutest", severity, run.SKI, "time-of-use test "+verdict, nil)
+}
+
+// runTouStage publishes the tariff of a stage and waits for the next charge plan
+func (h *hems) runTouStage(run *touTestRun, index int, st *touStage) {
+	revision := 0
+	if p := h.getChargePlan(run.SKI); p != nil {
+		revision = p.Revision
+	}
+
+	published := time.Now()
+	status, err := h.setTariff(st.tariff, run.SKI)
+	st.PublishedAt = &published
+	h.touTests.mu.Lock()
+	run.Stages[index] = *st
+	h.touTests.mu.Unlock()
+	h.broadcastTouTest()
+	if err != nil {
+		st.Error = "publish tariff: " + err.Error()
+		return
+	}
+	var writeErrors []string
+	for _, res := range status.Results {
+		for name, e := range res.Errors {
+			writeErrors = append(writeErrors, name+": "+e)
+		}
+	}
+	if len(writeErrors) > 0 {
+		sort.Strings(writeErrors)
+		st.Error = "publish tariff: " + strings.Join(writeErrors, "; ")
+		return
+	}
+
+	deadline := published.Add(time.Duration(st.TimeoutSeconds * float64(time.Second)))
+	var plan *cevcPlan
+	for {
+		if p := h.getChargePlan(run.SKI); p != nil && p.Revision > revision && p.ReceivedAt != nil {
+			plan = p
+			break
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(touPollInterval)
+	}
+	if plan == nil {
+		st.Error = fmt.Sprintf("no charge plan received within %.0f s", st.TimeoutSeconds)
+		return
+	}
+
+	h.touTests.mu.Lock()
+	run.Plan = plan
+	h.touTests.mu.Unlock()
+	st.Revision = plan.Revision
+	st.PlanReceivedAt = plan.ReceivedAt
+	latency := plan.ReceivedAt.Sub(published).Seconds()
+	st.PlanSeconds = &latency
+	st.Slots = len(plan.Slots)
+	for _, e := range plan.Excess {
+		if e.PowerW-e.LimitW > run.ToleranceWatts {
+			st.Excess = append(st.Excess, e)
+		}
+	}
+	switch {
+	case st.Slots == 0:
+		st.Error = "the charge plan has no slots"
+	case plan.Sent == nil || plan.Sent.SentAt.Before(published):
+		st.Error = "the power limits were not sent to the EV"
+	case len(st.Excess) > 0:
+		e := st.Excess[0]
+		st.Error = fmt.Sprintf("%d plan slots above the power limit, slot %d plans %.0f W at a limit of %.0f W", len(st.Excess), e.Slot+1, e.PowerW, e.LimitW)
+	default:
+		st.Passed = true
+	}
+}
+
+// touTestResult converts a finished time-of-use test to a stored test run
+func touTestResult(run *touTestRun) *testRunResult {
+	res := &testRunResult{Plan: "tou/cevc", SKI: run.SKI, StartedAt: run.StartedAt, Metadata: run.Metadata}
+	if run.EndedAt != nil {
+		res.EndedAt = *run.EndedAt
+	}
+	for _, st := range run.Stages {
+		msg := st.Error
+		if msg == "" && st.PublishedAt == nil {
+			msg = "not run"
+		}
+		res.Assertions = append(res.Assertions, testAssertion{
+			Name:            fmt.Sprintf("%s within %.0f s and power limits", st.Name, st.TimeoutSeconds),
+			Passed:          st.Passed,
+			Message:         msg,
+			DurationSeconds: st.PlanSeconds,
+		})
+	}
+	if run.Error != "" {
+		res.Assertions = append(res.Assertions, testAssertion{Name: "test completed", Message: run.Error})
+	}
+	return res
+}
+
+func copyTouTestRun(run *touTestRun) *touTestRun {
+	c := *run
+	c.Stages = append([]touStage(nil), run.Stages...)
+	return &c
+}
+
+// getTouTest returns a copy of the current or last time-of-use test
+func (h *hems) getTouTest() *touTestRun {
+	h.touTests.mu.Lock()
+	defer h.touTests.mu.Unlock()
+	if h.touTests.run == nil {
+		return nil
+	}
+	return copyTouTestRun(h.touTests.run)
+}
+
+// broadcastTouTest sends the progress of the time-of-use test to all websocket clients
+func (h *hems) broadcastTouTest() {
+	run := h.getTouTest()
+	if run == nil {
+		return
+	}
+	h.broadcastJSON(map[string]interface{}{
+		"type":    "toutest",
+		"ski":     run.SKI,
+		"toutest": run,
+	})
+}
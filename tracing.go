@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the OTLP span export
+const (
+	defaultTracingServiceName = "eebus-device-tester"
+	defaultTracingFlush       = 5 * time.Second
+	// maxBufferedSpans is the number of spans kept while the collector is unreachable
+	maxBufferedSpans = 4096
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOk    = 1
+	spanStatusError = 2
+)
+
+// TracingConfig configures the export of OpenTelemetry spans via OTLP/HTTP (JSON encoding)
+type TracingConfig struct {
+	// Endpoint is the base URL of the collector, e.g. http://localhost:4318, tracing is off without it
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export, e.g. an authorization header
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is the service.name resource attribute, defaults to eebus-device-tester
+	ServiceName string `json:"serviceName,omitempty"`
+	// FlushSeconds is the export interval, defaults to 5
+	FlushSeconds float64 `json:"flushSeconds,omitempty"`
+}
+
+func (c TracingConfig) serviceName() string {
+	if c.ServiceName == "" {
+		return defaultTracingServiceName
+	}
+	return c.ServiceName
+}
+
+func (c TracingConfig) flushInterval() time.Duration {
+	if c.FlushSeconds <= 0 {
+		return defaultTracingFlush
+	}
+	return time.Duration(c.FlushSeconds * float64(time.Second))
+}
+
+// spanAttr is a span attribute, values are strings, bools, integers or floats
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+func attr(key string, value interface{}) spanAttr {
+	return spanAttr{key: key, value: value}
+}
+
+// traceSpan is a span in progress. All methods accept a nil span, which is what
+// startSpan returns while tracing is disabled.
+type traceSpan struct {
+	t        *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	mu       sync.Mutex
+	attrs    []spanAttr
+}
+
+// finishedSpan is a span waiting for export
+type finishedSpan struct {
+	traceID, spanID, parentID string
+	name                      string
+	kind                      int
+	start, end                time.Time
+	attrs                     []spanAttr
+	status                    int
+	message                   string
+}
+
+// tracer buffers finished spans and exports them periodically
+type tracer struct {
+	cfg      TracingConfig
+	h        *hems
+	resource []spanAttr
+
+	mu      sync.Mutex
+	spans   []finishedSpan
+	dropped int
+	// failing suppresses repeated export errors until an export succeeds again
+	failing bool
+}
+
+// newTracer returns nil when no endpoint is configured
+func newTracer(h *hems, cfg TracingConfig, localSKI string) *tracer {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		cfg: cfg,
+		h:   h,
+		resource: []spanAttr{
+			attr("service.name", cfg.serviceName()),
+			attr("service.instance.id", localSKI),
+			attr("eebus.ski", localSKI),
+		},
+	}
+	go func() {
+		for range time.Tick(t.cfg.flushInterval()) {
+			t.flush()
+		}
+	}()
+	return t
+}
+
+// startSpan starts a root span, or a child span when parent is set
+func (t *tracer) startSpan(name string, kind int, parent *traceSpan, start time.Time, attrs ...spanAttr) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	s := &traceSpan{t: t, name: name, kind: kind, start: start, attrs: attrs}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return s
+}
+
+// startSpan of a span starts a child span
+func (s *traceSpan) startSpan(name string, kind int, start time.Time, attrs ...spanAttr) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	return s.t.startSpan(name, kind, s, start, attrs...)
+}
+
+func (s *traceSpan) setAttrs(attrs ...spanAttr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// end finishes the span, a non-empty errText sets the error status
+func (s *traceSpan) end(at time.Time, errText string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	fs := finishedSpan{
+		traceID: hex.EncodeToString(s.traceID[:]),
+		spanID:  hex.EncodeToString(s.spanID[:]),
+		name:    s.name,
+		kind:    s.kind,
+		start:   s.start,
+		end:     at,
+		attrs:   append([]spanAttr(nil), s.attrs...),
+		status:  spanStatusOk,
+	}
+	s.mu.Unlock()
+	if s.parentID != [8]byte{} {
+		fs.parentID = hex.EncodeToString(s.parentID[:])
+	}
+	if errText != "" {
+		fs.status, fs.message = spanStatusError, errText
+	}
+
+	t := s.t
+	t.mu.Lock()
+	t.spans = append(t.spans, fs)
+	if len(t.spans) > maxBufferedSpans {
+		t.dropped += len(t.spans) - maxBufferedSpans
+		t.spans = t.spans[len(t.spans)-maxBufferedSpans:]
+	}
+	t.mu.Unlock()
+}
+
+// flush exports the buffered spans. Spans of a failed export are kept for the next one.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	dropped := t.dropped
+	t.dropped = 0
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if dropped > 0 {
+		t.h.Errorf("tracing: %d spans dropped, the collector is not keeping up", dropped)
+	}
+
+	err := t.export(spans)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.spans = append(spans, t.spans...)
+		if len(t.spans) > maxBufferedSpans {
+			t.dropped += len(t.spans) - maxBufferedSpans
+			t.spans = t.spans[len(t.spans)-maxBufferedSpans:]
+		}
+		if !t.failing {
+			t.h.Errorf("tracing: export to %s: %v", t.cfg.Endpoint, err)
+		}
+		t.failing = true
+		return
+	}
+	t.failing = false
+}
+
+func (t *tracer) export(spans []finishedSpan) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+			"status":            map[string]interface{}{"code": s.status, "message": s.message},
+		}
+		if s.parentID != "" {
+			span["parentSpanId"] = s.parentID
+		}
+		otlpSpans = append(otlpSpans, span)
+	}
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(t.resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "device-tester"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(t.cfg.Endpoint, "/")+"/v1/traces", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpAttributes encodes attributes as OTLP AnyValues
+func otlpAttributes(attrs []spanAttr) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch val := a.value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": val}
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(val)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case uint64:
+			v = map[string]interface{}{"intValue": strconv.FormatUint(val, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		out = append(out, map[string]interface{}{"key": a.key, "value": v})
+	}
+	return out
+}
+
+// traceHandshake exports a finished connection setup as a span with one child per phase,
+// the detailed discovery phase is the SPINE discovery of the DUT
+func (h *hems) traceHandshake(run *handshakeRun) {
+	if h.tracer == nil {
+		return
+	}
+	kind := spanKindServer
+	if run.Direction == "outgoing" {
+		kind = spanKindClient
+	}
+	end := run.StartedAt.Add(time.Duration(run.TotalMs * float64(time.Millisecond)))
+	root := h.tracer.startSpan("ship.connect", kind, nil, run.StartedAt,
+		attr("eebus.remote.ski", run.SKI), attr("ship.direction", run.Direction), attr("ship.state", run.State))
+	for _, p := range run.Phases {
+		name := "ship." + p.Name
+		if p.Name == phaseDetailedDiscovery {
+			name = "spine.detailedDiscovery"
+		}
+		phase := root.startSpan(name, spanKindInternal, p.StartedAt)
+		phaseEnd := p.StartedAt.Add(time.Duration(p.DurationMs * float64(time.Millisecond)))
+		errText := ""
+		// the failure happened in the last phase reached
+		if run.Error != "" && p.Name == run.Phases[len(run.Phases)-1].Name {
+			errText = run.Error
+		}
+		phase.end(phaseEnd, errText)
+	}
+	root.end(end, run.Error)
+}
+
+// traceCommand exports a finished write command as a span with one child per attempt,
+// the SPINE message counters allow matching the DUT side of the write
+func (h *hems) traceCommand(c command) {
+	if h.tracer == nil {
+		return
+	}
+	root := h.tracer.startSpan("write "+c.Cmd, spanKindClient, nil, c.CreatedAt,
+		attr("command.id", c.ID), attr("command.state", string(c.State)), attr("eebus.remote.ski", c.ski))
+	if v, ok := c.Payload["value"]; ok {
+		root.setAttrs(attr("limit.value", v))
+	}
+	if v, ok := c.Payload["durationSeconds"]; ok {
+		root.setAttrs(attr("limit.durationSeconds", v))
+	}
+	if v, ok := c.Payload["isActive"]; ok {
+		root.setAttrs(attr("limit.active", v))
+	}
+	for _, a := range c.Attempts {
+		span := root.startSpan(fmt.Sprintf("write attempt %d", a.Attempt), spanKindClient, a.StartedAt,
+			attr("command.state", string(a.State)))
+		counters := make([]string, 0, len(a.Messages))
+		for _, m := range a.Messages {
+			if !m.wasSent() {
+				span.setAttrs(attr("eebus.entity.error", m.Entity+": "+m.Error))
+				continue
+			}
+			counters = append(counters, strconv.FormatUint(m.MsgCounter, 10))
+			if m.ErrorNumber != nil {
+				span.setAttrs(attr("spine.errorNumber", int(*m.ErrorNumber)))
+			}
+		}
+		if len(counters) > 0 {
+			span.setAttrs(attr("spine.msgCounter", strings.Join(counters, ",")))
+		}
+		span.end(a.EndedAt, a.Error)
+	}
+	errText := ""
+	if c.State != commandAcknowledged {
+		errText = c.Error
+		if errText == "" {
+			errText = string(c.State)
+		}
+	}
+	root.end(c.UpdatedAt, errText)
+}
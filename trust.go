@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// skiListPollInterval is the interval the SKI list file is checked for changes
+const skiListPollInterval = 2 * time.Second
+
+// TrustConfig configures how incoming pairing requests are trusted
+type TrustConfig struct {
+	// AutoAccept lists SKIs whose incoming pairing requests are accepted automatically,
+	// "*" accepts any SKI (closed lab networks only)
+	AutoAccept []string `json:"autoAccept,omitempty"`
+	// SkiListFile is a JSON file with "allow" and "deny" SKI lists, reloaded when it changes
+	SkiListFile string `json:"skiListFile,omitempty"`
+	// ShipIDFile keeps the SHIP IDs of paired services across restarts, defaults to shipids.json
+	ShipIDFile string `json:"shipIdFile,omitempty"`
+	// Prompt asks the operator to accept or reject pairing requests of other SKIs
+	Prompt *TrustPromptConfig `json:"prompt,omitempty"`
+}
+
+// skiList is the content of the SKI list file. Deny entries win, a non-empty
+// allow list only permits the listed SKIs.
+type skiList struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// acceptsAny reports if every incoming pairing request is accepted
+func (c TrustConfig) acceptsAny() bool {
+	for _, ski := range c.AutoAccept {
+		if ski == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// autoAccepts reports if the pairing request of the SKI is accepted without user interaction
+func (c TrustConfig) autoAccepts(ski string) bool {
+	ski = shiputil.NormalizeSKI(ski)
+	for _, entry := range c.AutoAccept {
+		if entry == "*" || shiputil.NormalizeSKI(entry) == ski {
+			return true
+		}
+	}
+	return false
+}
+
+// trustState tracks the trust decisions of the tester
+type trustState struct {
+	mu sync.Mutex
+	// autoAccepted holds the SKIs that were trusted by the auto accept configuration
+	autoAccepted map[string]bool
+
+	allow     map[string]bool
+	deny      map[string]bool
+	listMod   time.Time
+	listLoad  time.Time
+	listError string
+}
+
+func newTrustState() *trustState {
+	return &trustState{
+		autoAccepted: make(map[string]bool),
+		allow:        make(map[string]bool),
+		deny:         make(map[string]bool),
+	}
+}
+
+// setupTrust applies the trust configuration to the service
+func (h *hems) setupTrust() {
+	if h.config.Trust.acceptsAny() {
+		// ship-go skips the trust wait and announces register=true via mDNS
+		h.myService.SetAutoAccept(true)
+		h.Infof("Auto accept enabled for all incoming pairing requests")
+	} else if len(h.config.Trust.AutoAccept) > 0 {
+		h.Infof("Auto accept enabled for %d SKIs", len(h.config.Trust.AutoAccept))
+	}
+	if h.config.Trust.SkiListFile != "" {
+		h.loadSkiList(true)
+		go h.watchSkiList()
+	}
+}
+
+// autoAcceptTrust trusts a remote service waiting for trust if it is configured for auto accept.
+// It returns true if the pairing request was accepted.
+func (h *hems) autoAcceptTrust(ski string) bool {
+	if h.config == nil || !h.config.Trust.autoAccepts(ski) {
+		return false
+	}
+	if ok, _ := h.skiPermitted(ski); !ok {
+		return false
+	}
+	ski = shiputil.NormalizeSKI(ski)
+
+	h.trust.mu.Lock()
+	done := h.trust.autoAccepted[ski]
+	h.trust.autoAccepted[ski] = true
+	h.trust.mu.Unlock()
+	if done {
+		return true
+	}
+
+	h.Infof("Auto accepting pairing request of %s", ski)
+	h.recordEvent("trust", severityInfo, ski, "pairing request accepted automatically", nil)
+	// called from within the SHIP handshake, registering approves the pending handshake
+	go h.myService.RegisterRemoteSKI(ski, "")
+	return true
+}
+
+// forgetAutoAccept allows the SKI to be auto accepted again after it was unregistered
+func (h *hems) forgetAutoAccept(ski string) {
+	h.trust.mu.Lock()
+	delete(h.trust.autoAccepted, shiputil.NormalizeSKI(ski))
+	h.trust.mu.Unlock()
+}
+
+// loadSkiList reads the SKI list file, unchanged files are skipped unless forced.
+// It returns true if a new list was applied.
+func (h *hems) loadSkiList(force bool) (bool, error) {
+	path := h.config.Trust.SkiListFile
+	if path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		h.setSkiListError(err)
+		return false, err
+	}
+
+	h.trust.mu.Lock()
+	unchanged := info.ModTime().Equal(h.trust.listMod)
+	h.trust.mu.Unlock()
+	if unchanged && !force {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		h.setSkiListError(err)
+		return false, err
+	}
+	var list skiList
+	if err := json.Unmarshal(data, &list); err != nil {
+		err = fmt.Errorf("parse %s: %w", path, err)
+		h.setSkiListError(err)
+		return false, err
+	}
+
+	allow := make(map[string]bool, len(list.Allow))
+	for _, ski := range list.Allow {
+		allow[shiputil.NormalizeSKI(ski)] = true
+	}
+	deny := make(map[string]bool, len(list.Deny))
+	for _, ski := range list.Deny {
+		deny[shiputil.NormalizeSKI(ski)] = true
+	}
+
+	h.trust.mu.Lock()
+	h.trust.allow = allow
+	h.trust.deny = deny
+	h.trust.listMod = info.ModTime()
+	h.trust.listLoad = time.Now()
+	h.trust.listError = ""
+	h.trust.mu.Unlock()
+
+	h.Infof("SKI list loaded from %s: %d allowed, %d denied", path, len(allow), len(deny))
+	h.recordEvent("trust", severityInfo, "", "SKI list reloaded", map[string]interface{}{"allow": len(allow), "deny": len(deny)})
+	h.enforceSkiList()
+	return true, nil
+}
+
+func (h *hems) setSkiListError(err error) {
+	h.trust.mu.Lock()
+	changed := h.trust.listError != err.Error()
+	h.trust.listError = err.Error()
+	h.trust.mu.Unlock()
+	if changed {
+		h.Errorf("SKI list: %v", err)
+	}
+}
+
+// watchSkiList reloads the SKI list file whenever it changes
+func (h *hems) watchSkiList() {
+	if h.config.Trust.SkiListFile == "" {
+		return
+	}
+	ticker := time.NewTicker(skiListPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.loadSkiList(false)
+	}
+}
+
+// skiPermitted checks the SKI against the allow and deny lists
+func (h *hems) skiPermitted(ski string) (bool, string) {
+	ski = shiputil.NormalizeSKI(ski)
+	h.trust.mu.Lock()
+	defer h.trust.mu.Unlock()
+
+	if h.trust.deny[ski] {
+		return false, "SKI is on the deny list"
+	}
+	if len(h.trust.allow) > 0 && !h.trust.allow[ski] {
+		return false, "SKI is not on the allow list"
+	}
+	return true, ""
+}
+
+// enforceSkiList disconnects and unpairs known peers that are no longer permitted
+func (h *hems) enforceSkiList() {
+	h.peersMu.Lock()
+	skis := make([]string, 0, len(h.peers))
+	for ski := range h.peers {
+		skis = append(skis, ski)
+	}
+	h.peersMu.Unlock()
+
+	for _, ski := range skis {
+		h.rejectDeniedSKI(ski)
+	}
+}
+
+// rejectDeniedSKI disconnects and unpairs an SKI that is not permitted by the SKI list.
+// It returns true if the SKI was rejected.
+func (h *hems) rejectDeniedSKI(ski string) bool {
+	ok, reason := h.skiPermitted(ski)
+	if ok {
+		return false
+	}
+	detail := h.myService.PairingDetailForSki(ski)
+	if detail == nil {
+		return true
+	}
+	if h.myService.RemoteServiceForSKI(ski).Trusted() || detail.State() != shipapi.ConnectionStateNone {
+		h.Infof("Rejecting %s: %s", ski, reason)
+		h.recordEvent("trust", severityWarning, ski, "connection rejected: "+reason, nil)
+		h.myService.CancelPairingWithSKI(ski)
+		h.myService.UnregisterRemoteSKI(ski)
+		h.forgetAutoAccept(ski)
+		h.forgetShipID(ski)
+	}
+	return true
+}
+
+// trustStatus returns the trust configuration and the loaded SKI list
+func (h *hems) trustStatus() map[string]interface{} {
+	h.trust.mu.Lock()
+	defer h.trust.mu.Unlock()
+
+	keys := func(m map[string]bool) []string {
+		out := make([]string, 0, len(m))
+		for k := range m {
+			out = append(out, k)
+		}
+		sort.Strings(out)
+		return out
+	}
+	status := map[string]interface{}{
+		"autoAccept":  h.config.Trust.AutoAccept,
+		"skiListFile": h.config.Trust.SkiListFile,
+		"allow":       keys(h.trust.allow),
+		"deny":        keys(h.trust.deny),
+		"loadedAt":    optionalTime(h.trust.listLoad),
+		"shipIdFile":  h.config.Trust.shipIDFile(),
+		"shipIds":     h.shipIDList(),
+		"prompt":      h.config.Trust.Prompt,
+	}
+	if h.trust.listError != "" {
+		status["error"] = h.trust.listError
+	}
+	return status
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	shiputil "github.com/enbility/ship-go/util"
+)
+
+// TrustPromptConfig asks the operator to trust SKIs that request a connection
+type TrustPromptConfig struct {
+	// TimeoutSeconds is the time the operator has to decide, defaults to 30
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// Default is applied when the timeout passes: "reject" (default) or "accept"
+	Default string `json:"default,omitempty"`
+}
+
+func (c TrustPromptConfig) timeout() time.Duration {
+	if c.TimeoutSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds * float64(time.Second))
+}
+
+func (c TrustPromptConfig) defaultAccept() bool {
+	return strings.ToLower(c.Default) == "accept"
+}
+
+// trustPromptState is the state of a trust prompt
+type trustPromptState string
+
+const (
+	trustPromptPending  trustPromptState = "pending"
+	trustPromptAccepted trustPromptState = "accepted"
+	trustPromptRejected trustPromptState = "rejected"
+)
+
+// trustPrompt is a pairing request of a not yet trusted SKI waiting for the operator
+type trustPrompt struct {
+	SKI         string           `json:"ski"`
+	State       trustPromptState `json:"state"`
+	RequestedAt time.Time        `json:"requestedAt"`
+	ExpiresAt   time.Time        `json:"expiresAt"`
+	// Default is the decision applied when the prompt expires
+	Default   string     `json:"default"`
+	DecidedBy string     `json:"decidedBy,omitempty"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+	// DecisionSeconds is the time from the request until the decision
+	DecisionSeconds *float64 `json:"decisionSeconds,omitempty"`
+}
+
+// trustPromptStore keeps the last trust prompt per SKI
+type trustPromptStore struct {
+	mu      sync.Mutex
+	prompts map[string]*trustPrompt
+}
+
+func newTrustPromptStore() *trustPromptStore {
+	return &trustPromptStore{prompts: make(map[string]*trustPrompt)}
+}
+
+// promptTrust asks the operator to decide on the pairing request of a SKI, the default
+// decision is applied when the timeout passes. A pending prompt is not repeated.
+func (h *hems) promptTrust(ski string) {
+	if h.config == nil || h.config.Trust.Prompt == nil {
+		return
+	}
+	cfg := h.config.Trust.Prompt
+	ski = shiputil.NormalizeSKI(ski)
+	now := time.Now()
+
+	h.trustPrompts.mu.Lock()
+	if p, ok := h.trustPrompts.prompts[ski]; ok && p.State == trustPromptPending {
+		h.trustPrompts.mu.Unlock()
+		return
+	}
+	p := &trustPrompt{
+		SKI:         ski,
+		State:       trustPromptPending,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(cfg.timeout()),
+		Default:     string(trustPromptRejected),
+	}
+	if cfg.defaultAccept() {
+		p.Default = string(trustPromptAccepted)
+	}
+	h.trustPrompts.prompts[ski] = p
+	snap := *p
+	h.trustPrompts.mu.Unlock()
+
+	h.Infof("Pairing request of %s waits for a decision until %s", ski, formatTimestamp(snap.ExpiresAt))
+	h.recordEvent("trust", severityInfo, ski, fmt.Sprintf("pairing request waits %.0f s for a decision", cfg.timeout().Seconds()), nil)
+	h.broadcastTrustPrompt(snap)
+
+	accept := cfg.defaultAccept()
+	time.AfterFunc(cfg.timeout(), func() {
+		_ = h.decideTrust(ski, accept, "timeout")
+	})
+}
+
+// decideTrust accepts or rejects the pending pairing request of a SKI
+func (h *hems) decideTrust(ski string, accept bool, decidedBy string) error {
+	ski = shiputil.NormalizeSKI(ski)
+	h.trustPrompts.mu.Lock()
+	p, ok := h.trustPrompts.prompts[ski]
+	if !ok {
+		h.trustPrompts.mu.Unlock()
+		return fmt.Errorf("no pairing request of %s", ski)
+	}
+	if p.State != trustPromptPending {
+		h.trustPrompts.mu.Unlock()
+		return fmt.Errorf("pairing request of %s is already %s", ski, p.State)
+	}
+	now := time.Now()
+	decision := now.Sub(p.RequestedAt).Seconds()
+	p.DecidedAt, p.DecidedBy, p.DecisionSeconds = &now, decidedBy, &decision
+	p.State = trustPromptRejected
+	if accept {
+		p.State = trustPromptAccepted
+	}
+	snap := *p
+	h.trustPrompts.mu.Unlock()
+
+	if accept {
+		h.markPairingAction(ski, "accept")
+		h.myService.RegisterRemoteSKI(ski, "")
+	} else {
+		h.markPairingAction(ski, "reject")
+		h.myService.CancelPairingWithSKI(ski)
+	}
+	h.Infof("Pairing request of %s %s by %s after %.1f s", ski, snap.State, decidedBy, decision)
+	h.recordEvent("trust", severityInfo, ski, fmt.Sprintf("pairing request %s by %s after %.1f s", snap.State, decidedBy, decision), nil)
+	h.broadcastTrustPrompt(snap)
+	return nil
+}
+
+// getTrustPrompts returns the last prompt of every SKI, newest first
+func (h *hems) getTrustPrompts() []trustPrompt {
+	h.trustPrompts.mu.Lock()
+	out := make([]trustPrompt, 0, len(h.trustPrompts.prompts))
+	for _, p := range h.trustPrompts.prompts {
+		out = append(out, *p)
+	}
+	h.trustPrompts.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].RequestedAt.After(out[j].RequestedAt) })
+	return out
+}
+
+func (h *hems) broadcastTrustPrompt(p trustPrompt) {
+	h.broadcastJSON(map[string]interface{}{
+		"type":        "trustPrompt",
+		"ski":         p.SKI,
+		"trustPrompt": p,
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+	"github.com/enbility/spine-go/spine"
+)
+
+// usecaseSpec maps a use case display name to the SPINE use case name and the actors
+// the remote side announces it with
+type usecaseSpec struct {
+	Name   model.UseCaseNameType
+	Actors []model.UseCaseActorType
+}
+
+var usecaseSpecs = map[string]usecaseSpec{
+	"CEVC":   {model.UseCaseNameTypeCoordinatedEVCharging, []model.UseCaseActorType{model.UseCaseActorTypeEV}},
+	"EVCEM":  {model.UseCaseNameTypeMeasurementOfElectricityDuringEVCharging, []model.UseCaseActorType{model.UseCaseActorTypeEV}},
+	"EVCC":   {model.UseCaseNameTypeEVCommissioningAndConfiguration, []model.UseCaseActorType{model.UseCaseActorTypeEV}},
+	"EVSECC": {model.UseCaseNameTypeEVSECommissioningAndConfiguration, []model.UseCaseActorType{model.UseCaseActorTypeEVSE}},
+	"EVSOC":  {model.UseCaseNameTypeEVStateOfCharge, []model.UseCaseActorType{model.UseCaseActorTypeEV}},
+	"OPEV":   {model.UseCaseNameTypeOverloadProtectionByEVChargingCurrentCurtailment, []model.UseCaseActorType{model.UseCaseActorTypeEV}},
+	"OSCEV":  {model.UseCaseNameTypeOptimizationOfSelfConsumptionDuringEVCharging, []model.UseCaseActorType{model.UseCaseActorTypeEV}},
+	"LPC":    {model.UseCaseNameTypeLimitationOfPowerConsumption, []model.UseCaseActorType{model.UseCaseActorTypeControllableSystem}},
+	"LPP":    {model.UseCaseNameTypeLimitationOfPowerProduction, []model.UseCaseActorType{model.UseCaseActorTypeControllableSystem}},
+	"CSLPC":  {model.UseCaseNameTypeLimitationOfPowerConsumption, []model.UseCaseActorType{model.UseCaseActorTypeEnergyGuard}},
+	"CSLPP":  {model.UseCaseNameTypeLimitationOfPowerProduction, []model.UseCaseActorType{model.UseCaseActorTypeEnergyGuard}},
+	"MPC":    {model.UseCaseNameTypeMonitoringOfPowerConsumption, []model.UseCaseActorType{model.UseCaseActorTypeMonitoredUnit}},
+	"MGCP":   {model.UseCaseNameTypeMonitoringOfGridConnectionPoint, []model.UseCaseActorType{model.UseCaseActorTypeGridConnectionPoint}},
+}
+
+// usecaseDeclaration is a use case the remote device declares in its node management
+// use case data, with the scenarios it claims to support
+type usecaseDeclaration struct {
+	// Usecase is the display name of the matching local use case, empty if the tester
+	// does not implement the counterpart
+	Usecase     string `json:"usecase,omitempty"`
+	Name        string `json:"name"`
+	Actor       string `json:"actor"`
+	Entity      string `json:"entity"`
+	Version     string `json:"version,omitempty"`
+	SubRevision string `json:"subRevision,omitempty"`
+	Available   *bool  `json:"available,omitempty"`
+	Scenarios   []uint `json:"scenarios"`
+}
+
+func (d usecaseDeclaration) key() string {
+	return d.Actor + "/" + d.Name + "/" + d.Entity
+}
+
+// equal reports whether the declarations announce the same version, availability and scenarios
+func (d usecaseDeclaration) equal(o usecaseDeclaration) bool {
+	return d.Version == o.Version && d.SubRevision == o.SubRevision &&
+		(d.Available == nil) == (o.Available == nil) && (d.Available == nil || *d.Available == *o.Available) &&
+		slices.Equal(d.Scenarios, o.Scenarios)
+}
+
+// usecaseDeclarationChange is a declaration that appeared, changed or disappeared at runtime
+type usecaseDeclarationChange struct {
+	Kind        string              `json:"kind"`
+	Declaration usecaseDeclaration  `json:"declaration"`
+	Previous    *usecaseDeclaration `json:"previous,omitempty"`
+}
+
+// testerUsecase returns the display name of the local use case matching a remote declaration
+func testerUsecase(name model.UseCaseNameType, actor model.UseCaseActorType) string {
+	for display, spec := range usecaseSpecs {
+		if spec.Name == name && slices.Contains(spec.Actors, actor) {
+			return display
+		}
+	}
+	return ""
+}
+
+// declaredUsecases returns the use cases declared by the remote device, sorted by entity
+// and name
+func declaredUsecases(device spineapi.DeviceRemoteInterface) []usecaseDeclaration {
+	out := []usecaseDeclaration{}
+	for _, info := range device.UseCases() {
+		var actor model.UseCaseActorType
+		if info.Actor != nil {
+			actor = *info.Actor
+		}
+		entity := ""
+		if info.Address != nil {
+			parts := make([]string, 0, len(info.Address.Entity))
+			for _, a := range info.Address.Entity {
+				parts = append(parts, fmt.Sprint(a))
+			}
+			entity = strings.Join(parts, ".")
+		}
+		for _, support := range info.UseCaseSupport {
+			if support.UseCaseName == nil {
+				continue
+			}
+			d := usecaseDeclaration{
+				Usecase:   testerUsecase(*support.UseCaseName, actor),
+				Name:      string(*support.UseCaseName),
+				Actor:     string(actor),
+				Entity:    entity,
+				Available: support.UseCaseAvailable,
+				Scenarios: []uint{},
+			}
+			if support.UseCaseVersion != nil {
+				d.Version = string(*support.UseCaseVersion)
+			}
+			if support.UseCaseDocumentSubRevision != nil {
+				d.SubRevision = *support.UseCaseDocumentSubRevision
+			}
+			for _, s := range support.ScenarioSupport {
+				d.Scenarios = append(d.Scenarios, uint(s))
+			}
+			slices.Sort(d.Scenarios)
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Entity != out[j].Entity {
+			return out[i].Entity < out[j].Entity
+		}
+		return out[i].key() < out[j].key()
+	})
+	return out
+}
+
+// updateDeclarations replaces the declarations of the peer and returns the changes
+func (s *usecaseSupportStore) updateDeclarations(current []usecaseDeclaration) []usecaseDeclarationChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes []usecaseDeclarationChange
+	next := make(map[string]usecaseDeclaration, len(current))
+	for _, d := range current {
+		next[d.key()] = d
+		prev, ok := s.declared[d.key()]
+		switch {
+		case !ok:
+			changes = append(changes, usecaseDeclarationChange{Kind: "declared", Declaration: d})
+		case !prev.equal(d):
+			changes = append(changes, usecaseDeclarationChange{Kind: "changed", Declaration: d, Previous: &prev})
+		}
+	}
+	for key, prev := range s.declared {
+		if _, ok := next[key]; !ok {
+			changes = append(changes, usecaseDeclarationChange{Kind: "withdrawn", Declaration: prev})
+		}
+	}
+	s.declared = next
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Declaration.key() < changes[j].Declaration.key() })
+	return changes
+}
+
+// declarations returns the current declarations sorted by entity and name
+func (s *usecaseSupportStore) declarations() []usecaseDeclaration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]usecaseDeclaration, 0, len(s.declared))
+	for _, d := range s.declared {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Entity != out[j].Entity {
+			return out[i].Entity < out[j].Entity
+		}
+		return out[i].key() < out[j].key()
+	})
+	return out
+}
+
+// usecaseDeclarationHandler follows the node management use case data of the remote devices
+type usecaseDeclarationHandler struct {
+	h *hems
+}
+
+func (u usecaseDeclarationHandler) HandleEvent(payload spineapi.EventPayload) {
+	if payload.Device == nil {
+		return
+	}
+	if payload.EventType == spineapi.EventTypeDeviceChange && payload.ChangeType == spineapi.ElementChangeRemove && payload.Entity == nil {
+		// the device disconnected, its declarations are read again on the next connection
+		if peer := u.h.getPeer(payload.Ski); peer != nil {
+			peer.usecases.updateDeclarations(nil)
+		}
+		return
+	}
+	if _, ok := payload.Data.(*model.NodeManagementUseCaseDataType); !ok {
+		return
+	}
+	u.h.updateUsecaseDeclarations(u.h.getOrCreatePeer(payload.Ski), payload.Device)
+}
+
+// setupUsecaseDeclarations subscribes to the SPINE events carrying use case declarations
+func (h *hems) setupUsecaseDeclarations() {
+	_ = spine.Events.Subscribe(usecaseDeclarationHandler{h: h})
+}
+
+// updateUsecaseDeclarations records the declarations of a remote device, changes are
+// recorded as usecase timeline events and broadcast as {"type":"usecaseDeclarations",..}
+func (h *hems) updateUsecaseDeclarations(peer *peerData, device spineapi.DeviceRemoteInterface) {
+	changes := peer.usecases.updateDeclarations(declaredUsecases(device))
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		d := c.Declaration
+		label := d.Name
+		if d.Usecase != "" {
+			label = d.Usecase
+		}
+		data := map[string]interface{}{"name": d.Name, "actor": d.Actor, "entity": d.Entity, "version": d.Version, "scenarios": d.Scenarios}
+		switch c.Kind {
+		case "declared":
+			h.recordEvent("usecase", severityInfo, peer.ski, fmt.Sprintf("%s %s declared by entity %s with scenarios %v", label, d.Version, d.Entity, d.Scenarios), data)
+		case "changed":
+			p := c.Previous
+			data["previousVersion"], data["previousScenarios"] = p.Version, p.Scenarios
+			h.recordEvent("usecase", severityWarning, peer.ski, fmt.Sprintf("%s declaration of entity %s changed from %s %v to %s %v", label, d.Entity, p.Version, p.Scenarios, d.Version, d.Scenarios), data)
+		case "withdrawn":
+			h.recordEvent("usecase", severityWarning, peer.ski, fmt.Sprintf("%s no longer declared by entity %s", label, d.Entity), data)
+		}
+	}
+	h.broadcastJSON(map[string]interface{}{
+		"type":         "usecaseDeclarations",
+		"ski":          peer.ski,
+		"declarations": peer.usecases.declarations(),
+		"changes":      changes,
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+)
+
+// usecaseSupport is the support of a use case by one remote entity
+type usecaseSupport struct {
+	Usecase string `json:"usecase"`
+	// Entity is the address of the remote entity, empty for support restored from a
+	// snapshot or reported by an extension
+	Entity     string `json:"entity,omitempty"`
+	EntityType string `json:"entityType,omitempty"`
+	Scenarios  []uint `json:"scenarios,omitempty"`
+	Supported  bool   `json:"supported"`
+	// DetectedAt is the last time the entity announced the use case
+	DetectedAt time.Time `json:"detectedAt"`
+	// WithdrawnAt is set while the entity no longer announces the use case
+	WithdrawnAt *time.Time `json:"withdrawnAt,omitempty"`
+	Withdrawals int        `json:"withdrawals"`
+	// Version and DeclaredScenarios are taken from the declaration of the entity, the
+	// declared scenarios may differ from the scenarios usable with the entity's features
+	Version           string `json:"version,omitempty"`
+	DeclaredScenarios []uint `json:"declaredScenarios,omitempty"`
+}
+
+// usecaseSupportStore tracks the use case support of the entities of one peer
+type usecaseSupportStore struct {
+	mu      sync.Mutex
+	entries map[string]*usecaseSupport
+	// declared are the use case declarations of the remote device by actor, name and entity
+	declared map[string]usecaseDeclaration
+}
+
+func newUsecaseSupportStore() *usecaseSupportStore {
+	return &usecaseSupportStore{entries: make(map[string]*usecaseSupport), declared: make(map[string]usecaseDeclaration)}
+}
+
+func usecaseSupportKey(name, entity string) string {
+	return name + "/" + entity
+}
+
+// set updates the support of a use case by an entity and returns the entry if the
+// support changed, the caller holds the lock
+func (s *usecaseSupportStore) set(name, entity string, supported bool, now time.Time) (usecaseSupport, bool) {
+	key := usecaseSupportKey(name, entity)
+	e, ok := s.entries[key]
+	if !ok {
+		if !supported {
+			return usecaseSupport{}, false
+		}
+		e = &usecaseSupport{Usecase: name, Entity: entity}
+		s.entries[key] = e
+	}
+	if e.Supported == supported {
+		return usecaseSupport{}, false
+	}
+	e.Supported = supported
+	if supported {
+		e.DetectedAt = now
+		e.WithdrawnAt = nil
+	} else {
+		e.WithdrawnAt = &now
+		e.Withdrawals++
+	}
+	return e.copy(), true
+}
+
+// reconcile applies the remote entities and scenarios eebus-go currently knows for a use
+// case of the peer and returns the entries whose support changed
+func (s *usecaseSupportStore) reconcile(name string, current []api.RemoteEntityScenarios, now time.Time) []usecaseSupport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []usecaseSupport
+	seen := make(map[string]bool)
+	for _, c := range current {
+		if c.Entity == nil || len(c.Scenarios) == 0 {
+			continue
+		}
+		addr := entityAddressString(c.Entity)
+		seen[addr] = true
+		if e, ok := s.set(name, addr, true, now); ok {
+			changed = append(changed, e)
+		}
+		e := s.entries[usecaseSupportKey(name, addr)]
+		e.EntityType = string(c.Entity.EntityType())
+		e.Scenarios = slices.Clone(c.Scenarios)
+	}
+	for key, e := range s.entries {
+		if e.Usecase != name {
+			continue
+		}
+		// live support replaces the entity-less support restored from a snapshot
+		if e.Entity == "" {
+			delete(s.entries, key)
+			continue
+		}
+		if !seen[e.Entity] {
+			if c, ok := s.set(name, e.Entity, false, now); ok {
+				changed = append(changed, c)
+			}
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Entity < changed[j].Entity })
+	return changed
+}
+
+// setSupported sets the entity-less support of a use case and reports whether it changed
+func (s *usecaseSupportStore) setSupported(name string, supported bool, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.set(name, "", supported, now)
+	return ok
+}
+
+// supported reports whether any entity supports the use case
+func (s *usecaseSupportStore) supported(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.Usecase == name && e.Supported {
+			return true
+		}
+	}
+	return false
+}
+
+// flat returns the support per use case name, true if any entity supports it. Names
+// without an entry are reported as unsupported.
+func (s *usecaseSupportStore) flat(names []string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]bool, len(names))
+	for _, name := range names {
+		out[name] = false
+	}
+	for _, e := range s.entries {
+		out[e.Usecase] = out[e.Usecase] || e.Supported
+	}
+	return out
+}
+
+// list returns copies of all entries sorted by use case and entity
+func (s *usecaseSupportStore) list() []usecaseSupport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]usecaseSupport, 0, len(s.entries))
+	for _, e := range s.entries {
+		c := e.copy()
+		for _, d := range s.declared {
+			if d.Usecase == c.Usecase && d.Entity == c.Entity {
+				c.Version, c.DeclaredScenarios = d.Version, slices.Clone(d.Scenarios)
+			}
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Usecase != out[j].Usecase {
+			return out[i].Usecase < out[j].Usecase
+		}
+		return out[i].Entity < out[j].Entity
+	})
+	return out
+}
+
+func (e *usecaseSupport) copy() usecaseSupport {
+	c := *e
+	c.Scenarios = slices.Clone(e.Scenarios)
+	if e.WithdrawnAt != nil {
+		t := *e.WithdrawnAt
+		c.WithdrawnAt = &t
+	}
+	return c
+}
+
+// trackUsecase registers a local use case under its display name, its support is
+// reported per peer and entity. uc is nil for use cases without an implementation.
+func (h *hems) trackUsecase(name string, uc api.UseCaseBaseInterface) {
+	ucMu.Lock()
+	h.trackedUsecases[name] = uc
+	ucMu.Unlock()
+}
+
+// trackedUsecaseNames returns the names of the registered use cases, sorted
+func (h *hems) trackedUsecaseNames() []string {
+	ucMu.Lock()
+	defer ucMu.Unlock()
+	names := make([]string, 0, len(h.trackedUsecases))
+	for name := range h.trackedUsecases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// usecaseSupportOf returns the support per use case of a peer, true if any entity supports it
+func (h *hems) usecaseSupportOf(peer *peerData) map[string]bool {
+	return peer.usecases.flat(h.trackedUsecaseNames())
+}
+
+// updateUsecaseSupport reconciles the entities of the peer supporting a use case after
+// eebus-go reported a use case support update, including withdrawn support
+func (h *hems) updateUsecaseSupport(peer *peerData, name string) {
+	if peer == nil {
+		return
+	}
+	ucMu.Lock()
+	uc := h.trackedUsecases[name]
+	ucMu.Unlock()
+	if uc == nil {
+		return
+	}
+
+	var current []api.RemoteEntityScenarios
+	for _, c := range uc.RemoteEntitiesScenarios() {
+		if c.Entity != nil && c.Entity.Device() != nil && c.Entity.Device().Ski() == peer.ski {
+			current = append(current, c)
+		}
+	}
+	for _, e := range peer.usecases.reconcile(name, current, time.Now()) {
+		if e.Supported {
+			data := map[string]interface{}{"usecase": name, "entity": e.Entity, "scenarios": e.Scenarios}
+			msg := fmt.Sprintf("%s supported by entity %s (%s)", name, e.Entity, e.EntityType)
+			if ms, ok := h.readinessUsecase(peer.ski, name, e.DetectedAt); ok {
+				data["sinceConnectMs"] = ms
+				msg += fmt.Sprintf(" %.0f ms after connecting", ms)
+			}
+			h.recordEvent("usecase", severityInfo, peer.ski, msg, data)
+		} else {
+			h.recordEvent("usecase", severityWarning, peer.ski, fmt.Sprintf("%s withdrawn by entity %s", name, e.Entity),
+				map[string]interface{}{"usecase": name, "entity": e.Entity})
+		}
+		h.broadcastUsecaseSupport(peer, name, &e)
+	}
+}
+
+// setUsecaseSupportedForPeer sets the entity-less support of a use case, used by
+// extensions that report the support themselves
+func (h *hems) setUsecaseSupportedForPeer(peer *peerData, name string, supported bool) {
+	if peer == nil {
+		return
+	}
+	if peer.usecases.setSupported(name, supported, time.Now()) {
+		h.broadcastUsecaseSupport(peer, name, nil)
+	}
+}
+
+// broadcastUsecaseSupport sends {"type":"usecase","name","supported","ski"} with the
+// support of the peer, "support" is the entity entry that changed
+func (h *hems) broadcastUsecaseSupport(peer *peerData, name string, entry *usecaseSupport) {
+	msg := map[string]interface{}{
+		"type":      "usecase",
+		"name":      name,
+		"supported": peer.usecases.supported(name),
+		"ski":       peer.ski,
+	}
+	if entry != nil {
+		msg["support"] = entry
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		h.Errorf("marshal usecase update: %v", err)
+		return
+	}
+	h.broadcastWebsocket(b)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// featureRequirement is a server feature of the remote entity and the functions a
+// scenario reads from it
+type featureRequirement struct {
+	Feature   model.FeatureTypeType
+	Functions []model.FunctionType
+}
+
+var (
+	reqLoadControl = featureRequirement{model.FeatureTypeTypeLoadControl, []model.FunctionType{
+		model.FunctionTypeLoadControlLimitDescriptionListData, model.FunctionTypeLoadControlLimitListData}}
+	reqDeviceConfiguration = featureRequirement{model.FeatureTypeTypeDeviceConfiguration, []model.FunctionType{
+		model.FunctionTypeDeviceConfigurationKeyValueDescriptionListData, model.FunctionTypeDeviceConfigurationKeyValueListData}}
+	reqHeartbeat = featureRequirement{model.FeatureTypeTypeDeviceDiagnosis, []model.FunctionType{
+		model.FunctionTypeDeviceDiagnosisHeartbeatData}}
+	reqDiagnosisState = featureRequirement{model.FeatureTypeTypeDeviceDiagnosis, []model.FunctionType{
+		model.FunctionTypeDeviceDiagnosisStateData}}
+	reqCharacteristics = featureRequirement{model.FeatureTypeTypeElectricalConnection, []model.FunctionType{
+		model.FunctionTypeElectricalConnectionCharacteristicListData}}
+	reqPermittedValues = featureRequirement{model.FeatureTypeTypeElectricalConnection, []model.FunctionType{
+		model.FunctionTypeElectricalConnectionParameterDescriptionListData, model.FunctionTypeElectricalConnectionPermittedValueSetListData}}
+	reqConnectionParameters = featureRequirement{model.FeatureTypeTypeElectricalConnection, []model.FunctionType{
+		model.FunctionTypeElectricalConnectionDescriptionListData, model.FunctionTypeElectricalConnectionParameterDescriptionListData}}
+	reqMeasurement = featureRequirement{model.FeatureTypeTypeMeasurement, []model.FunctionType{
+		model.FunctionTypeMeasurementDescriptionListData, model.FunctionTypeMeasurementListData}}
+	reqTimeSeries = featureRequirement{model.FeatureTypeTypeTimeSeries, []model.FunctionType{
+		model.FunctionTypeTimeSeriesDescriptionListData, model.FunctionTypeTimeSeriesListData}}
+	reqTimeSeriesConstraints = featureRequirement{model.FeatureTypeTypeTimeSeries, []model.FunctionType{
+		model.FunctionTypeTimeSeriesDescriptionListData, model.FunctionTypeTimeSeriesConstraintsListData, model.FunctionTypeTimeSeriesListData}}
+	reqIncentiveTable = featureRequirement{model.FeatureTypeTypeIncentiveTable, []model.FunctionType{
+		model.FunctionTypeIncentiveTableDescriptionData, model.FunctionTypeIncentiveTableConstraintsData, model.FunctionTypeIncentiveTableData}}
+	reqIdentification = featureRequirement{model.FeatureTypeTypeIdentification, []model.FunctionType{
+		model.FunctionTypeIdentificationListData}}
+	reqManufacturer = featureRequirement{model.FeatureTypeTypeDeviceClassification, []model.FunctionType{
+		model.FunctionTypeDeviceClassificationManufacturerData}}
+)
+
+// scenarioRequirements are the server features the remote entity needs per declared
+// scenario, following the scenarios of the eebus-go use cases. Scenarios without an
+// entry need no server feature of the remote, the controllable system use cases are
+// served by the tester itself.
+var scenarioRequirements = map[string]map[uint][]featureRequirement{
+	"LPC":    {1: {reqLoadControl}, 2: {reqDeviceConfiguration}, 3: {reqHeartbeat}, 4: {reqCharacteristics}},
+	"LPP":    {1: {reqLoadControl}, 2: {reqDeviceConfiguration}, 3: {reqHeartbeat}, 4: {reqCharacteristics}},
+	"CEVC":   {1: {reqTimeSeriesConstraints}, 2: {reqTimeSeries}, 3: {reqIncentiveTable}, 4: {reqTimeSeries}},
+	"EVCEM":  {1: {reqConnectionParameters, reqMeasurement}, 2: {reqConnectionParameters, reqMeasurement}, 3: {reqConnectionParameters, reqMeasurement}},
+	"EVCC":   {2: {reqDeviceConfiguration}, 3: {reqDeviceConfiguration}, 4: {reqIdentification}, 5: {reqManufacturer}, 6: {reqPermittedValues}, 7: {reqDiagnosisState}},
+	"EVSECC": {1: {reqManufacturer}, 2: {reqDiagnosisState}},
+	"EVSOC":  {1: {reqMeasurement}},
+	"OPEV":   {1: {reqLoadControl, reqPermittedValues}},
+	"OSCEV":  {1: {reqLoadControl, reqPermittedValues}},
+	"MPC":    {1: {reqConnectionParameters, reqMeasurement}, 2: {reqConnectionParameters, reqMeasurement}, 3: {reqConnectionParameters, reqMeasurement}, 4: {reqConnectionParameters, reqMeasurement}, 5: {reqConnectionParameters, reqMeasurement}},
+	"MGCP":   {1: {reqDeviceConfiguration}, 2: {reqConnectionParameters, reqMeasurement}, 3: {reqConnectionParameters, reqMeasurement}, 4: {reqConnectionParameters, reqMeasurement}, 5: {reqConnectionParameters, reqMeasurement}, 6: {reqConnectionParameters, reqMeasurement}, 7: {reqConnectionParameters, reqMeasurement}},
+}
+
+// scenarioFinding is the validation result of one declared scenario
+type scenarioFinding struct {
+	Usecase    string `json:"usecase"`
+	Entity     string `json:"entity"`
+	EntityType string `json:"entityType,omitempty"`
+	Scenario   uint   `json:"scenario"`
+	Passed     bool   `json:"passed"`
+	// MissingFeatures are server features the entity does not expose
+	MissingFeatures []string `json:"missingFeatures"`
+	// MissingFunctions are functions of exposed features the entity does not support, as
+	// Feature.function
+	MissingFunctions []string `json:"missingFunctions"`
+	Message          string   `json:"message,omitempty"`
+}
+
+// usecaseValidation is the required feature validation of the declared use cases of a peer
+type usecaseValidation struct {
+	SKI      string            `json:"ski"`
+	Passed   bool              `json:"passed"`
+	Findings []scenarioFinding `json:"findings"`
+}
+
+// validateUsecaseFeatures checks the declared scenarios of the use cases the tester
+// implements against the server features and functions of the declaring entities
+func (h *hems) validateUsecaseFeatures(peer *peerData) usecaseValidation {
+	res := usecaseValidation{SKI: peer.ski, Passed: true, Findings: []scenarioFinding{}}
+	entities := make(map[string]spineapi.EntityRemoteInterface)
+	for _, e := range peer.entities.snapshot().Entities {
+		entities[entityAddressString(e)] = e
+	}
+
+	for _, d := range peer.usecases.declarations() {
+		reqs, ok := scenarioRequirements[d.Usecase]
+		if !ok {
+			continue
+		}
+		entity := entities[d.Entity]
+		// EVSEs may declare EV use cases with their own address, as eebus-go does the
+		// EV sub entity is checked then
+		if d.Actor == string(model.UseCaseActorTypeEV) && entity != nil && entity.EntityType() != model.EntityTypeTypeEV {
+			if ev, ok := entities[d.Entity+".1"]; ok {
+				entity = ev
+			}
+		}
+		for _, scenario := range d.Scenarios {
+			f := scenarioFinding{Usecase: d.Usecase, Entity: d.Entity, Scenario: scenario, Passed: true,
+				MissingFeatures: []string{}, MissingFunctions: []string{}}
+			if entity == nil {
+				f.Passed = false
+				f.Message = fmt.Sprintf("entity %s is not part of the detailed discovery", d.Entity)
+			} else {
+				f.Entity, f.EntityType = entityAddressString(entity), string(entity.EntityType())
+				checkScenarioFeatures(entity, reqs[scenario], &f)
+			}
+			res.Passed = res.Passed && f.Passed
+			res.Findings = append(res.Findings, f)
+		}
+	}
+	return res
+}
+
+// checkScenarioFeatures lists the required server features and functions the entity lacks
+func checkScenarioFeatures(entity spineapi.EntityRemoteInterface, reqs []featureRequirement, f *scenarioFinding) {
+	for _, req := range reqs {
+		feature := entity.FeatureOfTypeAndRole(req.Feature, model.RoleTypeServer)
+		if feature == nil {
+			if !slices.Contains(f.MissingFeatures, string(req.Feature)) {
+				f.MissingFeatures = append(f.MissingFeatures, string(req.Feature))
+			}
+			continue
+		}
+		ops := feature.Operations()
+		for _, fn := range req.Functions {
+			name := string(req.Feature) + "." + string(fn)
+			if _, ok := ops[fn]; !ok && !slices.Contains(f.MissingFunctions, name) {
+				f.MissingFunctions = append(f.MissingFunctions, name)
+			}
+		}
+	}
+	f.Passed = len(f.MissingFeatures) == 0 && len(f.MissingFunctions) == 0
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WatchdogConfig configures the detection and recovery of a wedged SHIP/SPINE service
+type WatchdogConfig struct {
+	// Enabled starts the watchdog, it is off by default
+	Enabled bool `json:"enabled,omitempty"`
+	// IntervalSeconds is the check interval, defaults to 30
+	IntervalSeconds int `json:"intervalSeconds,omitempty"`
+	// SilenceSeconds is the time a connected peer may send no SPINE message, defaults to 300
+	SilenceSeconds int `json:"silenceSeconds,omitempty"`
+	// HandshakeSeconds is the time a SHIP handshake may take, defaults to 120. Handshakes
+	// waiting for trust in the hello phase are not flagged.
+	HandshakeSeconds int `json:"handshakeSeconds,omitempty"`
+	// MinRestartSeconds is the minimum time between two service restarts, defaults to 600
+	MinRestartSeconds int `json:"minRestartSeconds,omitempty"`
+}
+
+func (c WatchdogConfig) interval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+func (c WatchdogConfig) silence() time.Duration {
+	if c.SilenceSeconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.SilenceSeconds) * time.Second
+}
+
+func (c WatchdogConfig) handshake() time.Duration {
+	if c.HandshakeSeconds <= 0 {
+		return 2 * time.Minute
+	}
+	return time.Duration(c.HandshakeSeconds) * time.Second
+}
+
+func (c WatchdogConfig) minRestart() time.Duration {
+	if c.MinRestartSeconds <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.MinRestartSeconds) * time.Second
+}
+
+// watchdogRecovery is a recovery action taken by the watchdog
+type watchdogRecovery struct {
+	Time   time.Time `json:"time"`
+	SKI    string    `json:"ski,omitempty"`
+	Reason string    `json:"reason"`
+	// Action is "disconnect" for a single peer or "restart" for the whole service
+	Action string `json:"action"`
+}
+
+// maxWatchdogRecoveries limits the recoveries kept for the API
+const maxWatchdogRecoveries = 100
+
+// watchdogState tracks the connected peers and the recoveries
+type watchdogState struct {
+	mu             sync.Mutex
+	connectedSince map[string]time.Time
+	// recovered are the peers disconnected by the watchdog, a peer wedged again after
+	// its reconnect escalates to a service restart
+	recovered   map[string]time.Time
+	lastRestart time.Time
+	lastCheck   time.Time
+	recoveries  []watchdogRecovery
+}
+
+// runWatchdog checks the service periodically while the watchdog is enabled
+func (h *hems) runWatchdog() {
+	cfg := h.config.Watchdog
+	if !cfg.Enabled {
+		return
+	}
+	h.watchdog.mu.Lock()
+	h.watchdog.connectedSince = make(map[string]time.Time)
+	h.watchdog.recovered = make(map[string]time.Time)
+	h.watchdog.mu.Unlock()
+	h.Infof("watchdog started (silence %s, handshake %s)", cfg.silence(), cfg.handshake())
+
+	ticker := time.NewTicker(cfg.interval())
+	defer ticker.Stop()
+	for range ticker.C {
+		h.checkWatchdog(cfg, time.Now())
+	}
+}
+
+// checkWatchdog detects silent peers, stuck handshakes and a stopped service
+func (h *hems) checkWatchdog(cfg WatchdogConfig, now time.Time) {
+	type finding struct{ ski, reason string }
+	var found []finding
+
+	if !h.myService.IsRunning() {
+		found = append(found, finding{"", "EEBUS service is not running"})
+	}
+
+	h.watchdog.mu.Lock()
+	h.watchdog.lastCheck = now
+	peers := h.getAllPeers()
+	for ski, peer := range peers {
+		if !peer.connected {
+			delete(h.watchdog.connectedSince, ski)
+			continue
+		}
+		if _, ok := h.watchdog.connectedSince[ski]; !ok {
+			h.watchdog.connectedSince[ski] = now
+		}
+	}
+	connectedSince := make(map[string]time.Time, len(h.watchdog.connectedSince))
+	for ski, since := range h.watchdog.connectedSince {
+		connectedSince[ski] = since
+	}
+	h.watchdog.mu.Unlock()
+
+	for ski, since := range connectedSince {
+		last := since
+		if dgs := h.getDatagrams(datagramFilter{SKI: ski, Direction: datagramReceived, Limit: 1}); len(dgs) > 0 && dgs[0].Time.After(last) {
+			last = dgs[0].Time
+		}
+		if silent := now.Sub(last); silent > cfg.silence() {
+			found = append(found, finding{ski, fmt.Sprintf("no SPINE message received for %s", silent.Round(time.Second))})
+		}
+	}
+
+	h.handshakes.mu.Lock()
+	for ski, run := range h.handshakes.active {
+		if len(run.Phases) == 0 {
+			continue
+		}
+		phase := run.Phases[len(run.Phases)-1].Name
+		if phase == phaseHello {
+			continue
+		}
+		if d := now.Sub(run.StartedAt); d > cfg.handshake() {
+			found = append(found, finding{ski, fmt.Sprintf("SHIP handshake stuck in phase %s for %s", phase, d.Round(time.Second))})
+		}
+	}
+	h.handshakes.mu.Unlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ski < found[j].ski })
+	restart := ""
+	for _, f := range found {
+		if f.ski == "" {
+			restart = f.reason
+			continue
+		}
+		h.watchdog.mu.Lock()
+		_, again := h.watchdog.recovered[f.ski]
+		h.watchdog.mu.Unlock()
+		if again {
+			restart = fmt.Sprintf("%s still wedged after a reconnect: %s", f.ski, f.reason)
+			continue
+		}
+		h.recoverPeer(f.ski, f.reason, now)
+	}
+	if restart != "" {
+		h.restartService(cfg, restart, now)
+	}
+
+	// peers that were disconnected and are connected and talking again are recovered
+	h.watchdog.mu.Lock()
+	for ski := range h.watchdog.recovered {
+		wedged := false
+		for _, f := range found {
+			wedged = wedged || f.ski == ski
+		}
+		if peer, ok := peers[ski]; !wedged && ok && peer.connected && now.Sub(h.watchdog.recovered[ski]) > cfg.silence() {
+			delete(h.watchdog.recovered, ski)
+		}
+	}
+	h.watchdog.mu.Unlock()
+}
+
+// recoverPeer closes the connection of a wedged peer, ship-go connects again
+func (h *hems) recoverPeer(ski, reason string, now time.Time) {
+	h.Errorf("watchdog: %s: %s, reconnecting", ski, reason)
+	h.watchdog.mu.Lock()
+	h.watchdog.recovered[ski] = now
+	delete(h.watchdog.connectedSince, ski)
+	h.watchdog.mu.Unlock()
+
+	h.handshakes.mu.Lock()
+	var aborted *handshakeRun
+	if run, ok := h.handshakes.active[ski]; ok {
+		run.State = "failed"
+		run.Error = "aborted by the watchdog: " + reason
+		aborted = h.finishHandshake(run, now)
+	}
+	h.handshakes.mu.Unlock()
+	if aborted != nil {
+		h.recordEvent("handshake", severityWarning, ski, "SHIP handshake failed: "+aborted.Error, handshakeEventData(aborted))
+	}
+
+	h.myService.DisconnectSKI(ski, "watchdog: "+reason)
+	h.addWatchdogRecovery(watchdogRecovery{Time: now, SKI: ski, Reason: reason, Action: "disconnect"})
+}
+
+// restartService shuts the EEBUS service down and starts it again, at most once per
+// minRestartSeconds
+func (h *hems) restartService(cfg WatchdogConfig, reason string, now time.Time) {
+	h.watchdog.mu.Lock()
+	if !h.watchdog.lastRestart.IsZero() && now.Sub(h.watchdog.lastRestart) < cfg.minRestart() {
+		h.watchdog.mu.Unlock()
+		h.Debugf("watchdog: restart skipped, last restart at %s: %s", formatTimestamp(h.watchdog.lastRestart), reason)
+		return
+	}
+	h.watchdog.lastRestart = now
+	h.watchdog.recovered = make(map[string]time.Time)
+	h.watchdog.connectedSince = make(map[string]time.Time)
+	h.watchdog.mu.Unlock()
+
+	h.Errorf("watchdog: %s, restarting the EEBUS service", reason)
+	h.handshakes.mu.Lock()
+	var aborted []*handshakeRun
+	for _, run := range h.handshakes.active {
+		run.State = "failed"
+		run.Error = "aborted by the watchdog restart"
+		aborted = append(aborted, h.finishHandshake(run, now))
+	}
+	h.handshakes.mu.Unlock()
+	for _, run := range aborted {
+		h.recordEvent("handshake", severityWarning, run.SKI, "SHIP handshake failed: "+run.Error, handshakeEventData(run))
+	}
+
+	h.myService.Shutdown()
+	time.Sleep(time.Second)
+	h.myService.Start()
+	h.addWatchdogRecovery(watchdogRecovery{Time: now, Reason: reason, Action: "restart"})
+}
+
+func (h *hems) addWatchdogRecovery(r watchdogRecovery) {
+	h.watchdog.mu.Lock()
+	h.watchdog.recoveries = append(h.watchdog.recoveries, r)
+	if len(h.watchdog.recoveries) > maxWatchdogRecoveries {
+		h.watchdog.recoveries = h.watchdog.recoveries[len(h.watchdog.recoveries)-maxWatchdogRecoveries:]
+	}
+	h.watchdog.mu.Unlock()
+
+	msg := fmt.Sprintf("watchdog recovery (%s): %s", r.Action, r.Reason)
+	h.recordEvent("watchdog", severityError, r.SKI, msg, map[string]interface{}{"action": r.Action, "reason": r.Reason})
+	h.broadcastJSON(map[string]interface{}{"type": "watchdog", "ski": r.SKI, "recovery": r})
+}
+
+// watchdogStatus returns the watchdog settings and the recoveries, newest first
+func (h *hems) watchdogStatus() map[string]interface{} {
+	h.watchdog.mu.Lock()
+	defer h.watchdog.mu.Unlock()
+	recoveries := make([]watchdogRecovery, 0, len(h.watchdog.recoveries))
+	for i := len(h.watchdog.recoveries) - 1; i >= 0; i-- {
+		recoveries = append(recoveries, h.watchdog.recoveries[i])
+	}
+	return map[string]interface{}{
+		"enabled":     h.config.Watchdog.Enabled,
+		"config":      h.config.Watchdog,
+		"lastCheck":   optionalTime(h.watchdog.lastCheck),
+		"lastRestart": optionalTime(h.watchdog.lastRestart),
+		"recoveries":  recoveries,
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	shiputil "github.com/enbility/ship-go/util"
+	"github.com/enbility/spine-go/model"
+)
+
+// writeCommandExec returns the write of a validated /api/write payload
+func (h *hems) writeCommandExec(cmd string, payload map[string]interface{}) (func() ([]sentMessage, error), error) {
+	var exec func() ([]sentMessage, error)
+	// the write goes to the entities of this DUT, to all connected DUTs without it
+	ski, _ := payload["ski"].(string)
+	switch cmd {
+	case "writeLPCConsumptionLimit":
+		// expect: durationSeconds (int), value (float), isActive (bool)
+		var durSec int64
+		var val float64
+		var isActive bool
+		if d, ok := payload["durationSeconds"].(float64); ok {
+			durSec = int64(d)
+		}
+		if v, ok := payload["value"].(float64); ok {
+			val = v
+		}
+		if a, ok := payload["isActive"].(bool); ok {
+			isActive = a
+		}
+		exec = func() ([]sentMessage, error) {
+			return h.WriteLPCConsumptionLimit(ski, durSec, val, isActive)
+		}
+	case "writeLPCFailsafeDuration":
+		// expect: durationMinutes (int)
+		var minutes int64
+		if d, ok := payload["durationMinutes"].(float64); ok {
+			minutes = int64(d)
+		}
+		minDuration := time.Duration(minutes) * time.Minute
+		exec = func() ([]sentMessage, error) {
+			return h.WriteLPCFailsafeDuration(ski, minDuration)
+		}
+	case "writeLPCFailsafeValue":
+		// expect: failsafePower (float)
+		var limit float64
+		if l, ok := payload["failsafePower"].(float64); ok {
+			limit = l
+		}
+		exec = func() ([]sentMessage, error) {
+			return h.WriteLPCFailsafeValue(ski, limit)
+		}
+	case "writeLPPProductionLimit":
+		// expect: durationSeconds (int), value (float), isActive (bool)
+		var durSec int64
+		var val float64
+		var isActive bool
+		if d, ok := payload["durationSeconds"].(float64); ok {
+			durSec = int64(d)
+		}
+		if v, ok := payload["value"].(float64); ok {
+			val = v
+		}
+		if a, ok := payload["isActive"].(bool); ok {
+			isActive = a
+		}
+		exec = func() ([]sentMessage, error) {
+			return h.WriteLPPProductionLimit(ski, durSec, val, isActive)
+		}
+	case "writeLPPFailsafeDuration":
+		// expect: durationMinutes (int)
+		var minutes int64
+		if d, ok := payload["durationMinutes"].(float64); ok {
+			minutes = int64(d)
+		}
+		minDuration := time.Duration(minutes) * time.Minute
+		exec = func() ([]sentMessage, error) {
+			return h.WriteLPPFailsafeDuration(ski, minDuration)
+		}
+	case "writeLPPFailsafeValue":
+		// expect: failsafePower (float)
+		var limit float64
+		if l, ok := payload["failsafePower"].(float64); ok {
+			limit = l
+		}
+		exec = func() ([]sentMessage, error) {
+			return h.WriteLPPFailsafeValue(ski, limit)
+		}
+	case "writeOSCEVLoadControlLimits":
+		// Simple interface: accept value and isActive, build limits array for all phases
+		value, ok := payload["value"].(float64)
+		if !ok {
+			return nil, errors.New("value must be a number")
+		}
+		isActive, ok := payload["isActive"].(bool)
+		if !ok {
+			isActive = true // default to active
+		}
+		// Build limits for all three phases
+		limits := []ucapi.LoadLimitsPhase{
+			{Phase: model.ElectricalConnectionPhaseNameTypeA, Value: value, IsActive: isActive},
+			{Phase: model.ElectricalConnectionPhaseNameTypeB, Value: value, IsActive: isActive},
+			{Phase: model.ElectricalConnectionPhaseNameTypeC, Value: value, IsActive: isActive},
+		}
+		exec = func() ([]sentMessage, error) {
+			return h.WriteOSCEVLoadControlLimits(ski, limits)
+		}
+	case "writeOPEVLoadControlLimits":
+		// Simple interface: accept value and isActive, build limits array for all phases
+		value, ok := payload["value"].(float64)
+		if !ok {
+			return nil, errors.New("value must be a number")
+		}
+		isActive, ok := payload["isActive"].(bool)
+		if !ok {
+			isActive = true // default to active
+		}
+		// Build limits for all three phases
+		limits := []ucapi.LoadLimitsPhase{
+			{Phase: model.ElectricalConnectionPhaseNameTypeA, Value: value, IsActive: isActive},
+			{Phase: model.ElectricalConnectionPhaseNameTypeB, Value: value, IsActive: isActive},
+			{Phase: model.ElectricalConnectionPhaseNameTypeC, Value: value, IsActive: isActive},
+		}
+		exec = func() ([]sentMessage, error) {
+			return h.WriteOPEVLoadControlLimits(ski, limits)
+		}
+	default:
+		return nil, fmt.Errorf("unknown command %s", cmd)
+	}
+
+	return exec, nil
+}
+
+// writeCommandSuccessor is the v1 resource replacing a command of the deprecated /api/write
+var writeCommandSuccessor = map[string]string{
+	"writeLPCConsumptionLimit":    "/api/v1/usecases/lpc/limit",
+	"writeLPCFailsafeValue":       "/api/v1/usecases/lpc/failsafe",
+	"writeLPCFailsafeDuration":    "/api/v1/usecases/lpc/failsafe",
+	"writeLPPProductionLimit":     "/api/v1/usecases/lpp/limit",
+	"writeLPPFailsafeValue":       "/api/v1/usecases/lpp/failsafe",
+	"writeLPPFailsafeDuration":    "/api/v1/usecases/lpp/failsafe",
+	"writeOSCEVLoadControlLimits": "/api/v1/usecases/oscev/limits",
+	"writeOPEVLoadControlLimits":  "/api/v1/usecases/opev/limits",
+}
+
+// v1LimitRequest is the body of PUT /api/v1/usecases/{lpc,lpp}/limit
+type v1LimitRequest struct {
+	SKI string `json:"ski,omitempty"`
+	// Value is the active power limit in W
+	Value float64 `json:"value"`
+	// DurationSeconds is the limit duration, 0 for an indefinite limit
+	DurationSeconds int64        `json:"durationSeconds,omitempty"`
+	IsActive        bool         `json:"isActive"`
+	Retry           *RetryConfig `json:"retry,omitempty"`
+}
+
+// v1FailsafeRequest is the body of PUT /api/v1/usecases/{lpc,lpp}/failsafe, each set
+// field is written as its own command
+type v1FailsafeRequest struct {
+	SKI string `json:"ski,omitempty"`
+	// Value is the failsafe active power limit in W
+	Value           *float64     `json:"value,omitempty"`
+	DurationMinutes *int64       `json:"durationMinutes,omitempty"`
+	Retry           *RetryConfig `json:"retry,omitempty"`
+}
+
+// v1PhaseLimitsRequest is the body of PUT /api/v1/usecases/{oscev,opev}/limits
+type v1PhaseLimitsRequest struct {
+	SKI string `json:"ski,omitempty"`
+	// Value is the current limit in A, written to all three phases
+	Value float64 `json:"value"`
+	// IsActive defaults to true
+	IsActive *bool        `json:"isActive,omitempty"`
+	Retry    *RetryConfig `json:"retry,omitempty"`
+}
+
+// v1WriteResponse is the response of all v1 write resources
+type v1WriteResponse struct {
+	Commands []commandResult `json:"commands"`
+}
+
+// v1Write is a command a v1 request is translated to
+type v1Write struct {
+	cmd     string
+	payload map[string]interface{}
+}
+
+// v1Resource is a write resource of a use case
+type v1Resource struct {
+	schema *jsonSchema
+	// writes converts the validated body, it returns the commands to queue
+	writes func(body []byte) ([]v1Write, error)
+}
+
+// writePayload returns the command payload of a v1 write, in the format of /api/write
+func writePayload(cmd, ski string, retry *RetryConfig, fields map[string]interface{}) v1Write {
+	payload := map[string]interface{}{"cmd": cmd}
+	if ski != "" {
+		payload["ski"] = ski
+	}
+	if retry != nil {
+		payload["retry"] = retry
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	return v1Write{cmd: cmd, payload: payload}
+}
+
+// v1Resources are the write resources by path below /api/v1/usecases/
+var v1Resources = func() map[string]v1Resource {
+	limit := func(uc, cmd string) v1Resource {
+		return v1Resource{
+			schema: payloadSchema("PUT /api/v1/usecases/"+uc+"/limit", writeSchemas[cmd].Description, []string{"value", "isActive"}, map[string]*jsonSchema{
+				"value":           {Type: "number", Minimum: schemaBound(0), Description: "limit in W"},
+				"durationSeconds": {Type: "integer", Minimum: schemaBound(0), Description: "limit duration in seconds, 0 or omitted for an indefinite limit (the time period is deleted on the DUT)"},
+				"isActive":        {Type: "boolean", Description: "activates the limit"},
+			}),
+			writes: func(body []byte) ([]v1Write, error) {
+				var req v1LimitRequest
+				if err := json.Unmarshal(body, &req); err != nil {
+					return nil, err
+				}
+				return []v1Write{writePayload(cmd, req.SKI, req.Retry, map[string]interface{}{
+					"value": req.Value, "durationSeconds": float64(req.DurationSeconds), "isActive": req.IsActive,
+				})}, nil
+			},
+		}
+	}
+	failsafe := func(uc, valueCmd, durationCmd string) v1Resource {
+		return v1Resource{
+			schema: payloadSchema("PUT /api/v1/usecases/"+uc+"/failsafe", "failsafe limit and duration minimum, at least one is required", nil, map[string]*jsonSchema{
+				"value":           {Type: "number", Minimum: schemaBound(0), Description: "failsafe limit in W"},
+				"durationMinutes": {Type: "integer", Minimum: schemaBound(0), Description: "failsafe duration minimum in minutes"},
+			}),
+			writes: func(body []byte) ([]v1Write, error) {
+				var req v1FailsafeRequest
+				if err := json.Unmarshal(body, &req); err != nil {
+					return nil, err
+				}
+				var writes []v1Write
+				if req.Value != nil {
+					writes = append(writes, writePayload(valueCmd, req.SKI, req.Retry, map[string]interface{}{"failsafePower": *req.Value}))
+				}
+				if req.DurationMinutes != nil {
+					writes = append(writes, writePayload(durationCmd, req.SKI, req.Retry, map[string]interface{}{"durationMinutes": float64(*req.DurationMinutes)}))
+				}
+				if len(writes) == 0 {
+					return nil, errors.New("value or durationMinutes required")
+				}
+				return writes, nil
+			},
+		}
+	}
+	phaseLimits := func(uc, cmd string) v1Resource {
+		return v1Resource{
+			schema: payloadSchema("PUT /api/v1/usecases/"+uc+"/limits", writeSchemas[cmd].Description, []string{"value"}, map[string]*jsonSchema{
+				"value":    {Type: "number", Minimum: schemaBound(0), Description: "current limit in A, written to all phases"},
+				"isActive": {Type: "boolean", Description: "activates the limits, defaults to true"},
+			}),
+			writes: func(body []byte) ([]v1Write, error) {
+				var req v1PhaseLimitsRequest
+				if err := json.Unmarshal(body, &req); err != nil {
+					return nil, err
+				}
+				isActive := true
+				if req.IsActive != nil {
+					isActive = *req.IsActive
+				}
+				return []v1Write{writePayload(cmd, req.SKI, req.Retry, map[string]interface{}{"value": req.Value, "isActive": isActive})}, nil
+			},
+		}
+	}
+	return map[string]v1Resource{
+		"lpc/limit":    limit("lpc", "writeLPCConsumptionLimit"),
+		"lpc/failsafe": failsafe("lpc", "writeLPCFailsafeValue", "writeLPCFailsafeDuration"),
+		"lpp/limit":    limit("lpp", "writeLPPProductionLimit"),
+		"lpp/failsafe": failsafe("lpp", "writeLPPFailsafeValue", "writeLPPFailsafeDuration"),
+		"oscev/limits": phaseLimits("oscev", "writeOSCEVLoadControlLimits"),
+		"opev/limits":  phaseLimits("opev", "writeOPEVLoadControlLimits"),
+	}
+}()
+
+// registerWriteAPI registers the v1 write resources
+func (h *hems) registerWriteAPI() {
+	http.HandleFunc("PUT /api/v1/usecases/{usecase}/{resource}", h.requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		res, ok := v1Resources[r.PathValue("usecase")+"/"+r.PathValue("resource")]
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "unknown write resource")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		var raw interface{}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, "invalid json")
+			return
+		}
+		if fields := res.schema.validate("", raw); len(fields) > 0 {
+			writeAPIFieldErrors(w, fields)
+			return
+		}
+		writes, err := res.writes(body)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		if !h.writeTargetConnected(writes[0].payload) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotFound, "the DUT is not connected")
+			return
+		}
+
+		commands := make([]*command, 0, len(writes))
+		for _, wr := range writes {
+			c, err := h.enqueueWrite(wr)
+			if err != nil {
+				if len(commands) == 0 {
+					writeAPIError(w, http.StatusServiceUnavailable, errCodeUnavailable, err.Error())
+					return
+				}
+				// the commands queued so far are reported, the remaining ones are dropped
+				h.Errorf("%s: %v", r.URL.Path, err)
+				break
+			}
+			commands = append(commands, c)
+		}
+		h.writeCommandsResponse(w, r, commands)
+	}))
+
+	// endpoint: JSON schemas of the v1 write resources
+	http.HandleFunc("GET /api/v1/schema", h.requireRole(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		schemas := make(map[string]*jsonSchema, len(v1Resources))
+		for path, res := range v1Resources {
+			schemas["PUT /api/v1/usecases/"+path] = res.schema
+		}
+		if err := json.NewEncoder(w).Encode(schemas); err != nil {
+			h.Errorf("encode v1 schemas: %v", err)
+		}
+	}))
+}
+
+// writeTargetConnected reports whether the DUT a write payload names is connected, a
+// payload without ski writes to all connected DUTs
+func (h *hems) writeTargetConnected(payload map[string]interface{}) bool {
+	ski, _ := payload["ski"].(string)
+	if ski == "" {
+		return true
+	}
+	return h.dutConnected(shiputil.NormalizeSKI(ski))
+}
+
+// enqueueWrite queues the command of a v1 write
+func (h *hems) enqueueWrite(wr v1Write) (*command, error) {
+	exec, err := h.writeCommandExec(wr.cmd, wr.payload)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := h.retryPolicy(wr.payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry policy: %w", err)
+	}
+	return h.enqueueCommand(wr.cmd, wr.payload, retry, exec)
+}
+
+// writeCommandsResponse answers a v1 write, the status is the one of the worst command
+func (h *hems) writeCommandsResponse(w http.ResponseWriter, r *http.Request, commands []*command) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !waitForCommands(r, commands...) {
+		return
+	}
+	resp := v1WriteResponse{Commands: make([]commandResult, 0, len(commands))}
+	status := http.StatusOK
+	for _, c := range commands {
+		snap, _ := h.getCommand(c.ID)
+		resp.Commands = append(resp.Commands, newCommandResult(snap))
+		// failures outrank pending commands, pending commands outrank acknowledged ones
+		if s := commandHTTPStatus(snap.State); s >= http.StatusBadRequest || (s == http.StatusAccepted && status == http.StatusOK) {
+			status = s
+		}
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		h.Errorf("encode commands: %v", err)
+	}
+}
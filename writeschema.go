@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) used to describe and
+// validate API payloads
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Const                interface{}            `json:"const,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+// apiFieldError is a validation error of a single payload field
+type apiFieldError struct {
+	// Field is the JSON path of the field, e.g. retry.maxRetries
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// validate checks a decoded JSON value against the schema
+func (s *jsonSchema) validate(path string, v interface{}) []apiFieldError {
+	field := path
+	if field == "" {
+		field = "(payload)"
+	}
+	fail := func(format string, args ...interface{}) []apiFieldError {
+		return []apiFieldError{{Field: field, Error: fmt.Sprintf(format, args...)}}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("must be an object")
+		}
+		return s.validateObject(path, obj)
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fail("must be an array")
+		}
+		var errs []apiFieldError
+		for i, item := range arr {
+			if s.Items != nil {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+		return errs
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if s.Const != nil && str != s.Const {
+			return fail("must be %q", s.Const)
+		}
+		if len(s.Enum) > 0 && !enumContains(s.Enum, str) {
+			return fail("must be one of %s", enumList(s.Enum))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be true or false")
+		}
+	case "number", "integer":
+		n, ok := v.(float64)
+		if !ok {
+			return fail("must be a number")
+		}
+		if s.Type == "integer" && n != math.Trunc(n) {
+			return fail("must be a whole number")
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fail("must be at least %g", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fail("must be at most %g", *s.Maximum)
+		}
+		if len(s.Enum) > 0 && !enumContains(s.Enum, n) {
+			return fail("must be one of %s", enumList(s.Enum))
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(path string, obj map[string]interface{}) []apiFieldError {
+	prefix := ""
+	if path != "" {
+		prefix = path + "."
+	}
+	var errs []apiFieldError
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			errs = append(errs, apiFieldError{Field: prefix + name, Error: "is required"})
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, known := s.Properties[name]
+		if !known {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				msg := "is not a known field"
+				if similar := s.similarProperty(name); similar != "" {
+					msg += fmt.Sprintf(", did you mean %q?", similar)
+				}
+				errs = append(errs, apiFieldError{Field: prefix + name, Error: msg})
+			}
+			continue
+		}
+		errs = append(errs, prop.validate(prefix+name, obj[name])...)
+	}
+	return errs
+}
+
+// similarProperty returns the property a misspelled field most likely meant, e.g.
+// durationSeconds for duration_seconds or durationseconds
+func (s *jsonSchema) similarProperty(name string) string {
+	normalize := func(n string) string {
+		return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(n))
+	}
+	want := normalize(name)
+	for prop := range s.Properties {
+		if normalize(prop) == want {
+			return prop
+		}
+	}
+	return ""
+}
+
+func enumContains(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	parts := make([]string, 0, len(enum))
+	for _, e := range enum {
+		parts = append(parts, fmt.Sprintf("%v", e))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func schemaBound(v float64) *float64 {
+	return &v
+}
+
+// retrySchema describes the retry object of write payloads (RetryConfig)
+func retrySchema() *jsonSchema {
+	states := []interface{}{}
+	for _, st := range []commandState{commandRejected, commandTimedOut, commandFailed} {
+		states = append(states, string(st))
+	}
+	closed := false
+	return &jsonSchema{
+		Type:        "object",
+		Description: "overrides the configured retry policy for this command",
+		Properties: map[string]*jsonSchema{
+			"maxRetries":          {Type: "integer", Minimum: schemaBound(0), Description: "retries after the first attempt, 0 disables retries"},
+			"backoffMs":           {Type: "integer", Minimum: schemaBound(0), Description: "delay before the first retry"},
+			"backoffFactor":       {Type: "number", Minimum: schemaBound(0), Description: "multiplies the delay for every further retry"},
+			"retryOn":             {Type: "array", Items: &jsonSchema{Type: "string", Enum: states}},
+			"abortOnErrorNumbers": {Type: "array", Items: &jsonSchema{Type: "integer", Minimum: schemaBound(0)}},
+		},
+		AdditionalProperties: &closed,
+	}
+}
+
+// payloadSchema returns the schema of a write payload with the fields common to all writes
+func payloadSchema(title, description string, required []string, fields map[string]*jsonSchema) *jsonSchema {
+	props := map[string]*jsonSchema{
+		"ski":   {Type: "string", Description: "SKI of the DUT to write to, all connected DUTs if omitted"},
+		"retry": retrySchema(),
+	}
+	for name, field := range fields {
+		props[name] = field
+	}
+	closed := false
+	return &jsonSchema{
+		Schema:               "https://json-schema.org/draft/2020-12/schema",
+		Title:                title,
+		Description:          description,
+		Type:                 "object",
+		Properties:           props,
+		Required:             required,
+		AdditionalProperties: &closed,
+	}
+}
+
+// writeCommandSchema returns the schema of a write command with its specific fields
+func writeCommandSchema(cmd, description string, required []string, fields map[string]*jsonSchema) *jsonSchema {
+	s := payloadSchema(cmd, description, append([]string{"cmd"}, required...), fields)
+	s.Properties["cmd"] = &jsonSchema{Type: "string", Const: cmd}
+	return s
+}
+
+// writeSchemas are the payload schemas of all /api/write commands
+var writeSchemas = func() map[string]*jsonSchema {
+	limit := func(cmd, description string) *jsonSchema {
+		return writeCommandSchema(cmd, description, []string{"value"}, map[string]*jsonSchema{
+			"value":           {Type: "number", Minimum: schemaBound(0), Description: "limit in W"},
+			"durationSeconds": {Type: "integer", Minimum: schemaBound(0), Description: "limit duration in seconds, 0 or omitted for an indefinite limit (the time period is deleted on the DUT)"},
+			"isActive":        {Type: "boolean", Description: "activates the limit, defaults to false"},
+		})
+	}
+	failsafeValue := func(cmd, description string) *jsonSchema {
+		return writeCommandSchema(cmd, description, []string{"failsafePower"}, map[string]*jsonSchema{
+			"failsafePower": {Type: "number", Minimum: schemaBound(0), Description: "failsafe limit in W"},
+		})
+	}
+	failsafeDuration := func(cmd, description string) *jsonSchema {
+		return writeCommandSchema(cmd, description, []string{"durationMinutes"}, map[string]*jsonSchema{
+			"durationMinutes": {Type: "integer", Minimum: schemaBound(0), Description: "failsafe duration minimum in minutes"},
+		})
+	}
+	phaseLimits := func(cmd, description string) *jsonSchema {
+		return writeCommandSchema(cmd, description, []string{"value"}, map[string]*jsonSchema{
+			"value":    {Type: "number", Minimum: schemaBound(0), Description: "current limit in A, written to all phases"},
+			"isActive": {Type: "boolean", Description: "activates the limits, defaults to true"},
+		})
+	}
+	return map[string]*jsonSchema{
+		"writeLPCConsumptionLimit":    limit("writeLPCConsumptionLimit", "LPC active power consumption limit"),
+		"writeLPCFailsafeValue":       failsafeValue("writeLPCFailsafeValue", "LPC failsafe consumption active power limit"),
+		"writeLPCFailsafeDuration":    failsafeDuration("writeLPCFailsafeDuration", "LPC failsafe duration minimum"),
+		"writeLPPProductionLimit":     limit("writeLPPProductionLimit", "LPP active power production limit"),
+		"writeLPPFailsafeValue":       failsafeValue("writeLPPFailsafeValue", "LPP failsafe production active power limit"),
+		"writeLPPFailsafeDuration":    failsafeDuration("writeLPPFailsafeDuration", "LPP failsafe duration minimum"),
+		"writeOSCEVLoadControlLimits": phaseLimits("writeOSCEVLoadControlLimits", "OSCEV recommended charging current limits"),
+		"writeOPEVLoadControlLimits":  phaseLimits("writeOPEVLoadControlLimits", "OPEV obligated charging current limits"),
+	}
+}()
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultWebsocketQueueSize is the number of messages buffered per websocket client
+const defaultWebsocketQueueSize = 1024
+
+// wsWriteTimeout is the time a single websocket write may take before the client is dropped
+const wsWriteTimeout = 10 * time.Second
+
+// defaultWebsocketCoalesce is the window in which repeated snapshots of the same kind are merged
+const defaultWebsocketCoalesce = 200 * time.Millisecond
+
+// WebsocketConfig configures the websocket transport
+type WebsocketConfig struct {
+	// Compression enables permessage-deflate for clients that offer it
+	Compression bool `json:"compression,omitempty"`
+	// CompressionLevel is the flate level 1 (fastest) to 9 (smallest), defaults to 1
+	CompressionLevel int `json:"compressionLevel,omitempty"`
+	// CoalesceMs is the window in which entity and peer list snapshots are merged,
+	// only the last snapshot is sent. Defaults to 200, negative disables coalescing.
+	CoalesceMs int `json:"coalesceMs,omitempty"`
+}
+
+func (c WebsocketConfig) compressionLevel() int {
+	if c.CompressionLevel < 1 || c.CompressionLevel > 9 {
+		return 1
+	}
+	return c.CompressionLevel
+}
+
+func (c WebsocketConfig) coalesceWindow() time.Duration {
+	switch {
+	case c.CoalesceMs < 0:
+		return 0
+	case c.CoalesceMs == 0:
+		return defaultWebsocketCoalesce
+	}
+	return time.Duration(c.CoalesceMs) * time.Millisecond
+}
+
+// wsCoalescer keeps the latest pending snapshot per key until its window elapsed
+type wsCoalescer struct {
+	mu      sync.Mutex
+	pending map[string][]byte
+}
+
+// Websocket subprotocols, clients without a subprotocol get JSON text messages
+const (
+	wsProtocolJSON    = "json"
+	wsProtocolMsgpack = "msgpack"
+)
+
+// wsSubprotocols are offered to clients in order of preference
+var wsSubprotocols = []string{wsProtocolJSON, wsProtocolMsgpack}
+
+// Websocket message schemas, selected with ?schema= when connecting
+const (
+	// wsSchemaLegacy sends log lines as raw text and every other message as its own JSON object
+	wsSchemaLegacy = "legacy"
+	// wsSchemaEnvelope wraps all messages into a wsEnvelope
+	wsSchemaEnvelope = "envelope"
+)
+
+// wsEnvelope is the common frame of all messages of the envelope schema
+type wsEnvelope struct {
+	// Type is the type of the legacy message, "log" for log lines
+	Type string `json:"type"`
+	// Seq increases by one per broadcast, a gap means the client missed messages.
+	// The snapshot sent after connecting has no sequence numbers.
+	Seq      uint64          `json:"seq,omitempty"`
+	Time     string          `json:"time"`
+	SKI      string          `json:"ski,omitempty"`
+	Snapshot bool            `json:"snapshot,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// wsLogPayload is the payload of a log line in the envelope schema
+type wsLogPayload struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Line    string `json:"line"`
+}
+
+// wsMessage is a message in the legacy form and, when envelope clients are connected,
+// the envelope, so both are encoded once per broadcast
+type wsMessage struct {
+	legacy   []byte
+	envelope []byte
+}
+
+// wsSchemaState numbers the broadcasts, the number is taken under wsMu so the clients
+// receive the messages in sequence order
+type wsSchemaState struct {
+	seq atomic.Uint64
+}
+
+// wrapWebsocketMessage builds the envelope of a legacy message. The type and ski of a
+// JSON message move into the envelope, the other fields are the payload.
+func wrapWebsocketMessage(b []byte, seq uint64, snapshot bool) []byte {
+	env := wsEnvelope{Seq: seq, Time: formatTimestamp(time.Now()), Snapshot: snapshot}
+	var fields map[string]json.RawMessage
+	if bytes.HasPrefix(b, []byte("{")) && json.Unmarshal(b, &fields) == nil {
+		_ = json.Unmarshal(fields["type"], &env.Type)
+		_ = json.Unmarshal(fields["ski"], &env.SKI)
+		delete(fields, "type")
+		delete(fields, "ski")
+		env.Payload, _ = json.Marshal(fields)
+	} else {
+		// log lines are "<timestamp> <level> <ski> <message>", see hems.print
+		line := string(b)
+		parts := strings.SplitN(line, " ", 4)
+		env.Type = "log"
+		p := wsLogPayload{Line: line, Message: line}
+		if len(parts) == 4 {
+			if t, err := time.Parse(timestampLayout, parts[0]); err == nil {
+				env.Time = formatTimestamp(t)
+			}
+			p.Level, env.SKI, p.Message = parts[1], parts[2], parts[3]
+		}
+		env.Payload, _ = json.Marshal(p)
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		return b
+	}
+	return out
+}
+
+// Policies for websocket clients whose send queue is full
+const (
+	// wsPolicyDisconnect closes the connection, the browser UI reconnects and gets a fresh snapshot
+	wsPolicyDisconnect = "disconnect"
+	// wsPolicyDrop discards the messages that do not fit into the queue
+	wsPolicyDrop = "drop"
+)
+
+func (c LimitsConfig) websocketQueueSize() int {
+	if c.WebsocketQueueSize <= 0 {
+		return defaultWebsocketQueueSize
+	}
+	return c.WebsocketQueueSize
+}
+
+func (c LimitsConfig) slowWebsocketPolicy() string {
+	if c.SlowWebsocketPolicy == wsPolicyDrop {
+		return wsPolicyDrop
+	}
+	return wsPolicyDisconnect
+}
+
+// wsClient is a websocket connection with its own send queue and writer goroutine,
+// so a slow client does not block logging and event processing
+type wsClient struct {
+	conn *websocket.Conn
+	// msgpack clients get binary MessagePack frames instead of JSON text
+	msgpack bool
+	// envelope clients get all messages wrapped into a wsEnvelope
+	envelope bool
+	send     chan wsMessage
+	closed   chan struct{}
+	once     sync.Once
+	dropped  atomic.Uint64
+}
+
+// close closes the connection once, the writer goroutine exits
+func (c *wsClient) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// write sends a message in the schema and encoding negotiated by the client. Only the
+// writer goroutine or the handler before the writer started may call it.
+func (c *wsClient) write(m wsMessage) error {
+	b := m.legacy
+	if c.envelope {
+		b = m.envelope
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if !c.msgpack {
+		return c.conn.WriteMessage(websocket.TextMessage, b)
+	}
+	packed, err := jsonToMsgpack(b)
+	if err != nil {
+		// not representable, skip the message but keep the client
+		fmt.Printf("websocket msgpack encoding: %v\n", err)
+		return nil
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, packed)
+}
+
+// writeSnapshot sends a message of the initial snapshot, before the writer started
+func (c *wsClient) writeSnapshot(b []byte) error {
+	m := wsMessage{legacy: b}
+	if c.envelope {
+		m.envelope = wrapWebsocketMessage(b, 0, true)
+	}
+	return c.write(m)
+}
+
+// registerWebsocket adds a connection to the broadcast set. The writer goroutine is
+// started by startWebsocketWriter, until then messages are only queued so the caller
+// can write an initial snapshot directly.
+func (h *hems) registerWebsocket(conn *websocket.Conn, schema string) *wsClient {
+	size := defaultWebsocketQueueSize
+	if h.config != nil {
+		size = h.config.Limits.websocketQueueSize()
+	}
+	if h.config != nil && h.config.Websocket.Compression {
+		conn.EnableWriteCompression(true)
+		_ = conn.SetCompressionLevel(h.config.Websocket.compressionLevel())
+	}
+	c := &wsClient{
+		conn:     conn,
+		msgpack:  conn.Subprotocol() == wsProtocolMsgpack,
+		envelope: schema == wsSchemaEnvelope,
+		send:     make(chan wsMessage, size),
+		closed:   make(chan struct{}),
+	}
+	h.wsMu.Lock()
+	h.wsConns[c] = struct{}{}
+	h.wsMu.Unlock()
+	return c
+}
+
+// unregisterWebsocket removes a connection from the broadcast set and closes it
+func (h *hems) unregisterWebsocket(c *wsClient) {
+	h.wsMu.Lock()
+	delete(h.wsConns, c)
+	h.wsMu.Unlock()
+	c.close()
+}
+
+// startWebsocketWriter writes the queued messages of a client until it is closed
+func (h *hems) startWebsocketWriter(c *wsClient) {
+	go func() {
+		for {
+			select {
+			case m := <-c.send:
+				if err := c.write(m); err != nil {
+					h.unregisterWebsocket(c)
+					return
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+}
+
+// broadcastWebsocket queues a message for all websocket clients without blocking.
+// Clients with a full queue are handled by the configured slow client policy.
+func (h *hems) broadcastWebsocket(b []byte) {
+	policy := wsPolicyDisconnect
+	if h.config != nil {
+		policy = h.config.Limits.slowWebsocketPolicy()
+	}
+	m := wsMessage{legacy: b}
+
+	var slow []*wsClient
+	h.wsMu.Lock()
+	seq := h.wsSchema.seq.Add(1)
+	for c := range h.wsConns {
+		if c.envelope && m.envelope == nil {
+			// built once for the first envelope client of the broadcast
+			m.envelope = wrapWebsocketMessage(b, seq, false)
+		}
+		select {
+		case c.send <- m:
+		default:
+			if policy == wsPolicyDrop {
+				c.dropped.Add(1)
+				continue
+			}
+			delete(h.wsConns, c)
+			slow = append(slow, c)
+		}
+	}
+	h.wsMu.Unlock()
+
+	// not logged via appendLog, it would broadcast again
+	for _, c := range slow {
+		fmt.Printf("websocket client %s too slow, disconnecting\n", c.conn.RemoteAddr())
+		c.close()
+	}
+}
+
+// broadcastCoalesced broadcasts a snapshot that supersedes earlier ones with the same key.
+// Within the coalesce window only the latest snapshot is sent, so bursts of events
+// do not re-send the full entity JSON for every single update.
+func (h *hems) broadcastCoalesced(key string, b []byte) {
+	window := defaultWebsocketCoalesce
+	if h.config != nil {
+		window = h.config.Websocket.coalesceWindow()
+	}
+	if window <= 0 {
+		h.broadcastWebsocket(b)
+		return
+	}
+
+	h.wsCoalesce.mu.Lock()
+	if h.wsCoalesce.pending == nil {
+		h.wsCoalesce.pending = make(map[string][]byte)
+	}
+	_, scheduled := h.wsCoalesce.pending[key]
+	h.wsCoalesce.pending[key] = b
+	h.wsCoalesce.mu.Unlock()
+	if scheduled {
+		return
+	}
+
+	time.AfterFunc(window, func() {
+		h.wsCoalesce.mu.Lock()
+		latest := h.wsCoalesce.pending[key]
+		delete(h.wsCoalesce.pending, key)
+		h.wsCoalesce.mu.Unlock()
+		h.broadcastWebsocket(latest)
+	})
+}
+
+// websocketStats returns the connected clients with their queue usage
+func (h *hems) websocketStats() []map[string]interface{} {
+	h.wsMu.Lock()
+	defer h.wsMu.Unlock()
+	out := make([]map[string]interface{}, 0, len(h.wsConns))
+	for c := range h.wsConns {
+		out = append(out, map[string]interface{}{
+			"remote":   c.conn.RemoteAddr().String(),
+			"msgpack":  c.msgpack,
+			"envelope": c.envelope,
+			"queued":   len(c.send),
+			"queue":    cap(c.send),
+			"dropped":  c.dropped.Load(),
+		})
+	}
+	return out
+}